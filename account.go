@@ -69,6 +69,10 @@ func (am *ACMEIssuer) loadAccount(ctx context.Context, ca, email string) (acme.A
 	if err != nil {
 		return acct, err
 	}
+	keyBytes, err = am.config.decryptKeyPEM(ctx, keyBytes)
+	if err != nil {
+		return acct, err
+	}
 	acct.PrivateKey, err = PEMDecodePrivateKey(keyBytes)
 	if err != nil {
 		return acct, fmt.Errorf("could not decode account's private key: %v", err)
@@ -103,6 +107,9 @@ func (am *ACMEIssuer) GetAccount(ctx context.Context, privateKeyPEM []byte) (acm
 		}
 	} else {
 		keyBytes, err := am.config.Storage.Load(ctx, am.storageKeyUserPrivateKey(am.CA, email))
+		if err == nil {
+			keyBytes, err = am.config.decryptKeyPEM(ctx, keyBytes)
+		}
 		if err == nil && bytes.Equal(bytes.TrimSpace(keyBytes), bytes.TrimSpace(privateKeyPEM)) {
 			return am.loadAccount(ctx, am.CA, email)
 		}
@@ -126,6 +133,9 @@ func (am *ACMEIssuer) loadAccountByKey(ctx context.Context, privateKeyPEM []byte
 			// for we will try to save it again after confirming with the ACME server.
 			continue
 		}
+		if keyBytes, err = am.config.decryptKeyPEM(ctx, keyBytes); err != nil {
+			continue
+		}
 		if bytes.Equal(bytes.TrimSpace(keyBytes), bytes.TrimSpace(privateKeyPEM)) {
 			// Found the account with the correct private key, try loading it. If this fails we we will follow
 			// the same procedure as if the private key was not found and confirm with the ACME server before saving
@@ -176,6 +186,10 @@ func (am *ACMEIssuer) saveAccount(ctx context.Context, ca string, account acme.A
 	if err != nil {
 		return err
 	}
+	keyBytes, err = am.config.encryptKeyPEM(ctx, keyBytes)
+	if err != nil {
+		return err
+	}
 	// extract primary contact (email), without scheme (e.g. "mailto:")
 	primaryContact := getPrimaryContact(account)
 	all := []keyValue{
@@ -319,7 +333,14 @@ func (am *ACMEIssuer) storageKeyCAPrefix(caURL string) string {
 }
 
 func (am *ACMEIssuer) storageKeyUsersPrefix(caURL string) string {
-	return path.Join(am.storageKeyCAPrefix(caURL), "users")
+	prefix := am.storageKeyCAPrefix(caURL)
+	if am.externalAccountName != "" {
+		prefix = am.storageKeyExternalAccountPrefix(caURL)
+	}
+	if am.poolAccount > 0 {
+		prefix = am.storageKeyPoolAccountPrefix(prefix)
+	}
+	return path.Join(prefix, "users")
 }
 
 func (am *ACMEIssuer) storageKeyUserPrefix(caURL, email string) string {
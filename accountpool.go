@@ -0,0 +1,159 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// ACMEAccountPool spreads the orders of an ACMEIssuer across several
+// ACME accounts, to stay within per-account rate limits of the CA (like
+// Let's Encrypt's limit of new orders per account) in very large, e.g.
+// on-demand, deployments.
+//
+// The first account of the pool is the issuer's default account, so an
+// existing account stays in use. The others are registered as they are
+// first needed, with the same email address and EAB credential (so the
+// CA must allow a credential to be bound to several accounts), and are
+// stored separately. Their keys are generated; AccountKeyPEM is only
+// used for the default account. Certificates are revoked with the
+// account that obtained them.
+//
+// Do not share a pool between issuers.
+//
+// EXPERIMENTAL: Subject to change.
+type ACMEAccountPool struct {
+	// The number of accounts. A pool of fewer than 2
+	// accounts is just the default account.
+	Size int
+
+	// How to choose the account for an order. Default:
+	// AccountPoolRoundRobin.
+	Policy AccountPoolPolicy
+
+	next atomic.Uint64
+}
+
+// AccountPoolPolicy is how an ACMEAccountPool chooses accounts.
+type AccountPoolPolicy string
+
+// Account pool policies.
+const (
+	// AccountPoolRoundRobin uses the accounts in turn,
+	// which spreads orders most evenly.
+	AccountPoolRoundRobin AccountPoolPolicy = "round_robin"
+
+	// AccountPoolHashByName chooses the account by a hash
+	// of the names of the certificate, so a certificate is
+	// always renewed with the account that obtained it.
+	// Prefer this if the CA requires ARI replacements to
+	// be ordered by the same account.
+	AccountPoolHashByName AccountPoolPolicy = "hash_by_name"
+)
+
+// choose returns the index of the account to order a certificate for
+// names with.
+func (pool *ACMEAccountPool) choose(names []string) int {
+	if pool.Policy == AccountPoolHashByName {
+		names = slices.Clone(names)
+		for i := range names {
+			names[i] = strings.ToLower(names[i])
+		}
+		slices.Sort(names)
+		h := fnv.New32a()
+		h.Write([]byte(strings.Join(names, ",")))
+		return int(h.Sum32() % uint32(pool.Size))
+	}
+	return int((pool.next.Add(1) - 1) % uint64(pool.Size))
+}
+
+// usesAccountPool returns true if am has several accounts to choose from.
+func (am *ACMEIssuer) usesAccountPool() bool {
+	return am.AccountPool != nil && am.AccountPool.Size > 1
+}
+
+// forPoolAccount returns the issuer to order a certificate for names
+// with, which is am using the account of the pool that is chosen for
+// names, if am has an account pool.
+func (am *ACMEIssuer) forPoolAccount(names []string) *ACMEIssuer {
+	if !am.usesAccountPool() {
+		return am
+	}
+	i := am.AccountPool.choose(names)
+	am.Logger.Debug("using pooled ACME account",
+		zap.Strings("identifiers", names),
+		zap.Int("account", i),
+		zap.Int("pool_size", am.AccountPool.Size))
+	return am.poolAccountAt(i)
+}
+
+// poolAccountAt returns am using the account of its pool at index i;
+// index 0 is the default account.
+func (am *ACMEIssuer) poolAccountAt(i int) *ACMEIssuer {
+	if i == 0 {
+		return am
+	}
+	// like for external accounts, the copy shares the mutex
+	// of am, which is all right, since it is only used for
+	// this operation
+	iss := *am
+	iss.AccountKeyPEM = "" // the configured key is for the default account
+	iss.poolAccount = i
+	return &iss
+}
+
+// forRevocation returns the issuer to revoke cert with, which is am
+// using the account of its pool that obtained cert, if am has an
+// account pool.
+func (am *ACMEIssuer) forRevocation(ctx context.Context, cert CertificateResource) *ACMEIssuer {
+	if !am.usesAccountPool() {
+		return am
+	}
+	var acmeCert acme.Certificate
+	if len(cert.IssuerData) > 0 && json.Unmarshal(cert.IssuerData, &acmeCert) == nil && acmeCert.Account != "" {
+		ca := acmeCert.CA
+		if ca == "" {
+			ca = am.CA
+		}
+		for i := range am.AccountPool.Size {
+			iss := am.poolAccountAt(i)
+			account, err := iss.loadAccount(ctx, ca, iss.getEmail())
+			if err == nil && account.Location == acmeCert.Account {
+				return iss
+			}
+		}
+		am.Logger.Warn("account that obtained certificate is not in the account pool; revoking with chosen account",
+			zap.Strings("identifiers", cert.SANs),
+			zap.String("account", acmeCert.Account))
+	}
+	return am.forPoolAccount(cert.SANs)
+}
+
+// storageKeyPoolAccountPrefix returns the prefix of the storage keys
+// for the users of the pool account, under the given prefix for the
+// users of the default account.
+func (am *ACMEIssuer) storageKeyPoolAccountPrefix(prefix string) string {
+	return path.Join(prefix, "account_pool", strconv.Itoa(am.poolAccount))
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/rveen/certmagic"
+	"github.com/rveen/certmagic/certmagictest"
+)
+
+func TestACMEAccountPool(t *testing.T) {
+	for _, policy := range []certmagic.AccountPoolPolicy{certmagic.AccountPoolRoundRobin, certmagic.AccountPoolHashByName} {
+		t.Run(string(policy), func(t *testing.T) {
+			ca := certmagictest.NewACMEServer(t, certmagictest.ACMEServerOptions{})
+			h := certmagictest.New(t, certmagictest.Options{
+				CA:     ca,
+				Issuer: certmagic.ACMEIssuer{AccountPool: &certmagic.ACMEAccountPool{Size: 3, Policy: policy}},
+			})
+
+			names := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com", "f.example.com"}
+			for _, name := range names {
+				h.Obtain(name)
+			}
+			keys, err := h.Storage.List(t.Context(), "acme", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var accounts int
+			for _, key := range keys {
+				if strings.Contains(key, "/users/") && strings.HasSuffix(key, ".key") {
+					accounts++
+				}
+			}
+			if accounts < 2 || accounts > 3 {
+				t.Errorf("Expected orders to be spread across the pool's accounts, got %d accounts: %v", accounts, keys)
+			}
+
+			// the CA only lets the account that ordered a certificate revoke it
+			for _, name := range names {
+				h.Revoke(name, acme.ReasonSuperseded)
+			}
+			for _, cert := range ca.Issued() {
+				if _, ok := ca.RevocationReason(cert); !ok {
+					t.Errorf("Expected certificate for %v to be revoked", cert.DNSNames)
+				}
+			}
+		})
+	}
+}
@@ -84,6 +84,12 @@ func (iss *ACMEIssuer) newACMEClientWithAccount(ctx context.Context, useTestCA,
 
 		// synchronize this so the account is only created once
 		acctLockKey := accountRegLockKey(account)
+		if iss.externalAccountName != "" {
+			acctLockKey += "_" + StorageKeys.Safe(iss.externalAccountName)
+		}
+		if iss.poolAccount > 0 {
+			acctLockKey += "_pool_" + strconv.Itoa(iss.poolAccount)
+		}
 		err = acquireLock(ctx, iss.config.Storage, acctLockKey)
 		if err != nil {
 			return nil, fmt.Errorf("locking account registration: %v", err)
@@ -143,8 +149,8 @@ func (iss *ACMEIssuer) newACMEClientWithAccount(ctx context.Context, useTestCA,
 			account.TermsOfServiceAgreed = iss.isAgreed()
 
 			// associate account with external binding, if configured
-			if iss.ExternalAccount != nil {
-				err := account.SetExternalAccountBinding(ctx, client.Client, *iss.ExternalAccount)
+			if eab := iss.externalAccount(); eab != nil {
+				err := account.SetExternalAccountBinding(ctx, client.Client, *eab)
 				if err != nil {
 					return nil, err
 				}
@@ -205,32 +211,14 @@ func (iss *ACMEIssuer) newACMEClient(useTestCA bool) (*acmez.Client, error) {
 	// exclusive of other ones because it is usually only used
 	// in situations where the default challenges would fail)
 	if iss.DNS01Solver == nil {
-		// enable HTTP-01 challenge
-		if !iss.DisableHTTPChallenge {
-			client.ChallengeSolvers[acme.ChallengeTypeHTTP01] = distributedSolver{
-				storage:                iss.config.Storage,
-				storageKeyIssuerPrefix: iss.storageKeyCAPrefix(client.Directory),
-				solver: &httpSolver{
-					handler: iss.HTTPChallengeHandler(http.NewServeMux()),
-					address: net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getHTTPPort())),
-				},
-			}
-		}
-
-		// enable TLS-ALPN-01 challenge
-		if !iss.DisableTLSALPNChallenge {
-			client.ChallengeSolvers[acme.ChallengeTypeTLSALPN01] = distributedSolver{
-				storage:                iss.config.Storage,
-				storageKeyIssuerPrefix: iss.storageKeyCAPrefix(client.Directory),
-				solver: &tlsALPNSolver{
-					config:  iss.config,
-					address: net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getTLSALPNPort())),
-				},
-			}
-		}
+		iss.enableHTTPAndTLSALPNChallenges(client)
 	} else {
-		// use DNS challenge exclusively
+		// use DNS challenge exclusively, unless the challenge policy
+		// says to try others too
 		client.ChallengeSolvers[acme.ChallengeTypeDNS01] = iss.DNS01Solver
+		if iss.ChallengePolicy != nil && iss.ChallengePolicy.enablesNonDNSChallenges() {
+			iss.enableHTTPAndTLSALPNChallenges(client)
+		}
 	}
 
 	// wrap solvers in our wrapper so that we can keep track of challenge
@@ -248,13 +236,74 @@ func (iss *ACMEIssuer) newACMEClient(useTestCA bool) (*acmez.Client, error) {
 	// do not know about each other
 	// (doing this here in a separate loop ensures that even if we expose
 	// solver config to users later, we will even wrap their own solvers)
-	for name, solver := range client.ChallengeSolvers {
-		client.ChallengeSolvers[name] = solverWrapper{solver}
-	}
+	wrapChallengeSolvers(client)
 
 	return client, nil
 }
 
+// enableHTTPAndTLSALPNChallenges adds solvers for the HTTP-01 and
+// TLS-ALPN-01 challenges to client, unless they are disabled.
+func (iss *ACMEIssuer) enableHTTPAndTLSALPNChallenges(client *acmez.Client) {
+	// enable HTTP-01 challenge
+	if !iss.DisableHTTPChallenge {
+		var solver acmez.Solver = &httpSolver{
+			handler: iss.HTTPChallengeHandler(http.NewServeMux()),
+			address: net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getHTTPPort())),
+		}
+		if iss.HTTP01Solver != nil {
+			solver = iss.HTTP01Solver
+		}
+		client.ChallengeSolvers[acme.ChallengeTypeHTTP01] = distributedSolver{
+			storage:                iss.config.Storage,
+			storageKeyIssuerPrefix: iss.storageKeyCAPrefix(client.Directory),
+			solver:                 iss.withClusterSolver(solver),
+		}
+	}
+
+	// enable TLS-ALPN-01 challenge
+	if !iss.DisableTLSALPNChallenge {
+		client.ChallengeSolvers[acme.ChallengeTypeTLSALPN01] = distributedSolver{
+			storage:                iss.config.Storage,
+			storageKeyIssuerPrefix: iss.storageKeyCAPrefix(client.Directory),
+			solver: iss.withClusterSolver(&tlsALPNSolver{
+				config:  iss.config,
+				address: net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getTLSALPNPort())),
+			}),
+		}
+	}
+}
+
+// withClusterSolver wraps solver so that it shares its challenges
+// with the ClusterSolver of iss, if there is one.
+func (iss *ACMEIssuer) withClusterSolver(solver acmez.Solver) acmez.Solver {
+	if iss.ClusterSolver == nil {
+		return solver
+	}
+	return clusterSolver{solver: solver, cluster: iss.ClusterSolver, logger: iss.Logger}
+}
+
+// useIPChallenges reconfigures the challenge solvers of client for an
+// order for IP addresses only: the DNS challenge can't validate those
+// (RFC 8738 section 7), so if it is configured, it is replaced with
+// the HTTP and TLS-ALPN challenges.
+func (iss *ACMEIssuer) useIPChallenges(client *acmez.Client) {
+	if iss.DNS01Solver == nil {
+		return
+	}
+	client.ChallengeSolvers = make(map[string]acmez.Solver)
+	iss.enableHTTPAndTLSALPNChallenges(client)
+	wrapChallengeSolvers(client)
+}
+
+// wrapChallengeSolvers wraps the solvers of client with solverWrapper.
+func wrapChallengeSolvers(client *acmez.Client) {
+	for name, solver := range client.ChallengeSolvers {
+		if _, ok := solver.(solverWrapper); !ok {
+			client.ChallengeSolvers[name] = solverWrapper{solver}
+		}
+	}
+}
+
 // newBasicACMEClient sets up a basically-functional ACME client that is not capable
 // of solving challenges but can provide basic interactions with the server.
 func (iss *ACMEIssuer) newBasicACMEClient() (*acmez.Client, error) {
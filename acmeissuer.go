@@ -15,14 +15,17 @@
 package certmagic
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -68,9 +71,26 @@ type ACMEIssuer struct {
 	Agreed bool
 
 	// An optional external account to associate
-	// with this ACME account
+	// with this ACME account; to change it while
+	// the issuer is in use, use RotateExternalAccount
 	ExternalAccount *acme.EAB
 
+	// Optionally select the external account, and
+	// the EAB credential for it, by the names of
+	// the certificate, e.g. by tenant, instead of
+	// using ExternalAccount for all certificates.
+	// A zero-value credential selects the default.
+	//
+	// (EXPERIMENTAL: Subject to change.)
+	ExternalAccountFunc func(ctx context.Context, names []string) (ExternalAccountCredential, error)
+
+	// Optionally spread orders across a pool of
+	// ACME accounts, e.g. to stay within per-account
+	// rate limits in very large deployments.
+	//
+	// (EXPERIMENTAL: Subject to change.)
+	AccountPool *ACMEAccountPool
+
 	// Optionally select an ACME profile offered
 	// by the ACME server. The list of supported
 	// profile names can be obtained from the ACME
@@ -80,6 +100,19 @@ type ACMEIssuer struct {
 	// (EXPERIMENTAL: Subject to change.)
 	Profile string
 
+	// Optionally select ACME profiles for specific
+	// names instead of Profile, keyed by name or
+	// wildcard pattern (e.g. "*.example.com"); an
+	// empty profile selects the CA's default. If a
+	// certificate has multiple names, the first one
+	// with an override decides. If the CA does not
+	// offer the selected profile, its default
+	// profile is used and an event is emitted.
+	// Use Profiles to discover which are offered.
+	//
+	// (EXPERIMENTAL: Subject to change.)
+	ProfileOverrides map[string]string
+
 	// Optionally specify the validity period of
 	// the certificate(s) here as offsets from the
 	// approximate time of certificate issuance,
@@ -115,11 +148,44 @@ type ACMEIssuer struct {
 	// from this package
 	DNS01Solver acmez.Solver
 
+	// The solver for the http-01 challenge; by
+	// default, a server is started on ListenHost
+	// and the HTTP challenge port if that port is
+	// free. Usually this is an HTTP01Solver value
+	// from this package, for when the challenge
+	// requests are forwarded to another address.
+	// (EXPERIMENTAL: Subject to change)
+	HTTP01Solver acmez.Solver
+
+	// Optionally, a way to share the HTTP-01 and
+	// TLS-ALPN-01 challenges this issuer solves
+	// with other instances that don't share its
+	// storage, so that they can answer them too.
+	// (EXPERIMENTAL: Subject to change)
+	ClusterSolver ClusterSolver
+
+	// Optionally, which challenge types to try in
+	// which order, and how to retry failed attempts.
+	// (EXPERIMENTAL: Subject to change)
+	ChallengePolicy *ChallengePolicy
+
+	// Optionally, limits on orders to enforce before
+	// placing them, to stay within the CA's limits.
+	// (EXPERIMENTAL: Subject to change)
+	RateLimits *ACMERateLimits
+
 	// TrustedRoots specifies a pool of root CA
 	// certificates to trust when communicating
 	// over a network to a peer.
 	TrustedRoots *x509.CertPool
 
+	// Optionally, TLS settings for connections to the
+	// ACME server, like client certificates for private
+	// ACME servers that require mutual TLS. If set,
+	// TrustedRoots overrides its RootCAs.
+	// (EXPERIMENTAL: Subject to change)
+	ClientTLS *tls.Config
+
 	// The maximum amount of time to allow for
 	// obtaining a certificate. If empty, the
 	// default from the underlying ACME lib is
@@ -147,10 +213,19 @@ type ACMEIssuer struct {
 	// desired, set this to zap.NewNop().
 	Logger *zap.Logger
 
-	// Set a http proxy to use when issuing a certificate.
-	// Default is http.ProxyFromEnvironment
+	// Set a http proxy to use when issuing a certificate,
+	// which is also used for ARI and OCSP. Proxy URLs may
+	// be HTTP(S) or SOCKS5. Default is
+	// http.ProxyFromEnvironment; use NoProxy to connect
+	// directly regardless of the environment.
 	HTTPProxy func(*http.Request) (*url.URL, error)
 
+	// If set, CONNECT requests to the HTTP proxy are
+	// authenticated with this, which allows schemes that
+	// take multiple legs, like NTLM and Negotiate.
+	// EXPERIMENTAL: Subject to change.
+	ProxyAuthenticator ProxyAuthenticator
+
 	config     *Config
 	httpClient *http.Client
 
@@ -165,6 +240,15 @@ type ACMEIssuer struct {
 	email  string
 	agreed bool
 	mu     *sync.Mutex // protects the above grouped fields, as well as entire struct during NewAccountFunc calls
+
+	// the name of the external account, if this
+	// is a copy of the issuer for a named account
+	externalAccountName string
+
+	// the index of the account in the account pool,
+	// if this is a copy of the issuer for one of the
+	// pool's additional accounts
+	poolAccount int
 }
 
 // NewACMEIssuer constructs a valid ACMEIssuer based on a template
@@ -201,6 +285,18 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.ExternalAccount == nil {
 		template.ExternalAccount = DefaultACME.ExternalAccount
 	}
+	if template.ExternalAccountFunc == nil {
+		template.ExternalAccountFunc = DefaultACME.ExternalAccountFunc
+	}
+	if template.AccountPool == nil {
+		template.AccountPool = DefaultACME.AccountPool
+	}
+	if template.Profile == "" {
+		template.Profile = DefaultACME.Profile
+	}
+	if template.ProfileOverrides == nil {
+		template.ProfileOverrides = DefaultACME.ProfileOverrides
+	}
 	if template.NotBefore == 0 {
 		template.NotBefore = DefaultACME.NotBefore
 	}
@@ -225,9 +321,24 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.DNS01Solver == nil {
 		template.DNS01Solver = DefaultACME.DNS01Solver
 	}
+	if template.HTTP01Solver == nil {
+		template.HTTP01Solver = DefaultACME.HTTP01Solver
+	}
+	if template.ClusterSolver == nil {
+		template.ClusterSolver = DefaultACME.ClusterSolver
+	}
+	if template.ChallengePolicy == nil {
+		template.ChallengePolicy = DefaultACME.ChallengePolicy
+	}
+	if template.RateLimits == nil {
+		template.RateLimits = DefaultACME.RateLimits
+	}
 	if template.TrustedRoots == nil {
 		template.TrustedRoots = DefaultACME.TrustedRoots
 	}
+	if template.ClientTLS == nil {
+		template.ClientTLS = DefaultACME.ClientTLS
+	}
 	if template.CertObtainTimeout == 0 {
 		template.CertObtainTimeout = DefaultACME.CertObtainTimeout
 	}
@@ -249,9 +360,13 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.HTTPProxy == nil {
 		template.HTTPProxy = DefaultACME.HTTPProxy
 	}
+	explicitProxy := template.HTTPProxy != nil
 	if template.HTTPProxy == nil {
 		template.HTTPProxy = http.ProxyFromEnvironment
 	}
+	if template.ProxyAuthenticator == nil {
+		template.ProxyAuthenticator = DefaultACME.ProxyAuthenticator
+	}
 
 	template.config = cfg
 	template.mu = new(sync.Mutex)
@@ -271,27 +386,75 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 			},
 		}
 	}
+	var dialPolicy *DialPolicy
+	if cfg != nil {
+		dialPolicy = cfg.DialPolicy
+	}
 	transport := &http.Transport{
 		Proxy:                 template.HTTPProxy,
-		DialContext:           dialer.DialContext,
+		DialContext:           dialPolicy.dialContext(dialer),
 		TLSHandshakeTimeout:   30 * time.Second, // increase to 30s requested in #175
 		ResponseHeaderTimeout: 30 * time.Second, // increase to 30s requested in #175
 		ExpectContinueTimeout: 2 * time.Second,
 		ForceAttemptHTTP2:     true,
 	}
+	timeout := HTTPTimeout
+
+	// start from the config's client, if any, and keep what it
+	// configures unless the issuer configures it too; if its
+	// transport is not an *http.Transport, it is used as it is
+	if cfg != nil && cfg.HTTPClient != nil {
+		base, ok := cfg.HTTPClient.Transport.(*http.Transport)
+		if cfg.HTTPClient.Transport == nil {
+			base, ok = http.DefaultTransport.(*http.Transport), true
+		}
+		if !ok {
+			template.httpClient = cfg.HTTPClient
+			return &template
+		}
+		transport = base.Clone()
+		if explicitProxy {
+			transport.Proxy = template.HTTPProxy
+		}
+		if template.Resolver != "" || dialPolicy != nil {
+			transport.DialContext = dialPolicy.dialContext(dialer)
+		}
+		timeout = cfg.HTTPClient.Timeout
+	}
+
+	if template.ClientTLS != nil {
+		transport.TLSClientConfig = template.ClientTLS.Clone()
+	}
 	if template.TrustedRoots != nil {
-		transport.TLSClientConfig = &tls.Config{
-			RootCAs: template.TrustedRoots,
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = new(tls.Config)
+		} else {
+			transport.TLSClientConfig = transport.TLSClientConfig.Clone()
 		}
+		transport.TLSClientConfig.RootCAs = template.TrustedRoots
+	}
+	if template.ProxyAuthenticator != nil {
+		// the transport's own proxy support can't authenticate,
+		// so we tunnel through the proxy when dialing instead
+		transport.Proxy = nil
+		transport.DialContext = proxyConnectDialer{
+			proxy:         template.HTTPProxy,
+			authenticator: template.ProxyAuthenticator,
+			dialer:        dialer,
+		}.DialContext
 	}
 	template.httpClient = &http.Client{
 		Transport: transport,
-		Timeout:   HTTPTimeout,
+		Timeout:   timeout,
 	}
 
 	return &template
 }
 
+func (am *ACMEIssuer) proxy() (func(*http.Request) (*url.URL, error), ProxyAuthenticator) {
+	return am.HTTPProxy, am.ProxyAuthenticator
+}
+
 // IssuerKey returns the unique issuer key for the
 // configured CA endpoint.
 func (am *ACMEIssuer) IssuerKey() string {
@@ -339,8 +502,13 @@ func (iss *ACMEIssuer) isAgreed() bool {
 //
 // IP certificates via ACME are defined in RFC 8738.
 func (am *ACMEIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
-	publicCAsAndIPCerts := map[string]bool{ // map of public CAs to whether they support IP certificates (last updated: Q1 2024)
-		"api.letsencrypt.org": false, // https://community.letsencrypt.org/t/certificate-for-static-ip/84/2?u=mholt
+	for _, name := range names {
+		if SubjectIsURI(name) || SubjectIsEmail(name) {
+			return fmt.Errorf("subject '%s' cannot be validated with ACME; URI and email certificates require an issuer for a private CA", name)
+		}
+	}
+	publicCAsAndIPCerts := map[string]bool{ // map of public CAs to whether they support IP certificates (last updated: Q3 2025)
+		"api.letsencrypt.org": true,  // https://letsencrypt.org/2025/07/01/issuing-our-first-ip-address-certificate
 		"acme.zerossl.com":    false, // only supported via their API, not ACME endpoint
 		"api.pki.goog":        true,  // https://pki.goog/faq/#faq-IPCerts
 		"api.buypass.com":     false, // https://community.buypass.com/t/h7hm76w/buypass-support-for-rfc-8738
@@ -379,10 +547,16 @@ func (am *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (
 	}
 	isRetry := attempts > 0
 
-	cert, usedTestCA, err := am.doIssue(ctx, csr, attempts)
+	iss, err := am.forExternalAccount(ctx, namesFromCSR(csr))
 	if err != nil {
 		return nil, err
 	}
+	iss = iss.forPoolAccount(namesFromCSR(csr))
+
+	cert, usedTestCA, err := iss.doIssue(ctx, csr, attempts)
+	if err != nil {
+		return nil, iss.explainNetworkError(ctx, err)
+	}
 
 	// important to note that usedTestCA is not necessarily the same as isRetry
 	// (usedTestCA can be true if the main CA and the test CA happen to be the same)
@@ -407,7 +581,7 @@ func (am *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (
 		// other endpoint. This is more likely to happen if a user is testing with
 		// the staging CA as the main CA, then changes their configuration once they
 		// think they are ready for the production endpoint.
-		cert, _, err = am.doIssue(ctx, csr, 0)
+		cert, _, err = iss.doIssue(ctx, csr, 0)
 		if err != nil {
 			// succeeded with test CA but failed just now with the production CA;
 			// either we are observing differing internal states of each CA that will
@@ -436,6 +610,9 @@ func (am *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (
 }
 
 func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest, attempts int) (*IssuedCertificate, bool, error) {
+	// let solvers emit events
+	ctx = withConfig(ctx, am.config)
+
 	useTestCA := attempts > 0
 	client, err := am.newACMEClientWithAccount(ctx, useTestCA, false)
 	if err != nil {
@@ -444,11 +621,21 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 	usingTestCA := client.usingTestCA()
 
 	nameSet := namesFromCSR(csr)
+	if slices.ContainsFunc(nameSet, SubjectIsIP) && !slices.ContainsFunc(nameSet, func(name string) bool { return !SubjectIsIP(name) }) {
+		am.useIPChallenges(client.acmeClient)
+	}
 
+	var limits *caRateLimiter
 	if !useTestCA {
 		if err := client.throttle(ctx, nameSet); err != nil {
 			return nil, usingTestCA, err
 		}
+		if am.RateLimits != nil {
+			limits = am.RateLimits.limiter(client.acmeClient.Directory, am.getEmail())
+			if err := limits.wait(ctx, am.Logger, nameSet); err != nil {
+				return nil, usingTestCA, err
+			}
+		}
 	}
 
 	params, err := acmez.OrderParametersFromCSR(client.account, csr)
@@ -461,7 +648,7 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 	if am.NotAfter != 0 {
 		params.NotAfter = time.Now().Add(am.NotAfter)
 	}
-	params.Profile = am.Profile
+	params.Profile = am.selectProfile(ctx, client.acmeClient, nameSet)
 
 	// Notify the ACME server we are replacing a certificate (if the caller says we are),
 	// only if the following conditions are met:
@@ -486,7 +673,7 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 			zap.String("account_id", params.Account.Location),
 			zap.Strings("account_contact", params.Account.Contact))
 
-		certChains, err = client.acmeClient.ObtainCertificate(ctx, params)
+		certChains, err = am.obtainCertificate(ctx, client.acmeClient, params, nameSet)
 		if err != nil {
 			var prob acme.Problem
 			if errors.As(err, &prob) && prob.Type == acme.ProblemTypeAccountDoesNotExist {
@@ -519,6 +706,9 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 		}
 		break
 	}
+	if limits != nil {
+		limits.issued(nameSet)
+	}
 
 	preferredChain := am.selectPreferredChain(certChains)
 
@@ -536,16 +726,22 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 // chain preferred by the client. If there's only one chain, that is returned without any
 // processing. If there are no matches, the first chain is returned.
 func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.Certificate {
+	prefs := am.PreferredChains
+	if prefs.isZero() && am.config != nil {
+		prefs = am.config.PreferredChains
+	}
+	byName := len(prefs.AnyCommonName) > 0 || len(prefs.RootCommonName) > 0 || len(prefs.RootKeyID) > 0
+
 	if len(certChains) == 1 {
-		if len(am.PreferredChains.AnyCommonName) > 0 || len(am.PreferredChains.RootCommonName) > 0 {
+		if byName {
 			am.Logger.Debug("there is only one chain offered; selecting it regardless of preferences",
 				zap.String("chain_url", certChains[0].URL))
 		}
 		return certChains[0]
 	}
 
-	if am.PreferredChains.Smallest != nil {
-		if *am.PreferredChains.Smallest {
+	if prefs.Smallest != nil {
+		if *prefs.Smallest {
 			sort.Slice(certChains, func(i, j int) bool {
 				return len(certChains[i].ChainPEM) < len(certChains[j].ChainPEM)
 			})
@@ -556,7 +752,7 @@ func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.C
 		}
 	}
 
-	if len(am.PreferredChains.AnyCommonName) > 0 || len(am.PreferredChains.RootCommonName) > 0 {
+	if byName {
 		// in order to inspect, we need to decode their PEM contents
 		decodedChains := make([][]*x509.Certificate, len(certChains))
 		for i, chain := range certChains {
@@ -570,8 +766,8 @@ func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.C
 			decodedChains[i] = certs
 		}
 
-		if len(am.PreferredChains.AnyCommonName) > 0 {
-			for _, prefAnyCN := range am.PreferredChains.AnyCommonName {
+		if len(prefs.AnyCommonName) > 0 {
+			for _, prefAnyCN := range prefs.AnyCommonName {
 				for i, chain := range decodedChains {
 					for _, cert := range chain {
 						if cert.Issuer.CommonName == prefAnyCN {
@@ -585,10 +781,10 @@ func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.C
 			}
 		}
 
-		if len(am.PreferredChains.RootCommonName) > 0 {
-			for _, prefRootCN := range am.PreferredChains.RootCommonName {
+		if len(prefs.RootCommonName) > 0 {
+			for _, prefRootCN := range prefs.RootCommonName {
 				for i, chain := range decodedChains {
-					if chain[len(chain)-1].Issuer.CommonName == prefRootCN {
+					if len(chain) > 0 && chain[len(chain)-1].Issuer.CommonName == prefRootCN {
 						am.Logger.Debug("found preferred certificate chain by root common name",
 							zap.String("preference", prefRootCN),
 							zap.Int("chain", i))
@@ -598,20 +794,130 @@ func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.C
 			}
 		}
 
+		if len(prefs.RootKeyID) > 0 {
+			for _, prefKeyID := range prefs.RootKeyID {
+				for i, chain := range decodedChains {
+					if len(chain) > 0 && keyIDsEqual(chain[len(chain)-1].AuthorityKeyId, prefKeyID) {
+						am.Logger.Debug("found preferred certificate chain by root key ID",
+							zap.String("preference", prefKeyID),
+							zap.Int("chain", i))
+						return certChains[i]
+					}
+				}
+			}
+		}
+
 		am.Logger.Warn("did not find chain matching preferences; using first")
 	}
 
 	return certChains[0]
 }
 
+// keyIDsEqual returns true if keyID is the hex encoding of id; it may
+// contain colons and be of any case.
+func keyIDsEqual(id []byte, keyID string) bool {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(keyID, ":", ""))
+	return err == nil && len(id) > 0 && bytes.Equal(id, decoded)
+}
+
+// Profiles returns the ACME profiles offered by the CA, which can be
+// selected with Profile and ProfileOverrides, keyed by name, with
+// descriptions (often a URL) as values.
+//
+// EXPERIMENTAL: Subject to change.
+func (am *ACMEIssuer) Profiles(ctx context.Context) (map[string]string, error) {
+	client, err := am.newBasicACMEClient()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting ACME directory: %v", err)
+	}
+	if dir.Meta == nil {
+		return nil, nil
+	}
+	return dir.Meta.Profiles, nil
+}
+
+// selectProfile returns the profile to order a certificate for names
+// with; if the CA does not offer it, it returns the empty string so
+// the CA's default profile is used.
+func (am *ACMEIssuer) selectProfile(ctx context.Context, client *acmez.Client, names []string) string {
+	profile := am.Profile
+	if override, ok := am.profileOverride(names); ok {
+		profile = override
+	} else if profile == "" && slices.ContainsFunc(names, SubjectIsIP) && strings.Contains(client.Directory, "api.letsencrypt.org") {
+		// Let's Encrypt only issues IP certificates with this profile
+		profile = "shortlived"
+	}
+	if profile == "" {
+		return ""
+	}
+
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		// the order will fail anyway
+		return profile
+	}
+	var available map[string]string
+	if dir.Meta != nil {
+		available = dir.Meta.Profiles
+	}
+	if _, ok := available[profile]; ok {
+		return profile
+	}
+
+	offered := make([]string, 0, len(available))
+	for name := range available {
+		offered = append(offered, name)
+	}
+	sort.Strings(offered)
+	am.Logger.Warn("ACME profile is not offered by CA; using its default profile",
+		zap.Strings("identifiers", names),
+		zap.String("ca", client.Directory),
+		zap.String("profile", profile),
+		zap.Strings("available_profiles", offered))
+	if am.config != nil {
+		am.config.emit(ctx, "acme_profile_unavailable", map[string]any{
+			"identifiers":        names,
+			"ca":                 client.Directory,
+			"profile":            profile,
+			"available_profiles": offered,
+		})
+	}
+	return ""
+}
+
+// profileOverride returns the profile override for
+// the first of names that has one, exact matches first.
+func (am *ACMEIssuer) profileOverride(names []string) (string, bool) {
+	for _, name := range names {
+		if profile, ok := am.ProfileOverrides[name]; ok {
+			return profile, true
+		}
+		for pattern, profile := range am.ProfileOverrides {
+			if strings.HasPrefix(pattern, "*.") && MatchWildcard(name, pattern) {
+				return profile, true
+			}
+		}
+	}
+	return "", false
+}
+
 // Revoke implements the Revoker interface. It revokes the given certificate.
 func (am *ACMEIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
-	client, err := am.newACMEClientWithAccount(ctx, false, false)
+	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
 	if err != nil {
 		return err
 	}
 
-	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
+	iss, err := am.forExternalAccount(ctx, cert.SANs)
+	if err != nil {
+		return err
+	}
+	iss = iss.forRevocation(ctx, cert)
+	client, err := iss.newACMEClientWithAccount(ctx, false, false)
 	if err != nil {
 		return err
 	}
@@ -633,6 +939,16 @@ type ChainPreference struct {
 	// Select first chain that has any issuer with one
 	// of these common names.
 	AnyCommonName []string
+
+	// Select first chain having a root with one of
+	// these key IDs (the hex-encoded subject key ID of
+	// the root, which may contain colons).
+	RootKeyID []string
+}
+
+func (cp ChainPreference) isZero() bool {
+	return cp.Smallest == nil && len(cp.RootCommonName) == 0 &&
+		len(cp.AnyCommonName) == 0 && len(cp.RootKeyID) == 0
 }
 
 // DefaultACME specifies default settings to use for ACMEIssuers.
@@ -663,11 +979,17 @@ const prefixACME = "acme"
 
 type ctxKey string
 
-const ctxKeyARIReplaces = ctxKey("ari_replaces")
+const (
+	ctxKeyARIReplaces  = ctxKey("ari_replaces")
+	ctxKeyConfig       = ctxKey("config")
+	ctxKeyShuttingDown = ctxKey("shutting_down")
+	ctxKeyConnRoute    = ctxKey("conn_route")
+)
 
 // Interface guards
 var (
-	_ PreChecker = (*ACMEIssuer)(nil)
-	_ Issuer     = (*ACMEIssuer)(nil)
-	_ Revoker    = (*ACMEIssuer)(nil)
+	_ PreChecker    = (*ACMEIssuer)(nil)
+	_ Issuer        = (*ACMEIssuer)(nil)
+	_ Revoker       = (*ACMEIssuer)(nil)
+	_ proxiedIssuer = (*ACMEIssuer)(nil)
 )
@@ -1,3 +1,145 @@
 package certmagic
 
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
 const dummyCA = "https://example.com/acme/directory"
+
+func TestACMEProfiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{
+			"newNonce": "https://example.com/nonce",
+			"newAccount": "https://example.com/account",
+			"newOrder": "https://example.com/order",
+			"meta": {"profiles": {"classic": "https://example.com/classic", "shortlived": "https://example.com/shortlived"}}
+		}`))
+	}))
+	defer server.Close()
+
+	var unavailable []string
+	cfg := &Config{
+		Logger: defaultTestLogger,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "acme_profile_unavailable" {
+				unavailable = append(unavailable, data["profile"].(string))
+			}
+			return nil
+		},
+	}
+	am := &ACMEIssuer{
+		CA:      server.URL,
+		Profile: "classic",
+		ProfileOverrides: map[string]string{
+			"short.example.com": "shortlived",
+			"*.example.net":     "tlsserver",
+			"default.example":   "",
+		},
+		Logger: defaultTestLogger,
+		config: cfg,
+	}
+
+	ctx := context.Background()
+	profiles, err := am.Profiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles["shortlived"] == "" {
+		t.Errorf("Unexpected profiles: %v", profiles)
+	}
+
+	client, err := am.newBasicACMEClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		names  []string
+		expect string
+	}{
+		{names: []string{"example.com"}, expect: "classic"},
+		{names: []string{"example.com", "short.example.com"}, expect: "shortlived"},
+		{names: []string{"default.example"}, expect: ""},
+		{names: []string{"sub.example.net"}, expect: ""}, // not offered
+	} {
+		if actual := am.selectProfile(ctx, client, tc.names); actual != tc.expect {
+			t.Errorf("Test %d: Expected profile %q for %v, got %q", i, tc.expect, tc.names, actual)
+		}
+	}
+	if len(unavailable) != 1 || unavailable[0] != "tlsserver" {
+		t.Errorf("Expected one event for unavailable profile 'tlsserver', got %v", unavailable)
+	}
+}
+
+func TestUseIPChallenges(t *testing.T) {
+	cfg := &Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger}
+	am := &ACMEIssuer{
+		CA:                      dummyCA,
+		DNS01Solver:             &DNS01Solver{},
+		DisableTLSALPNChallenge: true,
+		Logger:                  defaultTestLogger,
+		config:                  cfg,
+	}
+	client, err := am.newACMEClient(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.ChallengeSolvers[acme.ChallengeTypeDNS01]; !ok || len(client.ChallengeSolvers) != 1 {
+		t.Fatalf("Expected only the DNS challenge to be enabled, got %v", client.ChallengeSolvers)
+	}
+
+	am.useIPChallenges(client)
+	if len(client.ChallengeSolvers) != 1 {
+		t.Fatalf("Expected only the HTTP challenge to be enabled, got %v", client.ChallengeSolvers)
+	}
+	solver, ok := client.ChallengeSolvers[acme.ChallengeTypeHTTP01]
+	if !ok {
+		t.Fatalf("Expected HTTP challenge to be enabled, got %v", client.ChallengeSolvers)
+	}
+	if _, ok := solver.(solverWrapper); !ok {
+		t.Errorf("Expected solver to be wrapped, got %T", solver)
+	}
+}
+
+func TestACMEIssuerClientTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	certPEM, keyPEM := mustGenerateTestCert(t, []string{"client.example.com"}, time.Now().Add(time.Hour))
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger}
+	am := NewACMEIssuer(cfg, ACMEIssuer{
+		CA:           srv.URL,
+		TrustedRoots: roots,
+		ClientTLS:    &tls.Config{Certificates: []tls.Certificate{clientCert}},
+		Logger:       defaultTestLogger,
+	})
+	resp, err := am.httpClient.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected client certificate to be presented, got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rveen/certmagic/ratelimit"
+	"go.uber.org/zap"
+)
+
+// ACMERateLimits are limits that an ACMEIssuer enforces on its own
+// orders, per CA and account, so that it stays within the limits of
+// the CA instead of running into them. This matters most when many
+// certificates need renewal at once, like when a large fleet restarts:
+// orders beyond the limit wait in line until the window allows them.
+//
+// Unlike the internal throttle, which only smooths out bursts, these
+// limits mirror the CA's actual limits; the defaults are those of
+// Let's Encrypt. Since other clients and instances may use the same
+// account, the CA remains the authority.
+//
+// EXPERIMENTAL: Subject to change.
+type ACMERateLimits struct {
+	// How many new orders to place per OrdersWindow.
+	// Defaults: 300 per 3h.
+	Orders       int
+	OrdersWindow time.Duration
+
+	// How many certificates to obtain for the exact same
+	// set of names per DuplicateWindow. An order that would
+	// exceed it is refused with a LocalRateLimitError, which
+	// is retried once the window allows it.
+	// Defaults: 5 per 168h (one week).
+	DuplicateCertificates int
+	DuplicateWindow       time.Duration
+}
+
+// limiter returns the limiter of these limits for the account
+// with the given email address at the CA with the given directory.
+func (rl ACMERateLimits) limiter(directory, email string) *caRateLimiter {
+	if rl.Orders <= 0 {
+		rl.Orders = 300
+	}
+	if rl.OrdersWindow <= 0 {
+		rl.OrdersWindow = 3 * time.Hour
+	}
+	if rl.DuplicateCertificates <= 0 {
+		rl.DuplicateCertificates = 5
+	}
+	if rl.DuplicateWindow <= 0 {
+		rl.DuplicateWindow = 7 * 24 * time.Hour
+	}
+
+	key := fmt.Sprintf("%s,%s,%d/%s,%d/%s", directory, email,
+		rl.Orders, rl.OrdersWindow, rl.DuplicateCertificates, rl.DuplicateWindow)
+
+	caRateLimitersMu.Lock()
+	defer caRateLimitersMu.Unlock()
+	limiter, ok := caRateLimiters[key]
+	if !ok {
+		limiter = &caRateLimiter{
+			ca:       directory,
+			account:  email,
+			limits:   rl,
+			orders:   NewRateLimiter(rl.Orders, rl.OrdersWindow),
+			issuedAt: make(map[string][]time.Time),
+		}
+		caRateLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// caRateLimiter enforces ACMERateLimits for one account at one CA.
+type caRateLimiter struct {
+	ca, account string
+	limits      ACMERateLimits
+	orders      *RingBufferRateLimiter
+
+	mu       sync.Mutex
+	issuedAt map[string][]time.Time // keyed by duplicateKey
+}
+
+// wait blocks until an order for names is allowed, or returns a
+// LocalRateLimitError if there are too many certificates for names
+// already.
+func (l *caRateLimiter) wait(ctx context.Context, logger *zap.Logger, names []string) error {
+	if retryAfter, ok := l.duplicatesExceeded(names, time.Now()); ok {
+		return LocalRateLimitError{Limit: ratelimit.Limit{
+			Name:       "certificates per exact set of identifiers",
+			Identifier: strings.Join(names, ","),
+			Threshold:  l.limits.DuplicateCertificates,
+			Window:     l.limits.DuplicateWindow,
+			RetryAfter: retryAfter,
+		}}
+	}
+
+	if l.orders.Allow() {
+		return nil
+	}
+	logger.Info("order rate limit reached; waiting in line",
+		zap.Strings("identifiers", names),
+		zap.String("ca", l.ca),
+		zap.String("account", l.account),
+		zap.Int("orders", l.limits.Orders),
+		zap.Duration("window", l.limits.OrdersWindow))
+	start := time.Now()
+	if err := l.orders.Wait(ctx); err != nil {
+		return err
+	}
+	logger.Info("done waiting on order rate limit",
+		zap.Strings("identifiers", names),
+		zap.String("ca", l.ca),
+		zap.Duration("waited", time.Since(start)))
+	return nil
+}
+
+// duplicatesExceeded returns whether another certificate for names
+// would exceed the duplicate certificate limit, and if so, when it
+// would not.
+func (l *caRateLimiter) duplicatesExceeded(names []string, now time.Time) (time.Time, bool) {
+	key := duplicateKey(names)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	issued := slices.DeleteFunc(l.issuedAt[key], func(t time.Time) bool {
+		return now.Sub(t) >= l.limits.DuplicateWindow
+	})
+	if len(issued) == 0 {
+		delete(l.issuedAt, key)
+	} else {
+		l.issuedAt[key] = issued
+	}
+	if len(issued) < l.limits.DuplicateCertificates {
+		return time.Time{}, false
+	}
+	return issued[len(issued)-l.limits.DuplicateCertificates].Add(l.limits.DuplicateWindow), true
+}
+
+// issued records that a certificate for names was obtained.
+func (l *caRateLimiter) issued(names []string) {
+	key := duplicateKey(names)
+	l.mu.Lock()
+	l.issuedAt[key] = append(l.issuedAt[key], time.Now())
+	l.mu.Unlock()
+}
+
+// duplicateKey returns the key of the set of names, in which
+// order and case don't matter, like for the CA.
+func duplicateKey(names []string) string {
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		normalized[i] = strings.ToLower(name)
+	}
+	slices.Sort(normalized)
+	return strings.Join(slices.Compact(normalized), ",")
+}
+
+// LocalRateLimitError is returned if an order is refused because
+// it would exceed ACMERateLimits. Like rate limit errors from CAs,
+// it is recognized by ratelimit.FromError, and retries wait until
+// the limit allows the order.
+//
+// EXPERIMENTAL: Subject to change.
+type LocalRateLimitError struct {
+	Limit ratelimit.Limit
+}
+
+func (e LocalRateLimitError) Error() string {
+	return "refusing order that would exceed internal " + e.Limit.String()
+}
+
+// RateLimit implements ratelimit.Limited.
+func (e LocalRateLimitError) RateLimit() ratelimit.Limit { return e.Limit }
+
+var (
+	caRateLimiters   = make(map[string]*caRateLimiter)
+	caRateLimitersMu sync.Mutex
+)
+
+// Interface guard
+var _ ratelimit.Limited = LocalRateLimitError{}
@@ -0,0 +1,85 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rveen/certmagic/ratelimit"
+)
+
+func TestACMERateLimitsOrders(t *testing.T) {
+	limits := ACMERateLimits{Orders: 2, OrdersWindow: time.Hour}
+	limiter := limits.limiter("https://ca.example/orders", t.Name())
+	if limits.limiter("https://ca.example/orders", t.Name()) != limiter {
+		t.Fatal("expected the same limiter for the same CA, account and limits")
+	}
+
+	ctx := context.Background()
+	for i := range 2 {
+		if err := limiter.wait(ctx, defaultTestLogger, []string{fmt.Sprintf("%d.example.com", i)}); err != nil {
+			t.Fatalf("order %d: %v", i, err)
+		}
+	}
+
+	// the third order waits in line until the window allows it
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(waitCtx, defaultTestLogger, []string{"2.example.com"}); err == nil {
+		t.Fatal("expected the third order to wait")
+	}
+}
+
+func TestACMERateLimitsDuplicates(t *testing.T) {
+	limits := ACMERateLimits{DuplicateCertificates: 2, DuplicateWindow: time.Hour}
+	limiter := limits.limiter("https://ca.example/duplicates", t.Name())
+	ctx := context.Background()
+
+	names := []string{"a.example.com", "b.example.com"}
+	for range 2 {
+		if err := limiter.wait(ctx, defaultTestLogger, names); err != nil {
+			t.Fatal(err)
+		}
+		limiter.issued(names)
+	}
+
+	// the same set of names, in any order or case, is refused
+	err := limiter.wait(ctx, defaultTestLogger, []string{"B.example.com", "a.example.com"})
+	var limitErr LocalRateLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected LocalRateLimitError, got %v", err)
+	}
+	limit, ok := ratelimit.FromError(fmt.Errorf("obtaining: %w", err))
+	if !ok {
+		t.Fatal("expected ratelimit.FromError to recognize the error")
+	}
+	if wait, ok := limit.Wait(time.Now()); !ok || wait <= 0 || wait > time.Hour {
+		t.Errorf("expected to wait up to an hour, got %s (%v)", wait, ok)
+	}
+
+	// other sets of names are not affected
+	if err := limiter.wait(ctx, defaultTestLogger, []string{"a.example.com"}); err != nil {
+		t.Errorf("expected a different set of names to be allowed, got %v", err)
+	}
+
+	// once the window has passed, the names are allowed again
+	if _, exceeded := limiter.duplicatesExceeded(names, time.Now().Add(time.Hour)); exceeded {
+		t.Error("expected the duplicate limit to lapse after the window")
+	}
+}
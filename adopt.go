@@ -0,0 +1,140 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// AdoptOptions configures how an externally-issued
+// certificate is adopted into management.
+type AdoptOptions struct {
+	// The name to manage the certificate for. The
+	// certificate must be valid for this name.
+	// Default: the first name on the certificate.
+	Name string
+
+	// The issuer under whose storage location the
+	// certificate will be kept; it must be one of
+	// the config's Issuers. Renewals will be done
+	// by the configured issuers as usual, so this
+	// only matters for where the files are stored.
+	// Default: the first configured issuer.
+	Issuer Issuer
+
+	// If true, a certificate already managed for
+	// the name will be replaced; otherwise it is an
+	// error if one exists.
+	Overwrite bool
+}
+
+// AdoptCertificate takes an externally-obtained certificate (and its
+// private key), both PEM-encoded, and stores it in the managed storage
+// layout so that it is subsequently treated like any other managed
+// certificate: it is loaded into the cache, and it will be renewed by
+// the configured issuers when it is due. This eases migrating from
+// manual issuance workflows without a moment of downtime or having to
+// obtain a new certificate up front.
+//
+// Since CertMagic manages one name per certificate, renewals will be
+// for opts.Name only, even if the adopted certificate has more names.
+// Adopt the certificate once for each name that should be managed.
+//
+// The returned certificate is the one that was added to the cache.
+func (cfg *Config) AdoptCertificate(ctx context.Context, certPEM, keyPEM []byte, opts AdoptOptions) (Certificate, error) {
+	cert, err := makeCertificate(certPEM, keyPEM)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = cert.Names[0]
+	}
+	name = normalizedName(name)
+	if !slices.ContainsFunc(cert.Names, func(san string) bool {
+		return san == name || MatchWildcard(name, san)
+	}) {
+		return Certificate{}, fmt.Errorf("certificate is not valid for %s (names: %v)", name, cert.Names)
+	}
+	if cert.Expired() {
+		return Certificate{}, fmt.Errorf("certificate for %s has expired", name)
+	}
+
+	issuer := opts.Issuer
+	if issuer == nil {
+		if len(cfg.Issuers) == 0 {
+			return Certificate{}, fmt.Errorf("no issuers configured")
+		}
+		issuer = cfg.Issuers[0]
+	}
+	if !slices.ContainsFunc(cfg.Issuers, func(iss Issuer) bool { return iss.IssuerKey() == issuer.IssuerKey() }) {
+		return Certificate{}, fmt.Errorf("issuer %s is not one of the configured issuers", issuer.IssuerKey())
+	}
+
+	log := cfg.Logger.With(zap.String("identifier", name), zap.String("issuer", issuer.IssuerKey()))
+
+	// don't race with an obtain or renewal of the same name
+	lockKey := cfg.lockKey(certIssueLockOp, name)
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return Certificate{}, fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		// the lock must be released even if ctx was canceled meanwhile
+		if err := releaseLock(context.WithoutCancel(ctx), cfg.Storage, lockKey); err != nil {
+			log.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	if !opts.Overwrite && cfg.storageHasCertResourcesAnyIssuer(ctx, name) {
+		return Certificate{}, fmt.Errorf("a certificate for %s is already managed", name)
+	}
+
+	certRes := CertificateResource{
+		SANs:           []string{name},
+		CertificatePEM: certPEM,
+		PrivateKeyPEM:  keyPEM,
+		issuerKey:      issuer.IssuerKey(),
+	}
+	if err := cfg.saveCertResource(ctx, issuer, certRes); err != nil {
+		return Certificate{}, fmt.Errorf("saving adopted certificate: %v", err)
+	}
+
+	cached, err := cfg.CacheManagedCertificate(ctx, name)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("loading adopted certificate: %v", err)
+	}
+
+	log.Info("adopted certificate into management",
+		zap.Strings("sans", cert.Names),
+		zap.Time("expiration", expiresAt(cert.Leaf)))
+
+	cfg.emit(ctx, "cert_adopted", map[string]any{
+		"identifier":       name,
+		"issuer":           issuer.IssuerKey(),
+		"sans":             cert.Names,
+		"expiration":       expiresAt(cert.Leaf),
+		"storage_path":     StorageKeys.CertsSitePrefix(issuer.IssuerKey(), name),
+		"certificate_path": StorageKeys.SiteCert(issuer.IssuerKey(), name),
+		"private_key_path": StorageKeys.SitePrivateKey(issuer.IssuerKey(), name),
+		"metadata_path":    StorageKeys.SiteMeta(issuer.IssuerKey(), name),
+	})
+
+	return cached, nil
+}
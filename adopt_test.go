@@ -0,0 +1,102 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAdoptCertificate(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	am := &ACMEIssuer{CA: "https://example.com/acme/directory"}
+	cfg := &Config{
+		Issuers:   []Issuer{am},
+		Storage:   &FileStorage{Path: tmpDir},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		certCache: NewCache(CacheOptions{GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil }}),
+	}
+	defer cfg.certCache.Stop()
+	am.config = cfg
+
+	certPEM, keyPEM := mustGenerateTestCert(t, []string{"example.com", "www.example.com"}, time.Now().Add(24*time.Hour))
+
+	if _, err := cfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{Name: "other.com"}); err == nil {
+		t.Error("Expected error adopting certificate for a name it doesn't cover")
+	}
+
+	cert, err := cfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !cert.managed {
+		t.Error("Expected adopted certificate to be managed")
+	}
+	if !cfg.storageHasCertResources(ctx, am, "example.com") {
+		t.Error("Expected adopted certificate to be in managed storage layout")
+	}
+	if len(cfg.certCache.getAllMatchingCerts("example.com")) != 1 {
+		t.Error("Expected adopted certificate to be cached")
+	}
+
+	if _, err := cfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{}); err == nil {
+		t.Error("Expected error adopting over an existing managed certificate")
+	}
+	if _, err := cfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{Overwrite: true}); err != nil {
+		t.Errorf("Expected overwrite to succeed, got: %v", err)
+	}
+}
+
+// mustGenerateTestCert returns a PEM-encoded self-signed certificate
+// and key for names that expires at notAfter.
+func mustGenerateTestCert(t *testing.T, names []string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err = PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
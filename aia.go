@@ -0,0 +1,165 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// AIAFetcher completes certificate chains that lack intermediates, as
+// when a Manager or storage provides only a leaf certificate, by
+// following the Authority Information Access (AIA) "CA Issuers" URLs
+// in the certificates. Fetched certificates are cached in memory by
+// URL.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AIAFetcher struct {
+	// The client to fetch certificates with. Default: a
+	// client with a timeout of HTTPTimeout.
+	HTTPClient *http.Client
+
+	// The maximum number of intermediates to fetch for
+	// a chain. Default: 4.
+	MaxDepth int
+
+	mu    sync.RWMutex
+	cache map[string]*x509.Certificate
+}
+
+// CompleteChain appends the missing issuer certificates to the chain of
+// tlsCert, which must have its Leaf set or its first certificate be the
+// leaf. It stops at a self-signed certificate or a certificate without
+// AIA URL, so roots are usually not included. If an error is returned,
+// the chain is left unchanged.
+func (af *AIAFetcher) CompleteChain(ctx context.Context, tlsCert *tls.Certificate) error {
+	if len(tlsCert.Certificate) == 0 {
+		return fmt.Errorf("certificate is empty")
+	}
+	chain := make([]*x509.Certificate, len(tlsCert.Certificate))
+	for i, der := range tlsCert.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parsing certificate %d of chain: %v", i, err)
+		}
+		chain[i] = cert
+	}
+
+	maxDepth := af.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 4
+	}
+	var fetched [][]byte
+	for last := chain[len(chain)-1]; !isSelfSigned(last) && len(last.IssuingCertificateURL) > 0; {
+		if len(fetched) == maxDepth {
+			return fmt.Errorf("chain of %s needs more than %d intermediates", chain[0].Subject, maxDepth)
+		}
+		issuer, err := af.fetch(ctx, last.IssuingCertificateURL[0])
+		if err != nil {
+			return err
+		}
+		if err := last.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("certificate from %s did not issue %s: %v", last.IssuingCertificateURL[0], last.Subject, err)
+		}
+		if isSelfSigned(issuer) {
+			break // don't serve the root
+		}
+		fetched = append(fetched, issuer.Raw)
+		last = issuer
+	}
+
+	tlsCert.Certificate = append(tlsCert.Certificate, fetched...)
+	return nil
+}
+
+// fetch returns the certificate at url, from the cache if possible.
+// The certificate may be DER- or PEM-encoded.
+func (af *AIAFetcher) fetch(ctx context.Context, url string) (*x509.Certificate, error) {
+	af.mu.RLock()
+	cert, ok := af.cache[url]
+	af.mu.RUnlock()
+	if ok {
+		return cert, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClientFor(ctx, af.HTTPClient, HTTPTimeout).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching issuer certificate: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching issuer certificate from %s: HTTP %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("reading issuer certificate: %v", err)
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	cert, err = x509.ParseCertificate(body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer certificate from %s: %v", url, err)
+	}
+
+	af.mu.Lock()
+	if af.cache == nil {
+		af.cache = make(map[string]*x509.Certificate)
+	}
+	af.cache[url] = cert
+	af.mu.Unlock()
+
+	return cert, nil
+}
+
+// completeChain completes the chain of cert with cfg.AIA, if set. If
+// that fails, the incomplete chain is kept and the error is logged.
+// It returns true if the chain was changed.
+func (cfg *Config) completeChain(ctx context.Context, cert *Certificate) bool {
+	if cfg.AIA == nil {
+		return false
+	}
+	before := len(cert.Certificate.Certificate)
+	if err := cfg.AIA.CompleteChain(withConfig(ctx, cfg), &cert.Certificate); err != nil {
+		cfg.Logger.Warn("unable to complete certificate chain; serving it incomplete",
+			zap.Strings("identifiers", cert.Names),
+			zap.Error(err))
+		return false
+	}
+	if len(cert.Certificate.Certificate) == before {
+		return false
+	}
+	cfg.Logger.Debug("completed certificate chain",
+		zap.Strings("identifiers", cert.Names),
+		zap.Int("fetched_intermediates", len(cert.Certificate.Certificate)-before))
+	return true
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
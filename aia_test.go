@@ -0,0 +1,148 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// testCA is a certificate and its key, for building chains in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issueTestCert issues a certificate signed by ca, or a self-signed one if ca
+// is nil, optionally with an AIA URL.
+func issueTestCert(t *testing.T, ca *testCA, cn string, isCA bool, aiaURL string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if aiaURL != "" {
+		tmpl.IssuingCertificateURL = []string{aiaURL}
+	}
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func TestAIAFetcherCompleteChain(t *testing.T) {
+	root := issueTestCert(t, nil, "Test Root", true, "")
+	var requests atomic.Int32
+	var intermediate *testCA
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/intermediate.pem":
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.cert.Raw})
+		case "/root.der":
+			w.Write(root.cert.Raw)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	intermediate = issueTestCert(t, root, "Test Intermediate", true, srv.URL+"/root.der")
+	leaf := issueTestCert(t, intermediate, "leaf.example.com", false, srv.URL+"/intermediate.pem")
+
+	af := &AIAFetcher{}
+	for i := 0; i < 2; i++ {
+		tlsCert := tls.Certificate{Certificate: [][]byte{leaf.cert.Raw}}
+		if err := af.CompleteChain(context.Background(), &tlsCert); err != nil {
+			t.Fatal(err)
+		}
+		if len(tlsCert.Certificate) != 2 || !bytes.Equal(tlsCert.Certificate[1], intermediate.cert.Raw) {
+			t.Fatalf("Expected leaf and intermediate (without root), got %d certificates", len(tlsCert.Certificate))
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected fetched certificates to be cached, got %d requests", n)
+	}
+
+	// a certificate that doesn't issue the chain is refused
+	other := issueTestCert(t, nil, "Other Root", true, "")
+	stranger := issueTestCert(t, other, "stranger.example.com", false, srv.URL+"/intermediate.pem")
+	tlsCert := tls.Certificate{Certificate: [][]byte{stranger.cert.Raw}}
+	if err := af.CompleteChain(context.Background(), &tlsCert); err == nil || len(tlsCert.Certificate) != 1 {
+		t.Errorf("Expected unrelated issuer to be refused and chain unchanged, got err=%v", err)
+	}
+}
+
+func TestSelectPreferredChainByRootKeyID(t *testing.T) {
+	chainFor := func(rootCN string) (acme.Certificate, []byte) {
+		root := issueTestCert(t, nil, rootCN, true, "")
+		intermediate := issueTestCert(t, root, rootCN+" Intermediate", true, "")
+		leaf := issueTestCert(t, intermediate, "example.com", false, "")
+		var buf bytes.Buffer
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: leaf.cert.Raw})
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.cert.Raw})
+		return acme.Certificate{URL: rootCN, ChainPEM: buf.Bytes()}, root.cert.SubjectKeyId
+	}
+	first, _ := chainFor("Root A")
+	second, keyID := chainFor("Root B")
+
+	// as a default from the Config
+	am := &ACMEIssuer{
+		Logger: defaultTestLogger,
+		config: &Config{PreferredChains: ChainPreference{RootKeyID: []string{hex.EncodeToString(keyID)}}},
+	}
+	if chain := am.selectPreferredChain([]acme.Certificate{first, second}); chain.URL != "Root B" {
+		t.Errorf("Expected chain of preferred root key, got %s", chain.URL)
+	}
+
+	// the issuer's own preference wins
+	am.PreferredChains = ChainPreference{RootCommonName: []string{"Root A"}}
+	if chain := am.selectPreferredChain([]acme.Certificate{first, second}); chain.URL != "Root A" {
+		t.Errorf("Expected chain of issuer's preferred root, got %s", chain.URL)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// alternateKeyConfig returns the config that manages the certificates
+// with keys of cfg.AlternateKeyType, or nil if there are none. It is
+// like cfg, except that its issuers store certificates under their
+// own issuer keys, and that it doesn't do what is done per name
+// rather than per certificate, like generating next keys, publishing
+// TLSA records, or batching issuance, which cfg does.
+func (cfg *Config) alternateKeyConfig() *Config {
+	if cfg.AlternateKeyType == "" || cfg.OnDemand != nil {
+		return nil
+	}
+	alt := *cfg
+	alt.alternateKey = cfg.AlternateKeyType
+	alt.AlternateKeyType = ""
+	alt.KeySource = StandardKeyGenerator{KeyType: cfg.AlternateKeyType}
+	alt.Issuers = alternateKeyIssuers(cfg.Issuers, cfg.AlternateKeyType)
+	alt.NextKeys = false
+	alt.KeyRotation = nil
+	alt.DANE = nil
+	alt.IssuanceBatching = nil
+	alt.Preload = nil
+	alt.clientCerts = nil
+	alt.successor = nil
+	return &alt
+}
+
+// manageAlternateCert obtains the certificate with the alternate key
+// for domain, if cfg has an AlternateKeyType and storage doesn't have
+// it yet, like when the key type was just configured, and caches it.
+func (cfg *Config) manageAlternateCert(ctx context.Context, domain string, interactive bool) error {
+	alt := cfg.alternateKeyConfig()
+	if alt == nil {
+		return nil
+	}
+	domain = cfg.transformSubject(ctx, nil, domain)
+	if alt.storageHasCertResourcesAnyIssuer(ctx, domain) {
+		return nil // cached along with the certificate with the primary key
+	}
+	if err := alt.obtainOneCert(ctx, domain, interactive); err != nil {
+		return err
+	}
+	_, err := alt.CacheManagedCertificate(ctx, domain)
+	return err
+}
+
+// forKeyOf returns the config that manages cert, which is the
+// one for the alternate key type if cert has it.
+func (cfg *Config) forKeyOf(cert Certificate) *Config {
+	if cfg.AlternateKeyType == "" || !strings.HasSuffix(cert.issuerKey, alternateKeySuffix(cfg.AlternateKeyType)) {
+		return cfg
+	}
+	if alt := cfg.alternateKeyConfig(); alt != nil {
+		return alt
+	}
+	return cfg
+}
+
+// renewedWithoutAlternate returns whether the certificate for name
+// with the primary key was issued after leaf, which is the one with
+// the alternate key that cfg manages, so that leaf is renewed with
+// it even if it doesn't need renewal by itself (or if its renewal
+// failed before).
+func (cfg *Config) renewedWithoutAlternate(ctx context.Context, name string, leaf *x509.Certificate) bool {
+	primary := *cfg
+	primary.Issuers = make([]Issuer, len(cfg.Issuers))
+	for i, issuer := range cfg.Issuers {
+		primary.Issuers[i] = unwrapAlternateKeyIssuer(issuer)
+	}
+	certRes, err := primary.loadCertResourceAnyIssuer(ctx, name)
+	if err != nil {
+		return false
+	}
+	certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		return false
+	}
+	if certs[0].NotBefore.After(leaf.NotBefore) {
+		cfg.Logger.Info("certificate with primary key was renewed; renewing certificate with alternate key too",
+			zap.String("identifier", name),
+			zap.String("key_type", string(cfg.alternateKey)))
+		return true
+	}
+	return false
+}
+
+// selectDefault chooses one of choices for hello without
+// CertSelection: if there are certificates with alternate
+// keys, the one with an ECDSA key if the client supports
+// it; otherwise as DefaultCertificateSelector does.
+func (cfg *Config) selectDefault(hello *tls.ClientHelloInfo, choices []Certificate) (Certificate, error) {
+	if cfg.AlternateKeyType != "" && len(choices) > 1 {
+		return CertSelectionPolicy{PreferECDSA: true}.SelectCertificate(hello, choices)
+	}
+	return DefaultCertificateSelector(hello, choices)
+}
+
+// alternateKeyIssuers wraps issuers, so that the certificates
+// with keys of keyType that they issue are stored apart from
+// the others.
+func alternateKeyIssuers(issuers []Issuer, keyType KeyType) []Issuer {
+	wrapped := make([]Issuer, len(issuers))
+	for i, issuer := range issuers {
+		ai := alternateKeyIssuer{unwrapAlternateKeyIssuer(issuer), keyType}
+		if _, ok := ai.Issuer.(RenewalInfoGetter); ok {
+			wrapped[i] = alternateKeyARIIssuer{ai}
+		} else {
+			wrapped[i] = ai
+		}
+	}
+	return wrapped
+}
+
+func unwrapAlternateKeyIssuer(issuer Issuer) Issuer {
+	switch ai := issuer.(type) {
+	case alternateKeyIssuer:
+		return ai.Issuer
+	case alternateKeyARIIssuer:
+		return ai.Issuer
+	}
+	return issuer
+}
+
+func alternateKeySuffix(keyType KeyType) string {
+	return "-" + strings.ToLower(string(keyType))
+}
+
+// alternateKeyIssuer wraps an issuer of certificates with
+// the alternate key type, so that they are stored separately
+// from the certificates from the same issuer.
+type alternateKeyIssuer struct {
+	Issuer
+	keyType KeyType
+}
+
+// IssuerKey implements Issuer.
+func (ai alternateKeyIssuer) IssuerKey() string {
+	return ai.Issuer.IssuerKey() + alternateKeySuffix(ai.keyType)
+}
+
+// PreCheck implements PreChecker.
+func (ai alternateKeyIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	if prechecker, ok := ai.Issuer.(PreChecker); ok {
+		return prechecker.PreCheck(ctx, names, interactive)
+	}
+	return nil
+}
+
+// Revoke implements Revoker.
+func (ai alternateKeyIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	revoker, ok := ai.Issuer.(Revoker)
+	if !ok {
+		return fmt.Errorf("issuer %s is not a Revoker", ai.Issuer.IssuerKey())
+	}
+	return revoker.Revoke(ctx, cert, reason)
+}
+
+// alternateKeyARIIssuer is an alternateKeyIssuer
+// for an issuer that is a RenewalInfoGetter.
+type alternateKeyARIIssuer struct {
+	alternateKeyIssuer
+}
+
+// GetRenewalInfo implements RenewalInfoGetter.
+func (ai alternateKeyARIIssuer) GetRenewalInfo(ctx context.Context, cert Certificate) (acme.RenewalInfo, error) {
+	return ai.Issuer.(RenewalInfoGetter).GetRenewalInfo(ctx, cert)
+}
+
+// Interface guards
+var (
+	_ Issuer            = alternateKeyIssuer{}
+	_ PreChecker        = alternateKeyIssuer{}
+	_ Revoker           = alternateKeyIssuer{}
+	_ RenewalInfoGetter = alternateKeyARIIssuer{}
+)
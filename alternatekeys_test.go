@@ -0,0 +1,123 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestAlternateKeyType(t *testing.T) {
+	ctx := context.Background()
+	const name = "dual.example.com"
+	issuer := &testIssuer{}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:          []Issuer{issuer},
+		KeySource:        StandardKeyGenerator{KeyType: P256},
+		AlternateKeyType: RSA2048,
+		Storage:          &FileStorage{Path: t.TempDir()},
+		Logger:           defaultTestLogger,
+		OCSP:             OCSPConfig{DisableStapling: true},
+	})
+
+	if err := cfg.ManageSync(ctx, []string{name}); err != nil {
+		t.Fatal(err)
+	}
+
+	// both certificates are stored apart and cached
+	for _, issuerKey := range []string{issuer.IssuerKey(), issuer.IssuerKey() + "-rsa2048"} {
+		if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(issuerKey, name)) {
+			t.Errorf("Expected certificate in storage under %s", issuerKey)
+		}
+	}
+	cached := cache.getAllMatchingCerts(name)
+	if len(cached) != 2 {
+		t.Fatalf("Expected 2 cached certificates, got %d", len(cached))
+	}
+	for _, cert := range cached {
+		altCfg, err := cache.getConfig(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isRSA := cert.Leaf.PublicKeyAlgorithm == x509.RSA; isRSA != (altCfg.alternateKey == RSA2048) {
+			t.Errorf("Expected certificate with RSA key to be managed by the alternate config, and only it (issuer key %s)", cert.issuerKey)
+		}
+	}
+
+	// clients get the certificate they support, preferably ECDSA
+	for i, tc := range []struct {
+		hello  *tls.ClientHelloInfo
+		expect x509.PublicKeyAlgorithm
+	}{
+		{
+			hello: &tls.ClientHelloInfo{
+				ServerName:        name,
+				SupportedVersions: []uint16{tls.VersionTLS13},
+				CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+				SignatureSchemes:  []tls.SignatureScheme{tls.PSSWithSHA256, tls.ECDSAWithP256AndSHA256},
+				SupportedCurves:   []tls.CurveID{tls.X25519},
+			},
+			expect: x509.ECDSA,
+		},
+		{
+			hello: &tls.ClientHelloInfo{
+				ServerName:        name,
+				SupportedVersions: []uint16{tls.VersionTLS12},
+				CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+				SupportedCurves:   []tls.CurveID{tls.X25519},
+				SupportedPoints:   []uint8{0},
+			},
+			expect: x509.RSA,
+		},
+	} {
+		cert, matched, _ := cfg.getCertificateFromCache(tc.hello)
+		if !matched || cert.Leaf.PublicKeyAlgorithm != tc.expect {
+			t.Errorf("Test %d: Expected %s certificate, got %v (matched=%t)", i, tc.expect, cert.Leaf.PublicKeyAlgorithm, matched)
+		}
+	}
+
+	// when the certificate with the primary key is renewed
+	// by itself, the other one is renewed along with it
+	altKey := StorageKeys.SiteCert(issuer.IssuerKey()+"-rsa2048", name)
+	oldAlt, err := cfg.Storage.Load(ctx, altKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second) // certificate times have one-second precision
+	if err := cfg.renewOneCert(ctx, name, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.RenewCertSync(ctx, name, false); err != nil {
+		t.Fatal(err)
+	}
+	newAlt, err := cfg.Storage.Load(ctx, altKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldAlt, newAlt) {
+		t.Error("Expected certificate with alternate key to be renewed with the other one")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rveen/certmagic/ratelimit"
 	"go.uber.org/zap"
 )
 
@@ -81,54 +82,114 @@ func (jm *jobManager) worker() {
 	}
 }
 
-func doWithRetry(ctx context.Context, log *zap.Logger, f func(context.Context) error) error {
+// doWithRetry calls f until it succeeds, with backoff between attempts.
+// If cp is not nil, the loop resumes from, and records its progress to,
+// the checkpoint, so that backoff is stable across restarts.
+func doWithRetry(ctx context.Context, log *zap.Logger, cp retryCheckpoint, f func(context.Context) error) error {
 	var attempts int
 	ctx = context.WithValue(ctx, AttemptsCtxKey, &attempts)
 
 	// the initial intervalIndex is -1, signaling
 	// that we should not wait for the first attempt
 	start, intervalIndex := time.Now(), -1
+	var wait time.Duration
 	var err error
 
-	for time.Since(start) < maxRetryDuration {
-		var wait time.Duration
-		if intervalIndex >= 0 {
-			wait = retryIntervals[intervalIndex]
+	if cp != nil {
+		var next time.Time
+		start, attempts, next = cp.resume(ctx)
+		if attempts > 0 {
+			intervalIndex = min(attempts, len(retryIntervals)) - 1
+			wait = max(time.Until(next), 0)
+			log.Info("resuming retries",
+				zap.Int("attempt", attempts),
+				zap.Duration("retrying_in", wait),
+				zap.Duration("elapsed", time.Since(start)))
+		}
+	}
+	var canceled bool
+	defer func() {
+		// a canceled loop resumes later where it left off
+		if cp != nil && !canceled {
+			cp.finished(ctx)
 		}
+	}()
+
+	for time.Since(start) < maxRetryDuration {
+		stopRetryWait := issuanceTimerFromContext(ctx).track(retryWaitPhase)
 		timer := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
+			canceled = true
+			return context.Canceled
+		case <-shuttingDown(ctx):
+			// don't wait for the next attempt while shutting down
+			timer.Stop()
+			canceled = true
 			return context.Canceled
 		case <-timer.C:
-			err = f(ctx)
-			attempts++
-			if err == nil || errors.Is(err, context.Canceled) {
-				return err
-			}
-			var errNoRetry ErrNoRetry
-			if errors.As(err, &errNoRetry) {
-				return err
-			}
-			if intervalIndex < len(retryIntervals)-1 {
-				intervalIndex++
-			}
-			if time.Since(start) < maxRetryDuration {
-				log.Error("will retry",
-					zap.Error(err),
-					zap.Int("attempt", attempts),
-					zap.Duration("retrying_in", retryIntervals[intervalIndex]),
-					zap.Duration("elapsed", time.Since(start)),
-					zap.Duration("max_duration", maxRetryDuration))
-
-			} else {
-				log.Error("final attempt; giving up",
-					zap.Error(err),
-					zap.Int("attempt", attempts),
-					zap.Duration("elapsed", time.Since(start)),
-					zap.Duration("max_duration", maxRetryDuration))
-				return nil
+		case <-backoffReset(ctx):
+			// an operator reset the backoff of names; try again now
+			timer.Stop()
+		}
+		stopRetryWait()
+		err = f(ctx)
+		attempts++
+		if errors.Is(err, context.Canceled) {
+			canceled = true
+			return err
+		}
+		if err == nil {
+			return err
+		}
+		var errNoRetry ErrNoRetry
+		if errors.As(err, &errNoRetry) {
+			return err
+		}
+		// the CA will never issue for some identifiers
+		caErr, isCAErr := ClassifyCAError(err)
+		if isCAErr && caErr.Kind == CAErrorRejected {
+			return err
+		}
+		certJobFromContext(ctx).attemptFailed(err)
+
+		// errors from the CA decide how long to wait; if the CA
+		// told us when its rate limit resets, there's no point
+		// in retrying before then, nor in waiting longer
+		nextIndex := min(intervalIndex+1, len(retryIntervals)-1)
+		wait = retryIntervals[nextIndex]
+		advance := true
+		var limitFields []zap.Field
+		if isCAErr {
+			wait, advance = caErr.retryWait(wait)
+			limitFields = append(limitFields, zap.String("ca_error", string(caErr.Kind)))
+		}
+		if limit, ok := ratelimit.FromError(err); ok {
+			limitFields = append(limitFields, zap.Stringer("rate_limit", limit))
+		}
+		if advance {
+			intervalIndex = nextIndex
+		}
+
+		if time.Since(start) < maxRetryDuration {
+			if cp != nil {
+				cp.failed(ctx, attempts, time.Now().Add(wait), err)
 			}
+			log.Error("will retry", append([]zap.Field{
+				zap.Error(err),
+				zap.Int("attempt", attempts),
+				zap.Duration("retrying_in", wait),
+				zap.Duration("elapsed", time.Since(start)),
+				zap.Duration("max_duration", maxRetryDuration)}, limitFields...)...)
+
+		} else {
+			log.Error("final attempt; giving up",
+				zap.Error(err),
+				zap.Int("attempt", attempts),
+				zap.Duration("elapsed", time.Since(start)),
+				zap.Duration("max_duration", maxRetryDuration))
+			return nil
 		}
 	}
 	return err
@@ -193,3 +254,8 @@ var retryIntervals = []time.Duration{
 // maxRetryDuration is the maximum duration to try
 // doing retries using the above intervals.
 const maxRetryDuration = 24 * time.Hour * 30
+
+// minRateLimitWait is the least amount of time to wait before
+// retrying after a rate limit, even if the CA says it has
+// already reset, to avoid hammering a CA whose clock is off.
+const minRateLimitWait = 5 * time.Second
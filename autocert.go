@@ -0,0 +1,361 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutocertManager is a drop-in replacement for autocert.Manager
+// from golang.org/x/crypto/acme/autocert. It has the same commonly
+// used fields and methods, so existing call sites can switch to it
+// by changing only the type name, but certificates are managed by
+// CertMagic: they are stored in (possibly shared) Storage, renewed
+// in the background, and have their OCSP responses stapled.
+//
+// Like autocert.Manager, certificates are obtained on-demand during
+// TLS handshakes, subject to HostPolicy.
+//
+// The zero value is ready to use, but (like autocert) Prompt must be
+// set to agree to the CA's terms of service or no certificates will
+// be obtained.
+//
+// EXPERIMENTAL: Subject to change.
+type AutocertManager struct {
+	// Prompt is called with the CA's terms of service URL
+	// when a new account is registered; it must return true
+	// to agree to them. See autocert.AcceptTOS.
+	Prompt func(tosURL string) bool
+
+	// Cache is where certificates and account keys are kept.
+	// If nil, CertMagic's default storage is used instead
+	// (unlike autocert, which keeps nothing if Cache is nil).
+	// To use a CertMagic Storage directly, leave this nil and
+	// set Storage.
+	Cache autocert.Cache
+
+	// Storage, if set, is used instead of Cache. This is the
+	// way to gain clustering support, since autocert.Cache
+	// has no notion of locking.
+	Storage Storage
+
+	// HostPolicy decides which host names certificates may
+	// be obtained for. If nil, all host names are allowed,
+	// which is the same (discouraged) default as autocert.
+	HostPolicy autocert.HostPolicy
+
+	// RenewBefore is how long before expiration renewal is
+	// attempted. It is converted to a renewal window ratio
+	// assuming a 90-day certificate lifetime. Default: the
+	// CertMagic default renewal window.
+	RenewBefore time.Duration
+
+	// DirectoryURL is the ACME directory endpoint of the CA.
+	// Default: Let's Encrypt's production endpoint.
+	DirectoryURL string
+
+	// Email is the contact address for the ACME account.
+	Email string
+
+	// ExternalAccountBinding optionally binds the ACME
+	// account to an existing account with the CA.
+	ExternalAccountBinding *acme.EAB
+
+	once sync.Once
+	cfg  *Config
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook,
+// just like autocert.Manager.GetCertificate.
+func (m *AutocertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.Config().GetCertificate(hello)
+}
+
+// TLSConfig returns a TLS config that uses m.GetCertificate and
+// supports the TLS-ALPN challenge, like autocert.Manager.TLSConfig.
+func (m *AutocertManager) TLSConfig() *tls.Config {
+	tlsConfig := m.Config().TLSConfig()
+	tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+	return tlsConfig
+}
+
+// HTTPHandler returns a handler that solves HTTP-01 challenges
+// and otherwise invokes fallback. If fallback is nil, requests
+// are redirected to HTTPS, just like autocert.Manager.HTTPHandler.
+func (m *AutocertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.HandlerFunc(httpRedirectHandler)
+	}
+	cfg := m.Config()
+	for _, issuer := range cfg.Issuers {
+		if am, ok := issuer.(*ACMEIssuer); ok {
+			return am.HTTPChallengeHandler(fallback)
+		}
+	}
+	return fallback
+}
+
+// Config returns the underlying CertMagic config, which can be
+// used to access features that autocert does not have. It is
+// initialized on first use; m should not be changed after that.
+func (m *AutocertManager) Config() *Config {
+	m.once.Do(m.init)
+	return m.cfg
+}
+
+func (m *AutocertManager) init() {
+	storage := m.Storage
+	if storage == nil && m.Cache != nil {
+		storage = NewAutocertStorage(m.Cache)
+	}
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) {
+			return cfg, nil
+		},
+	})
+
+	template := Config{
+		Storage: storage,
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(ctx context.Context, name string) error {
+				if m.HostPolicy == nil {
+					return nil
+				}
+				return m.HostPolicy(ctx, name)
+			},
+		},
+	}
+	if m.RenewBefore > 0 {
+		const assumedLifetime = 90 * 24 * time.Hour
+		template.RenewalWindowRatio = min(float64(m.RenewBefore)/float64(assumedLifetime), 1)
+	}
+	cfg = New(cache, template)
+
+	issuer := NewACMEIssuer(cfg, ACMEIssuer{
+		CA:              m.DirectoryURL,
+		Email:           m.Email,
+		ExternalAccount: m.ExternalAccountBinding,
+		NewAccountFunc:  m.promptTerms,
+	})
+	if m.DirectoryURL != "" && m.DirectoryURL != DefaultACME.CA {
+		issuer.TestCA = ""
+	}
+	cfg.Issuers = []Issuer{issuer}
+
+	m.cfg = cfg
+}
+
+// promptTerms asks m.Prompt to agree to the CA's terms of service
+// before a new ACME account is registered.
+func (m *AutocertManager) promptTerms(ctx context.Context, iss *ACMEIssuer, acct acme.Account) (acme.Account, error) {
+	if m.Prompt == nil {
+		return acct, fmt.Errorf("autocert: Prompt is not set; CA terms of service were not accepted")
+	}
+	client, err := iss.newBasicACMEClient()
+	if err != nil {
+		return acct, err
+	}
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return acct, fmt.Errorf("getting directory: %w", err)
+	}
+	var tosURL string
+	if dir.Meta != nil {
+		tosURL = dir.Meta.TermsOfService
+	}
+	if !m.Prompt(tosURL) {
+		return acct, fmt.Errorf("autocert: CA terms of service were not accepted")
+	}
+	iss.Agreed = true
+	iss.agreed = true
+	acct.TermsOfServiceAgreed = true
+	return acct, nil
+}
+
+// NewAutocertCache returns an autocert.Cache that is backed by storage,
+// so that autocert.Manager values can share storage with CertMagic
+// while they are being migrated.
+func NewAutocertCache(storage Storage) autocert.Cache {
+	return autocertCache{storage}
+}
+
+// autocertCache adapts a Storage to the autocert.Cache interface.
+type autocertCache struct {
+	storage Storage
+}
+
+func (ac autocertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := ac.storage.Load(ctx, autocertCacheKey(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (ac autocertCache) Put(ctx context.Context, key string, data []byte) error {
+	return ac.storage.Store(ctx, autocertCacheKey(key), data)
+}
+
+func (ac autocertCache) Delete(ctx context.Context, key string) error {
+	err := ac.storage.Delete(ctx, autocertCacheKey(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func autocertCacheKey(key string) string {
+	return prefixAutocert + "/" + StorageKeys.Safe(key)
+}
+
+// NewAutocertStorage returns a Storage that is backed by an existing
+// autocert.Cache. Because autocert.Cache can only get, put, and delete
+// keys, the returned Storage has limitations: listing is not supported
+// (storage cleaning will not work), Stat reports only the size, and
+// locks are effective only within this process. If multiple instances
+// share the cache, use a real Storage implementation instead.
+//
+// Storage keys are nested paths, but autocert.Cache keys are flat (for
+// example, autocert.DirCache stores each key as a file in one directory),
+// so keys are base64url-encoded before they are passed to the cache.
+func NewAutocertStorage(cache autocert.Cache) Storage {
+	return &autocertStorage{cache: cache, locks: make(map[string]*autocertLock)}
+}
+
+// autocertStorage adapts an autocert.Cache to the Storage interface.
+type autocertStorage struct {
+	cache   autocert.Cache
+	locksMu sync.Mutex
+	locks   map[string]*autocertLock
+}
+
+// autocertLock is a lock of an autocertStorage. It is removed
+// when it is neither held nor waited for.
+type autocertLock struct {
+	sem  chan struct{}
+	refs int // holders and waiters
+}
+
+func (as *autocertStorage) Store(ctx context.Context, key string, value []byte) error {
+	return as.cache.Put(ctx, autocertStorageKey(key), value)
+}
+
+func (as *autocertStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	data, err := as.cache.Get(ctx, autocertStorageKey(key))
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, fs.ErrNotExist
+	}
+	return data, err
+}
+
+func (as *autocertStorage) Delete(ctx context.Context, key string) error {
+	return as.cache.Delete(ctx, autocertStorageKey(key))
+}
+
+func (as *autocertStorage) Exists(ctx context.Context, key string) bool {
+	_, err := as.cache.Get(ctx, autocertStorageKey(key))
+	return err == nil
+}
+
+func (as *autocertStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	return nil, fmt.Errorf("listing %s: not supported by autocert.Cache", path)
+}
+
+func (as *autocertStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	data, err := as.Load(ctx, key)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return KeyInfo{
+		Key:        key,
+		Size:       int64(len(data)),
+		IsTerminal: !strings.HasSuffix(key, "/"),
+	}, nil
+}
+
+func (as *autocertStorage) Lock(ctx context.Context, name string) error {
+	as.locksMu.Lock()
+	lock, ok := as.locks[name]
+	if !ok {
+		lock = &autocertLock{sem: make(chan struct{}, 1)}
+		as.locks[name] = lock
+	}
+	lock.refs++
+	as.locksMu.Unlock()
+	select {
+	case lock.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		as.locksMu.Lock()
+		as.release(name, lock)
+		as.locksMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (as *autocertStorage) Unlock(ctx context.Context, name string) error {
+	as.locksMu.Lock()
+	defer as.locksMu.Unlock()
+	lock, ok := as.locks[name]
+	if !ok {
+		return fmt.Errorf("lock %s is not held", name)
+	}
+	select {
+	case <-lock.sem:
+		as.release(name, lock)
+		return nil
+	default:
+		return fmt.Errorf("lock %s is not held", name)
+	}
+}
+
+// release drops a reference to lock, and removes it if it was the
+// last one. It must be called with locksMu held.
+func (as *autocertStorage) release(name string, lock *autocertLock) {
+	lock.refs--
+	if lock.refs == 0 {
+		delete(as.locks, name)
+	}
+}
+
+// autocertStorageKey returns the flat autocert.Cache key for a
+// storage key.
+func autocertStorageKey(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// prefixAutocert is the storage prefix for keys written
+// through the autocert.Cache adapter.
+const prefixAutocert = "autocert"
+
+// Interface guards
+var (
+	_ autocert.Cache = (*autocertCache)(nil)
+	_ Storage        = (*autocertStorage)(nil)
+)
@@ -0,0 +1,102 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestAutocertCacheAdapter(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cache := NewAutocertCache(&FileStorage{Path: tmpDir})
+
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Fatalf("Expected cache miss, got: %v", err)
+	}
+	if err := cache.Put(ctx, "example.com", []byte("data")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := cache.Get(ctx, "example.com")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("Expected stored data, got: %q (err=%v)", data, err)
+	}
+	if err := cache.Delete(ctx, "example.com"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := cache.Delete(ctx, "example.com"); err != nil {
+		t.Fatalf("Deleting a missing key should not fail, got: %v", err)
+	}
+}
+
+func TestAutocertStorageAdapter(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := NewAutocertStorage(autocert.DirCache(tmpDir))
+	key := StorageKeys.SiteCert("acme-v02.api.letsencrypt.org-directory", "example.com")
+
+	if _, err := s.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist, got: %v", err)
+	}
+	if err := s.Store(ctx, key, []byte("bar")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !s.Exists(ctx, key) {
+		t.Error("Expected key to exist")
+	}
+	if data, err := s.Load(ctx, key); err != nil || string(data) != "bar" {
+		t.Errorf("Expected stored value, got: %q (err=%v)", data, err)
+	}
+	if info, err := s.Stat(ctx, key); err != nil || info.Size != 3 || info.Key != key {
+		t.Errorf("Expected size 3, got: %+v (err=%v)", info, err)
+	}
+	if err := s.Delete(ctx, key); err != nil || s.Exists(ctx, key) {
+		t.Errorf("Expected key to be deleted (err=%v)", err)
+	}
+
+	if err := s.Lock(ctx, "foo"); err != nil {
+		t.Fatalf("Expected to acquire free lock, got: %v", err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := s.Lock(cctx, "foo"); err == nil {
+		t.Fatal("Expected error acquiring held lock with canceled context")
+	}
+	if err := s.Unlock(ctx, "foo"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.Unlock(ctx, "foo"); err == nil {
+		t.Error("Expected error unlocking lock that is not held")
+	}
+	if n := len(s.(*autocertStorage).locks); n != 0 {
+		t.Errorf("Expected released locks to be removed, got %d", n)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AWSPCAIssuer gets certificates from an AWS Private Certificate
+// Authority (ACM PCA), for workloads in AWS that need certificates
+// from a private CA. Requests are made directly to the ACM PCA API,
+// signed with AWS Signature Version 4, so no AWS SDK is needed.
+//
+// EXPERIMENTAL: Subject to change.
+type AWSPCAIssuer struct {
+	// The ARN of the private CA. REQUIRED.
+	CertificateAuthorityARN string
+
+	// The ARN of the certificate template to apply, e.g. for
+	// client authentication or a specific path length.
+	// Default: the end-entity template of the CA.
+	TemplateARN string
+
+	// The algorithm the CA signs with; it must match the CA's
+	// key type, e.g. "SHA256WITHECDSA" for an EC key.
+	// Default: "SHA256WITHRSA".
+	SigningAlgorithm string
+
+	// How many days issued certificates are valid for.
+	// Default: 90.
+	ValidityDays int
+
+	// The AWS region of the CA. Default: from the ARN.
+	Region string
+
+	// The credentials to sign requests with. Default: from
+	// the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+	// AWS_SESSION_TOKEN environment variables.
+	Credentials *AWSCredentials
+
+	// The URL of the ACM PCA API, e.g. for VPC endpoints.
+	// Default: the regional endpoint.
+	Endpoint string
+
+	// How long to wait between checks if the certificate
+	// has been issued. Default: 1s.
+	PollInterval time.Duration
+
+	// The HTTP client to use. Default: a client with
+	// HTTPTimeout.
+	HTTPClient *http.Client
+
+	// An optional (but highly recommended) logger.
+	Logger *zap.Logger
+}
+
+// AWSCredentials are credentials for signing AWS API requests.
+//
+// EXPERIMENTAL: Subject to change.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // only for temporary credentials
+}
+
+// IssuerKey returns the unique issuer key for the CA.
+func (iss *AWSPCAIssuer) IssuerKey() string {
+	// the last part of the ARN is the CA's unique ID
+	arn := iss.CertificateAuthorityARN
+	if i := strings.LastIndex(arn, "/"); i >= 0 {
+		arn = arn[i+1:]
+	}
+	return "awspca-" + arn
+}
+
+// Issue obtains a certificate for the given csr. It submits the CSR
+// and waits until the certificate is issued.
+func (iss *AWSPCAIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	if iss.CertificateAuthorityARN == "" {
+		return nil, ErrNoRetry{fmt.Errorf("AWS PCA issuer: no certificate authority ARN")}
+	}
+	logger := iss.logger()
+
+	signingAlg := iss.SigningAlgorithm
+	if signingAlg == "" {
+		signingAlg = "SHA256WITHRSA"
+	}
+	validityDays := iss.ValidityDays
+	if validityDays <= 0 {
+		validityDays = 90
+	}
+
+	// retrying the same CSR won't issue another certificate
+	csrHash := sha256.Sum256(csr.Raw)
+	issueReq := map[string]any{
+		"CertificateAuthorityArn": iss.CertificateAuthorityARN,
+		"Csr":                     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}),
+		"SigningAlgorithm":        signingAlg,
+		"Validity":                map[string]any{"Type": "DAYS", "Value": validityDays},
+		"IdempotencyToken":        hex.EncodeToString(csrHash[:16]),
+	}
+	if iss.TemplateARN != "" {
+		issueReq["TemplateArn"] = iss.TemplateARN
+	}
+	var issueResp struct {
+		CertificateArn string
+	}
+	if err := iss.call(ctx, "IssueCertificate", issueReq, &issueResp); err != nil {
+		return nil, err
+	}
+
+	logger.Info("requested certificate from AWS Private CA",
+		zap.String("ca_arn", iss.CertificateAuthorityARN),
+		zap.String("certificate_arn", issueResp.CertificateArn),
+		zap.Strings("identifiers", namesFromCSR(csr)))
+
+	// issuance is asynchronous; poll until it's done
+	pollInterval := iss.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	getReq := map[string]any{
+		"CertificateAuthorityArn": iss.CertificateAuthorityARN,
+		"CertificateArn":          issueResp.CertificateArn,
+	}
+	for {
+		var getResp struct {
+			Certificate      string
+			CertificateChain string
+		}
+		err := iss.call(ctx, "GetCertificate", getReq, &getResp)
+		if err == nil {
+			bundle := strings.TrimSpace(getResp.Certificate) + "\n" + strings.TrimSpace(getResp.CertificateChain) + "\n"
+			return &IssuedCertificate{
+				Certificate: []byte(bundle),
+				Metadata:    map[string]string{"certificate_arn": issueResp.CertificateArn},
+			}, nil
+		}
+		var awsErr awsAPIError
+		if !errors.As(err, &awsErr) || awsErr.Type != "RequestInProgressException" {
+			return nil, err
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Revoke revokes the given certificate.
+func (iss *AWSPCAIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
+	if err != nil {
+		return err
+	}
+	revocationReason, ok := awsRevocationReasons[reason]
+	if !ok {
+		return fmt.Errorf("revocation reason %d is not supported by AWS Private CA", reason)
+	}
+	serial := certs[0].SerialNumber.Bytes()
+	hexParts := make([]string, len(serial))
+	for i, b := range serial {
+		hexParts[i] = fmt.Sprintf("%02x", b)
+	}
+	return iss.call(ctx, "RevokeCertificate", map[string]any{
+		"CertificateAuthorityArn": iss.CertificateAuthorityARN,
+		"CertificateSerial":       strings.Join(hexParts, ":"),
+		"RevocationReason":        revocationReason,
+	}, nil)
+}
+
+// call calls the ACM PCA API action with in as the request,
+// decoding the response into out, if not nil.
+func (iss *AWSPCAIssuer) call(ctx context.Context, action string, in, out any) error {
+	region := iss.Region
+	if region == "" {
+		// arn:aws:acm-pca:<region>:<account>:certificate-authority/<id>
+		if parts := strings.Split(iss.CertificateAuthorityARN, ":"); len(parts) > 3 {
+			region = parts[3]
+		}
+	}
+	if region == "" {
+		return ErrNoRetry{fmt.Errorf("AWS PCA issuer: unknown region")}
+	}
+	endpoint := iss.Endpoint
+	if endpoint == "" {
+		endpoint = "https://acm-pca." + region + ".amazonaws.com/"
+	}
+	creds := iss.Credentials
+	if creds == nil {
+		creds = &AWSCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return ErrNoRetry{fmt.Errorf("AWS PCA issuer: no credentials")}
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "ACMPrivateCA."+action)
+	req.Header.Set("User-Agent", buildUAString())
+	signAWSRequest(req, body, *creds, region, "acm-pca", time.Now())
+
+	resp, err := httpClientFor(ctx, iss.HTTPClient, HTTPTimeout).Do(req)
+	if err != nil {
+		return fmt.Errorf("AWS PCA %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return fmt.Errorf("AWS PCA %s: reading response: %v", action, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		awsErr := awsAPIError{StatusCode: resp.StatusCode}
+		_ = json.Unmarshal(respBody, &awsErr)
+		// the type may be qualified, like "aws.protocol#ErrorName"
+		if i := strings.LastIndex(awsErr.Type, "#"); i >= 0 {
+			awsErr.Type = awsErr.Type[i+1:]
+		}
+		if resp.StatusCode < 500 && awsErr.Type != "RequestInProgressException" &&
+			awsErr.Type != "ThrottlingException" && awsErr.Type != "TooManyRequestsException" {
+			return ErrNoRetry{fmt.Errorf("AWS PCA %s: %w", action, awsErr)}
+		}
+		return fmt.Errorf("AWS PCA %s: %w", action, awsErr)
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("AWS PCA %s: decoding response: %v", action, err)
+		}
+	}
+	return nil
+}
+
+func (iss *AWSPCAIssuer) logger() *zap.Logger {
+	if iss.Logger != nil {
+		return iss.Logger
+	}
+	return zap.NewNop()
+}
+
+// awsAPIError is an error response from an AWS JSON API.
+type awsAPIError struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"__type"`
+	Message    string `json:"message"`
+}
+
+func (e awsAPIError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to req, whose body is body.
+func signAWSRequest(req *http.Request, body []byte, creds AWSCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	bodyHash := sha256.Sum256(body)
+
+	// canonical headers: host and all x-amz-* and content-type headers
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsRevocationReasons maps RFC 5280 reason codes to those of ACM PCA.
+var awsRevocationReasons = map[int]string{
+	0:  "UNSPECIFIED",
+	1:  "KEY_COMPROMISE",
+	2:  "CERTIFICATE_AUTHORITY_COMPROMISE",
+	3:  "AFFILIATION_CHANGED",
+	4:  "SUPERSEDED",
+	5:  "CESSATION_OF_OPERATION",
+	9:  "PRIVILEGE_WITHDRAWN",
+	10: "A_A_COMPROMISE",
+}
+
+// Interface guards
+var (
+	_ Issuer  = (*AWSPCAIssuer)(nil)
+	_ Revoker = (*AWSPCAIssuer)(nil)
+)
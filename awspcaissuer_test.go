@@ -0,0 +1,180 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// the get-vanilla case of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Errorf("Expected Authorization header:\n%s\nGot:\n%s", expected, actual)
+	}
+}
+
+func TestAWSPCAIssuer(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const caARN = "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/abcd-1234"
+	const certARN = caARN + "/certificate/cert1"
+
+	var issued []byte
+	var polls int
+	var revokedSerial, revokedReason string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/acm-pca/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"__type":"AccessDeniedException","message":"bad signature"}`))
+			return
+		}
+		var req map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["CertificateAuthorityArn"] != caARN {
+			t.Errorf("Expected CA ARN %s, got %v", caARN, req["CertificateAuthorityArn"])
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "ACMPrivateCA.IssueCertificate":
+			if req["SigningAlgorithm"] != "SHA256WITHECDSA" || req["TemplateArn"] != "arn:template" {
+				t.Errorf("Unexpected options in request: %v", req)
+			}
+			var csrPEM []byte
+			_ = json.Unmarshal([]byte(`"`+req["Csr"].(string)+`"`), &csrPEM)
+			block, _ := pem.Decode(csrPEM)
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Errorf("Parsing CSR: %v", err)
+				return
+			}
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(0xabcdef),
+				Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now().Add(-time.Minute),
+				NotAfter:     time.Now().Add(24 * time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, caKey)
+			if err != nil {
+				t.Errorf("Creating certificate: %v", err)
+				return
+			}
+			issued = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			_, _ = w.Write([]byte(`{"CertificateArn":"` + certARN + `"}`))
+		case "ACMPrivateCA.GetCertificate":
+			if polls++; polls < 2 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"__type":"RequestInProgressException","message":"not yet"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"Certificate":      string(issued),
+				"CertificateChain": string(issued),
+			})
+		case "ACMPrivateCA.RevokeCertificate":
+			revokedSerial, _ = req["CertificateSerial"].(string)
+			revokedReason, _ = req["RevocationReason"].(string)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"InvalidAction"}`))
+		}
+	}))
+	defer server.Close()
+
+	iss := &AWSPCAIssuer{
+		CertificateAuthorityARN: caARN,
+		TemplateARN:             "arn:template",
+		SigningAlgorithm:        "SHA256WITHECDSA",
+		Credentials:             &AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		Endpoint:                server.URL,
+		PollInterval:            time.Millisecond,
+	}
+	if iss.IssuerKey() != "awspca-abcd-1234" {
+		t.Errorf("Unexpected issuer key: %s", iss.IssuerKey())
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"internal.example.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	result, err := iss.Issue(ctx, csr)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if polls != 2 {
+		t.Errorf("Expected to poll 2 times, polled %d", polls)
+	}
+	certs, err := parseCertsFromPEMBundle(result.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].DNSNames[0] != "internal.example.com" {
+		t.Errorf("Unexpected certificate chain: %d certificates", len(certs))
+	}
+
+	err = iss.Revoke(ctx, CertificateResource{CertificatePEM: result.Certificate}, 4)
+	if err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if revokedSerial != "ab:cd:ef" || revokedReason != "SUPERSEDED" {
+		t.Errorf("Unexpected revocation: serial=%s reason=%s", revokedSerial, revokedReason)
+	}
+
+	// client errors are not retried
+	iss.Credentials = &AWSCredentials{AccessKeyID: "wrong", SecretAccessKey: "secret"}
+	_, err = iss.Issue(ctx, csr)
+	if _, ok := err.(ErrNoRetry); !ok {
+		t.Errorf("Expected ErrNoRetry, got %T: %v", err, err)
+	}
+}
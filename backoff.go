@@ -0,0 +1,287 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NameBackoffPolicy configures how long to back off from issuing
+// certificates for names that are unsuitable for issuance: names whose
+// CAA records forbid it, that don't resolve, or that the CA rejects
+// outright. Backoff is kept in storage, so that it holds across
+// restarts and for all instances sharing the storage; after fixing
+// the cause, operators can call Config.ResetBackoff to try right away.
+//
+// EXPERIMENTAL: Subject to change.
+type NameBackoffPolicy struct {
+	// How long to back off after the first failure;
+	// it doubles with each failure after that.
+	// Default: 1 hour.
+	Initial time.Duration
+
+	// The longest to back off. Default: 7 days.
+	Max time.Duration
+}
+
+// duration returns how long to back off after the given number of
+// failures in a row.
+func (p *NameBackoffPolicy) duration(failures int) time.Duration {
+	initial, maxBackoff := p.Initial, p.Max
+	if initial <= 0 {
+		initial = DefaultNameBackoffInitial
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultNameBackoffMax
+	}
+	backoff := initial
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// NameBackoff is the backoff state of a name that is unsuitable
+// for issuance.
+//
+// EXPERIMENTAL: Subject to change.
+type NameBackoff struct {
+	// The name that is backed off from.
+	Name string `json:"name"`
+
+	// The kind of error that made the name unsuitable
+	// (CAErrorDNS or CAErrorRejected), and the error.
+	Kind  CAErrorKind `json:"kind"`
+	Error string      `json:"error"`
+
+	// How many attempts failed in a row.
+	Failures int `json:"failures"`
+
+	// When the first attempt in a row failed, and
+	// until when not to try again.
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+// BackoffFor returns the backoff state of name, if issuance for it is
+// backed off (see NameBackoff). A backoff that has ended is returned
+// until the name succeeds or fails again.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) BackoffFor(ctx context.Context, name string) (NameBackoff, bool) {
+	cfg = cfg.current()
+	backoff, err := cfg.loadNameBackoff(ctx, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			cfg.Logger.Error("loading backoff", zap.String("identifier", name), zap.Error(err))
+		}
+		return NameBackoff{}, false
+	}
+	return backoff, true
+}
+
+// ResetBackoff forgets the backoff of name, so that the certificate
+// for it can be obtained or renewed right away, e.g. after its DNS
+// was fixed. Retries that are waiting in this process are woken up.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) ResetBackoff(ctx context.Context, name string) error {
+	cfg = cfg.current()
+	if err := cfg.Storage.Delete(ctx, nameBackoffKey(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting backoff of %s: %w", name, err)
+	}
+	cfg.Logger.Info("reset backoff", zap.String("identifier", name))
+	cfg.certCache.backoffResets.broadcast()
+	return nil
+}
+
+// checkBackoff returns an error if issuance for any of names is
+// backed off; the error says until when.
+func (cfg *Config) checkBackoff(ctx context.Context, names []string) error {
+	if cfg.NameBackoff == nil {
+		return nil
+	}
+	for _, name := range names {
+		backoff, err := cfg.loadNameBackoff(ctx, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			// not knowing is no reason to not try
+			cfg.Logger.Error("loading backoff", zap.String("identifier", name), zap.Error(err))
+			continue
+		}
+		if time.Now().Before(backoff.Until) {
+			return CAError{
+				Kind:       backoff.Kind,
+				Identifier: name,
+				RetryAfter: backoff.Until,
+				Err: fmt.Errorf("backing off from issuing for %s until %s after %d failures: %s",
+					name, backoff.Until.UTC().Format(time.RFC3339), backoff.Failures, backoff.Error),
+			}
+		}
+	}
+	return nil
+}
+
+// recordBackoff records, for names, the result of an attempt to obtain
+// or renew a certificate: it backs off from names that err says are
+// unsuitable for issuance, and forgets the backoff of names otherwise.
+// It returns err, which says until when to back off if it does.
+func (cfg *Config) recordBackoff(ctx context.Context, names []string, err error) error {
+	if cfg.NameBackoff == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	unsuitable, kind := unsuitableNames(names, err)
+	if len(unsuitable) == 0 {
+		if err != nil {
+			// the names may be fine; this says nothing about them
+			return err
+		}
+		for _, name := range names {
+			if err := cfg.Storage.Delete(ctx, nameBackoffKey(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				cfg.Logger.Error("deleting backoff", zap.String("identifier", name), zap.Error(err))
+			}
+		}
+		return nil
+	}
+
+	var until time.Time
+	now := time.Now()
+	for _, name := range unsuitable {
+		backoff, loadErr := cfg.loadNameBackoff(ctx, name)
+		if loadErr != nil {
+			backoff = NameBackoff{Name: name, Since: now}
+		}
+		backoff.Kind = kind
+		backoff.Error = err.Error()
+		backoff.Failures++
+		backoff.Until = now.Add(cfg.NameBackoff.duration(backoff.Failures))
+		until = maxTime(until, backoff.Until)
+
+		backoffJSON, err := json.Marshal(backoff)
+		if err == nil {
+			err = cfg.Storage.Store(ctx, nameBackoffKey(name), backoffJSON)
+		}
+		if err != nil {
+			cfg.Logger.Error("storing backoff", zap.String("identifier", name), zap.Error(err))
+		}
+		cfg.Logger.Warn("backing off from unsuitable name",
+			zap.String("identifier", name),
+			zap.String("kind", string(kind)),
+			zap.Int("failures", backoff.Failures),
+			zap.Time("until", backoff.Until))
+	}
+
+	// no point in retrying before the backoff ends
+	if caErr, ok := ClassifyCAError(err); ok && caErr.RetryAfter.Before(until) {
+		caErr.RetryAfter = until
+		return caErr
+	}
+	return err
+}
+
+// unsuitableNames returns which of names err says are unsuitable for
+// issuance, and the kind of error it is.
+func unsuitableNames(names []string, err error) ([]string, CAErrorKind) {
+	if err == nil {
+		return nil, ""
+	}
+	var caaErr CAAError
+	if errors.As(err, &caaErr) {
+		return []string{caaErr.Name}, CAErrorDNS
+	}
+	caErr, ok := ClassifyCAError(err)
+	if !ok || (caErr.Kind != CAErrorDNS && caErr.Kind != CAErrorRejected) {
+		return nil, ""
+	}
+	if caErr.Identifier != "" {
+		return []string{caErr.Identifier}, caErr.Kind
+	}
+	return names, caErr.Kind
+}
+
+func (cfg *Config) loadNameBackoff(ctx context.Context, name string) (NameBackoff, error) {
+	var backoff NameBackoff
+	backoffJSON, err := cfg.Storage.Load(ctx, nameBackoffKey(name))
+	if err != nil {
+		return backoff, err
+	}
+	if err := json.Unmarshal(backoffJSON, &backoff); err != nil {
+		return backoff, fmt.Errorf("decoding backoff of %s: %v", name, err)
+	}
+	return backoff, nil
+}
+
+func nameBackoffKey(name string) string {
+	return path.Join(prefixBackoff, StorageKeys.safeSubject(name)+".json")
+}
+
+// backoffResets wakes up retries when backoff is reset.
+type backoffResets struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel that is closed at the next reset.
+func (br *backoffResets) wait() <-chan struct{} {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.ch == nil {
+		br.ch = make(chan struct{})
+	}
+	return br.ch
+}
+
+func (br *backoffResets) broadcast() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.ch != nil {
+		close(br.ch)
+		br.ch = nil
+	}
+}
+
+// backoffReset returns a channel that is closed when backoff is reset
+// in the cache of the operation of ctx; it is nil (blocks forever)
+// for contexts that are not of an operation.
+func backoffReset(ctx context.Context) <-chan struct{} {
+	resets, ok := ctx.Value(ctxKeyBackoffResets).(*backoffResets)
+	if !ok {
+		return nil
+	}
+	return resets.wait()
+}
+
+const ctxKeyBackoffResets = ctxKey("backoff_resets")
+
+// Defaults for NameBackoffPolicy.
+const (
+	DefaultNameBackoffInitial = time.Hour
+	DefaultNameBackoffMax     = 7 * 24 * time.Hour
+)
+
+const prefixBackoff = "backoff"
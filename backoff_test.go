@@ -0,0 +1,133 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestNameBackoffPolicyDuration(t *testing.T) {
+	p := &NameBackoffPolicy{Initial: time.Hour, Max: 5 * time.Hour}
+	for failures, expected := range []time.Duration{time.Hour, time.Hour, 2 * time.Hour, 4 * time.Hour, 5 * time.Hour, 5 * time.Hour} {
+		if actual := p.duration(failures); actual != expected {
+			t.Errorf("Expected %s after %d failures, got %s", expected, failures, actual)
+		}
+	}
+	if actual := new(NameBackoffPolicy).duration(100); actual != DefaultNameBackoffMax {
+		t.Errorf("Expected default maximum, got %s", actual)
+	}
+}
+
+func TestNameBackoffSharedAndReset(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	issuer := &gatedIssuer{gate: make(chan error, 1)}
+	cfg := newCertJobTestConfig(t, issuer)
+	cfg.NameBackoff = &NameBackoffPolicy{Initial: time.Hour}
+
+	issuer.gate <- acme.Problem{Type: acme.ProblemTypeDNS, Status: 400, Detail: "NXDOMAIN looking up A for nx.example.com"}
+	if err := cfg.ObtainCertSync(ctx, "nx.example.com"); err == nil {
+		t.Fatal("Expected obtain to fail")
+	}
+	backoff, ok := cfg.BackoffFor(ctx, "nx.example.com")
+	if !ok || backoff.Kind != CAErrorDNS || backoff.Failures != 1 || time.Until(backoff.Until) < 59*time.Minute {
+		t.Fatalf("Unexpected backoff: %+v (found=%t)", backoff, ok)
+	}
+
+	// another instance sharing storage backs off too,
+	// without asking the issuer (which would block)
+	other := newCertJobTestConfig(t, issuer)
+	other.Storage = cfg.Storage
+	other.NameBackoff = cfg.NameBackoff
+	err := other.ObtainCertSync(ctx, "nx.example.com")
+	var caErr CAError
+	if !errors.As(err, &caErr) || !caErr.RetryAfter.Equal(backoff.Until) {
+		t.Fatalf("Expected backoff error, got %v", err)
+	}
+
+	// after a reset, the name is tried again
+	if err := other.ResetBackoff(ctx, "nx.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.BackoffFor(ctx, "nx.example.com"); ok {
+		t.Error("Expected backoff to be reset")
+	}
+	issuer.gate <- nil
+	if err := cfg.ObtainCertSync(ctx, "nx.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsuitableNames(t *testing.T) {
+	names := []string{"a.example.com", "b.example.com"}
+	if unsuitable, kind := unsuitableNames(names, acme.Problem{
+		Type: acme.ProblemTypeCompound,
+		Subproblems: []acme.Subproblem{
+			{Problem: acme.Problem{Type: acme.ProblemTypeCAA}, Identifier: acme.Identifier{Value: "b.example.com"}},
+		},
+	}); len(unsuitable) != 1 || unsuitable[0] != "b.example.com" || kind != CAErrorDNS {
+		t.Errorf("Expected only the name with the subproblem to be unsuitable, got %v (%s)", unsuitable, kind)
+	}
+	if unsuitable, _ := unsuitableNames(names, ErrNoRetry{CAAError{Name: "a.example.com"}}); len(unsuitable) != 1 || unsuitable[0] != "a.example.com" {
+		t.Errorf("Expected name forbidden by CAA to be unsuitable, got %v", unsuitable)
+	}
+	if unsuitable, _ := unsuitableNames(names, acme.Problem{Type: acme.ProblemTypeServerInternal}); len(unsuitable) != 0 {
+		t.Errorf("Expected server errors to say nothing about names, got %v", unsuitable)
+	}
+}
+
+func TestBackoffResetWakesRetries(t *testing.T) {
+	resets := new(backoffResets)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = context.WithValue(ctx, ctxKeyBackoffResets, resets)
+
+	var calls int
+	done := make(chan error)
+	go func() {
+		done <- doWithRetry(ctx, defaultTestLogger, nil, func(context.Context) error {
+			calls++
+			if calls == 1 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+	}()
+
+	// the retry would be a minute away
+	var err error
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case err = <-done:
+			break wait
+		case <-ticker.C:
+			resets.broadcast()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected a retry right after the reset, got %d calls", calls)
+	}
+}
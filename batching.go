@@ -0,0 +1,161 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IssuanceBatching coalesces names that need a certificate around the
+// same time into one certificate with several names (SANs), so that
+// deployments that manage many related names place far fewer orders
+// with their CA, and stay clear of rate limits.
+//
+// A batched certificate is stored for each of its names, so that each
+// can be loaded and checked by itself, and it is renewed for all of
+// its names at once. Names that have a SubjectOverride, and on-demand
+// certificates, are not batched.
+//
+// EXPERIMENTAL: Subject to change.
+type IssuanceBatching struct {
+	// The maximum number of names on a certificate.
+	// Default: 100 (the limit of Let's Encrypt).
+	MaxSANs int
+
+	// How long to wait for more names after the first
+	// name of a batch before obtaining its certificate.
+	// Default: 2s.
+	Window time.Duration
+
+	// An optional function that returns the group of a
+	// name; only names of the same group are batched,
+	// e.g. the names of one customer. Return "" to not
+	// batch a name. Default: all names are in one group.
+	Group func(name string) string
+}
+
+// batchesIssuance returns whether certificates for name are obtained
+// in batches.
+func (cfg *Config) batchesIssuance(name string) bool {
+	if cfg.IssuanceBatching == nil || cfg.OnDemand != nil {
+		return false
+	}
+	if _, ok := cfg.subjectOverride(name); ok {
+		return false
+	}
+	if cfg.IssuanceBatching.Group != nil && cfg.IssuanceBatching.Group(name) == "" {
+		return false
+	}
+	return true
+}
+
+// issuanceBatches collects the names of batches that are not full
+// yet, by config and group.
+type issuanceBatches struct {
+	mu      sync.Mutex
+	pending map[issuanceBatchKey]*issuanceBatch
+}
+
+type issuanceBatchKey struct {
+	cfg   *Config
+	group string
+}
+
+type issuanceBatch struct {
+	names       []string
+	interactive bool
+	done        chan struct{}
+	err         error
+}
+
+// obtain adds name to a batch, and waits until the certificate for
+// the batch has been obtained. The batch is obtained when it is full,
+// or when the window of its first name has passed.
+func (b *issuanceBatches) obtain(ctx context.Context, cfg *Config, name string, interactive bool) error {
+	batching := cfg.IssuanceBatching
+	maxSANs := batching.MaxSANs
+	if maxSANs <= 0 {
+		maxSANs = 100
+	}
+	window := batching.Window
+	if window <= 0 {
+		window = 2 * time.Second
+	}
+	key := issuanceBatchKey{cfg: cfg}
+	if batching.Group != nil {
+		key.group = batching.Group(name)
+	}
+
+	b.mu.Lock()
+	if b.pending == nil {
+		b.pending = make(map[issuanceBatchKey]*issuanceBatch)
+	}
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &issuanceBatch{done: make(chan struct{})}
+		b.pending[key] = batch
+		// the batch may outlive the context of its first name,
+		// since other names are waiting for it too
+		batchCtx := context.WithoutCancel(ctx)
+		time.AfterFunc(window, func() { b.flush(batchCtx, cfg, key, batch) })
+	}
+	if !slices.Contains(batch.names, name) {
+		batch.names = append(batch.names, name)
+	}
+	// a batch is interactive (not retried) only if all its names are
+	if len(batch.names) == 1 {
+		batch.interactive = interactive
+	} else {
+		batch.interactive = batch.interactive && interactive
+	}
+	full := len(batch.names) >= maxSANs
+	b.mu.Unlock()
+
+	if full {
+		go b.flush(context.WithoutCancel(ctx), cfg, key, batch)
+	}
+
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush obtains the certificate for batch, unless it is already
+// being obtained.
+func (b *issuanceBatches) flush(ctx context.Context, cfg *Config, key issuanceBatchKey, batch *issuanceBatch) {
+	b.mu.Lock()
+	if b.pending[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	names, interactive := batch.names, batch.interactive
+	b.mu.Unlock()
+
+	log := cfg.Logger.Named("obtain")
+	log.Info("obtaining certificate for batch of names",
+		zap.Int("count", len(names)),
+		zap.String("group", key.group))
+	batch.err = cfg.obtainCertForNames(ctx, log, names, interactive)
+	close(batch.done)
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingIssuer struct {
+	testIssuer
+	orders atomic.Int32
+}
+
+func (ci *countingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	ci.orders.Add(1)
+	return ci.testIssuer.Issue(ctx, csr)
+}
+
+func TestIssuanceBatching(t *testing.T) {
+	issuer := new(countingIssuer)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		IssuanceBatching: &IssuanceBatching{
+			MaxSANs: 3,
+			Window:  time.Minute, // only full batches are obtained in time
+			Group: func(name string) string {
+				if strings.HasSuffix(name, ".alone.example") {
+					return ""
+				}
+				return name[strings.Index(name, ".")+1:]
+			},
+		},
+	})
+	ctx := context.Background()
+
+	// a full batch of names is obtained with one order
+	names := []string{"a.one.example", "b.one.example", "c.one.example"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = cfg.ObtainCertSync(ctx, name)
+		}(i, name)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Obtaining %s: %v", names[i], err)
+		}
+	}
+	if n := issuer.orders.Load(); n != 1 {
+		t.Errorf("Expected one order for the batch, got %d", n)
+	}
+
+	// the certificate is stored for each name
+	for _, name := range names {
+		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+		if err != nil {
+			t.Fatalf("Loading certificate for %s: %v", name, err)
+		}
+		sans := slices.Sorted(slices.Values(certRes.SANs))
+		if !certRes.Batched || !reflect.DeepEqual(sans, names) {
+			t.Errorf("Expected batched certificate for %v stored for %s, got %v (batched=%t)", names, name, certRes.SANs, certRes.Batched)
+		}
+	}
+
+	// it is renewed for all of its names
+	if err := cfg.RenewCertSync(ctx, "b.one.example", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := issuer.orders.Load(); n != 2 {
+		t.Errorf("Expected one more order for the renewal, got %d", n)
+	}
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, "c.one.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certRes.Batched || len(certs[0].DNSNames) != 3 {
+		t.Errorf("Expected renewed certificate for all names, got %v", certs[0].DNSNames)
+	}
+
+	// names that aren't batched are obtained by themselves
+	if err := cfg.ObtainCertSync(ctx, "x.alone.example"); err != nil {
+		t.Fatal(err)
+	}
+	if n := issuer.orders.Load(); n != 3 {
+		t.Errorf("Expected an order for the name that isn't batched, got %d", n)
+	}
+	certRes, err = cfg.loadCertResourceAnyIssuer(ctx, "x.alone.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certRes.Batched || len(certRes.SANs) != 1 {
+		t.Errorf("Expected certificate for one name, got %v (batched=%t)", certRes.SANs, certRes.Batched)
+	}
+}
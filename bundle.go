@@ -0,0 +1,420 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/scrypt"
+)
+
+// BundleOptions configures ExportBundle and ImportBundle.
+//
+// EXPERIMENTAL: Subject to change.
+type BundleOptions struct {
+	// The passphrase the bundle is encrypted with. REQUIRED.
+	Passphrase string
+
+	// If set, only certificates managed for these names are
+	// exported. Wildcard names are written like "*.example.com".
+	// Default: all certificates.
+	Names []string
+
+	// If set, only certificates and accounts of the issuers
+	// with these keys are exported. Default: all issuers.
+	Issuers []string
+
+	// Whether to export ACME accounts, too.
+	Accounts bool
+
+	// When importing, whether to replace certificates and
+	// accounts that exist in storage already; otherwise they
+	// are kept, and those in the bundle are not imported.
+	Overwrite bool
+
+	// Optional logger.
+	Logger *zap.Logger
+}
+
+// BundleItem describes a certificate or account in a bundle.
+//
+// EXPERIMENTAL: Subject to change.
+type BundleItem struct {
+	// "certificate" or "account".
+	Kind string `json:"kind"`
+
+	// The storage key of the issuer (for accounts, of the
+	// CA, which is the same for ACME issuers).
+	Issuer string `json:"issuer"`
+
+	// The name the certificate is managed for, or the
+	// email address of the account.
+	Name string `json:"name"`
+}
+
+// ExportBundle writes the selected certificates, their private keys and
+// metadata, and optionally ACME accounts, from storage into a single
+// archive encrypted with opts.Passphrase, for backups or migrating to
+// other storage. The bundle does not depend on how assets are laid out
+// in storage; ImportBundle puts them where they belong. OCSP staples
+// and certificate history are not exported.
+//
+// It returns the items that were exported.
+//
+// EXPERIMENTAL: Subject to change.
+func ExportBundle(ctx context.Context, storage Storage, w io.Writer, opts BundleOptions) ([]BundleItem, error) {
+	if opts.Passphrase == "" {
+		return nil, fmt.Errorf("passphrase is required")
+	}
+
+	contents := bundleContents{Created: time.Now().UTC()}
+	if err := contents.collectCertificates(ctx, storage, opts); err != nil {
+		return nil, err
+	}
+	if opts.Accounts {
+		if err := contents.collectAccounts(ctx, storage, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, fmt.Errorf("encoding bundle: %v", err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	envelope := bundleEnvelope{
+		Format:  bundleFormat,
+		Version: 1,
+		KDF:     "scrypt",
+		N:       1 << 15,
+		R:       8,
+		P:       1,
+		Salt:    make([]byte, 16),
+	}
+	if _, err := io.ReadFull(rand.Reader, envelope.Salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %v", err)
+	}
+	key, err := envelope.key(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext, err = sealAESGCM(key, compressed.Bytes(), []byte(bundleFormat))
+	if err != nil {
+		return nil, fmt.Errorf("encrypting bundle: %v", err)
+	}
+
+	if err := json.NewEncoder(w).Encode(envelope); err != nil {
+		return nil, fmt.Errorf("writing bundle: %v", err)
+	}
+	return contents.items(), nil
+}
+
+// ImportBundle reads a bundle written by ExportBundle and stores its
+// certificates and accounts in storage. Unless opts.Overwrite is set,
+// assets that exist already are kept. The selection options (Names,
+// Issuers, Accounts) are ignored; everything in the bundle is imported.
+// Imported certificates are managed like any other once they are
+// loaded into the cache, for example by ManageSync or a TLS handshake.
+//
+// It returns the items that were imported.
+//
+// EXPERIMENTAL: Subject to change.
+func ImportBundle(ctx context.Context, storage Storage, r io.Reader, opts BundleOptions) ([]BundleItem, error) {
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger.Named("bundle")
+	}
+
+	var envelope bundleEnvelope
+	if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("reading bundle: %v", err)
+	}
+	if envelope.Format != bundleFormat || envelope.Version != 1 {
+		return nil, fmt.Errorf("not a supported bundle (format=%q version=%d)", envelope.Format, envelope.Version)
+	}
+	key, err := envelope.key(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := openAESGCM(key, envelope.Ciphertext, []byte(bundleFormat))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting bundle (wrong passphrase?): %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing bundle: %v", err)
+	}
+	var contents bundleContents
+	if err := json.NewDecoder(gz).Decode(&contents); err != nil {
+		return nil, fmt.Errorf("decoding bundle: %v", err)
+	}
+
+	var imported []BundleItem
+	for _, cert := range contents.Certificates {
+		item := BundleItem{Kind: "certificate", Issuer: cert.Issuer, Name: cert.Name}
+		ok, err := importBundleCertificate(ctx, storage, cert, opts.Overwrite)
+		if err != nil {
+			return imported, fmt.Errorf("importing certificate for %s: %v", cert.Name, err)
+		}
+		if !ok {
+			opts.Logger.Info("certificate exists already; skipping", zap.String("issuer", cert.Issuer), zap.String("name", cert.Name))
+			continue
+		}
+		imported = append(imported, item)
+	}
+	for _, acct := range contents.Accounts {
+		item := BundleItem{Kind: "account", Issuer: acct.Issuer, Name: acct.Email}
+		regKey, privKey := acct.storageKeys()
+		if !opts.Overwrite && storage.Exists(ctx, regKey) {
+			opts.Logger.Info("account exists already; skipping", zap.String("issuer", acct.Issuer), zap.String("email", acct.Email))
+			continue
+		}
+		err := storeTx(ctx, storage, []keyValue{
+			{key: privKey, value: acct.PrivateKeyPEM},
+			{key: regKey, value: acct.Registration},
+		})
+		if err != nil {
+			return imported, fmt.Errorf("importing account %s: %v", acct.Email, err)
+		}
+		imported = append(imported, item)
+	}
+
+	opts.Logger.Info("imported bundle",
+		zap.Time("created", contents.Created),
+		zap.Int("items", len(imported)))
+
+	return imported, nil
+}
+
+// importBundleCertificate stores cert, unless it exists and overwrite is
+// false, while holding its issuance lock so it doesn't race renewals.
+func importBundleCertificate(ctx context.Context, storage Storage, cert bundleCertificate, overwrite bool) (bool, error) {
+	lockKey := fmt.Sprintf("%s_%s", certIssueLockOp, cert.Name)
+	if err := acquireLock(ctx, storage, lockKey); err != nil {
+		return false, fmt.Errorf("unable to acquire lock: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, storage, lockKey); err != nil {
+			defaultLogger.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	if !overwrite && storage.Exists(ctx, StorageKeys.SiteCert(cert.Issuer, cert.Name)) {
+		return false, nil
+	}
+	return true, storeTx(ctx, storage, []keyValue{
+		{key: StorageKeys.SitePrivateKey(cert.Issuer, cert.Name), value: cert.PrivateKeyPEM},
+		{key: StorageKeys.SiteCert(cert.Issuer, cert.Name), value: cert.CertificatePEM},
+		{key: StorageKeys.SiteMeta(cert.Issuer, cert.Name), value: cert.Metadata},
+	})
+}
+
+const bundleFormat = "certmagic-bundle"
+
+// bundleEnvelope is the encrypted bundle as it is written.
+type bundleEnvelope struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// key derives the key the bundle is encrypted with from passphrase.
+func (env bundleEnvelope) key(passphrase string) ([]byte, error) {
+	if env.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", env.KDF)
+	}
+	// don't let a crafted bundle make us use excessive memory
+	if env.N > 1<<20 || env.R > 32 || env.P > 16 {
+		return nil, fmt.Errorf("key derivation parameters too large")
+	}
+	key, err := scrypt.Key([]byte(passphrase), env.Salt, env.N, env.R, env.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key from passphrase: %v", err)
+	}
+	return key, nil
+}
+
+// bundleContents is what a bundle contains, once decrypted.
+type bundleContents struct {
+	Created      time.Time           `json:"created"`
+	Certificates []bundleCertificate `json:"certificates,omitempty"`
+	Accounts     []bundleAccount     `json:"accounts,omitempty"`
+}
+
+type bundleCertificate struct {
+	Issuer         string `json:"issuer"`
+	Name           string `json:"name"`
+	CertificatePEM []byte `json:"certificate_pem"`
+	PrivateKeyPEM  []byte `json:"private_key_pem"`
+	Metadata       []byte `json:"metadata"`
+}
+
+type bundleAccount struct {
+	Issuer          string `json:"issuer"`
+	ExternalAccount string `json:"external_account,omitempty"`
+	Email           string `json:"email"`
+	Registration    []byte `json:"registration"`
+	PrivateKeyPEM   []byte `json:"private_key_pem"`
+}
+
+// storageKeys returns the storage keys of the account's registration
+// and private key, like ACMEIssuer does.
+func (acct bundleAccount) storageKeys() (string, string) {
+	usersPrefix := path.Join(storageKeyACMECAPrefix(acct.Issuer), "users")
+	if acct.ExternalAccount != "" {
+		usersPrefix = path.Join(storageKeyACMECAPrefix(acct.Issuer), "external_accounts", StorageKeys.Safe(acct.ExternalAccount), "users")
+	}
+	userPrefix := path.Join(usersPrefix, StorageKeys.Safe(acct.Email))
+	username := StorageKeys.Safe(new(ACMEIssuer).emailUsername(acct.Email))
+	regName, keyName := username, username
+	if username == "" {
+		regName, keyName = "registration", "private"
+	}
+	return path.Join(userPrefix, regName+".json"), path.Join(userPrefix, keyName+".key")
+}
+
+func (bc *bundleContents) collectCertificates(ctx context.Context, storage Storage, opts BundleOptions) error {
+	issuerKeys, err := storage.List(ctx, prefixCerts, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing issuers: %v", err)
+	}
+	for _, issuerPrefix := range issuerKeys {
+		issuer := path.Base(issuerPrefix)
+		if !bundleSelects(opts.Issuers, issuer) {
+			continue
+		}
+		siteKeys, err := storage.List(ctx, issuerPrefix, false)
+		if err != nil {
+			return fmt.Errorf("listing certificates of %s: %v", issuer, err)
+		}
+		for _, siteKey := range siteKeys {
+			safeName := path.Base(siteKey)
+			if !bundleSelects(opts.Names, safeName) {
+				continue
+			}
+			cert := bundleCertificate{Issuer: issuer, Name: safeName}
+			if cert.CertificatePEM, err = storage.Load(ctx, StorageKeys.SiteCert(issuer, safeName)); errors.Is(err, fs.ErrNotExist) {
+				continue // not a complete certificate, like an orphaned key
+			} else if err != nil {
+				return fmt.Errorf("loading certificate for %s: %v", safeName, err)
+			}
+			if cert.PrivateKeyPEM, err = storage.Load(ctx, StorageKeys.SitePrivateKey(issuer, safeName)); err != nil {
+				return fmt.Errorf("loading private key for %s: %v", safeName, err)
+			}
+			if cert.Metadata, err = storage.Load(ctx, StorageKeys.SiteMeta(issuer, safeName)); err != nil {
+				return fmt.Errorf("loading metadata for %s: %v", safeName, err)
+			}
+
+			// prefer the actual name over the storage-safe one, for readability
+			var meta CertificateResource
+			if err := json.Unmarshal(cert.Metadata, &meta); err == nil {
+				if i := slices.IndexFunc(meta.SANs, func(san string) bool { return StorageKeys.Safe(san) == safeName }); i >= 0 {
+					cert.Name = meta.SANs[i]
+				}
+			}
+
+			bc.Certificates = append(bc.Certificates, cert)
+		}
+	}
+	return nil
+}
+
+func (bc *bundleContents) collectAccounts(ctx context.Context, storage Storage, opts BundleOptions) error {
+	caKeys, err := storage.List(ctx, prefixACME, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing ACME CAs: %v", err)
+	}
+	for _, caPrefix := range caKeys {
+		issuer := path.Base(caPrefix)
+		if !bundleSelects(opts.Issuers, issuer) {
+			continue
+		}
+		usersPrefixes := map[string]string{path.Join(caPrefix, "users"): ""}
+		externalAccounts, _ := storage.List(ctx, path.Join(caPrefix, "external_accounts"), false)
+		for _, eab := range externalAccounts {
+			usersPrefixes[path.Join(eab, "users")] = path.Base(eab)
+		}
+
+		for usersPrefix, externalAccount := range usersPrefixes {
+			users, err := storage.List(ctx, usersPrefix, false)
+			if err != nil {
+				continue // no accounts
+			}
+			for _, userPrefix := range users {
+				acct := bundleAccount{Issuer: issuer, ExternalAccount: externalAccount, Email: path.Base(userPrefix)}
+				regKey, privKey := acct.storageKeys()
+				if acct.Registration, err = storage.Load(ctx, regKey); errors.Is(err, fs.ErrNotExist) {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("loading account %s: %v", acct.Email, err)
+				}
+				if acct.PrivateKeyPEM, err = storage.Load(ctx, privKey); err != nil {
+					return fmt.Errorf("loading private key of account %s: %v", acct.Email, err)
+				}
+				bc.Accounts = append(bc.Accounts, acct)
+			}
+		}
+	}
+	return nil
+}
+
+func (bc bundleContents) items() []BundleItem {
+	items := make([]BundleItem, 0, len(bc.Certificates)+len(bc.Accounts))
+	for _, cert := range bc.Certificates {
+		items = append(items, BundleItem{Kind: "certificate", Issuer: cert.Issuer, Name: cert.Name})
+	}
+	for _, acct := range bc.Accounts {
+		items = append(items, BundleItem{Kind: "account", Issuer: acct.Issuer, Name: acct.Email})
+	}
+	return items
+}
+
+// bundleSelects returns true if selection is empty or contains a value
+// that is stored as safe.
+func bundleSelects(selection []string, safe string) bool {
+	return len(selection) == 0 || slices.ContainsFunc(selection, func(s string) bool {
+		return StorageKeys.Safe(s) == safe
+	})
+}
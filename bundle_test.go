@@ -0,0 +1,107 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestExportImportBundle(t *testing.T) {
+	ctx := context.Background()
+	src := &FileStorage{Path: t.TempDir()}
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   src,
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+	for _, name := range []string{"*.example.com", "other.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	am := &ACMEIssuer{CA: "https://ca.example.com/directory"}
+	regKey := am.storageKeyUserReg(am.CA, "me@example.com")
+	keyKey := am.storageKeyUserPrivateKey(am.CA, "me@example.com")
+	src.Store(ctx, regKey, []byte(`{"status":"valid"}`))
+	src.Store(ctx, keyKey, []byte("account key"))
+
+	var bundle bytes.Buffer
+	opts := BundleOptions{Passphrase: "correct horse", Names: []string{"*.example.com"}, Accounts: true, Logger: defaultTestLogger}
+	exported, err := ExportBundle(ctx, src, &bundle, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 2 || exported[0].Name != "*.example.com" || exported[1].Name != "me@example.com" {
+		t.Fatalf("Expected wildcard certificate and account to be exported, got %+v", exported)
+	}
+	if bytes.Contains(bundle.Bytes(), []byte("account key")) {
+		t.Fatal("Bundle is not encrypted")
+	}
+
+	dst := &FileStorage{Path: t.TempDir()}
+	if _, err := ImportBundle(ctx, dst, bytes.NewReader(bundle.Bytes()), BundleOptions{Passphrase: "wrong", Logger: defaultTestLogger}); err == nil {
+		t.Fatal("Expected import with wrong passphrase to fail")
+	}
+	imported, err := ImportBundle(ctx, dst, bytes.NewReader(bundle.Bytes()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 {
+		t.Errorf("Expected 2 imported items, got %+v", imported)
+	}
+	for _, key := range []string{
+		StorageKeys.SiteCert("test_issuer", "*.example.com"),
+		StorageKeys.SitePrivateKey("test_issuer", "*.example.com"),
+		StorageKeys.SiteMeta("test_issuer", "*.example.com"),
+		regKey,
+		keyKey,
+	} {
+		orig, _ := src.Load(ctx, key)
+		if got, err := dst.Load(ctx, key); err != nil || !bytes.Equal(got, orig) {
+			t.Errorf("Expected %s to be imported unchanged, got err=%v", key, err)
+		}
+	}
+	if dst.Exists(ctx, StorageKeys.SiteCert("test_issuer", "other.example.com")) {
+		t.Error("Expected unselected certificate to not be exported")
+	}
+
+	// existing assets are kept unless overwriting
+	dst.Store(ctx, keyKey, []byte("newer account key"))
+	if imported, err := ImportBundle(ctx, dst, bytes.NewReader(bundle.Bytes()), opts); err != nil || len(imported) != 0 {
+		t.Errorf("Expected nothing to be imported again, got %+v (err=%v)", imported, err)
+	}
+	opts.Overwrite = true
+	if imported, err := ImportBundle(ctx, dst, bytes.NewReader(bundle.Bytes()), opts); err != nil || len(imported) != 2 {
+		t.Errorf("Expected everything to be overwritten, got %+v (err=%v)", imported, err)
+	}
+
+	// imported certificates can be managed
+	cfg.Storage = dst
+	if _, err := cfg.CacheManagedCertificate(ctx, "*.example.com"); err != nil {
+		t.Errorf("Expected imported certificate to be loadable: %v", err)
+	}
+}
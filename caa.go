@@ -0,0 +1,265 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// CAAPreflight enables checking the CAA records (RFC 8659) of names
+// before getting certificates for them from issuers that implement
+// CAAIdentifier. If the records don't allow the CA of an issuer to
+// issue for a name, the issuer is skipped with a CAAError instead of
+// placing an order that the CA would reject, and a "caa_forbidden"
+// event is emitted.
+//
+// Only the issuer domain names of "issue" and "issuewild" properties
+// are checked, not their parameters. If CAA records can't be looked
+// up, issuance proceeds, and the CA decides.
+//
+// EXPERIMENTAL: Subject to change.
+type CAAPreflight struct {
+	// The DNS resolvers to use. Default: the system's.
+	Resolvers []string
+
+	// How long to cache looked-up CAA records, so that the
+	// many renewals of a maintenance run don't repeat the
+	// same lookups. Default: 5m.
+	CacheDuration time.Duration
+}
+
+// CAAIdentifier is a type that can return the domain names that
+// identify its CA in CAA records, like "letsencrypt.org".
+//
+// EXPERIMENTAL: Subject to change.
+type CAAIdentifier interface {
+	CAAIdentities(ctx context.Context) ([]string, error)
+}
+
+// CAAError is returned if CAA records don't allow the CA of an
+// issuer to issue a certificate for a name.
+//
+// EXPERIMENTAL: Subject to change.
+type CAAError struct {
+	// The name whose CAA records forbid issuance.
+	Name string
+
+	// The issuer and the CAA identities of its CA.
+	Issuer     string
+	Identities []string
+
+	// The relevant CAA records, in presentation format,
+	// and the name they were found at.
+	Records  []string
+	RecordAt string
+}
+
+func (e CAAError) Error() string {
+	return fmt.Sprintf("CAA records at %s do not allow %s (CAA identities %v) to issue certificates for %s: %v",
+		e.RecordAt, e.Issuer, e.Identities, e.Name, e.Records)
+}
+
+// checkCAA returns a CAAError if the CAA records of any of names
+// forbid issuer to issue certificates for them.
+func (cfg *Config) checkCAA(ctx context.Context, issuer Issuer, names []string) error {
+	if cfg.CAAPreflight == nil {
+		return nil
+	}
+	identifier, ok := issuer.(CAAIdentifier)
+	if !ok {
+		return nil
+	}
+	identities, err := identifier.CAAIdentities(ctx)
+	if err != nil {
+		cfg.Logger.Warn("unable to get CAA identities of issuer; skipping CAA check",
+			zap.String("issuer", issuer.IssuerKey()),
+			zap.Error(err))
+		return nil
+	}
+	if len(identities) == 0 {
+		return nil
+	}
+	ctx = withConfig(ctx, cfg)
+
+	for _, name := range names {
+		if SubjectIsIP(name) {
+			continue
+		}
+		wildcard := strings.HasPrefix(name, "*.")
+		records, at, err := cfg.certCache.caaCache.relevantRecords(ctx, strings.TrimPrefix(name, "*."), cfg.CAAPreflight)
+		if err != nil {
+			cfg.Logger.Warn("unable to look up CAA records; skipping CAA check",
+				zap.String("identifier", name),
+				zap.Error(err))
+			continue
+		}
+		if caaPermits(records, identities, wildcard) {
+			continue
+		}
+		caaErr := CAAError{
+			Name:       name,
+			Issuer:     issuer.IssuerKey(),
+			Identities: identities,
+			RecordAt:   at,
+		}
+		for _, rec := range records {
+			caaErr.Records = append(caaErr.Records, fmt.Sprintf("%d %s %q", rec.Flag, rec.Tag, rec.Value))
+		}
+		cfg.emit(ctx, "caa_forbidden", map[string]any{
+			"identifier":     name,
+			"issuer":         caaErr.Issuer,
+			"caa_identities": identities,
+			"records":        caaErr.Records,
+			"record_name":    at,
+		})
+		return caaErr
+	}
+	return nil
+}
+
+// caaPermits returns whether the relevant CAA records allow a CA with
+// the given identities to issue a certificate, as in RFC 8659.
+func caaPermits(records []*dns.CAA, identities []string, wildcard bool) bool {
+	tag := "issue"
+	if wildcard && slices.ContainsFunc(records, func(rec *dns.CAA) bool { return strings.EqualFold(rec.Tag, "issuewild") }) {
+		tag = "issuewild"
+	}
+	for _, rec := range records {
+		if rec.Flag&128 != 0 && !slices.Contains(knownCAATags, strings.ToLower(rec.Tag)) {
+			return false // CAs must not issue if they don't understand a critical property
+		}
+	}
+	var restricted bool
+	for _, rec := range records {
+		if !strings.EqualFold(rec.Tag, tag) {
+			continue
+		}
+		restricted = true
+		issuerDomain, _, _ := strings.Cut(rec.Value, ";")
+		issuerDomain = strings.TrimSpace(issuerDomain)
+		if issuerDomain == "" {
+			continue // only forbids issuance
+		}
+		if slices.ContainsFunc(identities, func(id string) bool { return strings.EqualFold(id, issuerDomain) }) {
+			return true
+		}
+	}
+	return !restricted
+}
+
+var knownCAATags = []string{"issue", "issuewild", "iodef", "issuemail", "issuevmc", "contactemail", "contactphone"}
+
+// caaCache caches the CAA records of names, so that names that share
+// ancestors (whose records are relevant if they have none themselves)
+// share lookups too.
+type caaCache struct {
+	mu      sync.Mutex
+	entries map[string]caaCacheEntry
+}
+
+type caaCacheEntry struct {
+	records []*dns.CAA
+	expires time.Time
+}
+
+// relevantRecords returns the relevant CAA records for name, which
+// are those of the closest of name and its ancestors that has any,
+// and the name they are at.
+func (c *caaCache) relevantRecords(ctx context.Context, name string, preflight *CAAPreflight) ([]*dns.CAA, string, error) {
+	fqdn := dns.Fqdn(strings.ToLower(name))
+	for labels := dns.SplitDomainName(fqdn); len(labels) > 0; labels = labels[1:] {
+		at := dns.Fqdn(strings.Join(labels, "."))
+		records, err := c.lookup(ctx, at, preflight)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(records) > 0 {
+			return records, at, nil
+		}
+	}
+	return nil, fqdn, nil
+}
+
+// lookup returns the CAA records at fqdn.
+func (c *caaCache) lookup(ctx context.Context, fqdn string, preflight *CAAPreflight) ([]*dns.CAA, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[fqdn]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.records, nil
+	}
+
+	msg, err := dnsQuery(ctx, fqdn, dns.TypeCAA, RecursiveNameservers(preflight.Resolvers), true)
+	if err != nil {
+		return nil, fmt.Errorf("querying CAA records of %s: %v", fqdn, err)
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("querying CAA records of %s%s", fqdn, formatDNSError(msg, nil))
+	}
+	var records []*dns.CAA
+	for _, rr := range msg.Answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			records = append(records, caa)
+		}
+	}
+
+	cacheDuration := preflight.CacheDuration
+	if cacheDuration <= 0 {
+		cacheDuration = 5 * time.Minute
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]caaCacheEntry)
+	}
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[fqdn] = caaCacheEntry{records: records, expires: now.Add(cacheDuration)}
+	return records, nil
+}
+
+// CAAIdentities returns the CAA identities of the CA, from its ACME
+// directory. It implements CAAIdentifier.
+//
+// EXPERIMENTAL: Subject to change.
+func (am *ACMEIssuer) CAAIdentities(ctx context.Context) ([]string, error) {
+	client, err := am.newBasicACMEClient()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting ACME directory: %v", err)
+	}
+	if dir.Meta == nil {
+		return nil, nil
+	}
+	return dir.Meta.CAAIdentities, nil
+}
+
+// Interface guard
+var _ CAAIdentifier = (*ACMEIssuer)(nil)
@@ -0,0 +1,149 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCAAPermits(t *testing.T) {
+	caa := func(flag uint8, tag, value string) *dns.CAA {
+		return &dns.CAA{Flag: flag, Tag: tag, Value: value}
+	}
+	ids := []string{"letsencrypt.org"}
+	for i, tc := range []struct {
+		records  []*dns.CAA
+		wildcard bool
+		expect   bool
+	}{
+		{records: nil, expect: true},
+		{records: []*dns.CAA{caa(0, "iodef", "mailto:a@example.com")}, expect: true},
+		{records: []*dns.CAA{caa(0, "issue", "letsencrypt.org")}, expect: true},
+		{records: []*dns.CAA{caa(0, "issue", "LetsEncrypt.org; accounturi=https://example")}, expect: true},
+		{records: []*dns.CAA{caa(0, "issue", "pki.goog")}, expect: false},
+		{records: []*dns.CAA{caa(0, "issue", ";")}, expect: false},
+		{records: []*dns.CAA{caa(0, "issue", "pki.goog"), caa(0, "issue", "letsencrypt.org")}, expect: true},
+		{records: []*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(128, "future", "x")}, expect: false},
+		{records: []*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(0, "issuewild", "pki.goog")}, wildcard: true, expect: false},
+		{records: []*dns.CAA{caa(0, "issue", "pki.goog"), caa(0, "issuewild", "letsencrypt.org")}, wildcard: true, expect: true},
+		{records: []*dns.CAA{caa(0, "issue", "letsencrypt.org")}, wildcard: true, expect: true},
+	} {
+		if actual := caaPermits(tc.records, ids, tc.wildcard); actual != tc.expect {
+			t.Errorf("Test %d: Expected %v, got %v", i, tc.expect, actual)
+		}
+	}
+}
+
+type caaTestIssuer struct {
+	testIssuer
+	key        string
+	identities []string
+}
+
+func (ci *caaTestIssuer) IssuerKey() string { return ci.key }
+
+func (ci *caaTestIssuer) CAAIdentities(context.Context) ([]string, error) {
+	return ci.identities, nil
+}
+
+func TestCAAPreflight(t *testing.T) {
+	// a DNS server with CAA records for example.com only
+	var queries atomic.Int32
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeCAA && q.Name == "example.com." {
+			m.Answer = append(m.Answer, &dns.CAA{
+				Hdr:   dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 300},
+				Tag:   "issue",
+				Value: "allowed.example",
+			})
+		}
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	forbidden := &caaTestIssuer{key: "forbidden", identities: []string{"forbidden.example"}}
+	allowed := &caaTestIssuer{key: "allowed", identities: []string{"allowed.example"}}
+	var events []map[string]any
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:      []Issuer{forbidden, allowed},
+		CAAPreflight: &CAAPreflight{Resolvers: []string{pc.LocalAddr().String()}},
+		Storage:      &FileStorage{Path: t.TempDir()},
+		Logger:       defaultTestLogger,
+		OCSP:         OCSPConfig{DisableStapling: true},
+		KeySource:    StandardKeyGenerator{KeyType: P256},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "caa_forbidden" {
+				events = append(events, data)
+			}
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	if err := cfg.ObtainCertSync(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certRes.issuerKey != "allowed" {
+		t.Errorf("Expected certificate from the allowed issuer, got %s", certRes.issuerKey)
+	}
+	if len(events) != 1 || events[0]["issuer"] != "forbidden" || events[0]["record_name"] != "example.com." {
+		t.Errorf("Expected 1 caa_forbidden event for the forbidden issuer, got %v", events)
+	}
+
+	// the looked-up records are cached, also for names with the same ancestors
+	before := queries.Load()
+	if err := cfg.checkCAA(ctx, allowed, []string{"www.example.com"}); err != nil {
+		t.Errorf("Expected allowed issuer to pass, got %v", err)
+	}
+	if err := cfg.checkCAA(ctx, allowed, []string{"*.example.com"}); err != nil {
+		t.Errorf("Expected allowed issuer to pass, got %v", err)
+	}
+	if queries.Load() != before {
+		t.Errorf("Expected cached CAA records to be used, but %d queries were made", queries.Load()-before)
+	}
+
+	cfg.Issuers = []Issuer{forbidden}
+	err = cfg.ObtainCertSync(ctx, "other.example.com")
+	var caaErr CAAError
+	if !errors.As(err, &caaErr) || caaErr.Name != "other.example.com" {
+		t.Errorf("Expected CAAError, got %v", err)
+	}
+}
@@ -15,10 +15,11 @@
 package certmagic
 
 import (
+	"context"
 	"fmt"
-	weakrand "math/rand"
-	"strings"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -52,19 +53,99 @@ type Cache struct {
 	optionsMu sync.RWMutex
 
 	// The cache is keyed by certificate hash
-	cache map[string]Certificate
+	cache shardedMap[Certificate]
 
-	// cacheIndex is a map of SAN to cache key (cert hash)
-	cacheIndex map[string][]string
+	// cacheIndex maps SANs to cache keys (cert hashes); it is
+	// immutable, and replaced on changes with mu held
+	cacheIndex atomic.Pointer[nameIndex]
 
-	// Protects the cache and cacheIndex maps
-	mu sync.RWMutex
+	// usage tracks handshake usage of certs, keyed by cert hash,
+	// for use by eviction policies
+	usage shardedMap[*certUsage]
+
+	// delegated credentials of certs, keyed by cert hash
+	delegatedCredentials shardedMap[*DelegatedCredential]
+
+	// when certs below the minimum serving validity were
+	// last reloaded during handshakes, keyed by cert hash
+	unservableReloads shardedMap[time.Time]
+
+	// running certificate jobs, keyed by name
+	certJobs shardedMap[*CertJob]
+
+	// until when issuance is paused because of rate
+	// limits, keyed by name
+	issuancePauses shardedMap[time.Time]
+
+	// wakes up retries when backoff of names is reset
+	backoffResets backoffResets
+
+	// Serializes changes to which certificates are in the cache,
+	// so that the cache and cacheIndex maps stay consistent with
+	// each other. Reads and in-place updates of cached certificates
+	// need not hold it, since the maps are safe for concurrent use.
+	mu sync.Mutex
+
+	// Incremented whenever a certificate is removed, after it is
+	// removed from cacheIndex but before it is removed from cache;
+	// readers of the index use it to tell whether a certificate
+	// they did not find was replaced while they were reading
+	indexVersion atomic.Uint64
+
+	// Version of the routing table, and waiters for changes
+	// to it; changed with mu held
+	routing routingState
 
 	// Close this channel to cancel asset maintenance
 	stopChan chan struct{}
 
 	// Used to signal when stopping is completed
 	doneChan chan struct{}
+	stopOnce sync.Once
+
+	// In-flight obtain and renew operations, which Shutdown
+	// waits for; closing is closed when shutdown begins, and
+	// cancelOperations cancels the operations
+	operationsMu     sync.Mutex
+	operations       sync.WaitGroup
+	closing          chan struct{}
+	operationsCtx    context.Context
+	cancelOperations context.CancelFunc
+
+	// Identifies this cache in invalidations sent to other instances
+	// and in leader election
+	instanceID string
+
+	// Whether this cache was the elected leader at the last check
+	leader atomic.Bool
+
+	// When the cache was created
+	created time.Time
+
+	// Timings of issuances by configs using this cache
+	issuanceLatency issuanceLatency
+
+	// Recent failures of issuers, for error budgets
+	issuerHealth issuerHealth
+
+	// Recently looked-up CAA records
+	caaCache caaCache
+
+	// Recent issuance failures by name, and certificates
+	// currently alerted about for being close to expiry
+	issuanceFailures issuanceFailures
+	expiryAlerts     expiryAlerts
+
+	// Names waiting to be obtained together
+	issuanceBatches issuanceBatches
+
+	// Limits how many renewals queued by maintenance run
+	// at once, if MaxConcurrentRenewals is set
+	renewalSlots chan struct{}
+
+	// How often to check for renewals, in nanoseconds, if it
+	// was tightened or relaxed for short-lived certificates
+	effectiveRenewCheckInterval atomic.Int64
 
 	logger *zap.Logger
 }
@@ -112,12 +193,18 @@ func NewCache(opts CacheOptions) *Cache {
 
 	c := &Cache{
 		options:    opts,
-		cache:      make(map[string]Certificate),
-		cacheIndex: make(map[string][]string),
 		stopChan:   make(chan struct{}),
 		doneChan:   make(chan struct{}),
+		closing:    make(chan struct{}),
+		instanceID: newInstanceID(),
+		created:    time.Now(),
 		logger:     opts.Logger,
 	}
+	c.issuanceFailures.limit = opts.MaxIssuanceFailures
+	c.operationsCtx, c.cancelOperations = context.WithCancel(context.Background())
+	if opts.MaxConcurrentRenewals > 0 {
+		c.renewalSlots = make(chan struct{}, opts.MaxConcurrentRenewals)
+	}
 
 	// absolutely do not allow a nil logger; panics galore
 	if c.logger == nil {
@@ -125,6 +212,11 @@ func NewCache(opts CacheOptions) *Cache {
 	}
 
 	go c.maintainAssets(0)
+	go c.maintainARI(0)
+
+	if opts.Notifier != nil {
+		go c.listenForInvalidations(opts.Notifier)
+	}
 
 	return c
 }
@@ -133,6 +225,9 @@ func (certCache *Cache) SetOptions(opts CacheOptions) {
 	certCache.optionsMu.Lock()
 	certCache.options = opts
 	certCache.optionsMu.Unlock()
+	certCache.issuanceFailures.mu.Lock()
+	certCache.issuanceFailures.limit = opts.MaxIssuanceFailures
+	certCache.issuanceFailures.mu.Unlock()
 }
 
 // Stop stops the maintenance goroutine for
@@ -140,10 +235,99 @@ func (certCache *Cache) SetOptions(opts CacheOptions) {
 // stopping is complete. Once a cache is
 // stopped, it cannot be reused.
 func (certCache *Cache) Stop() {
-	close(certCache.stopChan) // signal to stop
-	<-certCache.doneChan      // wait for stop to complete
+	certCache.stopOnce.Do(func() { close(certCache.stopChan) }) // signal to stop
+	<-certCache.doneChan                                        // wait for stop to complete
 }
 
+// Shutdown stops the cache gracefully: it stops maintenance like Stop,
+// and then waits for the obtain and renew operations that are in
+// progress to finish, which releases the storage locks they hold and
+// emits their events. Operations that are waiting to retry are not
+// waited for; they stop, and with PersistentQueue, they can resume
+// after a restart. If ctx is done before the operations finish, they
+// are canceled, and Shutdown returns once they have returned (or
+// after a short grace period), with the error of ctx.
+//
+// Once a cache is shut down, it cannot be reused; new operations with
+// its configs are canceled right away.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) Shutdown(ctx context.Context) error {
+	certCache.operationsMu.Lock()
+	select {
+	case <-certCache.closing:
+	default:
+		close(certCache.closing)
+	}
+	certCache.operationsMu.Unlock()
+
+	certCache.Stop()
+
+	finished := make(chan struct{})
+	go func() {
+		certCache.operations.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		certCache.logger.Info("shut down certificate cache")
+		return nil
+	case <-ctx.Done():
+	}
+
+	certCache.logger.Warn("canceling certificate operations that did not finish in time")
+	certCache.cancelOperations()
+	select {
+	case <-finished:
+	case <-time.After(shutdownGracePeriod):
+		certCache.logger.Error("certificate operations did not return after being canceled; storage locks may remain",
+			zap.Duration("grace_period", shutdownGracePeriod))
+	}
+	return fmt.Errorf("shutting down certificate cache: %w", ctx.Err())
+}
+
+// trackOperation registers an obtain or renew operation, so that
+// Shutdown waits for it; done must be called when it returns. The
+// returned context is canceled if Shutdown gives up waiting, or
+// right away if the cache is shut down already.
+func (certCache *Cache) trackOperation(ctx context.Context) (context.Context, func()) {
+	if certCache == nil || certCache.operationsCtx == nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	certCache.operationsMu.Lock()
+	select {
+	case <-certCache.closing:
+		certCache.operationsMu.Unlock()
+		cancel()
+		return ctx, func() {}
+	default:
+	}
+	certCache.operations.Add(1)
+	certCache.operationsMu.Unlock()
+	stop := context.AfterFunc(certCache.operationsCtx, cancel)
+	ctx = context.WithValue(ctx, ctxKeyShuttingDown, (<-chan struct{})(certCache.closing))
+	ctx = context.WithValue(ctx, ctxKeyBackoffResets, &certCache.backoffResets)
+	return ctx, func() {
+		stop()
+		cancel()
+		certCache.operations.Done()
+	}
+}
+
+// shuttingDown returns a channel that is closed when the cache of
+// the operation of ctx is shutting down; it is nil (blocks forever)
+// for contexts that are not of an operation.
+func shuttingDown(ctx context.Context) <-chan struct{} {
+	closing, _ := ctx.Value(ctxKeyShuttingDown).(<-chan struct{})
+	return closing
+}
+
+// shutdownGracePeriod is how long Shutdown waits for canceled
+// operations to return.
+const shutdownGracePeriod = 10 * time.Second
+
 // CacheOptions is used to configure certificate caches.
 // Once a cache has been created with certain options,
 // those settings cannot be changed.
@@ -175,11 +359,42 @@ type CacheOptions struct {
 	// if unset, DefaultRenewCheckInterval will be used.
 	RenewCheckInterval time.Duration
 
+	// How many certificates maintenance renews at once;
+	// the others wait in line. Together with the rate
+	// limits of issuers (see ACMERateLimits), this keeps
+	// a restart with many expiring certificates from
+	// overwhelming the CA. 0 means no limit.
+	MaxConcurrentRenewals int
+
 	// Maximum number of certificates to allow in the cache.
-	// If reached, certificates will be randomly evicted to
-	// make room for new ones. 0 means unlimited.
+	// If reached, certificates will be evicted according
+	// to EvictionPolicy to make room for new ones. 0 means
+	// unlimited.
 	Capacity int
 
+	// How to choose which certificate to evict when the
+	// cache is at capacity. Default: RandomEviction.
+	EvictionPolicy EvictionPolicy
+
+	// How many names with failures to obtain or renew
+	// certificates to remember; see IssuanceFailures.
+	// Default: DefaultMaxIssuanceFailures.
+	MaxIssuanceFailures int
+
+	// If set, other instances sharing storage are notified
+	// when a certificate is renewed, revoked, or rolled back,
+	// and notifications from them update this cache right
+	// away. Otherwise, caches of other instances catch up
+	// only during maintenance.
+	Notifier Notifier
+
+	// If set, only the instance that is elected leader
+	// renews certificates during maintenance; the others
+	// reload them from storage after the leader renewed
+	// them. For clusters of instances that share storage.
+	// EXPERIMENTAL: Subject to change.
+	LeaderElection LeaderElector
+
 	// Set a logger to enable logging
 	Logger *zap.Logger
 }
@@ -203,21 +418,20 @@ func (certCache *Cache) cacheCertificate(cert Certificate) {
 // updates the name index.
 //
 // This function is NOT safe for concurrent use. Callers MUST acquire
-// a write lock on certCache.mu first.
+// a lock on certCache.mu first.
 func (certCache *Cache) unsyncedCacheCertificate(cert Certificate) {
 	// if this certificate already exists in the cache, this is basically
 	// a no-op so we reuse existing cert (prevent duplication), but we do
 	// modify the cert to add tags it may be missing (see issue #211)
-	if existingCert, ok := certCache.cache[cert.hash]; ok {
+	if certCache.cache.update(cert.hash, func(existingCert *Certificate) {
+		for _, tag := range cert.Tags {
+			if !existingCert.HasTag(tag) {
+				existingCert.Tags = append(slices.Clip(existingCert.Tags), tag)
+			}
+		}
+	}) {
 		logMsg := "certificate already cached"
-
 		if len(cert.Tags) > 0 {
-			for _, tag := range cert.Tags {
-				if !existingCert.HasTag(tag) {
-					existingCert.Tags = append(existingCert.Tags, tag)
-				}
-			}
-			certCache.cache[cert.hash] = existingCert
 			logMsg += "; appended any missing tags to cert"
 		}
 
@@ -232,40 +446,48 @@ func (certCache *Cache) unsyncedCacheCertificate(cert Certificate) {
 	}
 
 	// if the cache is at capacity, make room for new cert
-	cacheSize := len(certCache.cache)
+	cacheSize := certCache.cache.len()
 	certCache.optionsMu.RLock()
 	atCapacity := certCache.options.Capacity > 0 && cacheSize >= certCache.options.Capacity
+	policy := certCache.options.EvictionPolicy
 	certCache.optionsMu.RUnlock()
 
-	if atCapacity {
-		// Go maps are "nondeterministic" but not actually random,
-		// so although we could just chop off the "front" of the
-		// map with less code, that is a heavily skewed eviction
-		// strategy; generating random numbers is cheap and
-		// ensures a much better distribution.
-		rnd := weakrand.Intn(cacheSize)
-		i := 0
-		for _, randomCert := range certCache.cache {
-			if i == rnd {
-				certCache.logger.Debug("cache full; evicting random certificate",
-					zap.Strings("removing_subjects", randomCert.Names),
-					zap.String("removing_hash", randomCert.hash),
-					zap.Strings("inserting_subjects", cert.Names),
-					zap.String("inserting_hash", cert.hash))
-				certCache.removeCertificate(randomCert)
-				break
-			}
-			i++
+	if atCapacity && cacheSize > 0 {
+		if policy == nil {
+			policy = RandomEviction{}
+		}
+		if victim, ok := certCache.evictionVictim(policy); ok {
+			certCache.logger.Debug("cache full; evicting certificate",
+				zap.String("policy", fmt.Sprintf("%T", policy)),
+				zap.Strings("removing_subjects", victim.Names),
+				zap.String("removing_hash", victim.hash),
+				zap.Strings("inserting_subjects", cert.Names),
+				zap.String("inserting_hash", cert.hash))
+			certCache.removeCertificate(victim)
 		}
 	}
 
-	// store the certificate
-	certCache.cache[cert.hash] = cert
+	certCache.unsyncedStoreCertificate(cert)
+}
 
-	// update the index so we can access it by name
-	for _, name := range cert.Names {
-		certCache.cacheIndex[name] = append(certCache.cacheIndex[name], cert.hash)
-	}
+// unsyncedStoreCertificate adds cert, which must not be in the
+// cache yet, to the cache and the name index, regardless of the
+// capacity of the cache.
+//
+// This function is NOT safe for concurrent use. Callers MUST acquire
+// a lock on certCache.mu first.
+func (certCache *Cache) unsyncedStoreCertificate(cert Certificate) {
+	cert.shareTLSCertificate()
+	certCache.cache.store(cert.hash, cert)
+	certCache.usage.store(cert.hash, &certUsage{added: time.Now()})
+	defer certCache.routing.notify()
+
+	// update the index so we can access it by name; the lists
+	// of hashes are shared with readers, so never modify them
+	// in place (clipping forces append to make a copy)
+	certCache.updateIndex(cert.Names, func(hashes []string) []string {
+		return append(slices.Clip(hashes), cert.hash)
+	})
 
 	certCache.optionsMu.RLock()
 	certCache.logger.Debug("added certificate to cache",
@@ -274,7 +496,7 @@ func (certCache *Cache) unsyncedCacheCertificate(cert Certificate) {
 		zap.Bool("managed", cert.managed),
 		zap.String("issuer_key", cert.issuerKey),
 		zap.String("hash", cert.hash),
-		zap.Int("cache_size", len(certCache.cache)),
+		zap.Int("cache_size", certCache.cache.len()),
 		zap.Int("cache_capacity", certCache.options.Capacity))
 	certCache.optionsMu.RUnlock()
 }
@@ -282,26 +504,22 @@ func (certCache *Cache) unsyncedCacheCertificate(cert Certificate) {
 // removeCertificate removes cert from the cache.
 //
 // This function is NOT safe for concurrent use; callers
-// MUST first acquire a write lock on certCache.mu.
+// MUST first acquire a lock on certCache.mu.
 func (certCache *Cache) removeCertificate(cert Certificate) {
 	// delete all mentions of this cert from the name index
-	for _, name := range cert.Names {
-		keyList := certCache.cacheIndex[name]
-		for i := 0; i < len(keyList); i++ {
-			if keyList[i] == cert.hash {
-				keyList = append(keyList[:i], keyList[i+1:]...)
-				i--
-			}
-		}
-		if len(keyList) == 0 {
-			delete(certCache.cacheIndex, name)
-		} else {
-			certCache.cacheIndex[name] = keyList
-		}
-	}
-
-	// delete the actual cert from the cache
-	delete(certCache.cache, cert.hash)
+	// (without modifying the lists readers may be holding)
+	certCache.updateIndex(cert.Names, func(hashes []string) []string {
+		return slices.DeleteFunc(slices.Clone(hashes), func(h string) bool { return h == cert.hash })
+	})
+
+	// delete the actual cert from the cache (after
+	// telling readers that the index changed)
+	certCache.indexVersion.Add(1)
+	certCache.cache.delete(cert.hash)
+	certCache.usage.delete(cert.hash)
+	certCache.delegatedCredentials.delete(cert.hash)
+	certCache.unservableReloads.delete(cert.hash)
+	certCache.routing.notify()
 
 	certCache.optionsMu.RLock()
 	certCache.logger.Debug("removed certificate from cache",
@@ -310,51 +528,176 @@ func (certCache *Cache) removeCertificate(cert Certificate) {
 		zap.Bool("managed", cert.managed),
 		zap.String("issuer_key", cert.issuerKey),
 		zap.String("hash", cert.hash),
-		zap.Int("cache_size", len(certCache.cache)),
+		zap.Int("cache_size", certCache.cache.len()),
 		zap.Int("cache_capacity", certCache.options.Capacity))
 	certCache.optionsMu.RUnlock()
 }
 
 // replaceCertificate atomically replaces oldCert with newCert in
-// the cache.
+// the cache. The new certificate is added before the old one is
+// removed, so that there is no moment at which a name of both
+// resolves to neither of them.
 //
 // This method is safe for concurrent use.
 func (certCache *Cache) replaceCertificate(oldCert, newCert Certificate) {
 	certCache.mu.Lock()
-	certCache.removeCertificate(oldCert)
-	certCache.unsyncedCacheCertificate(newCert)
+	oldUsage, hadUsage := certCache.usage.load(oldCert.hash)
+	certCache.unsyncedReplaceCertificate(oldCert, newCert)
+	if hadUsage {
+		// the usage of a certificate carries over to its replacement
+		certCache.usage.compute(newCert.hash, func(usage *certUsage, ok bool) (*certUsage, bool) {
+			if !ok {
+				return nil, false
+			}
+			return oldUsage.clone(), true
+		})
+	}
 	certCache.mu.Unlock()
 	certCache.logger.Info("replaced certificate in cache",
 		zap.Strings("subjects", newCert.Names),
 		zap.Time("new_expiration", expiresAt(newCert.Leaf)))
 }
 
+// unsyncedReplaceCertificate replaces oldCert with newCert, adding
+// newCert to the cache and the name index before removing oldCert.
+// Replacing does not grow the cache, so nothing is evicted.
+//
+// This function is NOT safe for concurrent use. Callers MUST acquire
+// a lock on certCache.mu first.
+func (certCache *Cache) unsyncedReplaceCertificate(oldCert, newCert Certificate) {
+	if oldCert.hash == newCert.hash {
+		// the same certificate, like when it is reloaded
+		// from storage; its entry is swapped in place
+		if !certCache.cache.update(newCert.hash, func(cert *Certificate) {
+			*cert = newCert
+			cert.shareTLSCertificate()
+		}) {
+			certCache.unsyncedStoreCertificate(newCert)
+		}
+		return
+	}
+	if _, ok := certCache.cache.load(newCert.hash); ok {
+		certCache.unsyncedCacheCertificate(newCert) // only merges tags
+	} else {
+		certCache.unsyncedStoreCertificate(newCert)
+	}
+	certCache.removeCertificate(oldCert)
+}
+
+// updateIndex replaces the name index with one in which the hashes
+// for each of names are set by fn; see nameIndex.with. All of the
+// names change at once for readers.
+//
+// This function is NOT safe for concurrent use. Callers MUST acquire
+// a lock on certCache.mu first.
+func (certCache *Cache) updateIndex(names []string, fn func(hashes []string) []string) {
+	index := certCache.cacheIndex.Load()
+	for _, name := range names {
+		index = index.with(name, fn)
+	}
+	certCache.cacheIndex.Store(index)
+}
+
 // getAllMatchingCerts returns all certificates with exactly this subject
 // (wildcards are NOT expanded).
+//
+// This method is safe for concurrent use.
 func (certCache *Cache) getAllMatchingCerts(subject string) []Certificate {
-	certCache.mu.RLock()
-	defer certCache.mu.RUnlock()
+	for attempt := 1; ; attempt++ {
+		version := certCache.indexVersion.Load()
+		hashes, _ := certCache.cacheIndex.Load().get(subject)
+		certs, complete := certCache.appendCertsWithHashes(nil, hashes)
+
+		// if a cert was removed, it may have been replaced by one
+		// that is in the index by now, so read it again
+		if complete || certCache.indexVersion.Load() == version || attempt == maxIndexReads {
+			return certs
+		}
+	}
+}
 
-	allCertKeys := certCache.cacheIndex[subject]
+// candidateCerts returns the certificates that could serve name: those
+// for exactly name, and those for each name made by replacing labels of
+// name with wildcards from the left (see nameIndex.candidates), in the
+// order they should be tried. They are found with one walk of the index.
+//
+// This method is safe for concurrent use.
+func (certCache *Cache) candidateCerts(name string) (exact []Certificate, wildcards [][]Certificate) {
+	for attempt := 1; ; attempt++ {
+		version := certCache.indexVersion.Load()
+		exactHashes, wildcardHashes := certCache.cacheIndex.Load().candidates(name)
+		exact, complete := certCache.appendCertsWithHashes(nil, exactHashes)
+		wildcards = make([][]Certificate, len(wildcardHashes))
+		for i, hashes := range wildcardHashes {
+			var ok bool
+			wildcards[i], ok = certCache.appendCertsWithHashes(nil, hashes)
+			complete = complete && ok
+		}
+		if complete || certCache.indexVersion.Load() == version || attempt == maxIndexReads {
+			return exact, wildcards
+		}
+	}
+}
 
-	certs := make([]Certificate, len(allCertKeys))
-	for i := range allCertKeys {
-		certs[i] = certCache.cache[allCertKeys[i]]
+// mostSpecificCerts appends to certs the certificates for the first of
+// name and the names made by replacing labels of name with wildcards
+// (see nameIndex.candidates) that has any, and returns how many labels
+// were replaced for it. Those are the certificates to select from if
+// there is no custom selection. If certs has room for them, it doesn't
+// allocate, so TLS handshakes that hit the cache don't.
+//
+// This method is safe for concurrent use.
+func (certCache *Cache) mostSpecificCerts(certs []Certificate, name string) ([]Certificate, int) {
+	for attempt := 1; ; attempt++ {
+		version := certCache.indexVersion.Load()
+		hashes, wildcardLabels := certCache.cacheIndex.Load().mostSpecific(name)
+		found, complete := certCache.appendCertsWithHashes(certs, hashes)
+		if complete || certCache.indexVersion.Load() == version || attempt == maxIndexReads {
+			return found, wildcardLabels
+		}
 	}
+}
 
-	return certs
+// appendCertsWithHashes appends the cached certificates with the given
+// hashes to certs, and reports whether all of them are (still) cached.
+func (certCache *Cache) appendCertsWithHashes(certs []Certificate, hashes []string) ([]Certificate, bool) {
+	var missing bool
+	for _, hash := range hashes {
+		// the cert may have been removed since we read the index
+		if cert, ok := certCache.cache.load(hash); ok {
+			certs = append(certs, cert)
+		} else {
+			missing = true
+		}
+	}
+	return certs, !missing
 }
 
+// getAllCerts returns all certificates in the cache.
+//
+// This method is safe for concurrent use.
 func (certCache *Cache) getAllCerts() []Certificate {
-	certCache.mu.RLock()
-	defer certCache.mu.RUnlock()
-	certs := make([]Certificate, 0, len(certCache.cache))
-	for _, cert := range certCache.cache {
+	certs := make([]Certificate, 0, certCache.cache.len())
+	certCache.cache.rangeAll(func(_ string, cert Certificate) {
 		certs = append(certs, cert)
-	}
+	})
 	return certs
 }
 
+// updateCertificate atomically applies fn to the cached certificate with
+// the given hash, if it is still in the cache, and reports whether it was.
+// It is for changing properties of a certificate that do not affect how
+// it is indexed, like its OCSP staple or ARI; fn must not change its hash
+// or names.
+//
+// This method is safe for concurrent use.
+func (certCache *Cache) updateCertificate(hash string, fn func(*Certificate)) bool {
+	return certCache.cache.update(hash, func(cert *Certificate) {
+		fn(cert)
+		cert.shareTLSCertificate()
+	})
+}
+
 func (certCache *Cache) getConfig(cert Certificate) (*Config, error) {
 	certCache.optionsMu.RLock()
 	getCert := certCache.options.GetConfigForCert
@@ -364,6 +707,7 @@ func (certCache *Cache) getConfig(cert Certificate) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg = cfg.current().forKeyOf(cert)
 	if cfg.certCache == nil {
 		return nil, fmt.Errorf("config returned for certificate %v has nil cache; expected %p (this one)",
 			cert.Names, certCache)
@@ -379,18 +723,12 @@ func (certCache *Cache) getConfig(cert Certificate) (*Config, error) {
 // be used to serve the given SNI name, including exact SAN matches and
 // wildcard matches.
 func (certCache *Cache) AllMatchingCertificates(name string) []Certificate {
-	// get exact matches first
-	certs := certCache.getAllMatchingCerts(name)
-
-	// then look for wildcard matches by replacing each
-	// label of the domain name with wildcards
-	labels := strings.Split(name, ".")
-	for i := range labels {
-		labels[i] = "*"
-		candidate := strings.Join(labels, ".")
-		certs = append(certs, certCache.getAllMatchingCerts(candidate)...)
+	// exact matches first, then wildcard matches
+	// from the most to the least specific
+	certs, wildcards := certCache.candidateCerts(name)
+	for _, wildcardCerts := range wildcards {
+		certs = append(certs, wildcardCerts...)
 	}
-
 	return certs
 }
 
@@ -424,12 +762,17 @@ func (certCache *Cache) RemoveManaged(subjects []SubjectIssuer) {
 func (certCache *Cache) Remove(hashes []string) {
 	certCache.mu.Lock()
 	for _, h := range hashes {
-		cert := certCache.cache[h]
-		certCache.removeCertificate(cert)
+		if cert, ok := certCache.cache.load(h); ok {
+			certCache.removeCertificate(cert)
+		}
 	}
 	certCache.mu.Unlock()
 }
 
+// maxIndexReads is how many times to read the name index
+// when certificates are removed while reading it.
+const maxIndexReads = 3
+
 var (
 	defaultCache   *Cache
 	defaultCacheMu sync.Mutex
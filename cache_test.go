@@ -14,7 +14,17 @@
 
 package certmagic
 
-import "testing"
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestNewCache(t *testing.T) {
 	noop := func(Certificate) (*Config, error) { return new(Config), nil }
@@ -33,10 +43,155 @@ func TestNewCache(t *testing.T) {
 	if c.options.GetConfigForCert == nil {
 		t.Error("Expected GetConfigForCert to be set, but it was nil")
 	}
-	if c.cache == nil {
-		t.Error("Expected cache to be set, but it was nil")
+	if c.doneChan == nil {
+		t.Error("Expected doneChan to be set, but it was nil")
 	}
 	if c.stopChan == nil {
 		t.Error("Expected stopChan to be set, but it was nil")
 	}
 }
+
+// blockingIssuer is a testIssuer that blocks in Issue until
+// it is released or its context is done.
+type blockingIssuer struct {
+	testIssuer
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (bi *blockingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	bi.once.Do(func() { close(bi.entered) })
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case <-bi.release:
+		return bi.testIssuer.Issue(ctx, csr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestCacheShutdown(t *testing.T) {
+	newConfig := func(t *testing.T, issuer Issuer) (*Cache, *Config) {
+		var cfg *Config
+		cache := NewCache(CacheOptions{
+			GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+			Logger:           defaultTestLogger,
+		})
+		cfg = New(cache, Config{
+			Issuers:   []Issuer{issuer},
+			Storage:   &FileStorage{Path: t.TempDir()},
+			Logger:    defaultTestLogger,
+			OCSP:      OCSPConfig{DisableStapling: true},
+			KeySource: StandardKeyGenerator{KeyType: P256},
+		})
+		return cache, cfg
+	}
+	ctx := context.Background()
+
+	t.Run("waits for operations", func(t *testing.T) {
+		issuer := &blockingIssuer{entered: make(chan struct{}), release: make(chan struct{})}
+		cache, cfg := newConfig(t, issuer)
+
+		obtained := make(chan error, 1)
+		go func() { obtained <- cfg.ObtainCertSync(ctx, "shutdown.example.com") }()
+		<-issuer.entered
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- cache.Shutdown(ctx) }()
+		select {
+		case err := <-shutdown:
+			t.Fatalf("Shutdown returned before the operation finished: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(issuer.release)
+		if err := <-shutdown; err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+		if err := <-obtained; err != nil {
+			t.Fatalf("Obtaining: %v", err)
+		}
+		lockKey := cfg.lockKey(certIssueLockOp, "shutdown.example.com")
+		for _, held := range DefaultLockSupervisor.HeldLocks() {
+			if held.Name == lockKey {
+				t.Error("Expected the lock of the operation to be released")
+			}
+		}
+
+		// operations after shutdown don't start
+		if err := cfg.ObtainCertSync(ctx, "late.example.com"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected operation after shutdown to be canceled, got %v", err)
+		}
+	})
+
+	t.Run("cancels operations at deadline", func(t *testing.T) {
+		issuer := &blockingIssuer{entered: make(chan struct{}), release: make(chan struct{})}
+		cache, cfg := newConfig(t, issuer)
+
+		obtained := make(chan error, 1)
+		go func() { obtained <- cfg.ObtainCertSync(ctx, "slow.example.com") }()
+		<-issuer.entered
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if err := cache.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected Shutdown to give up at the deadline, got %v", err)
+		}
+		if err := <-obtained; err == nil {
+			t.Fatal("Expected the canceled operation to fail")
+		}
+	})
+}
+
+func TestReplaceCertificateNoGap(t *testing.T) {
+	noop := func(Certificate) (*Config, error) { return new(Config), nil }
+	c := NewCache(CacheOptions{GetConfigForCert: noop, Capacity: 1, Logger: defaultTestLogger})
+	defer c.Stop()
+
+	newCert := func(i int) Certificate {
+		return Certificate{
+			Names:       []string{"example.com"},
+			hash:        fmt.Sprintf("hash%d", i),
+			Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now()}},
+		}
+	}
+	current := newCert(0)
+	c.cacheCertificate(current)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var gaps atomic.Int32
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if len(c.getAllMatchingCerts("example.com")) == 0 {
+					gaps.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20000; i++ {
+		next := newCert(i)
+		c.replaceCertificate(current, next)
+		current = next
+	}
+	close(done)
+	wg.Wait()
+
+	if n := gaps.Load(); n > 0 {
+		t.Errorf("Expected the name to always resolve to a certificate, but it didn't %d times", n)
+	}
+	if certs := c.getAllMatchingCerts("example.com"); len(certs) != 1 || certs[0].hash != current.hash {
+		t.Errorf("Expected only the last certificate to be cached, got %v", certs)
+	}
+}
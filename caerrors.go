@@ -0,0 +1,250 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/rveen/certmagic/ratelimit"
+)
+
+// CAErrorKind classifies errors from CAs by how they are
+// responded to when obtaining or renewing certificates.
+//
+// EXPERIMENTAL: Subject to change.
+type CAErrorKind string
+
+// Kinds of CA errors.
+const (
+	// The CA rate-limited the request. Nothing is retried for the
+	// affected names before the limit resets, if the CA said when.
+	CAErrorRateLimited CAErrorKind = "rate_limited"
+
+	// The order was finalized before its authorizations were
+	// valid, or a nonce was rejected; these are hiccups in the
+	// protocol, which are retried soon without backing off.
+	CAErrorOrderNotReady CAErrorKind = "order_not_ready"
+	CAErrorBadNonce      CAErrorKind = "bad_nonce"
+
+	// The CA could not look up the names in DNS, or CAA records
+	// forbid it from issuing. DNS has to change (and propagate)
+	// before a retry can succeed, so retries are not made sooner
+	// than minDNSErrorWait.
+	CAErrorDNS CAErrorKind = "dns"
+
+	// The CA will never issue for the identifier, because it is
+	// against its policy or of a type it doesn't support. This
+	// is not retried.
+	CAErrorRejected CAErrorKind = "rejected"
+
+	// Any other problem reported by the CA, which is retried
+	// with the usual backoff.
+	CAErrorOther CAErrorKind = "other"
+)
+
+// CAError is an error from a CA that was classified by its kind. Errors
+// returned from obtaining or renewing certificates wrap a CAError if
+// the CA reported a problem, so that callers can tell them apart with
+// errors.As.
+//
+// EXPERIMENTAL: Subject to change.
+type CAError struct {
+	// How the error is responded to.
+	Kind CAErrorKind
+
+	// The ACME problem type, if the CA is an ACME CA,
+	// e.g. "urn:ietf:params:acme:error:rateLimited".
+	ProblemType string
+
+	// The identifier the error is about, if the CA
+	// attributed it to one.
+	Identifier string
+
+	// When the CA will accept a retry, if it said so.
+	RetryAfter time.Time
+
+	// The error from the CA.
+	Err error
+}
+
+func (e CAError) Error() string { return e.Err.Error() }
+
+// Unwrap makes it so that e wraps e.Err.
+func (e CAError) Unwrap() error { return e.Err }
+
+// ClassifyCAError returns err classified as a CAError, if it
+// is (or wraps) a problem reported by a CA.
+//
+// EXPERIMENTAL: Subject to change.
+func ClassifyCAError(err error) (CAError, bool) {
+	if err == nil {
+		return CAError{}, false
+	}
+	var caErr CAError
+	if errors.As(err, &caErr) {
+		return caErr, true
+	}
+
+	if limit, ok := ratelimit.FromError(err); ok {
+		return CAError{
+			Kind:        CAErrorRateLimited,
+			ProblemType: acme.ProblemTypeRateLimited,
+			Identifier:  limit.Identifier,
+			RetryAfter:  limit.RetryAfter,
+			Err:         err,
+		}, true
+	}
+
+	var problem acme.Problem
+	if !errors.As(err, &problem) {
+		var problemPtr *acme.Problem
+		if !errors.As(err, &problemPtr) || problemPtr == nil {
+			return CAError{}, false
+		}
+		problem = *problemPtr
+	}
+
+	// a compound problem (or any other) may only be
+	// specific in its subproblems; the most severe
+	// kind among them determines how to respond
+	caErr = CAError{
+		Kind:        problemKind(problem.Type),
+		ProblemType: problem.Type,
+		Err:         err,
+	}
+	for _, sub := range problem.Subproblems {
+		if kind := problemKind(sub.Type); caErrorSeverity[kind] > caErrorSeverity[caErr.Kind] {
+			caErr.Kind = kind
+			caErr.ProblemType = sub.Type
+			caErr.Identifier = sub.Identifier.Value
+		}
+	}
+	return caErr, true
+}
+
+// problemKind returns the kind of CA error an ACME problem type is.
+func problemKind(problemType string) CAErrorKind {
+	switch problemType {
+	case acme.ProblemTypeRateLimited:
+		return CAErrorRateLimited
+	case acme.ProblemTypeOrderNotReady:
+		return CAErrorOrderNotReady
+	case acme.ProblemTypeBadNonce:
+		return CAErrorBadNonce
+	case acme.ProblemTypeDNS, acme.ProblemTypeCAA:
+		return CAErrorDNS
+	case acme.ProblemTypeRejectedIdentifier, acme.ProblemTypeUnsupportedIdentifier:
+		return CAErrorRejected
+	}
+	return CAErrorOther
+}
+
+// caErrorSeverity orders kinds of CA errors by how long they
+// hold up issuance, for when a problem has several of them.
+var caErrorSeverity = map[CAErrorKind]int{
+	CAErrorBadNonce:      1,
+	CAErrorOrderNotReady: 1,
+	CAErrorOther:         2,
+	CAErrorDNS:           3,
+	CAErrorRateLimited:   4,
+	CAErrorRejected:      5,
+}
+
+// retryWait returns how long to wait before retrying after e, given
+// the usual backoff, and whether the backoff should advance.
+func (e CAError) retryWait(backoff time.Duration) (time.Duration, bool) {
+	wait, advance := backoff, true
+	switch e.Kind {
+	case CAErrorOrderNotReady, CAErrorBadNonce:
+		wait, advance = transientCAErrorWait, false
+	case CAErrorDNS:
+		wait = max(wait, minDNSErrorWait)
+	}
+
+	// if the CA told us when it will accept a retry, there's
+	// no point in retrying before then, nor in waiting longer
+	if !e.RetryAfter.IsZero() {
+		wait = max(time.Until(e.RetryAfter), minRateLimitWait)
+	}
+	return wait, advance
+}
+
+// classifyIssuanceError returns err, from obtaining or renewing a
+// certificate for names, wrapped in a CAError if it came from the CA.
+// Rate limits that say when they reset pause issuance for the names
+// (or the one name they are about) until then.
+func (cfg *Config) classifyIssuanceError(names []string, err error) error {
+	caErr, ok := ClassifyCAError(err)
+	if !ok {
+		return err
+	}
+	if caErr.Kind == CAErrorRateLimited && caErr.RetryAfter.After(time.Now()) {
+		paused := names
+		if caErr.Identifier != "" {
+			paused = []string{caErr.Identifier}
+		}
+		for _, name := range paused {
+			cfg.certCache.issuancePauses.compute(name, func(until time.Time, ok bool) (time.Time, bool) {
+				return maxTime(until, caErr.RetryAfter), true
+			})
+		}
+	}
+	return caErr
+}
+
+// issuancePaused returns an error if issuance for any of names is
+// paused because the CA rate-limited it; the error says until when.
+func (certCache *Cache) issuancePaused(names []string) error {
+	now := time.Now()
+	for _, name := range names {
+		until, ok := certCache.issuancePauses.load(name)
+		if !ok {
+			continue
+		}
+		if !until.After(now) {
+			certCache.issuancePauses.compute(name, func(until time.Time, ok bool) (time.Time, bool) {
+				return until, ok && until.After(now)
+			})
+			continue
+		}
+		return CAError{
+			Kind:        CAErrorRateLimited,
+			ProblemType: acme.ProblemTypeRateLimited,
+			Identifier:  name,
+			RetryAfter:  until,
+			Err:         fmt.Errorf("issuance for %s is paused until %s because the CA rate-limited it", name, until.UTC().Format(time.RFC3339)),
+		}
+	}
+	return nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// transientCAErrorWait is how long to wait before retrying
+// after a protocol hiccup, like a rejected nonce.
+const transientCAErrorWait = 10 * time.Second
+
+// minDNSErrorWait is the least amount of time to wait before
+// retrying after the CA failed to look up names in DNS, since
+// fixes take a while to propagate.
+const minDNSErrorWait = 5 * time.Minute
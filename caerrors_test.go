@@ -0,0 +1,140 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestClassifyCAError(t *testing.T) {
+	for i, tc := range []struct {
+		err        error
+		kind       CAErrorKind
+		identifier string
+	}{
+		{
+			err:  fmt.Errorf("finalizing: %w", acme.Problem{Type: acme.ProblemTypeBadNonce, Status: 400}),
+			kind: CAErrorBadNonce,
+		},
+		{
+			err:  acme.Problem{Type: acme.ProblemTypeOrderNotReady, Status: 403},
+			kind: CAErrorOrderNotReady,
+		},
+		{
+			err: acme.Problem{
+				Type: acme.ProblemTypeCompound,
+				Subproblems: []acme.Subproblem{
+					{Problem: acme.Problem{Type: acme.ProblemTypeUnauthorized}, Identifier: acme.Identifier{Value: "a.example.com"}},
+					{Problem: acme.Problem{Type: acme.ProblemTypeDNS}, Identifier: acme.Identifier{Value: "b.example.com"}},
+				},
+			},
+			kind:       CAErrorDNS,
+			identifier: "b.example.com",
+		},
+		{
+			err: acme.Problem{
+				Type:   acme.ProblemTypeRateLimited,
+				Status: 429,
+				Subproblems: []acme.Subproblem{
+					{Problem: acme.Problem{Type: acme.ProblemTypeRateLimited, Detail: "too many certificates, retry after 2099-01-01T00:00:00Z"}, Identifier: acme.Identifier{Value: "c.example.com"}},
+				},
+			},
+			kind:       CAErrorRateLimited,
+			identifier: "c.example.com",
+		},
+		{
+			err:  ErrNoRetry{acme.Problem{Type: acme.ProblemTypeRejectedIdentifier}},
+			kind: CAErrorRejected,
+		},
+		{
+			err:  acme.Problem{Type: acme.ProblemTypeServerInternal, Status: 500},
+			kind: CAErrorOther,
+		},
+	} {
+		caErr, ok := ClassifyCAError(tc.err)
+		if !ok {
+			t.Errorf("Test %d: Expected a CA error", i)
+			continue
+		}
+		if caErr.Kind != tc.kind || caErr.Identifier != tc.identifier {
+			t.Errorf("Test %d: Expected kind %q for %q, got %q for %q", i, tc.kind, tc.identifier, caErr.Kind, caErr.Identifier)
+		}
+		if caErr.Error() != tc.err.Error() {
+			t.Errorf("Test %d: Expected CA error to wrap the original error", i)
+		}
+	}
+
+	if _, ok := ClassifyCAError(errors.New("connection refused")); ok {
+		t.Error("Expected errors that aren't from the CA not to be classified")
+	}
+}
+
+func TestCAErrorRetryWait(t *testing.T) {
+	for i, tc := range []struct {
+		err     CAError
+		wait    time.Duration
+		advance bool
+	}{
+		{err: CAError{Kind: CAErrorBadNonce}, wait: transientCAErrorWait, advance: false},
+		{err: CAError{Kind: CAErrorDNS}, wait: minDNSErrorWait, advance: true},
+		{err: CAError{Kind: CAErrorOther}, wait: time.Minute, advance: true},
+		{err: CAError{Kind: CAErrorRateLimited, RetryAfter: time.Now().Add(-time.Hour)}, wait: minRateLimitWait, advance: true},
+	} {
+		wait, advance := tc.err.retryWait(time.Minute)
+		if wait != tc.wait || advance != tc.advance {
+			t.Errorf("Test %d: Expected to wait %s (advance=%t), got %s (advance=%t)", i, tc.wait, tc.advance, wait, advance)
+		}
+	}
+}
+
+func TestRateLimitPausesIssuance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	issuer := &gatedIssuer{gate: make(chan error, 1)}
+	cfg := newCertJobTestConfig(t, issuer)
+
+	retryAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	issuer.gate <- acme.Problem{
+		Type:   acme.ProblemTypeRateLimited,
+		Status: 429,
+		Detail: "too many certificates already issued, retry after " + retryAfter.Format(time.RFC3339),
+	}
+	err := cfg.ObtainCertSync(ctx, "limited.example.com")
+	var caErr CAError
+	if !errors.As(err, &caErr) || caErr.Kind != CAErrorRateLimited || !caErr.RetryAfter.Equal(retryAfter) {
+		t.Fatalf("Expected rate limit error with retry time, got %v (%+v)", err, caErr)
+	}
+
+	// the issuer would block if it were asked again
+	err = cfg.ObtainCertSync(ctx, "limited.example.com")
+	if !errors.As(err, &caErr) || caErr.Kind != CAErrorRateLimited || !caErr.RetryAfter.Equal(retryAfter) {
+		t.Fatalf("Expected issuance to be paused, got %v", err)
+	}
+	if !errors.Is(issuanceHandshakeError("limited.example.com", err), ErrCARejected) {
+		t.Error("Expected paused issuance to fail handshakes as rejected by the CA")
+	}
+
+	// other names are not paused
+	issuer.gate <- nil
+	if err := cfg.ObtainCertSync(ctx, "other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -19,9 +19,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -51,6 +54,10 @@ type Certificate struct {
 	// most recent OCSP response we have for this certificate.
 	ocsp *ocsp.Response
 
+	// When the OCSP responder started failing to give
+	// a response, if it is failing.
+	ocspFailingSince time.Time
+
 	// The hex-encoded hash of this cert's chain's DER bytes.
 	hash string
 
@@ -62,6 +69,40 @@ type Certificate struct {
 
 	// ACME Renewal Information, if available
 	ari acme.RenewalInfo
+
+	// A copy of the tls.Certificate to serve, which the copies
+	// of a cached certificate share; see tlsCertificate.
+	served *tls.Certificate
+}
+
+// tlsCertificate returns the tls.Certificate of cert to serve in a TLS
+// handshake. Copies of a cached certificate share one, so that serving
+// them doesn't allocate, unless the copy was changed since it was
+// cached (as when it was stapled); only the fields that are changed
+// after certificates are made are compared.
+func (cert *Certificate) tlsCertificate() *tls.Certificate {
+	if s := cert.served; s != nil &&
+		s.Leaf == cert.Leaf &&
+		sameSlice(s.Certificate, cert.Certificate.Certificate) &&
+		sameSlice(s.OCSPStaple, cert.Certificate.OCSPStaple) {
+		return s
+	}
+	tlsCert := cert.Certificate
+	return &tlsCert
+}
+
+// shareTLSCertificate makes a copy of the tls.Certificate of cert to
+// serve, which copies of cert will share; see tlsCertificate. It must
+// be called whenever a certificate is cached or changed in the cache.
+func (cert *Certificate) shareTLSCertificate() {
+	tlsCert := cert.Certificate
+	cert.served = &tlsCert
+}
+
+// sameSlice returns whether a and b are the same slice,
+// not merely equal ones.
+func sameSlice[T any](a, b []T) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
 // Empty returns true if the certificate struct is not filled out; at
@@ -94,21 +135,25 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 		}
 		return false
 	}
+	cfg = cfg.forLeaf(leaf)
 
 	expiration := expiresAt(leaf)
+	renewCheckInterval := cfg.certCache.renewCheckInterval()
 
-	var logger *zap.Logger
-	if emitLogs {
-		logger = cfg.Logger.With(
+	// the logger is only built to log, since this is
+	// checked during handshakes, which shouldn't allocate
+	logger := func() *zap.Logger {
+		if !emitLogs {
+			return zap.NewNop()
+		}
+		return cfg.Logger.With(
 			zap.Strings("subjects", leaf.DNSNames),
 			zap.Time("expiration", expiration),
 			zap.String("ari_cert_id", ari.UniqueIdentifier),
 			zap.Timep("next_ari_update", ari.RetryAfter),
-			zap.Duration("renew_check_interval", cfg.certCache.options.RenewCheckInterval),
+			zap.Duration("renew_check_interval", renewCheckInterval),
 			zap.Time("window_start", ari.SuggestedWindow.Start),
 			zap.Time("window_end", ari.SuggestedWindow.End))
-	} else {
-		logger = zap.NewNop()
 	}
 
 	if !cfg.DisableARI {
@@ -128,7 +173,7 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 			(!ari.SuggestedWindow.Start.IsZero() && !ari.SuggestedWindow.End.IsZero()) {
 			start, end := ari.SuggestedWindow.Start.Unix()+1, ari.SuggestedWindow.End.Unix()
 			selectedTime = time.Unix(rand.Int63n(end-start)+start, 0).UTC()
-			logger.Warn("no renewal time had been selected with ARI; chose an ephemeral one for now",
+			logger().Warn("no renewal time had been selected with ARI; chose an ephemeral one for now",
 				zap.Time("ephemeral_selected_time", selectedTime))
 		}
 
@@ -138,9 +183,9 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 			// time OR just before it if the next waking time would be after it; this
 			// cutoff can actually be before the start of the renewal window, but the spec
 			// author says that's OK: https://github.com/aarongable/draft-acme-ari/issues/71
-			cutoff := ari.SelectedTime.Add(-cfg.certCache.options.RenewCheckInterval)
+			cutoff := ari.SelectedTime.Add(-renewCheckInterval)
 			if time.Now().After(cutoff) {
-				logger.Info("certificate needs renewal based on ARI window",
+				logger().Info("certificate needs renewal based on ARI window",
 					zap.Time("selected_time", selectedTime),
 					zap.Time("renewal_cutoff", cutoff))
 				return true
@@ -153,7 +198,7 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 			// possibility of a bug in ARI compromising a site's uptime: we should always always
 			// always give heed to actual validity period
 			if currentlyInRenewalWindow(leaf.NotBefore, expiration, 1.0/20.0) {
-				logger.Warn("certificate is in emergency renewal window; superseding ARI",
+				logger().Warn("certificate is in emergency renewal window; superseding ARI",
 					zap.Duration("remaining", time.Until(expiration)),
 					zap.Time("renewal_cutoff", cutoff))
 				return true
@@ -162,9 +207,10 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 	}
 
 	// the normal check, in the absence of ARI, is to determine if we're near enough (or past)
-	// the expiration date based on the configured remaining:lifetime ratio
-	if currentlyInRenewalWindow(leaf.NotBefore, expiration, cfg.RenewalWindowRatio) {
-		logger.Info("certificate is in configured renewal window based on expiration date",
+	// the expiration date based on the configured remaining:lifetime ratio (which is
+	// different for short-lived certificates)
+	if currentlyInRenewalWindow(leaf.NotBefore, expiration, cfg.renewalWindowRatio(leaf)) {
+		logger().Info("certificate is in configured renewal window based on expiration date",
 			zap.Duration("remaining", time.Until(expiration)))
 		return true
 	}
@@ -175,8 +221,8 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 	// routine to check for renewals, to accommodate both exceptionally long and short
 	// cert lifetimes
 	if currentlyInRenewalWindow(leaf.NotBefore, expiration, 1.0/50.0) ||
-		time.Until(expiration) < cfg.certCache.options.RenewCheckInterval*5 {
-		logger.Warn("certificate is in emergency renewal window; expiration imminent",
+		time.Until(expiration) < renewCheckInterval*5 {
+		logger().Warn("certificate is in emergency renewal window; expiration imminent",
 			zap.Duration("remaining", time.Until(expiration)))
 		return true
 	}
@@ -223,6 +269,18 @@ func currentlyInRenewalWindow(notBefore, notAfter time.Time, renewalWindowRatio
 	return time.Now().After(renewalWindowStart)
 }
 
+// renewalOverdue returns true if more than half of the renewal window
+// of leaf has passed (or it expired), so that it is at risk of expiring
+// if renewal keeps failing.
+func (cfg *Config) renewalOverdue(leaf *x509.Certificate) bool {
+	ratio := cfg.forLeaf(leaf).RenewalWindowRatio
+	if ratio == 0 {
+		ratio = DefaultRenewalWindowRatio
+	}
+	renewalWindow := time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * ratio)
+	return time.Until(expiresAt(leaf)) < renewalWindow/2
+}
+
 // HasTag returns true if cert.Tags has tag.
 func (cert Certificate) HasTag(tag string) bool {
 	for _, t := range cert.Tags {
@@ -251,6 +309,7 @@ func expiresAt(cert *x509.Certificate) time.Time {
 //
 // This method is safe for concurrent use.
 func (cfg *Config) CacheManagedCertificate(ctx context.Context, domain string) (Certificate, error) {
+	cfg = cfg.current()
 	domain = cfg.transformSubject(ctx, nil, domain)
 	cert, err := cfg.loadManagedCertificate(ctx, domain)
 	if err != nil {
@@ -258,6 +317,19 @@ func (cfg *Config) CacheManagedCertificate(ctx context.Context, domain string) (
 	}
 	cfg.certCache.cacheCertificate(cert)
 	cfg.emit(ctx, "cached_managed_cert", map[string]any{"sans": cert.Names})
+
+	// the certificate with the alternate key is served along with it
+	if alt := cfg.alternateKeyConfig(); alt != nil {
+		altCert, err := alt.loadManagedCertificate(ctx, domain)
+		if err == nil {
+			alt.certCache.cacheCertificate(altCert)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			cfg.Logger.Error("loading certificate with alternate key",
+				zap.String("identifier", domain),
+				zap.String("key_type", string(cfg.AlternateKeyType)),
+				zap.Error(err))
+		}
+	}
 	return cert, nil
 }
 
@@ -265,6 +337,7 @@ func (cfg *Config) CacheManagedCertificate(ctx context.Context, domain string) (
 // of the configured issuers' storage locations, but it does not add it to
 // the cache. It just loads from storage and returns it.
 func (cfg *Config) loadManagedCertificate(ctx context.Context, domain string) (Certificate, error) {
+	cfg = cfg.forSubject(domain)
 	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, domain)
 	if err != nil {
 		return Certificate{}, err
@@ -335,6 +408,7 @@ func (cfg *Config) CacheUnmanagedTLSCertificate(ctx context.Context, tlsCert tls
 	if err != nil {
 		return "", err
 	}
+	cfg.completeChain(ctx, &cert)
 	if time.Now().After(cert.Leaf.NotAfter) {
 		cfg.Logger.Warn("unmanaged certificate has expired",
 			zap.Time("not_after", cert.Leaf.NotAfter),
@@ -344,7 +418,7 @@ func (cfg *Config) CacheUnmanagedTLSCertificate(ctx context.Context, tlsCert tls
 			zap.Time("not_after", cert.Leaf.NotAfter),
 			zap.Strings("sans", cert.Names))
 	}
-	err = stapleOCSP(ctx, cfg.OCSP, cfg.Storage, &cert, nil)
+	err = stapleOCSP(ctx, cfg.ocspConfig(), cfg.Storage, &cert, nil)
 	if err != nil {
 		cfg.Logger.Warn("stapling OCSP", zap.Error(err))
 	}
@@ -393,7 +467,10 @@ func (cfg Config) makeCertificateWithOCSP(ctx context.Context, certPEMBlock, key
 	if err != nil {
 		return cert, err
 	}
-	err = stapleOCSP(ctx, cfg.OCSP, cfg.Storage, &cert, certPEMBlock)
+	if cfg.completeChain(ctx, &cert) {
+		certPEMBlock = nil // staple with the completed chain
+	}
+	err = stapleOCSP(ctx, cfg.ocspConfig(), cfg.Storage, &cert, certPEMBlock)
 	if err != nil {
 		cfg.Logger.Warn("stapling OCSP", zap.Error(err), zap.Strings("identifiers", cert.Names))
 	}
@@ -518,7 +595,21 @@ func (cfg *Config) reloadManagedCertificate(ctx context.Context, oldCert Certifi
 // - must not be empty
 // - must not start or end with a dot (RFC 1034; RFC 6066 section 3)
 // - must not contain common accidental special characters
+//
+// URIs (see SubjectIsURI) and email addresses (see SubjectIsEmail)
+// qualify too, though only private CAs issue certificates for them.
 func SubjectQualifiesForCert(subj string) bool {
+	if SubjectIsURI(subj) {
+		return !strings.ContainsAny(subj, " \t\n\"<>\\{}|^`")
+	}
+	if SubjectIsEmail(subj) {
+		local, domain, _ := strings.Cut(subj, "@")
+		return !strings.ContainsAny(local, " \t\n\"()<>[]\\,;:") &&
+			strings.Contains(domain, ".") &&
+			!strings.Contains(domain, "*") &&
+			SubjectQualifiesForCert(domain)
+	}
+
 	// must not be empty
 	return strings.TrimSpace(subj) != "" &&
 
@@ -545,6 +636,10 @@ func SubjectQualifiesForPublicCert(subj string) bool {
 	// must at least qualify for a certificate
 	return SubjectQualifiesForCert(subj) &&
 
+		// public CAs only issue certificates for hostnames and IPs
+		!SubjectIsURI(subj) &&
+		!SubjectIsEmail(subj) &&
+
 		// loopback hosts and internal IPs are ineligible
 		!SubjectIsInternal(subj) &&
 
@@ -561,6 +656,26 @@ func SubjectIsIP(subj string) bool {
 	return net.ParseIP(subj) != nil
 }
 
+// SubjectIsURI returns true if subj is an absolute URI with an
+// authority, like a SPIFFE ID ("spiffe://example.org/ns/default/sa/web"),
+// which becomes a URI SAN. Unlike hostnames, URIs are case-sensitive.
+func SubjectIsURI(subj string) bool {
+	if !strings.Contains(subj, "://") {
+		return false
+	}
+	u, err := url.Parse(subj)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// SubjectIsEmail returns true if subj looks like an email address
+// ("local@domain"), which becomes an email SAN.
+func SubjectIsEmail(subj string) bool {
+	local, domain, ok := strings.Cut(subj, "@")
+	return ok && local != "" && domain != "" &&
+		!strings.Contains(domain, "@") &&
+		!SubjectIsURI(subj)
+}
+
 // SubjectIsInternal returns true if subj is an internal-facing
 // hostname or address, including localhost/loopback hosts.
 // Ports are ignored, if present.
@@ -23,7 +23,7 @@ import (
 )
 
 func TestUnexportedGetCertificate(t *testing.T) {
-	certCache := &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string), logger: defaultTestLogger}
+	certCache := &Cache{logger: defaultTestLogger}
 	cfg := &Config{Logger: defaultTestLogger, certCache: certCache}
 
 	// When cache is empty
@@ -33,15 +33,15 @@ func TestUnexportedGetCertificate(t *testing.T) {
 
 	// When cache has one certificate in it
 	firstCert := Certificate{Names: []string{"example.com"}}
-	certCache.cache["0xdeadbeef"] = firstCert
-	certCache.cacheIndex["example.com"] = []string{"0xdeadbeef"}
+	certCache.cache.store("0xdeadbeef", firstCert)
+	certCache.updateIndex([]string{"example.com"}, func([]string) []string { return []string{"0xdeadbeef"} })
 	if cert, matched, defaulted := cfg.getCertificateFromCache(&tls.ClientHelloInfo{ServerName: "example.com"}); !matched || defaulted || cert.Names[0] != "example.com" {
 		t.Errorf("Didn't get a cert for 'example.com' or got the wrong one: %v, matched=%v, defaulted=%v", cert, matched, defaulted)
 	}
 
 	// When retrieving wildcard certificate
-	certCache.cache["0xb01dface"] = Certificate{Names: []string{"*.example.com"}}
-	certCache.cacheIndex["*.example.com"] = []string{"0xb01dface"}
+	certCache.cache.store("0xb01dface", Certificate{Names: []string{"*.example.com"}})
+	certCache.updateIndex([]string{"*.example.com"}, func([]string) []string { return []string{"0xb01dface"} })
 	if cert, matched, defaulted := cfg.getCertificateFromCache(&tls.ClientHelloInfo{ServerName: "sub.example.com"}); !matched || defaulted || cert.Names[0] != "*.example.com" {
 		t.Errorf("Didn't get wildcard cert for 'sub.example.com' or got the wrong one: %v, matched=%v, defaulted=%v", cert, matched, defaulted)
 	}
@@ -53,34 +53,64 @@ func TestUnexportedGetCertificate(t *testing.T) {
 }
 
 func TestCacheCertificate(t *testing.T) {
-	certCache := &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string), logger: defaultTestLogger}
+	certCache := &Cache{logger: defaultTestLogger}
 
 	certCache.cacheCertificate(Certificate{Names: []string{"example.com", "sub.example.com"}, hash: "foobar", Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now()}}})
-	if len(certCache.cache) != 1 {
+	if certCache.cache.len() != 1 {
 		t.Errorf("Expected length of certificate cache to be 1")
 	}
-	if _, ok := certCache.cache["foobar"]; !ok {
+	if _, ok := certCache.cache.load("foobar"); !ok {
 		t.Error("Expected first cert to be cached by key 'foobar', but it wasn't")
 	}
-	if _, ok := certCache.cacheIndex["example.com"]; !ok {
+	if _, ok := certCache.cacheIndex.Load().get("example.com"); !ok {
 		t.Error("Expected first cert to be keyed by 'example.com', but it wasn't")
 	}
-	if _, ok := certCache.cacheIndex["sub.example.com"]; !ok {
+	if _, ok := certCache.cacheIndex.Load().get("sub.example.com"); !ok {
 		t.Error("Expected first cert to be keyed by 'sub.example.com', but it wasn't")
 	}
 
 	// using same cache; and has cert with overlapping name, but different hash
 	certCache.cacheCertificate(Certificate{Names: []string{"example.com"}, hash: "barbaz", Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now()}}})
-	if _, ok := certCache.cache["barbaz"]; !ok {
+	if _, ok := certCache.cache.load("barbaz"); !ok {
 		t.Error("Expected second cert to be cached by key 'barbaz.com', but it wasn't")
 	}
-	if hashes, ok := certCache.cacheIndex["example.com"]; !ok {
+	if hashes, ok := certCache.cacheIndex.Load().get("example.com"); !ok {
 		t.Error("Expected second cert to be keyed by 'example.com', but it wasn't")
 	} else if !reflect.DeepEqual(hashes, []string{"foobar", "barbaz"}) {
 		t.Errorf("Expected second cert to map to 'barbaz' but it was %v instead", hashes)
 	}
 }
 
+func TestTLSCertificateShared(t *testing.T) {
+	certCache := &Cache{logger: defaultTestLogger}
+	certCache.cacheCertificate(Certificate{
+		Names:       []string{"example.com"},
+		hash:        "foobar",
+		Certificate: tls.Certificate{Certificate: [][]byte{{1}}, Leaf: &x509.Certificate{NotAfter: time.Now()}},
+	})
+
+	cached, _ := certCache.cache.load("foobar")
+	other, _ := certCache.cache.load("foobar")
+	if cached.tlsCertificate() != other.tlsCertificate() {
+		t.Error("Expected copies of cached certificate to share the certificate to serve")
+	}
+
+	// a copy that was changed has its own
+	cached.Certificate.OCSPStaple = []byte("staple")
+	if served := cached.tlsCertificate(); served == other.tlsCertificate() || string(served.OCSPStaple) != "staple" {
+		t.Error("Expected changed copy of cached certificate to serve its own certificate")
+	}
+
+	// until it is changed in the cache too
+	certCache.updateCertificate("foobar", func(cert *Certificate) {
+		cert.Certificate.OCSPStaple = cached.Certificate.OCSPStaple
+	})
+	updated, _ := certCache.cache.load("foobar")
+	if served := updated.tlsCertificate(); served != updated.served || string(served.OCSPStaple) != "staple" {
+		t.Error("Expected updated certificate to share the updated certificate to serve")
+	}
+}
+
 func TestSubjectQualifiesForCert(t *testing.T) {
 	for i, test := range []struct {
 		host   string
@@ -123,6 +153,13 @@ func TestSubjectQualifiesForCert(t *testing.T) {
 		{"user@hostname", false},
 		{"hostname;", false},
 		{`"hostname"`, false},
+		{"spiffe://example.org/ns/default/sa/web", true},
+		{"spiffe://example.org/sa/{web}", false},
+		{"user@example.com", true},
+		{"Some.User+tag@example.com", true},
+		{"user@*.example.com", false},
+		{"us er@example.com", false},
+		{"@example.com", false},
 	} {
 		actual := SubjectQualifiesForCert(test.host)
 		if actual != test.expect {
@@ -180,6 +217,8 @@ func TestSubjectQualifiesForPublicCert(t *testing.T) {
 		{"user@hostname", false},
 		{"hostname;", false},
 		{`"hostname"`, false},
+		{"spiffe://example.org/ns/default/sa/web", false},
+		{"user@example.com", false},
 	} {
 		actual := SubjectQualifiesForPublicCert(test.host)
 		if actual != test.expect {
@@ -225,3 +264,25 @@ func TestMatchWildcard(t *testing.T) {
 		}
 	}
 }
+
+func TestRenewalOverdue(t *testing.T) {
+	cfg := &Config{RenewalWindowRatio: 1.0 / 3}
+	now := time.Now()
+	for i, test := range []struct {
+		remaining time.Duration
+		expect    bool
+	}{
+		{remaining: 60 * 24 * time.Hour, expect: false}, // not in renewal window
+		{remaining: 20 * 24 * time.Hour, expect: false}, // early in renewal window
+		{remaining: 10 * 24 * time.Hour, expect: true},  // past half of the window
+		{remaining: -time.Hour, expect: true},           // expired
+	} {
+		leaf := &x509.Certificate{
+			NotBefore: now.Add(test.remaining - 90*24*time.Hour),
+			NotAfter:  now.Add(test.remaining),
+		}
+		if actual := cfg.renewalOverdue(leaf); actual != test.expect {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertJobStatus is the status of a CertJob.
+//
+// EXPERIMENTAL: Subject to change.
+type CertJobStatus string
+
+// The statuses of a CertJob. A job starts out pending, becomes
+// validating when an issuer is asked for the certificate (which
+// is when challenges are solved, for ACME issuers), and goes back
+// to pending while waiting to retry after a failed attempt, until
+// it ends up issued or failed.
+const (
+	CertJobPending    CertJobStatus = "pending"
+	CertJobValidating CertJobStatus = "validating"
+	CertJobIssued     CertJobStatus = "issued"
+	CertJobFailed     CertJobStatus = "failed"
+)
+
+// CertJobState is the state of a CertJob at some point in time.
+//
+// EXPERIMENTAL: Subject to change.
+type CertJobState struct {
+	// The name the certificate is obtained for.
+	Name string
+
+	Status CertJobStatus
+
+	// Why the job failed, if Status is CertJobFailed;
+	// otherwise, the error of the last failed attempt,
+	// if any.
+	Err error
+
+	// How many attempts failed so far.
+	FailedAttempts int
+
+	// When the job started, and when its
+	// state last changed.
+	Started, Updated time.Time
+}
+
+// Done returns true if the job is over.
+func (s CertJobState) Done() bool {
+	return s.Status == CertJobIssued || s.Status == CertJobFailed
+}
+
+// CertJob is a handle to a certificate being obtained in the
+// background; see Config.ObtainCertJob. Its methods are safe
+// for concurrent use.
+//
+// EXPERIMENTAL: Subject to change.
+type CertJob struct {
+	mu     sync.Mutex
+	state  CertJobState
+	subs   []chan CertJobState
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// ObtainCertJob starts obtaining a certificate for name in the
+// background, like ObtainCertAsync, and returns a handle to follow its
+// progress. If a job for name is already running with cfg's cache, that
+// job is returned instead of starting another. The job runs until it is
+// over or ctx is canceled.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) ObtainCertJob(ctx context.Context, name string) *CertJob {
+	cfg = cfg.current()
+	ctx, cancel := context.WithCancel(ctx)
+	job := &CertJob{done: make(chan struct{}), cancel: cancel}
+	now := time.Now()
+	job.state = CertJobState{Name: name, Status: CertJobPending, Started: now, Updated: now}
+
+	started := false
+	cfg.certCache.certJobs.compute(name, func(running *CertJob, ok bool) (*CertJob, bool) {
+		if ok {
+			job = running
+			return running, true
+		}
+		started = true
+		return job, true
+	})
+	if !started {
+		cancel()
+		return job
+	}
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				cfg.Logger.Error("panic: certificate job", zap.String("identifier", name), zap.Any("error", err))
+				job.finish(CertJobFailed, fmt.Errorf("panic: %v", err))
+			}
+			cfg.certCache.certJobs.compute(name, func(current *CertJob, ok bool) (*CertJob, bool) {
+				return current, ok && current != job
+			})
+			cancel()
+		}()
+
+		err := cfg.ObtainCertAsync(context.WithValue(ctx, certJobCtxKey, job), name)
+		switch {
+		case err != nil:
+			job.finish(CertJobFailed, err)
+		case cfg.storageHasCertResourcesAnyIssuer(ctx, name):
+			job.finish(CertJobIssued, nil)
+		default:
+			// retries gave up, or the job was canceled
+			err = ctx.Err()
+			if err == nil {
+				err = job.State().Err
+			}
+			if err == nil {
+				err = fmt.Errorf("certificate was not obtained")
+			}
+			job.finish(CertJobFailed, err)
+		}
+	}()
+
+	return job
+}
+
+// CertJob returns the job that is obtaining a certificate
+// for name with cfg's cache, or nil if there is none.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) CertJob(name string) *CertJob {
+	job, _ := cfg.certCache.certJobs.load(name)
+	return job
+}
+
+// State returns the current state of the job.
+func (job *CertJob) State() CertJobState {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.state
+}
+
+// Subscribe returns a channel that receives the state of the job
+// every time it changes, starting with the current state; if states
+// aren't received in time, only the latest is kept. The channel is
+// closed after the job is over, or when unsubscribe is called.
+func (job *CertJob) Subscribe() (states <-chan CertJobState, unsubscribe func()) {
+	ch := make(chan CertJobState, 1)
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	ch <- job.state
+	if job.state.Done() {
+		close(ch)
+		return ch, func() {}
+	}
+	job.subs = append(job.subs, ch)
+	return ch, func() {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		for i, sub := range job.subs {
+			if sub == ch {
+				job.subs = append(job.subs[:i], job.subs[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}
+}
+
+// Done returns a channel that is closed when the job is over.
+func (job *CertJob) Done() <-chan struct{} {
+	return job.done
+}
+
+// Wait blocks until the job is over or ctx is canceled,
+// and returns the state of the job.
+func (job *CertJob) Wait(ctx context.Context) (CertJobState, error) {
+	select {
+	case <-job.done:
+		return job.State(), nil
+	case <-ctx.Done():
+		return job.State(), ctx.Err()
+	}
+}
+
+// Cancel stops the job; it fails with context.Canceled.
+func (job *CertJob) Cancel() {
+	job.cancel()
+}
+
+func (job *CertJob) setStatus(status CertJobStatus) {
+	if job == nil {
+		return
+	}
+	job.update(func(state *CertJobState) { state.Status = status })
+}
+
+// attemptFailed records that an attempt failed with err,
+// and that the job is waiting to retry.
+func (job *CertJob) attemptFailed(err error) {
+	if job == nil {
+		return
+	}
+	job.update(func(state *CertJobState) {
+		state.Status = CertJobPending
+		state.Err = err
+		state.FailedAttempts++
+	})
+}
+
+func (job *CertJob) finish(status CertJobStatus, err error) {
+	job.update(func(state *CertJobState) {
+		state.Status = status
+		state.Err = err
+	})
+}
+
+// update changes the state of the job with fn and notifies
+// subscribers, unless the job is already over.
+func (job *CertJob) update(fn func(*CertJobState)) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.state.Done() {
+		return
+	}
+	fn(&job.state)
+	job.state.Updated = time.Now()
+	for _, sub := range job.subs {
+		// keep only the latest state if the subscriber lags
+		select {
+		case <-sub:
+		default:
+		}
+		sub <- job.state
+	}
+	if job.state.Done() {
+		for _, sub := range job.subs {
+			close(sub)
+		}
+		job.subs = nil
+		close(job.done)
+	}
+}
+
+func certJobFromContext(ctx context.Context) *CertJob {
+	job, _ := ctx.Value(certJobCtxKey).(*CertJob)
+	return job
+}
+
+// certJobCtxKey is the context key for the CertJob
+// that an obtain operation is reporting progress to.
+const certJobCtxKey = ctxKey("cert_job")
@@ -0,0 +1,136 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+)
+
+// gatedIssuer is a testIssuer that waits for a result on its gate:
+// nil to issue the certificate, or an error to fail.
+type gatedIssuer struct {
+	testIssuer
+	gate chan error
+}
+
+func (gi *gatedIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	select {
+	case err := <-gi.gate:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return gi.testIssuer.Issue(ctx, csr)
+}
+
+func newCertJobTestConfig(t *testing.T, issuer Issuer) *Config {
+	t.Helper()
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	t.Cleanup(cache.Stop)
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+	return cfg
+}
+
+func TestObtainCertJob(t *testing.T) {
+	ctx := context.Background()
+	issuer := &gatedIssuer{gate: make(chan error)}
+	cfg := newCertJobTestConfig(t, issuer)
+
+	job := cfg.ObtainCertJob(ctx, "job.example.com")
+	states, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+	if state := <-states; state.Status != CertJobPending {
+		t.Errorf("Expected job to start pending, got %s", state.Status)
+	}
+	if state := <-states; state.Status != CertJobValidating {
+		t.Errorf("Expected job to be validating while the issuer works, got %s", state.Status)
+	}
+	if again := cfg.ObtainCertJob(ctx, "job.example.com"); again != job {
+		t.Error("Expected running job to be returned for the same name")
+	}
+	if cfg.CertJob("job.example.com") != job {
+		t.Error("Expected running job to be found by name")
+	}
+
+	issuer.gate <- nil
+	state, err := job.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != CertJobIssued || state.Err != nil {
+		t.Errorf("Expected job to be issued, got %s (error: %v)", state.Status, state.Err)
+	}
+	for range states {
+		// the channel is closed when the job is over
+	}
+	if cfg.CertJob("job.example.com") != nil {
+		t.Error("Expected finished job to be forgotten")
+	}
+	if !cfg.storageHasCertResourcesAnyIssuer(ctx, "job.example.com") {
+		t.Error("Expected certificate to be stored")
+	}
+}
+
+func TestObtainCertJobFailed(t *testing.T) {
+	ctx := context.Background()
+	issuer := &gatedIssuer{gate: make(chan error, 1)}
+	cfg := newCertJobTestConfig(t, issuer)
+
+	// errors that are not retried fail the job right away
+	issuer.gate <- ErrNoRetry{errors.New("unauthorized")}
+	state, err := cfg.ObtainCertJob(ctx, "fail.example.com").Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != CertJobFailed || state.Err == nil {
+		t.Errorf("Expected job to fail with a cause, got %s (error: %v)", state.Status, state.Err)
+	}
+
+	// a job waiting to retry reports the last error until canceled
+	issuer.gate <- errors.New("CA is down")
+	job := cfg.ObtainCertJob(ctx, "retry.example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State().FailedAttempts == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	state = job.State()
+	if state.Status != CertJobPending || state.FailedAttempts != 1 || state.Err == nil {
+		t.Fatalf("Expected job to be pending after a failed attempt, got %+v", state)
+	}
+	job.Cancel()
+	state, err = job.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != CertJobFailed || !errors.Is(state.Err, context.Canceled) {
+		t.Errorf("Expected canceled job to fail with context.Canceled, got %s (error: %v)", state.Status, state.Err)
+	}
+}
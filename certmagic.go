@@ -215,6 +215,8 @@ func TLS(domainNames []string) (*tls.Config, error) {
 // listener and does not presume HTTP is also being served,
 // the HTTP challenge will be disabled. The package variable
 // Default is modified so that the HTTP challenge is disabled.
+// For the PROXY protocol or socket options, use
+// ListenWithOptions.
 //
 // Calling this function signifies your acceptance to
 // the CA's Subscriber Agreement and/or Terms of Service.
@@ -277,11 +279,11 @@ func ManageAsync(ctx context.Context, domainNames []string) error {
 // config is used as a template), this struct regulates
 // certificate operations using an implicit whitelist
 // containing the names passed into those functions if
-// no DecisionFunc is set. This ensures some degree of
+// no DecisionFunc or Permission is set. This ensures some degree of
 // control by default to avoid certificate operations for
 // arbitrary domain names. To override this whitelist,
 // manually specify a DecisionFunc. To impose rate limits,
-// specify your own DecisionFunc.
+// set RateLimit or specify your own DecisionFunc.
 type OnDemandConfig struct {
 	// If set, this function will be called to determine
 	// whether a certificate can be obtained or renewed
@@ -289,6 +291,23 @@ type OnDemandConfig struct {
 	// request will be denied.
 	DecisionFunc func(ctx context.Context, name string) error
 
+	// If set, this will be asked whether a certificate
+	// can be obtained or renewed for the given name,
+	// for example an HTTPPermission endpoint. If
+	// DecisionFunc is also set, both must allow the name.
+	Permission OnDemandPermission
+
+	// If set, certificates are only obtained or renewed
+	// for names that resolve to an address of this
+	// server, in addition to what DecisionFunc or
+	// Permission allow.
+	// EXPERIMENTAL: Subject to change.
+	Destination *DestinationCheck
+
+	// If set, limits how often and how many certificate
+	// operations can be started during TLS handshakes.
+	RateLimit *OnDemandRateLimit
+
 	// Sources for getting new, unmanaged certificates.
 	// They will be invoked only during TLS handshakes
 	// before on-demand certificate management occurs,
@@ -298,6 +317,44 @@ type OnDemandConfig struct {
 	// TODO: EXPERIMENTAL: subject to change and/or removal.
 	Managers []Manager
 
+	// Parent domains whose subdomains share a wildcard
+	// certificate: when a certificate is needed on demand
+	// for a name one label below one of these domains,
+	// like foo.example.com for "example.com", a certificate
+	// for *.example.com is obtained instead, which is then
+	// served for all of its subdomains. This can greatly
+	// reduce the number of certificates for platforms that
+	// give each tenant a subdomain. The requested name must
+	// still be allowed by DecisionFunc or Permission. The
+	// issuers must be able to obtain wildcard certificates,
+	// which requires the DNS challenge.
+	// EXPERIMENTAL: Subject to change or removal.
+	WildcardDomains []string
+
+	// If true, obtaining certificates on demand is
+	// coordinated with other instances that share the
+	// same storage, with a lock in storage: while one
+	// instance obtains a certificate for a name, the
+	// others hold their handshakes for the name until
+	// it is done, and then load the certificate from
+	// storage instead of starting their own issuance.
+	// Without this, only handshakes in the same process
+	// are coordinated like that. The wait is limited
+	// by HandshakeTimeouts.Obtain.
+	// EXPERIMENTAL: Subject to change or removal.
+	CoordinateInstances bool
+
+	// If set, limits how many certificates are managed
+	// on demand, in total and per parent domain, and
+	// decides what happens when more are needed.
+	// EXPERIMENTAL: Subject to change.
+	MaxCertificates *CertificateBudget
+
+	// If set, on-demand certificates that go unused
+	// are decommissioned.
+	// EXPERIMENTAL: Subject to change or removal.
+	Decommission *DecommissionPolicy
+
 	// List of allowed hostnames (SNI values) for
 	// deferred (on-demand) obtaining of certificates.
 	// Used only by higher-level functions in this
@@ -399,6 +456,22 @@ const (
 	// configured issuers, then uses the first one
 	// that successfully returns a certificate.
 	UseFirstRandomIssuer = "first_random"
+
+	// UseWeightedRandomIssuer shuffles the list of
+	// configured issuers such that issuers with a
+	// higher weight (see Config.IssuerWeights) are
+	// more likely to be first, then uses the first
+	// one that successfully returns a certificate.
+	// This spreads the load over multiple CAs.
+	UseWeightedRandomIssuer = "weighted_random"
+
+	// UseStickyIssuer prefers the issuer of the current
+	// certificate for a name when renewing it; for new
+	// names, it chooses an issuer by hashing the name,
+	// respecting any weights, so that a name keeps the
+	// same issuer as long as the set of issuers doesn't
+	// change. The others are tried after that issuer.
+	UseStickyIssuer = "sticky"
 )
 
 // IssuedCertificate represents a certificate that was just issued.
@@ -431,6 +504,15 @@ type CertificateResource struct {
 	// usually provided by the issuer implementation.
 	IssuerData json.RawMessage `json:"issuer_data,omitempty"`
 
+	// Whether the certificate was obtained for several names
+	// at once (see IssuanceBatching); if so, it is stored for
+	// each of its names, and renewed for all of them at once.
+	Batched bool `json:"batched,omitempty"`
+
+	// How many renewals in a row reused the private key
+	// (see KeyRotationPolicy) up to this certificate.
+	KeyReuses int `json:"key_reuses,omitempty"`
+
 	// The unique string identifying the issuer of the
 	// certificate; internally useful for storage access.
 	issuerKey string
@@ -449,6 +531,15 @@ func (cr *CertificateResource) NamesKey() string {
 	return result
 }
 
+// storageKeys returns the keys that the resource is stored under:
+// the names key, or each of its names if it is batched.
+func (cr *CertificateResource) storageKeys() []string {
+	if cr.Batched {
+		return cr.SANs
+	}
+	return []string{cr.NamesKey()}
+}
+
 // Default contains the package defaults for the
 // various Config fields. This is used as a template
 // when creating your own Configs with New() or
@@ -0,0 +1,808 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ACMEServerOptions configures an ACMEServer.
+type ACMEServerOptions struct {
+	// How long issued certificates are valid. Default: 90 days.
+	CertificateLifetime time.Duration
+
+	// Identifiers for which authorizations fail, as if their
+	// challenges could not be solved.
+	RejectIdentifiers []string
+}
+
+// ACMEServer is an in-process ACME server (RFC 8555) for tests. It
+// implements accounts, orders, authorizations, finalization, certificate
+// downloads, and revocation, and checks nonces and request signatures,
+// but it doesn't actually validate challenges: every challenge succeeds
+// (except for the RejectIdentifiers) once the client initiates it.
+// Certificates are issued from an intermediate of a root that is
+// generated for every server.
+type ACMEServer struct {
+	opts ACMEServerOptions
+	srv  *httptest.Server
+
+	ca *testCA
+
+	mu       sync.Mutex
+	nextID   int
+	nonces   map[string]struct{}
+	accounts map[string]*mockAccount
+	orders   map[string]*mockOrder
+	authzs   map[string]*mockAuthz
+	certs    map[string]*mockCert
+	issued   []*mockCert
+}
+
+type mockAccount struct {
+	id      string
+	key     crypto.PublicKey
+	contact []string
+}
+
+type mockOrder struct {
+	id          string
+	account     string
+	status      string
+	identifiers []identifier
+	authzs      []string
+	cert        string
+}
+
+type mockAuthz struct {
+	id         string
+	order      string
+	status     string
+	identifier identifier
+	wildcard   bool
+	token      string
+}
+
+type mockCert struct {
+	id      string
+	account string
+	leaf    *x509.Certificate
+	chain   []byte
+	revoked *int
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// NewACMEServer starts an ACMEServer, which is closed when the test ends.
+func NewACMEServer(t testing.TB, opts ACMEServerOptions) *ACMEServer {
+	t.Helper()
+	if opts.CertificateLifetime <= 0 {
+		opts.CertificateLifetime = 90 * 24 * time.Hour
+	}
+	s := &ACMEServer{
+		opts:     opts,
+		nonces:   make(map[string]struct{}),
+		accounts: make(map[string]*mockAccount),
+		orders:   make(map[string]*mockOrder),
+		authzs:   make(map[string]*mockAuthz),
+		certs:    make(map[string]*mockCert),
+	}
+	var err error
+	if s.ca, err = newTestCA(); err != nil {
+		t.Fatalf("generating CA: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handleDirectory)
+	mux.HandleFunc("/new-nonce", s.handleNewNonce)
+	mux.HandleFunc("POST /new-account", s.post(s.handleNewAccount))
+	mux.HandleFunc("POST /account/{id}", s.post(s.handleAccount))
+	mux.HandleFunc("POST /new-order", s.post(s.handleNewOrder))
+	mux.HandleFunc("POST /order/{id}", s.post(s.handleOrder))
+	mux.HandleFunc("POST /authz/{id}", s.post(s.handleAuthz))
+	mux.HandleFunc("POST /challenge/{id}", s.post(s.handleChallenge))
+	mux.HandleFunc("POST /finalize/{id}", s.post(s.handleFinalize))
+	mux.HandleFunc("POST /cert/{id}", s.post(s.handleCert))
+	mux.HandleFunc("POST /revoke-cert", s.post(s.handleRevokeCert))
+	s.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// DirectoryURL returns the URL of the server's ACME directory.
+func (s *ACMEServer) DirectoryURL() string { return s.srv.URL + "/directory" }
+
+// TLSRoots returns a pool with the certificate the server's HTTPS endpoint
+// serves, for ACME clients to trust.
+func (s *ACMEServer) TLSRoots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.srv.Certificate())
+	return pool
+}
+
+// Roots returns a pool with the root of the certificates the server
+// issues, for TLS clients to trust.
+func (s *ACMEServer) Roots() *x509.CertPool {
+	return s.ca.roots()
+}
+
+// Issued returns the leaf certificates the server issued, in order.
+func (s *ACMEServer) Issued() []*x509.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	issued := make([]*x509.Certificate, 0, len(s.issued))
+	for _, cert := range s.issued {
+		issued = append(issued, cert.leaf)
+	}
+	return issued
+}
+
+// RevocationReason returns the reason cert was revoked with, and whether
+// it was revoked.
+func (s *ACMEServer) RevocationReason(cert *x509.Certificate) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.certs {
+		if c.leaf.SerialNumber.Cmp(cert.SerialNumber) == 0 && c.revoked != nil {
+			return *c.revoked, true
+		}
+	}
+	return 0, false
+}
+
+// Close shuts down the server.
+func (s *ACMEServer) Close() { s.srv.Close() }
+
+func (s *ACMEServer) url(path string, id string) string {
+	return s.srv.URL + "/" + path + "/" + id
+}
+
+// newID returns a new identifier; s.mu must be locked.
+func (s *ACMEServer) newID() string {
+	s.nextID++
+	return fmt.Sprint(s.nextID)
+}
+
+func (s *ACMEServer) newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	s.mu.Lock()
+	s.nonces[nonce] = struct{}{}
+	s.mu.Unlock()
+	return nonce
+}
+
+func (s *ACMEServer) handleDirectory(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"newNonce":   s.srv.URL + "/new-nonce",
+		"newAccount": s.srv.URL + "/new-account",
+		"newOrder":   s.srv.URL + "/new-order",
+		"revokeCert": s.srv.URL + "/revoke-cert",
+	})
+}
+
+func (s *ACMEServer) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// request is an authenticated request to the server.
+type request struct {
+	payload []byte // empty for POST-as-GET
+	account *mockAccount
+	jwk     crypto.PublicKey // only if the request was signed with a JWK
+}
+
+// post wraps handler with verification of the JWS of the request.
+func (s *ACMEServer) post(handler func(http.ResponseWriter, *http.Request, request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		req, prob := s.verify(r)
+		if prob != nil {
+			writeProblem(w, *prob)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		handler(w, r, req)
+	}
+}
+
+func (s *ACMEServer) verify(r *http.Request) (request, *problem) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return request{}, malformed("decoding JWS: %v", err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return request{}, malformed("decoding protected header: %v", err)
+	}
+	var header struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		KID   string          `json:"kid"`
+		JWK   json.RawMessage `json:"jwk"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return request{}, malformed("parsing protected header: %v", err)
+	}
+	if header.URL != s.srv.URL+r.URL.Path {
+		return request{}, unauthorized("JWS url %q does not match request URL", header.URL)
+	}
+
+	s.mu.Lock()
+	_, validNonce := s.nonces[header.Nonce]
+	delete(s.nonces, header.Nonce)
+	s.mu.Unlock()
+	if !validNonce {
+		return request{}, &problem{Type: "badNonce", Detail: "invalid nonce", Status: http.StatusBadRequest}
+	}
+
+	var req request
+	var key crypto.PublicKey
+	switch {
+	case header.KID != "" && len(header.JWK) == 0:
+		s.mu.Lock()
+		req.account = s.accounts[strings.TrimPrefix(header.KID, s.srv.URL+"/account/")]
+		s.mu.Unlock()
+		if req.account == nil {
+			return request{}, &problem{Type: "accountDoesNotExist", Detail: "unknown account " + header.KID, Status: http.StatusBadRequest}
+		}
+		key = req.account.key
+	case header.KID == "" && len(header.JWK) > 0:
+		if key, err = parseJWK(header.JWK); err != nil {
+			return request{}, &problem{Type: "badPublicKey", Detail: err.Error(), Status: http.StatusBadRequest}
+		}
+		req.jwk = key
+	default:
+		return request{}, malformed("exactly one of kid and jwk is required")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return request{}, malformed("decoding signature: %v", err)
+	}
+	if err := verifySignature(key, header.Alg, []byte(jws.Protected+"."+jws.Payload), sig); err != nil {
+		return request{}, &problem{Type: "badSignatureAlgorithm", Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+
+	if req.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil {
+		return request{}, malformed("decoding payload: %v", err)
+	}
+
+	return req, nil
+}
+
+func (s *ACMEServer) handleNewAccount(w http.ResponseWriter, _ *http.Request, req request) {
+	if req.jwk == nil {
+		writeProblem(w, *malformed("new accounts must be requested with a JWK"))
+		return
+	}
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, *malformed("parsing account: %v", err))
+		return
+	}
+
+	for _, acct := range s.accounts {
+		if publicKeysEqual(acct.key, req.jwk) {
+			s.writeAccount(w, http.StatusOK, acct)
+			return
+		}
+	}
+	if payload.OnlyReturnExisting {
+		writeProblem(w, problem{Type: "accountDoesNotExist", Detail: "no account with this key", Status: http.StatusBadRequest})
+		return
+	}
+
+	acct := &mockAccount{id: s.newID(), key: req.jwk, contact: payload.Contact}
+	s.accounts[acct.id] = acct
+	s.writeAccount(w, http.StatusCreated, acct)
+}
+
+func (s *ACMEServer) handleAccount(w http.ResponseWriter, r *http.Request, req request) {
+	if req.account == nil || req.account.id != r.PathValue("id") {
+		writeProblem(w, *unauthorized("not the account's key"))
+		return
+	}
+	var payload struct {
+		Contact []string `json:"contact"`
+	}
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, *malformed("parsing account: %v", err))
+			return
+		}
+		if payload.Contact != nil {
+			req.account.contact = payload.Contact
+		}
+	}
+	s.writeAccount(w, http.StatusOK, req.account)
+}
+
+func (s *ACMEServer) writeAccount(w http.ResponseWriter, status int, acct *mockAccount) {
+	w.Header().Set("Location", s.url("account", acct.id))
+	writeJSON(w, status, map[string]any{
+		"status":  "valid",
+		"contact": acct.contact,
+	})
+}
+
+func (s *ACMEServer) handleNewOrder(w http.ResponseWriter, _ *http.Request, req request) {
+	if req.account == nil {
+		writeProblem(w, *unauthorized("orders must be requested by an account"))
+		return
+	}
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, *malformed("parsing order: %v", err))
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		writeProblem(w, *malformed("order has no identifiers"))
+		return
+	}
+
+	order := &mockOrder{
+		id:          s.newID(),
+		account:     req.account.id,
+		status:      "pending",
+		identifiers: payload.Identifiers,
+	}
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" && id.Type != "ip" {
+			writeProblem(w, problem{Type: "unsupportedIdentifier", Detail: "unsupported identifier type " + id.Type, Status: http.StatusBadRequest})
+			return
+		}
+		authz := &mockAuthz{
+			id:         s.newID(),
+			order:      order.id,
+			status:     "pending",
+			identifier: id,
+			token:      s.newNonceToken(),
+		}
+		if value, ok := strings.CutPrefix(id.Value, "*."); ok {
+			authz.identifier.Value = value
+			authz.wildcard = true
+		}
+		s.authzs[authz.id] = authz
+		order.authzs = append(order.authzs, authz.id)
+	}
+	s.orders[order.id] = order
+
+	s.writeOrder(w, http.StatusCreated, order)
+}
+
+func (s *ACMEServer) newNonceToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *ACMEServer) handleOrder(w http.ResponseWriter, r *http.Request, req request) {
+	order := s.orders[r.PathValue("id")]
+	if order == nil || req.account == nil || order.account != req.account.id {
+		writeProblem(w, problem{Type: "malformed", Detail: "no such order", Status: http.StatusNotFound})
+		return
+	}
+	s.writeOrder(w, http.StatusOK, order)
+}
+
+func (s *ACMEServer) writeOrder(w http.ResponseWriter, status int, order *mockOrder) {
+	obj := map[string]any{
+		"status":      order.status,
+		"expires":     time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+		"identifiers": order.identifiers,
+		"finalize":    s.url("finalize", order.id),
+	}
+	var authzURLs []string
+	for _, id := range order.authzs {
+		authzURLs = append(authzURLs, s.url("authz", id))
+	}
+	obj["authorizations"] = authzURLs
+	if order.cert != "" {
+		obj["certificate"] = s.url("cert", order.cert)
+	}
+	w.Header().Set("Location", s.url("order", order.id))
+	writeJSON(w, status, obj)
+}
+
+func (s *ACMEServer) handleAuthz(w http.ResponseWriter, r *http.Request, req request) {
+	authz := s.authzs[r.PathValue("id")]
+	if authz == nil || req.account == nil || s.orders[authz.order].account != req.account.id {
+		writeProblem(w, problem{Type: "malformed", Detail: "no such authorization", Status: http.StatusNotFound})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.authzObject(authz))
+}
+
+func (s *ACMEServer) authzObject(authz *mockAuthz) map[string]any {
+	types := []string{"http-01", "dns-01", "tls-alpn-01"}
+	if authz.wildcard {
+		types = []string{"dns-01"}
+	}
+	var challenges []map[string]any
+	for _, typ := range types {
+		challenges = append(challenges, s.challengeObject(authz, typ))
+	}
+	return map[string]any{
+		"status":     authz.status,
+		"expires":    time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+		"identifier": authz.identifier,
+		"wildcard":   authz.wildcard,
+		"challenges": challenges,
+	}
+}
+
+func (s *ACMEServer) challengeObject(authz *mockAuthz, typ string) map[string]any {
+	obj := map[string]any{
+		"type":   typ,
+		"url":    s.url("challenge", authz.id+"-"+typ),
+		"token":  authz.token,
+		"status": authz.status,
+	}
+	if authz.status == "invalid" {
+		obj["error"] = problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "challenge rejected by test server", Status: http.StatusForbidden}
+	}
+	return obj
+}
+
+func (s *ACMEServer) handleChallenge(w http.ResponseWriter, r *http.Request, req request) {
+	authzID, typ, _ := strings.Cut(r.PathValue("id"), "-")
+	authz := s.authzs[authzID]
+	if authz == nil || req.account == nil || s.orders[authz.order].account != req.account.id {
+		writeProblem(w, problem{Type: "malformed", Detail: "no such challenge", Status: http.StatusNotFound})
+		return
+	}
+
+	// initiating the challenge validates it right away
+	if len(req.payload) > 0 && authz.status == "pending" {
+		authz.status = "valid"
+		if slices.Contains(s.opts.RejectIdentifiers, authz.identifier.Value) ||
+			(authz.wildcard && slices.Contains(s.opts.RejectIdentifiers, "*."+authz.identifier.Value)) {
+			authz.status = "invalid"
+		}
+		order := s.orders[authz.order]
+		order.status = "ready"
+		for _, id := range order.authzs {
+			switch s.authzs[id].status {
+			case "invalid":
+				order.status = "invalid"
+			case "pending":
+				if order.status != "invalid" {
+					order.status = "pending"
+				}
+			}
+		}
+	}
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="up"`, s.url("authz", authz.id)))
+	writeJSON(w, http.StatusOK, s.challengeObject(authz, typ))
+}
+
+func (s *ACMEServer) handleFinalize(w http.ResponseWriter, r *http.Request, req request) {
+	order := s.orders[r.PathValue("id")]
+	if order == nil || req.account == nil || order.account != req.account.id {
+		writeProblem(w, problem{Type: "malformed", Detail: "no such order", Status: http.StatusNotFound})
+		return
+	}
+	if order.status != "ready" {
+		writeProblem(w, problem{Type: "orderNotReady", Detail: "order is " + order.status, Status: http.StatusForbidden})
+		return
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, *malformed("parsing finalize request: %v", err))
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		writeProblem(w, problem{Type: "badCSR", Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeProblem(w, problem{Type: "badCSR", Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	if err := csrMatchesOrder(csr, order); err != nil {
+		writeProblem(w, problem{Type: "badCSR", Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+
+	cert, err := s.issue(csr, order.account)
+	if err != nil {
+		writeProblem(w, problem{Type: "serverInternal", Detail: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	order.status = "valid"
+	order.cert = cert.id
+
+	s.writeOrder(w, http.StatusOK, order)
+}
+
+// csrMatchesOrder returns an error if the identifiers in csr are not
+// exactly those of order.
+func csrMatchesOrder(csr *x509.CertificateRequest, order *mockOrder) error {
+	var csrIDs []string
+	for _, name := range csr.DNSNames {
+		csrIDs = append(csrIDs, "dns:"+name)
+	}
+	for _, ip := range csr.IPAddresses {
+		csrIDs = append(csrIDs, "ip:"+ip.String())
+	}
+	var orderIDs []string
+	for _, id := range order.identifiers {
+		orderIDs = append(orderIDs, id.Type+":"+id.Value)
+	}
+	slices.Sort(csrIDs)
+	slices.Sort(orderIDs)
+	if !slices.Equal(slices.Compact(csrIDs), slices.Compact(orderIDs)) {
+		return fmt.Errorf("CSR identifiers %v do not match order identifiers %v", csrIDs, orderIDs)
+	}
+	return nil
+}
+
+// issue issues a certificate for csr; s.mu must be locked.
+func (s *ACMEServer) issue(csr *x509.CertificateRequest, account string) (*mockCert, error) {
+	leaf, chain, err := s.ca.sign(csr, s.opts.CertificateLifetime)
+	if err != nil {
+		return nil, err
+	}
+	cert := &mockCert{id: s.newID(), account: account, leaf: leaf, chain: chain}
+	s.certs[cert.id] = cert
+	s.issued = append(s.issued, cert)
+	return cert, nil
+}
+
+func (s *ACMEServer) handleCert(w http.ResponseWriter, r *http.Request, req request) {
+	cert := s.certs[r.PathValue("id")]
+	if cert == nil || req.account == nil || cert.account != req.account.id {
+		writeProblem(w, problem{Type: "malformed", Detail: "no such certificate", Status: http.StatusNotFound})
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(cert.chain)
+}
+
+func (s *ACMEServer) handleRevokeCert(w http.ResponseWriter, _ *http.Request, req request) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, *malformed("parsing revocation request: %v", err))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		writeProblem(w, *malformed("decoding certificate: %v", err))
+		return
+	}
+
+	var cert *mockCert
+	for _, c := range s.certs {
+		if string(c.leaf.Raw) == string(der) {
+			cert = c
+			break
+		}
+	}
+	if cert == nil {
+		writeProblem(w, problem{Type: "malformed", Detail: "certificate was not issued by this server", Status: http.StatusNotFound})
+		return
+	}
+
+	// the account that ordered the certificate, or the certificate's
+	// own key, may revoke it
+	authorized := (req.account != nil && req.account.id == cert.account) ||
+		(req.jwk != nil && publicKeysEqual(req.jwk, cert.leaf.PublicKey))
+	if !authorized {
+		writeProblem(w, *unauthorized("not authorized to revoke this certificate"))
+		return
+	}
+	if cert.revoked != nil {
+		writeProblem(w, problem{Type: "alreadyRevoked", Detail: "certificate is already revoked", Status: http.StatusBadRequest})
+		return
+	}
+	if payload.Reason < 0 || payload.Reason > 10 || payload.Reason == 7 {
+		writeProblem(w, problem{Type: "badRevocationReason", Detail: fmt.Sprintf("invalid reason %d", payload.Reason), Status: http.StatusBadRequest})
+		return
+	}
+
+	reason := payload.Reason
+	cert.revoked = &reason
+	w.WriteHeader(http.StatusOK)
+}
+
+// problem is an RFC 7807 problem document.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func malformed(format string, args ...any) *problem {
+	return &problem{Type: "malformed", Detail: fmt.Sprintf(format, args...), Status: http.StatusBadRequest}
+}
+
+func unauthorized(format string, args ...any) *problem {
+	return &problem{Type: "unauthorized", Detail: fmt.Sprintf(format, args...), Status: http.StatusForbidden}
+}
+
+func writeProblem(w http.ResponseWriter, prob problem) {
+	if !strings.HasPrefix(prob.Type, "urn:") {
+		prob.Type = "urn:ietf:params:acme:error:" + prob.Type
+	}
+	body, _ := json.Marshal(prob)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(prob.Status)
+	_, _ = w.Write(body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(w, problem{Type: "serverInternal", Detail: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// parseJWK parses an RSA or EC public key in JWK form.
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, fmt.Errorf("parsing JWK: %v", err)
+	}
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// verifySignature verifies the JWS signature sig of signed by key.
+func verifySignature(key crypto.PublicKey, alg string, signed, sig []byte) error {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var hash crypto.Hash
+		switch alg {
+		case "ES256":
+			hash = crypto.SHA256
+		case "ES384":
+			hash = crypto.SHA384
+		case "ES512":
+			hash = crypto.SHA512
+		default:
+			return fmt.Errorf("unsupported algorithm %q for EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		h := hash.New()
+		h.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("unsupported algorithm %q for RSA key", alg)
+		}
+		h := crypto.SHA256.New()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), sig)
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	ka, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && ka.Equal(b)
+}
+
+// Interface guard
+var _ CA = (*ACMEServer)(nil)
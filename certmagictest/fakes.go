@@ -0,0 +1,379 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rveen/certmagic"
+)
+
+// FakeIssuer is a certmagic.Issuer, Revoker, and PreChecker for unit
+// tests. Calls to Issue return the scripted Responses in order; once
+// those are used up, it issues certificates for the CSRs from a CA that
+// is generated for the issuer (see Roots). All calls are recorded.
+//
+// The zero value is ready to use; do not change its fields while it
+// is in use.
+type FakeIssuer struct {
+	// The issuer key. Default: "fake".
+	Key string
+
+	// Results of the first calls to Issue, in order.
+	Responses []FakeResponse
+
+	// How long calls to Issue without a scripted response
+	// take. (Calls return early with the context's error if
+	// it is canceled.)
+	Delay time.Duration
+
+	// How long issued certificates are valid. Default: 90 days.
+	Lifetime time.Duration
+
+	// Errors to return from PreCheck and Revoke.
+	PreCheckError error
+	RevokeError   error
+
+	mu    sync.Mutex
+	ca    *testCA
+	next  int
+	calls []IssuerCall
+}
+
+// FakeResponse is a scripted result of a call to a fake.
+type FakeResponse struct {
+	// How long the call takes.
+	Delay time.Duration
+
+	// The error to return, if any.
+	Error error
+
+	// The certificate to return if there is no error: for a
+	// FakeIssuer, Certificate (default: one issued for the
+	// CSR); for a FakeManager, TLS (default: none).
+	Certificate *certmagic.IssuedCertificate
+	TLS         *tls.Certificate
+}
+
+// IssuerCall is a recorded call to a FakeIssuer.
+type IssuerCall struct {
+	// "Issue", "Revoke", or "PreCheck".
+	Method string
+
+	// The names in the CSR, the certificate, or the pre-check.
+	Names []string
+
+	// The revocation reason (Revoke), or whether the call was
+	// interactive (PreCheck).
+	Reason      int
+	Interactive bool
+
+	// The attempt number, if the call was part of a retry loop.
+	Attempt int
+
+	Time  time.Time
+	Error error
+}
+
+// IssuerKey returns the issuer key.
+func (fi *FakeIssuer) IssuerKey() string {
+	if fi.Key == "" {
+		return "fake"
+	}
+	return fi.Key
+}
+
+// Issue returns the next scripted response, or issues a certificate.
+func (fi *FakeIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	fi.mu.Lock()
+	resp := FakeResponse{Delay: fi.Delay}
+	if fi.next < len(fi.Responses) {
+		resp = fi.Responses[fi.next]
+		fi.next++
+	}
+	fi.mu.Unlock()
+
+	call := IssuerCall{Method: "Issue", Names: csrNames(csr), Time: time.Now()}
+	if attempts, ok := ctx.Value(certmagic.AttemptsCtxKey).(*int); ok {
+		call.Attempt = *attempts
+	}
+
+	cert, err := fi.issue(ctx, csr, resp)
+	call.Error = err
+	fi.record(call)
+
+	return cert, err
+}
+
+func (fi *FakeIssuer) issue(ctx context.Context, csr *x509.CertificateRequest, resp FakeResponse) (*certmagic.IssuedCertificate, error) {
+	if err := sleep(ctx, resp.Delay); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp.Certificate != nil {
+		return resp.Certificate, nil
+	}
+
+	ca, err := fi.testCA()
+	if err != nil {
+		return nil, err
+	}
+	lifetime := fi.Lifetime
+	if lifetime <= 0 {
+		lifetime = 90 * 24 * time.Hour
+	}
+	_, chain, err := ca.sign(csr, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &certmagic.IssuedCertificate{Certificate: chain}, nil
+}
+
+// Revoke records the call and returns RevokeError.
+func (fi *FakeIssuer) Revoke(_ context.Context, cert certmagic.CertificateResource, reason int) error {
+	fi.record(IssuerCall{Method: "Revoke", Names: cert.SANs, Reason: reason, Time: time.Now(), Error: fi.RevokeError})
+	return fi.RevokeError
+}
+
+// PreCheck records the call and returns PreCheckError.
+func (fi *FakeIssuer) PreCheck(_ context.Context, names []string, interactive bool) error {
+	fi.record(IssuerCall{Method: "PreCheck", Names: names, Interactive: interactive, Time: time.Now(), Error: fi.PreCheckError})
+	return fi.PreCheckError
+}
+
+// Calls returns the recorded calls, in order; if methods are given,
+// only calls of those methods.
+func (fi *FakeIssuer) Calls(methods ...string) []IssuerCall {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	var calls []IssuerCall
+	for _, call := range fi.calls {
+		if len(methods) == 0 || slices.Contains(methods, call.Method) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Roots returns a pool with the root of the certificates the issuer
+// issues, for TLS clients to trust.
+func (fi *FakeIssuer) Roots() *x509.CertPool {
+	ca, err := fi.testCA()
+	if err != nil {
+		return x509.NewCertPool()
+	}
+	return ca.roots()
+}
+
+// Reset forgets the recorded calls and starts over with the first
+// scripted response.
+func (fi *FakeIssuer) Reset() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.calls = nil
+	fi.next = 0
+}
+
+func (fi *FakeIssuer) record(call IssuerCall) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.calls = append(fi.calls, call)
+}
+
+func (fi *FakeIssuer) testCA() (*testCA, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.ca == nil {
+		ca, err := newTestCA()
+		if err != nil {
+			return nil, err
+		}
+		fi.ca = ca
+	}
+	return fi.ca, nil
+}
+
+// FakeManager is a certmagic.Manager for unit tests. Calls to
+// GetCertificate return the scripted Responses in order; once those are
+// used up, the certificate in Certificates for the server name, if any.
+// All calls are recorded.
+//
+// The zero value is ready to use; do not change its fields while it
+// is in use.
+type FakeManager struct {
+	// Results of the first calls to GetCertificate, in order.
+	Responses []FakeResponse
+
+	// Certificates by (lowercase) server name.
+	Certificates map[string]*tls.Certificate
+
+	// How long calls without a scripted response take.
+	Delay time.Duration
+
+	mu    sync.Mutex
+	next  int
+	calls []ManagerCall
+}
+
+// ManagerCall is a recorded call to a FakeManager.
+type ManagerCall struct {
+	ServerName  string
+	Time        time.Time
+	Certificate *tls.Certificate
+	Error       error
+}
+
+// GetCertificate returns the next scripted response, or the certificate
+// for the server name.
+func (fm *FakeManager) GetCertificate(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(hello.ServerName)
+
+	fm.mu.Lock()
+	resp := FakeResponse{Delay: fm.Delay, TLS: fm.Certificates[serverName]}
+	if fm.next < len(fm.Responses) {
+		resp = fm.Responses[fm.next]
+		fm.next++
+	}
+	fm.mu.Unlock()
+
+	call := ManagerCall{ServerName: serverName, Time: time.Now()}
+	if err := sleep(ctx, resp.Delay); err != nil {
+		call.Error = err
+	} else if resp.Error != nil {
+		call.Error = resp.Error
+	} else {
+		call.Certificate = resp.TLS
+	}
+
+	fm.mu.Lock()
+	fm.calls = append(fm.calls, call)
+	fm.mu.Unlock()
+
+	return call.Certificate, call.Error
+}
+
+// Calls returns the recorded calls, in order; if server names are given,
+// only calls for those names.
+func (fm *FakeManager) Calls(serverNames ...string) []ManagerCall {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	var calls []ManagerCall
+	for _, call := range fm.calls {
+		if len(serverNames) == 0 || slices.Contains(serverNames, call.ServerName) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the recorded calls and starts over with the first
+// scripted response.
+func (fm *FakeManager) Reset() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.calls = nil
+	fm.next = 0
+}
+
+// NewCertificate returns a certificate for names, issued by a throwaway
+// CA, for example for a FakeManager to return; it fails the test if the
+// certificate can't be generated.
+func NewCertificate(t testing.TB, names ...string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.CertificateRequest{}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := newTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _, err := ca.sign(csr, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// csrNames returns the names in csr.
+func csrNames(csr *x509.CertificateRequest) []string {
+	names := slices.Clone(csr.DNSNames)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, email := range csr.EmailAddresses {
+		names = append(names, email)
+	}
+	for _, uri := range csr.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Interface guards
+var (
+	_ certmagic.Issuer     = (*FakeIssuer)(nil)
+	_ certmagic.Revoker    = (*FakeIssuer)(nil)
+	_ certmagic.PreChecker = (*FakeIssuer)(nil)
+	_ certmagic.Manager    = (*FakeManager)(nil)
+)
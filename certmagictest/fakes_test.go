@@ -0,0 +1,132 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rveen/certmagic"
+	"go.uber.org/zap"
+)
+
+func newFakeConfig(t *testing.T, tmpl certmagic.Config) *certmagic.Config {
+	var cfg *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) { return cfg, nil },
+		Logger:           zap.NewNop(),
+	})
+	t.Cleanup(cache.Stop)
+	tmpl.Storage = &certmagic.FileStorage{Path: t.TempDir()}
+	tmpl.Logger = zap.NewNop()
+	tmpl.OCSP = certmagic.OCSPConfig{DisableStapling: true}
+	cfg = certmagic.New(cache, tmpl)
+	return cfg
+}
+
+func TestFakeIssuer(t *testing.T) {
+	errCA := errors.New("CA is down")
+	issuer := &FakeIssuer{Responses: []FakeResponse{{Error: errCA}}}
+	cfg := newFakeConfig(t, certmagic.Config{Issuers: []certmagic.Issuer{issuer}})
+
+	if err := cfg.ObtainCertSync(t.Context(), "example.com"); !errors.Is(err, errCA) {
+		t.Fatalf("Expected scripted error, got %v", err)
+	}
+	if err := cfg.ObtainCertSync(t.Context(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(t.Context(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: issuer.Roots(), Intermediates: intermediates(cert)}); err != nil {
+		t.Errorf("Expected certificate chaining to issuer's root: %v", err)
+	}
+
+	calls := issuer.Calls("Issue")
+	if len(calls) != 2 || !errors.Is(calls[0].Error, errCA) || calls[1].Error != nil {
+		t.Fatalf("Unexpected calls: %+v", calls)
+	}
+	if !slices.Equal(calls[1].Names, []string{"example.com"}) {
+		t.Errorf("Expected names of CSR to be recorded, got %v", calls[1].Names)
+	}
+	if len(issuer.Calls("PreCheck")) != 2 {
+		t.Errorf("Expected pre-checks to be recorded, got %+v", issuer.Calls())
+	}
+
+	if err := cfg.RevokeCert(t.Context(), "example.com", 4, false); err != nil {
+		t.Fatal(err)
+	}
+	if revokes := issuer.Calls("Revoke"); len(revokes) != 1 || revokes[0].Reason != 4 {
+		t.Errorf("Expected revocation to be recorded, got %+v", revokes)
+	}
+}
+
+func TestFakeIssuerDelay(t *testing.T) {
+	issuer := &FakeIssuer{Delay: time.Minute}
+	cfg := newFakeConfig(t, certmagic.Config{Issuers: []certmagic.Issuer{issuer}})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := cfg.ObtainCertSync(ctx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected delay to be canceled, got %v", err)
+	}
+}
+
+func TestFakeManager(t *testing.T) {
+	cert := NewCertificate(t, "example.com")
+	manager := &FakeManager{
+		Responses:    []FakeResponse{{Error: errors.New("not yet")}},
+		Certificates: map[string]*tls.Certificate{"example.com": cert},
+	}
+	cfg := newFakeConfig(t, certmagic.Config{
+		OnDemand: &certmagic.OnDemandConfig{Managers: []certmagic.Manager{manager}},
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: "Example.com"}
+	if _, err := cfg.GetCertificate(hello); err == nil {
+		t.Fatal("Expected scripted error")
+	}
+	got, err := cfg.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Leaf.Equal(cert.Leaf) {
+		t.Error("Expected certificate for server name")
+	}
+	if calls := manager.Calls("example.com"); len(calls) != 2 || calls[0].Error == nil || calls[1].Certificate != cert {
+		t.Errorf("Unexpected calls: %+v", calls)
+	}
+
+	manager.Reset()
+	if len(manager.Calls()) != 0 {
+		t.Error("Expected calls to be forgotten")
+	}
+}
+
+func intermediates(cert certmagic.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, der := range cert.Certificate.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			pool.AddCert(c)
+		}
+	}
+	return pool
+}
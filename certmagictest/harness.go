@@ -0,0 +1,236 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certmagictest helps test integrations of CertMagic end-to-end,
+// without a staging CA: it provides an in-process ACME server, a way to
+// run Pebble, and a Harness that wires a Config, Cache, and temporary
+// Storage to them and runs obtain, renew, and revoke flows. For unit
+// tests, FakeIssuer and FakeManager can be scripted to return
+// certificates, errors, and delays, and record how they were called.
+//
+//	func TestServer(t *testing.T) {
+//		h := certmagictest.New(t, certmagictest.Options{})
+//		h.Obtain("example.com")
+//		// ... start the server under test with h.Config.TLSConfig() ...
+//	}
+//
+// EXPERIMENTAL: Subject to change (or removal).
+package certmagictest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	"github.com/rveen/certmagic"
+	"go.uber.org/zap"
+)
+
+// CA is an ACME server to test against, like an ACMEServer or Pebble.
+type CA interface {
+	// The URL of the ACME directory.
+	DirectoryURL() string
+
+	// The roots to trust when connecting to the ACME server.
+	TLSRoots() *x509.CertPool
+
+	// The roots of the certificates the CA issues.
+	Roots() *x509.CertPool
+}
+
+// Options configures a Harness.
+type Options struct {
+	// The CA to obtain certificates from. Default: a new
+	// ACMEServer with default options.
+	CA CA
+
+	// A template for the config. Default storage: a
+	// FileStorage in a temporary directory; default logger:
+	// a no-op logger. Issuers is set to the ACME issuer, and
+	// OnEvent records events before calling this OnEvent.
+	Config certmagic.Config
+
+	// A template for the ACME issuer. CA, TrustedRoots, and
+	// Agreed are set, and challenges are "solved" by a
+	// solver that does nothing, since the test CAs don't
+	// validate them. Default email: certmagictest@example.com
+	// (so that the user is never prompted for one).
+	Issuer certmagic.ACMEIssuer
+}
+
+// Harness is a Config, with its Cache and Storage, that obtains
+// certificates from a test CA.
+type Harness struct {
+	CA      CA
+	Storage certmagic.Storage
+	Cache   *certmagic.Cache
+	Config  *certmagic.Config
+	Issuer  *certmagic.ACMEIssuer
+
+	t      testing.TB
+	mu     sync.Mutex
+	events []Event
+}
+
+// Event is an event that was emitted by the harness's config.
+type Event struct {
+	Name string
+	Data map[string]any
+}
+
+// New returns a new Harness, which is cleaned up when the test ends.
+func New(t testing.TB, opts Options) *Harness {
+	t.Helper()
+
+	h := &Harness{CA: opts.CA, t: t}
+	if h.CA == nil {
+		h.CA = NewACMEServer(t, ACMEServerOptions{})
+	}
+
+	template := opts.Config
+	if template.Storage == nil {
+		template.Storage = &certmagic.FileStorage{Path: t.TempDir()}
+	}
+	if template.Logger == nil {
+		template.Logger = zap.NewNop()
+	}
+	next := template.OnEvent
+	template.OnEvent = func(ctx context.Context, event string, data map[string]any) error {
+		h.mu.Lock()
+		h.events = append(h.events, Event{Name: event, Data: data})
+		h.mu.Unlock()
+		if next != nil {
+			return next(ctx, event, data)
+		}
+		return nil
+	}
+	h.Storage = template.Storage
+
+	h.Cache = certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return h.Config, nil
+		},
+		Logger: template.Logger,
+	})
+	t.Cleanup(h.Cache.Stop)
+	h.Config = certmagic.New(h.Cache, template)
+
+	issuer := opts.Issuer
+	issuer.CA = h.CA.DirectoryURL()
+	issuer.TestCA = ""
+	issuer.TrustedRoots = h.CA.TLSRoots()
+	issuer.Agreed = true
+	issuer.DisableTLSALPNChallenge = true
+	issuer.DNS01Solver = noopSolver{}
+	if issuer.Email == "" {
+		issuer.Email = "certmagictest@example.com"
+	}
+	if issuer.Logger == nil {
+		issuer.Logger = template.Logger
+	}
+	h.Issuer = certmagic.NewACMEIssuer(h.Config, issuer)
+	h.Config.Issuers = []certmagic.Issuer{h.Issuer}
+
+	return h
+}
+
+// Obtain obtains and caches a certificate for name, and fails the test
+// if that fails.
+func (h *Harness) Obtain(name string) certmagic.Certificate {
+	h.t.Helper()
+	if err := h.Config.ObtainCertSync(h.t.Context(), name); err != nil {
+		h.t.Fatalf("obtaining certificate for %s: %v", name, err)
+	}
+	return h.load(name)
+}
+
+// Renew renews and caches the certificate for name, even if it doesn't
+// need to be renewed yet, and fails the test if that fails.
+func (h *Harness) Renew(name string) certmagic.Certificate {
+	h.t.Helper()
+	if err := h.Config.RenewCertSync(h.t.Context(), name, true); err != nil {
+		h.t.Fatalf("renewing certificate for %s: %v", name, err)
+	}
+	h.Cache.RemoveManaged([]certmagic.SubjectIssuer{{Subject: name}})
+	return h.load(name)
+}
+
+// Revoke revokes the certificate for name with the given reason (see
+// the acme.ReasonX constants), and fails the test if that fails.
+func (h *Harness) Revoke(name string, reason int) {
+	h.t.Helper()
+	if err := h.Config.RevokeCert(h.t.Context(), name, reason, false); err != nil {
+		h.t.Fatalf("revoking certificate for %s: %v", name, err)
+	}
+}
+
+func (h *Harness) load(name string) certmagic.Certificate {
+	h.t.Helper()
+	cert, err := h.Config.CacheManagedCertificate(h.t.Context(), name)
+	if err != nil {
+		h.t.Fatalf("loading certificate for %s: %v", name, err)
+	}
+	return cert
+}
+
+// Handshake performs a TLS handshake with the harness's config as the
+// server, and a client that trusts the CA's roots and connects to
+// serverName, and returns the certificate chain the client verified.
+func (h *Harness) Handshake(serverName string) ([]*x509.Certificate, error) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+		_ = tls.Server(serverConn, h.Config.TLSConfig()).HandshakeContext(h.t.Context())
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    h.CA.Roots(),
+	})
+	if err := client.HandshakeContext(h.t.Context()); err != nil {
+		return nil, err
+	}
+	chains := client.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return nil, nil
+	}
+	return chains[0], nil
+}
+
+// Events returns the events the config emitted so far, in order; if
+// names are given, only events with one of those names.
+func (h *Harness) Events(names ...string) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []Event
+	for _, e := range h.events {
+		if len(names) == 0 || slices.Contains(names, e.Name) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// noopSolver "solves" challenges of test CAs, which don't validate them.
+type noopSolver struct{}
+
+func (noopSolver) Present(context.Context, acme.Challenge) error { return nil }
+func (noopSolver) CleanUp(context.Context, acme.Challenge) error { return nil }
@@ -0,0 +1,89 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestHarness(t *testing.T) {
+	ca := NewACMEServer(t, ACMEServerOptions{})
+	h := New(t, Options{CA: ca})
+
+	cert := h.Obtain("example.com")
+	if !slices.Equal(cert.Names, []string{"example.com"}) {
+		t.Errorf("Unexpected names: %v", cert.Names)
+	}
+	chain, err := h.Handshake("example.com")
+	if err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if len(chain) != 3 || chain[0].SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Errorf("Expected obtained certificate to be served with intermediate and root, got %d certificates", len(chain))
+	}
+
+	renewed := h.Renew("example.com")
+	if renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Error("Expected renewal to issue a new certificate")
+	}
+	if chain, err := h.Handshake("example.com"); err != nil || chain[0].SerialNumber.Cmp(renewed.Leaf.SerialNumber) != 0 {
+		t.Errorf("Expected renewed certificate to be served: %v", err)
+	}
+
+	h.Revoke("example.com", acme.ReasonSuperseded)
+	if reason, ok := ca.RevocationReason(renewed.Leaf); !ok || reason != acme.ReasonSuperseded {
+		t.Errorf("Expected certificate to be revoked as superseded, got %d (%t)", reason, ok)
+	}
+	if issued := ca.Issued(); len(issued) != 2 {
+		t.Errorf("Expected 2 issued certificates, got %d", len(issued))
+	}
+	if len(h.Events("cert_obtained")) != 2 {
+		t.Errorf("Expected 2 cert_obtained events, got %v", h.Events())
+	}
+}
+
+func TestHarnessWildcard(t *testing.T) {
+	h := New(t, Options{})
+	h.Obtain("*.example.com")
+	if _, err := h.Handshake("www.example.com"); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+}
+
+func TestACMEServerRejectIdentifiers(t *testing.T) {
+	ca := NewACMEServer(t, ACMEServerOptions{RejectIdentifiers: []string{"bad.example.com"}})
+	h := New(t, Options{CA: ca})
+	if err := h.Config.ObtainCertSync(t.Context(), "bad.example.com"); err == nil {
+		t.Fatal("Expected obtaining certificate to fail")
+	}
+	if len(ca.Issued()) != 0 {
+		t.Error("Expected no certificate to be issued")
+	}
+	if len(h.Events("cert_failed")) != 1 {
+		t.Errorf("Expected cert_failed event, got %v", h.Events())
+	}
+}
+
+func TestPebble(t *testing.T) {
+	h := New(t, Options{CA: StartPebble(t)})
+	h.Obtain("example.com")
+	if _, err := h.Handshake("example.com"); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	h.Revoke("example.com", acme.ReasonUnspecified)
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagictest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Pebble is a Pebble ACME test server (https://github.com/letsencrypt/pebble)
+// running as a subprocess. Unlike ACMEServer, it is a complete CA with
+// the same behavior as Let's Encrypt's production CA, so it is a more
+// realistic (but slower) test.
+type Pebble struct {
+	dirURL   string
+	tlsRoots *x509.CertPool
+	roots    *x509.CertPool
+}
+
+// StartPebble starts Pebble, which is stopped when the test ends. The
+// pebble binary is run from the path in the PEBBLE environment variable,
+// or else from $PATH; if it isn't found, the test is skipped. Pebble is
+// run with PEBBLE_VA_ALWAYS_VALID=1, so challenges don't have to (and
+// can't) actually be solved.
+func StartPebble(t testing.TB) *Pebble {
+	t.Helper()
+
+	path := os.Getenv("PEBBLE")
+	if path == "" {
+		var err error
+		if path, err = exec.LookPath("pebble"); err != nil {
+			t.Skip("pebble not found in $PATH; set $PEBBLE to its path to run this test")
+		}
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	tlsCert, err := writeLocalhostCert(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("generating Pebble's certificate: %v", err)
+	}
+	listenAddr, err := freeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	managementAddr, err := freeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := json.Marshal(map[string]any{
+		"pebble": map[string]any{
+			"listenAddress":           listenAddr,
+			"managementListenAddress": managementAddr,
+			"certificate":             certFile,
+			"privateKey":              keyFile,
+			"httpPort":                5002,
+			"tlsPort":                 5001,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "pebble-config.json")
+	if err := os.WriteFile(configFile, config, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := new(syncBuffer)
+	cmd := exec.Command(path, "-config", configFile)
+	cmd.Env = append(os.Environ(),
+		"PEBBLE_VA_ALWAYS_VALID=1",
+		"PEBBLE_VA_NOSLEEP=1",
+		"PEBBLE_WFE_NONCEREJECT=0")
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting Pebble: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if t.Failed() {
+			t.Logf("Pebble output:\n%s", output)
+		}
+	})
+
+	p := &Pebble{
+		dirURL:   "https://" + listenAddr + "/dir",
+		tlsRoots: x509.NewCertPool(),
+	}
+	p.tlsRoots.AddCert(tlsCert)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: p.tlsRoots}},
+	}
+
+	// wait for Pebble to be ready, then get the root it issues from
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := client.Get(p.dirURL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Pebble did not become ready: %v\n%s", err, output)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	resp, err := client.Get("https://" + managementAddr + "/roots/0")
+	if err != nil {
+		t.Fatalf("getting Pebble's root: %v", err)
+	}
+	defer resp.Body.Close()
+	rootPEM, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading Pebble's root: %v", err)
+	}
+	p.roots = x509.NewCertPool()
+	if !p.roots.AppendCertsFromPEM(rootPEM) {
+		t.Fatalf("no root in Pebble's response: %s", rootPEM)
+	}
+
+	return p
+}
+
+// DirectoryURL returns the URL of Pebble's ACME directory.
+func (p *Pebble) DirectoryURL() string { return p.dirURL }
+
+// TLSRoots returns a pool with the certificate Pebble's HTTPS endpoint
+// serves, for ACME clients to trust.
+func (p *Pebble) TLSRoots() *x509.CertPool { return p.tlsRoots }
+
+// Roots returns a pool with the root of the certificates Pebble issues,
+// for TLS clients to trust.
+func (p *Pebble) Roots() *x509.CertPool { return p.roots }
+
+// writeLocalhostCert writes a self-signed certificate for localhost and
+// 127.0.0.1, and its key, to certFile and keyFile.
+func writeLocalhostCert(certFile, keyFile string) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// freeAddr returns a loopback address with a port that is free to
+// listen on.
+func freeAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("finding free port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+// Interface guard
+var _ CA = (*Pebble)(nil)
@@ -0,0 +1,137 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CertSelectionPolicy is a CertificateSelector that chooses among
+// the certificates for a name by common preferences, so that they
+// don't need a custom selector. Set it as the CertSelection of a
+// Config.
+//
+// Like DefaultCertificateSelector, it prefers certificates that
+// the client supports, and of those, ones that are currently
+// valid. Then the preferences apply in the order of the fields.
+// Certificates it can't tell apart are chosen by hash, so that
+// the choice doesn't depend on the order they were cached in.
+//
+// EXPERIMENTAL: Subject to change.
+type CertSelectionPolicy struct {
+	// Prefer certificates issued by these issuers, in
+	// order; each is an issuer key (like the CA URL of
+	// an ACMEIssuer without its scheme), or the common
+	// name or organization of the issuing certificate.
+	PreferIssuers []string
+
+	// Prefer certificates with ECDSA keys. Clients that
+	// don't support them, as told by the signature
+	// schemes and cipher suites of their ClientHello,
+	// get certificates with other keys, like RSA.
+	PreferECDSA bool
+
+	// Prefer the most recently issued certificates
+	// (with the latest NotBefore).
+	PreferNewest bool
+}
+
+// SelectCertificate chooses the most preferred of choices for hello.
+// If the client supports none of them, it chooses the most preferred
+// one anyway, as DefaultCertificateSelector does.
+func (p CertSelectionPolicy) SelectCertificate(hello *tls.ClientHelloInfo, choices []Certificate) (Certificate, error) {
+	if len(choices) == 0 {
+		return Certificate{}, HandshakeError{Kind: ErrNoCertAvailable, Name: hello.ServerName}
+	}
+	now := time.Now()
+	best, bestPref := 0, p.preference(hello, &choices[0], now)
+	for i := 1; i < len(choices); i++ {
+		if pref := p.preference(hello, &choices[i], now); pref.compare(bestPref) < 0 {
+			best, bestPref = i, pref
+		}
+	}
+	return choices[best], nil
+}
+
+// certPreference is how much a certificate is preferred;
+// the zero values of its fields are preferred.
+type certPreference struct {
+	unsupported bool
+	invalid     bool
+	issuer      int
+	notECDSA    bool
+	age         time.Duration
+	hash        string
+}
+
+func (p CertSelectionPolicy) preference(hello *tls.ClientHelloInfo, cert *Certificate, now time.Time) certPreference {
+	pref := certPreference{
+		unsupported: hello.SupportsCertificate(&cert.Certificate) != nil,
+		invalid:     now.Before(cert.Leaf.NotBefore) || now.After(expiresAt(cert.Leaf)),
+		issuer:      len(p.PreferIssuers),
+		hash:        cert.hash,
+	}
+	if i := slices.IndexFunc(p.PreferIssuers, func(issuer string) bool {
+		return issuedBy(cert, issuer)
+	}); i >= 0 {
+		pref.issuer = i
+	}
+	if p.PreferECDSA {
+		pref.notECDSA = cert.Leaf.PublicKeyAlgorithm != x509.ECDSA
+	}
+	if p.PreferNewest {
+		pref.age = now.Sub(cert.Leaf.NotBefore)
+	}
+	return pref
+}
+
+// compare returns a negative number if a is preferred to b, a positive
+// number if b is preferred to a, and 0 if they are the same.
+func (a certPreference) compare(b certPreference) int {
+	return cmp.Or(
+		compareBool(a.unsupported, b.unsupported),
+		compareBool(a.invalid, b.invalid),
+		cmp.Compare(a.issuer, b.issuer),
+		compareBool(a.notECDSA, b.notECDSA),
+		cmp.Compare(a.age, b.age),
+		strings.Compare(a.hash, b.hash),
+	)
+}
+
+// issuedBy returns whether cert was issued by issuer, which is an
+// issuer key or the common name or organization of the issuer.
+func issuedBy(cert *Certificate, issuer string) bool {
+	return cert.issuerKey == issuer ||
+		cert.Leaf.Issuer.CommonName == issuer ||
+		slices.Contains(cert.Leaf.Issuer.Organization, issuer)
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// Interface guard
+var _ CertificateSelector = CertSelectionPolicy{}
@@ -0,0 +1,178 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCertSelectionPolicy(t *testing.T) {
+	const name = "select.example.com"
+	now := time.Now()
+	ecdsaOld := newSelectionTestCert(t, "ecdsa-old", true, "Issuer A", now.Add(-48*time.Hour))
+	ecdsaNew := newSelectionTestCert(t, "ecdsa-new", true, "Issuer B", now.Add(-time.Hour))
+	rsaCert := newSelectionTestCert(t, "rsa", false, "Issuer B", now.Add(-2*time.Hour))
+	expired := newSelectionTestCert(t, "expired", true, "Issuer A", now.Add(-1000*time.Hour))
+	expired.Leaf.NotAfter = now.Add(-time.Hour)
+
+	modern := &tls.ClientHelloInfo{
+		ServerName:        name,
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+	rsaOnly := &tls.ClientHelloInfo{
+		ServerName:        name,
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+
+	for i, tc := range []struct {
+		policy  CertSelectionPolicy
+		hello   *tls.ClientHelloInfo
+		choices []Certificate
+		expect  string
+	}{
+		{
+			policy:  CertSelectionPolicy{PreferECDSA: true},
+			hello:   modern,
+			choices: []Certificate{rsaCert, ecdsaOld},
+			expect:  "ecdsa-old",
+		},
+		{
+			// falls back to RSA for clients without ECDSA
+			policy:  CertSelectionPolicy{PreferECDSA: true},
+			hello:   rsaOnly,
+			choices: []Certificate{ecdsaOld, rsaCert, ecdsaNew},
+			expect:  "rsa",
+		},
+		{
+			policy:  CertSelectionPolicy{PreferNewest: true},
+			hello:   modern,
+			choices: []Certificate{ecdsaOld, rsaCert, ecdsaNew},
+			expect:  "ecdsa-new",
+		},
+		{
+			policy:  CertSelectionPolicy{PreferIssuers: []string{"Issuer A"}, PreferNewest: true},
+			hello:   modern,
+			choices: []Certificate{ecdsaNew, ecdsaOld},
+			expect:  "ecdsa-old",
+		},
+		{
+			// the issuer key works too, and only issuers
+			// the client supports certificates of count
+			policy:  CertSelectionPolicy{PreferIssuers: []string{"ca.example/b"}, PreferECDSA: true},
+			hello:   rsaOnly,
+			choices: []Certificate{ecdsaNew, ecdsaOld, rsaCert},
+			expect:  "rsa",
+		},
+		{
+			// valid certificates come first
+			policy:  CertSelectionPolicy{PreferIssuers: []string{"Issuer A"}},
+			hello:   modern,
+			choices: []Certificate{expired, ecdsaNew},
+			expect:  "ecdsa-new",
+		},
+		{
+			// if the client supports none, the most preferred
+			policy:  CertSelectionPolicy{PreferNewest: true},
+			hello:   rsaOnly,
+			choices: []Certificate{ecdsaOld, ecdsaNew},
+			expect:  "ecdsa-new",
+		},
+	} {
+		// the choice doesn't depend on the order of the choices
+		for _, choices := range [][]Certificate{tc.choices, reversed(tc.choices)} {
+			cert, err := tc.policy.SelectCertificate(tc.hello, choices)
+			if err != nil {
+				t.Fatalf("Test %d: %v", i, err)
+			}
+			if cert.hash != tc.expect {
+				t.Errorf("Test %d: Expected %s, got %s", i, tc.expect, cert.hash)
+			}
+		}
+	}
+
+	// without preferences, ties are broken by hash
+	for _, choices := range [][]Certificate{{ecdsaNew, ecdsaOld}, {ecdsaOld, ecdsaNew}} {
+		if cert, _ := (CertSelectionPolicy{}).SelectCertificate(modern, choices); cert.hash != "ecdsa-new" {
+			t.Errorf("Expected ecdsa-new, got %s", cert.hash)
+		}
+	}
+
+	if _, err := (CertSelectionPolicy{}).SelectCertificate(modern, nil); err == nil {
+		t.Error("Expected an error without choices")
+	}
+}
+
+func newSelectionTestCert(t *testing.T, hash string, useECDSA bool, issuerOrg string, notBefore time.Time) Certificate {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	if useECDSA {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hash, Organization: []string{issuerOrg}},
+		DNSNames:     []string{"select.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := Certificate{
+		Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf},
+		Names:       []string{"select.example.com"},
+		hash:        hash,
+	}
+	if issuerOrg == "Issuer B" {
+		cert.issuerKey = "ca.example/b"
+	}
+	return cert
+}
+
+func reversed[T any](s []T) []T {
+	s = slices.Clone(s)
+	slices.Reverse(s)
+	return s
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"sync"
+	"time"
+)
+
+// distributedChallenges briefly remembers challenges that were initiated
+// by other instances, after they were loaded from storage or a cluster
+// solver, keyed by identifier. CAs that validate from multiple network
+// perspectives send several requests within seconds, and without this,
+// each of them would cost a storage round-trip (and for TLS-ALPN, the
+// creation of a certificate).
+//
+// Challenges for the same identifier don't overlap, but a failed one can
+// be followed by a new one; so entries are kept only for a short time,
+// which is much less than the time before a failed issuance is retried,
+// and HTTP challenges are only answered from here if the token matches.
+var distributedChallenges = &challengeCache{
+	ttl:     distributedChallengeTTL,
+	entries: make(map[string]cachedChallenge),
+}
+
+type challengeCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedChallenge
+}
+
+type cachedChallenge struct {
+	chal    Challenge
+	expires time.Time
+}
+
+// get returns the challenge for identifier, if it hasn't expired.
+func (cc *challengeCache) get(identifier string) (Challenge, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	entry, ok := cc.entries[identifier]
+	if !ok {
+		return Challenge{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cc.entries, identifier)
+		return Challenge{}, false
+	}
+	return entry.chal, true
+}
+
+// put remembers chal for identifier, and forgets expired challenges.
+func (cc *challengeCache) put(identifier string, chal Challenge) {
+	now := time.Now()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for id, entry := range cc.entries {
+		if now.After(entry.expires) {
+			delete(cc.entries, id)
+		}
+	}
+	cc.entries[identifier] = cachedChallenge{chal: chal, expires: now.Add(cc.ttl)}
+}
+
+// setData attaches data, like the TLS-ALPN certificate, to the challenge
+// for identifier, if it is still remembered and has the same token.
+func (cc *challengeCache) setData(identifier, token string, data any) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	entry, ok := cc.entries[identifier]
+	if !ok || entry.chal.Token != token {
+		return
+	}
+	entry.chal.data = data
+	cc.entries[identifier] = entry
+}
+
+// forget forgets the challenge for identifier.
+func (cc *challengeCache) forget(identifier string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.entries, identifier)
+}
+
+// distributedChallengeTTL is how long challenges of
+// other instances are remembered after loading them.
+const distributedChallengeTTL = 30 * time.Second
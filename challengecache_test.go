@@ -0,0 +1,134 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestDistributedChallengesCached(t *testing.T) {
+	storage := &recordingStorage{Storage: &FileStorage{Path: t.TempDir()}}
+	am := &ACMEIssuer{CA: "https://example.com/acme/directory", Logger: defaultTestLogger}
+	cfg := &Config{
+		Issuers:   []Issuer{am},
+		Storage:   storage,
+		Logger:    defaultTestLogger,
+		certCache: new(Cache),
+	}
+	am.config = cfg
+	ds := distributedSolver{storage: storage, storageKeyIssuerPrefix: storageKeyACMECAPrefix(am.IssuerKey())}
+
+	// another instance presents a challenge
+	const host = "cached-challenge.example.com"
+	defer distributedChallenges.forget(host)
+	present := func(token string) {
+		t.Helper()
+		storeDistributedChallenge(t, ds, acme.Challenge{
+			Type:             acme.ChallengeTypeHTTP01,
+			Identifier:       acme.Identifier{Type: "dns", Value: host},
+			Token:            token,
+			KeyAuthorization: token + ".thumbprint",
+		})
+	}
+	solve := func(token string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/.well-known/acme-challenge/"+token, nil)
+		rw := httptest.NewRecorder()
+		if !am.HandleHTTPChallenge(rw, req) {
+			t.Fatalf("Expected challenge with token %s to be handled", token)
+		}
+		return rw.Body.String()
+	}
+	loads := func() int {
+		var n int
+		for _, call := range storage.calls {
+			if call.name == "Load" && call.args[0] == ds.challengeTokensKey(host) {
+				n++
+			}
+		}
+		return n
+	}
+
+	present("first")
+	for range 4 {
+		if body := solve("first"); body != "first.thumbprint" {
+			t.Errorf("Expected key authorization, got %q", body)
+		}
+	}
+	if n := loads(); n != 1 {
+		t.Errorf("Expected challenge to be loaded from storage once, got %d loads", n)
+	}
+
+	// a new challenge for the same name isn't answered with the old one
+	present("second")
+	if body := solve("second"); body != "second.thumbprint" {
+		t.Errorf("Expected key authorization of new challenge, got %q", body)
+	}
+}
+
+func TestDistributedTLSALPNChallengeCertCached(t *testing.T) {
+	storage := &FileStorage{Path: t.TempDir()}
+	am := &ACMEIssuer{CA: "https://example.com/acme/directory", Logger: defaultTestLogger}
+	cfg := &Config{
+		Issuers:   []Issuer{am},
+		Storage:   storage,
+		Logger:    defaultTestLogger,
+		certCache: new(Cache),
+	}
+	am.config = cfg
+	ds := distributedSolver{storage: storage, storageKeyIssuerPrefix: storageKeyACMECAPrefix(am.IssuerKey())}
+
+	const host = "cached-alpn.example.com"
+	defer distributedChallenges.forget(host)
+	storeDistributedChallenge(t, ds, acme.Challenge{
+		Type:             acme.ChallengeTypeTLSALPN01,
+		Identifier:       acme.Identifier{Type: "dns", Value: host},
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: host}
+	first, distributed, err := cfg.getTLSALPNChallengeCert(hello)
+	if err != nil || !distributed {
+		t.Fatalf("Expected distributed challenge certificate, got distributed=%t err=%v", distributed, err)
+	}
+	second, _, err := cfg.getTLSALPNChallengeCert(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("Expected challenge certificate to be reused")
+	}
+}
+
+// storeDistributedChallenge stores chal like the distributed
+// solver of another instance does when presenting it.
+func storeDistributedChallenge(t *testing.T, ds distributedSolver, chal acme.Challenge) {
+	t.Helper()
+	chalJSON, err := json.Marshal(chal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.storage.Store(context.Background(), ds.challengeTokensKey(challengeKey(chal)), chalJSON); err != nil {
+		t.Fatal(err)
+	}
+}
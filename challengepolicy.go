@@ -0,0 +1,202 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// ChallengePolicy configures which challenge types an ACMEIssuer
+// tries, in which order, and how it retries failed attempts. Without
+// a policy, the ACME client tries all enabled challenge types within
+// one order, preferring the ones that succeeded most often.
+//
+// With a policy, each attempt is an order in which only one challenge
+// type is enabled, and after a failed attempt, the next attempt uses
+// the next challenge type (round-robin) after a backoff that doubles
+// with every attempt. A "challenge_attempt" event is emitted with the
+// outcome of each attempt.
+//
+// Challenge types that have no solver (for example, because they are
+// disabled, or because IP addresses can't be validated with DNS-01)
+// are skipped. Listing the HTTP-01 or TLS-ALPN-01 challenge enables it
+// alongside a DNS01Solver, which is otherwise used exclusively.
+//
+// EXPERIMENTAL: Subject to change.
+type ChallengePolicy struct {
+	// The challenge types to try, in order of preference,
+	// like "http-01", "tls-alpn-01", and "dns-01".
+	// Default: http-01, tls-alpn-01, dns-01.
+	Order []string
+
+	// The challenge types to try if the order has a wildcard
+	// name, which the CA can only validate with DNS-01, like
+	// a DNS01Solver for a different provider. Default: Order.
+	WildcardOrder []string
+
+	// The maximum number of attempts. Default: the number of
+	// challenge types to try, so each is tried once.
+	MaxAttempts int
+
+	// The backoff before the second attempt, which doubles for
+	// each further attempt, up to MaxBackoff. Defaults: 2s, 1m.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// order returns the challenge types to try for names, in order.
+func (cp *ChallengePolicy) order(names []string) []string {
+	if len(cp.WildcardOrder) > 0 && slices.ContainsFunc(names, func(name string) bool { return strings.HasPrefix(name, "*.") }) {
+		return cp.WildcardOrder
+	}
+	if len(cp.Order) > 0 {
+		return cp.Order
+	}
+	return []string{acme.ChallengeTypeHTTP01, acme.ChallengeTypeTLSALPN01, acme.ChallengeTypeDNS01}
+}
+
+// enablesNonDNSChallenges returns whether the policy tries other
+// challenges than DNS-01.
+func (cp *ChallengePolicy) enablesNonDNSChallenges() bool {
+	for _, order := range [][]string{cp.order(nil), cp.WildcardOrder} {
+		if slices.ContainsFunc(order, func(chalType string) bool { return chalType != acme.ChallengeTypeDNS01 }) {
+			return true
+		}
+	}
+	return false
+}
+
+// obtainCertificate obtains certificate chains with client according
+// to the challenge policy of am: it tries one challenge type at a time,
+// in the order of the policy, with backoff between attempts.
+func (am *ACMEIssuer) obtainCertificate(ctx context.Context, client *acmez.Client, params acmez.OrderParameters, names []string) ([]acme.Certificate, error) {
+	policy := am.ChallengePolicy
+	if policy == nil {
+		return client.ObtainCertificate(ctx, params)
+	}
+
+	solvers := client.ChallengeSolvers
+	defer func() { client.ChallengeSolvers = solvers }()
+
+	return am.tryChallenges(ctx, policy, names, solvers, func(solvers map[string]acmez.Solver) ([]acme.Certificate, error) {
+		client.ChallengeSolvers = solvers
+		return client.ObtainCertificate(ctx, params)
+	})
+}
+
+// tryChallenges calls obtain with the solver of one challenge type at
+// a time, according to policy, until it succeeds.
+func (am *ACMEIssuer) tryChallenges(ctx context.Context, policy *ChallengePolicy, names []string, solvers map[string]acmez.Solver,
+	obtain func(map[string]acmez.Solver) ([]acme.Certificate, error)) ([]acme.Certificate, error) {
+	var chalTypes []string
+	for _, chalType := range policy.order(names) {
+		if _, ok := solvers[chalType]; ok && !slices.Contains(chalTypes, chalType) {
+			chalTypes = append(chalTypes, chalType)
+		}
+	}
+	if len(chalTypes) == 0 {
+		// nothing in the policy can be used; fall back to what can
+		return obtain(solvers)
+	}
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = len(chalTypes)
+	}
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = 2 * time.Second
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+
+		chalType := chalTypes[(attempt-1)%len(chalTypes)]
+		start := time.Now()
+		var certChains []acme.Certificate
+		certChains, err = obtain(map[string]acmez.Solver{chalType: solvers[chalType]})
+
+		data := map[string]any{
+			"identifiers":    names,
+			"challenge_type": chalType,
+			"attempt":        attempt,
+			"max_attempts":   maxAttempts,
+			"success":        err == nil,
+			"elapsed":        time.Since(start),
+		}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		am.config.emit(ctx, "challenge_attempt", data)
+
+		if err == nil {
+			return certChains, nil
+		}
+		if !retryableWithOtherChallenge(err) || attempt == maxAttempts {
+			break
+		}
+		am.Logger.Warn("attempt to obtain certificate failed; retrying",
+			zap.Strings("identifiers", names),
+			zap.String("challenge_type", chalType),
+			zap.Int("attempt", attempt),
+			zap.Int("max_attempts", maxAttempts),
+			zap.Duration("retrying_in", backoff),
+			zap.Error(err))
+	}
+	return nil, err
+}
+
+// retryableWithOtherChallenge returns whether err, from obtaining a
+// certificate, might not happen again with another attempt; errors
+// about the account, rate limits and the like don't depend on the
+// challenge.
+func retryableWithOtherChallenge(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var problem acme.Problem
+	if errors.As(err, &problem) {
+		switch problem.Type {
+		case acme.ProblemTypeAccountDoesNotExist,
+			acme.ProblemTypeRateLimited,
+			acme.ProblemTypeRejectedIdentifier,
+			acme.ProblemTypeUnsupportedIdentifier,
+			acme.ProblemTypeExternalAccountRequired,
+			acme.ProblemTypeUserActionRequired:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestChallengePolicyTryChallenges(t *testing.T) {
+	var events []map[string]any
+	cfg := &Config{
+		Logger: defaultTestLogger,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "challenge_attempt" {
+				events = append(events, data)
+			}
+			return nil
+		},
+	}
+	am := NewACMEIssuer(cfg, ACMEIssuer{Logger: defaultTestLogger})
+	policy := &ChallengePolicy{
+		Order:          []string{acme.ChallengeTypeTLSALPN01, acme.ChallengeTypeHTTP01},
+		WildcardOrder:  []string{acme.ChallengeTypeDNS01},
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}
+	solvers := map[string]acmez.Solver{
+		acme.ChallengeTypeHTTP01:    &httpSolver{},
+		acme.ChallengeTypeTLSALPN01: &tlsALPNSolver{},
+		acme.ChallengeTypeDNS01:     &DNS01Solver{},
+	}
+
+	// one challenge type per attempt, in order, round-robin
+	var tried []string
+	_, err := am.tryChallenges(context.Background(), policy, []string{"example.com"}, solvers, func(solvers map[string]acmez.Solver) ([]acme.Certificate, error) {
+		for chalType := range solvers {
+			tried = append(tried, chalType)
+		}
+		if len(solvers) != 1 {
+			t.Errorf("Expected one solver per attempt, got %d", len(solvers))
+		}
+		if len(tried) < 3 {
+			return nil, fmt.Errorf("validation failed")
+		}
+		return []acme.Certificate{{}}, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected success on the third attempt, got %v", err)
+	}
+	expected := []string{acme.ChallengeTypeTLSALPN01, acme.ChallengeTypeHTTP01, acme.ChallengeTypeTLSALPN01}
+	if !reflect.DeepEqual(tried, expected) {
+		t.Errorf("Expected challenge types %v, got %v", expected, tried)
+	}
+	if len(events) != 3 || events[0]["success"] != false || events[2]["success"] != true || events[2]["attempt"] != 3 {
+		t.Errorf("Expected an event for each attempt, got %v", events)
+	}
+
+	// wildcards use their own order
+	tried = nil
+	_, _ = am.tryChallenges(context.Background(), policy, []string{"*.example.com"}, solvers, func(solvers map[string]acmez.Solver) ([]acme.Certificate, error) {
+		for chalType := range solvers {
+			tried = append(tried, chalType)
+		}
+		return nil, fmt.Errorf("validation failed")
+	})
+	if !reflect.DeepEqual(tried, []string{acme.ChallengeTypeDNS01, acme.ChallengeTypeDNS01, acme.ChallengeTypeDNS01}) {
+		t.Errorf("Expected only DNS challenges for wildcard, got %v", tried)
+	}
+
+	// errors that don't depend on the challenge aren't retried
+	var attempts int
+	_, err = am.tryChallenges(context.Background(), policy, []string{"example.com"}, solvers, func(map[string]acmez.Solver) ([]acme.Certificate, error) {
+		attempts++
+		return nil, fmt.Errorf("creating new order: %w", acme.Problem{Type: acme.ProblemTypeRateLimited})
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected one attempt for rate limit error, got %d (err=%v)", attempts, err)
+	}
+}
+
+func TestChallengePolicyEnablesNonDNSChallenges(t *testing.T) {
+	dnsOnly := &ChallengePolicy{Order: []string{acme.ChallengeTypeDNS01}}
+	if dnsOnly.enablesNonDNSChallenges() {
+		t.Error("Expected DNS-only policy not to enable other challenges")
+	}
+	mixed := &ChallengePolicy{Order: []string{acme.ChallengeTypeDNS01, acme.ChallengeTypeHTTP01}}
+	if !mixed.enablesNonDNSChallenges() {
+		t.Error("Expected policy with HTTP challenge to enable other challenges")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// clientCerts is the state for managing client certificates of a config.
+type clientCerts struct {
+	mu  sync.Mutex
+	cfg *Config // manages the client certificates, with its own cache
+}
+
+// ManageClientCerts obtains client certificates (with the clientAuth
+// extended key usage) for identities, and keeps them renewed, so that
+// they can be used for mutual TLS by GetClientCertificate. This is for
+// programs, like agents, that need to authenticate to servers.
+//
+// Client certificates are obtained from cfg.ClientIssuers, and are
+// kept apart from the certificates managed for serving: in storage,
+// they are under their own issuer keys, and in memory, they are in a
+// separate cache that is never used for TLS handshakes as a server.
+// Unlike ClientCredentials, this makes sure that issued certificates
+// are valid for client authentication, and they are renewed in the
+// background like all other managed certificates.
+//
+// The config must have been made with New or NewDefault.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) ManageClientCerts(ctx context.Context, identities []string) error {
+	clientCfg, err := cfg.clientCertConfig()
+	if err != nil {
+		return err
+	}
+	return clientCfg.ManageSync(ctx, identities)
+}
+
+// GetClientCertificate returns a managed client certificate that is
+// acceptable to the server according to cri, preferring the one that
+// expires last. If there is none, it returns an empty certificate, so
+// that no certificate is sent (which the server may or may not allow).
+// It can be used as tls.Config.GetClientCertificate.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) GetClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	clientCfg, err := cfg.clientCertConfig()
+	if err != nil {
+		return nil, err
+	}
+	var chosen *Certificate
+	for _, cert := range clientCfg.certCache.getAllCerts() {
+		if cert.Expired() || cri.SupportsCertificate(&cert.Certificate) != nil {
+			continue
+		}
+		if chosen == nil || expiresAt(cert.Leaf).After(expiresAt(chosen.Leaf)) {
+			chosen = &cert
+		}
+	}
+	if chosen == nil {
+		return new(tls.Certificate), nil
+	}
+	tlsCert := chosen.Certificate
+	tlsCert.Leaf = chosen.Leaf
+	return &tlsCert, nil
+}
+
+// clientCertConfig returns the config that manages client certificates
+// for cfg, creating it if needed.
+func (cfg *Config) clientCertConfig() (*Config, error) {
+	if cfg.clientCerts == nil || cfg.certCache == nil {
+		return nil, fmt.Errorf("managing client certificates requires a config made with New")
+	}
+	cfg.clientCerts.mu.Lock()
+	defer cfg.clientCerts.mu.Unlock()
+	if cfg.clientCerts.cfg != nil {
+		return cfg.clientCerts.cfg, nil
+	}
+
+	issuers := cfg.ClientIssuers
+	if issuers == nil {
+		issuers = cfg.Issuers
+	}
+	clientCfg := *cfg
+	clientCfg.Issuers = make([]Issuer, len(issuers))
+	for i, issuer := range issuers {
+		clientCfg.Issuers[i] = clientCertIssuer{issuer}
+	}
+	clientCfg.OnDemand = nil
+	clientCfg.Preload = nil
+	clientCfg.clientCerts = nil
+	clientCfg.successor = nil
+
+	cfg.certCache.optionsMu.RLock()
+	opts := cfg.certCache.options
+	cfg.certCache.optionsMu.RUnlock()
+	clientCfg.certCache = NewCache(CacheOptions{
+		GetConfigForCert:   func(Certificate) (*Config, error) { return &clientCfg, nil },
+		OCSPCheckInterval:  opts.OCSPCheckInterval,
+		RenewCheckInterval: opts.RenewCheckInterval,
+		Logger:             opts.Logger,
+	})
+
+	// the client cache lives as long as the main one
+	go func() {
+		<-cfg.certCache.stopChan
+		clientCfg.certCache.Stop()
+	}()
+
+	cfg.clientCerts.cfg = &clientCfg
+	return &clientCfg, nil
+}
+
+// clientCertIssuer wraps an issuer of client certificates, so that
+// they are stored separately from server certificates from the same
+// issuer, and to make sure issued certificates allow client auth.
+type clientCertIssuer struct {
+	Issuer
+}
+
+// IssuerKey implements Issuer.
+func (ci clientCertIssuer) IssuerKey() string {
+	return ci.Issuer.IssuerKey() + "-client"
+}
+
+// Issue implements Issuer.
+func (ci clientCertIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	issued, err := ci.Issuer.Issue(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	eku := certs[0].ExtKeyUsage
+	if len(eku) > 0 && !slices.Contains(eku, x509.ExtKeyUsageClientAuth) && !slices.Contains(eku, x509.ExtKeyUsageAny) {
+		return nil, ErrNoRetry{fmt.Errorf("issuer %s issued a certificate that is not valid for client authentication; check its profile or template",
+			ci.Issuer.IssuerKey())}
+	}
+	return issued, nil
+}
+
+// PreCheck implements PreChecker.
+func (ci clientCertIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	if prechecker, ok := ci.Issuer.(PreChecker); ok {
+		return prechecker.PreCheck(ctx, names, interactive)
+	}
+	return nil
+}
+
+// Revoke implements Revoker.
+func (ci clientCertIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	revoker, ok := ci.Issuer.(Revoker)
+	if !ok {
+		return fmt.Errorf("issuer %s is not a Revoker", ci.Issuer.IssuerKey())
+	}
+	return revoker.Revoke(ctx, cert, reason)
+}
+
+// Interface guards
+var (
+	_ Issuer     = clientCertIssuer{}
+	_ PreChecker = clientCertIssuer{}
+	_ Revoker    = clientCertIssuer{}
+)
@@ -0,0 +1,87 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestManageClientCerts(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:       []Issuer{&testIssuer{extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}},
+		ClientIssuers: []Issuer{&testIssuer{extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}},
+		Storage:       &FileStorage{Path: tmpDir},
+		Logger:        defaultTestLogger,
+		OCSP:          OCSPConfig{DisableStapling: true},
+		KeySource:     StandardKeyGenerator{KeyType: P256},
+	})
+
+	// before any are managed, no certificate is sent
+	cri := &tls.CertificateRequestInfo{
+		Version:          tls.VersionTLS13,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+	if cert, err := cfg.GetClientCertificate(cri); err != nil || len(cert.Certificate) > 0 {
+		t.Fatalf("Expected empty certificate, got %d certs (err=%v)", len(cert.Certificate), err)
+	}
+
+	if err := cfg.ManageClientCerts(ctx, []string{"agent.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.GetClientCertificate(cri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || !slices.Contains(cert.Leaf.DNSNames, "agent.example.com") {
+		t.Fatalf("Expected client certificate for agent.example.com, got %+v", cert.Leaf)
+	}
+
+	// client certificates must not be served by the server side
+	if certs := cache.getAllMatchingCerts("agent.example.com"); len(certs) > 0 {
+		t.Error("Expected client certificate to not be in the server cache")
+	}
+	if cfg.storageHasCertResources(ctx, cfg.Issuers[0], "agent.example.com") {
+		t.Error("Expected client certificate to be stored apart from server certificates")
+	}
+
+	// issuers that don't issue client certificates are caught
+	cfg2 := New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}},
+		Storage:   &FileStorage{Path: tmpDir},
+		Logger:    defaultTestLogger,
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+	if err := cfg2.ManageClientCerts(ctx, []string{"other.example.com"}); err == nil {
+		t.Error("Expected error when issuer does not issue client certificates")
+	}
+}
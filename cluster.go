@@ -0,0 +1,336 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// ClusterSolver shares the HTTP-01 and TLS-ALPN-01 challenges that an
+// instance is solving with the other instances of its cluster, so that
+// whichever instance the CA's validation request reaches can answer
+// it. Sharing storage does the same, but a ClusterSolver also works for
+// instances that don't share storage, like regions with their own
+// buckets. Set it as the ClusterSolver of an ACMEIssuer.
+//
+// EXPERIMENTAL: Subject to change.
+type ClusterSolver interface {
+	// ShareChallenge makes chal known to the other instances.
+	ShareChallenge(ctx context.Context, chal acme.Challenge) error
+
+	// UnshareChallenge makes the other instances forget chal.
+	UnshareChallenge(ctx context.Context, chal acme.Challenge) error
+
+	// SharedChallenge returns the challenge for identifier
+	// that another instance shared, if any.
+	SharedChallenge(ctx context.Context, identifier string) (acme.Challenge, bool, error)
+}
+
+// clusterSolver is a solver that also shares its challenges
+// with a ClusterSolver.
+type clusterSolver struct {
+	solver  acmez.Solver
+	cluster ClusterSolver
+	logger  *zap.Logger
+}
+
+// Present presents the challenge with the underlying solver, and
+// then shares it with the cluster.
+func (cs clusterSolver) Present(ctx context.Context, chal acme.Challenge) error {
+	if err := cs.solver.Present(ctx, chal); err != nil {
+		return err
+	}
+	if err := cs.cluster.ShareChallenge(ctx, chal); err != nil {
+		return fmt.Errorf("sharing challenge with cluster: %w", err)
+	}
+	return nil
+}
+
+// Wait waits for the underlying solver, if it is a Waiter.
+func (cs clusterSolver) Wait(ctx context.Context, chal acme.Challenge) error {
+	if waiter, ok := cs.solver.(acmez.Waiter); ok {
+		return waiter.Wait(ctx, chal)
+	}
+	return nil
+}
+
+// CleanUp unshares the challenge and cleans it up with the
+// underlying solver; both happen even if one fails.
+func (cs clusterSolver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	if err := cs.cluster.UnshareChallenge(ctx, chal); err != nil {
+		cs.logger.Error("unsharing challenge with cluster",
+			zap.String("identifier", chal.Identifier.Value),
+			zap.String("challenge_type", chal.Type),
+			zap.Error(err))
+	}
+	return cs.solver.CleanUp(ctx, chal)
+}
+
+// HTTPClusterSolver is a ClusterSolver that pushes challenges to the
+// other instances over HTTP. Every instance must serve the
+// HTTPClusterSolver (it is an http.Handler) at the URL that the other
+// instances have in Peers, preferably over HTTPS. Requests are
+// authenticated with a secret that all instances share.
+//
+// Challenges that are shared with an instance are forgotten after
+// an hour even if they are not unshared, in case the instance that
+// shared them went away.
+//
+// EXPERIMENTAL: Subject to change.
+type HTTPClusterSolver struct {
+	// The URLs at which the other instances serve their
+	// HTTPClusterSolver. REQUIRED.
+	Peers []string
+
+	// The secret that authenticates the instances to each
+	// other; it should be at least 32 random bytes. REQUIRED.
+	Secret []byte
+
+	// The HTTP client to use. Default: a client with
+	// HTTPTimeout.
+	HTTPClient *http.Client
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu     sync.Mutex
+	shared map[string][]sharedChallenge // keyed by challengeKey
+}
+
+type sharedChallenge struct {
+	acme.Challenge
+	expires time.Time
+}
+
+// ShareChallenge implements ClusterSolver by sending chal to all
+// peers. It fails only if no peer has received it, since the CA
+// may well reach one that did.
+func (cs *HTTPClusterSolver) ShareChallenge(ctx context.Context, chal acme.Challenge) error {
+	return cs.push(ctx, http.MethodPut, chal)
+}
+
+// UnshareChallenge implements ClusterSolver by telling all peers
+// to forget chal.
+func (cs *HTTPClusterSolver) UnshareChallenge(ctx context.Context, chal acme.Challenge) error {
+	return cs.push(ctx, http.MethodDelete, chal)
+}
+
+// SharedChallenge implements ClusterSolver. Since challenges
+// are pushed to all instances, it only looks in memory.
+func (cs *HTTPClusterSolver) SharedChallenge(_ context.Context, identifier string) (acme.Challenge, bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, sc := range cs.shared[identifier] {
+		if time.Now().Before(sc.expires) {
+			return sc.Challenge, true, nil
+		}
+	}
+	return acme.Challenge{}, false, nil
+}
+
+// ServeHTTP receives the challenges that other instances share
+// or unshare.
+func (cs *HTTPClusterSolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "reading body", http.StatusBadRequest)
+		return
+	}
+	if err := cs.verify(r.Method, r.Header.Get(clusterSignatureHeader), body); err != nil {
+		cs.logger().Warn("rejected cluster challenge request",
+			zap.String("remote", r.RemoteAddr),
+			zap.Error(err))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var chal acme.Challenge
+	if err := json.Unmarshal(body, &chal); err != nil || chal.Identifier.Value == "" || chal.Token == "" {
+		http.Error(w, "invalid challenge", http.StatusBadRequest)
+		return
+	}
+
+	key := challengeKey(chal)
+	cs.mu.Lock()
+	if cs.shared == nil {
+		cs.shared = make(map[string][]sharedChallenge)
+	}
+	var kept []sharedChallenge
+	for _, sc := range cs.shared[key] {
+		if sc.Token != chal.Token && time.Now().Before(sc.expires) {
+			kept = append(kept, sc)
+		}
+	}
+	if r.Method == http.MethodPut {
+		kept = append(kept, sharedChallenge{Challenge: chal, expires: time.Now().Add(time.Hour)})
+	}
+	if len(kept) == 0 {
+		delete(cs.shared, key)
+	} else {
+		cs.shared[key] = kept
+	}
+	cs.mu.Unlock()
+
+	cs.logger().Debug("received shared challenge",
+		zap.String("method", r.Method),
+		zap.String("identifier", chal.Identifier.Value),
+		zap.String("challenge_type", chal.Type),
+		zap.String("remote", r.RemoteAddr))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// push sends chal to all peers with the given method.
+func (cs *HTTPClusterSolver) push(ctx context.Context, method string, chal acme.Challenge) error {
+	if len(cs.Secret) == 0 {
+		return fmt.Errorf("cluster solver has no secret")
+	}
+	body, err := json.Marshal(chal)
+	if err != nil {
+		return err
+	}
+	signature := cs.sign(method, time.Now(), body)
+
+	client := httpClientFor(ctx, cs.HTTPClient, HTTPTimeout)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(cs.Peers))
+	for i, peer := range cs.Peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, method, peer, bytes.NewReader(body))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(clusterSignatureHeader, signature)
+			resp, err := client.Do(req)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+				errs[i] = fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+
+	var failed int
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed++
+		errs[i] = fmt.Errorf("peer %s: %w", cs.Peers[i], err)
+		cs.logger().Warn("pushing challenge to peer",
+			zap.String("peer", cs.Peers[i]),
+			zap.String("method", method),
+			zap.String("identifier", chal.Identifier.Value),
+			zap.Error(err))
+	}
+	if failed > 0 && failed == len(cs.Peers) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// sign returns the value of the signature header of a request.
+func (cs *HTTPClusterSolver) sign(method string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",sig=" + hex.EncodeToString(cs.mac(method, timestamp, body))
+}
+
+// verify checks the signature header of a request, which must
+// be recent to prevent replays.
+func (cs *HTTPClusterSolver) verify(method, header string, body []byte) error {
+	if len(cs.Secret) == 0 {
+		return fmt.Errorf("cluster solver has no secret")
+	}
+	var timestamp, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "sig":
+			sig = value
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed signature")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > clusterSignatureMaxAge || age < -clusterSignatureMaxAge {
+		return fmt.Errorf("signature is too old or too new (%s)", age)
+	}
+	given, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(given, cs.mac(method, timestamp, body)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func (cs *HTTPClusterSolver) mac(method, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, cs.Secret)
+	h.Write([]byte(method + "\n" + timestamp + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func (cs *HTTPClusterSolver) logger() *zap.Logger {
+	logger := cs.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return logger.Named("cluster_solver")
+}
+
+const (
+	clusterSignatureHeader = "Certmagic-Cluster-Signature"
+	clusterSignatureMaxAge = 5 * time.Minute
+)
+
+// Interface guards
+var (
+	_ acmez.Solver  = clusterSolver{}
+	_ acmez.Waiter  = clusterSolver{}
+	_ ClusterSolver = (*HTTPClusterSolver)(nil)
+	_ http.Handler  = (*HTTPClusterSolver)(nil)
+)
@@ -0,0 +1,92 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestHTTPClusterSolver(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	receiver := &HTTPClusterSolver{Secret: secret}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sender := &HTTPClusterSolver{Secret: secret, Peers: []string{server.URL}}
+
+	ctx := context.Background()
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeHTTP01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	}
+	if err := sender.ShareChallenge(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := receiver.SharedChallenge(ctx, "example.com")
+	if err != nil || !ok || got.KeyAuthorization != chal.KeyAuthorization {
+		t.Fatalf("Expected receiver to have the shared challenge, got %+v (ok=%t err=%v)", got, ok, err)
+	}
+
+	// a config whose issuer has the cluster solver can answer it
+	cfg := &Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger}
+	cfg.Issuers = []Issuer{NewACMEIssuer(cfg, ACMEIssuer{ClusterSolver: receiver, Logger: defaultTestLogger})}
+	chalInfo, distributed, err := cfg.getChallengeInfo(ctx, "example.com")
+	if err != nil || !distributed || chalInfo.Token != chal.Token {
+		t.Errorf("Expected shared challenge from config, got %+v (distributed=%t err=%v)", chalInfo, distributed, err)
+	}
+
+	if err := sender.UnshareChallenge(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := receiver.SharedChallenge(ctx, "example.com"); ok {
+		t.Error("Expected challenge to be forgotten after unsharing")
+	}
+
+	// peers with another secret are rejected
+	impostor := &HTTPClusterSolver{Secret: []byte("not the secret"), Peers: []string{server.URL}}
+	if err := impostor.ShareChallenge(ctx, chal); err == nil {
+		t.Error("Expected error sharing with the wrong secret")
+	}
+	if _, ok, _ := receiver.SharedChallenge(ctx, "example.com"); ok {
+		t.Error("Expected challenge of impostor to be rejected")
+	}
+}
+
+func TestHTTPClusterSolverVerify(t *testing.T) {
+	cs := &HTTPClusterSolver{Secret: []byte("secret")}
+	body := []byte(`{"token":"x"}`)
+
+	if err := cs.verify("PUT", cs.sign("PUT", time.Now(), body), body); err != nil {
+		t.Errorf("Expected valid signature, got %v", err)
+	}
+	if err := cs.verify("DELETE", cs.sign("PUT", time.Now(), body), body); err == nil {
+		t.Error("Expected error for signature of another method")
+	}
+	if err := cs.verify("PUT", cs.sign("PUT", time.Now(), body), []byte(`{"token":"y"}`)); err == nil {
+		t.Error("Expected error for signature of another body")
+	}
+	if err := cs.verify("PUT", cs.sign("PUT", time.Now().Add(-time.Hour), body), body); err == nil {
+		t.Error("Expected error for old signature")
+	}
+	if err := cs.verify("PUT", "", body); err == nil {
+		t.Error("Expected error for missing signature")
+	}
+}
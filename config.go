@@ -32,7 +32,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mholt/acmez/v3"
@@ -55,6 +57,23 @@ type Config struct {
 	// Ratio is remaining:total lifetime.
 	RenewalWindowRatio float64
 
+	// The fraction of the renewal window by which the
+	// start of the renewal of each certificate is
+	// delayed, chosen per certificate (the same on all
+	// instances sharing storage), to spread out renewals
+	// of certificates that were issued around the same
+	// time; e.g. 0.2 spreads them over the first fifth
+	// of their renewal window. Short-lived certificates
+	// use the jitter of ShortLived instead. Default: 0.
+	// EXPERIMENTAL: Subject to change.
+	RenewalJitter float64
+
+	// How to renew short-lived certificates, which
+	// use their own renewal window ratio, and are
+	// checked for renewal more often.
+	// EXPERIMENTAL: Subject to change.
+	ShortLived ShortLivedPolicy
+
 	// An optional event callback clients can set
 	// to subscribe to certain things happening
 	// internally by this config; invocations are
@@ -70,6 +89,44 @@ type Config struct {
 	// ignore returned errors.
 	OnEvent func(ctx context.Context, event string, data map[string]any) error
 
+	// The minimum validity a certificate must have left
+	// to be used for new TLS handshakes. Certificates
+	// with less time remaining are considered unusable:
+	// on-demand certificates are renewed synchronously,
+	// and other managed certificates are reloaded from
+	// storage in case they were renewed elsewhere; if
+	// that doesn't help, the handshake fails. Useful if
+	// connections are long-lived and must not outlive
+	// their certificate. Default: 0 (serve until expiry).
+	MinServingValidity time.Duration
+
+	// How long TLS handshakes are held while their
+	// certificate is loaded, obtained, or renewed.
+	// EXPERIMENTAL: Subject to change.
+	HandshakeTimeouts HandshakeTimeouts
+
+	// If set, certificate lifecycle events are persisted
+	// in storage so that they can be replayed later by
+	// consumers that were not subscribed at the time.
+	// EXPERIMENTAL: Subject to change or removal.
+	Journal *EventJournal
+
+	// How many previous versions of each managed
+	// certificate to keep in storage when it is
+	// replaced, so that RollbackCertificate can restore
+	// them. Default: 0 (no history is kept).
+	// EXPERIMENTAL: Subject to change or removal.
+	CertificateHistory int
+
+	// If set, certificates in storage are loaded into
+	// the cache in the background when the Config is
+	// created with New, so that the first handshakes
+	// after a restart needn't wait on storage. Unlike
+	// most fields, this is not inherited from Default,
+	// since it should apply only to long-lived configs.
+	// EXPERIMENTAL: Subject to change or removal.
+	Preload *CachePreload
+
 	// DefaultServerName specifies a server name
 	// to use when choosing a certificate if the
 	// ClientHello's ServerName field is empty.
@@ -82,6 +139,46 @@ type Config struct {
 	// EXPERIMENTAL: Subject to change or removal.
 	FallbackServerName string
 
+	// How the server names (SNI values) of TLS
+	// handshakes are normalized; by default, IDNs
+	// are converted with the IDNA Lookup profile.
+	// EXPERIMENTAL: Subject to change or removal.
+	ServerNames ServerNamePolicy
+
+	// The chain to prefer if the CA offers alternate
+	// chains, for ACME issuers that have no preference
+	// of their own.
+	// EXPERIMENTAL: Subject to change or removal.
+	PreferredChains ChainPreference
+
+	// If set, missing intermediate certificates are
+	// fetched via AIA when a certificate from a Manager,
+	// storage, or the application has an incomplete
+	// chain.
+	// EXPERIMENTAL: Subject to change or removal.
+	AIA *AIAFetcher
+
+	// If set, decides how a TLS handshake that fails
+	// because no certificate could be found is surfaced
+	// to the client (see HandshakeResponse); by default,
+	// the error is returned to crypto/tls, which sends an
+	// internal_error alert.
+	// EXPERIMENTAL: Subject to change or removal.
+	OnHandshakeFailure HandshakeFailureFunc
+
+	// If set, returns routing metadata for connections
+	// after their certificate is selected; see ConnRouteFunc
+	// and ConnContext.
+	// EXPERIMENTAL: Subject to change or removal.
+	RouteConn ConnRouteFunc
+
+	// If set, managed certificates that get close to
+	// expiring without being renewed are alerted about
+	// with events when they cross these thresholds; see
+	// ExpiryAlert and DefaultExpiryAlerts.
+	// EXPERIMENTAL: Subject to change or removal.
+	ExpiryAlerts []ExpiryAlert
+
 	// The state needed to operate on-demand TLS;
 	// if non-nil, on-demand TLS is enabled and
 	// certificate operations are deferred to
@@ -92,16 +189,131 @@ type Config struct {
 	// Adds the must staple TLS extension to the CSR.
 	MustStaple bool
 
+	// If set, this function is called to customize the
+	// CSR given to each issuer before it is signed, e.g.
+	// to add extensions with custom OIDs, set subject
+	// fields, or add email or URI SANs if the CA allows
+	// them. The template already has the SANs of the
+	// certificate (and the must staple extension, if
+	// enabled); since issuers differ in what they allow,
+	// it can check which issuer the CSR is for. If it
+	// returns an error, the certificate is not obtained.
+	// EXPERIMENTAL: Subject to change.
+	CSRTemplate func(ctx context.Context, issuer Issuer, template *x509.CertificateRequest) error
+
+	// Optionally check CAA records before getting
+	// certificates, to skip issuers whose CA is not
+	// allowed to issue for the names.
+	// EXPERIMENTAL: Subject to change.
+	CAAPreflight *CAAPreflight
+
+	// Optionally send the DNS queries CertMagic makes
+	// (for DNS challenges, CAA and DANE) with this
+	// resolver instead of directly to nameservers.
+	// EXPERIMENTAL: Subject to change.
+	Resolver DNSResolver
+
+	// Optionally obtain one certificate for several
+	// names that need one around the same time, to
+	// place fewer orders with the CA.
+	// EXPERIMENTAL: Subject to change.
+	IssuanceBatching *IssuanceBatching
+
+	// If true, background obtains and renewals are
+	// persisted in storage with the progress of their
+	// retries while they are pending, so that after a
+	// restart, ResumeQueue can continue them with the
+	// same backoff.
+	// EXPERIMENTAL: Subject to change.
+	PersistentQueue bool
+
+	// Optionally publish DANE TLSA records for the
+	// managed certificates, and roll them over when
+	// certificates are renewed.
+	// EXPERIMENTAL: Subject to change.
+	DANE *DANEConfig
+
+	// Optionally decrypt Encrypted Client Hellos with the
+	// given keys in configs returned by TLSConfig, and
+	// allow obtaining the ECH public name's certificate
+	// on demand. The keys must be started separately.
+	// EXPERIMENTAL: Subject to change.
+	ECH *ECHKeys
+
+	// If true, failures to obtain or renew certificates
+	// are also kept in storage, so that IssuanceFailure
+	// finds failures of other instances and from before
+	// restarts.
+	// EXPERIMENTAL: Subject to change.
+	PersistIssuanceFailures bool
+
+	// Optionally the HTTP client to base outbound requests
+	// on, like to CAs, OCSP responders and webhooks, for
+	// instrumentation, custom dialers or timeouts. Clients
+	// configured on components (like HTTPClient fields)
+	// take precedence; ACMEIssuer applies its connection
+	// settings to a copy of its transport, if that is an
+	// *http.Transport.
+	// EXPERIMENTAL: Subject to change.
+	HTTPClient *http.Client
+
+	// Optionally control which IP address families
+	// are used to connect to CAs and OCSP responders.
+	// EXPERIMENTAL: Subject to change.
+	DialPolicy *DialPolicy
+
+	// Optionally back off, across restarts and instances
+	// sharing storage, from names that are unsuitable for
+	// issuance, like names whose CAA records forbid it.
+	// EXPERIMENTAL: Subject to change.
+	NameBackoff *NameBackoffPolicy
+
+	// Optionally generate delegated credentials (RFC 9345)
+	// for managed certificates, for TLS stacks that can
+	// serve them; see GetDelegatedCredential.
+	// EXPERIMENTAL: Subject to change.
+	DelegatedCredentials *DelegatedCredentialPolicy
+
 	// Sources for getting new, managed certificates;
 	// the default Issuer is ACMEIssuer. If multiple
 	// issuers are specified, they will be tried in
 	// turn until one succeeds.
 	Issuers []Issuer
 
+	// Settings to use instead of those above for
+	// certain subject names, keyed by name or by
+	// wildcard pattern (e.g. "*.example.com"); the
+	// most specific match is used. They apply to
+	// all certificate operations for those names,
+	// including renewals and on-demand issuance.
+	// EXPERIMENTAL: Subject to change or removal.
+	SubjectOverrides map[string]SubjectOverride
+
 	// How to select which issuer to use.
 	// Default: UseFirstIssuer (subject to change).
 	IssuerPolicy IssuerPolicy
 
+	// The relative weights of issuers, by issuer key,
+	// for the UseWeightedRandomIssuer and UseStickyIssuer
+	// policies. Issuers without a positive weight have a
+	// weight of 1.
+	// EXPERIMENTAL: Subject to change or removal.
+	IssuerWeights map[string]int
+
+	// If set, issuers that fail too often are tried
+	// after all other issuers until they recover,
+	// regardless of the IssuerPolicy.
+	// EXPERIMENTAL: Subject to change or removal.
+	IssuerErrorBudget *IssuerErrorBudget
+
+	// Sources for client certificates managed with
+	// ManageClientCerts; they must issue certificates
+	// with the clientAuth extended key usage (e.g. an
+	// ACMEIssuer with a suitable Profile). Default:
+	// Issuers.
+	// EXPERIMENTAL: Subject to change or removal.
+	ClientIssuers []Issuer
+
 	// If true, private keys already existing in storage
 	// will be reused. Otherwise, a new key will be
 	// created for every new certificate to mitigate
@@ -109,14 +321,51 @@ type Config struct {
 	// Default: false (do not reuse keys).
 	ReusePrivateKeys bool
 
+	// If true, the private key of the next certificate
+	// for each name is generated ahead of time, when the
+	// current certificate is issued, so that its pin can
+	// be published as a backup pin (see Pins) before the
+	// key is used. Ignored if ReusePrivateKeys is true.
+	// EXPERIMENTAL: Subject to change.
+	NextKeys bool
+
+	// When certificates get new private keys, and whether
+	// the next keys are published ahead of time for DANE.
+	// Implies NextKeys. Ignored if ReusePrivateKeys is true.
+	// EXPERIMENTAL: Subject to change.
+	KeyRotation *KeyRotationPolicy
+
 	// The source of new private keys for certificates;
 	// the default KeySource is StandardKeyGenerator.
 	KeySource KeyGenerator
 
+	// If set, the private keys of certificates and ACME
+	// accounts, including next keys and those of previous
+	// certificates, are encrypted with it before they are
+	// written to storage, and decrypted when they are
+	// loaded. Keys that were stored unencrypted can still
+	// be loaded. Unlike EncryptedStorage, this protects
+	// only private keys, and works with any Storage.
+	// EXPERIMENTAL: Subject to change.
+	KeyEncryption KeyEncryption
+
+	// If set, a second certificate, with a key of this
+	// type, is obtained and renewed along with each
+	// managed certificate, like an RSA2048 one alongside
+	// one with an ECDSA key, for clients that support
+	// only one of them. Handshakes are completed with
+	// the one the client supports, preferring ECDSA if
+	// CertSelection is not set. These certificates are
+	// stored apart, under the issuer keys with the key
+	// type appended. Not used for on-demand TLS.
+	// EXPERIMENTAL: Subject to change.
+	AlternateKeyType KeyType
+
 	// CertSelection chooses one of the certificates
 	// with which the ClientHello will be completed;
 	// if not set, DefaultCertificateSelector will
-	// be used.
+	// be used. CertSelectionPolicy implements common
+	// preferences without a custom selector.
 	CertSelection CertificateSelector
 
 	// OCSP configures how OCSP is handled. By default,
@@ -153,12 +402,39 @@ type Config struct {
 	// TEMPORARY: Will likely be removed in the future.
 	DisableARI bool
 
+	// The context of the work that is done for this
+	// config in the background, like updating ARI and
+	// renewing certificates after handshakes, retiring
+	// TLSA records, and maintaining the certificates of
+	// the cache. Cancel it to stop that work when the
+	// server or program that uses the config stops.
+	// Default: a context that is never canceled.
+	//
+	// EXPERIMENTAL: Subject to change.
+	Context context.Context
+
 	// Set a logger to enable logging. If not set,
 	// a default logger will be created.
 	Logger *zap.Logger
 
 	// required pointer to the in-memory cert cache
 	certCache *Cache
+
+	// Client certificates managed by this config
+	clientCerts *clientCerts
+
+	// The config that replaced this one, if it was
+	// updated (see Update)
+	successor *atomic.Pointer[Config]
+
+	// The loggers of the handshake path, built once
+	// rather than for every handshake
+	handshakeLogs *atomic.Pointer[handshakeLoggers]
+
+	// If this config manages the certificates with the
+	// alternate key type of another config, that key
+	// type (see AlternateKeyType)
+	alternateKey KeyType
 }
 
 // NewDefault makes a valid config based on the package
@@ -241,37 +517,157 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 		panic("cannot make a valid config without a pointer to a certificate cache")
 	}
 
+	cfg.setDefaults()
+
+	cfg.certCache = certCache
+	cfg.clientCerts = new(clientCerts)
+	cfg.successor = new(atomic.Pointer[Config])
+	cfg.handshakeLogs = new(atomic.Pointer[handshakeLoggers])
+
+	if cfg.Preload != nil {
+		go cfg.preload()
+	}
+
+	return &cfg
+}
+
+// setDefaults populates zero-value fields of cfg from the Default
+// Config, or with sensible defaults.
+func (cfg *Config) setDefaults() {
 	if cfg.OnDemand == nil {
 		cfg.OnDemand = Default.OnDemand
 	}
 	if !cfg.MustStaple {
 		cfg.MustStaple = Default.MustStaple
 	}
+	if !cfg.NextKeys {
+		cfg.NextKeys = Default.NextKeys
+	}
+	if cfg.KeyRotation == nil {
+		cfg.KeyRotation = Default.KeyRotation
+	}
+	if cfg.CSRTemplate == nil {
+		cfg.CSRTemplate = Default.CSRTemplate
+	}
+	// the default issuer uses the HTTP client
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = Default.HTTPClient
+	}
 	if cfg.Issuers == nil {
 		cfg.Issuers = Default.Issuers
 		if cfg.Issuers == nil {
 			// at least one issuer is absolutely required if not nil
-			cfg.Issuers = []Issuer{NewACMEIssuer(&cfg, DefaultACME)}
+			cfg.Issuers = []Issuer{NewACMEIssuer(cfg, DefaultACME)}
 		}
 	}
+	if cfg.ClientIssuers == nil {
+		cfg.ClientIssuers = Default.ClientIssuers
+	}
+	if cfg.IssuerPolicy == "" {
+		cfg.IssuerPolicy = Default.IssuerPolicy
+	}
+	if cfg.SubjectOverrides == nil {
+		cfg.SubjectOverrides = Default.SubjectOverrides
+	}
+	if cfg.IssuerWeights == nil {
+		cfg.IssuerWeights = Default.IssuerWeights
+	}
+	if cfg.IssuerErrorBudget == nil {
+		cfg.IssuerErrorBudget = Default.IssuerErrorBudget
+	}
 	if cfg.RenewalWindowRatio == 0 {
 		cfg.RenewalWindowRatio = Default.RenewalWindowRatio
 	}
+	if cfg.RenewalJitter == 0 {
+		cfg.RenewalJitter = Default.RenewalJitter
+	}
+	if cfg.ShortLived == (ShortLivedPolicy{}) {
+		cfg.ShortLived = Default.ShortLived
+	}
+	if cfg.DANE == nil {
+		cfg.DANE = Default.DANE
+	}
+	if cfg.ECH == nil {
+		cfg.ECH = Default.ECH
+	}
+	if !cfg.PersistIssuanceFailures {
+		cfg.PersistIssuanceFailures = Default.PersistIssuanceFailures
+	}
+	if cfg.DelegatedCredentials == nil {
+		cfg.DelegatedCredentials = Default.DelegatedCredentials
+	}
+	if cfg.NameBackoff == nil {
+		cfg.NameBackoff = Default.NameBackoff
+	}
+	if cfg.DialPolicy == nil {
+		cfg.DialPolicy = Default.DialPolicy
+	}
+	if cfg.CAAPreflight == nil {
+		cfg.CAAPreflight = Default.CAAPreflight
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = Default.Resolver
+	}
+	if cfg.IssuanceBatching == nil {
+		cfg.IssuanceBatching = Default.IssuanceBatching
+	}
+	if !cfg.PersistentQueue {
+		cfg.PersistentQueue = Default.PersistentQueue
+	}
 	if cfg.OnEvent == nil {
 		cfg.OnEvent = Default.OnEvent
 	}
+	if cfg.Journal == nil {
+		cfg.Journal = Default.Journal
+	}
+	if cfg.MinServingValidity == 0 {
+		cfg.MinServingValidity = Default.MinServingValidity
+	}
+	if cfg.HandshakeTimeouts == (HandshakeTimeouts{}) {
+		cfg.HandshakeTimeouts = Default.HandshakeTimeouts
+	}
+	if cfg.CertificateHistory == 0 {
+		cfg.CertificateHistory = Default.CertificateHistory
+	}
 	if cfg.KeySource == nil {
 		cfg.KeySource = Default.KeySource
 	}
+	if cfg.KeyEncryption == nil {
+		cfg.KeyEncryption = Default.KeyEncryption
+	}
+	if cfg.AlternateKeyType == "" {
+		cfg.AlternateKeyType = Default.AlternateKeyType
+	}
 	if cfg.DefaultServerName == "" {
 		cfg.DefaultServerName = Default.DefaultServerName
 	}
 	if cfg.FallbackServerName == "" {
 		cfg.FallbackServerName = Default.FallbackServerName
 	}
+	if cfg.ServerNames.isZero() {
+		cfg.ServerNames = Default.ServerNames
+	}
+	if cfg.PreferredChains.isZero() {
+		cfg.PreferredChains = Default.PreferredChains
+	}
+	if cfg.AIA == nil {
+		cfg.AIA = Default.AIA
+	}
+	if cfg.OnHandshakeFailure == nil {
+		cfg.OnHandshakeFailure = Default.OnHandshakeFailure
+	}
+	if cfg.RouteConn == nil {
+		cfg.RouteConn = Default.RouteConn
+	}
+	if cfg.ExpiryAlerts == nil {
+		cfg.ExpiryAlerts = Default.ExpiryAlerts
+	}
 	if cfg.Storage == nil {
 		cfg.Storage = Default.Storage
 	}
+	if cfg.Context == nil {
+		cfg.Context = Default.Context
+	}
 	if cfg.Logger == nil {
 		cfg.Logger = Default.Logger
 	}
@@ -288,10 +684,6 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 	if cfg.Logger == nil {
 		cfg.Logger = defaultLogger
 	}
-
-	cfg.certCache = certCache
-
-	return &cfg
 }
 
 // ManageSync causes the certificates for domainNames to be managed
@@ -366,6 +758,7 @@ func (cfg *Config) ClientCredentials(ctx context.Context, identifiers []string)
 }
 
 func (cfg *Config) manageAll(ctx context.Context, domainNames []string, async bool) error {
+	cfg = cfg.current()
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -410,6 +803,10 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 		}
 		// if we don't have one in storage, obtain one
 		obtain := func() error {
+			ctx, timer, ownTimer := withIssuanceTimer(ctx, false)
+			if ownTimer {
+				defer timer.finish(cfg.certCache)
+			}
 			var err error
 			if async {
 				err = cfg.ObtainCertAsync(ctx, domainName)
@@ -419,7 +816,9 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 			if err != nil {
 				return fmt.Errorf("%s: obtaining certificate: %w", domainName, err)
 			}
+			stopCacheLoad := timer.track(cacheLoadPhase)
 			cert, err = cfg.CacheManagedCertificate(ctx, domainName)
+			stopCacheLoad()
 			if err != nil {
 				return fmt.Errorf("%s: caching certificate after obtaining it: %v", domainName, err)
 			}
@@ -447,6 +846,11 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 	// for an existing certificate, make sure it is renewed; or if it is revoked,
 	// force a renewal even if it's not expiring
 	renew := func() error {
+		// the certificate with the alternate key may not have been obtained yet
+		if err := cfg.manageAlternateCert(ctx, domainName, !async); err != nil {
+			return fmt.Errorf("%s: obtaining certificate with alternate key: %w", domainName, err)
+		}
+
 		// first, ensure status is not revoked (it was just refreshed in CacheManagedCertificate above)
 		if !cert.Expired() && cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
 			_, err = cfg.forceRenew(ctx, cfg.Logger, cert)
@@ -506,6 +910,19 @@ func (cfg *Config) ObtainCertAsync(ctx context.Context, name string) error {
 }
 
 func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool) error {
+	if err := cfg.obtainOneCert(ctx, name, interactive); err != nil {
+		return err
+	}
+	if alt := cfg.current().alternateKeyConfig(); alt != nil {
+		return alt.obtainOneCert(ctx, name, interactive)
+	}
+	return nil
+}
+
+// obtainOneCert obtains the certificate for name with the
+// key type of cfg; see obtainCert.
+func (cfg *Config) obtainOneCert(ctx context.Context, name string, interactive bool) error {
+	cfg = cfg.current()
 	if len(cfg.Issuers) == 0 {
 		return fmt.Errorf("no issuers configured; impossible to obtain or check for existing certificate in storage")
 	}
@@ -513,6 +930,13 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 	log := cfg.Logger.Named("obtain")
 
 	name = cfg.transformSubject(ctx, log, name)
+	cfg = cfg.forSubject(name)
+	ctx = withConfig(ctx, cfg)
+
+	ctx, timer, ownTimer := withIssuanceTimer(ctx, false)
+	if ownTimer {
+		defer timer.finish(cfg.certCache)
+	}
 
 	// if storage has all resources for this certificate, obtain is a no-op
 	if cfg.storageHasCertResourcesAnyIssuer(ctx, name) {
@@ -523,44 +947,75 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 	// TODO: this is not necessary every time; should only perform check once every so often for each storage, which may require some global state...
 	err := cfg.checkStorage(ctx)
 	if err != nil {
+		cfg.emitStorageError(ctx, "check", []string{name}, err)
 		return fmt.Errorf("failed storage check: %v - storage is probably misconfigured", err)
 	}
 
-	log.Info("acquiring lock", zap.String("identifier", name))
+	// coalesce with other names into one certificate if configured to
+	if cfg.batchesIssuance(name) {
+		return cfg.certCache.issuanceBatches.obtain(ctx, cfg, name, interactive)
+	}
 
-	// ensure idempotency of the obtain operation for this name
-	lockKey := cfg.lockKey(certIssueLockOp, name)
-	err = acquireLock(ctx, cfg.Storage, lockKey)
-	if err != nil {
-		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	return cfg.obtainCertForNames(ctx, log, []string{name}, interactive)
+}
+
+// obtainCertForNames obtains one certificate for names, which is
+// stored for each of them if there are several (see IssuanceBatching);
+// names that storage already has a certificate for are left out.
+func (cfg *Config) obtainCertForNames(ctx context.Context, log *zap.Logger, names []string, interactive bool) error {
+	name := names[0]
+	ctx, done := cfg.certCache.trackOperation(ctx)
+	defer done()
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	defer func() {
-		log.Info("releasing lock", zap.String("identifier", name))
-		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
-			log.Error("unable to unlock",
-				zap.String("identifier", name),
-				zap.String("lock_key", lockKey),
-				zap.Error(err))
+	timer := issuanceTimerFromContext(ctx)
+
+	log.Info("acquiring lock", zap.Strings("identifiers", names))
+
+	// ensure idempotency of the obtain operation for these names; the
+	// locks are acquired in order so that batches can't deadlock
+	lockNames := slices.Clone(names)
+	slices.Sort(lockNames)
+	for i, lockName := range lockNames {
+		lockKey := cfg.lockKey(certIssueLockOp, lockName)
+		stopLockWait := timer.track(lockWaitPhase)
+		err := acquireLock(ctx, cfg.Storage, lockKey)
+		stopLockWait()
+		if err != nil {
+			cfg.releaseObtainLocks(ctx, log, lockNames[:i])
+			return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
 		}
-	}()
-	log.Info("lock acquired", zap.String("identifier", name))
+	}
+	defer cfg.releaseObtainLocks(ctx, log, lockNames)
+	log.Info("lock acquired", zap.Strings("identifiers", names))
 
 	f := func(ctx context.Context) error {
 		// check if obtain is still needed -- might have been obtained during lock
-		if cfg.storageHasCertResourcesAnyIssuer(ctx, name) {
+		names := slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+			return cfg.storageHasCertResourcesAnyIssuer(ctx, name)
+		})
+		if len(names) == 0 {
 			log.Info("certificate already exists in storage", zap.String("identifier", name))
 			return nil
 		}
+		name := names[0]
+		batched := len(names) > 1
 
-		log.Info("obtaining certificate", zap.String("identifier", name))
+		log.Info("obtaining certificate", zap.Strings("identifiers", names))
 
-		if err := cfg.emit(ctx, "cert_obtaining", map[string]any{"identifier": name}); err != nil {
+		eventData := map[string]any{"identifier": name}
+		if batched {
+			eventData["identifiers"] = names
+		}
+		if err := cfg.emit(ctx, "cert_obtaining", eventData); err != nil {
 			return fmt.Errorf("obtaining certificate aborted by event handler: %w", err)
 		}
-
 		// If storage has a private key already, use it; otherwise we'll generate our own.
 		// Also create the slice of issuers we will try using according to any issuer
 		// selection policy (it must be a copy of the slice so we don't mutate original).
+		stopKeyGeneration := timer.track(keyGenerationPhase)
+		var err error
 		var privKey crypto.PrivateKey
 		var privKeyPEM []byte
 		var issuers []Issuer
@@ -573,13 +1028,13 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			issuers = make([]Issuer, len(cfg.Issuers))
 			copy(issuers, cfg.Issuers)
 		}
-		if cfg.IssuerPolicy == UseFirstRandomIssuer {
-			weakrand.Shuffle(len(issuers), func(i, j int) {
-				issuers[i], issuers[j] = issuers[j], issuers[i]
-			})
+		var currentIssuerKey string
+		if privKey != nil {
+			currentIssuerKey = issuers[0].IssuerKey() // it has the key we are reusing
 		}
+		issuers = cfg.selectIssuers(name, issuers, currentIssuerKey)
 		if privKey == nil {
-			privKey, err = cfg.KeySource.GenerateKey()
+			privKey, err = cfg.newPrivateKey(ctx, name)
 			if err != nil {
 				return err
 			}
@@ -589,10 +1044,11 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			}
 		}
 
-		csr, err := cfg.generateCSR(privKey, []string{name}, false)
+		csr, err := cfg.generateCSR(privKey, names, false)
 		if err != nil {
 			return err
 		}
+		stopKeyGeneration()
 
 		// try to obtain from each issuer until we succeed
 		var issuedCert *IssuedCertificate
@@ -605,25 +1061,33 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 				zap.String("issuer", issuer.IssuerKey()))
 
 			if prechecker, ok := issuer.(PreChecker); ok {
-				err = prechecker.PreCheck(ctx, []string{name}, interactive)
+				err = prechecker.PreCheck(ctx, names, interactive)
 				if err != nil {
 					continue
 				}
 			}
+			if err = cfg.checkCAA(ctx, issuer, names); err != nil {
+				log.Error("skipping issuer because of CAA records",
+					zap.String("identifier", name),
+					zap.String("issuer", issuer.IssuerKey()),
+					zap.Error(err))
+				err = ErrNoRetry{err}
+				continue
+			}
 
-			// TODO: ZeroSSL's API currently requires CommonName to be set, and requires it be
-			// distinct from SANs. If this was a cert it would violate the BRs, but their certs
-			// are compliant, so their CSR requirements just needlessly add friction, complexity,
-			// and inefficiency for clients. CommonName has been deprecated for 25+ years.
-			useCSR := csr
-			if issuer.IssuerKey() == zerosslIssuerKey {
-				useCSR, err = cfg.generateCSR(privKey, []string{name}, true)
-				if err != nil {
-					return err
-				}
+			cfg.emitIssuerChosen(ctx, name, issuer, i, false)
+
+			var useCSR *x509.CertificateRequest
+			useCSR, err = cfg.csrForIssuer(ctx, issuer, privKey, names, csr)
+			if err != nil {
+				return err
 			}
 
+			certJobFromContext(ctx).setStatus(CertJobValidating)
+			stopIssuance := timer.track(issuancePhase)
 			issuedCert, err = issuer.Issue(ctx, useCSR)
+			stopIssuance()
+			cfg.recordIssuerResult(ctx, issuer, err)
 			if err == nil {
 				issuerUsed = issuer
 				break
@@ -640,14 +1104,19 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 				zap.String("identifier", name),
 				zap.String("issuer", issuer.IssuerKey()),
 				zap.Error(errToLog))
+			err = issuerError{issuerKey: issuer.IssuerKey(), err: err}
 		}
 		if err != nil {
-			cfg.emit(ctx, "cert_failed", map[string]any{
+			failedData := map[string]any{
 				"renewal":    false,
 				"identifier": name,
 				"issuers":    issuerKeys,
 				"error":      err,
-			})
+			}
+			if batched {
+				failedData["identifiers"] = names
+			}
+			cfg.emit(ctx, "cert_failed", failedData)
 
 			// only the error from the last issuer will be returned, but we logged the others
 			return fmt.Errorf("[%s] Obtain: %w", name, err)
@@ -664,20 +1133,29 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			CertificatePEM: issuedCert.Certificate,
 			PrivateKeyPEM:  privKeyPEM,
 			IssuerData:     metaJSON,
+			Batched:        batched,
 			issuerKey:      issuerUsed.IssuerKey(),
 		}
+		if _, err := cfg.prepareTLSAForNewCert(ctx, certRes.SANs, nil, certRes.CertificatePEM); err != nil {
+			return fmt.Errorf("[%s] Obtain: %v", name, err)
+		}
+		stopStorage := timer.track(storagePhase)
 		err = cfg.saveCertResource(ctx, issuerUsed, certRes)
+		stopStorage()
 		if err != nil {
+			cfg.emitStorageError(ctx, "store", []string{name}, err)
 			return fmt.Errorf("[%s] Obtain: saving assets: %v", name, err)
 		}
 
+		timer.markIssued()
+
 		log.Info("certificate obtained successfully",
-			zap.String("identifier", name),
+			zap.Strings("identifiers", names),
 			zap.String("issuer", issuerUsed.IssuerKey()))
 
-		certKey := certRes.NamesKey()
+		certKey := certRes.storageKeys()[0]
 
-		cfg.emit(ctx, "cert_obtained", map[string]any{
+		obtainedData := map[string]any{
 			"renewal":          false,
 			"identifier":       name,
 			"issuer":           issuerUsed.IssuerKey(),
@@ -685,24 +1163,63 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			"private_key_path": StorageKeys.SitePrivateKey(issuerKey, certKey),
 			"certificate_path": StorageKeys.SiteCert(issuerKey, certKey),
 			"metadata_path":    StorageKeys.SiteMeta(issuerKey, certKey),
+			"timing":           timer.snapshot(),
 			"csr_pem": pem.EncodeToMemory(&pem.Block{
 				Type:  "CERTIFICATE REQUEST",
 				Bytes: csr.Raw,
 			}),
-		})
+		}
+		if batched {
+			obtainedData["identifiers"] = names
+		}
+		cfg.emit(ctx, "cert_obtained", obtainedData)
+		cfg.certificateIssued(ctx, log, name, certRes, false)
 
 		return nil
 	}
 
+	// remember why obtaining fails, for IssuanceFailure, and
+	// don't bother the CA while it rate-limits these names or
+	// they are unsuitable for issuance
+	obtain := func(ctx context.Context) error {
+		if err := cfg.certCache.issuancePaused(names); err != nil {
+			return err
+		}
+		if err := cfg.checkBackoff(ctx, names); err != nil {
+			return err
+		}
+		err := cfg.classifyIssuanceError(names, f(ctx))
+		err = cfg.recordBackoff(ctx, names, err)
+		for _, name := range names {
+			cfg.recordIssuanceResult(ctx, name, false, err)
+		}
+		return err
+	}
+
+	var err error
 	if interactive {
-		err = f(ctx)
+		err = obtain(ctx)
 	} else {
-		err = doWithRetry(ctx, log, f)
+		err = doWithRetry(ctx, log, cfg.retryCheckpoint(queuedObtain, names, false), obtain)
 	}
 
 	return err
 }
 
+// releaseObtainLocks releases the obtain locks of names.
+func (cfg *Config) releaseObtainLocks(ctx context.Context, log *zap.Logger, names []string) {
+	for _, name := range names {
+		log.Info("releasing lock", zap.String("identifier", name))
+		lockKey := cfg.lockKey(certIssueLockOp, name)
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			log.Error("unable to unlock",
+				zap.String("identifier", name),
+				zap.String("lock_key", lockKey),
+				zap.Error(err))
+		}
+	}
+}
+
 // reusePrivateKey looks for a private key for domain in storage in the configured issuers
 // paths. For the first private key it finds, it returns that key both decoded and PEM-encoded,
 // as well as the reordered list of issuers to use instead of cfg.Issuers (because if a key
@@ -725,6 +1242,10 @@ func (cfg *Config) reusePrivateKey(ctx context.Context, domain string) (privKey
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("loading existing private key for reuse with issuer %s: %v", issuer.IssuerKey(), err)
 		}
+		privKeyPEM, err = cfg.decryptKeyPEM(ctx, privKeyPEM)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
 		// we loaded a private key; try decoding it so we can use it
 		privKey, err = PEMDecodePrivateKey(privKeyPEM)
@@ -769,6 +1290,19 @@ func (cfg *Config) RenewCertAsync(ctx context.Context, name string, force bool)
 }
 
 func (cfg *Config) renewCert(ctx context.Context, name string, force, interactive bool) error {
+	if err := cfg.renewOneCert(ctx, name, force, interactive); err != nil {
+		return err
+	}
+	if alt := cfg.current().alternateKeyConfig(); alt != nil {
+		return alt.renewOneCert(ctx, name, force, interactive)
+	}
+	return nil
+}
+
+// renewOneCert renews the certificate for name with the key
+// type of cfg; see renewCert.
+func (cfg *Config) renewOneCert(ctx context.Context, name string, force, interactive bool) error {
+	cfg = cfg.current()
 	if len(cfg.Issuers) == 0 {
 		return fmt.Errorf("no issuers configured; impossible to renew or check existing certificate in storage")
 	}
@@ -776,11 +1310,25 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 	log := cfg.Logger.Named("renew")
 
 	name = cfg.transformSubject(ctx, log, name)
+	cfg = cfg.forSubject(name)
+	ctx = withConfig(ctx, cfg)
+
+	ctx, done := cfg.certCache.trackOperation(ctx)
+	defer done()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ctx, timer, ownTimer := withIssuanceTimer(ctx, true)
+	if ownTimer {
+		defer timer.finish(cfg.certCache)
+	}
 
 	// ensure storage is writeable and readable
 	// TODO: this is not necessary every time; should only perform check once every so often for each storage, which may require some global state...
 	err := cfg.checkStorage(ctx)
 	if err != nil {
+		cfg.emitStorageError(ctx, "check", []string{name}, err)
 		return fmt.Errorf("failed storage check: %v - storage is probably misconfigured", err)
 	}
 
@@ -788,7 +1336,9 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 
 	// ensure idempotency of the renew operation for this name
 	lockKey := cfg.lockKey(certIssueLockOp, name)
+	stopLockWait := timer.track(lockWaitPhase)
 	err = acquireLock(ctx, cfg.Storage, lockKey)
+	stopLockWait()
 	if err != nil {
 		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
 	}
@@ -808,11 +1358,16 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		// prepare for renewal (load PEM cert, key, and meta)
 		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
 		if err != nil {
+			cfg.emitStorageError(ctx, "load", []string{name}, err)
 			return err
 		}
 
 		// check if renew is still needed - might have been renewed while waiting for lock
 		timeLeft, leaf, needsRenew := cfg.managedCertNeedsRenewal(certRes, false)
+		if !needsRenew && cfg.alternateKey != "" {
+			// renewed along with the certificate with the primary key
+			needsRenew = cfg.renewedWithoutAlternate(ctx, name, leaf)
+		}
 		if !needsRenew {
 			if force {
 				log.Info("certificate does not need to be renewed, but renewal is being forced",
@@ -840,54 +1395,72 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			return fmt.Errorf("renewing certificate aborted by event handler: %w", err)
 		}
 
+		// let issuers that can authenticate renewals with
+		// the current certificate (and key) do so
+		ctx = context.WithValue(ctx, ctxKeyRenewing, certRes)
+
 		// reuse or generate new private key for CSR
+		stopKeyGeneration := timer.track(keyGenerationPhase)
+		reuseKey := cfg.ReusePrivateKeys || cfg.KeyRotation.reusesKey(certRes)
 		var privateKey crypto.PrivateKey
-		if cfg.ReusePrivateKeys {
+		if reuseKey {
 			privateKey, err = PEMDecodePrivateKey(certRes.PrivateKeyPEM)
 		} else {
-			privateKey, err = cfg.KeySource.GenerateKey()
+			privateKey, err = cfg.newPrivateKey(ctx, name)
 		}
 		if err != nil {
 			return err
 		}
 
 		// if we generated a new key, make sure to replace its PEM encoding too!
-		if !cfg.ReusePrivateKeys {
+		if !reuseKey {
 			certRes.PrivateKeyPEM, err = PEMEncodePrivateKey(privateKey)
 			if err != nil {
 				return err
 			}
 		}
 
-		csr, err := cfg.generateCSR(privateKey, []string{name}, false)
+		// a batched certificate is renewed for all of its names
+		sans := []string{name}
+		if certRes.Batched && len(certRes.SANs) > 1 {
+			sans = certRes.SANs
+		}
+
+		csr, err := cfg.generateCSR(privateKey, sans, false)
 		if err != nil {
 			return err
 		}
+		stopKeyGeneration()
 
 		// try to obtain from each issuer until we succeed
 		var issuedCert *IssuedCertificate
 		var issuerUsed Issuer
 		var issuerKeys []string
-		for _, issuer := range cfg.Issuers {
-			// TODO: ZeroSSL's API currently requires CommonName to be set, and requires it be
-			// distinct from SANs. If this was a cert it would violate the BRs, but their certs
-			// are compliant, so their CSR requirements just needlessly add friction, complexity,
-			// and inefficiency for clients. CommonName has been deprecated for 25+ years.
-			useCSR := csr
-			if issuer.IssuerKey() == "zerossl" {
-				useCSR, err = cfg.generateCSR(privateKey, []string{name}, true)
-				if err != nil {
-					return err
-				}
+		issuers := cfg.selectIssuers(name, cfg.Issuers, certRes.issuerKey)
+		for i, issuer := range issuers {
+			var useCSR *x509.CertificateRequest
+			useCSR, err = cfg.csrForIssuer(ctx, issuer, privateKey, sans, csr)
+			if err != nil {
+				return err
 			}
 
 			issuerKeys = append(issuerKeys, issuer.IssuerKey())
 			if prechecker, ok := issuer.(PreChecker); ok {
-				err = prechecker.PreCheck(ctx, []string{name}, interactive)
+				err = prechecker.PreCheck(ctx, sans, interactive)
 				if err != nil {
 					continue
 				}
 			}
+			if err = cfg.checkCAA(ctx, issuer, sans); err != nil {
+				log.Error("skipping issuer because of CAA records",
+					zap.String("identifier", name),
+					zap.String("issuer", issuer.IssuerKey()),
+					zap.Error(err))
+				err = ErrNoRetry{err}
+				continue
+			}
+
+			cfg.emitIssuerChosen(ctx, name, issuer, i, true)
 
 			// if we're renewing with the same ACME CA as before, have the ACME
 			// client tell the server we are replacing a certificate (but doing
@@ -903,7 +1476,10 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 				}
 			}
 
+			stopIssuance := timer.track(issuancePhase)
 			issuedCert, err = issuer.Issue(ctx, useCSR)
+			stopIssuance()
+			cfg.recordIssuerResult(ctx, issuer, err)
 			if err == nil {
 				issuerUsed = issuer
 				break
@@ -920,6 +1496,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 				zap.String("identifier", name),
 				zap.String("issuer", issuer.IssuerKey()),
 				zap.Error(errToLog))
+			err = issuerError{issuerKey: issuer.IssuerKey(), err: err}
 		}
 		if err != nil {
 			cfg.emit(ctx, "cert_failed", map[string]any{
@@ -929,6 +1506,15 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 				"issuers":    issuerKeys,
 				"error":      err,
 			})
+			if leaf != nil && cfg.renewalOverdue(leaf) {
+				cfg.emit(ctx, "cert_expiring_unrenewable", map[string]any{
+					"identifier": name,
+					"remaining":  timeLeft,
+					"expiration": expiresAt(leaf),
+					"issuers":    issuerKeys,
+					"error":      err,
+				})
+			}
 
 			// only the error from the last issuer will be returned, but we logged the others
 			return fmt.Errorf("[%s] Renew: %w", name, err)
@@ -945,18 +1531,36 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			CertificatePEM: issuedCert.Certificate,
 			PrivateKeyPEM:  certRes.PrivateKeyPEM,
 			IssuerData:     metaJSON,
+			Batched:        len(sans) > 1,
 			issuerKey:      issuerKey,
 		}
+		if reuseKey {
+			newCertRes.KeyReuses = certRes.KeyReuses + 1
+		}
+		// make sure DANE clients will accept the new certificate
+		// before anyone can use it
+		rollover, err := cfg.prepareTLSAForNewCert(ctx, newCertRes.SANs, certRes.CertificatePEM, newCertRes.CertificatePEM)
+		if err != nil {
+			return fmt.Errorf("[%s] Renew: %v", name, err)
+		}
+		stopStorage := timer.track(storagePhase)
 		err = cfg.saveCertResource(ctx, issuerUsed, newCertRes)
+		stopStorage()
 		if err != nil {
+			cfg.emitStorageError(ctx, "store", []string{name}, err)
 			return fmt.Errorf("[%s] Renew: saving assets: %v", name, err)
 		}
+		if rollover {
+			cfg.retireTLSA(issuerUsed, newCertRes)
+		}
+
+		timer.markIssued()
 
 		log.Info("certificate renewed successfully",
 			zap.String("identifier", name),
 			zap.String("issuer", issuerKey))
 
-		certKey := newCertRes.NamesKey()
+		certKey := newCertRes.storageKeys()[0]
 
 		cfg.emit(ctx, "cert_obtained", map[string]any{
 			"renewal":          true,
@@ -967,29 +1571,87 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			"private_key_path": StorageKeys.SitePrivateKey(issuerKey, certKey),
 			"certificate_path": StorageKeys.SiteCert(issuerKey, certKey),
 			"metadata_path":    StorageKeys.SiteMeta(issuerKey, certKey),
+			"timing":           timer.snapshot(),
 			"csr_pem": pem.EncodeToMemory(&pem.Block{
 				Type:  "CERTIFICATE REQUEST",
 				Bytes: csr.Raw,
 			}),
 		})
 
+		cfg.certificateIssued(ctx, log, name, newCertRes, true)
+		cfg.certCache.notifyInvalidation(ctx, "renewed", newCertRes.SANs)
+
 		return nil
 	}
 
+	// remember why renewals fail, for expiry alerts and
+	// IssuanceFailure, and don't bother the CA while it
+	// rate-limits this name or it is unsuitable for issuance
+	renew := func(ctx context.Context) error {
+		if err := cfg.certCache.issuancePaused([]string{name}); err != nil {
+			return err
+		}
+		if err := cfg.checkBackoff(ctx, []string{name}); err != nil {
+			return err
+		}
+		err := cfg.classifyIssuanceError([]string{name}, f(ctx))
+		err = cfg.recordBackoff(ctx, []string{name}, err)
+		cfg.recordIssuanceResult(ctx, name, true, err)
+		return err
+	}
+
 	if interactive {
-		err = f(ctx)
+		err = renew(ctx)
 	} else {
-		err = doWithRetry(ctx, log, f)
+		err = doWithRetry(ctx, log, cfg.retryCheckpoint(queuedRenew, []string{name}, force), renew)
 	}
 
 	return err
 }
 
+// csrForIssuer returns the CSR to give issuer, which is csr (generated
+// for sans with privateKey) unless the issuer needs a different one, or
+// CSRTemplate customizes it.
+func (cfg *Config) csrForIssuer(ctx context.Context, issuer Issuer, privateKey crypto.PrivateKey, sans []string, csr *x509.CertificateRequest) (*x509.CertificateRequest, error) {
+	// TODO: ZeroSSL's API currently requires CommonName to be set, and requires it be
+	// distinct from SANs. If this was a cert it would violate the BRs, but their certs
+	// are compliant, so their CSR requirements just needlessly add friction, complexity,
+	// and inefficiency for clients. CommonName has been deprecated for 25+ years.
+	useCN := issuer.IssuerKey() == zerosslIssuerKey
+	if !useCN && cfg.CSRTemplate == nil {
+		return csr, nil
+	}
+	return cfg.generateCustomCSR(privateKey, sans, useCN, func(template *x509.CertificateRequest) error {
+		if cfg.CSRTemplate == nil {
+			return nil
+		}
+		if err := cfg.CSRTemplate(ctx, issuer, template); err != nil {
+			return fmt.Errorf("customizing CSR for issuer %s: %w", issuer.IssuerKey(), err)
+		}
+		return nil
+	})
+}
+
 // generateCSR generates a CSR for the given SANs. If useCN is true, CommonName will get the first SAN (TODO: this is only a temporary hack for ZeroSSL API support).
 func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useCN bool) (*x509.CertificateRequest, error) {
+	return cfg.generateCustomCSR(privateKey, sans, useCN, nil)
+}
+
+// generateCustomCSR is like generateCSR, but if customize is set, it is
+// called with the template before the CSR is signed.
+func (cfg *Config) generateCustomCSR(privateKey crypto.PrivateKey, sans []string, useCN bool, customize func(*x509.CertificateRequest) error) (*x509.CertificateRequest, error) {
 	csrTemplate := new(x509.CertificateRequest)
 
 	for _, name := range sans {
+		if SubjectIsURI(name) {
+			u, err := url.Parse(name)
+			if err != nil {
+				return nil, fmt.Errorf("parsing URI identifier '%s': %v", name, err)
+			}
+			csrTemplate.URIs = append(csrTemplate.URIs, u)
+			continue
+		}
+
 		// identifiers should be converted to punycode before going into the CSR
 		normalizedName, err := idna.ToASCII(name)
 		if err != nil {
@@ -1006,8 +1668,6 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 			csrTemplate.IPAddresses = append(csrTemplate.IPAddresses, ip)
 		} else if strings.Contains(normalizedName, "@") {
 			csrTemplate.EmailAddresses = append(csrTemplate.EmailAddresses, normalizedName)
-		} else if u, err := url.Parse(normalizedName); err == nil && strings.Contains(normalizedName, "/") {
-			csrTemplate.URIs = append(csrTemplate.URIs, u)
 		} else {
 			csrTemplate.DNSNames = append(csrTemplate.DNSNames, normalizedName)
 		}
@@ -1016,6 +1676,15 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 	if cfg.MustStaple {
 		csrTemplate.ExtraExtensions = append(csrTemplate.ExtraExtensions, mustStapleExtension)
 	}
+	if cfg.DelegatedCredentials != nil {
+		csrTemplate.ExtraExtensions = append(csrTemplate.ExtraExtensions, delegationUsageExtension)
+	}
+
+	if customize != nil {
+		if err := customize(csrTemplate); err != nil {
+			return nil, err
+		}
+	}
 
 	// IP addresses aren't printed here because I'm too lazy to marshal them as strings, but
 	// we at least print the incoming SANs so it should be obvious what became IPs
@@ -1023,6 +1692,7 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 		zap.Strings("identifiers", sans),
 		zap.Strings("san_dns_names", csrTemplate.DNSNames),
 		zap.Strings("san_emails", csrTemplate.EmailAddresses),
+		zap.Int("san_uris", len(csrTemplate.URIs)),
 		zap.String("common_name", csrTemplate.Subject.CommonName),
 		zap.Int("extra_extensions", len(csrTemplate.ExtraExtensions)),
 	)
@@ -1040,37 +1710,13 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 // certificate being revoked. See RFC 5280 §5.3.1 for reason codes.
 //
 // The certificate assets are deleted from storage after successful revocation
-// to prevent reuse.
+// to prevent reuse. See Revoke for more options.
 func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, interactive bool) error {
-	for i, issuer := range cfg.Issuers {
-		issuerKey := issuer.IssuerKey()
-
-		rev, ok := issuer.(Revoker)
-		if !ok {
-			return fmt.Errorf("issuer %d (%s) is not a Revoker", i, issuerKey)
-		}
-
-		certRes, err := cfg.loadCertResource(ctx, issuer, domain)
-		if err != nil {
-			return err
-		}
-
-		if !cfg.Storage.Exists(ctx, StorageKeys.SitePrivateKey(issuerKey, domain)) {
-			return fmt.Errorf("private key not found for %s", certRes.SANs)
-		}
-
-		err = rev.Revoke(ctx, certRes, reason)
-		if err != nil {
-			return fmt.Errorf("issuer %d (%s): %v", i, issuerKey, err)
-		}
-
-		err = cfg.deleteSiteAssets(ctx, issuerKey, domain)
-		if err != nil {
-			return fmt.Errorf("certificate revoked, but unable to fully clean up assets from issuer %s: %v", issuerKey, err)
-		}
-	}
-
-	return nil
+	_, err := cfg.Revoke(ctx, domain, RevocationOptions{
+		Reason:      RevocationReason(reason),
+		Interactive: interactive,
+	})
+	return err
 }
 
 // TLSConfig is an opinionated method that returns a recommended, modern
@@ -1093,10 +1739,12 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, in
 // challenges will fail (which may be acceptable if you are not using
 // ACME, or specifically, the TLS-ALPN challenge).
 //
+// If cfg.ECH is set, the config also decrypts Encrypted Client Hellos.
+//
 // Unlike the package TLS() function, this method does not, by itself,
 // enable certificate management for any domain names.
 func (cfg *Config) TLSConfig() *tls.Config {
-	return &tls.Config{
+	tlsCfg := &tls.Config{
 		// these two fields necessary for TLS-ALPN challenge
 		GetCertificate: cfg.GetCertificate,
 		NextProtos:     []string{acmez.ACMETLS1Protocol},
@@ -1110,6 +1758,10 @@ func (cfg *Config) TLSConfig() *tls.Config {
 		CipherSuites:             preferredDefaultCipherSuites(),
 		PreferServerCipherSuites: true,
 	}
+	if cfg.ECH != nil {
+		cfg.ECH.Register(tlsCfg)
+	}
+	return tlsCfg
 }
 
 // getChallengeInfo loads the challenge info from either the internal challenge memory
@@ -1118,14 +1770,40 @@ func (cfg *Config) TLSConfig() *tls.Config {
 // challenge is being solved in a distributed fashion; if false, from internal memory.
 // If no matching challenge information can be found, an error is returned.
 func (cfg *Config) getChallengeInfo(ctx context.Context, identifier string) (Challenge, bool, error) {
+	cfg = cfg.forSubject(identifier)
+
 	// first, check if our process initiated this challenge; if so, just return it
 	chalData, ok := GetACMEChallenge(identifier)
 	if ok {
 		return chalData, false, nil
 	}
 
+	// another instance's challenge was probably loaded moments
+	// ago, for a request from another validation perspective
+	if chal, ok := distributedChallenges.get(identifier); ok {
+		return chal, true, nil
+	}
+
 	// otherwise, perhaps another instance in the cluster initiated it; check
-	// the configured storage to retrieve challenge data
+	// if it was shared with us directly, or else the configured storage to
+	// retrieve challenge data
+	for _, issuer := range cfg.Issuers {
+		am, ok := issuer.(*ACMEIssuer)
+		if !ok || am.ClusterSolver == nil {
+			continue
+		}
+		chal, ok, err := am.ClusterSolver.SharedChallenge(ctx, identifier)
+		if err != nil {
+			cfg.Logger.Error("looking up challenge shared by cluster",
+				zap.String("identifier", identifier),
+				zap.Error(err))
+			continue
+		}
+		if ok {
+			distributedChallenges.put(identifier, Challenge{Challenge: chal})
+			return Challenge{Challenge: chal}, true, nil
+		}
+	}
 
 	var chalInfo acme.Challenge
 	var chalInfoBytes []byte
@@ -1154,6 +1832,7 @@ func (cfg *Config) getChallengeInfo(ctx context.Context, identifier string) (Cha
 	if err != nil {
 		return Challenge{}, false, fmt.Errorf("decoding challenge token file %s (corrupted?): %v", tokenKey, err)
 	}
+	distributedChallenges.put(identifier, Challenge{Challenge: chalInfo})
 
 	return Challenge{Challenge: chalInfo}, true, nil
 }
@@ -1273,11 +1952,71 @@ func (cfg *Config) managedCertNeedsRenewal(certRes CertificateResource, emitLogs
 	return remaining, certChain[0], cfg.certNeedsRenewal(certChain[0], ari, emitLogs)
 }
 
+// parentContext returns the context that the background
+// work of cfg derives from; see the Context field.
+func (cfg *Config) parentContext() context.Context {
+	if cfg.Context != nil {
+		return cfg.Context
+	}
+	return context.Background()
+}
+
+// backgroundContext returns a context for work of cfg that is
+// done in the background, like after a handshake has completed,
+// which ends when cfg.Context does or after timeout.
+func (cfg *Config) backgroundContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(withConfig(cfg.parentContext(), cfg), timeout)
+}
+
+// boundContext returns a copy of ctx that is also canceled when
+// cfg.Context is, for work of cfg that is done as part of other
+// background work, like the maintenance of the cache.
+func (cfg *Config) boundContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if cfg.Context == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(cfg.Context, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// handlesEvent returns whether emitting eventName has any effect, so
+// that hot paths can skip assembling the data of events nobody gets.
+func (cfg *Config) handlesEvent(eventName string) bool {
+	return cfg.OnEvent != nil || (cfg.Journal != nil && cfg.Journal.records(eventName))
+}
+
 func (cfg *Config) emit(ctx context.Context, eventName string, data map[string]any) error {
-	if cfg.OnEvent == nil {
-		return nil
+	if cfg.OnEvent != nil {
+		if err := cfg.OnEvent(withConfig(ctx, cfg), eventName, data); err != nil {
+			return err
+		}
+	}
+	if cfg.Journal != nil && cfg.Journal.records(eventName) {
+		if _, err := cfg.Journal.Append(ctx, cfg.Storage, eventName, data); err != nil {
+			cfg.Logger.Error("recording event in journal",
+				zap.String("event", eventName),
+				zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// emitStorageError emits the storage_error event for err, which occurred
+// during operation ("check", "load", or "store") for the given names.
+func (cfg *Config) emitStorageError(ctx context.Context, operation string, names []string, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return // not an error with storage itself
 	}
-	return cfg.OnEvent(ctx, eventName, data)
+	cfg.emit(ctx, "storage_error", map[string]any{
+		"operation":   operation,
+		"identifiers": names,
+		"storage":     fmt.Sprint(cfg.Storage),
+		"error":       err,
+	})
 }
 
 // CertificateSelector is a type which can select a certificate to use given multiple choices.
@@ -1301,8 +2040,34 @@ type OCSPConfig struct {
 	ResponderOverrides map[string]string
 
 	// Optionally specify a function that can return the URL
-	// for an HTTP proxy to use for OCSP-related HTTP requests.
-	HTTPProxy func(*http.Request) (*url.URL, error)
+	// for an HTTP proxy to use for OCSP-related HTTP requests,
+	// and how to authenticate to it. If not set, the proxy of
+	// the config's HTTPClient, or else the proxy of the first
+	// issuer that has one, is used.
+	HTTPProxy          func(*http.Request) (*url.URL, error)
+	ProxyAuthenticator ProxyAuthenticator
+
+	// Fail TLS handshakes for certificates that have an
+	// OCSP responder but no valid staple, instead of
+	// serving them without one (soft-fail, the default).
+	// EXPERIMENTAL: Subject to change or removal.
+	HardFail bool
+
+	// If the OCSP responder of a certificate has been
+	// failing for longer than this, the certificate is
+	// served without staple even if HardFail is enabled.
+	// Useful as CAs phase out OCSP. Default: 0 (never).
+	// EXPERIMENTAL: Subject to change or removal.
+	ServeUnstapledAfter time.Duration
+
+	// Overrides for classes of certificates; the first
+	// that matches a certificate applies to it.
+	// EXPERIMENTAL: Subject to change or removal.
+	Policies []OCSPPolicy
+
+	// the client to make requests with, if not one
+	// for the proxy above; see Config.ocspConfig
+	httpClient *http.Client
 }
 
 // certIssueLockOp is the name of the operation used
@@ -1311,6 +2076,15 @@ type OCSPConfig struct {
 // certain name.
 const certIssueLockOp = "issue_cert"
 
+// onDemandObtainLockOp is the lock op that coordinates obtaining
+// certificates on demand across instances (see
+// OnDemandConfig.CoordinateInstances).
+const onDemandObtainLockOp = "on_demand_obtain"
+
+// ctxKeyRenewing is the context key for the CertificateResource
+// that is being renewed, when issuers are asked for a renewal.
+const ctxKeyRenewing = ctxKey("renewing")
+
 // Constants for PKIX MustStaple extension.
 var (
 	tlsFeatureExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
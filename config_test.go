@@ -17,10 +17,16 @@ package certmagic
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
+	"errors"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mholt/acmez/v3/acme"
 )
@@ -83,3 +89,156 @@ func mustJSON(val any) []byte {
 	}
 	return result
 }
+
+// csrRecordingIssuer is a testIssuer that records the CSRs it gets.
+type csrRecordingIssuer struct {
+	testIssuer
+	mu   sync.Mutex
+	csrs []*x509.CertificateRequest
+}
+
+func (ci *csrRecordingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	ci.mu.Lock()
+	ci.csrs = append(ci.csrs, csr)
+	ci.mu.Unlock()
+	return ci.testIssuer.Issue(ctx, csr)
+}
+
+func TestCSRTemplate(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	issuer := new(csrRecordingIssuer)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	templateErr := errors.New("not allowed")
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		CSRTemplate: func(_ context.Context, iss Issuer, template *x509.CertificateRequest) error {
+			if iss != issuer {
+				t.Errorf("Expected CSR to be customized for the issuer, got %T", iss)
+			}
+			if template.DNSNames[0] == "denied.example.com" {
+				return templateErr
+			}
+			template.Subject = pkix.Name{Organization: []string{"Example Org"}}
+			template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oid, Value: []byte{0x05, 0x00}})
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(issuer.csrs) != 1 {
+		t.Fatalf("Expected 1 CSR, got %d", len(issuer.csrs))
+	}
+	csr := issuer.csrs[0]
+	if len(csr.Subject.Organization) != 1 || csr.Subject.Organization[0] != "Example Org" || csr.DNSNames[0] != "example.com" {
+		t.Errorf("Expected customized subject and original SANs, got %v %v", csr.Subject, csr.DNSNames)
+	}
+	var found bool
+	for _, ext := range csr.Extensions {
+		found = found || ext.Id.Equal(oid)
+	}
+	if !found {
+		t.Error("Expected custom extension in CSR")
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Errorf("Expected CSR to be signed after customization: %v", err)
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "denied.example.com"); !errors.Is(err, templateErr) {
+		t.Errorf("Expected template error, got %v", err)
+	}
+}
+
+func TestURIAndEmailSubjects(t *testing.T) {
+	issuer := new(csrRecordingIssuer)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	storage := &FileStorage{Path: t.TempDir()}
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   storage,
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+
+	// these URIs have the same Safe form, but must not share storage
+	ctx := context.Background()
+	subjects := []string{"spiffe://example.org/ns/default/sa/Web", "spiffe://example.org/ns/default/sa/web", "Workload@Example.com"}
+	if err := cfg.ManageSync(ctx, subjects); err != nil {
+		t.Fatal(err)
+	}
+	if len(issuer.csrs) != 3 {
+		t.Fatalf("Expected 3 CSRs, got %d", len(issuer.csrs))
+	}
+	if uris := issuer.csrs[0].URIs; len(uris) != 1 || uris[0].String() != subjects[0] || len(issuer.csrs[0].DNSNames) != 0 {
+		t.Errorf("Expected URI SAN in CSR, got %v %v", uris, issuer.csrs[0].DNSNames)
+	}
+	if emails := issuer.csrs[2].EmailAddresses; len(emails) != 1 || emails[0] != "workload@example.com" {
+		t.Errorf("Expected email SAN in CSR, got %v", emails)
+	}
+	for _, subject := range subjects {
+		certs := cache.AllMatchingCertificates(normalizedName(subject))
+		if len(certs) != 1 {
+			t.Errorf("Expected certificate for %s in cache, got %d", subject, len(certs))
+		}
+	}
+	if StorageKeys.SiteCert("test", subjects[0]) == StorageKeys.SiteCert("test", subjects[1]) {
+		t.Error("Expected URIs to have distinct storage keys")
+	}
+
+	acmeIssuer := &ACMEIssuer{CA: "https://ca.example/directory", mu: new(sync.Mutex), Logger: defaultTestLogger}
+	if err := acmeIssuer.PreCheck(ctx, subjects[:1], false); err == nil {
+		t.Error("Expected ACME issuer to refuse URI subject")
+	}
+}
+
+func TestBackgroundContext(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	cfg := &Config{Context: parent}
+
+	background, cancel := cfg.backgroundContext(time.Hour)
+	defer cancel()
+	if got, _ := background.Value(ctxKeyConfig).(*Config); got != cfg {
+		t.Error("Expected the config to be attached to the background context")
+	}
+	maintenance, cancelMaintenance := context.WithCancel(context.Background())
+	defer cancelMaintenance()
+	bound, cancelBound := cfg.boundContext(maintenance)
+	defer cancelBound()
+
+	cancelParent()
+	for name, ctx := range map[string]context.Context{"background": background, "bound": bound} {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected %s context to be canceled with the config's context", name)
+		}
+	}
+
+	// without a context, work only ends when it would otherwise
+	cfg = new(Config)
+	bound, cancelBound = cfg.boundContext(context.Background())
+	if bound.Err() != nil {
+		t.Errorf("Expected bound context to be live, got %v", bound.Err())
+	}
+	cancelBound()
+	if bound.Err() == nil {
+		t.Error("Expected bound context to be canceled")
+	}
+}
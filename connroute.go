@@ -0,0 +1,93 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ConnRouteFunc returns routing metadata for a connection, like the
+// tenant that the server name or cert belongs to, after cert was
+// selected for its TLS handshake, so that servers built on this
+// package don't need to parse the ClientHello again downstream.
+// The metadata can be gotten with ConnRoute from the context of
+// the handshake (see ConnContext). An error aborts the handshake.
+// It is called synchronously during the handshake, so it should
+// return quickly.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ConnRouteFunc func(ctx context.Context, hello *tls.ClientHelloInfo, cert Certificate) (any, error)
+
+// ConnContext returns a context for the TLS handshake of a
+// connection, in which the metadata returned by the RouteConn
+// function of the config is stored; see ConnRoute. It can be used as
+// http.Server.ConnContext, since the handshake of a connection
+// has its context, as do its requests. Otherwise, pass the
+// context to tls.Conn.HandshakeContext.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	if _, ok := ctx.Value(ctxKeyConnRoute).(*connRoute); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyConnRoute, new(connRoute))
+}
+
+// ConnRoute returns the metadata that the RouteConn function of the
+// config returned for the connection whose context (see ConnContext)
+// ctx is or derives from, or nil if there is none (yet).
+//
+// EXPERIMENTAL: Subject to change or removal.
+func ConnRoute(ctx context.Context) any {
+	route, ok := ctx.Value(ctxKeyConnRoute).(*connRoute)
+	if !ok {
+		return nil
+	}
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	return route.value
+}
+
+// connRoute holds the routing metadata of a connection.
+type connRoute struct {
+	mu    sync.Mutex
+	value any
+}
+
+// routeConn calls cfg.RouteConn for cert, which was selected for
+// hello, and stores the metadata it returns in ctx, if ctx has a
+// place for it.
+func (cfg *Config) routeConn(ctx context.Context, hello *tls.ClientHelloInfo, cert Certificate) error {
+	value, err := cfg.RouteConn(ctx, hello, cert)
+	if err != nil {
+		cfg.Logger.Error("TLS handshake aborted by connection route function",
+			zap.String("server_name", hello.ServerName),
+			zap.String("remote", remoteAddr(hello)),
+			zap.Error(err))
+		return fmt.Errorf("handshake aborted by connection route function: %w", err)
+	}
+	if route, ok := ctx.Value(ctxKeyConnRoute).(*connRoute); ok {
+		route.mu.Lock()
+		route.value = value
+		route.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnRoute(t *testing.T) {
+	ctx := context.Background()
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers: []Issuer{&testIssuer{}},
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+		OCSP:    OCSPConfig{DisableStapling: true},
+		RouteConn: func(ctx context.Context, hello *tls.ClientHelloInfo, cert Certificate) (any, error) {
+			tenant, _, _ := strings.Cut(cert.Names[0], ".")
+			if tenant == "blocked" {
+				return nil, fmt.Errorf("tenant %s is blocked", tenant)
+			}
+			return tenant, nil
+		},
+	})
+	if err := cfg.ManageSync(ctx, []string{"acme.example.com", "blocked.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(serverName string) (any, error) {
+		t.Helper()
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+		connCtx := ConnContext(ctx, serverConn)
+		err := tls.Server(serverConn, cfg.TLSConfig()).HandshakeContext(connCtx)
+		return ConnRoute(connCtx), err
+	}
+
+	route, err := handshake("acme.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route != "acme" {
+		t.Errorf("Expected route acme, got %v", route)
+	}
+	if route, err = handshake("blocked.example.com"); err == nil || route != nil {
+		t.Errorf("Expected handshake to be aborted without route, got %v (err=%v)", route, err)
+	}
+
+	if route := ConnRoute(ctx); route != nil {
+		t.Errorf("Expected no route without ConnContext, got %v", route)
+	}
+}
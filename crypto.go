@@ -142,7 +142,7 @@ func fastHash(input []byte) string {
 
 // saveCertResource saves the certificate resource to disk. This
 // includes the certificate file itself, the private key, and the
-// metadata file.
+// metadata file. A batched certificate is saved for each of its names.
 func (cfg *Config) saveCertResource(ctx context.Context, issuer Issuer, cert CertificateResource) error {
 	metaBytes, err := json.MarshalIndent(cert, "", "\t")
 	if err != nil {
@@ -150,21 +150,38 @@ func (cfg *Config) saveCertResource(ctx context.Context, issuer Issuer, cert Cer
 	}
 
 	issuerKey := issuer.IssuerKey()
-	certKey := cert.NamesKey()
-
-	all := []keyValue{
-		{
-			key:   StorageKeys.SitePrivateKey(issuerKey, certKey),
-			value: cert.PrivateKeyPEM,
-		},
-		{
-			key:   StorageKeys.SiteCert(issuerKey, certKey),
-			value: cert.CertificatePEM,
-		},
-		{
-			key:   StorageKeys.SiteMeta(issuerKey, certKey),
-			value: metaBytes,
-		},
+
+	keyPEM, err := cfg.encryptKeyPEM(ctx, cert.PrivateKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	var all []keyValue
+	for _, certKey := range cert.storageKeys() {
+		if cfg.CertificateHistory > 0 {
+			if err := cfg.archiveCertResource(ctx, issuer, certKey, cert.CertificatePEM); err != nil {
+				// not worth failing over, since the new cert is what matters most
+				cfg.Logger.Error("unable to keep previous version of certificate",
+					zap.String("identifier", certKey),
+					zap.String("issuer", issuerKey),
+					zap.Error(err))
+			}
+		}
+
+		all = append(all,
+			keyValue{
+				key:   StorageKeys.SitePrivateKey(issuerKey, certKey),
+				value: keyPEM,
+			},
+			keyValue{
+				key:   StorageKeys.SiteCert(issuerKey, certKey),
+				value: cert.CertificatePEM,
+			},
+			keyValue{
+				key:   StorageKeys.SiteMeta(issuerKey, certKey),
+				value: metaBytes,
+			},
+		)
 	}
 
 	return storeTx(ctx, cfg.Storage, all)
@@ -250,7 +267,10 @@ func (cfg *Config) loadCertResource(ctx context.Context, issuer Issuer, certName
 	if err != nil {
 		return CertificateResource{}, err
 	}
-	certRes.PrivateKeyPEM = keyBytes
+	certRes.PrivateKeyPEM, err = cfg.decryptKeyPEM(ctx, keyBytes)
+	if err != nil {
+		return CertificateResource{}, err
+	}
 	certBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteCert(certRes.issuerKey, normalizedName))
 	if err != nil {
 		return CertificateResource{}, err
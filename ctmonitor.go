@@ -0,0 +1,352 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CTMonitor watches Certificate Transparency (CT) logs for certificates
+// issued for the names that are managed in a cache, and emits a
+// "ct_unexpected_certificate" event (with the config that manages the
+// name) for every certificate that was not obtained by CertMagic. Such
+// a certificate may be a sign of a hijacked domain or of mis-issuance
+// by a CA, so it is also logged as a warning.
+//
+// Certificates are expected if their serial number is that of a
+// certificate that was managed in the cache while the monitor was
+// running, or that is in storage, or if they were issued by one of
+// ExpectedIssuers.
+//
+// A CTMonitor is optional; use Run to start one.
+//
+// EXPERIMENTAL: Subject to change.
+type CTMonitor struct {
+	// Where to look up logged certificates. REQUIRED.
+	Source CTSource
+
+	// How often to check the logs. Default: 1h.
+	Interval time.Duration
+
+	// Only certificates that are valid from this time on
+	// are checked. Default: when Run is called.
+	Since time.Time
+
+	// Certificates issued by issuers whose distinguished
+	// name contains any of these strings are expected,
+	// e.g. for names that another system also gets
+	// certificates for, like a CDN.
+	ExpectedIssuers []string
+
+	// The logger to use; default: the cache's logger.
+	Logger *zap.Logger
+
+	mu       sync.Mutex
+	ours     map[string]struct{} // serial numbers of our certificates
+	reported map[string]struct{} // serial numbers of reported certificates
+}
+
+// CTSource looks up certificates that were logged to CT logs.
+//
+// EXPERIMENTAL: Subject to change.
+type CTSource interface {
+	// LoggedCertificates returns the certificates logged
+	// for name, which may be a wildcard name. They must
+	// include the certificates for names that are covered
+	// by name, like subdomains for a wildcard.
+	LoggedCertificates(ctx context.Context, name string) ([]CTEntry, error)
+}
+
+// CTEntry is a certificate (or precertificate) found in a CT log.
+//
+// EXPERIMENTAL: Subject to change.
+type CTEntry struct {
+	// An ID of the entry that is unique within the source.
+	ID string
+
+	// The subject names of the certificate.
+	Names []string
+
+	// The distinguished name of the issuer.
+	Issuer string
+
+	// The serial number, in lowercase hexadecimal.
+	SerialNumber string
+
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Run checks the CT logs for the names managed in cache every
+// Interval until ctx is canceled.
+func (m *CTMonitor) Run(ctx context.Context, cache *Cache) error {
+	if m.Source == nil {
+		return fmt.Errorf("CT monitor has no source")
+	}
+	if m.Since.IsZero() {
+		m.Since = time.Now()
+	}
+	interval := m.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx, cache)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// check looks up the logged certificates for all managed names
+// once, and emits events for the unexpected ones.
+func (m *CTMonitor) check(ctx context.Context, cache *Cache) {
+	logger := m.logger(cache)
+
+	// remember our certificates, so that the ones we replaced
+	// are still expected after they are gone from the cache
+	certsByName := make(map[string]Certificate)
+	m.mu.Lock()
+	if m.ours == nil {
+		m.ours = make(map[string]struct{})
+		m.reported = make(map[string]struct{})
+	}
+	for _, cert := range cache.getAllCerts() {
+		if !cert.managed || cert.Leaf == nil {
+			continue
+		}
+		m.ours[serialHex(cert)] = struct{}{}
+		for _, name := range cert.Names {
+			if !SubjectIsIP(name) {
+				certsByName[name] = cert
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	names := make([]string, 0, len(certsByName))
+	for name := range certsByName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		entries, err := m.Source.LoggedCertificates(ctx, name)
+		if err != nil {
+			logger.Error("looking up certificates in CT logs",
+				zap.String("identifier", name),
+				zap.Error(err))
+			continue
+		}
+		cert := certsByName[name]
+		cfg, err := cache.getConfig(cert)
+		if err != nil {
+			logger.Error("getting config for certificate", zap.Strings("identifiers", cert.Names), zap.Error(err))
+			continue
+		}
+		for _, entry := range entries {
+			if !m.unexpected(ctx, cfg, cert.Names[0], entry) {
+				continue
+			}
+			logger.Warn("unexpected certificate found in CT logs",
+				zap.String("identifier", name),
+				zap.String("entry", entry.ID),
+				zap.Strings("names", entry.Names),
+				zap.String("issuer", entry.Issuer),
+				zap.String("serial", entry.SerialNumber),
+				zap.Time("not_before", entry.NotBefore))
+			cfg.emit(ctx, "ct_unexpected_certificate", map[string]any{
+				"identifier": name,
+				"id":         entry.ID,
+				"names":      entry.Names,
+				"issuer":     entry.Issuer,
+				"serial":     entry.SerialNumber,
+				"not_before": entry.NotBefore,
+				"not_after":  entry.NotAfter,
+			})
+		}
+	}
+}
+
+// unexpected returns whether entry is an unexpected certificate that
+// has not been reported yet, and marks it as reported if so. Since a
+// precertificate has the same serial number as its certificate, they
+// are reported once.
+func (m *CTMonitor) unexpected(ctx context.Context, cfg *Config, certKey string, entry CTEntry) bool {
+	if entry.NotBefore.Before(m.Since) {
+		return false
+	}
+	for _, issuer := range m.ExpectedIssuers {
+		if strings.Contains(entry.Issuer, issuer) {
+			return false
+		}
+	}
+	serial := strings.TrimLeft(strings.ToLower(strings.ReplaceAll(entry.SerialNumber, ":", "")), "0")
+
+	m.mu.Lock()
+	_, ours := m.ours[serial]
+	_, reported := m.reported[serial]
+	m.mu.Unlock()
+	if ours || reported {
+		return false
+	}
+
+	// it may be a certificate that another instance obtained and
+	// that we haven't loaded yet; those are in storage
+	if certRes, err := cfg.loadCertResourceAnyIssuer(ctx, certKey); err == nil {
+		if certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM); err == nil && len(certs) > 0 &&
+			strings.ToLower(certs[0].SerialNumber.Text(16)) == serial {
+			m.mu.Lock()
+			m.ours[serial] = struct{}{}
+			m.mu.Unlock()
+			return false
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, reported := m.reported[serial]; reported {
+		return false
+	}
+	m.reported[serial] = struct{}{}
+	return true
+}
+
+func (m *CTMonitor) logger(cache *Cache) *zap.Logger {
+	if m.Logger != nil {
+		return m.Logger
+	}
+	return cache.logger
+}
+
+func serialHex(cert Certificate) string {
+	return strings.ToLower(cert.Leaf.SerialNumber.Text(16))
+}
+
+// CrtShSource looks up logged certificates with the JSON API of
+// crt.sh, or of services that have the same API.
+//
+// EXPERIMENTAL: Subject to change.
+type CrtShSource struct {
+	// The URL of the API. Default: https://crt.sh/.
+	URL string
+
+	// Whether to exclude expired certificates.
+	// Default: false.
+	ExcludeExpired bool
+
+	// The HTTP client to use. Default: a client with
+	// HTTPTimeout.
+	HTTPClient *http.Client
+}
+
+// LoggedCertificates implements CTSource.
+func (s CrtShSource) LoggedCertificates(ctx context.Context, name string) ([]CTEntry, error) {
+	endpoint := s.URL
+	if endpoint == "" {
+		endpoint = "https://crt.sh/"
+	}
+	query := url.Values{
+		"q":      {strings.ReplaceAll(name, "*", "%")},
+		"output": {"json"},
+	}
+	if s.ExcludeExpired {
+		query.Set("exclude", "expired")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := s.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: HTTPTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+
+	var results []struct {
+		ID           int64  `json:"id"`
+		IssuerName   string `json:"issuer_name"`
+		CommonName   string `json:"common_name"`
+		NameValue    string `json:"name_value"`
+		SerialNumber string `json:"serial_number"`
+		NotBefore    string `json:"not_before"`
+		NotAfter     string `json:"not_after"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024*1024)).Decode(&results); err != nil {
+		return nil, fmt.Errorf("decoding response: %v", err)
+	}
+
+	entries := make([]CTEntry, 0, len(results))
+	for _, r := range results {
+		entry := CTEntry{
+			ID:           strconv.FormatInt(r.ID, 10),
+			Issuer:       r.IssuerName,
+			SerialNumber: strings.ToLower(r.SerialNumber),
+			NotBefore:    parseCrtShTime(r.NotBefore),
+			NotAfter:     parseCrtShTime(r.NotAfter),
+		}
+		for _, n := range strings.Split(r.NameValue, "\n") {
+			if n = strings.TrimSpace(n); n != "" && !slices.Contains(entry.Names, n) {
+				entry.Names = append(entry.Names, n)
+			}
+		}
+		if len(entry.Names) == 0 && r.CommonName != "" {
+			entry.Names = []string{r.CommonName}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseCrtShTime parses a time in the format of crt.sh, which is
+// in UTC but has no time zone.
+func parseCrtShTime(s string) time.Time {
+	t, err := time.Parse("2006-01-02T15:04:05", strings.TrimSuffix(s, "Z"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Interface guard
+var _ CTSource = CrtShSource{}
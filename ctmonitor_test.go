@@ -0,0 +1,116 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeCTSource map[string][]CTEntry
+
+func (s fakeCTSource) LoggedCertificates(_ context.Context, name string) ([]CTEntry, error) {
+	return s[name], nil
+}
+
+func TestCTMonitor(t *testing.T) {
+	ctx := context.Background()
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+
+	var events []map[string]any
+	cfg = New(cache, Config{
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+		OCSP:    OCSPConfig{DisableStapling: true},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "ct_unexpected_certificate" {
+				events = append(events, data)
+			}
+			return nil
+		},
+	})
+
+	const name = "ct.example.com"
+	certPEM, keyPEM := mustGenerateTestCert(t, []string{name}, time.Now().Add(24*time.Hour))
+	cert, err := cfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	source := fakeCTSource{name: {
+		{ID: "1", Names: []string{name}, Issuer: "CN=Ours", SerialNumber: "00" + cert.Leaf.SerialNumber.Text(16), NotBefore: notBefore},
+		{ID: "2", Names: []string{name}, Issuer: "CN=Rogue CA", SerialNumber: "0abc", NotBefore: notBefore},
+		{ID: "3", Names: []string{name}, Issuer: "CN=Rogue CA", SerialNumber: "0a:bc", NotBefore: notBefore}, // the precertificate
+		{ID: "4", Names: []string{name}, Issuer: "CN=Our CDN", SerialNumber: "def", NotBefore: notBefore},
+		{ID: "5", Names: []string{name}, Issuer: "CN=Old CA", SerialNumber: "123", NotBefore: notBefore.Add(-48 * time.Hour)},
+	}}
+	monitor := &CTMonitor{
+		Source:          source,
+		Since:           time.Now().Add(-24 * time.Hour),
+		ExpectedIssuers: []string{"Our CDN"},
+	}
+
+	monitor.check(ctx, cache)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d: %v", len(events), events)
+	}
+	if events[0]["id"] != "2" || events[0]["identifier"] != name || events[0]["issuer"] != "CN=Rogue CA" {
+		t.Errorf("Unexpected event: %v", events[0])
+	}
+
+	// certificates are reported only once
+	monitor.check(ctx, cache)
+	if len(events) != 1 {
+		t.Errorf("Expected no more events, got %d", len(events))
+	}
+}
+
+func TestCrtShSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "%.example.com" || r.URL.Query().Get("output") != "json" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`[{"issuer_ca_id":1,"issuer_name":"C=US, O=Let's Encrypt, CN=R3","common_name":"a.example.com","name_value":"a.example.com\nb.example.com","id":42,"entry_timestamp":"2024-05-01T12:00:01.5","not_before":"2024-05-01T11:00:00","not_after":"2024-07-30T11:00:00","serial_number":"03ABCDEF"}]`))
+	}))
+	defer server.Close()
+
+	entries, err := CrtShSource{URL: server.URL}.LoggedCertificates(context.Background(), "*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CTEntry{{
+		ID:           "42",
+		Names:        []string{"a.example.com", "b.example.com"},
+		Issuer:       "C=US, O=Let's Encrypt, CN=R3",
+		SerialNumber: "03abcdef",
+		NotBefore:    time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2024, 7, 30, 11, 0, 0, 0, time.UTC),
+	}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, entries)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+// DANEConfig configures the publication of DANE TLSA records (RFC 6698)
+// for managed certificates. Records are published in an order that keeps
+// DANE validation working across renewals, even if the key changes:
+//
+//  1. Before a renewed certificate is stored (and thus before any
+//     instance serves it), the records of both the current and the new
+//     certificate are published.
+//  2. The renewal waits for RolloverDelay, so that resolvers that cached
+//     the old records have expired them.
+//  3. The new certificate is stored and used.
+//  4. After another RolloverDelay, when all instances should have loaded
+//     the new certificate, the records of the old one are removed.
+//
+// If the records don't change, e.g. because the record selects the
+// public key and ReusePrivateKeys is enabled, renewals don't wait.
+// Wildcard and IP names are skipped.
+//
+// EXPERIMENTAL: Subject to change.
+type DANEConfig struct {
+	// Publishes the records. REQUIRED.
+	Publisher TLSAPublisher
+
+	// The parameters of the records to publish for each
+	// certificate. Default: a DANE-EE record of the SHA-256
+	// hash of the public key ("3 1 1").
+	Records []TLSAParams
+
+	// The ports to publish records for. Default: 443.
+	Ports []int
+
+	// The transport protocol. Default: "tcp".
+	Protocol string
+
+	// How long to wait between the steps of a rollover;
+	// it should be at least the TTL of the records (plus
+	// any propagation delay). Default: 20m.
+	RolloverDelay time.Duration
+}
+
+// TLSAParams are the parameters of a TLSA record.
+//
+// EXPERIMENTAL: Subject to change.
+type TLSAParams struct {
+	// 0: PKIX-TA, 1: PKIX-EE, 2: DANE-TA, 3: DANE-EE.
+	// The trust anchor usages (0 and 2) match the
+	// issuer of the certificate.
+	Usage uint8
+
+	// 0: the full certificate, 1: the public key.
+	Selector uint8
+
+	// 0: exact match, 1: SHA-256, 2: SHA-512.
+	MatchingType uint8
+}
+
+// TLSARecord is a TLSA record.
+//
+// EXPERIMENTAL: Subject to change.
+type TLSARecord struct {
+	TLSAParams
+
+	// The certificate association data.
+	Data []byte
+}
+
+// String returns the record data in presentation
+// format, e.g. "3 1 1 <hex>".
+func (r TLSARecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Usage, r.Selector, r.MatchingType, hex.EncodeToString(r.Data))
+}
+
+// TLSAPublisher publishes TLSA records.
+//
+// EXPERIMENTAL: Subject to change.
+type TLSAPublisher interface {
+	// PublishTLSA replaces the TLSA records at owner, which
+	// is a name like "_443._tcp.example.com", with records.
+	PublishTLSA(ctx context.Context, owner string, records []TLSARecord) error
+}
+
+// TLSARecordsFor returns the TLSA records with the given parameters for
+// the certificate chain in certPEM.
+//
+// EXPERIMENTAL: Subject to change.
+func TLSARecordsFor(certPEM []byte, params []TLSAParams) ([]TLSARecord, error) {
+	chain, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	var records []TLSARecord
+	for _, p := range params {
+		cert := chain[0]
+		if p.Usage == 0 || p.Usage == 2 {
+			if len(chain) < 2 {
+				return nil, fmt.Errorf("TLSA usage %d needs the issuer certificate, but the chain has none", p.Usage)
+			}
+			cert = chain[1]
+		}
+		data, err := tlsaData(cert, p)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, TLSARecord{TLSAParams: p, Data: data})
+	}
+	return records, nil
+}
+
+func tlsaData(cert *x509.Certificate, p TLSAParams) ([]byte, error) {
+	var selected []byte
+	switch p.Selector {
+	case 0:
+		selected = cert.Raw
+	case 1:
+		selected = cert.RawSubjectPublicKeyInfo
+	default:
+		return nil, fmt.Errorf("unsupported TLSA selector %d", p.Selector)
+	}
+	return tlsaMatch(selected, p.MatchingType)
+}
+
+// tlsaMatch returns the association data of selected for matchingType.
+func tlsaMatch(selected []byte, matchingType uint8) ([]byte, error) {
+	switch matchingType {
+	case 0:
+		return selected, nil
+	case 1:
+		sum := sha256.Sum256(selected)
+		return sum[:], nil
+	case 2:
+		sum := sha512.Sum512(selected)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unsupported TLSA matching type %d", matchingType)
+}
+
+func (d *DANEConfig) records() []TLSAParams {
+	if len(d.Records) > 0 {
+		return d.Records
+	}
+	return []TLSAParams{{Usage: 3, Selector: 1, MatchingType: 1}}
+}
+
+func (d *DANEConfig) rolloverDelay() time.Duration {
+	if d.RolloverDelay > 0 {
+		return d.RolloverDelay
+	}
+	return 20 * time.Minute
+}
+
+// owners returns the owner names of the TLSA records for names.
+func (d *DANEConfig) owners(names []string) []string {
+	ports := d.Ports
+	if len(ports) == 0 {
+		ports = []int{443}
+	}
+	protocol := d.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	var owners []string
+	for _, name := range names {
+		if SubjectIsIP(name) || strings.Contains(name, "*") {
+			continue
+		}
+		for _, port := range ports {
+			owners = append(owners, fmt.Sprintf("_%d._%s.%s", port, protocol, strings.TrimSuffix(name, ".")))
+		}
+	}
+	return owners
+}
+
+// publishTLSA publishes the records for the certificates in certPEMs
+// (the first of which may be nil) for names, and those of the next key
+// of the certificate if KeyRotation.PublishNextKey is enabled.
+func (cfg *Config) publishTLSA(ctx context.Context, names []string, certPEMs ...[]byte) error {
+	ctx = withConfig(ctx, cfg)
+	var records []TLSARecord
+	for _, certPEM := range certPEMs {
+		if len(certPEM) == 0 {
+			continue
+		}
+		recs, err := TLSARecordsFor(certPEM, cfg.DANE.records())
+		if err != nil {
+			return fmt.Errorf("computing TLSA records: %v", err)
+		}
+		records = appendTLSARecords(records, recs...)
+	}
+	if len(names) > 0 {
+		records = appendTLSARecords(records, cfg.nextKeyTLSA(ctx, names[0])...)
+	}
+	for _, owner := range cfg.DANE.owners(names) {
+		if err := cfg.DANE.Publisher.PublishTLSA(ctx, owner, records); err != nil {
+			return fmt.Errorf("publishing TLSA records for %s: %v", owner, err)
+		}
+		cfg.Logger.Info("published TLSA records",
+			zap.String("owner", owner),
+			zap.Int("records", len(records)))
+	}
+	return nil
+}
+
+// appendTLSARecords appends those of recs to records that it doesn't
+// contain yet.
+func appendTLSARecords(records []TLSARecord, recs ...TLSARecord) []TLSARecord {
+	for _, rec := range recs {
+		if !containsTLSARecord(records, rec) {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func containsTLSARecord(records []TLSARecord, rec TLSARecord) bool {
+	return slices.ContainsFunc(records, func(other TLSARecord) bool {
+		return other.TLSAParams == rec.TLSAParams && bytes.Equal(other.Data, rec.Data)
+	})
+}
+
+// prepareTLSAForNewCert publishes the TLSA records for newCertPEM
+// before it is stored, along with those of oldCertPEM (if any), and
+// waits for them to propagate if the records of the old certificate
+// don't already match the new one, or were published ahead of time for
+// its key (see KeyRotationPolicy.PublishNextKey). It reports whether
+// the records of the old certificate need to be removed later with
+// retireTLSA.
+func (cfg *Config) prepareTLSAForNewCert(ctx context.Context, names []string, oldCertPEM, newCertPEM []byte) (bool, error) {
+	if cfg.DANE == nil || cfg.DANE.Publisher == nil {
+		return false, nil
+	}
+	var announced bool
+	if len(oldCertPEM) > 0 {
+		oldRecs, err := TLSARecordsFor(oldCertPEM, cfg.DANE.records())
+		if err != nil {
+			// if the old records can't be computed, they
+			// aren't published, so there's nothing to keep
+			oldCertPEM = nil
+		} else if newRecs, err := TLSARecordsFor(newCertPEM, cfg.DANE.records()); err == nil {
+			if slices.EqualFunc(oldRecs, newRecs, func(a, b TLSARecord) bool { return bytes.Equal(a.Data, b.Data) }) {
+				// the records are the same; nothing to roll over
+				return false, cfg.publishTLSA(ctx, names, newCertPEM)
+			}
+			// the records of the new key may have been published
+			// already, before it was used; if so, there's no need
+			// to wait for them (the next key is replaced only
+			// after the new certificate is stored)
+			published := appendTLSARecords(oldRecs, cfg.nextKeyTLSA(ctx, names[0])...)
+			announced = !slices.ContainsFunc(newRecs, func(rec TLSARecord) bool {
+				return !containsTLSARecord(published, rec)
+			})
+		}
+	}
+	if err := cfg.publishTLSA(ctx, names, oldCertPEM, newCertPEM); err != nil {
+		return false, err
+	}
+	if len(oldCertPEM) == 0 {
+		return false, nil
+	}
+	if announced {
+		return true, nil
+	}
+
+	cfg.Logger.Info("waiting for new TLSA records to propagate before using new certificate",
+		zap.Strings("identifiers", names),
+		zap.Duration("delay", cfg.DANE.rolloverDelay()))
+	timer := time.NewTimer(cfg.DANE.rolloverDelay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	return true, nil
+}
+
+// retireTLSA removes the TLSA records of the certificate that the
+// certificate in certRes replaced after the rollover delay, unless
+// certRes has been replaced in storage by then (in which case the
+// next renewal publishes the right records).
+func (cfg *Config) retireTLSA(issuer Issuer, certRes CertificateResource) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				cfg.Logger.Error("panic while retiring TLSA records", zap.Any("error", err))
+			}
+		}()
+
+		timer := time.NewTimer(cfg.DANE.rolloverDelay())
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-cfg.parentContext().Done():
+			return
+		}
+
+		ctx, cancel := cfg.backgroundContext(5 * time.Minute)
+		defer cancel()
+		current, err := cfg.loadCertResource(ctx, issuer, certRes.NamesKey())
+		if err != nil || !bytes.Equal(current.CertificatePEM, certRes.CertificatePEM) {
+			return
+		}
+		if err := cfg.publishTLSA(ctx, certRes.SANs, certRes.CertificatePEM); err != nil {
+			cfg.Logger.Error("removing TLSA records of replaced certificate",
+				zap.Strings("identifiers", certRes.SANs),
+				zap.Error(err))
+		}
+	}()
+}
+
+// LibDNSTLSAPublisher publishes TLSA records with a libdns provider.
+//
+// EXPERIMENTAL: Subject to change.
+type LibDNSTLSAPublisher struct {
+	// The DNS provider. REQUIRED.
+	Provider interface {
+		libdns.RecordGetter
+		libdns.RecordAppender
+		libdns.RecordDeleter
+	}
+
+	// The TTL of the records.
+	TTL time.Duration
+
+	// The zone of the records; if empty, it is looked up
+	// with the given resolvers or the system resolvers.
+	Zone      string
+	Resolvers []string
+
+	Logger *zap.Logger
+}
+
+// PublishTLSA implements TLSAPublisher.
+func (p LibDNSTLSAPublisher) PublishTLSA(ctx context.Context, owner string, records []TLSARecord) error {
+	logger := p.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+	zone := p.Zone
+	if zone == "" {
+		var err error
+		zone, err = FindZoneByFQDN(ctx, logger, owner+".", RecursiveNameservers(p.Resolvers))
+		if err != nil {
+			return fmt.Errorf("could not determine zone for %q: %v", owner, err)
+		}
+	}
+	name := libdns.RelativeName(owner+".", zone)
+
+	existing, err := p.Provider.GetRecords(ctx, zone)
+	if err != nil {
+		return fmt.Errorf("getting records: %v", err)
+	}
+	want := make([]string, len(records))
+	for i, rec := range records {
+		want[i] = rec.String()
+	}
+
+	// add the new records before deleting the old ones,
+	// so that there is never no record for the owner
+	var have []string
+	var stale []libdns.Record
+	for _, rec := range existing {
+		if rec.Type != "TLSA" || rec.Name != name {
+			continue
+		}
+		value := normalizeTLSAValue(rec.Value)
+		if slices.Contains(want, value) {
+			have = append(have, value)
+		} else {
+			stale = append(stale, rec)
+		}
+	}
+	var toAdd []libdns.Record
+	for _, value := range want {
+		if !slices.Contains(have, value) {
+			toAdd = append(toAdd, libdns.Record{Type: "TLSA", Name: name, Value: value, TTL: p.TTL})
+		}
+	}
+	if len(toAdd) > 0 {
+		if _, err := p.Provider.AppendRecords(ctx, zone, toAdd); err != nil {
+			return fmt.Errorf("adding records: %v", err)
+		}
+	}
+	if len(stale) > 0 {
+		if _, err := p.Provider.DeleteRecords(ctx, zone, stale); err != nil {
+			return fmt.Errorf("deleting records: %v", err)
+		}
+	}
+	return nil
+}
+
+// normalizeTLSAValue normalizes the presentation format of TLSA
+// record data, which may have the hex data in any case and split
+// into multiple fields.
+func normalizeTLSAValue(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) < 4 {
+		return value
+	}
+	for i := 0; i < 3; i++ {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return value
+		}
+		fields[i] = strconv.Itoa(n)
+	}
+	return strings.Join(fields[:3], " ") + " " + strings.ToLower(strings.Join(fields[3:], ""))
+}
+
+// Interface guard
+var _ TLSAPublisher = LibDNSTLSAPublisher{}
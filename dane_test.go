@@ -0,0 +1,124 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTLSAPublisher struct {
+	mu    sync.Mutex
+	calls [][]TLSARecord
+}
+
+func (p *recordingTLSAPublisher) PublishTLSA(_ context.Context, owner string, records []TLSARecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if owner == "_443._tcp.dane.example.com" {
+		p.calls = append(p.calls, records)
+	}
+	return nil
+}
+
+func (p *recordingTLSAPublisher) published() [][]TLSARecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.calls)
+}
+
+func TestDANERollover(t *testing.T) {
+	publisher := new(recordingTLSAPublisher)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers: []Issuer{&testIssuer{}},
+		DANE: &DANEConfig{
+			Publisher:     publisher,
+			Records:       []TLSAParams{{Usage: 3, Selector: 0, MatchingType: 1}},
+			RolloverDelay: 50 * time.Millisecond,
+		},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+
+	ctx := context.Background()
+	const name = "dane.example.com"
+	certHash := func() []byte {
+		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(certs[0].Raw)
+		return sum[:]
+	}
+
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	oldHash := certHash()
+	if calls := publisher.published(); len(calls) != 1 || len(calls[0]) != 1 || string(calls[0][0].Data) != string(oldHash) {
+		t.Fatalf("Expected the record of the new certificate to be published, got %v", calls)
+	}
+
+	if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+		t.Fatal(err)
+	}
+	newHash := certHash()
+	calls := publisher.published()
+	if len(calls) != 2 || len(calls[1]) != 2 ||
+		string(calls[1][0].Data) != string(oldHash) || string(calls[1][1].Data) != string(newHash) {
+		t.Fatalf("Expected the records of both certificates to be published before renewal, got %v", calls)
+	}
+
+	// the record of the old certificate is removed after the delay
+	deadline := time.Now().Add(5 * time.Second)
+	for len(publisher.published()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the record of the old certificate to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	calls = publisher.published()
+	if len(calls[2]) != 1 || string(calls[2][0].Data) != string(newHash) {
+		t.Errorf("Expected only the record of the new certificate, got %v", calls[2])
+	}
+}
+
+func TestNormalizeTLSAValue(t *testing.T) {
+	for i, tc := range []struct{ input, expect string }{
+		{"3 1 1 ABCDEF", "3 1 1 abcdef"},
+		{"03 1 1 ab cd ef", "3 1 1 abcdef"},
+		{"garbage", "garbage"},
+	} {
+		if actual := normalizeTLSAValue(tc.input); actual != tc.expect {
+			t.Errorf("Test %d: Expected %q, got %q", i, tc.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DecommissionPolicy decommissions on-demand certificates that are not
+// used anymore: they are removed from the cache, so they are no longer
+// maintained, and optionally deleted from storage. If a name is needed
+// again later, its certificate is loaded from storage or obtained anew
+// as usual.
+//
+// Usage is tracked in memory, since the cache was created, so a
+// certificate loaded after a restart is idle only after MaxIdle passes
+// without use. Since other instances in a cluster don't share usage,
+// beware of deleting certificates from shared storage that other
+// instances serve.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type DecommissionPolicy struct {
+	// How long a certificate may go without being used
+	// for a TLS handshake before it is decommissioned.
+	// Required.
+	MaxIdle time.Duration
+
+	// Whether to delete decommissioned certificates
+	// from storage, too.
+	DeleteFromStorage bool
+}
+
+// idleFor returns how long the cached certificate with the given hash
+// has not been used for a TLS handshake; if it was never used, since
+// it was added to the cache.
+func (certCache *Cache) idleFor(hash string) time.Duration {
+	usage, ok := certCache.usage.load(hash)
+	if !ok {
+		return 0
+	}
+	lastActive := usage.added
+	if lastUsed := usage.lastUsed.Load(); lastUsed > 0 {
+		lastActive = time.Unix(0, lastUsed)
+	}
+	return time.Since(lastActive)
+}
+
+// shouldDecommission returns true if cert, an on-demand certificate
+// managed by cfg, is idle for longer than cfg allows.
+func (cfg *Config) shouldDecommission(cert Certificate) bool {
+	if cfg.OnDemand == nil || cfg.OnDemand.Decommission == nil || cfg.OnDemand.Decommission.MaxIdle <= 0 {
+		return false
+	}
+	return cfg.certCache.idleFor(cert.hash) > cfg.OnDemand.Decommission.MaxIdle
+}
+
+// decommission removes cert from the cache and, if configured, from
+// storage. Handlers of the cert_decommissioning event may prevent it
+// by returning an error.
+func (cfg *Config) decommission(ctx context.Context, cert Certificate) error {
+	policy := cfg.OnDemand.Decommission
+	idle := cfg.certCache.idleFor(cert.hash)
+
+	if err := cfg.emit(ctx, "cert_decommissioning", map[string]any{
+		"identifiers":         cert.Names,
+		"issuer":              cert.issuerKey,
+		"idle":                idle,
+		"delete_from_storage": policy.DeleteFromStorage,
+	}); err != nil {
+		return fmt.Errorf("decommissioning aborted by event handler: %w", err)
+	}
+
+	cfg.certCache.mu.Lock()
+	cfg.certCache.removeCertificate(cert)
+	cfg.certCache.mu.Unlock()
+
+	if budget := cfg.OnDemand.MaxCertificates; budget != nil {
+		budget.remove(cert.Names...)
+	}
+
+	if policy.DeleteFromStorage && cert.issuerKey != "" {
+		if err := cfg.deleteCertAssets(ctx, cert.issuerKey, cert.Names, "decommissioned"); err != nil {
+			return fmt.Errorf("removed from cache, but unable to delete from storage: %v", err)
+		}
+	}
+
+	cfg.Logger.Info("decommissioned unused on-demand certificate",
+		zap.Strings("identifiers", cert.Names),
+		zap.Duration("idle", idle),
+		zap.Bool("deleted_from_storage", policy.DeleteFromStorage))
+	cfg.emit(ctx, "cert_decommissioned", map[string]any{
+		"identifiers":          cert.Names,
+		"issuer":               cert.issuerKey,
+		"deleted_from_storage": policy.DeleteFromStorage,
+	})
+
+	return nil
+}
+
+// deleteCertAssets deletes the assets of the certificate for names
+// from issuerKey from storage while holding the lock for issuing it,
+// and tells other instances to drop it from their caches for reason.
+func (cfg *Config) deleteCertAssets(ctx context.Context, issuerKey string, names []string, reason string) error {
+	name := names[0]
+	// don't delete a certificate that is being renewed right now
+	lockKey := cfg.lockKey(certIssueLockOp, name)
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return fmt.Errorf("unable to acquire lock to delete %s: %v", name, err)
+	}
+	err := cfg.deleteSiteAssets(ctx, issuerKey, name)
+	if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+		cfg.Logger.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+	}
+	if err != nil {
+		return err
+	}
+	cfg.certCache.notifyInvalidation(ctx, reason, names)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecommissionUnusedOnDemandCertificates(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+
+	var events []string
+	keep := true
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(context.Context, string) error { return nil },
+			Decommission: &DecommissionPolicy{MaxIdle: time.Hour, DeleteFromStorage: true},
+		},
+		OnEvent: func(_ context.Context, event string, _ map[string]any) error {
+			events = append(events, event)
+			if event == "cert_decommissioning" && keep {
+				return errors.New("still needed")
+			}
+			return nil
+		},
+	})
+	ctx := context.Background()
+
+	const name = "unused.example.com"
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerKey := cfg.Issuers[0].IssuerKey()
+
+	// recently added certificates are kept
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.getAllMatchingCerts(name)) != 1 {
+		t.Fatal("Expected certificate in use to be kept")
+	}
+
+	// idle certificates are decommissioned, unless an event handler objects
+	cache.usage.update(cert.hash, func(u **certUsage) { (*u).added = time.Now().Add(-2 * time.Hour) })
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.getAllMatchingCerts(name)) != 1 {
+		t.Fatal("Expected event handler to prevent decommissioning")
+	}
+
+	keep = false
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.getAllMatchingCerts(name)) != 0 {
+		t.Error("Expected idle certificate to be removed from the cache")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert(issuerKey, name)) {
+		t.Error("Expected idle certificate to be deleted from storage")
+	}
+	if events[len(events)-1] != "cert_decommissioned" {
+		t.Errorf("Expected cert_decommissioned event, got %v", events)
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// DelegatedCredentialPolicy configures generating delegated credentials
+// (RFC 9345) for managed certificates. A delegated credential is a
+// short-lived key signed by the certificate's key, which TLS servers
+// can use in place of the certificate's key with clients that support
+// it; so, servers that load delegated credentials from storage don't
+// need the certificate's key, and if one is compromised, the damage
+// is limited to the validity of the credential.
+//
+// Credentials are generated by instances that have the certificate's
+// key, stored alongside the certificate, and renewed in the background
+// when half of their validity has passed. Only certificates with the
+// DelegationUsage extension can delegate; with this policy set, it is
+// requested in CSRs, but not all CAs honor it.
+//
+// Go's crypto/tls does not serve delegated credentials; they can be
+// given to TLS stacks that do with Config.GetDelegatedCredential.
+//
+// EXPERIMENTAL: Subject to change.
+type DelegatedCredentialPolicy struct {
+	// How long credentials are valid; at most 7 days.
+	// Default: 24h.
+	Validity time.Duration
+
+	// The type of key to generate for credentials:
+	// P256, P384, or ED25519. Default: P256.
+	KeyType KeyType
+}
+
+// DelegatedCredential is a delegated credential (RFC 9345) and its key.
+//
+// EXPERIMENTAL: Subject to change.
+type DelegatedCredential struct {
+	// The serialized DelegatedCredential structure,
+	// to send in the Certificate message.
+	Raw []byte
+
+	// The private key of the credential.
+	PrivateKey crypto.Signer
+
+	// The signature scheme of the credential's key,
+	// for CertificateVerify.
+	Algorithm tls.SignatureScheme
+
+	// When the credential expires.
+	Expires time.Time
+
+	// The hash of the certificate that delegated it.
+	parent string
+}
+
+// GetDelegatedCredential returns the delegated credential for the
+// certificate that would be served for hello, generating one if the
+// certificate's key is available and there is no valid one yet; it
+// is meant to be used by TLS stacks that serve delegated credentials.
+// An error is returned if cfg.DelegatedCredentials is not set or no
+// valid credential is available.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) GetDelegatedCredential(hello *tls.ClientHelloInfo) (*DelegatedCredential, error) {
+	cfg = cfg.current()
+	if cfg.DelegatedCredentials == nil {
+		return nil, fmt.Errorf("delegated credentials are not enabled")
+	}
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cert, matched, defaulted := cfg.getCertificateFromCache(hello)
+	if !matched && !defaulted {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return cfg.delegatedCredential(ctx, cert)
+}
+
+// delegatedCredential returns the credential of cert from memory or
+// storage, generating and storing a new one if it is due and cert's key
+// is available.
+func (cfg *Config) delegatedCredential(ctx context.Context, cert Certificate) (*DelegatedCredential, error) {
+	policy := cfg.DelegatedCredentials
+	dc, ok := cfg.certCache.delegatedCredentials.load(cert.hash)
+	if ok && !policy.due(dc) {
+		return dc, nil
+	}
+
+	// maybe another instance renewed it
+	if cert.issuerKey != "" && len(cert.Names) > 0 {
+		stored, err := cfg.loadDelegatedCredential(ctx, cert)
+		if err == nil && !policy.due(stored) {
+			cfg.certCache.delegatedCredentials.store(cert.hash, stored)
+			return stored, nil
+		}
+		if err == nil && (dc == nil || stored.Expires.After(dc.Expires)) {
+			dc = stored
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			cfg.Logger.Error("loading delegated credential",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+		}
+	}
+
+	signer, canSign := cert.PrivateKey.(crypto.Signer)
+	if !canSign {
+		// we can't renew it; use it while it lasts
+		if dc != nil && time.Now().Before(dc.Expires) {
+			cfg.certCache.delegatedCredentials.store(cert.hash, dc)
+			return dc, nil
+		}
+		return nil, fmt.Errorf("no valid delegated credential for %v, and the certificate's key is not available", cert.Names)
+	}
+
+	dc, err := newDelegatedCredential(cert.Leaf, signer, policy)
+	if err != nil {
+		return nil, fmt.Errorf("generating delegated credential for %v: %w", cert.Names, err)
+	}
+	dc.parent = cert.hash
+	if cert.issuerKey != "" && len(cert.Names) > 0 {
+		if err := cfg.storeDelegatedCredential(ctx, cert, dc); err != nil {
+			// we can still serve it ourselves
+			cfg.Logger.Error("storing delegated credential",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+		}
+	}
+	cfg.certCache.delegatedCredentials.store(cert.hash, dc)
+	cfg.Logger.Info("generated delegated credential",
+		zap.Strings("identifiers", cert.Names),
+		zap.Time("expires", dc.Expires))
+
+	return dc, nil
+}
+
+func (cfg *Config) loadDelegatedCredential(ctx context.Context, cert Certificate) (*DelegatedCredential, error) {
+	storedJSON, err := cfg.Storage.Load(ctx, StorageKeys.SiteDelegatedCredential(cert.issuerKey, cert.Names[0]))
+	if err != nil {
+		return nil, err
+	}
+	var stored storedDelegatedCredential
+	if err := json.Unmarshal(storedJSON, &stored); err != nil {
+		return nil, fmt.Errorf("decoding delegated credential: %v", err)
+	}
+	if stored.Parent != cert.hash {
+		// delegated by a previous certificate
+		return nil, fs.ErrNotExist
+	}
+	key, err := PEMDecodePrivateKey(stored.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decoding delegated credential key: %v", err)
+	}
+	return &DelegatedCredential{
+		Raw:        stored.Credential,
+		PrivateKey: key,
+		Algorithm:  stored.Algorithm,
+		Expires:    stored.Expires,
+		parent:     stored.Parent,
+	}, nil
+}
+
+func (cfg *Config) storeDelegatedCredential(ctx context.Context, cert Certificate, dc *DelegatedCredential) error {
+	keyPEM, err := PEMEncodePrivateKey(dc.PrivateKey)
+	if err != nil {
+		return err
+	}
+	storedJSON, err := json.Marshal(storedDelegatedCredential{
+		Credential: dc.Raw,
+		PrivateKey: keyPEM,
+		Algorithm:  dc.Algorithm,
+		Expires:    dc.Expires,
+		Parent:     dc.parent,
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.Storage.Store(ctx, StorageKeys.SiteDelegatedCredential(cert.issuerKey, cert.Names[0]), storedJSON)
+}
+
+// updateDelegatedCredentials renews the delegated credentials of the
+// certificates in the cache that are due, if their keys are available.
+func (certCache *Cache) updateDelegatedCredentials(ctx context.Context) {
+	for _, cert := range certCache.getAllCerts() {
+		if cert.Leaf == nil || cert.Expired() || !hasDelegationUsage(cert.Leaf) {
+			continue
+		}
+		if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+			continue
+		}
+		cfg, err := certCache.getConfig(cert)
+		if err != nil || cfg.DelegatedCredentials == nil {
+			continue
+		}
+		if _, err := cfg.delegatedCredential(ctx, cert); err != nil {
+			cfg.Logger.Error("renewing delegated credential",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+		}
+	}
+}
+
+// storedDelegatedCredential is how a delegated credential is kept in storage.
+type storedDelegatedCredential struct {
+	Credential []byte              `json:"credential"`
+	PrivateKey []byte              `json:"private_key"`
+	Algorithm  tls.SignatureScheme `json:"algorithm"`
+	Expires    time.Time           `json:"expires"`
+	Parent     string              `json:"parent"`
+}
+
+// newDelegatedCredential generates a key and signs a delegated
+// credential for it with the key of parent, according to policy.
+func newDelegatedCredential(parent *x509.Certificate, parentKey crypto.Signer, policy *DelegatedCredentialPolicy) (*DelegatedCredential, error) {
+	if !hasDelegationUsage(parent) {
+		return nil, fmt.Errorf("certificate does not have the DelegationUsage extension")
+	}
+	if parent.KeyUsage != 0 && parent.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, fmt.Errorf("certificate does not allow digital signatures")
+	}
+
+	keyType := policy.KeyType
+	if keyType == "" {
+		keyType = P256
+	}
+	var dcScheme tls.SignatureScheme
+	switch keyType {
+	case P256:
+		dcScheme = tls.ECDSAWithP256AndSHA256
+	case P384:
+		dcScheme = tls.ECDSAWithP384AndSHA384
+	case ED25519:
+		dcScheme = tls.Ed25519
+	default:
+		return nil, fmt.Errorf("unsupported key type for delegated credentials: %s", keyType)
+	}
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	signer := key.(crypto.Signer)
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// the validity is relative to the parent's, and can't exceed it
+	expires := time.Now().Add(policy.validity()).Truncate(time.Second)
+	if parent.NotAfter.Before(expires) {
+		expires = parent.NotAfter
+	}
+	if !expires.After(parent.NotBefore) || !expires.After(time.Now()) {
+		return nil, fmt.Errorf("certificate is not valid long enough to delegate")
+	}
+
+	var cred cryptobyte.Builder
+	cred.AddUint32(uint32(expires.Sub(parent.NotBefore) / time.Second))
+	cred.AddUint16(uint16(dcScheme))
+	cred.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(spki)
+	})
+	credBytes, err := cred.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, opts, err := delegationSignatureScheme(parentKey)
+	if err != nil {
+		return nil, err
+	}
+	signed := delegationSignedMessage(parent.Raw, credBytes, scheme)
+	digest := signed
+	if hash := opts.HashFunc(); hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	sig, err := parentKey.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("signing delegated credential: %v", err)
+	}
+
+	var dc cryptobyte.Builder
+	dc.AddBytes(credBytes)
+	dc.AddUint16(uint16(scheme))
+	dc.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(sig)
+	})
+	raw, err := dc.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DelegatedCredential{
+		Raw:        raw,
+		PrivateKey: signer,
+		Algorithm:  dcScheme,
+		Expires:    expires,
+	}, nil
+}
+
+// delegationSignedMessage returns the message that is signed by the
+// certificate's key to delegate the credential (RFC 9345, section 4.1.3).
+func delegationSignedMessage(parentDER, cred []byte, scheme tls.SignatureScheme) []byte {
+	msg := slices.Repeat([]byte{0x20}, 64)
+	msg = append(msg, "TLS, server delegated credentials\x00"...)
+	msg = append(msg, parentDER...)
+	msg = append(msg, cred...)
+	return append(msg, byte(scheme>>8), byte(scheme))
+}
+
+// delegationSignatureScheme returns the signature scheme and
+// signer options to sign delegated credentials with key.
+func delegationSignatureScheme(key crypto.Signer) (tls.SignatureScheme, crypto.SignerOpts, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return tls.ECDSAWithP256AndSHA256, crypto.SHA256, nil
+		case elliptic.P384():
+			return tls.ECDSAWithP384AndSHA384, crypto.SHA384, nil
+		case elliptic.P521():
+			return tls.ECDSAWithP521AndSHA512, crypto.SHA512, nil
+		}
+	case ed25519.PublicKey:
+		return tls.Ed25519, crypto.Hash(0), nil
+	case *rsa.PublicKey:
+		return tls.PSSWithSHA256, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported certificate key type for delegated credentials: %T", key.Public())
+}
+
+// hasDelegationUsage returns true if cert has the DelegationUsage extension.
+func hasDelegationUsage(cert *x509.Certificate) bool {
+	return slices.ContainsFunc(cert.Extensions, func(ext pkix.Extension) bool {
+		return ext.Id.Equal(delegationUsageOID)
+	})
+}
+
+func (p *DelegatedCredentialPolicy) validity() time.Duration {
+	if p.Validity > 0 {
+		return min(p.Validity, maxDelegatedCredentialValidity)
+	}
+	return 24 * time.Hour
+}
+
+// due returns true if dc should be renewed, because it
+// is nil or half of its validity has passed.
+func (p *DelegatedCredentialPolicy) due(dc *DelegatedCredential) bool {
+	return dc == nil || time.Until(dc.Expires) < p.validity()/2
+}
+
+// maxDelegatedCredentialValidity is the longest validity allowed
+// for delegated credentials (RFC 9345, section 4.1.3).
+const maxDelegatedCredentialValidity = 7 * 24 * time.Hour
+
+// Constants for the DelegationUsage extension (RFC 9345, section 4.2).
+var (
+	delegationUsageOID       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44363, 44}
+	delegationUsageExtension = pkix.Extension{
+		Id:    delegationUsageOID,
+		Value: []byte{0x05, 0x00}, // NULL
+	}
+)
@@ -0,0 +1,215 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func TestNewDelegatedCredential(t *testing.T) {
+	parent, parentKey := mustGenerateDelegatingCert(t, time.Now().Add(30*24*time.Hour))
+
+	dc, err := newDelegatedCredential(parent, parentKey, &DelegatedCredentialPolicy{Validity: 48 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dc.Algorithm != tls.ECDSAWithP256AndSHA256 {
+		t.Errorf("Expected P-256 credential, got %v", dc.Algorithm)
+	}
+	if until := time.Until(dc.Expires); until > 48*time.Hour || until < 47*time.Hour {
+		t.Errorf("Expected credential to expire in 48h, expires in %s", until)
+	}
+
+	// parse it back and verify the signature with the parent's key
+	s := cryptobyte.String(dc.Raw)
+	var validTime uint32
+	var dcScheme, scheme uint16
+	var spki, sig cryptobyte.String
+	credStart := s
+	if !s.ReadUint32(&validTime) || !s.ReadUint16(&dcScheme) || !s.ReadUint24LengthPrefixed(&spki) {
+		t.Fatal("Malformed credential")
+	}
+	cred := credStart[:len(credStart)-len(s)]
+	if !s.ReadUint16(&scheme) || !s.ReadUint16LengthPrefixed(&sig) || !s.Empty() {
+		t.Fatal("Malformed delegated credential")
+	}
+	if expires := parent.NotBefore.Add(time.Duration(validTime) * time.Second); !expires.Equal(dc.Expires) {
+		t.Errorf("Expected valid_time to match expiration %s, got %s", dc.Expires, expires)
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dc.PrivateKey.Public().(*ecdsa.PublicKey).Equal(pub) {
+		t.Error("Expected credential to contain the public key of its private key")
+	}
+	if tls.SignatureScheme(scheme) != tls.ECDSAWithP256AndSHA256 {
+		t.Errorf("Expected signature with P-256 parent key, got %v", scheme)
+	}
+	digest := sha256.Sum256(delegationSignedMessage(parent.Raw, cred, tls.SignatureScheme(scheme)))
+	if !ecdsa.VerifyASN1(&parentKey.PublicKey, digest[:], sig) {
+		t.Error("Signature does not verify with the parent's key")
+	}
+
+	// the credential can't outlive its parent
+	shortParent, shortKey := mustGenerateDelegatingCert(t, time.Now().Add(time.Hour))
+	dc, err = newDelegatedCredential(shortParent, shortKey, &DelegatedCredentialPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dc.Expires.Equal(shortParent.NotAfter) {
+		t.Errorf("Expected credential to expire with its parent at %s, got %s", shortParent.NotAfter, dc.Expires)
+	}
+
+	// certificates without DelegationUsage can't delegate
+	certPEM, keyPEM := mustGenerateTestCert(t, []string{"example.com"}, time.Now().Add(time.Hour))
+	cert, err := makeCertificate(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDelegatedCredential(cert.Leaf, parentKey, &DelegatedCredentialPolicy{}); err == nil {
+		t.Error("Expected error for certificate without DelegationUsage")
+	}
+}
+
+func TestDelegatedCredentialSharedThroughStorage(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	storage := &FileStorage{Path: tmpDir}
+	newConfig := func() *Config {
+		return &Config{
+			Storage:              storage,
+			Logger:               defaultTestLogger,
+			DelegatedCredentials: &DelegatedCredentialPolicy{},
+			certCache:            new(Cache),
+		}
+	}
+
+	parent, parentKey := mustGenerateDelegatingCert(t, time.Now().Add(30*24*time.Hour))
+	cert := Certificate{
+		Certificate: tls.Certificate{Certificate: [][]byte{parent.Raw}, PrivateKey: parentKey, Leaf: parent},
+		Names:       []string{"delegating.example.com"},
+		hash:        hashCertificateChain([][]byte{parent.Raw}),
+		issuerKey:   "test",
+		managed:     true,
+	}
+
+	origin := newConfig()
+	dc, err := origin.delegatedCredential(ctx, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := origin.delegatedCredential(ctx, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != dc {
+		t.Error("Expected credential to be reused while it is fresh")
+	}
+
+	// an edge without the certificate's key uses the stored credential
+	edgeCert := cert
+	edgeCert.PrivateKey = nil
+	edge := newConfig()
+	loaded, err := edge.delegatedCredential(ctx, edgeCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Raw, dc.Raw) || loaded.Algorithm != dc.Algorithm {
+		t.Error("Expected edge to load the stored credential")
+	}
+
+	// a credential delegated by another certificate is not used
+	edgeCert.hash = "other"
+	if _, err := newConfig().delegatedCredential(ctx, edgeCert); err == nil {
+		t.Error("Expected error without a credential for the certificate or its key")
+	}
+}
+
+func TestCSRRequestsDelegationUsage(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Logger: defaultTestLogger, DelegatedCredentials: &DelegatedCredentialPolicy{}}
+	csr, err := cfg.generateCSR(key, []string{"example.com"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasDelegationUsageRequest(csr) {
+		t.Error("Expected CSR to request DelegationUsage")
+	}
+	cfg.DelegatedCredentials = nil
+	csr, err = cfg.generateCSR(key, []string{"example.com"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasDelegationUsageRequest(csr) {
+		t.Error("Expected CSR not to request DelegationUsage without a policy")
+	}
+}
+
+func hasDelegationUsageRequest(csr *x509.CertificateRequest) bool {
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(delegationUsageOID) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustGenerateDelegatingCert(t *testing.T, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: "delegating.example.com"},
+		DNSNames:        []string{"delegating.example.com"},
+		NotBefore:       time.Now().Add(-time.Hour).Truncate(time.Second),
+		NotAfter:        notAfter.Truncate(time.Second),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{delegationUsageExtension},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
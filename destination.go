@@ -0,0 +1,170 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrForeignDestination is returned (wrapped) when a name does not
+// resolve to an address of this server.
+var ErrForeignDestination = errors.New("name does not resolve to an address of this server")
+
+// DestinationCheck verifies that a name for which a certificate is
+// requested on demand resolves to an address of this server. Anyone
+// can point DNS records of their names at the server's address, and
+// have it obtain certificates for them with its CA account if the
+// DecisionFunc allows too much; this makes sure that the server only
+// asks for names that point to it. It does not replace a DecisionFunc,
+// since names can also be pointed at the server on purpose.
+//
+// EXPERIMENTAL: Subject to change.
+type DestinationCheck struct {
+	// The addresses of this server, or prefixes of them.
+	// If empty, the addresses of the network interfaces
+	// are used, which are not the public addresses of
+	// servers behind NAT or load balancers; those must
+	// be configured.
+	Addresses []netip.Prefix
+
+	// Require all addresses the name resolves to to be
+	// addresses of this server, instead of at least one.
+	RequireAll bool
+
+	// The resolver to look up names with. Default: the
+	// config's Resolver (see Config.Resolver), or, if it
+	// has none, net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// How long to wait for the lookup. Default: 5s.
+	Timeout time.Duration
+}
+
+// CertificateAllowed returns nil if name resolves to an address of
+// this server. It is suitable for use as an OnDemandConfig.DecisionFunc.
+func (dc *DestinationCheck) CertificateAllowed(ctx context.Context, name string) error {
+	addrs, err := dc.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	ours, err := dc.ownAddresses()
+	if err != nil {
+		return err
+	}
+	var matched bool
+	for _, addr := range addrs {
+		if slices.ContainsFunc(ours, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			matched = true
+		} else if dc.RequireAll {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForeignDestination, name, addr)
+		}
+	}
+	if !matched {
+		return fmt.Errorf("%w: %s resolves to %v", ErrForeignDestination, name, addrs)
+	}
+	return nil
+}
+
+// lookup returns the addresses name resolves to.
+func (dc *DestinationCheck) lookup(ctx context.Context, name string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(name); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	timeout := dc.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if dc.Resolver == nil && dnsResolverFor(ctx) != nil {
+		return lookupAddrs(ctx, name)
+	}
+	resolver := dc.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", name, err)
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, nil
+}
+
+// lookupAddrs returns the addresses name resolves to, queried with
+// the DNS resolver of the config ctx belongs to.
+func lookupAddrs(ctx context.Context, name string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, rtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg, err := dnsQuery(ctx, dns.Fqdn(name), rtype, RecursiveNameservers(nil), true)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", name, err)
+		}
+		if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("resolving %s%s", name, formatDNSError(msg, nil))
+		}
+		// recursive resolvers answer with the whole CNAME chain
+		for _, rr := range msg.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolving %s: no addresses found", name)
+	}
+	return addrs, nil
+}
+
+// ownAddresses returns the configured addresses, or the addresses of
+// the network interfaces (not the networks they are on).
+func (dc *DestinationCheck) ownAddresses() ([]netip.Prefix, error) {
+	if len(dc.Addresses) > 0 {
+		return dc.Addresses, nil
+	}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("getting addresses of network interfaces: %w", err)
+	}
+	var ours []netip.Prefix
+	for _, ifaceAddr := range ifaceAddrs {
+		ipNet, ok := ifaceAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ipNet.IP); ok {
+			addr = addr.Unmap()
+			ours = append(ours, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return ours, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDestinationCheck(t *testing.T) {
+	ctx := context.Background()
+	ours := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/28"), netip.MustParsePrefix("2001:db8::1/128")}
+
+	for i, tc := range []struct {
+		check     DestinationCheck
+		name      string
+		expectErr bool
+	}{
+		{check: DestinationCheck{Addresses: ours}, name: "203.0.113.7"},
+		{check: DestinationCheck{Addresses: ours}, name: "2001:db8::1"},
+		{check: DestinationCheck{Addresses: ours}, name: "203.0.113.16", expectErr: true},
+		{check: DestinationCheck{Addresses: ours}, name: "localhost", expectErr: true},
+		// the loopback addresses are addresses of this server
+		{name: "127.0.0.1"},
+		{name: "198.51.100.1", expectErr: true},
+		{check: DestinationCheck{Addresses: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}, name: "localhost"},
+	} {
+		err := tc.check.CertificateAllowed(ctx, tc.name)
+		if tc.expectErr {
+			if !errors.Is(err, ErrForeignDestination) {
+				t.Errorf("Test %d: Expected ErrForeignDestination for %s, got %v", i, tc.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("Test %d: Expected %s to be allowed, got %v", i, tc.name, err)
+		}
+	}
+
+	// applies on top of the decision function
+	cfg := &Config{OnDemand: &OnDemandConfig{
+		DecisionFunc: func(context.Context, string) error { return nil },
+		Destination:  &DestinationCheck{Addresses: ours},
+	}}
+	if err := cfg.checkIfCertShouldBeObtained(ctx, "203.0.113.1", true); err != nil {
+		t.Errorf("Expected certificate to be allowed, got %v", err)
+	}
+	if err := cfg.checkIfCertShouldBeObtained(ctx, "198.51.100.1", true); !errors.Is(err, ErrForeignDestination) {
+		t.Errorf("Expected certificate to be denied, got %v", err)
+	}
+}
+
+// addrResolver answers A queries for app.example.com through a CNAME
+// to a host with addr.
+type addrResolver struct{ addr string }
+
+func (r addrResolver) Exchange(_ context.Context, msg *dns.Msg, _ string) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetReply(msg)
+	if q := msg.Question[0]; q.Qtype == dns.TypeA && q.Name == "app.example.com." {
+		m.Answer = append(m.Answer,
+			&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "lb.example.net."},
+			&dns.A{Hdr: dns.RR_Header{Name: "lb.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(r.addr)})
+	}
+	return m, nil
+}
+
+func TestDestinationCheckConfigResolver(t *testing.T) {
+	cfg := &Config{
+		Resolver: addrResolver{addr: "203.0.113.5"},
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(context.Context, string) error { return nil },
+			Destination:  &DestinationCheck{Addresses: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/28")}},
+		},
+	}
+	if err := cfg.checkIfCertShouldBeObtained(context.Background(), "app.example.com", true); err != nil {
+		t.Errorf("Expected name to be resolved with the config's resolver, got %v", err)
+	}
+	cfg.Resolver = addrResolver{addr: "198.51.100.1"}
+	if err := cfg.checkIfCertShouldBeObtained(context.Background(), "app.example.com", true); !errors.Is(err, ErrForeignDestination) {
+		t.Errorf("Expected certificate to be denied, got %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DialPolicy configures which IP address families are used to connect
+// to CAs and OCSP responders, for networks on which one of them is
+// broken or slow. It applies to direct connections, not to connections
+// through a proxy.
+//
+// EXPERIMENTAL: Subject to change.
+type DialPolicy struct {
+	// Connect over only this address family:
+	// "ip4" or "ip6". Default: either.
+	Network string
+
+	// When connecting over either address family, the
+	// one to try first: "ip4" or "ip6". Default: the
+	// order of the resolved addresses (RFC 6724),
+	// which usually puts IPv6 first.
+	Prefer string
+
+	// How long to wait for a connection over the first
+	// address family before also trying the other one
+	// ("Happy Eyeballs", RFC 8305). If negative, the
+	// other one is only tried after the first fails.
+	// Default: 300ms.
+	FallbackDelay time.Duration
+}
+
+// dialContext returns a function that dials like dialer,
+// following the policy, if p is not nil.
+func (p *DialPolicy) dialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	if p == nil {
+		return dialer.DialContext
+	}
+	d := *dialer
+	d.FallbackDelay = p.FallbackDelay
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return d.DialContext(ctx, network, addr)
+		}
+		switch {
+		case p.Network == "ip4":
+			return d.DialContext(ctx, "tcp4", addr)
+		case p.Network == "ip6":
+			return d.DialContext(ctx, "tcp6", addr)
+		case p.Prefer == "ip4":
+			return dialPreferring(ctx, &d, "tcp4", "tcp6", addr, p.FallbackDelay)
+		case p.Prefer == "ip6":
+			return dialPreferring(ctx, &d, "tcp6", "tcp4", addr, p.FallbackDelay)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// dialPreferring dials addr over the primary network, and over the
+// fallback network if the primary one fails or hasn't connected
+// after delay (if it is not negative). The first connection wins.
+func dialPreferring(ctx context.Context, dialer *net.Dialer, primary, fallback, addr string, delay time.Duration) (net.Conn, error) {
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		network string
+		err     error
+	}
+	results := make(chan result, 2)
+	dial := func(network string) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		results <- result{conn, network, err}
+	}
+
+	go dial(primary)
+	pending, fellBack := 1, false
+	var fallbackTimer <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+
+	var errs []error
+	for {
+		select {
+		case <-fallbackTimer:
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// the other dial may still connect
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			errs = append(errs, fmt.Errorf("over %s: %w", addressFamilyName(res.network), res.err))
+			if fellBack && pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+		if !fellBack {
+			fellBack, fallbackTimer = true, nil
+			pending++
+			go dial(fallback)
+		}
+	}
+}
+
+// ReachabilityError is returned when a CA is not reachable over all of
+// the address families that connections to it may use.
+//
+// EXPERIMENTAL: Subject to change.
+type ReachabilityError struct {
+	// The URL that was checked.
+	URL string
+
+	// The error reaching the URL over each address family
+	// that it has addresses for ("ip4" and "ip6"); nil if
+	// it is reachable over that family.
+	Families map[string]error
+
+	// The error reaching the URL, if it wasn't
+	// checked per address family (as when
+	// connecting through a proxy).
+	Err error
+}
+
+func (e ReachabilityError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s is not reachable: %v", e.URL, e.Err)
+	}
+	var failed, reachable []string
+	for _, family := range []string{"ip6", "ip4"} {
+		err, ok := e.Families[family]
+		if !ok {
+			continue
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("over %s: %v", addressFamilyName(family), err))
+		} else {
+			reachable = append(reachable, addressFamilyName(family))
+		}
+	}
+	msg := fmt.Sprintf("%s is not reachable %s", e.URL, strings.Join(failed, "; "))
+	if len(reachable) > 0 {
+		msg += fmt.Sprintf(" (it is reachable over %s; consider a DialPolicy that prefers it)", strings.Join(reachable, " and "))
+	}
+	return msg
+}
+
+// Unwrap makes it so that e wraps the errors reaching the URL.
+func (e ReachabilityError) Unwrap() []error {
+	errs := []error{e.Err}
+	for _, err := range e.Families {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// CheckReachability checks that the CA's directory can be fetched
+// over each IP address family that connections to it may use, so that
+// networks on which one of them is broken can be told apart from other
+// failures. If it can't be over any of them, a ReachabilityError is
+// returned. Connections through a proxy are only checked as a whole.
+//
+// EXPERIMENTAL: Subject to change.
+func (am *ACMEIssuer) CheckReachability(ctx context.Context) error {
+	caURL := am.CA
+	transport, ok := am.httpClient.Transport.(*http.Transport)
+	viaProxy := !ok || am.ProxyAuthenticator != nil
+	if ok && !viaProxy && transport.Proxy != nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, caURL, nil)
+		if err != nil {
+			return err
+		}
+		proxyURL, err := transport.Proxy(req)
+		viaProxy = err != nil || proxyURL != nil
+	}
+	if viaProxy {
+		if err := checkURLReachable(ctx, am.httpClient, caURL); err != nil {
+			return ReachabilityError{URL: caURL, Err: err}
+		}
+		return nil
+	}
+
+	families := []string{"ip6", "ip4"}
+	if am.config != nil && am.config.DialPolicy != nil && am.config.DialPolicy.Network != "" {
+		families = []string{am.config.DialPolicy.Network}
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: reachabilityTimeout}).DialContext
+	}
+	result := ReachabilityError{URL: caURL, Families: make(map[string]error)}
+	var unreachable bool
+	for _, family := range families {
+		network := "tcp" + strings.TrimPrefix(family, "ip")
+		familyTransport := transport.Clone()
+		familyTransport.Proxy = nil
+		familyTransport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+		err := checkURLReachable(ctx, &http.Client{Transport: familyTransport, Timeout: reachabilityTimeout}, caURL)
+		familyTransport.CloseIdleConnections()
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) {
+			// no addresses of this family
+			continue
+		}
+		result.Families[family] = err
+		unreachable = unreachable || err != nil
+	}
+	if len(result.Families) == 0 {
+		result.Err = fmt.Errorf("no addresses to connect to")
+		return result
+	}
+	if unreachable {
+		return result
+	}
+	return nil
+}
+
+// explainNetworkError returns err, which occurred while talking to the
+// CA. Network errors are otherwise opaque timeouts or resets, so if err
+// is one, it says why if the CA turns out not to be reachable.
+func (am *ACMEIssuer) explainNetworkError(ctx context.Context, err error) error {
+	var netErr net.Error
+	var reachErr ReachabilityError
+	if !errors.As(err, &netErr) || errors.As(err, &reachErr) {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*reachabilityTimeout)
+	defer cancel()
+	if reachErr := am.CheckReachability(ctx); reachErr != nil {
+		return fmt.Errorf("%w (%w)", err, reachErr)
+	}
+	return err
+}
+
+// checkURLReachable fetches rawURL with client; any response will do.
+func checkURLReachable(ctx context.Context, client *http.Client, rawURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024*1024))
+	return resp.Body.Close()
+}
+
+func addressFamilyName(network string) string {
+	if strings.HasSuffix(network, "4") {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// defaultFallbackDelay is how long to wait for a connection over
+// the preferred address family before trying the other one, like
+// the standard library does.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// reachabilityTimeout is how long to try to reach
+// a CA over each address family.
+const reachabilityTimeout = 10 * time.Second
@@ -0,0 +1,89 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDialPolicy(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &net.Dialer{Timeout: time.Second}
+
+	// falls back to IPv4 when IPv6 fails, with or without delay
+	for _, delay := range []time.Duration{0, -1} {
+		dial := (&DialPolicy{Prefer: "ip6", FallbackDelay: delay}).dialContext(dialer)
+		conn, err := dial(ctx, "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Expected fallback to IPv4 (delay %s), got %v", delay, err)
+		}
+		conn.Close()
+	}
+
+	// but not when only IPv6 may be used
+	dial := (&DialPolicy{Network: "ip6"}).dialContext(dialer)
+	if conn, err := dial(ctx, "tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("Expected dialing only over IPv6 to fail")
+	}
+}
+
+func TestCheckReachability(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cfg := &Config{Logger: defaultTestLogger, DialPolicy: &DialPolicy{Prefer: "ip4"}}
+	am := NewACMEIssuer(cfg, ACMEIssuer{CA: srv.URL, HTTPProxy: NoProxy})
+	ctx := context.Background()
+
+	if err := am.CheckReachability(ctx); err != nil {
+		t.Fatalf("Expected CA to be reachable, got %v", err)
+	}
+
+	srv.Close()
+	err := am.CheckReachability(ctx)
+	var reachErr ReachabilityError
+	if !errors.As(err, &reachErr) || reachErr.Families["ip4"] == nil {
+		t.Fatalf("Expected CA not to be reachable over IPv4, got %v", err)
+	}
+	if _, ok := reachErr.Families["ip6"]; ok {
+		t.Error("Expected IPv6 to be skipped, since the CA has no IPv6 address")
+	}
+
+	// network errors from issuance say why
+	issueErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}
+	if err := am.explainNetworkError(ctx, issueErr); !errors.As(err, &reachErr) || !errors.Is(err, issueErr) {
+		t.Errorf("Expected network error to be explained, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNSResolver sends the DNS queries CertMagic makes itself: to find
+// zones and check propagation of DNS-01 challenge records, to look up
+// CAA records, and to find zones of DANE records. Set Config.Resolver
+// to use DNS-over-HTTPS or DNS-over-TLS, or to ask different servers
+// about some zones in split-horizon setups, where the system resolver
+// gives the wrong answers for the zones being validated.
+//
+// EXPERIMENTAL: Subject to change.
+type DNSResolver interface {
+	// Exchange sends the query msg and returns the response.
+	// nameserver (host:port) is the server CertMagic would
+	// query: a recursive resolver if msg.RecursionDesired,
+	// otherwise one of the zone's authoritative nameservers.
+	// Implementations may send the query elsewhere.
+	Exchange(ctx context.Context, msg *dns.Msg, nameserver string) (*dns.Msg, error)
+}
+
+// Nameserver is a DNSResolver that sends all queries to the nameserver
+// at its address (host:port) over UDP, retrying over TCP if needed.
+type Nameserver string
+
+// Exchange implements DNSResolver.
+func (ns Nameserver) Exchange(ctx context.Context, msg *dns.Msg, _ string) (*dns.Msg, error) {
+	return exchangeUDPOrTCP(ctx, msg, string(ns))
+}
+
+// DoHResolver is a DNSResolver that sends all queries to a DNS-over-HTTPS
+// (RFC 8484) server, with recursion desired, since public DoH servers
+// don't forward queries to authoritative nameservers.
+//
+// EXPERIMENTAL: Subject to change.
+type DoHResolver struct {
+	// The URL of the server, like
+	// "https://cloudflare-dns.com/dns-query". REQUIRED.
+	URL string
+
+	// The HTTP client to use. Default: a client with a timeout.
+	HTTPClient *http.Client
+}
+
+// Exchange implements DNSResolver.
+func (r DoHResolver) Exchange(ctx context.Context, msg *dns.Msg, _ string) (*dns.Msg, error) {
+	query := msg.Copy()
+	query.RecursionDesired = true
+	query.Id = 0 // recommended by RFC 8484 for cache-friendliness
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing DNS query: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := httpClientFor(ctx, r.HTTPClient, dnsTimeout).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying DoH server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server responded with HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("reading DoH response: %v", err)
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpacking DoH response: %v", err)
+	}
+	in.Id = msg.Id
+	return in, nil
+}
+
+// DoTResolver is a DNSResolver that sends all queries to a DNS-over-TLS
+// (RFC 7858) server, with recursion desired, like DoHResolver.
+//
+// EXPERIMENTAL: Subject to change.
+type DoTResolver struct {
+	// The address of the server (host:port, usually port 853),
+	// like "1.1.1.1:853". REQUIRED.
+	Address string
+
+	// The TLS config; its ServerName should be set to the name
+	// of the server's certificate (like "cloudflare-dns.com")
+	// if Address is an IP address.
+	TLSConfig *tls.Config
+}
+
+// Exchange implements DNSResolver.
+func (r DoTResolver) Exchange(ctx context.Context, msg *dns.Msg, _ string) (*dns.Msg, error) {
+	query := msg.Copy()
+	query.RecursionDesired = true
+	client := &dns.Client{Net: "tcp-tls", Timeout: dnsTimeout, TLSConfig: r.TLSConfig}
+	in, _, err := client.ExchangeContext(ctx, query, r.Address)
+	if err != nil {
+		return nil, fmt.Errorf("querying DoT server: %w", err)
+	}
+	return in, nil
+}
+
+// SplitDNSResolver is a DNSResolver that sends queries for names in some
+// zones to other resolvers, for split-horizon setups. Queries are sent
+// to the resolver of the longest zone that contains the queried name.
+//
+// EXPERIMENTAL: Subject to change.
+type SplitDNSResolver struct {
+	// Resolvers by zone, like "internal.example.com".
+	Zones map[string]DNSResolver
+
+	// The resolver for names in none of the zones. Default:
+	// the nameserver CertMagic chose.
+	Default DNSResolver
+}
+
+// Exchange implements DNSResolver.
+func (r SplitDNSResolver) Exchange(ctx context.Context, msg *dns.Msg, nameserver string) (*dns.Msg, error) {
+	var name string
+	if len(msg.Question) > 0 {
+		name = strings.ToLower(strings.TrimSuffix(msg.Question[0].Name, "."))
+	}
+	var resolver DNSResolver
+	var longest int
+	for zone, zoneResolver := range r.Zones {
+		zone = strings.ToLower(strings.Trim(zone, "."))
+		if (name == zone || strings.HasSuffix(name, "."+zone)) && len(zone) >= longest {
+			resolver, longest = zoneResolver, len(zone)
+		}
+	}
+	if resolver == nil {
+		resolver = r.Default
+	}
+	if resolver == nil {
+		return exchangeUDPOrTCP(ctx, msg, nameserver)
+	}
+	return resolver.Exchange(ctx, msg, nameserver)
+}
+
+// withConfig returns ctx with cfg, so that code that doesn't have the
+// config, like solvers, can use its settings and emit its events.
+func withConfig(ctx context.Context, cfg *Config) context.Context {
+	if cfg == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyConfig, cfg)
+}
+
+// dnsResolverFor returns the DNS resolver of the config of the operation
+// ctx belongs to, if it has one.
+func dnsResolverFor(ctx context.Context) DNSResolver {
+	if cfg, ok := ctx.Value(ctxKeyConfig).(*Config); ok && cfg != nil {
+		return cfg.Resolver
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ DNSResolver = Nameserver("")
+	_ DNSResolver = DoHResolver{}
+	_ DNSResolver = DoTResolver{}
+	_ DNSResolver = SplitDNSResolver{}
+)
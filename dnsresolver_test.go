@@ -0,0 +1,132 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// caaResolver answers CAA queries for example.com with an issue
+// record for value, and records the queried names.
+type caaResolver struct {
+	value   string
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *caaResolver) Exchange(_ context.Context, msg *dns.Msg, _ string) (*dns.Msg, error) {
+	r.mu.Lock()
+	r.queries = append(r.queries, msg.Question[0].Name)
+	r.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(msg)
+	if q := msg.Question[0]; q.Qtype == dns.TypeCAA && q.Name == "example.com." {
+		m.Answer = append(m.Answer, &dns.CAA{
+			Hdr:   dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 300},
+			Tag:   "issue",
+			Value: r.value,
+		})
+	}
+	return m, nil
+}
+
+func TestConfigResolver(t *testing.T) {
+	resolver := &caaResolver{value: "allowed.example"}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		CAAPreflight: &CAAPreflight{},
+		Resolver:     resolver,
+		Logger:       defaultTestLogger,
+	})
+
+	forbidden := &caaTestIssuer{key: "forbidden", identities: []string{"forbidden.example"}}
+	var caaErr CAAError
+	if err := cfg.checkCAA(context.Background(), forbidden, []string{"www.example.com"}); !errors.As(err, &caaErr) {
+		t.Fatalf("Expected CAA records from config's resolver to forbid issuance, got %v", err)
+	}
+	if len(resolver.queries) == 0 || resolver.queries[0] != "www.example.com." {
+		t.Errorf("Expected queries to be sent with config's resolver, got %v", resolver.queries)
+	}
+}
+
+func TestSplitDNSResolver(t *testing.T) {
+	internal := &caaResolver{}
+	corp := &caaResolver{}
+	public := &caaResolver{}
+	split := SplitDNSResolver{
+		Zones: map[string]DNSResolver{
+			"example.com":          corp,
+			"internal.example.com": internal,
+		},
+		Default: public,
+	}
+	for _, name := range []string{"a.internal.example.com.", "internal.example.com.", "www.example.com.", "example.net."} {
+		if _, err := split.Exchange(context.Background(), new(dns.Msg).SetQuestion(name, dns.TypeA), "192.0.2.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(internal.queries) != 2 || len(corp.queries) != 1 || len(public.queries) != 1 {
+		t.Errorf("Unexpected routing: internal=%v corp=%v public=%v", internal.queries, corp.queries, public.queries)
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := new(dns.Msg)
+		if r.Header.Get("Content-Type") != "application/dns-message" || query.Unpack(body) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(query)
+		if query.RecursionDesired {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{"token"},
+			})
+		}
+		packed, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	// authoritative queries are sent with recursion desired, too
+	query := createDNSMsg("_acme-challenge.example.com.", dns.TypeTXT, false)
+	in, err := DoHResolver{URL: server.URL}.Exchange(context.Background(), query, "ns1.example.com.:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := dnsAnswerHasValue(in, dns.TypeTXT, "token")
+	if err != nil || !found {
+		t.Errorf("Expected TXT record in response, got %v (%v)", in, err)
+	}
+	if in.Id != query.Id {
+		t.Errorf("Expected response ID to match query ID")
+	}
+}
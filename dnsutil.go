@@ -160,6 +160,13 @@ func createDNSMsg(fqdn string, rtype uint16, recursive bool) *dns.Msg {
 }
 
 func sendDNSQuery(ctx context.Context, m *dns.Msg, ns string) (*dns.Msg, error) {
+	if resolver := dnsResolverFor(ctx); resolver != nil {
+		return resolver.Exchange(ctx, m, ns)
+	}
+	return exchangeUDPOrTCP(ctx, m, ns)
+}
+
+func exchangeUDPOrTCP(ctx context.Context, m *dns.Msg, ns string) (*dns.Msg, error) {
 	udp := &dns.Client{Net: "udp", Timeout: dnsTimeout}
 	in, _, err := udp.ExchangeContext(ctx, m, ns)
 	// two kinds of errors we can handle by retrying with TCP:
@@ -232,6 +239,49 @@ func populateNameserverPorts(servers []string) {
 func checkDNSPropagation(ctx context.Context, logger *zap.Logger, fqdn string, recType uint16, expectedValue string, checkAuthoritativeServers bool, resolvers []string) (bool, error) {
 	logger = logger.Named("propagation")
 
+	fqdn, err := followCNAMEForCheck(ctx, fqdn, recType, resolvers)
+	if err != nil {
+		return false, err
+	}
+
+	if checkAuthoritativeServers {
+		authoritativeServers, err := lookupNameservers(ctx, logger, fqdn, resolvers)
+		if err != nil {
+			return false, fmt.Errorf("looking up authoritative nameservers: %v", err)
+		}
+		populateNameserverPorts(authoritativeServers)
+		resolvers = authoritativeServers
+	}
+	logger.Debug("checking authoritative nameservers", zap.Strings("resolvers", resolvers))
+
+	return checkAuthoritativeNss(ctx, fqdn, recType, expectedValue, resolvers)
+}
+
+// checkDNSPropagationEverywhere checks which of the authoritative
+// nameservers of the zone of fqdn serve the expected record, by
+// querying all of them directly. The resolvers are only used to find
+// the nameservers.
+func checkDNSPropagationEverywhere(ctx context.Context, logger *zap.Logger, fqdn string, recType uint16, expectedValue string, resolvers []string) (propagated, pending []string, lastErr error) {
+	logger = logger.Named("propagation")
+
+	fqdn, err := followCNAMEForCheck(ctx, fqdn, recType, resolvers)
+	if err != nil {
+		return nil, nil, err
+	}
+	authoritativeServers, err := lookupNameservers(ctx, logger, fqdn, resolvers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("looking up authoritative nameservers: %v", err)
+	}
+	populateNameserverPorts(authoritativeServers)
+	logger.Debug("checking all authoritative nameservers", zap.Strings("nameservers", authoritativeServers))
+
+	return checkAllAuthoritativeNss(ctx, fqdn, recType, expectedValue, authoritativeServers)
+}
+
+// followCNAMEForCheck returns the name to check for a record of fqdn:
+// the target of its CNAME, if it has one, unless the record to check
+// is the CNAME itself.
+func followCNAMEForCheck(ctx context.Context, fqdn string, recType uint16, resolvers []string) (string, error) {
 	if !strings.HasSuffix(fqdn, ".") {
 		fqdn += "."
 	}
@@ -242,24 +292,13 @@ func checkDNSPropagation(ctx context.Context, logger *zap.Logger, fqdn string, r
 	if recType != dns.TypeCNAME {
 		r, err := dnsQuery(ctx, fqdn, recType, resolvers, true)
 		if err != nil {
-			return false, fmt.Errorf("CNAME dns query: %v", err)
+			return "", fmt.Errorf("CNAME dns query: %v", err)
 		}
 		if r.Rcode == dns.RcodeSuccess {
 			fqdn = updateDomainWithCName(r, fqdn)
 		}
 	}
-
-	if checkAuthoritativeServers {
-		authoritativeServers, err := lookupNameservers(ctx, logger, fqdn, resolvers)
-		if err != nil {
-			return false, fmt.Errorf("looking up authoritative nameservers: %v", err)
-		}
-		populateNameserverPorts(authoritativeServers)
-		resolvers = authoritativeServers
-	}
-	logger.Debug("checking authoritative nameservers", zap.Strings("resolvers", resolvers))
-
-	return checkAuthoritativeNss(ctx, fqdn, recType, expectedValue, resolvers)
+	return fqdn, nil
 }
 
 // checkAuthoritativeNss queries each of the given nameservers for the expected record.
@@ -280,28 +319,70 @@ func checkAuthoritativeNss(ctx context.Context, fqdn string, recType uint16, exp
 			return false, fmt.Errorf("NS %s returned %s for %s", ns, dns.RcodeToString[r.Rcode], fqdn)
 		}
 
-		for _, rr := range r.Answer {
-			switch recType {
-			case dns.TypeTXT:
-				if txt, ok := rr.(*dns.TXT); ok {
-					record := strings.Join(txt.Txt, "")
-					if record == expectedValue {
-						return true, nil
-					}
+		found, err := dnsAnswerHasValue(r, recType, expectedValue)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkAllAuthoritativeNss queries each of the given authoritative
+// nameservers directly, without recursion, and returns the ones that
+// serve the expected record and the ones that don't (yet). Nameservers
+// that can't be queried are pending, since the CA may query any of them;
+// the last such error is returned too, for context.
+func checkAllAuthoritativeNss(ctx context.Context, fqdn string, recType uint16, expectedValue string, nameservers []string) (propagated, pending []string, lastErr error) {
+	for _, ns := range nameservers {
+		r, err := dnsQuery(ctx, fqdn, recType, []string{ns}, false)
+		if err != nil {
+			pending = append(pending, ns)
+			lastErr = fmt.Errorf("querying %s: %v", ns, err)
+			continue
+		}
+		found, err := dnsAnswerHasValue(r, recType, expectedValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("NS %s returned %s for %s", ns, dns.RcodeToString[r.Rcode], fqdn)
+		}
+		if found {
+			propagated = append(propagated, ns)
+		} else {
+			pending = append(pending, ns)
+		}
+	}
+	return propagated, pending, lastErr
+}
+
+// dnsAnswerHasValue returns whether the answer of r has a record of
+// type recType with the expected value.
+func dnsAnswerHasValue(r *dns.Msg, recType uint16, expectedValue string) (bool, error) {
+	for _, rr := range r.Answer {
+		switch recType {
+		case dns.TypeTXT:
+			if txt, ok := rr.(*dns.TXT); ok {
+				record := strings.Join(txt.Txt, "")
+				if record == expectedValue {
+					return true, nil
 				}
-			case dns.TypeCNAME:
-				if cname, ok := rr.(*dns.CNAME); ok {
-					// TODO: whether a DNS provider assumes a trailing dot or not varies, and we may have to standardize this in libdns packages
-					if strings.TrimSuffix(cname.Target, ".") == strings.TrimSuffix(expectedValue, ".") {
-						return true, nil
-					}
+			}
+		case dns.TypeCNAME:
+			if cname, ok := rr.(*dns.CNAME); ok {
+				// TODO: whether a DNS provider assumes a trailing dot or not varies, and we may have to standardize this in libdns packages
+				if strings.TrimSuffix(cname.Target, ".") == strings.TrimSuffix(expectedValue, ".") {
+					return true, nil
 				}
-			default:
-				return false, fmt.Errorf("unsupported record type: %d", recType)
 			}
+		default:
+			return false, fmt.Errorf("unsupported record type: %d", recType)
 		}
 	}
-
 	return false, nil
 }
 
@@ -15,6 +15,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
@@ -259,6 +260,58 @@ func TestRecursiveNameserversDefaults(t *testing.T) {
 	}
 }
 
+func TestCheckAllAuthoritativeNss(t *testing.T) {
+	const fqdn = "_acme-challenge.example.com."
+	synced := startTestNameserver(t, map[string]string{fqdn: "token"})
+	lagging := startTestNameserver(t, nil)
+
+	propagated, pending, err := checkAllAuthoritativeNss(context.Background(), fqdn, dns.TypeTXT, "token", []string{synced, lagging})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(propagated, []string{synced}) || !reflect.DeepEqual(pending, []string{lagging}) {
+		t.Errorf("Expected %s to have the record and %s not, got propagated=%v pending=%v", synced, lagging, propagated, pending)
+	}
+
+	// nameservers that can't be queried are pending too
+	unreachable := "127.0.0.1:1"
+	propagated, pending, err = checkAllAuthoritativeNss(context.Background(), fqdn, dns.TypeTXT, "token", []string{synced, unreachable})
+	if err == nil {
+		t.Error("Expected error for unreachable nameserver")
+	}
+	if !reflect.DeepEqual(propagated, []string{synced}) || !reflect.DeepEqual(pending, []string{unreachable}) {
+		t.Errorf("Expected %s to be pending, got propagated=%v pending=%v", unreachable, propagated, pending)
+	}
+}
+
+// startTestNameserver starts an authoritative nameserver on a local
+// port that serves the given TXT records, and returns its address.
+func startTestNameserver(t *testing.T, txt map[string]string) string {
+	t.Helper()
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		q := r.Question[0]
+		if value, ok := txt[q.Name]; ok && q.Qtype == dns.TypeTXT && !r.RecursionDesired {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		}
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
 func clearFqdnCache() {
 	fqdnSOACacheMu.Lock()
 	fqdnSOACache = make(map[string]*soaCacheEntry)
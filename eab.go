@@ -0,0 +1,104 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// ExternalAccountCredential is an External Account Binding (EAB)
+// credential and the ACME account it is used for. CAs like ZeroSSL
+// and Google Trust Services tie entitlements to EAB credentials, so
+// certificates for different tenants may need different ones.
+//
+// EXPERIMENTAL: Subject to change.
+type ExternalAccountCredential struct {
+	// The name of the ACME account to use, e.g. the
+	// name of a tenant. Each named account is stored
+	// separately and registered once, with the EAB
+	// credential that is current at that time; since
+	// the account is looked up by name and not by the
+	// credential, the credential can be rotated without
+	// registering a new account. If empty, the default
+	// account of the issuer is used.
+	Account string
+
+	// The EAB credential to register the account with.
+	EAB *acme.EAB
+}
+
+// RotateExternalAccount replaces the External Account Binding of am
+// in a way that is safe while am is in use. Like ExternalAccount, the
+// new binding is used only when a new ACME account is registered; the
+// existing account keeps being used, since an EAB credential is bound
+// to an account only at registration (and CAs generally keep
+// accounts valid after the credential they were bound with is
+// retired).
+//
+// EXPERIMENTAL: Subject to change.
+func (am *ACMEIssuer) RotateExternalAccount(eab *acme.EAB) {
+	am.mu.Lock()
+	am.ExternalAccount = eab
+	am.mu.Unlock()
+}
+
+func (am *ACMEIssuer) externalAccount() *acme.EAB {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	return am.ExternalAccount
+}
+
+// forExternalAccount returns the issuer to get certificates for names
+// with, which is am using the external account that ExternalAccountFunc
+// selects for names, if any.
+func (am *ACMEIssuer) forExternalAccount(ctx context.Context, names []string) (*ACMEIssuer, error) {
+	if am.ExternalAccountFunc == nil {
+		return am, nil
+	}
+	cred, err := am.ExternalAccountFunc(ctx, names)
+	if err != nil {
+		return nil, fmt.Errorf("selecting external account for %v: %w", names, err)
+	}
+	if cred.Account == "" && cred.EAB == nil {
+		return am, nil
+	}
+
+	// the copy shares the mutex (and thus the synchronized state)
+	// of am, which is all right, since it is only used for this
+	// operation, and the account is the same unless it is named
+	iss := *am
+	iss.ExternalAccountFunc = nil
+	if cred.EAB != nil {
+		iss.ExternalAccount = cred.EAB
+	} else {
+		iss.ExternalAccount = am.externalAccount()
+	}
+	if cred.Account != "" {
+		// the configured account key is for the default account
+		iss.AccountKeyPEM = ""
+		iss.externalAccountName = cred.Account
+	}
+	return &iss, nil
+}
+
+// storageKeyExternalAccountPrefix returns the prefix of the storage
+// keys for the users of the named external account.
+func (am *ACMEIssuer) storageKeyExternalAccountPrefix(caURL string) string {
+	return path.Join(am.storageKeyCAPrefix(caURL), "external_accounts", StorageKeys.Safe(am.externalAccountName))
+}
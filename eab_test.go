@@ -0,0 +1,102 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+func TestExternalAccountFunc(t *testing.T) {
+	ctx := context.Background()
+
+	defaultEAB := &acme.EAB{KeyID: "default", MACKey: "AAAA"}
+	tenantEAB := &acme.EAB{KeyID: "tenant-a-1", MACKey: "BBBB"}
+	am := &ACMEIssuer{
+		CA:              dummyCA,
+		AccountKeyPEM:   "configured",
+		ExternalAccount: defaultEAB,
+		ExternalAccountFunc: func(_ context.Context, names []string) (ExternalAccountCredential, error) {
+			if strings.HasSuffix(names[0], ".tenant-a.example") {
+				return ExternalAccountCredential{Account: "Tenant A", EAB: tenantEAB}, nil
+			}
+			return ExternalAccountCredential{}, nil
+		},
+		Logger: zap.NewNop(),
+		mu:     new(sync.Mutex),
+	}
+	am.config = &Config{Storage: &memoryStorage{}, Logger: defaultTestLogger}
+
+	iss, err := am.forExternalAccount(ctx, []string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iss != am {
+		t.Error("Expected the default account to use the issuer itself")
+	}
+
+	iss, err = am.forExternalAccount(ctx, []string{"www.tenant-a.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iss.externalAccount() != tenantEAB {
+		t.Errorf("Expected the EAB of the tenant, got %v", iss.externalAccount())
+	}
+	if iss.AccountKeyPEM != "" {
+		t.Error("Expected the configured account key not to be used for a named account")
+	}
+	email := "me@foobar.com"
+	if iss.storageKeyUserReg(am.CA, email) == am.storageKeyUserReg(am.CA, email) {
+		t.Errorf("Expected the named account to be stored separately, but both are at %s", am.storageKeyUserReg(am.CA, email))
+	}
+
+	// the named account must be found again after the credential is rotated
+	account, err := iss.newAccount(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iss.saveAccount(ctx, am.CA, account); err != nil {
+		t.Fatal(err)
+	}
+	tenantEAB = &acme.EAB{KeyID: "tenant-a-2", MACKey: "CCCC"}
+	rotated, err := am.forExternalAccount(ctx, []string{"www.tenant-a.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.externalAccount().KeyID != "tenant-a-2" {
+		t.Errorf("Expected the rotated credential, got %v", rotated.externalAccount())
+	}
+	loaded, err := rotated.loadAccount(ctx, am.CA, email)
+	if err != nil {
+		t.Fatalf("Expected the account to survive the rotation: %v", err)
+	}
+	if !loaded.PrivateKey.(*ecdsa.PrivateKey).Equal(account.PrivateKey) {
+		t.Error("Expected the same account after the rotation")
+	}
+	if _, err := am.loadAccount(ctx, am.CA, email); err == nil {
+		t.Error("Expected the named account not to be the default account")
+	}
+
+	am.RotateExternalAccount(&acme.EAB{KeyID: "default-2"})
+	if am.externalAccount().KeyID != "default-2" {
+		t.Errorf("Expected the rotated default credential, got %v", am.externalAccount())
+	}
+}
@@ -0,0 +1,521 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ECHKeys generates, rotates, and distributes the keys for Encrypted
+// Client Hello (ECH) through storage, and publishes the resulting
+// ECHConfigList so that clients can find it. Servers sharing storage
+// share the keys, so any of them can decrypt a ClientHello that was
+// encrypted for one of them.
+//
+// With ECH, clients send the real (inner) server name encrypted, and
+// only PublicName in the clear. When the server can decrypt it, the
+// handshake continues with the inner ClientHello, so certificates are
+// selected by the inner server name as usual. When it can't, e.g.
+// because the client used an outdated config, the handshake continues
+// with the outer ClientHello: the server presents a certificate for
+// PublicName, with which the client verifies the current configs that
+// are sent to retry with. So, a certificate for PublicName must be
+// available: either manage it, or set the Config's ECH field, which
+// allows obtaining it on demand without asking the DecisionFunc.
+//
+// Keys are rotated like SessionTicketKeys: the next key is distributed
+// to all servers one rotation before it is published, and retired keys
+// are accepted for a while longer, so that clients that cached the
+// published configs can keep using them. The TTL of published records
+// should be shorter than RotationInterval.
+//
+// The keys are stored unencrypted; if the storage is not trusted with
+// them, wrap it with EncryptedStorage.
+//
+// EXPERIMENTAL: Subject to change.
+type ECHKeys struct {
+	// The storage to share keys through. REQUIRED.
+	Storage Storage
+
+	// The name sent in the clear in the outer ClientHello,
+	// for which a certificate must be available. REQUIRED.
+	PublicName string
+
+	// Publishes the current configs after rotations.
+	Publisher ECHPublisher
+
+	// How often to rotate the keys. Default: 7 days.
+	RotationInterval time.Duration
+
+	// How many retired keys to keep accepting after
+	// a rotation. Default: 1.
+	RetiredKeys int
+
+	// How often to check storage for keys rotated
+	// by other servers; must be shorter than
+	// RotationInterval. Default: 1h.
+	CheckInterval time.Duration
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu         sync.RWMutex
+	keys       []tls.EncryptedClientHelloKey
+	configList []byte
+}
+
+// Start loads or creates the keys, publishes them if needed, and keeps
+// them up to date in the background until ctx is canceled.
+func (ek *ECHKeys) Start(ctx context.Context) error {
+	if ek.Storage == nil {
+		return fmt.Errorf("ECH keys: no storage")
+	}
+	if ek.PublicName == "" {
+		return fmt.Errorf("ECH keys: no public name")
+	}
+	if ek.Logger == nil {
+		ek.Logger = zap.NewNop()
+	}
+	if err := ek.sync(ctx); err != nil {
+		return err
+	}
+	go ek.maintain(ctx)
+	return nil
+}
+
+// ConfigList returns the current ECHConfigList, which is what gets
+// published, or nil if the keys haven't been loaded yet.
+func (ek *ECHKeys) ConfigList() []byte {
+	ek.mu.RLock()
+	defer ek.mu.RUnlock()
+	return ek.configList
+}
+
+// isPublicName returns true if name is the public name of ek.
+func (ek *ECHKeys) isPublicName(name string) bool {
+	return ek != nil && name != "" && normalizedName(ek.PublicName) == name
+}
+
+func (ek *ECHKeys) maintain(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			ek.Logger.Error("panic: ECH key maintenance", zap.Any("error", err))
+		}
+	}()
+
+	ticker := time.NewTicker(ek.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ek.sync(ctx); err != nil {
+				ek.Logger.Error("updating ECH keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// sync loads the keys from storage, rotating them if they are due and
+// publishing them if they weren't yet, and applies them if they changed.
+func (ek *ECHKeys) sync(ctx context.Context) error {
+	stored, err := ek.load(ctx)
+	if err != nil || stored.due(ek.rotationInterval()) || (ek.Publisher != nil && stored.Published.IsZero()) {
+		if errors.Is(err, fs.ErrNotExist) {
+			ek.Logger.Info("creating ECH keys", zap.String("public_name", ek.PublicName))
+		} else if err != nil {
+			ek.Logger.Error("replacing unusable ECH keys", zap.Error(err))
+		}
+		stored, err = ek.rotate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// accept all keys, but only send the current one to retry with
+	keys := make([]tls.EncryptedClientHelloKey, len(stored.Keys))
+	for i, key := range stored.Keys {
+		keys[i] = tls.EncryptedClientHelloKey{
+			Config:      key.Config,
+			PrivateKey:  key.PrivateKey,
+			SendAsRetry: i == 1,
+		}
+	}
+	configList, err := stored.configList()
+	if err != nil {
+		return err
+	}
+
+	ek.mu.Lock()
+	defer ek.mu.Unlock()
+	ek.keys = keys
+	ek.configList = configList
+	return nil
+}
+
+// rotate rotates the keys in storage if they are due, unless another
+// server already did while we waited for the lock, and publishes them
+// if they haven't been yet. It returns the updated keys.
+func (ek *ECHKeys) rotate(ctx context.Context) (storedECHKeys, error) {
+	lockKey := ek.lockKey()
+	if err := acquireLock(ctx, ek.Storage, lockKey); err != nil {
+		return storedECHKeys{}, fmt.Errorf("unable to acquire lock: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, ek.Storage, lockKey); err != nil {
+			ek.Logger.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	stored, err := ek.load(ctx)
+	if err != nil {
+		// start over; clients with the old configs will be
+		// told to retry with the new ones
+		stored = storedECHKeys{}
+	}
+
+	changed := false
+	if err != nil || stored.due(ek.rotationInterval()) {
+		// a fresh set needs both a next and a current key
+		for len(stored.Keys) < 2 {
+			if err := stored.addKey(ek.PublicName); err != nil {
+				return storedECHKeys{}, err
+			}
+		}
+		if !stored.Rotated.IsZero() {
+			if err := stored.addKey(ek.PublicName); err != nil {
+				return storedECHKeys{}, err
+			}
+		}
+		stored.Keys = stored.Keys[:min(len(stored.Keys), 2+ek.retiredKeys())]
+		stored.Rotated = time.Now().UTC()
+		stored.Published = time.Time{}
+		changed = true
+		ek.Logger.Info("rotated ECH keys", zap.Int("keys", len(stored.Keys)))
+	}
+
+	if ek.Publisher != nil && stored.Published.IsZero() {
+		configList, err := stored.configList()
+		if err != nil {
+			return storedECHKeys{}, err
+		}
+		if err := ek.Publisher.PublishECHConfigList(ctx, configList); err != nil {
+			// we'll try again next time
+			ek.Logger.Error("publishing ECH configs", zap.Error(err))
+		} else {
+			stored.Published = time.Now().UTC()
+			changed = true
+			ek.Logger.Info("published ECH configs", zap.String("public_name", ek.PublicName))
+		}
+	}
+
+	if !changed {
+		return stored, nil
+	}
+	storedJSON, err := json.Marshal(stored)
+	if err != nil {
+		return storedECHKeys{}, err
+	}
+	if err := ek.Storage.Store(ctx, ek.storageKey(), storedJSON); err != nil {
+		return storedECHKeys{}, fmt.Errorf("storing ECH keys: %v", err)
+	}
+
+	return stored, nil
+}
+
+func (ek *ECHKeys) load(ctx context.Context) (storedECHKeys, error) {
+	storedJSON, err := ek.Storage.Load(ctx, ek.storageKey())
+	if err != nil {
+		return storedECHKeys{}, err
+	}
+	var stored storedECHKeys
+	if err := json.Unmarshal(storedJSON, &stored); err != nil {
+		return storedECHKeys{}, fmt.Errorf("decoding ECH keys: %v", err)
+	}
+	if len(stored.Keys) < 2 {
+		return storedECHKeys{}, fmt.Errorf("expected at least 2 ECH keys, found %d", len(stored.Keys))
+	}
+	for _, key := range stored.Keys {
+		if len(key.Config) < 5 {
+			return storedECHKeys{}, fmt.Errorf("malformed ECH config")
+		}
+	}
+	return stored, nil
+}
+
+func (ek *ECHKeys) storageKey() string {
+	return StorageKeys.Safe("ech") + "/" + StorageKeys.Safe(ek.PublicName) + ".json"
+}
+
+func (ek *ECHKeys) lockKey() string {
+	return "ech_keys_" + StorageKeys.Safe(ek.PublicName)
+}
+
+func (ek *ECHKeys) rotationInterval() time.Duration {
+	if ek.RotationInterval > 0 {
+		return ek.RotationInterval
+	}
+	return 7 * 24 * time.Hour
+}
+
+func (ek *ECHKeys) checkInterval() time.Duration {
+	if ek.CheckInterval > 0 {
+		return ek.CheckInterval
+	}
+	return time.Hour
+}
+
+func (ek *ECHKeys) retiredKeys() int {
+	if ek.RetiredKeys > 0 {
+		return ek.RetiredKeys
+	}
+	return 1
+}
+
+// storedECHKeys is how ECH keys are kept in storage.
+type storedECHKeys struct {
+	// The next key, then the current key, then retired keys.
+	Keys []storedECHKey `json:"keys"`
+
+	// When the keys were last rotated.
+	Rotated time.Time `json:"rotated"`
+
+	// When the current key was published;
+	// zero if it wasn't yet.
+	Published time.Time `json:"published,omitempty"`
+}
+
+type storedECHKey struct {
+	// The serialized ECHConfig.
+	Config []byte `json:"config"`
+
+	// The X25519 private key.
+	PrivateKey []byte `json:"private_key"`
+}
+
+func (s storedECHKeys) due(interval time.Duration) bool {
+	return time.Since(s.Rotated) >= interval
+}
+
+// addKey generates a new key for publicName and adds it
+// as the next key, with a config ID that isn't in use.
+func (s *storedECHKeys) addKey(publicName string) error {
+	var configID uint8
+	for {
+		var b [1]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(s.Keys, func(k storedECHKey) bool { return k.Config[4] == b[0] }) {
+			configID = b[0]
+			break
+		}
+	}
+	key, err := newECHKey(configID, publicName)
+	if err != nil {
+		return err
+	}
+	s.Keys = append([]storedECHKey{key}, s.Keys...)
+	return nil
+}
+
+// configList returns the ECHConfigList to publish,
+// which contains the config of the current key.
+func (s storedECHKeys) configList() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.Keys[1].Config)
+	})
+	return b.Bytes()
+}
+
+// newECHKey generates a key and its ECHConfig (draft-ietf-tls-esni,
+// section 4) with the X25519 KEM, the HKDF-SHA256 KDF, and the
+// AES-128-GCM and ChaCha20Poly1305 AEADs.
+func newECHKey(configID uint8, publicName string) (storedECHKey, error) {
+	if publicName == "" || len(publicName) > 255 {
+		return storedECHKey{}, fmt.Errorf("invalid ECH public name: %q", publicName)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return storedECHKey{}, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16(echVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID)
+		b.AddUint16(echKEMX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(priv.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []uint16{echAEADAES128GCM, echAEADChaCha20Poly1305} {
+				b.AddUint16(echKDFHKDFSHA256)
+				b.AddUint16(aead)
+			}
+		})
+		b.AddUint8(0) // maximum_name_length; 0 lets clients pad as they see fit
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(strings.TrimSuffix(publicName, ".")))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return storedECHKey{}, err
+	}
+
+	return storedECHKey{Config: config, PrivateKey: priv.Bytes()}, nil
+}
+
+// ECHPublisher publishes ECH configs so that clients can find them.
+//
+// EXPERIMENTAL: Subject to change.
+type ECHPublisher interface {
+	// PublishECHConfigList replaces any previously
+	// published configs with configList, which is
+	// a serialized ECHConfigList.
+	PublishECHConfigList(ctx context.Context, configList []byte) error
+}
+
+// LibDNSECHPublisher publishes ECH configs in the "ech" parameter of
+// HTTPS records (RFC 9460) with a libdns provider. Existing HTTPS
+// records of the domains that have an "ech" parameter are replaced;
+// other HTTPS records are left alone.
+//
+// EXPERIMENTAL: Subject to change.
+type LibDNSECHPublisher struct {
+	// The DNS provider. REQUIRED.
+	Provider interface {
+		libdns.RecordGetter
+		libdns.RecordAppender
+		libdns.RecordDeleter
+	}
+
+	// The domains to publish the configs for, i.e. the
+	// inner server names that clients connect to. REQUIRED.
+	Domains []string
+
+	// Other parameters of the records, in presentation
+	// format, e.g. `alpn="h2,h3"`.
+	Params string
+
+	// The TTL of the records.
+	TTL time.Duration
+
+	// The zone of the records; if empty, it is looked up
+	// with the given resolvers or the system resolvers.
+	Zone      string
+	Resolvers []string
+
+	Logger *zap.Logger
+}
+
+// PublishECHConfigList implements ECHPublisher.
+func (p LibDNSECHPublisher) PublishECHConfigList(ctx context.Context, configList []byte) error {
+	logger := p.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+	value := "ech=" + base64.StdEncoding.EncodeToString(configList)
+	if p.Params != "" {
+		value = p.Params + " " + value
+	}
+
+	for _, domain := range p.Domains {
+		domain = strings.TrimSuffix(domain, ".")
+		zone := p.Zone
+		if zone == "" {
+			var err error
+			zone, err = FindZoneByFQDN(ctx, logger, domain+".", RecursiveNameservers(p.Resolvers))
+			if err != nil {
+				return fmt.Errorf("could not determine zone for %q: %v", domain, err)
+			}
+		}
+		name := libdns.RelativeName(domain+".", zone)
+
+		existing, err := p.Provider.GetRecords(ctx, zone)
+		if err != nil {
+			return fmt.Errorf("getting records: %v", err)
+		}
+
+		// add the new record before deleting the old ones,
+		// so that there is never no record for the domain
+		var have bool
+		var stale []libdns.Record
+		for _, rec := range existing {
+			if rec.Type != "HTTPS" || rec.Name != name || !hasECHParam(rec.Value) {
+				continue
+			}
+			if rec.Value == value && !have {
+				have = true
+			} else {
+				stale = append(stale, rec)
+			}
+		}
+		if !have {
+			rec := libdns.Record{Type: "HTTPS", Name: name, Value: value, TTL: p.TTL, Priority: 1, Target: "."}
+			if _, err := p.Provider.AppendRecords(ctx, zone, []libdns.Record{rec}); err != nil {
+				return fmt.Errorf("adding HTTPS record for %s: %v", domain, err)
+			}
+		}
+		if len(stale) > 0 {
+			if _, err := p.Provider.DeleteRecords(ctx, zone, stale); err != nil {
+				return fmt.Errorf("deleting HTTPS records for %s: %v", domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hasECHParam returns true if the HTTPS record value has an "ech" parameter.
+func hasECHParam(value string) bool {
+	for _, field := range strings.Fields(value) {
+		if strings.HasPrefix(field, "ech=") {
+			return true
+		}
+	}
+	return false
+}
+
+// ECH constants (draft-ietf-tls-esni and RFC 9180).
+const (
+	echVersion              = 0xfe0d
+	echKEMX25519            = 0x0020
+	echKDFHKDFSHA256        = 0x0001
+	echAEADAES128GCM        = 0x0001
+	echAEADChaCha20Poly1305 = 0x0003
+)
+
+// Interface guard
+var _ ECHPublisher = LibDNSECHPublisher{}
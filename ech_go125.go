@@ -0,0 +1,35 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package certmagic
+
+import "crypto/tls"
+
+// Register makes cfg decrypt ClientHellos with the shared ECH keys. It
+// can be called before or after Start, but not while cfg is in use.
+func (ek *ECHKeys) Register(cfg *tls.Config) {
+	cfg.GetEncryptedClientHelloKeys = ek.getKeys
+}
+
+func (ek *ECHKeys) getKeys(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+	ek.mu.RLock()
+	defer ek.mu.RUnlock()
+	if ek.keys == nil {
+		// no keys yet, so reject ECH instead of failing the handshake
+		return []tls.EncryptedClientHelloKey{}, nil
+	}
+	return ek.keys, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestECHKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	storage := &FileStorage{Path: tmpDir}
+
+	certPEM, keyPEM := mustGenerateTestCert(t, []string{"inner.example.com", "public.example.com"}, time.Now().Add(time.Hour))
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serverNames []string
+	server := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverNames = append(serverNames, hello.ServerName)
+			return &tlsCert, nil
+		},
+	}
+	publisher := new(recordingECHPublisher)
+	ek := &ECHKeys{Storage: storage, PublicName: "public.example.com", Publisher: publisher}
+	ek.Register(server)
+	if err := ek.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.published) != 1 || !bytes.Equal(publisher.published[0], ek.ConfigList()) {
+		t.Fatalf("Expected the config list to be published once, got %d publications", len(publisher.published))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &tls.Config{
+		ServerName:                     "inner.example.com",
+		RootCAs:                        roots,
+		EncryptedClientHelloConfigList: ek.ConfigList(),
+	}
+	if err := testECHHandshake(t, client, server); err != nil {
+		t.Fatalf("Handshake with ECH: %v", err)
+	}
+	if len(serverNames) != 1 || serverNames[0] != "inner.example.com" {
+		t.Errorf("Expected certificate to be selected for the inner server name, got %v", serverNames)
+	}
+
+	// after a rotation, the previous config is still accepted,
+	// and the new one is published
+	before := ek.ConfigList()
+	stored, err := ek.load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Rotated = time.Now().Add(-8 * 24 * time.Hour)
+	storedJSON, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(ctx, ek.storageKey(), storedJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := ek.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, ek.ConfigList()) {
+		t.Fatal("Expected config list to change after rotation")
+	}
+	if len(publisher.published) != 2 || !bytes.Equal(publisher.published[1], ek.ConfigList()) {
+		t.Errorf("Expected the rotated config list to be published, got %d publications", len(publisher.published))
+	}
+	if err := testECHHandshake(t, client, server); err != nil {
+		t.Errorf("Handshake with previous config after rotation: %v", err)
+	}
+
+	// a config the server doesn't know is rejected with the
+	// current configs, authenticated with the public name
+	unknown, err := newECHKey(1, "public.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EncryptedClientHelloConfigList = storedECHKeys{Keys: []storedECHKey{unknown, unknown}}.mustConfigList(t)
+	serverNames = nil
+	err = testECHHandshake(t, client, server)
+	var rejection *tls.ECHRejectionError
+	if !errors.As(err, &rejection) {
+		t.Fatalf("Expected ECH rejection, got: %v", err)
+	}
+	if !bytes.Equal(rejection.RetryConfigList, ek.ConfigList()) {
+		t.Error("Expected current config list to be sent to retry with")
+	}
+	if len(serverNames) != 1 || serverNames[0] != "public.example.com" {
+		t.Errorf("Expected certificate to be selected for the public name, got %v", serverNames)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !go1.25
+
+package certmagic
+
+import (
+	"crypto/tls"
+
+	"go.uber.org/zap"
+)
+
+// Register would make cfg decrypt ClientHellos with the shared ECH keys,
+// but tls.Config can only get rotating keys since Go 1.25, so with older
+// toolchains it leaves cfg unchanged (ECH is rejected) and logs an error.
+func (ek *ECHKeys) Register(*tls.Config) {
+	logger := ek.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+	logger.Error("ECH requires Go 1.25 or newer; not decrypting ClientHellos",
+		zap.String("public_name", ek.PublicName))
+}
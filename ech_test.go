@@ -0,0 +1,92 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+type recordingECHPublisher struct {
+	published [][]byte
+}
+
+func (p *recordingECHPublisher) PublishECHConfigList(_ context.Context, configList []byte) error {
+	p.published = append(p.published, configList)
+	return nil
+}
+
+func TestECHPublicNameAllowedOnDemand(t *testing.T) {
+	cfg := &Config{
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(context.Context, string) error { return errors.New("denied") },
+		},
+		ECH: &ECHKeys{PublicName: "Public.Example.com"},
+	}
+	if err := cfg.checkIfCertShouldBeObtained(context.Background(), "public.example.com", true); err != nil {
+		t.Errorf("Expected ECH public name to be allowed, got: %v", err)
+	}
+	if err := cfg.checkIfCertShouldBeObtained(context.Background(), "other.example.com", true); err == nil {
+		t.Error("Expected other names to be subject to the decision func")
+	}
+}
+
+func TestHasECHParam(t *testing.T) {
+	for i, tc := range []struct {
+		value  string
+		expect bool
+	}{
+		{value: `ech=AEX+DQ==`, expect: true},
+		{value: `alpn="h2,h3" ech=AEX+DQ==`, expect: true},
+		{value: `alpn="h2,h3"`, expect: false},
+		{value: ``, expect: false},
+	} {
+		if actual := hasECHParam(tc.value); actual != tc.expect {
+			t.Errorf("Test %d (%q): expected %t, got %t", i, tc.value, tc.expect, actual)
+		}
+	}
+}
+
+func (s storedECHKeys) mustConfigList(t *testing.T) []byte {
+	t.Helper()
+	configList, err := s.configList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configList
+}
+
+// testECHHandshake makes a connection from client to server,
+// returning an error if the handshake fails or ECH wasn't accepted.
+func testECHHandshake(t *testing.T, client, server *tls.Config) error {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		_ = tls.Server(serverConn, server).Handshake()
+	}()
+	conn := tls.Client(clientConn, client)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if !conn.ConnectionState().ECHAccepted {
+		return errors.New("ECH not accepted")
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// EncryptedStorage encrypts all values before storing them in the
+// underlying Storage, and decrypts them when loading. It uses envelope
+// encryption: each value is encrypted with its own random data key,
+// and the data key is encrypted ("wrapped") with a key-encryption key
+// (KEK) obtained from the KEK callback.
+//
+// The KEK callback is given the tenant on whose behalf the operation is
+// being performed (see TenantStorage and StorageTenant), so that each
+// tenant of a shared storage can have its own KEK. Compromise of one
+// tenant's KEK does not expose other tenants' key material, and a tenant
+// can be crypto-shredded by destroying its KEK. For this to work, the
+// TenantStorage must wrap the EncryptedStorage, not the other way around:
+//
+//	TenantStorage{Tenant: "acme", Storage: EncryptedStorage{Storage: shared, KEK: kekFn}}
+//
+// Keys, key listings, and locks are not encrypted.
+//
+// EXPERIMENTAL: Subject to change.
+type EncryptedStorage struct {
+	// The underlying storage. REQUIRED.
+	Storage Storage
+
+	// KEK returns the key-encryption key for the given tenant
+	// (which is empty if the operation is not tenant-scoped).
+	// When encrypting, keyID is empty and the tenant's current
+	// KEK should be returned; when decrypting, keyID is the ID
+	// of the KEK that was used to encrypt the value, which
+	// allows KEKs to be rotated. REQUIRED.
+	KEK func(ctx context.Context, tenant, keyID string) (KEK, error)
+}
+
+// KEK is a key-encryption key.
+type KEK struct {
+	// An identifier for the key, which is stored with
+	// the values that were encrypted with it.
+	ID string
+
+	// The key, which must be 32 bytes (AES-256).
+	Key []byte
+}
+
+// encryptedValue is the envelope stored in the underlying storage.
+type encryptedValue struct {
+	Version    int    `json:"v"`
+	KeyID      string `json:"kid"`
+	WrappedKey []byte `json:"dek"`
+	Ciphertext []byte `json:"ct"`
+}
+
+func (es EncryptedStorage) Store(ctx context.Context, key string, value []byte) error {
+	kek, err := es.KEK(ctx, StorageTenant(ctx), "")
+	if err != nil {
+		return fmt.Errorf("getting key-encryption key: %v", err)
+	}
+
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return fmt.Errorf("generating data key: %v", err)
+	}
+	wrapped, err := sealAESGCM(kek.Key, dek, []byte(kek.ID))
+	if err != nil {
+		return fmt.Errorf("wrapping data key: %v", err)
+	}
+	ciphertext, err := sealAESGCM(dek, value, []byte(key))
+	if err != nil {
+		return fmt.Errorf("encrypting %s: %v", key, err)
+	}
+
+	envelope, err := json.Marshal(encryptedValue{
+		Version:    1,
+		KeyID:      kek.ID,
+		WrappedKey: wrapped,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return err
+	}
+	return es.Storage.Store(ctx, key, envelope)
+}
+
+func (es EncryptedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	envelopeBytes, err := es.Storage.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var envelope encryptedValue
+	if err := json.Unmarshal(envelopeBytes, &envelope); err != nil || envelope.Version != 1 {
+		return nil, fmt.Errorf("%s is not an encrypted value (stored without encryption?)", key)
+	}
+
+	kek, err := es.KEK(ctx, StorageTenant(ctx), envelope.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("getting key-encryption key %q: %v", envelope.KeyID, err)
+	}
+	dek, err := openAESGCM(kek.Key, envelope.WrappedKey, []byte(envelope.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key for %s: %v", key, err)
+	}
+	value, err := openAESGCM(dek, envelope.Ciphertext, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func (es EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return es.Storage.Delete(ctx, key)
+}
+
+func (es EncryptedStorage) Exists(ctx context.Context, key string) bool {
+	return es.Storage.Exists(ctx, key)
+}
+
+func (es EncryptedStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	return es.Storage.List(ctx, path, recursive)
+}
+
+func (es EncryptedStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	return es.Storage.Stat(ctx, key)
+}
+
+func (es EncryptedStorage) Lock(ctx context.Context, name string) error {
+	return es.Storage.Lock(ctx, name)
+}
+
+func (es EncryptedStorage) Unlock(ctx context.Context, name string) error {
+	return es.Storage.Unlock(ctx, name)
+}
+
+// sealAESGCM encrypts plaintext with key using AES-GCM, binding it
+// to additionalData. The nonce is prepended to the ciphertext.
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAESGCM reverses sealAESGCM.
+func openAESGCM(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Interface guard
+var _ Storage = EncryptedStorage{}
@@ -0,0 +1,85 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestEncryptedTenantStorage(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	shared := &FileStorage{Path: tmpDir}
+
+	keks := map[string][]byte{
+		"a": bytes.Repeat([]byte{1}, 32),
+		"b": bytes.Repeat([]byte{2}, 32),
+	}
+	encrypted := EncryptedStorage{
+		Storage: shared,
+		KEK: func(ctx context.Context, tenant, keyID string) (KEK, error) {
+			key, ok := keks[tenant]
+			if !ok {
+				return KEK{}, fmt.Errorf("no KEK for tenant %q", tenant)
+			}
+			return KEK{ID: tenant + "-v1", Key: key}, nil
+		},
+	}
+	tenantA := TenantStorage{Tenant: "a", Storage: encrypted}
+	tenantB := TenantStorage{Tenant: "b", Storage: encrypted}
+
+	secret := []byte("private key")
+	if err := tenantA.Store(ctx, "certificates/example.com.key", secret); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tenantB.Store(ctx, "certificates/example.com.key", []byte("other")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	raw, err := shared.Load(ctx, "tenants/a/certificates/example.com.key")
+	if err != nil {
+		t.Fatalf("Expected value under tenant prefix: %v", err)
+	}
+	if bytes.Contains(raw, secret) {
+		t.Error("Value was stored in plaintext")
+	}
+
+	loaded, err := tenantA.Load(ctx, "certificates/example.com.key")
+	if err != nil || !bytes.Equal(loaded, secret) {
+		t.Fatalf("Expected to load original value, got %q (err=%v)", loaded, err)
+	}
+
+	keys, err := tenantA.List(ctx, "certificates", false)
+	if err != nil || len(keys) != 1 || keys[0] != "certificates/example.com.key" {
+		t.Errorf("Expected unprefixed key listing, got %v (err=%v)", keys, err)
+	}
+
+	// crypto-shredding tenant b must not affect tenant a
+	delete(keks, "b")
+	if _, err := tenantB.Load(ctx, "certificates/example.com.key"); err == nil {
+		t.Error("Expected error loading value of shredded tenant")
+	}
+	if _, err := tenantA.Load(ctx, "certificates/example.com.key"); err != nil {
+		t.Errorf("Other tenant should be unaffected, got: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	weakrand "math/rand"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EvictionPolicy decides which certificate to evict from a cache
+// that is at capacity.
+type EvictionPolicy interface {
+	// Evict returns the index of the candidate to evict.
+	// It is called with the cache locked, so it should
+	// return quickly. There is always at least one
+	// candidate.
+	Evict(candidates []EvictionCandidate) int
+}
+
+// EvictionCandidate is a certificate in the cache that could be
+// evicted, along with its usage statistics.
+type EvictionCandidate struct {
+	Certificate Certificate
+
+	// When the certificate was last used for a TLS
+	// handshake; zero if never used (in which case
+	// Added is more relevant).
+	LastUsed time.Time
+
+	// When the certificate was added to the cache.
+	Added time.Time
+
+	// How many TLS handshakes the certificate was
+	// used for since it was added to the cache.
+	Uses uint64
+}
+
+// RandomEviction evicts a random certificate. This is the default.
+type RandomEviction struct{}
+
+// Evict implements EvictionPolicy.
+func (RandomEviction) Evict(candidates []EvictionCandidate) int {
+	// Go maps are "nondeterministic" but not actually random,
+	// so although we could just chop off the "front" of the
+	// map with less code, that is a heavily skewed eviction
+	// strategy; generating random numbers is cheap and
+	// ensures a much better distribution.
+	return weakrand.Intn(len(candidates))
+}
+
+// LRUEviction evicts the certificate that was least recently used
+// for a TLS handshake (or, if never used, least recently added).
+type LRUEviction struct{}
+
+// Evict implements EvictionPolicy.
+func (LRUEviction) Evict(candidates []EvictionCandidate) int {
+	lastActive := func(c EvictionCandidate) time.Time {
+		if c.LastUsed.After(c.Added) {
+			return c.LastUsed
+		}
+		return c.Added
+	}
+	victim := 0
+	for i := 1; i < len(candidates); i++ {
+		if lastActive(candidates[i]).Before(lastActive(candidates[victim])) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// LFUEviction evicts the certificate that was used for the fewest
+// TLS handshakes; ties are broken by evicting the oldest one.
+type LFUEviction struct{}
+
+// Evict implements EvictionPolicy.
+func (LFUEviction) Evict(candidates []EvictionCandidate) int {
+	victim := 0
+	for i := 1; i < len(candidates); i++ {
+		c, v := candidates[i], candidates[victim]
+		if c.Uses < v.Uses || (c.Uses == v.Uses && c.Added.Before(v.Added)) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// SoonestExpiryEviction evicts the certificate that expires first;
+// such certificates are the least valuable to keep in memory because
+// they will need to be replaced soonest anyway.
+type SoonestExpiryEviction struct{}
+
+// Evict implements EvictionPolicy.
+func (SoonestExpiryEviction) Evict(candidates []EvictionCandidate) int {
+	victim := 0
+	for i := 1; i < len(candidates); i++ {
+		if expiresAt(candidates[i].Certificate.Leaf).Before(expiresAt(candidates[victim].Certificate.Leaf)) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// UsageRateEviction evicts the certificate that was used for the
+// fewest TLS handshakes per hour since it was added to the cache. Unlike
+// LFUEviction, it doesn't favor certificates that have been in the cache
+// long over new ones that are used just as much; certificates that were
+// added within the last hour are treated as if they were added an hour
+// ago, so that new certificates are not evicted before they are used.
+type UsageRateEviction struct{}
+
+// Evict implements EvictionPolicy.
+func (UsageRateEviction) Evict(candidates []EvictionCandidate) int {
+	now := time.Now()
+	rate := func(c EvictionCandidate) float64 {
+		return float64(c.Uses) / max(now.Sub(c.Added).Hours(), 1)
+	}
+	victim := 0
+	for i := 1; i < len(candidates); i++ {
+		c, v := candidates[i], candidates[victim]
+		if rate(c) < rate(v) || (rate(c) == rate(v) && c.LastUsed.Before(v.LastUsed)) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// certUsage tracks how a cached certificate is used. Its fields
+// are updated atomically so that handshakes need not lock the cache.
+type certUsage struct {
+	added    time.Time
+	lastUsed atomic.Int64 // unix nanoseconds
+	uses     atomic.Uint64
+}
+
+// clone returns a copy of u.
+func (u *certUsage) clone() *certUsage {
+	c := &certUsage{added: u.added}
+	c.lastUsed.Store(u.lastUsed.Load())
+	c.uses.Store(u.uses.Load())
+	return c
+}
+
+// recordUse notes that the certificate with the given hash was
+// used for a TLS handshake.
+//
+// This method is safe for concurrent use.
+func (certCache *Cache) recordUse(hash string) {
+	usage, ok := certCache.usage.load(hash)
+	if !ok {
+		return
+	}
+	usage.lastUsed.Store(time.Now().UnixNano())
+	usage.uses.Add(1)
+}
+
+// evictionVictim returns the certificate that policy chooses to evict.
+// The default random eviction picks one directly, since it needs no
+// candidates or usage statistics; other policies get all candidates,
+// and if they return an invalid index, a random one is evicted.
+//
+// This function is NOT safe for concurrent use; callers MUST
+// hold a lock on certCache.mu.
+func (certCache *Cache) evictionVictim(policy EvictionPolicy) (Certificate, bool) {
+	if _, ok := policy.(RandomEviction); ok {
+		return certCache.cache.random()
+	}
+	candidates := certCache.evictionCandidates()
+	if len(candidates) == 0 {
+		return Certificate{}, false
+	}
+	i := policy.Evict(candidates)
+	if i < 0 || i >= len(candidates) {
+		certCache.logger.Error("eviction policy returned invalid index; evicting random certificate",
+			zap.String("policy", fmt.Sprintf("%T", policy)),
+			zap.Int("index", i),
+			zap.Int("candidates", len(candidates)))
+		i = weakrand.Intn(len(candidates))
+	}
+	return candidates[i].Certificate, true
+}
+
+// evictionCandidates returns all certificates in the cache along
+// with their usage statistics.
+//
+// This function is NOT safe for concurrent use; callers MUST
+// hold a lock on certCache.mu.
+func (certCache *Cache) evictionCandidates() []EvictionCandidate {
+	candidates := make([]EvictionCandidate, 0, certCache.cache.len())
+	certCache.cache.rangeAll(func(hash string, cert Certificate) {
+		candidate := EvictionCandidate{Certificate: cert}
+		if usage, ok := certCache.usage.load(hash); ok {
+			candidate.Added = usage.added
+			candidate.Uses = usage.uses.Load()
+			if lastUsed := usage.lastUsed.Load(); lastUsed > 0 {
+				candidate.LastUsed = time.Unix(0, lastUsed)
+			}
+		}
+		candidates = append(candidates, candidate)
+	})
+	return candidates
+}
+
+// Interface guards
+var (
+	_ EvictionPolicy = RandomEviction{}
+	_ EvictionPolicy = LRUEviction{}
+	_ EvictionPolicy = LFUEviction{}
+	_ EvictionPolicy = SoonestExpiryEviction{}
+	_ EvictionPolicy = UsageRateEviction{}
+)
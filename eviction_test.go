@@ -0,0 +1,91 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	now := time.Now()
+	leaf := func(notAfter time.Time) tls.Certificate {
+		return tls.Certificate{Leaf: &x509.Certificate{NotAfter: notAfter}}
+	}
+	candidates := []EvictionCandidate{
+		{Certificate: Certificate{hash: "a", Certificate: leaf(now.Add(48 * time.Hour))}, Added: now.Add(-3 * time.Hour), LastUsed: now, Uses: 1},
+		{Certificate: Certificate{hash: "b", Certificate: leaf(now.Add(24 * time.Hour))}, Added: now.Add(-2 * time.Hour), LastUsed: now.Add(-time.Hour), Uses: 10},
+		{Certificate: Certificate{hash: "c", Certificate: leaf(now.Add(72 * time.Hour))}, Added: now.Add(-time.Minute), Uses: 5},
+	}
+
+	for i, tc := range []struct {
+		policy EvictionPolicy
+		expect string
+	}{
+		{LRUEviction{}, "b"},
+		{LFUEviction{}, "a"},
+		{SoonestExpiryEviction{}, "b"},
+		{UsageRateEviction{}, "a"},
+	} {
+		if actual := candidates[tc.policy.Evict(candidates)].Certificate.hash; actual != tc.expect {
+			t.Errorf("Test %d (%T): Expected to evict %s, got %s", i, tc.policy, tc.expect, actual)
+		}
+	}
+}
+
+func TestCacheEvictionLRU(t *testing.T) {
+	noop := func(Certificate) (*Config, error) { return new(Config), nil }
+	c := NewCache(CacheOptions{GetConfigForCert: noop, Capacity: 2, EvictionPolicy: LRUEviction{}, Logger: defaultTestLogger})
+	defer c.Stop()
+
+	c.cacheCertificate(Certificate{Names: []string{"a.com"}, hash: "a"})
+	c.cacheCertificate(Certificate{Names: []string{"b.com"}, hash: "b"})
+	c.recordUse("a")
+	c.cacheCertificate(Certificate{Names: []string{"c.com"}, hash: "c"})
+
+	if _, ok := c.cache.load("a"); !ok {
+		t.Error("Recently used certificate should not have been evicted")
+	}
+	if _, ok := c.cache.load("b"); ok {
+		t.Error("Least recently used certificate should have been evicted")
+	}
+	if c.usage.len() != 2 {
+		t.Errorf("Expected usage of 2 certificates to be tracked, got %d", c.usage.len())
+	}
+}
+
+// badEviction returns an index that is out of range.
+type badEviction struct{ index int }
+
+func (e badEviction) Evict([]EvictionCandidate) int { return e.index }
+
+func TestCacheEvictionFallback(t *testing.T) {
+	noop := func(Certificate) (*Config, error) { return new(Config), nil }
+	for _, policy := range []EvictionPolicy{nil, RandomEviction{}, badEviction{-1}, badEviction{2}} {
+		c := NewCache(CacheOptions{GetConfigForCert: noop, Capacity: 2, EvictionPolicy: policy, Logger: defaultTestLogger})
+		c.cacheCertificate(Certificate{Names: []string{"a.com"}, hash: "a"})
+		c.cacheCertificate(Certificate{Names: []string{"b.com"}, hash: "b"})
+		c.cacheCertificate(Certificate{Names: []string{"c.com"}, hash: "c"})
+		if n := c.cache.len(); n != 2 {
+			t.Errorf("%T: Expected a certificate to be evicted, got %d cached", policy, n)
+		}
+		if _, ok := c.cache.load("c"); !ok {
+			t.Errorf("%T: Expected new certificate to be cached", policy)
+		}
+		c.Stop()
+	}
+}
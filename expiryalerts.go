@@ -0,0 +1,210 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ExpiryAlert is a threshold of remaining validity below which a
+// managed certificate is alerted about, since that means renewing it
+// has not been succeeding. When a certificate crosses a threshold, the
+// event "cert_expiry_" + Level is emitted (for example
+// cert_expiry_critical), with the last renewal error; when it is
+// renewed after that, cert_expiry_resolved is emitted.
+//
+// EXPERIMENTAL: Subject to change.
+type ExpiryAlert struct {
+	// The level of the alert, like "warning" or "critical".
+	Level string
+
+	// The remaining validity below which to alert, as a
+	// duration, as a fraction of the certificate's lifetime,
+	// or both, in which case the lesser applies; so short-
+	// lived certificates can be covered by the ratio.
+	Remaining     time.Duration
+	LifetimeRatio float64
+}
+
+// DefaultExpiryAlerts warn when less than 20 days (or a quarter of the
+// lifetime) remain, and are critical when less than 7 days (or a tenth
+// of the lifetime) remain.
+//
+// EXPERIMENTAL: Subject to change.
+var DefaultExpiryAlerts = []ExpiryAlert{
+	{Level: "warning", Remaining: 20 * 24 * time.Hour, LifetimeRatio: 0.25},
+	{Level: "critical", Remaining: 7 * 24 * time.Hour, LifetimeRatio: 0.1},
+}
+
+// threshold returns the remaining validity of leaf below which ea applies.
+func (ea ExpiryAlert) threshold(leaf *x509.Certificate) time.Duration {
+	var thresholds []time.Duration
+	if ea.Remaining > 0 {
+		thresholds = append(thresholds, ea.Remaining)
+	}
+	if ea.LifetimeRatio > 0 {
+		thresholds = append(thresholds, time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore))*ea.LifetimeRatio))
+	}
+	if len(thresholds) == 0 {
+		return 0
+	}
+	return slices.Min(thresholds)
+}
+
+// ExpiryAlertStatus describes a managed certificate that is alerted
+// about because it is close to expiring.
+//
+// EXPERIMENTAL: Subject to change.
+type ExpiryAlertStatus struct {
+	Names     []string  `json:"names"`
+	Level     string    `json:"level"`
+	NotAfter  time.Time `json:"not_after"`
+	AlertedAt time.Time `json:"alerted_at"`
+
+	// The last error renewing the certificate, when it
+	// occurred, and how many renewal attempts have failed
+	// in a row (in this process).
+	LastRenewalError   string    `json:"last_renewal_error,omitempty"`
+	LastRenewalAttempt time.Time `json:"last_renewal_attempt,omitzero"`
+	FailedRenewals     int       `json:"failed_renewals"`
+}
+
+// ExpiryAlerts returns the certificates in the cache that are currently
+// alerted about, ordered by name, for example to export as metrics. It
+// is updated when the cache checks for renewals.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) ExpiryAlerts() []ExpiryAlertStatus {
+	certCache.expiryAlerts.mu.Lock()
+	defer certCache.expiryAlerts.mu.Unlock()
+	statuses := make([]ExpiryAlertStatus, 0, len(certCache.expiryAlerts.byName))
+	for _, status := range certCache.expiryAlerts.byName {
+		status.Names = slices.Clone(status.Names)
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b ExpiryAlertStatus) int {
+		return strings.Compare(a.Names[0], b.Names[0])
+	})
+	return statuses
+}
+
+// expiryAlerts keeps the alert status of certificates, by their first
+// name, so that every level is alerted only once.
+type expiryAlerts struct {
+	mu     sync.Mutex
+	byName map[string]ExpiryAlertStatus
+}
+
+// checkExpiryAlerts evaluates all managed certificates against the
+// ExpiryAlerts of their configs, and emits events for those that
+// crossed a threshold since they were last checked, or were renewed.
+func (certCache *Cache) checkExpiryAlerts(ctx context.Context) {
+	log := certCache.logger.Named("maintenance")
+
+	now := time.Now()
+	current := make(map[string]ExpiryAlertStatus)
+	configs := make(map[string]*Config)
+
+	for _, cert := range certCache.getAllCerts() {
+		if !cert.managed || len(cert.Names) == 0 || cert.Leaf == nil {
+			continue
+		}
+		cfg, err := certCache.getConfig(cert)
+		if err != nil || cfg == nil || len(cfg.ExpiryAlerts) == 0 {
+			continue
+		}
+		configs[cert.Names[0]] = cfg
+
+		// the alert with the lowest threshold that is crossed applies
+		remaining := expiresAt(cert.Leaf).Sub(now)
+		var alert *ExpiryAlert
+		var lowest time.Duration
+		for i, ea := range cfg.ExpiryAlerts {
+			if threshold := ea.threshold(cert.Leaf); remaining < threshold && (alert == nil || threshold < lowest) {
+				alert, lowest = &cfg.ExpiryAlerts[i], threshold
+			}
+		}
+		if alert == nil {
+			continue
+		}
+
+		status := ExpiryAlertStatus{
+			Names:    cert.Names,
+			Level:    alert.Level,
+			NotAfter: expiresAt(cert.Leaf),
+		}
+		if failure, ok := certCache.issuanceFailures.get(cert.Names[0]); ok && failure.Renewal {
+			status.LastRenewalError = failure.Error
+			status.LastRenewalAttempt = failure.LastFailed
+			status.FailedRenewals = failure.Attempts
+		}
+		current[cert.Names[0]] = status
+	}
+
+	certCache.expiryAlerts.mu.Lock()
+	previous := certCache.expiryAlerts.byName
+	var alerted []ExpiryAlertStatus
+	var resolved []ExpiryAlertStatus
+	for name, status := range current {
+		if prev, ok := previous[name]; ok && prev.Level == status.Level {
+			status.AlertedAt = prev.AlertedAt
+		} else {
+			status.AlertedAt = now
+			alerted = append(alerted, status)
+		}
+		current[name] = status
+	}
+	for name, prev := range previous {
+		// if the certificate is still in the cache, it was renewed
+		// (otherwise, it was removed; nothing to alert about anymore)
+		if _, ok := current[name]; !ok && configs[name] != nil {
+			resolved = append(resolved, prev)
+		}
+	}
+	certCache.expiryAlerts.byName = current
+	certCache.expiryAlerts.mu.Unlock()
+
+	for _, status := range alerted {
+		log.Warn("certificate is close to expiring, but has not been renewed",
+			zap.Strings("identifiers", status.Names),
+			zap.String("level", status.Level),
+			zap.Time("expiration", status.NotAfter),
+			zap.String("last_renewal_error", status.LastRenewalError))
+		configs[status.Names[0]].emit(ctx, "cert_expiry_"+status.Level, map[string]any{
+			"identifiers":          status.Names,
+			"level":                status.Level,
+			"remaining":            status.NotAfter.Sub(now),
+			"expiration":           status.NotAfter,
+			"last_renewal_error":   status.LastRenewalError,
+			"last_renewal_attempt": status.LastRenewalAttempt,
+			"failed_renewals":      status.FailedRenewals,
+		})
+	}
+	for _, prev := range resolved {
+		log.Info("certificate that was close to expiring has been renewed",
+			zap.Strings("identifiers", prev.Names))
+		configs[prev.Names[0]].emit(ctx, "cert_expiry_resolved", map[string]any{
+			"identifiers": prev.Names,
+			"level":       prev.Level,
+		})
+	}
+}
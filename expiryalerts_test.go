@@ -0,0 +1,103 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiryAlertThreshold(t *testing.T) {
+	now := time.Now()
+	long := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	short := &x509.Certificate{NotBefore: now, NotAfter: now.Add(6 * 24 * time.Hour)}
+	warning := DefaultExpiryAlerts[0]
+	if got := warning.threshold(long); got != 20*24*time.Hour {
+		t.Errorf("Expected duration to apply to long-lived certificate, got %s", got)
+	}
+	if got := warning.threshold(short); got != 36*time.Hour {
+		t.Errorf("Expected ratio to apply to short-lived certificate, got %s", got)
+	}
+}
+
+func TestCheckExpiryAlerts(t *testing.T) {
+	var events []string
+	var lastData map[string]any
+	var cfg *Config
+	c := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer c.Stop()
+	cfg = New(c, Config{
+		ExpiryAlerts: DefaultExpiryAlerts,
+		Logger:       defaultTestLogger,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			events = append(events, event)
+			lastData = data
+			return nil
+		},
+	})
+	ctx := context.Background()
+
+	certExpiringIn := func(hash string, remaining time.Duration) Certificate {
+		return Certificate{
+			Names:   []string{"example.com"},
+			hash:    hash,
+			managed: true,
+			Certificate: tls.Certificate{Leaf: &x509.Certificate{
+				NotBefore: time.Now().Add(remaining - 90*24*time.Hour),
+				NotAfter:  time.Now().Add(remaining),
+			}},
+		}
+	}
+	expiring := certExpiringIn("old", 5*24*time.Hour)
+	c.cacheCertificate(expiring)
+	c.cacheCertificate(Certificate{Names: []string{"fine.example.com"}, hash: "fine", managed: true,
+		Certificate: certExpiringIn("", 60*24*time.Hour).Certificate})
+	c.issuanceFailures.record("example.com", true, errors.New("CA is down"))
+	c.issuanceFailures.record("example.com", true, errors.New("CA is still down"))
+
+	c.checkExpiryAlerts(ctx)
+	if !slices.Equal(events, []string{"cert_expiry_critical"}) {
+		t.Fatalf("Expected critical alert, got %v", events)
+	}
+	if lastData["last_renewal_error"] != "CA is still down" || lastData["failed_renewals"] != 2 {
+		t.Errorf("Expected last renewal error in event, got %v", lastData)
+	}
+	alerts := c.ExpiryAlerts()
+	if len(alerts) != 1 || alerts[0].Level != "critical" || alerts[0].FailedRenewals != 2 {
+		t.Errorf("Unexpected alerts: %+v", alerts)
+	}
+
+	// alerts are not repeated
+	c.checkExpiryAlerts(ctx)
+	if len(events) != 1 {
+		t.Errorf("Expected no repeated alert, got %v", events)
+	}
+
+	// renewal resolves the alert
+	c.issuanceFailures.record("example.com", true, nil)
+	c.replaceCertificate(expiring, certExpiringIn("new", 89*24*time.Hour))
+	c.checkExpiryAlerts(ctx)
+	if events[len(events)-1] != "cert_expiry_resolved" || len(c.ExpiryAlerts()) != 0 {
+		t.Errorf("Expected alert to be resolved, got %v", events)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rveen/certmagic/internal/atomicfile"
+	"go.uber.org/zap"
+)
+
+// ExportFormat is a format to export certificates and their private
+// keys in, for software that can't read PEM files from storage.
+//
+// EXPERIMENTAL: Subject to change.
+type ExportFormat string
+
+const (
+	// ExportPKCS12 is a PKCS#12 (PFX) file, "<name>.p12";
+	// see EncodePKCS12.
+	ExportPKCS12 ExportFormat = "pkcs12"
+
+	// ExportJKS is a Java KeyStore, "<name>.jks"; see
+	// EncodeJKS.
+	ExportJKS ExportFormat = "jks"
+
+	// ExportDER is the certificate, "<name>.der", the
+	// rest of the chain as concatenated certificates,
+	// "<name>.chain.der" (omitted if there are none),
+	// and the unencrypted PKCS#8 private key,
+	// "<name>.key.der", all DER-encoded.
+	ExportDER ExportFormat = "der"
+)
+
+// ExportedFile is a file with an exported certificate or key.
+//
+// EXPERIMENTAL: Subject to change.
+type ExportedFile struct {
+	// The file name, which is the storage-safe form of the
+	// name of the certificate (see KeyBuilder.Safe) with an
+	// extension that depends on the format.
+	Name string
+
+	Data []byte
+
+	// Whether the file contains the private key, in which
+	// case it must be kept confidential.
+	Private bool
+}
+
+// ExportOptions configures how certificates are exported.
+//
+// EXPERIMENTAL: Subject to change.
+type ExportOptions struct {
+	// The password that protects PKCS#12 files and Java
+	// KeyStores. Java requires at least 6 characters.
+	Password string
+
+	// The alias of the entry in PKCS#12 files and Java
+	// KeyStores. Default: the name of the certificate.
+	Alias string
+}
+
+// Export exports the managed certificate for name, and its private key,
+// from storage in format. If it is stored for more than one issuer, the
+// most recently issued one is exported.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Export(ctx context.Context, name string, format ExportFormat, opts ExportOptions) ([]ExportedFile, error) {
+	certRes, err := cfg.current().forSubject(name).loadCertResourceAnyIssuer(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return exportCertificate(name, certRes.CertificatePEM, certRes.PrivateKeyPEM, format, opts)
+}
+
+// exportCertificate exports the PEM-encoded certificate chain and
+// private key for name in format.
+func exportCertificate(name string, certPEM, keyPEM []byte, format ExportFormat, opts ExportOptions) ([]ExportedFile, error) {
+	chain, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("decoding private key: %v", err)
+	}
+	alias := opts.Alias
+	if alias == "" {
+		alias = name
+	}
+	base := StorageKeys.Safe(name)
+
+	switch format {
+	case ExportPKCS12:
+		data, err := EncodePKCS12(key, chain, alias, opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		return []ExportedFile{{Name: base + ".p12", Data: data, Private: true}}, nil
+
+	case ExportJKS:
+		data, err := EncodeJKS(key, chain, alias, opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		return []ExportedFile{{Name: base + ".jks", Data: data, Private: true}}, nil
+
+	case ExportDER:
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		files := []ExportedFile{{Name: base + ".der", Data: chain[0].Raw}}
+		if len(chain) > 1 {
+			var intermediates bytes.Buffer
+			for _, cert := range chain[1:] {
+				intermediates.Write(cert.Raw)
+			}
+			files = append(files, ExportedFile{Name: base + ".chain.der", Data: intermediates.Bytes()})
+		}
+		return append(files, ExportedFile{Name: base + ".key.der", Data: keyDER, Private: true}), nil
+	}
+	return nil, fmt.Errorf("unknown export format: %s", format)
+}
+
+// CertificateExporter exports certificates every time they are obtained
+// or renewed, so that software which can't read PEM files from storage,
+// like appliances and JVM applications, always has the current ones.
+// Use its OnEvent method as (or call it from) Config.OnEvent:
+//
+//	exporter := &certmagic.CertificateExporter{
+//		Formats: []certmagic.ExportFormat{certmagic.ExportPKCS12},
+//		Options: certmagic.ExportOptions{Password: password},
+//		Dir:     "/etc/appliance/certs",
+//	}
+//	cfg := certmagic.NewDefault()
+//	cfg.OnEvent = exporter.OnEvent
+//
+// To export certificates that were obtained before, use Config.Export.
+//
+// EXPERIMENTAL: Subject to change.
+type CertificateExporter struct {
+	// The formats to export in. REQUIRED.
+	Formats []ExportFormat
+
+	Options ExportOptions
+
+	// The directory to write the files to. Files are
+	// replaced atomically; those that contain private
+	// keys are only readable by the owner.
+	Dir string
+
+	// If set, files are passed to this function instead
+	// of being written to Dir, for example to upload them.
+	Write func(ctx context.Context, name string, files []ExportedFile) error
+
+	// If set, events are passed on to this function, and its
+	// result is returned.
+	Next func(ctx context.Context, event string, data map[string]any) error
+
+	// Optional logger.
+	Logger *zap.Logger
+}
+
+// OnEvent exports the certificate of cert_obtained events.
+func (ex *CertificateExporter) OnEvent(ctx context.Context, event string, data map[string]any) error {
+	if event == "cert_obtained" {
+		if err := ex.export(ctx, data); err != nil {
+			ex.logger().Error("exporting certificate",
+				zap.Any("identifier", data["identifier"]),
+				zap.Error(err))
+		}
+	}
+	if ex.Next != nil {
+		return ex.Next(ctx, event, data)
+	}
+	return nil
+}
+
+// export exports the certificate that was obtained, as described by
+// the data of the cert_obtained event.
+func (ex *CertificateExporter) export(ctx context.Context, data map[string]any) error {
+	cfg, ok := ctx.Value(ctxKeyConfig).(*Config)
+	if !ok || cfg == nil {
+		return fmt.Errorf("no config in context")
+	}
+	name, _ := data["identifier"].(string)
+	certPath, _ := data["certificate_path"].(string)
+	keyPath, _ := data["private_key_path"].(string)
+	certPEM, err := cfg.Storage.Load(ctx, certPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := cfg.Storage.Load(ctx, keyPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err = cfg.decryptKeyPEM(ctx, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	var files []ExportedFile
+	for _, format := range ex.Formats {
+		exported, err := exportCertificate(name, certPEM, keyPEM, format, ex.Options)
+		if err != nil {
+			return fmt.Errorf("exporting as %s: %w", format, err)
+		}
+		files = append(files, exported...)
+	}
+	if ex.Write != nil {
+		return ex.Write(ctx, name, files)
+	}
+	return writeExportedFiles(ex.Dir, files)
+}
+
+// writeExportedFiles atomically writes files to dir.
+func writeExportedFiles(dir string, files []ExportedFile) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		mode := os.FileMode(0o644)
+		if file.Private {
+			mode = 0o600
+		}
+		fp, err := atomicfile.New(filepath.Join(dir, file.Name), mode)
+		if err != nil {
+			return err
+		}
+		if _, err := fp.Write(file.Data); err != nil {
+			fp.Cancel()
+			return err
+		}
+		if err := fp.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ex *CertificateExporter) logger() *zap.Logger {
+	if ex.Logger != nil {
+		return ex.Logger
+	}
+	return defaultLogger
+}
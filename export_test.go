@@ -0,0 +1,211 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	exporter := &CertificateExporter{
+		Formats: []ExportFormat{ExportPKCS12, ExportJKS, ExportDER},
+		Options: ExportOptions{Password: "changeit"},
+		Dir:     dir,
+		Logger:  defaultTestLogger,
+	}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnEvent:   exporter.OnEvent,
+	})
+	if err := cfg.ManageSync(ctx, []string{"*.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	cert := cache.getAllMatchingCerts("*.example.com")[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the exporter wrote the files when the certificate was obtained
+	for _, name := range []string{"wildcard_.example.com.p12", "wildcard_.example.com.jks", "wildcard_.example.com.der", "wildcard_.example.com.key.der"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if private := filepath.Ext(name) != ".der" || name == "wildcard_.example.com.key.der"; private && info.Mode().Perm() != 0o600 {
+			t.Errorf("Expected %s to be private, got mode %v", name, info.Mode())
+		}
+	}
+
+	files, err := cfg.Export(ctx, "*.example.com", ExportDER, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || !bytes.Equal(files[0].Data, cert.Leaf.Raw) || !bytes.Equal(files[1].Data, key) || !files[1].Private {
+		t.Errorf("Unexpected DER export: %+v", files)
+	}
+
+	files, err = cfg.Export(ctx, "*.example.com", ExportPKCS12, ExportOptions{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptTestPKCS12Key(t, files[0].Data, "secret"); !bytes.Equal(got, key) {
+		t.Error("Expected PKCS#12 file to contain the private key")
+	}
+
+	files, err = cfg.Export(ctx, "*.example.com", ExportJKS, ExportOptions{Password: "secret", Alias: "Server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptTestJKSKey(t, files[0].Data, "server", "secret"); !bytes.Equal(got, key) {
+		t.Error("Expected Java KeyStore to contain the private key")
+	}
+
+	if _, err := cfg.Export(ctx, "*.example.com", "pem", ExportOptions{}); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+// decryptTestPKCS12Key verifies the MAC of a PKCS#12 file as encoded by
+// EncodePKCS12 and returns its decrypted PKCS#8 private key.
+func decryptTestPKCS12Key(t *testing.T, data []byte, password string) []byte {
+	t.Helper()
+	var pfx pfxPDU
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		t.Fatal(err)
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, pkcs12KDF(bmpPassword(password), pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, 32))
+	mac.Write(authSafe)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatal("MAC does not match")
+	}
+
+	var contents []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		t.Fatal(err)
+	}
+	var safeContents []byte
+	if _, err := asn1.Unmarshal(contents[1].Content.Bytes, &safeContents); err != nil {
+		t.Fatal(err)
+	}
+	var bags []safeBag
+	if _, err := asn1.Unmarshal(safeContents, &bags); err != nil {
+		t.Fatal(err)
+	}
+	var keyInfo encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(bags[0].Value.Bytes, &keyInfo); err != nil {
+		t.Fatal(err)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(keyInfo.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdfParams); err != nil {
+		t.Fatal(err)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Encryption.Parameters.FullBytes, &iv); err != nil {
+		t.Fatal(err)
+	}
+	aesKey, err := pbkdf2.Key(sha256.New, password, kdfParams.Salt, kdfParams.Iterations, kdfParams.KeyLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, len(keyInfo.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, keyInfo.Data)
+	return plain[:len(plain)-int(plain[len(plain)-1])]
+}
+
+// decryptTestJKSKey verifies the integrity of a Java KeyStore as encoded
+// by EncodeJKS and returns the decrypted PKCS#8 private key of alias.
+func decryptTestJKSKey(t *testing.T, data []byte, alias, password string) []byte {
+	t.Helper()
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New()
+	h.Write(utf16BE(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		t.Fatal("Integrity digest does not match")
+	}
+
+	r := bytes.NewReader(body[16:]) // magic, version, count, entry tag
+	var aliasLen uint16
+	binary.Read(r, binary.BigEndian, &aliasLen)
+	gotAlias := make([]byte, aliasLen)
+	r.Read(gotAlias)
+	if string(gotAlias) != alias {
+		t.Fatalf("Expected alias %q, got %q", alias, gotAlias)
+	}
+	var created uint64
+	var keyLen uint32
+	binary.Read(r, binary.BigEndian, &created)
+	binary.Read(r, binary.BigEndian, &keyLen)
+	encryptedKey := make([]byte, keyLen)
+	r.Read(encryptedKey)
+	var keyInfo encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(encryptedKey, &keyInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	protected := keyInfo.Data
+	salt, encrypted := protected[:sha1.Size], protected[sha1.Size:len(protected)-sha1.Size]
+	plain := make([]byte, len(encrypted))
+	digest = salt
+	for i := range encrypted {
+		if i%sha1.Size == 0 {
+			h := sha1.New()
+			h.Write(utf16BE(password))
+			h.Write(digest)
+			digest = h.Sum(nil)
+		}
+		plain[i] = encrypted[i] ^ digest[i%sha1.Size]
+	}
+	return plain
+}
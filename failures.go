@@ -0,0 +1,205 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IssuanceFailure describes why a certificate for a name could not be
+// obtained or renewed recently. It is kept until the certificate is
+// obtained or renewed successfully, so it answers the question of why
+// a name doesn't have a (fresh) certificate.
+//
+// EXPERIMENTAL: Subject to change.
+type IssuanceFailure struct {
+	// The name the certificate is for.
+	Name string `json:"name"`
+
+	// Whether the last failed attempt was a renewal.
+	Renewal bool `json:"renewal"`
+
+	// The error of the last failed attempt.
+	Error string `json:"error"`
+
+	// How many attempts failed in a row.
+	Attempts int `json:"attempts"`
+
+	// When the first and the last attempt in a row failed.
+	FirstFailed time.Time `json:"first_failed"`
+	LastFailed  time.Time `json:"last_failed"`
+}
+
+// IssuanceFailures returns the most recent failures to obtain or renew
+// certificates by configs using this cache, most recent first. Only
+// the last CacheOptions.MaxIssuanceFailures names are kept.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) IssuanceFailures() []IssuanceFailure {
+	certCache.issuanceFailures.mu.Lock()
+	failures := make([]IssuanceFailure, 0, len(certCache.issuanceFailures.byName))
+	for _, failure := range certCache.issuanceFailures.byName {
+		failures = append(failures, failure)
+	}
+	certCache.issuanceFailures.mu.Unlock()
+	slices.SortFunc(failures, func(a, b IssuanceFailure) int {
+		return b.LastFailed.Compare(a.LastFailed)
+	})
+	return failures
+}
+
+// IssuanceFailure returns the most recent failure to obtain or renew a
+// certificate for name, if the last attempt failed. If failures are not
+// known to this instance, but cfg.PersistIssuanceFailures is enabled,
+// failures recorded in storage by any instance are also found.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) IssuanceFailure(ctx context.Context, name string) (IssuanceFailure, bool) {
+	cfg = cfg.current()
+	if failure, ok := cfg.certCache.issuanceFailures.get(name); ok {
+		return failure, true
+	}
+	if !cfg.PersistIssuanceFailures {
+		return IssuanceFailure{}, false
+	}
+	failureJSON, err := cfg.Storage.Load(ctx, issuanceFailureKey(name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			cfg.Logger.Error("loading issuance failure", zap.String("identifier", name), zap.Error(err))
+		}
+		return IssuanceFailure{}, false
+	}
+	var failure IssuanceFailure
+	if err := json.Unmarshal(failureJSON, &failure); err != nil {
+		cfg.Logger.Error("decoding issuance failure", zap.String("identifier", name), zap.Error(err))
+		return IssuanceFailure{}, false
+	}
+	return failure, true
+}
+
+// recordIssuanceResult records the result of an attempt to obtain or
+// renew the certificate for name: a failure if err is not nil, and
+// otherwise, that the previous failures are over. Canceled attempts are
+// not recorded.
+func (cfg *Config) recordIssuanceResult(ctx context.Context, name string, renewal bool, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	failure, changed := cfg.certCache.issuanceFailures.record(name, renewal, err)
+	if !cfg.PersistIssuanceFailures || !changed {
+		return
+	}
+
+	// the attempt itself may have been canceled
+	// after it failed; record the failure anyway
+	ctx = context.WithoutCancel(ctx)
+	key := issuanceFailureKey(name)
+	if err == nil {
+		if err := cfg.Storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			cfg.Logger.Error("deleting issuance failure", zap.String("identifier", name), zap.Error(err))
+		}
+		return
+	}
+	failureJSON, err := json.Marshal(failure)
+	if err == nil {
+		err = cfg.Storage.Store(ctx, key, failureJSON)
+	}
+	if err != nil {
+		cfg.Logger.Error("storing issuance failure", zap.String("identifier", name), zap.Error(err))
+	}
+}
+
+// issuanceFailures keeps the most recent issuance failures by name,
+// up to a limit.
+type issuanceFailures struct {
+	mu     sync.Mutex
+	limit  int
+	byName map[string]IssuanceFailure
+}
+
+// record records the result of an attempt to obtain or renew the
+// certificate for name, and returns the failure if err is not nil.
+// It returns false if nothing changed, because err is nil and there
+// were no failures.
+func (f *issuanceFailures) record(name string, renewal bool, err error) (IssuanceFailure, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		_, existed := f.byName[name]
+		delete(f.byName, name)
+		return IssuanceFailure{}, existed
+	}
+	if f.byName == nil {
+		f.byName = make(map[string]IssuanceFailure)
+	}
+
+	now := time.Now()
+	failure, ok := f.byName[name]
+	if !ok {
+		failure = IssuanceFailure{Name: name, FirstFailed: now}
+		f.evict()
+	}
+	failure.Renewal = renewal
+	failure.Error = err.Error()
+	failure.Attempts++
+	failure.LastFailed = now
+	f.byName[name] = failure
+
+	return failure, true
+}
+
+// evict makes room for one more failure, if needed, by
+// removing the failure that happened longest ago.
+func (f *issuanceFailures) evict() {
+	limit := f.limit
+	if limit <= 0 {
+		limit = DefaultMaxIssuanceFailures
+	}
+	for len(f.byName) >= limit {
+		var oldest string
+		for name, failure := range f.byName {
+			if oldest == "" || failure.LastFailed.Before(f.byName[oldest].LastFailed) {
+				oldest = name
+			}
+		}
+		delete(f.byName, oldest)
+	}
+}
+
+func (f *issuanceFailures) get(name string) (IssuanceFailure, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failure, ok := f.byName[name]
+	return failure, ok
+}
+
+func issuanceFailureKey(name string) string {
+	return path.Join(prefixIssuanceFailures, StorageKeys.safeSubject(name)+".json")
+}
+
+// DefaultMaxIssuanceFailures is how many names with
+// issuance failures a cache remembers by default.
+const DefaultMaxIssuanceFailures = 1000
+
+const prefixIssuanceFailures = "issuance_failures"
@@ -0,0 +1,91 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssuanceFailuresBounded(t *testing.T) {
+	f := issuanceFailures{limit: 2}
+	f.record("a.example.com", false, errors.New("a"))
+	time.Sleep(time.Millisecond)
+	f.record("b.example.com", false, errors.New("b"))
+	time.Sleep(time.Millisecond)
+	f.record("a.example.com", true, errors.New("a again"))
+	time.Sleep(time.Millisecond)
+	f.record("c.example.com", false, errors.New("c"))
+
+	if _, ok := f.get("b.example.com"); ok {
+		t.Error("Expected the least recent failure to be evicted")
+	}
+	a, ok := f.get("a.example.com")
+	if !ok || a.Attempts != 2 || !a.Renewal || a.Error != "a again" || !a.LastFailed.After(a.FirstFailed) {
+		t.Errorf("Unexpected failure: %+v", a)
+	}
+
+	if _, changed := f.record("a.example.com", true, nil); !changed {
+		t.Error("Expected success to clear the failure")
+	}
+	if _, ok := f.get("a.example.com"); ok {
+		t.Error("Expected failure to be cleared")
+	}
+	if _, changed := f.record("a.example.com", true, nil); changed {
+		t.Error("Expected nothing to change without failures")
+	}
+}
+
+func TestIssuanceFailureRecordedAndPersisted(t *testing.T) {
+	ctx := context.Background()
+	issuer := &gatedIssuer{gate: make(chan error, 1)}
+	cfg := newCertJobTestConfig(t, issuer)
+	cfg.PersistIssuanceFailures = true
+
+	issuer.gate <- errors.New("CA is down")
+	if err := cfg.ObtainCertSync(ctx, "failing.example.com"); err == nil {
+		t.Fatal("Expected obtain to fail")
+	}
+	failure, ok := cfg.IssuanceFailure(ctx, "failing.example.com")
+	if !ok || failure.Renewal || failure.Attempts != 1 || !strings.Contains(failure.Error, "CA is down") {
+		t.Fatalf("Unexpected failure: %+v (found=%t)", failure, ok)
+	}
+	if failures := cfg.certCache.IssuanceFailures(); len(failures) != 1 || failures[0].Name != "failing.example.com" {
+		t.Errorf("Expected failure to be listed, got %+v", failures)
+	}
+
+	// another instance sharing storage finds it too
+	other := newCertJobTestConfig(t, issuer)
+	other.Storage = cfg.Storage
+	other.PersistIssuanceFailures = true
+	if failure, ok := other.IssuanceFailure(ctx, "failing.example.com"); !ok || failure.Attempts != 1 {
+		t.Errorf("Expected persisted failure to be found, got %+v (found=%t)", failure, ok)
+	}
+
+	// success clears it
+	issuer.gate <- nil
+	if err := cfg.ObtainCertSync(ctx, "failing.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.IssuanceFailure(ctx, "failing.example.com"); ok {
+		t.Error("Expected failure to be cleared after success")
+	}
+	if _, ok := other.IssuanceFailure(ctx, "failing.example.com"); ok {
+		t.Error("Expected persisted failure to be cleared after success")
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/rveen/certmagic/internal/atomicfile"
@@ -262,6 +263,49 @@ func (s *FileStorage) Unlock(_ context.Context, name string) error {
 	return os.Remove(s.lockFilename(name))
 }
 
+// LockInfo describes the lock for name. It implements LockInspector.
+func (s *FileStorage) LockInfo(_ context.Context, name string) (LockInfo, error) {
+	data, err := os.ReadFile(s.lockFilename(name))
+	if err != nil {
+		return LockInfo{}, err
+	}
+	var meta lockMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return LockInfo{}, fmt.Errorf("decoding lockfile contents: %w", err)
+	}
+	return LockInfo{
+		Name:    name,
+		Created: meta.Created,
+		Updated: meta.Updated,
+		Holder:  meta.Holder,
+	}, nil
+}
+
+// BreakLock removes the lock for name, whoever holds it. It
+// implements LockInspector.
+func (s *FileStorage) BreakLock(_ context.Context, name string) error {
+	return os.Remove(s.lockFilename(name))
+}
+
+// ListLocks returns the names of all locks, as stored in the names of
+// the lock files. It implements LockLister.
+func (s *FileStorage) ListLocks(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.lockDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".lock"); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
 func (s *FileStorage) String() string {
 	return "FileStorage:" + s.Path
 }
@@ -389,6 +433,7 @@ func atomicallyCreateFile(filename string, writeLockInfo bool) error {
 		meta := lockMeta{
 			Created: now,
 			Updated: now,
+			Holder:  lockHolder,
 		}
 		if err := json.NewEncoder(f).Encode(meta); err != nil {
 			return err
@@ -432,8 +477,15 @@ func dataDir() string {
 type lockMeta struct {
 	Created time.Time `json:"created,omitempty"`
 	Updated time.Time `json:"updated,omitempty"`
+	Holder  string    `json:"holder,omitempty"`
 }
 
+// lockHolder identifies this process in lock files.
+var lockHolder = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}()
+
 // lockFreshnessInterval is how often to update
 // a lock's timestamp. Locks with a timestamp
 // more than this duration in the past (plus a
@@ -445,5 +497,9 @@ const lockFreshnessInterval = 5 * time.Second
 // to check the existence of a lock file
 const fileLockPollInterval = 1 * time.Second
 
-// Interface guard
-var _ Storage = (*FileStorage)(nil)
+// Interface guards
+var (
+	_ Storage       = (*FileStorage)(nil)
+	_ LockInspector = (*FileStorage)(nil)
+	_ LockLister    = (*FileStorage)(nil)
+)
@@ -1,6 +1,5 @@
 module github.com/rveen/certmagic
 
-
 go 1.24.1
 
 require (
@@ -0,0 +1,315 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// GoogleTrustEAB configures how GoogleTrustIssuer gets External
+// Account Binding (EAB) keys from the Google Cloud Public CA API,
+// which Google Trust Services requires to register ACME accounts.
+//
+// EXPERIMENTAL: Subject to change.
+type GoogleTrustEAB struct {
+	// The JSON key of a service account that is allowed
+	// to create external account keys (e.g. with the
+	// "Public CA External Account Key Creator" role).
+	// Either this or AccessToken is REQUIRED.
+	ServiceAccountKey []byte
+
+	// Optionally, a function that returns an OAuth 2.0
+	// access token for the API, e.g. from the metadata
+	// server, instead of using a service account key.
+	AccessToken func(ctx context.Context) (string, error)
+
+	// The ID of the Google Cloud project to create the
+	// keys in. Default: the project of the service
+	// account key.
+	Project string
+
+	// How many times to retry creating a key if the quota
+	// of the API is exhausted; Retry-After is honored.
+	// Default: 5.
+	MaxRetries int
+
+	// The URL of the Public CA API. Default: the API of
+	// the staging or production environment, according
+	// to the CA of the issuer.
+	Endpoint string
+
+	// The HTTP client to use. Default: a client with
+	// HTTPTimeout.
+	HTTPClient *http.Client
+}
+
+// GoogleTrustIssuer returns an ACMEIssuer for Google Trust Services
+// that gets a new EAB key from the Public CA API whenever it registers
+// an ACME account, since each EAB key can only be used once. The CA of
+// the template defaults to GoogleTrustProductionCA; other fields are
+// used as with NewACMEIssuer. If template has a NewAccountFunc, it is
+// called after the EAB key has been set.
+//
+// EXPERIMENTAL: Subject to change.
+func GoogleTrustIssuer(cfg *Config, eab GoogleTrustEAB, template ACMEIssuer) (*ACMEIssuer, error) {
+	if template.CA == "" {
+		template.CA = GoogleTrustProductionCA
+	}
+
+	client := &googleTrustClient{GoogleTrustEAB: eab}
+	if len(eab.ServiceAccountKey) > 0 {
+		if err := json.Unmarshal(eab.ServiceAccountKey, &client.serviceAccount); err != nil {
+			return nil, fmt.Errorf("decoding service account key: %v", err)
+		}
+		key, err := PEMDecodePrivateKey([]byte(client.serviceAccount.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("decoding service account private key: %v", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("service account private key is %T, not RSA", key)
+		}
+		client.signer = rsaKey
+		if client.serviceAccount.TokenURI == "" {
+			client.serviceAccount.TokenURI = googleOAuthTokenURL
+		}
+		if client.Project == "" {
+			client.Project = client.serviceAccount.ProjectID
+		}
+	} else if eab.AccessToken == nil {
+		return nil, fmt.Errorf("either a service account key or an access token function is required")
+	}
+	if client.Project == "" {
+		return nil, fmt.Errorf("missing Google Cloud project")
+	}
+	if client.Endpoint == "" {
+		client.Endpoint = googlePublicCAEndpoint
+		if template.CA == GoogleTrustStagingCA {
+			client.Endpoint = googlePublicCAStagingEndpoint
+		}
+	}
+
+	iss := NewACMEIssuer(cfg, template)
+	client.logger = iss.Logger
+	next := iss.NewAccountFunc
+	iss.NewAccountFunc = func(ctx context.Context, iss *ACMEIssuer, acct acme.Account) (acme.Account, error) {
+		key, err := client.createExternalAccountKey(ctx)
+		if err != nil {
+			return acct, fmt.Errorf("getting EAB key from Google Trust Services: %v", err)
+		}
+		iss.ExternalAccount = key
+		if next != nil {
+			return next(ctx, iss, acct)
+		}
+		return acct, nil
+	}
+	return iss, nil
+}
+
+// googleTrustClient creates EAB keys with the Public CA API.
+type googleTrustClient struct {
+	GoogleTrustEAB
+	serviceAccount googleServiceAccountKey
+	signer         *rsa.PrivateKey
+	logger         *zap.Logger
+}
+
+type googleServiceAccountKey struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// createExternalAccountKey creates a new EAB key, retrying with
+// backoff while the quota is exhausted.
+func (c *googleTrustClient) createExternalAccountKey(ctx context.Context) (*acme.EAB, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting access token: %v", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/locations/global/externalAccountKeys",
+		strings.TrimSuffix(c.Endpoint, "/"), url.PathEscape(c.Project))
+
+	maxRetries := c.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 5
+	}
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader("{}"))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.httpClient(ctx).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if attempt >= maxRetries {
+				return nil, fmt.Errorf("quota exhausted after %d attempts: HTTP %d: %s", attempt+1, resp.StatusCode, body)
+			}
+			wait := backoff
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+				wait = time.Duration(secs) * time.Second
+			}
+			c.logger.Warn("Public CA API quota exhausted; retrying",
+				zap.String("project", c.Project),
+				zap.Int("attempt", attempt+1),
+				zap.Duration("retry_after", wait))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("creating external account key: HTTP %d: %s", resp.StatusCode, body)
+		}
+
+		var key struct {
+			KeyID     string `json:"keyId"`
+			B64MACKey string `json:"b64MacKey"`
+		}
+		if err := json.Unmarshal(body, &key); err != nil {
+			return nil, fmt.Errorf("decoding external account key: %v", err)
+		}
+		// the API encodes the MAC key with standard base64,
+		// but ACME needs it to be URL-safe and unpadded
+		macKey, err := base64.StdEncoding.DecodeString(key.B64MACKey)
+		if err != nil {
+			return nil, fmt.Errorf("decoding MAC key: %v", err)
+		}
+		if key.KeyID == "" || len(macKey) == 0 {
+			return nil, fmt.Errorf("incomplete external account key in response: %s", body)
+		}
+		c.logger.Info("created external account key",
+			zap.String("project", c.Project),
+			zap.String("key_id", key.KeyID))
+		return &acme.EAB{
+			KeyID:  key.KeyID,
+			MACKey: base64.RawURLEncoding.EncodeToString(macKey),
+		}, nil
+	}
+}
+
+// accessToken returns an access token for the Public CA API,
+// exchanging a JWT signed with the service account key for one
+// unless an AccessToken function is configured.
+func (c *googleTrustClient) accessToken(ctx context.Context) (string, error) {
+	if c.AccessToken != nil {
+		return c.AccessToken(ctx)
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": c.serviceAccount.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   c.serviceAccount.ClientEmail,
+		"scope": googleCloudPlatformScope,
+		"aud":   c.serviceAccount.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.signer, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %v", err)
+	}
+	assertion := signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serviceAccount.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.httpClient(ctx).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("decoding token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token in response")
+	}
+	return token.AccessToken, nil
+}
+
+func (c *googleTrustClient) httpClient(ctx context.Context) *http.Client {
+	return httpClientFor(ctx, c.HTTPClient, HTTPTimeout)
+}
+
+const (
+	googlePublicCAEndpoint        = "https://publicca.googleapis.com"
+	googlePublicCAStagingEndpoint = "https://preprod-publicca.googleapis.com"
+	googleOAuthTokenURL           = "https://oauth2.googleapis.com/token"
+	googleCloudPlatformScope      = "https://www.googleapis.com/auth/cloud-platform"
+)
@@ -0,0 +1,124 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestGoogleTrustIssuer(t *testing.T) {
+	saKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var createCalls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "malformed assertion", http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&saKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token":"test-token","expires_in":3600}`))
+	})
+	mux.HandleFunc("POST /v1/projects/test-project/locations/global/externalAccountKeys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		createCalls++
+		if createCalls == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"error":{"status":"RESOURCE_EXHAUSTED"}}`, http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"name":"projects/test-project/locations/global/externalAccountKeys/k1","keyId":"k1","b64MacKey":"+/+/"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	keyPEM, err := PEMEncodePrivateKey(saKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saJSON, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "test-project",
+		"private_key":  string(keyPEM),
+		"client_email": "eab@test-project.iam.gserviceaccount.com",
+		"token_uri":    server.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nextCalled bool
+	cfg := &Config{Storage: &memoryStorage{}, Logger: defaultTestLogger}
+	iss, err := GoogleTrustIssuer(cfg, GoogleTrustEAB{
+		ServiceAccountKey: saJSON,
+		Endpoint:          server.URL,
+	}, ACMEIssuer{
+		Logger: defaultTestLogger,
+		NewAccountFunc: func(_ context.Context, iss *ACMEIssuer, acct acme.Account) (acme.Account, error) {
+			nextCalled = iss.ExternalAccount != nil
+			return acct, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iss.CA != GoogleTrustProductionCA {
+		t.Errorf("Expected CA to default to %s, got %s", GoogleTrustProductionCA, iss.CA)
+	}
+
+	if _, err := iss.NewAccountFunc(context.Background(), iss, acme.Account{}); err != nil {
+		t.Fatal(err)
+	}
+	if createCalls != 2 {
+		t.Errorf("Expected a retry after the quota error, got %d calls", createCalls)
+	}
+	if iss.ExternalAccount == nil || iss.ExternalAccount.KeyID != "k1" {
+		t.Fatalf("Expected EAB key k1, got %v", iss.ExternalAccount)
+	}
+	if iss.ExternalAccount.MACKey != "-_-_" {
+		t.Errorf("Expected URL-safe MAC key, got %s", iss.ExternalAccount.MACKey)
+	}
+	if !nextCalled {
+		t.Error("Expected the template's NewAccountFunc to be called with the EAB key set")
+	}
+
+	if _, err := GoogleTrustIssuer(cfg, GoogleTrustEAB{}, ACMEIssuer{}); err == nil {
+		t.Error("Expected an error without credentials")
+	}
+}
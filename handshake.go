@@ -16,19 +16,22 @@ package certmagic
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mholt/acmez/v3"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/crypto/ocsp"
-	"golang.org/x/net/idna"
 )
 
 // GetCertificate gets a certificate to satisfy clientHello. In getting
@@ -51,19 +54,21 @@ func (cfg *Config) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certif
 }
 
 func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if err := cfg.emit(ctx, "tls_get_certificate", map[string]any{"client_hello": clientHelloWithoutConn(clientHello)}); err != nil {
-		cfg.Logger.Error("TLS handshake aborted by event handler",
-			zap.String("server_name", clientHello.ServerName),
-			zap.String("remote", clientHello.Conn.RemoteAddr().String()),
-			zap.Error(err))
-		return nil, fmt.Errorf("handshake aborted by event handler: %w", err)
+	cfg = cfg.current()
+	if cfg.handlesEvent("tls_get_certificate") {
+		if err := cfg.emit(ctx, "tls_get_certificate", map[string]any{"client_hello": clientHelloWithoutConn(clientHello)}); err != nil {
+			cfg.Logger.Error("TLS handshake aborted by event handler",
+				zap.String("server_name", clientHello.ServerName),
+				zap.String("remote", remoteAddr(clientHello)),
+				zap.Error(err))
+			return nil, fmt.Errorf("handshake aborted by event handler: %w", err)
+		}
 	}
 
 	if ctx == nil {
 		// tests can't set context on a tls.ClientHelloInfo because it's unexported :(
 		ctx = context.Background()
 	}
-	ctx = context.WithValue(ctx, ClientHelloInfoCtxKey, clientHello)
 
 	// special case: serve up the certificate for a TLS-ALPN ACME challenge
 	// (https://www.rfc-editor.org/rfc/rfc8737.html)
@@ -76,7 +81,7 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 		challengeCert, distributed, err := cfg.getTLSALPNChallengeCert(clientHello)
 		if err != nil {
 			cfg.Logger.Error("tls-alpn challenge",
-				zap.String("remote_addr", clientHello.Conn.RemoteAddr().String()),
+				zap.String("remote_addr", remoteAddr(clientHello)),
 				zap.String("server_name", clientHello.ServerName),
 				zap.Error(err))
 			return nil, err
@@ -84,15 +89,83 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 		cfg.Logger.Info("served key authentication certificate",
 			zap.String("server_name", clientHello.ServerName),
 			zap.String("challenge", "tls-alpn-01"),
-			zap.String("remote", clientHello.Conn.RemoteAddr().String()),
+			zap.String("remote", remoteAddr(clientHello)),
 			zap.Bool("distributed", distributed))
 		return challengeCert, nil
 	}
 
 	// get the certificate and serve it up
 	cert, err := cfg.getCertDuringHandshake(ctx, clientHello, true)
+	if err == nil {
+		cert, err = cfg.OCSP.forCert(cert).checkStaple(cert)
+		if err != nil {
+			cfg.Logger.Error("refusing to serve certificate without OCSP staple",
+				zap.String("server_name", clientHello.ServerName),
+				zap.Error(err))
+			err = HandshakeError{Kind: ErrNoCertAvailable, Name: clientHello.ServerName, Err: err}
+		}
+	}
+	if err == nil && cfg.RouteConn != nil {
+		if err = cfg.routeConn(ctx, clientHello, cert); err != nil {
+			return nil, err
+		}
+	}
+	if err == nil {
+		cfg.certCache.recordUse(cert.hash)
+	} else if cfg.OnHandshakeFailure != nil {
+		ctx = context.WithValue(ctx, ClientHelloInfoCtxKey, clientHello)
+		return cfg.handshakeFailure(ctx, clientHello, err)
+	}
 
-	return &cert.Certificate, err
+	return cert.tlsCertificate(), err
+}
+
+// RawCertificate is a certificate and its private key, for TLS stacks
+// that don't use crypto/tls, like some QUIC implementations. Its slices
+// are shared with the cache, so they must not be modified.
+//
+// EXPERIMENTAL: Subject to change.
+type RawCertificate struct {
+	// The DER-encoded certificate chain, leaf first.
+	Chain [][]byte
+
+	// The private key of the leaf certificate.
+	Signer crypto.Signer
+
+	// The parsed leaf certificate.
+	Leaf *x509.Certificate
+
+	// The stapled OCSP response, if any.
+	OCSPStaple []byte
+}
+
+// GetCertificateRaw gets a certificate for serverName like GetCertificate
+// does for a ClientHello with it as the SNI value, from the same cache,
+// managers, storage or issuers, including on-demand TLS. It is for TLS
+// stacks that don't use tls.ClientHelloInfo; since it knows nothing else
+// about the client, it can't choose certificates by what the client
+// supports or by the local address.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) GetCertificateRaw(ctx context.Context, serverName string) (RawCertificate, error) {
+	tlsCert, err := cfg.GetCertificateWithContext(ctx, &tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return RawCertificate{}, err
+	}
+	if tlsCert == nil {
+		// OnHandshakeFailure chose RespondUnrecognizedName
+		return RawCertificate{}, HandshakeError{Kind: ErrNoCertAvailable, Name: serverName}
+	}
+	signer, ok := tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return RawCertificate{}, fmt.Errorf("private key of certificate for %s is not a crypto.Signer: %T", serverName, tlsCert.PrivateKey)
+	}
+	return RawCertificate{
+		Chain:      tlsCert.Certificate,
+		Signer:     signer,
+		Leaf:       tlsCert.Leaf,
+		OCSPStaple: tlsCert.OCSPStaple,
+	}, nil
 }
 
 // getCertificateFromCache gets a certificate that matches name from the in-memory
@@ -113,6 +186,12 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 // This function is safe for concurrent use.
 func (cfg *Config) getCertificateFromCache(hello *tls.ClientHelloInfo) (cert Certificate, matched, defaulted bool) {
 	name := normalizedName(hello.ServerName)
+	if name != "" && !cfg.ServerNames.isZero() {
+		// if the name can't be normalized, it doesn't match
+		if ascii, err := cfg.ServerNames.toASCII(hello.ServerName); err == nil {
+			name = normalizedName(ascii)
+		}
+	}
 
 	if name == "" {
 		// if SNI is empty, prefer matching IP address
@@ -132,20 +211,38 @@ func (cfg *Config) getCertificateFromCache(hello *tls.ClientHelloInfo) (cert Cer
 				return
 			}
 		}
+	} else if cfg.CertSelection == nil {
+		// if SNI is specified, the default selection chooses from
+		// the certificates of the exact name if there are any, or
+		// else those of the most specific wildcard name; with room
+		// for one, finding them doesn't allocate
+		var buf [1]Certificate
+		choices, wildcardLabels := cfg.certCache.mostSpecificCerts(buf[:0], name)
+		if len(choices) > 0 {
+			cert, _ = cfg.selectDefault(hello, choices)
+			if logger := cfg.handshakeLoggers().handshake; debugEnabled(logger) {
+				logger.Debug("default certificate selection results",
+					zap.String("identifier", wildcardCandidate(name, wildcardLabels)),
+					zap.Int("num_choices", len(choices)),
+					zap.Strings("subjects", cert.Names),
+					zap.Bool("managed", cert.managed),
+					zap.String("issuer_key", cert.issuerKey),
+					zap.String("hash", cert.hash))
+			}
+			return cert, true, false
+		}
 	} else {
-		// if SNI is specified, try an exact match first
-		cert, matched = cfg.selectCert(hello, name)
+		// try an exact match first
+		exact, wildcards := cfg.certCache.candidateCerts(name)
+		cert, matched = cfg.selectCertFrom(hello, name, exact)
 		if matched {
 			return
 		}
 
 		// try replacing labels in the name with
 		// wildcards until we get a match
-		labels := strings.Split(name, ".")
-		for i := range labels {
-			labels[i] = "*"
-			candidate := strings.Join(labels, ".")
-			cert, matched = cfg.selectCert(hello, candidate)
+		for i, choices := range wildcards {
+			cert, matched = cfg.selectCertFrom(hello, wildcardCandidate(name, i+1), choices)
 			if matched {
 				return
 			}
@@ -184,44 +281,61 @@ func (cfg *Config) getCertificateFromCache(hello *tls.ClientHelloInfo) (cert Cer
 // then all certificates in the cache will be passed in
 // for the cfg.CertSelection to make the final decision.
 func (cfg *Config) selectCert(hello *tls.ClientHelloInfo, name string) (Certificate, bool) {
-	logger := cfg.Logger.Named("handshake")
-	choices := cfg.certCache.getAllMatchingCerts(name)
+	return cfg.selectCertFrom(hello, name, cfg.certCache.getAllMatchingCerts(name))
+}
+
+// selectCertFrom is like selectCert, with the choices
+// of cached certificates for name already found.
+func (cfg *Config) selectCertFrom(hello *tls.ClientHelloInfo, name string, choices []Certificate) (Certificate, bool) {
+	// fields are only built if they are logged
+	logger := cfg.handshakeLoggers().handshake
+	debug := debugEnabled(logger)
 
 	if len(choices) == 0 {
 		if cfg.CertSelection == nil {
-			logger.Debug("no matching certificates and no custom selection logic", zap.String("identifier", name))
+			if debug {
+				logger.Debug("no matching certificates and no custom selection logic", zap.String("identifier", name))
+			}
 			return Certificate{}, false
 		}
-		logger.Debug("no matching certificate; will choose from all certificates", zap.String("identifier", name))
+		if debug {
+			logger.Debug("no matching certificate; will choose from all certificates", zap.String("identifier", name))
+		}
 		choices = cfg.certCache.getAllCerts()
 	}
 
-	logger.Debug("choosing certificate",
-		zap.String("identifier", name),
-		zap.Int("num_choices", len(choices)))
+	if debug {
+		logger.Debug("choosing certificate",
+			zap.String("identifier", name),
+			zap.Int("num_choices", len(choices)))
+	}
 
 	if cfg.CertSelection == nil {
-		cert, err := DefaultCertificateSelector(hello, choices)
-		logger.Debug("default certificate selection results",
+		cert, err := cfg.selectDefault(hello, choices)
+		if debug {
+			logger.Debug("default certificate selection results",
+				zap.Error(err),
+				zap.String("identifier", name),
+				zap.Strings("subjects", cert.Names),
+				zap.Bool("managed", cert.managed),
+				zap.String("issuer_key", cert.issuerKey),
+				zap.String("hash", cert.hash))
+		}
+		return cert, err == nil
+	}
+
+	cert, err := cfg.CertSelection.SelectCertificate(hello, choices)
+
+	if debug {
+		logger.Debug("custom certificate selection results",
 			zap.Error(err),
 			zap.String("identifier", name),
 			zap.Strings("subjects", cert.Names),
 			zap.Bool("managed", cert.managed),
 			zap.String("issuer_key", cert.issuerKey),
 			zap.String("hash", cert.hash))
-		return cert, err == nil
 	}
 
-	cert, err := cfg.CertSelection.SelectCertificate(hello, choices)
-
-	logger.Debug("custom certificate selection results",
-		zap.Error(err),
-		zap.String("identifier", name),
-		zap.Strings("subjects", cert.Names),
-		zap.Bool("managed", cert.managed),
-		zap.String("issuer_key", cert.issuerKey),
-		zap.String("hash", cert.hash))
-
 	return cert, err == nil
 }
 
@@ -238,7 +352,7 @@ func DefaultCertificateSelector(hello *tls.ClientHelloInfo, choices []Certificat
 		return choices[0], nil
 	}
 	if len(choices) == 0 {
-		return Certificate{}, fmt.Errorf("no certificates available")
+		return Certificate{}, HandshakeError{Kind: ErrNoCertAvailable, Name: hello.ServerName}
 	}
 
 	// Slow path: There are choices, so we need to check each of them.
@@ -270,25 +384,42 @@ func DefaultCertificateSelector(hello *tls.ClientHelloInfo, choices []Certificat
 //
 // This function is safe for concurrent use.
 func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.ClientHelloInfo, loadOrObtainIfNecessary bool) (Certificate, error) {
-	logger := logWithRemote(cfg.Logger.Named("handshake"), hello)
-
-	// First check our in-memory cache to see if we've already loaded it
+	// First check our in-memory cache to see if we've already loaded it;
+	// that is most handshakes, so it doesn't allocate unless it logs
 	cert, matched, defaulted := cfg.getCertificateFromCache(hello)
 	if matched {
-		logger.Debug("matched certificate in cache",
-			zap.Strings("subjects", cert.Names),
-			zap.Bool("managed", cert.managed),
-			zap.Time("expiration", expiresAt(cert.Leaf)),
-			zap.String("hash", cert.hash))
+		if logger := cfg.handshakeLoggers().handshake; debugEnabled(logger) {
+			logWithRemote(logger, hello).Debug("matched certificate in cache",
+				zap.Strings("subjects", cert.Names),
+				zap.Bool("managed", cert.managed),
+				zap.Time("expiration", expiresAt(cert.Leaf)),
+				zap.String("hash", cert.hash))
+		}
 		if cert.managed && cfg.OnDemand != nil && loadOrObtainIfNecessary {
 			// On-demand certificates are maintained in the background, but
 			// maintenance is triggered by handshakes instead of by a timer
 			// as in maintain.go.
-			return cfg.optionalMaintenance(ctx, cfg.Logger.Named("on_demand"), cert, hello)
+			return cfg.optionalMaintenance(ctx, cert, hello)
+		}
+		if cfg.belowMinServingValidity(cert) {
+			ctx = context.WithValue(ctx, ClientHelloInfoCtxKey, hello)
+			return cfg.reloadUnservableCertificate(ctx, logWithRemote(cfg.handshakeLoggers().handshake, hello), hello.ServerName, cert)
 		}
 		return cert, nil
 	}
 
+	ctx = context.WithValue(ctx, ClientHelloInfoCtxKey, hello)
+
+	// serving a default certificate doesn't need
+	// the logger, so it is only built when used
+	var logger *zap.Logger
+	handshakeLogger := func() *zap.Logger {
+		if logger == nil {
+			logger = logWithRemote(cfg.handshakeLoggers().handshake, hello)
+		}
+		return logger
+	}
+
 	name, err := cfg.getNameFromClientHello(hello)
 	if err != nil {
 		return Certificate{}, err
@@ -303,15 +434,8 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 		// another goroutine is already loading the cert; just wait and we'll get it from the in-memory cache
 		certLoadWaitChansMu.Unlock()
 
-		timeout := time.NewTimer(2 * time.Minute)
-		select {
-		case <-timeout.C:
-			return Certificate{}, fmt.Errorf("timed out waiting to load certificate for %s", name)
-		case <-ctx.Done():
-			timeout.Stop()
-			return Certificate{}, ctx.Err()
-		case <-wait:
-			timeout.Stop()
+		if err := cfg.waitForHandshake(ctx, wait, name, "waiting to load certificate"); err != nil {
+			return Certificate{}, err
 		}
 
 		return cfg.getCertDuringHandshake(ctx, hello, false)
@@ -332,7 +456,7 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 
 	// If an external Manager is configured, try to get it from them.
 	// Only continue to use our own logic if it returns empty+nil.
-	externalCert, err := cfg.getCertFromAnyCertManager(ctx, hello, logger)
+	externalCert, err := cfg.getCertFromAnyCertManager(ctx, hello)
 	if err != nil {
 		return Certificate{}, err
 	}
@@ -343,15 +467,13 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 	// Make sure a certificate is allowed for the given name. If not, it doesn't make sense
 	// to try loading one from storage (issue #185) or obtaining one from an issuer.
 	if err := cfg.checkIfCertShouldBeObtained(ctx, name, false); err != nil {
-		return Certificate{}, fmt.Errorf("certificate is not allowed for server name %s: %w", name, err)
+		return Certificate{}, HandshakeError{Kind: ErrNameNotAllowed, Name: name, Err: err}
 	}
 
 	// We might be able to load or obtain a needed certificate. Load from
 	// storage if OnDemand is enabled, or if there is the possibility that
 	// a statically-managed cert was evicted from a full cache.
-	cfg.certCache.mu.RLock()
-	cacheSize := len(cfg.certCache.cache)
-	cfg.certCache.mu.RUnlock()
+	cacheSize := cfg.certCache.cache.len()
 
 	// A cert might have still been evicted from the cache even if the cache
 	// is no longer completely full; this happens if the newly-loaded cert is
@@ -368,11 +490,14 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 
 	if loadDynamically && loadOrObtainIfNecessary {
 		// Check to see if we have one on disk
-		loadedCert, err := cfg.loadCertFromStorage(ctx, logger, hello)
+		loadedCert, err := cfg.loadCertFromStorage(ctx, handshakeLogger(), hello)
 		if err == nil {
+			if cfg.OnDemand != nil && cfg.OnDemand.MaxCertificates != nil {
+				cfg.OnDemand.MaxCertificates.add(loadedCert.Names[0])
+			}
 			return loadedCert, nil
 		}
-		logger.Debug("did not load cert from storage",
+		handshakeLogger().Debug("did not load cert from storage",
 			zap.String("server_name", hello.ServerName),
 			zap.Error(err))
 		if cfg.OnDemand != nil {
@@ -384,24 +509,28 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 
 	// Fall back to another certificate if there is one (either DefaultServerName or FallbackServerName)
 	if defaulted {
-		logger.Debug("fell back to default certificate",
-			zap.Strings("subjects", cert.Names),
-			zap.Bool("managed", cert.managed),
-			zap.Time("expiration", expiresAt(cert.Leaf)),
-			zap.String("hash", cert.hash))
+		if debugEnabled(cfg.handshakeLoggers().handshake) {
+			handshakeLogger().Debug("fell back to default certificate",
+				zap.Strings("subjects", cert.Names),
+				zap.Bool("managed", cert.managed),
+				zap.Time("expiration", expiresAt(cert.Leaf)),
+				zap.String("hash", cert.hash))
+		}
 		return cert, nil
 	}
 
-	logger.Debug("no certificate matching TLS ClientHello",
-		zap.String("server_name", hello.ServerName),
-		zap.String("remote", hello.Conn.RemoteAddr().String()),
-		zap.String("identifier", name),
-		zap.Uint16s("cipher_suites", hello.CipherSuites),
-		zap.Float64("cert_cache_fill", float64(cacheSize)/cacheCapacity), // may be approximate! because we are not within the lock
-		zap.Bool("load_or_obtain_if_necessary", loadOrObtainIfNecessary),
-		zap.Bool("on_demand", cfg.OnDemand != nil))
+	if debugEnabled(cfg.handshakeLoggers().handshake) {
+		handshakeLogger().Debug("no certificate matching TLS ClientHello",
+			zap.String("server_name", hello.ServerName),
+			zap.String("remote", remoteAddr(hello)),
+			zap.String("identifier", name),
+			zap.Uint16s("cipher_suites", hello.CipherSuites),
+			zap.Float64("cert_cache_fill", float64(cacheSize)/cacheCapacity), // may be approximate! because we are not within the lock
+			zap.Bool("load_or_obtain_if_necessary", loadOrObtainIfNecessary),
+			zap.Bool("on_demand", cfg.OnDemand != nil))
+	}
 
-	return Certificate{}, fmt.Errorf("no certificate available for '%s'", name)
+	return Certificate{}, HandshakeError{Kind: ErrNoCertAvailable, Name: name}
 }
 
 // loadCertFromStorage loads the certificate for name from storage and maintains it
@@ -419,7 +548,7 @@ func (cfg *Config) loadCertFromStorage(ctx context.Context, logger *zap.Logger,
 		loadedCert, err = cfg.CacheManagedCertificate(ctx, strings.Join(labels, "."))
 	}
 	if err != nil {
-		return Certificate{}, fmt.Errorf("no matching certificate to load for %s: %w", name, err)
+		return Certificate{}, HandshakeError{Kind: ErrNoCertAvailable, Name: name, Err: fmt.Errorf("loading from storage: %w", err)}
 	}
 	logger.Debug("loaded certificate from storage",
 		zap.Strings("subjects", loadedCert.Names),
@@ -435,21 +564,75 @@ func (cfg *Config) loadCertFromStorage(ctx context.Context, logger *zap.Logger,
 	return loadedCert, nil
 }
 
+// belowMinServingValidity returns true if cert has less validity left
+// than the configured MinServingValidity, making it unusable for new
+// handshakes.
+func (cfg *Config) belowMinServingValidity(cert Certificate) bool {
+	if cfg.MinServingValidity <= 0 || cert.Leaf == nil {
+		return false
+	}
+	return time.Until(expiresAt(cert.Leaf)) < cfg.MinServingValidity
+}
+
+// reloadUnservableCertificate is called for a certificate which is
+// below the minimum serving validity. If it is managed, it may have
+// been renewed by another instance, so it is reloaded from storage,
+// at most once per unservableReloadInterval so that a spike of
+// handshakes doesn't become a spike of storage reads; if the result
+// still can't be served, an error is returned.
+func (cfg *Config) reloadUnservableCertificate(ctx context.Context, logger *zap.Logger, serverName string, cert Certificate) (Certificate, error) {
+	if cert.managed && cfg.certCache.startUnservableReload(cert.hash) {
+		newCert, err := cfg.reloadManagedCertificate(ctx, cert)
+		if err != nil {
+			logger.Error("reloading certificate below minimum serving validity",
+				zap.Strings("subjects", cert.Names),
+				zap.Error(err))
+		} else {
+			cert = newCert
+		}
+	}
+	if cfg.belowMinServingValidity(cert) {
+		return Certificate{}, HandshakeError{
+			Kind: ErrNoCertAvailable,
+			Name: serverName,
+			Err: fmt.Errorf("certificate for %v expires at %s, which is within the minimum serving validity of %s",
+				cert.Names, expiresAt(cert.Leaf), cfg.MinServingValidity),
+		}
+	}
+	return cert, nil
+}
+
+// startUnservableReload returns true if the certificate with hash, which
+// is below the minimum serving validity, should be reloaded now, because
+// it wasn't within the last unservableReloadInterval.
+func (certCache *Cache) startUnservableReload(hash string) bool {
+	now := time.Now()
+	var reload bool
+	certCache.unservableReloads.compute(hash, func(last time.Time, ok bool) (time.Time, bool) {
+		if ok && now.Sub(last) < unservableReloadInterval {
+			return last, true
+		}
+		reload = true
+		return now, true
+	})
+	return reload
+}
+
 // optionalMaintenance will perform maintenance on the certificate (if necessary) and
 // will return the resulting certificate. This should only be done if the certificate
 // is managed, OnDemand is enabled, and the scope is allowed to obtain certificates.
-func (cfg *Config) optionalMaintenance(ctx context.Context, log *zap.Logger, cert Certificate, hello *tls.ClientHelloInfo) (Certificate, error) {
+func (cfg *Config) optionalMaintenance(ctx context.Context, cert Certificate, hello *tls.ClientHelloInfo) (Certificate, error) {
 	newCert, err := cfg.handshakeMaintenance(ctx, hello, cert)
 	if err == nil {
 		return newCert, nil
 	}
 
-	log.Error("renewing certificate on-demand failed",
+	cfg.handshakeLoggers().onDemand.Error("renewing certificate on-demand failed",
 		zap.Strings("subjects", cert.Names),
 		zap.Time("not_after", expiresAt(cert.Leaf)),
 		zap.Error(err))
 
-	if cert.Expired() {
+	if cert.Expired() || cfg.belowMinServingValidity(cert) {
 		return cert, err
 	}
 
@@ -467,11 +650,27 @@ func (cfg *Config) checkIfCertShouldBeObtained(ctx context.Context, name string,
 	if !SubjectQualifiesForCert(name) {
 		return fmt.Errorf("subject name does not qualify for certificate: %s", name)
 	}
+	if cfg.ECH.isPublicName(name) {
+		// the ECH public name is ours, not the client's choice
+		return nil
+	}
 	if cfg.OnDemand != nil {
 		if cfg.OnDemand.DecisionFunc != nil {
 			if err := cfg.OnDemand.DecisionFunc(ctx, name); err != nil {
 				return fmt.Errorf("decision func: %w", err)
 			}
+		}
+		if cfg.OnDemand.Permission != nil {
+			if err := cfg.OnDemand.Permission.CertificateAllowed(withConfig(ctx, cfg), name); err != nil {
+				return fmt.Errorf("permission: %w", err)
+			}
+		}
+		if cfg.OnDemand.Destination != nil {
+			if err := cfg.OnDemand.Destination.CertificateAllowed(withConfig(ctx, cfg), name); err != nil {
+				return fmt.Errorf("destination: %w", err)
+			}
+		}
+		if cfg.OnDemand.DecisionFunc != nil || cfg.OnDemand.Permission != nil {
 			return nil
 		}
 		if len(cfg.OnDemand.hostAllowlist) > 0 {
@@ -483,19 +682,47 @@ func (cfg *Config) checkIfCertShouldBeObtained(ctx context.Context, name string,
 	return nil
 }
 
+// wildcardFor returns the wildcard name to obtain a certificate for
+// instead of name, if name is a subdomain of one of the WildcardDomains
+// (but not of a subdomain of it); otherwise it returns "".
+func (o *OnDemandConfig) wildcardFor(name string) string {
+	if o == nil || len(o.WildcardDomains) == 0 || strings.HasPrefix(name, "*.") {
+		return ""
+	}
+	label, parent, ok := strings.Cut(name, ".")
+	if !ok || label == "" {
+		return ""
+	}
+	for _, domain := range o.WildcardDomains {
+		if strings.EqualFold(strings.Trim(domain, "."), parent) {
+			return "*." + parent
+		}
+	}
+	return ""
+}
+
 // obtainOnDemandCertificate obtains a certificate for hello.
 // If another goroutine has already started obtaining a cert for
 // hello, it will wait and use what the other goroutine obtained.
 //
 // This function is safe for use by multiple concurrent goroutines.
 func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.ClientHelloInfo) (Certificate, error) {
-	log := logWithRemote(cfg.Logger.Named("on_demand"), hello)
+	log := logWithRemote(cfg.handshakeLoggers().onDemand, hello)
 
 	name, err := cfg.getNameFromClientHello(hello)
 	if err != nil {
 		return Certificate{}, err
 	}
 
+	// if subdomains of the name's parent share a wildcard certificate,
+	// obtain that instead (and wait for others who are obtaining it)
+	if wildcard := cfg.OnDemand.wildcardFor(name); wildcard != "" {
+		log.Debug("obtaining wildcard certificate instead",
+			zap.String("server_name", name),
+			zap.String("wildcard", wildcard))
+		name = wildcard
+	}
+
 	// We must protect this process from happening concurrently, so synchronize.
 	obtainCertWaitChansMu.Lock()
 	wait, ok := obtainCertWaitChans[name]
@@ -507,13 +734,8 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 		log.Debug("new certificate is needed, but is already being obtained; waiting for that issuance to complete",
 			zap.String("subject", name))
 
-		// TODO: see if we can get a proper context in here, for true cancellation
-		timeout := time.NewTimer(2 * time.Minute)
-		select {
-		case <-timeout.C:
-			return Certificate{}, fmt.Errorf("timed out waiting to obtain certificate for %s", name)
-		case <-wait:
-			timeout.Stop()
+		if err := cfg.waitForHandshake(ctx, wait, name, "waiting for certificate to be obtained"); err != nil {
+			return Certificate{}, err
 		}
 
 		// it should now be loaded in the cache, ready to go; if not,
@@ -521,7 +743,18 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 		return cfg.getCertDuringHandshake(ctx, hello, false)
 	}
 
-	// looks like it's up to us to do all the work and obtain the cert.
+	// looks like it's up to us to do all the work and obtain the cert,
+	// but first make sure we are allowed to start a new operation
+	if cfg.OnDemand != nil && cfg.OnDemand.RateLimit != nil {
+		done, err := cfg.OnDemand.RateLimit.start(hello, name)
+		if err != nil {
+			obtainCertWaitChansMu.Unlock()
+			log.Warn("refusing to obtain certificate", zap.String("server_name", name), zap.Error(err))
+			return Certificate{}, err
+		}
+		defer done()
+	}
+
 	// make a chan others can wait on if needed
 	wait = make(chan struct{})
 	obtainCertWaitChans[name] = wait
@@ -537,18 +770,45 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 	log.Info("obtaining new certificate", zap.String("server_name", name))
 
 	// set a timeout so we don't inadvertently hold a client handshake open too long
-	// (timeout duration is based on https://caddy.community/t/zerossl-dns-challenge-failing-often-route53-plugin/13822/24?u=matt)
 	var cancel context.CancelFunc
-	ctx, cancel = context.WithTimeout(ctx, 180*time.Second)
+	ctx, cancel = withTimeout(ctx, cfg.HandshakeTimeouts.obtain())
 	defer cancel()
 
+	// make sure there is room for another certificate
+	var cert Certificate
+	if budget := cfg.OnDemand.MaxCertificates; budget != nil {
+		done, err := budget.reserve(ctx, cfg, name)
+		if err != nil {
+			unblockWaiters()
+			log.Warn("refusing to obtain certificate", zap.String("server_name", name), zap.Error(err))
+			return Certificate{}, err
+		}
+		defer func() { done(cert) }()
+	}
+
+	// let other instances finish obtaining the certificate, if they are
+	if cfg.OnDemand.CoordinateInstances {
+		var release func()
+		cert, release, err = cfg.coordinateOnDemandObtain(ctx, log, hello, name)
+		if err != nil || release == nil {
+			unblockWaiters()
+			return cert, issuanceHandshakeError(name, err)
+		}
+		defer release()
+	}
+
 	// obtain the certificate (this puts it in storage) and if successful,
 	// load it from storage so we and any other waiting goroutine can use it
-	var cert Certificate
+	ctx, timer, ownTimer := withIssuanceTimer(ctx, false)
+	if ownTimer {
+		defer timer.finish(cfg.certCache)
+	}
 	err = cfg.ObtainCertAsync(ctx, name)
 	if err == nil {
 		// load from storage while others wait to make the op as atomic as possible
+		stopCacheLoad := timer.track(cacheLoadPhase)
 		cert, err = cfg.loadCertFromStorage(ctx, log, hello)
+		stopCacheLoad()
 		if err != nil {
 			log.Error("loading newly-obtained certificate from storage", zap.String("server_name", name), zap.Error(err))
 		}
@@ -557,7 +817,38 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 	// immediately unblock anyone waiting for it
 	unblockWaiters()
 
-	return cert, err
+	return cert, issuanceHandshakeError(name, err)
+}
+
+// coordinateOnDemandObtain acquires the lock in storage that coordinates
+// obtaining the certificate for name on demand with other instances. If
+// another instance obtained the certificate while this one waited for the
+// lock, it returns that certificate; otherwise it returns a function that
+// releases the lock after the certificate has been obtained.
+func (cfg *Config) coordinateOnDemandObtain(ctx context.Context, log *zap.Logger, hello *tls.ClientHelloInfo, name string) (Certificate, func(), error) {
+	lockKey := cfg.lockKey(onDemandObtainLockOp, name)
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return Certificate{}, nil, fmt.Errorf("unable to acquire lock '%s': %w", lockKey, err)
+	}
+	release := func() {
+		// the handshake's context may be done by now
+		if err := releaseLock(context.WithoutCancel(ctx), cfg.Storage, lockKey); err != nil {
+			log.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}
+
+	if !cfg.storageHasCertResourcesAnyIssuer(ctx, name) {
+		return Certificate{}, release, nil
+	}
+	defer release()
+
+	log.Debug("certificate was obtained by another instance; loading it from storage",
+		zap.String("server_name", name))
+	cert, err := cfg.loadCertFromStorage(ctx, log, hello)
+	if err != nil {
+		return Certificate{}, nil, fmt.Errorf("loading certificate obtained by another instance: %w", err)
+	}
+	return cert, nil, nil
 }
 
 // handshakeMaintenance performs a check on cert for expiration and OCSP validity.
@@ -566,7 +857,13 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 //
 // This function is safe for use by multiple concurrent goroutines.
 func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHelloInfo, cert Certificate) (Certificate, error) {
-	logger := cfg.Logger.Named("on_demand").With(
+	// usually there is nothing to do, and preparing to do it allocates
+	if !cfg.needsHandshakeMaintenance(cert) {
+		return cert, nil
+	}
+	ctx = context.WithValue(ctx, ClientHelloInfoCtxKey, hello)
+
+	logger := cfg.handshakeLoggers().onDemand.With(
 		zap.Strings("identifiers", cert.Names),
 		zap.String("server_name", hello.ServerName))
 
@@ -574,7 +871,7 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 		if cert.Leaf == nil {
 			return cert, fmt.Errorf("leaf certificate is unexpectedly nil: either the Certificate got replaced by an empty value, or it was not properly initialized")
 		}
-		if cfg.certNeedsRenewal(cert.Leaf, cert.ari, true) {
+		if cfg.certNeedsRenewal(cert.Leaf, cert.ari, true) || cfg.belowMinServingValidity(cert) {
 			// Check if the certificate still exists on disk. If not, we need to obtain a new one.
 			// This can happen if the certificate was cleaned up by the storage cleaner, but still
 			// remains in the in-memory cache.
@@ -595,7 +892,7 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 			zap.Time("this_update", cert.ocsp.ThisUpdate),
 			zap.Time("next_update", cert.ocsp.NextUpdate))
 
-		err := stapleOCSP(ctx, cfg.OCSP, cfg.Storage, &cert, nil)
+		err := stapleOCSP(ctx, cfg.ocspConfig(), cfg.Storage, &cert, nil)
 		if err != nil {
 			// An error with OCSP stapling is not the end of the world, and in fact, is
 			// quite common considering not all certs have issuer URLs that support it.
@@ -607,10 +904,12 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 				zap.Time("next_update", cert.ocsp.NextUpdate))
 		}
 
-		// our copy of cert has the new OCSP staple, so replace it in the cache
-		cfg.certCache.mu.Lock()
-		cfg.certCache.cache[cert.hash] = cert
-		cfg.certCache.mu.Unlock()
+		// our copy of cert has the new OCSP staple, so update it in the cache
+		cfg.certCache.updateCertificate(cert.hash, func(cached *Certificate) {
+			cached.ocsp = cert.ocsp
+			cached.Certificate.OCSPStaple = cert.Certificate.OCSPStaple
+			cached.ocspFailingSince = cert.ocspFailingSince
+		})
 	}
 
 	// Check ARI status, but it's only relevant if the certificate is not expired (otherwise, we already know it needs renewal!)
@@ -620,13 +919,10 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 		// the new ARI, it is also updated in the cache and in storage, so future handshakes
 		// will utilize it
 		go func(hello *tls.ClientHelloInfo, cert Certificate, logger *zap.Logger) {
-			// TODO: a different context that isn't tied to the handshake is probably better
-			// than a generic background context; maybe a longer-lived server config context,
-			// or something that the importing package sets on the Config struct; for example,
-			// a Caddy config context could be good, so that ARI updates will continue after
-			// the handshake goes away, but will be stopped if the underlying server is stopped
-			// (for now, use an unusual timeout to help recognize it in log patterns, if needed)
-			ctx, cancel := context.WithTimeout(context.Background(), 8*time.Minute)
+			// not tied to the handshake, so that ARI updates continue after it goes
+			// away, but stopped along with the server if it cancels cfg.Context
+			// (the unusual timeout helps recognize it in log patterns, if needed)
+			ctx, cancel := cfg.backgroundContext(8 * time.Minute)
 			defer cancel()
 
 			var err error
@@ -657,6 +953,17 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 	return renewIfNecessary(ctx, hello, cert)
 }
 
+// needsHandshakeMaintenance returns whether handshakeMaintenance
+// has anything to do for cert.
+func (cfg *Config) needsHandshakeMaintenance(cert Certificate) bool {
+	return cert.Leaf == nil ||
+		(cert.ocsp != nil && !freshOCSP(cert.ocsp)) ||
+		(!cfg.DisableARI && cert.ari.NeedsRefresh() && time.Now().Before(cert.Leaf.NotAfter)) ||
+		certShouldBeForceRenewed(cert) ||
+		cfg.certNeedsRenewal(cert.Leaf, cert.ari, false) ||
+		cfg.belowMinServingValidity(cert)
+}
+
 // renewDynamicCertificate renews the certificate for name using cfg. It returns the
 // certificate to use and an error, if any. name should already be lower-cased before
 // calling this function. name is the name obtained directly from the handshake's
@@ -669,7 +976,7 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 //
 // This function is safe for use by multiple concurrent goroutines.
 func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.ClientHelloInfo, currentCert Certificate) (Certificate, error) {
-	logger := logWithRemote(cfg.Logger.Named("on_demand"), hello)
+	logger := logWithRemote(cfg.handshakeLoggers().onDemand, hello)
 
 	name, err := cfg.getNameFromClientHello(hello)
 	if err != nil {
@@ -688,7 +995,7 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 		// the current certificate hasn't expired, and another goroutine is already
 		// renewing it, so we might as well serve what we have without blocking, UNLESS
 		// we're forcing renewal, in which case the current certificate is not usable
-		if timeLeft > 0 && !revoked {
+		if timeLeft > cfg.MinServingValidity && !revoked {
 			logger.Debug("certificate expires soon but is already being renewed; serving current certificate",
 				zap.Strings("subjects", currentCert.Names),
 				zap.Duration("remaining", timeLeft))
@@ -703,13 +1010,8 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 			zap.Time("expired", expiresAt(currentCert.Leaf)),
 			zap.Bool("revoked", revoked))
 
-		// TODO: see if we can get a proper context in here, for true cancellation
-		timeout := time.NewTimer(2 * time.Minute)
-		select {
-		case <-timeout.C:
-			return Certificate{}, fmt.Errorf("timed out waiting for certificate renewal of %s", name)
-		case <-wait:
-			timeout.Stop()
+		if err := cfg.waitForHandshake(ctx, wait, name, "waiting for certificate renewal"); err != nil {
+			return Certificate{}, err
 		}
 
 		// it should now be loaded in the cache, ready to go; if not,
@@ -754,7 +1056,7 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 				logger.Error("certificate should not be obtained", zap.Error(err))
 			}
 
-			return Certificate{}, err
+			return Certificate{}, HandshakeError{Kind: ErrNameNotAllowed, Name: name, Err: err}
 		}
 
 		logger.Info("attempting certificate renewal")
@@ -780,29 +1082,31 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 			logger.Error("renewing and reloading certificate", zap.String("server_name", name), zap.Error(err))
 		}
 
-		return newCert, err
+		return newCert, issuanceHandshakeError(name, err)
 	}
 
-	// if the certificate hasn't expired, we can serve what we have and renew in the background
-	if timeLeft > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	// if the certificate hasn't expired (and has enough validity left to be
+	// served), we can serve what we have and renew in the background
+	if timeLeft > cfg.MinServingValidity {
+		ctx, cancel := cfg.backgroundContext(5 * time.Minute)
 		go renewAndReload(ctx, cancel)
 		return currentCert, nil
 	}
 
 	// otherwise, we have to block while we renew an expired certificate
-	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	ctx, cancel := withTimeout(ctx, cfg.HandshakeTimeouts.renew())
 	return renewAndReload(ctx, cancel)
 }
 
 // getCertFromAnyCertManager gets a certificate from cfg's Managers. If there are no Managers defined, this is
 // a no-op that returns empty values. Otherwise, it gets a certificate for hello from the first Manager that
 // returns a certificate and no error.
-func (cfg *Config) getCertFromAnyCertManager(ctx context.Context, hello *tls.ClientHelloInfo, logger *zap.Logger) (Certificate, error) {
+func (cfg *Config) getCertFromAnyCertManager(ctx context.Context, hello *tls.ClientHelloInfo) (Certificate, error) {
 	// fast path if nothing to do
 	if cfg.OnDemand == nil || len(cfg.OnDemand.Managers) == 0 {
 		return Certificate{}, nil
 	}
+	logger := logWithRemote(cfg.handshakeLoggers().handshake, hello)
 
 	// try all the GetCertificate methods on external managers; use first one that returns a certificate
 	var upstreamCert *tls.Certificate
@@ -833,6 +1137,7 @@ func (cfg *Config) getCertFromAnyCertManager(ctx context.Context, hello *tls.Cli
 	if err = fillCertFromLeaf(&cert, *upstreamCert); err != nil {
 		return Certificate{}, fmt.Errorf("external certificate manager: %s: filling cert from leaf: %v", hello.ServerName, err)
 	}
+	cfg.completeChain(ctx, &cert)
 
 	logger.Debug("using externally-managed certificate",
 		zap.String("sni", hello.ServerName),
@@ -868,6 +1173,9 @@ func (cfg *Config) getTLSALPNChallengeCert(clientHello *tls.ClientHelloInfo) (*t
 	if cert == nil {
 		return nil, distributed, fmt.Errorf("got nil TLS-ALPN challenge certificate but no error")
 	}
+	if distributed {
+		distributedChallenges.setData(clientHello.ServerName, chalData.Token, cert)
+	}
 
 	return cert, distributed, nil
 }
@@ -881,8 +1189,9 @@ func (cfg *Config) getNameFromClientHello(hello *tls.ClientHelloInfo) (string, e
 	// using profile recommended by RFC 5891 section 5; this solves the "σςΣ" problem
 	// (see https://unicode.org/faq/idn.html#22) where not all normalizations are 1:1.
 	// The Lookup profile, for instance, rejects wildcard characters (*), but they
-	// should never be used in the ClientHello SNI anyway.
-	name, err := idna.Lookup.ToASCII(strings.TrimSpace(hello.ServerName))
+	// should never be used in the ClientHello SNI anyway. The ServerNames policy
+	// may choose another profile for clients that send nonstandard names.
+	name, err := cfg.ServerNames.toASCII(hello.ServerName)
 	if err != nil {
 		return "", err
 	}
@@ -895,6 +1204,40 @@ func (cfg *Config) getNameFromClientHello(hello *tls.ClientHelloInfo) (string, e
 	return localIPFromConn(hello.Conn), nil
 }
 
+// handshakeLoggers are the loggers of the handshake
+// path, named after the logger of a config.
+type handshakeLoggers struct {
+	base, handshake, onDemand *zap.Logger
+}
+
+// handshakeLoggers returns the loggers of the handshake path. For
+// configs made with New, they are built once for each logger instead
+// of for every handshake.
+func (cfg *Config) handshakeLoggers() *handshakeLoggers {
+	if cfg.handshakeLogs != nil {
+		if l := cfg.handshakeLogs.Load(); l != nil && l.base == cfg.Logger {
+			return l
+		}
+	}
+	l := &handshakeLoggers{
+		base:      cfg.Logger,
+		handshake: cfg.Logger.Named("handshake"),
+		onDemand:  cfg.Logger.Named("on_demand"),
+	}
+	if cfg.handshakeLogs != nil {
+		cfg.handshakeLogs.Store(l)
+	}
+	return l
+}
+
+// debugEnabled returns whether l logs debug messages. Building loggers
+// and their fields allocates, which the handshake path avoids unless
+// they are logged. Debug logging of the handshake path is gated on
+// the handshake logger (see handshakeLoggers), which it logs with.
+func debugEnabled(l *zap.Logger) bool {
+	return l.Core().Enabled(zapcore.DebugLevel)
+}
+
 // logWithRemote adds the remote host and port to the logger.
 func logWithRemote(l *zap.Logger, hello *tls.ClientHelloInfo) *zap.Logger {
 	if hello.Conn == nil || l == nil {
@@ -909,6 +1252,15 @@ func logWithRemote(l *zap.Logger, hello *tls.ClientHelloInfo) *zap.Logger {
 	return l.With(zap.String("remote_ip", ip), zap.String("remote_port", port))
 }
 
+// remoteAddr returns the remote address of the connection of hello,
+// if it has one.
+func remoteAddr(hello *tls.ClientHelloInfo) string {
+	if hello.Conn == nil {
+		return ""
+	}
+	return hello.Conn.RemoteAddr().String()
+}
+
 // localIPFromConn returns the host portion of c's local address
 // and strips the scope ID if one exists (see RFC 4007).
 func localIPFromConn(c net.Conn) string {
@@ -933,7 +1285,31 @@ func localIPFromConn(c net.Conn) string {
 // normalizedName returns a cleaned form of serverName that is
 // used for consistency when referring to a SNI value.
 func normalizedName(serverName string) string {
-	return strings.ToLower(strings.TrimSpace(serverName))
+	if SubjectIsURI(strings.TrimSpace(serverName)) {
+		return strings.TrimSpace(serverName) // URIs are case-sensitive
+	}
+	name := strings.ToLower(strings.TrimSpace(serverName))
+	// IP addresses have many spellings, but are looked up
+	// by the canonical one, e.g. from the connection's
+	// local address when there is no SNI; only names that
+	// may be one are parsed, since failing to allocates
+	if !mayBeIP(name) {
+		return name
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")); err == nil && ip.Zone() == "" {
+		return ip.Unmap().String()
+	}
+	return name
+}
+
+// mayBeIP returns false if name is certainly not an IP address:
+// IPv6 addresses have colons, and IPv4 addresses end in a digit,
+// which no top-level domain does.
+func mayBeIP(name string) bool {
+	if strings.Contains(name, ":") {
+		return true
+	}
+	return name != "" && name[len(name)-1] >= '0' && name[len(name)-1] <= '9'
 }
 
 // obtainCertWaitChans is used to coordinate obtaining certs for each hostname.
@@ -996,3 +1372,7 @@ type helloInfoCtxKey string
 // For example, it is not advisable to use a client's IP address to decide whether to
 // allow a certificate. Instead, the ClientHello can be useful for logging, etc.
 const ClientHelloInfoCtxKey helloInfoCtxKey = "certmagic:ClientHelloInfo"
+
+// unservableReloadInterval is how often a managed certificate below the
+// minimum serving validity is reloaded from storage during handshakes.
+const unservableReloadInterval = time.Minute
@@ -14,17 +14,26 @@
 package certmagic
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestGetCertificate(t *testing.T) {
 	c := &Cache{
-		cache:      make(map[string]Certificate),
-		cacheIndex: make(map[string][]string),
-		logger:     defaultTestLogger,
+		logger: defaultTestLogger,
 	}
 	cfg := &Config{Logger: defaultTestLogger, certCache: c}
 
@@ -106,3 +115,521 @@ func TestGetCertificate(t *testing.T) {
 		t.Errorf("Expected IP cert, got: %v", cert)
 	}
 }
+
+func TestMinServingValidity(t *testing.T) {
+	c := &Cache{
+		logger: defaultTestLogger,
+	}
+	cfg := &Config{Logger: defaultTestLogger, certCache: c, MinServingValidity: 24 * time.Hour}
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+
+	c.cacheCertificate(Certificate{
+		Names:       []string{"example.com"},
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{DNSNames: []string{"example.com"}, NotAfter: time.Now().Add(time.Hour)}},
+	})
+	if _, err := cfg.GetCertificate(hello); err == nil {
+		t.Error("Expected error for certificate below minimum serving validity")
+	}
+
+	cfg.MinServingValidity = 0
+	if _, err := cfg.GetCertificate(hello); err != nil {
+		t.Errorf("Expected certificate to be served without minimum validity, got: %v", err)
+	}
+}
+
+// loadCountingStorage counts loads from storage.
+type loadCountingStorage struct {
+	*FileStorage
+	loads atomic.Int32
+}
+
+func (s *loadCountingStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	s.loads.Add(1)
+	return s.FileStorage.Load(ctx, key)
+}
+
+func TestMinServingValidityReloadThrottled(t *testing.T) {
+	storage := &loadCountingStorage{FileStorage: &FileStorage{Path: t.TempDir()}}
+	c := &Cache{logger: defaultTestLogger}
+	cfg := &Config{
+		Logger:             defaultTestLogger,
+		Storage:            storage,
+		Issuers:            []Issuer{&testIssuer{}},
+		certCache:          c,
+		MinServingValidity: 24 * time.Hour,
+	}
+	c.cacheCertificate(Certificate{
+		Names:       []string{"example.com"},
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{DNSNames: []string{"example.com"}, NotAfter: time.Now().Add(time.Hour)}},
+		managed:     true,
+		hash:        "abc",
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	for i := 0; i < 3; i++ {
+		if _, err := cfg.GetCertificate(hello); !errors.Is(err, ErrNoCertAvailable) {
+			t.Fatalf("Expected ErrNoCertAvailable, got: %v", err)
+		}
+	}
+	loads := storage.loads.Load()
+	if loads == 0 {
+		t.Fatal("Expected certificate to be reloaded from storage")
+	}
+
+	// the next handshakes fail fast instead of reading storage again
+	if _, err := cfg.GetCertificate(hello); err == nil {
+		t.Fatal("Expected error")
+	}
+	if n := storage.loads.Load(); n != loads {
+		t.Errorf("Expected reloads to be throttled, got %d loads, then %d", loads, n)
+	}
+}
+
+func TestNormalizedName(t *testing.T) {
+	for i, tc := range []struct{ input, expect string }{
+		{input: " Example.COM ", expect: "example.com"},
+		{input: "192.0.2.1", expect: "192.0.2.1"},
+		{input: "2001:DB8:0:0::1", expect: "2001:db8::1"},
+		{input: "[2001:db8::1]", expect: "2001:db8::1"},
+		{input: "::ffff:192.0.2.1", expect: "192.0.2.1"},
+		{input: "fe80::1%eth0", expect: "fe80::1%eth0"},
+	} {
+		if actual := normalizedName(tc.input); actual != tc.expect {
+			t.Errorf("Test %d: Expected %q to normalize to %q, got %q", i, tc.input, tc.expect, actual)
+		}
+	}
+}
+
+func TestOnDemandWildcardDomains(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	var allowed []string
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(_ context.Context, name string) error {
+				allowed = append(allowed, name)
+				return nil
+			},
+			WildcardDomains: []string{"Example.com."},
+		},
+	})
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	for _, name := range []string{"foo.example.com", "bar.example.com"} {
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: name, Conn: conn})
+		if err != nil {
+			t.Fatalf("Getting certificate for %s: %v", name, err)
+		}
+		if cert.Leaf == nil || len(cert.Leaf.DNSNames) != 1 || cert.Leaf.DNSNames[0] != "*.example.com" {
+			t.Fatalf("Expected wildcard certificate for %s, got %v", name, cert.Leaf)
+		}
+	}
+	if len(allowed) != 1 || allowed[0] != "foo.example.com" {
+		t.Errorf("Expected only the first requested name to be checked, got %v", allowed)
+	}
+	if count := cache.cache.len(); count != 1 {
+		t.Errorf("Expected one certificate in cache, got %d", count)
+	}
+}
+
+func TestOnDemandWildcardFor(t *testing.T) {
+	o := &OnDemandConfig{WildcardDomains: []string{"example.com", "tenants.example.net"}}
+	for i, tc := range []struct{ name, expect string }{
+		{name: "foo.example.com", expect: "*.example.com"},
+		{name: "example.com", expect: ""},
+		{name: "a.foo.example.com", expect: ""},
+		{name: "*.example.com", expect: ""},
+		{name: "foo.tenants.example.net", expect: "*.tenants.example.net"},
+		{name: "foo.example.net", expect: ""},
+	} {
+		if actual := o.wildcardFor(tc.name); actual != tc.expect {
+			t.Errorf("Test %d: Expected wildcard for %q to be %q, got %q", i, tc.name, tc.expect, actual)
+		}
+	}
+	if (*OnDemandConfig)(nil).wildcardFor("foo.example.com") != "" {
+		t.Error("Expected no wildcard without on-demand config")
+	}
+}
+
+func TestHandshakeTimeouts(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:           []Issuer{&testIssuer{delay: time.Second}},
+		Storage:           &FileStorage{Path: t.TempDir()},
+		Logger:            defaultTestLogger,
+		OCSP:              OCSPConfig{DisableStapling: true},
+		KeySource:         StandardKeyGenerator{KeyType: P256},
+		OnDemand:          &OnDemandConfig{DecisionFunc: func(context.Context, string) error { return nil }},
+		HandshakeTimeouts: HandshakeTimeouts{Wait: 50 * time.Millisecond, Obtain: 200 * time.Millisecond},
+	})
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	hello := &tls.ClientHelloInfo{ServerName: "example.com", Conn: conn}
+
+	obtained := make(chan error, 1)
+	go func() {
+		_, err := cfg.GetCertificate(hello)
+		obtained <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	_, err := cfg.GetCertificate(hello)
+	if !errors.Is(err, ErrObtainTimeout) {
+		t.Errorf("Expected waiting handshake to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected waiting handshake to give up after the wait timeout, took %s", elapsed)
+	}
+
+	if err := <-obtained; err == nil {
+		t.Error("Expected obtaining handshake to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("Expected obtaining handshake to give up after the obtain timeout, took %s", elapsed)
+	}
+}
+
+func TestWaitForHandshakeContext(t *testing.T) {
+	cfg := &Config{HandshakeTimeouts: HandshakeTimeouts{Wait: -1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cfg.waitForHandshake(ctx, make(chan struct{}), "example.com", "waiting"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context error, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cfg.waitForHandshake(ctx, make(chan struct{}), "example.com", "waiting"); !errors.Is(err, ErrObtainTimeout) {
+		t.Errorf("Expected timeout error from handshake deadline, got %v", err)
+	}
+
+	wait := make(chan struct{})
+	close(wait)
+	if err := cfg.waitForHandshake(context.Background(), wait, "example.com", "waiting"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestOnDemandCoordinateInstances(t *testing.T) {
+	storage := &FileStorage{Path: t.TempDir()}
+	newInstance := func(issuer Issuer) *Config {
+		var cfg *Config
+		cache := NewCache(CacheOptions{
+			GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+			Logger:           defaultTestLogger,
+		})
+		t.Cleanup(cache.Stop)
+		cfg = New(cache, Config{
+			Issuers:   []Issuer{issuer},
+			Storage:   storage,
+			Logger:    defaultTestLogger,
+			OCSP:      OCSPConfig{DisableStapling: true},
+			KeySource: StandardKeyGenerator{KeyType: P256},
+			OnDemand: &OnDemandConfig{
+				DecisionFunc:        func(context.Context, string) error { return nil },
+				CoordinateInstances: true,
+			},
+		})
+		return cfg
+	}
+	issuer1, issuer2 := new(csrRecordingIssuer), new(csrRecordingIssuer)
+	instance1, instance2 := newInstance(issuer1), newInstance(issuer2)
+
+	// instance1 plays another process that is obtaining the certificate
+	ctx := context.Background()
+	lockKey := instance1.lockKey(onDemandObtainLockOp, "example.com")
+	if err := acquireLock(ctx, storage, lockKey); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	type result struct {
+		cert *tls.Certificate
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		cert, err := instance2.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com", Conn: conn})
+		results <- result{cert, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case r := <-results:
+		t.Fatalf("Expected handshake to wait for the other instance, got %v", r.err)
+	default:
+	}
+
+	if err := instance1.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseLock(ctx, storage, lockKey); err != nil {
+		t.Fatal(err)
+	}
+	r := <-results
+	if r.err != nil || r.cert == nil {
+		t.Fatalf("Expected certificate from the other instance: %v", r.err)
+	}
+	if len(issuer1.csrs) != 1 || len(issuer2.csrs) != 0 {
+		t.Errorf("Expected only the other instance to obtain the certificate, got %d and %d CSRs", len(issuer1.csrs), len(issuer2.csrs))
+	}
+
+	// the lock is released
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := storage.Lock(ctx, lockKey); err != nil {
+		t.Fatalf("Expected lock to be released: %v", err)
+	}
+	_ = storage.Unlock(ctx, lockKey)
+}
+
+// TestHandshakeAllocations holds the handshake path to its budget:
+// certificates that are found in the cache are served without any
+// allocations.
+func TestHandshakeAllocations(t *testing.T) {
+	cfg, onDemand, conn := newHandshakePathConfigs(t)
+	for _, tc := range []struct {
+		name  string
+		cfg   *Config
+		hello *tls.ClientHelloInfo
+	}{
+		{"exact", cfg, &tls.ClientHelloInfo{ServerName: "example.com", Conn: conn}},
+		{"wildcard", cfg, &tls.ClientHelloInfo{ServerName: "sub.example.com", Conn: conn}},
+		{"on-demand", onDemand, &tls.ClientHelloInfo{ServerName: "example.com", Conn: conn}},
+	} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := tc.cfg.GetCertificate(tc.hello); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > 0 {
+			t.Errorf("%s: Expected no allocations serving certificate from cache, got %.1f", tc.name, allocs)
+		}
+	}
+}
+
+func TestHandshakeLoggers(t *testing.T) {
+	cfg, _, _ := newHandshakePathConfigs(t)
+	loggers := cfg.handshakeLoggers()
+	if cfg.handshakeLoggers() != loggers {
+		t.Error("Expected handshake loggers to be built once")
+	}
+	cfg.Logger = defaultTestLogger
+	if changed := cfg.handshakeLoggers(); changed == loggers || changed.base != defaultTestLogger {
+		t.Error("Expected handshake loggers to be built again for a different logger")
+	}
+}
+
+func TestGetCertificateRaw(t *testing.T) {
+	cfg, _, _ := newHandshakePathConfigs(t)
+	cfg.Logger = defaultTestLogger
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newHandshakePathCert("raw.example.com")
+	cert.PrivateKey = key
+	cert.OCSPStaple = []byte("staple")
+	cfg.certCache.cacheCertificate(cert)
+
+	raw, err := cfg.GetCertificateRaw(context.Background(), "RAW.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.Chain) != 1 || string(raw.Chain[0]) != "raw.example.com" || raw.Leaf != cert.Leaf || string(raw.OCSPStaple) != "staple" {
+		t.Errorf("Expected the cached certificate, got %+v", raw)
+	}
+	if raw.Signer != key {
+		t.Errorf("Expected the private key of the certificate, got %T", raw.Signer)
+	}
+
+	// without a ClientHello, the certificate can't be chosen by connection
+	if _, err := cfg.GetCertificateRaw(context.Background(), "other.test"); err == nil {
+		t.Error("Expected an error for a name without a certificate")
+	}
+	if _, err := cfg.GetCertificateRaw(context.Background(), "sub.example.com"); err == nil {
+		t.Error("Expected an error for a certificate without a signer")
+	}
+
+	// GetCertificate returns no certificate and no error for this response
+	cfg.OnHandshakeFailure = func(context.Context, *tls.ClientHelloInfo, error) (HandshakeResponse, *tls.Certificate) {
+		return RespondUnrecognizedName, nil
+	}
+	if _, err := cfg.GetCertificateRaw(context.Background(), "other.test"); !errors.Is(err, ErrNoCertAvailable) {
+		t.Errorf("Expected no certificate to be available, got: %v", err)
+	}
+}
+
+// newHandshakePathConfigs returns a config, and one with on-demand TLS,
+// that share a cache with valid managed certificates for example.com and
+// *.example.com, along with a connection for ClientHellos.
+func newHandshakePathConfigs(tb testing.TB) (cfg, onDemand *Config, conn net.Conn) {
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           zap.NewNop(),
+	})
+	tb.Cleanup(cache.Stop)
+	cfg = New(cache, Config{
+		Storage:           &FileStorage{Path: tb.TempDir()},
+		Logger:            zap.NewNop(),
+		DefaultServerName: "example.com",
+	})
+	onDemand = New(cache, Config{
+		Storage:  cfg.Storage,
+		Logger:   zap.NewNop(),
+		OnDemand: &OnDemandConfig{DecisionFunc: func(context.Context, string) error { return nil }},
+	})
+	for _, name := range []string{"example.com", "*.example.com"} {
+		cache.cacheCertificate(newHandshakePathCert(name))
+	}
+
+	conn, other := net.Pipe()
+	tb.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	return cfg, onDemand, conn
+}
+
+func newHandshakePathCert(name string) Certificate {
+	now := time.Now()
+	return Certificate{
+		Names: []string{name},
+		Certificate: tls.Certificate{
+			Certificate: [][]byte{[]byte(name)},
+			Leaf:        &x509.Certificate{DNSNames: []string{name}, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(90 * 24 * time.Hour)},
+		},
+		hash:    name,
+		managed: true,
+	}
+}
+
+// BenchmarkGetCertificate measures the handshake path for its common
+// outcomes. Run with -benchmem: hits in the cache must not allocate.
+func BenchmarkGetCertificate(b *testing.B) {
+	cfg, onDemand, conn := newHandshakePathConfigs(b)
+
+	for _, bm := range []struct {
+		name  string
+		cfg   *Config
+		hello *tls.ClientHelloInfo
+	}{
+		{"cache_hit", cfg, &tls.ClientHelloInfo{ServerName: "example.com", Conn: conn}},
+		{"wildcard_match", cfg, &tls.ClientHelloInfo{ServerName: "sub.example.com", Conn: conn}},
+		{"default_fallback", cfg, &tls.ClientHelloInfo{Conn: conn}},
+		{"on_demand_hit", onDemand, &tls.ClientHelloInfo{ServerName: "example.com", Conn: conn}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := bm.cfg.GetCertificate(bm.hello); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// a handshake waits for another one that is loading the
+	// certificate, then gets it from the cache
+	b.Run("on_demand_wait", func(b *testing.B) {
+		b.ReportAllocs()
+		const name = "waited.example.com"
+		hello := &tls.ClientHelloInfo{ServerName: name, Conn: conn}
+		cert := newHandshakePathCert(name)
+		cache := onDemand.certCache
+		for b.Loop() {
+			wait := make(chan struct{})
+			certLoadWaitChansMu.Lock()
+			certLoadWaitChans[name] = wait
+			certLoadWaitChansMu.Unlock()
+
+			done := make(chan error)
+			go func() {
+				_, err := onDemand.GetCertificate(hello)
+				done <- err
+			}()
+			cache.cacheCertificate(cert)
+			certLoadWaitChansMu.Lock()
+			delete(certLoadWaitChans, name)
+			close(wait)
+			certLoadWaitChansMu.Unlock()
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+
+			cache.mu.Lock()
+			cache.removeCertificate(cert)
+			cache.mu.Unlock()
+		}
+	})
+}
+
+// BenchmarkHandshakeLogging measures what logging costs a handshake that
+// hits the cache with debug logs disabled, as is usual in production:
+// "gated" is how it is done, and "eager" adds building the loggers and
+// fields of its debug logs regardless of the level, as was done before.
+func BenchmarkHandshakeLogging(b *testing.B) {
+	cfg, _, conn := newHandshakePathConfigs(b)
+	cfg.Logger = zap.New(zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(io.Discard),
+		zap.InfoLevel,
+	))
+	hello := &tls.ClientHelloInfo{ServerName: "example.com", Conn: conn}
+
+	for _, bm := range []struct {
+		name  string
+		eager bool
+	}{
+		{"gated", false},
+		{"eager", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				tlsCert, err := cfg.GetCertificate(hello)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if bm.eager {
+					cert := Certificate{Certificate: *tlsCert, Names: tlsCert.Leaf.DNSNames}
+					logger := logWithRemote(cfg.Logger.Named("handshake"), hello)
+					logger.Debug("matched certificate in cache",
+						zap.Strings("subjects", cert.Names),
+						zap.Bool("managed", cert.managed),
+						zap.Time("expiration", expiresAt(cert.Leaf)),
+						zap.String("hash", cert.hash))
+					logger = cfg.Logger.Named("handshake")
+					logger.Debug("choosing certificate",
+						zap.String("identifier", hello.ServerName),
+						zap.Int("num_choices", 1))
+					logger.Debug("default certificate selection results",
+						zap.Error(err),
+						zap.String("identifier", hello.ServerName),
+						zap.Strings("subjects", cert.Names),
+						zap.Bool("managed", cert.managed),
+						zap.String("issuer_key", cert.issuerKey),
+						zap.String("hash", cert.hash))
+				}
+			}
+		})
+	}
+}
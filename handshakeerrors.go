@@ -0,0 +1,119 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// Kinds of errors that fail TLS handshakes; see HandshakeError.
+var (
+	// No certificate is available for the server name.
+	ErrNoCertAvailable = errors.New("no certificate available")
+
+	// A certificate for the server name is not allowed,
+	// for example by the OnDemand decision function.
+	ErrNameNotAllowed = errors.New("certificate not allowed")
+
+	// Obtaining, renewing, or loading a certificate for
+	// the server name didn't finish in time.
+	ErrObtainTimeout = errors.New("timed out waiting for certificate")
+
+	// The issuer (usually its CA) refused to issue a
+	// certificate for the server name.
+	ErrCARejected = errors.New("issuer rejected certificate request")
+)
+
+// HandshakeError is returned by GetCertificate if the handshake can't
+// be completed. Its Kind is ErrNoCertAvailable, ErrNameNotAllowed,
+// ErrObtainTimeout, or ErrCARejected, and errors.Is works with both
+// its kind and its underlying error, so servers can decide how to
+// treat a failure:
+//
+//	if errors.Is(err, certmagic.ErrNameNotAllowed) { ... }
+//
+// EXPERIMENTAL: Subject to change.
+type HandshakeError struct {
+	// What kind of failure this is.
+	Kind error
+
+	// The server name of the handshake.
+	Name string
+
+	// The issuer involved, if any.
+	IssuerKey string
+
+	// The underlying error, if any.
+	Err error
+}
+
+func (e HandshakeError) Error() string {
+	msg := fmt.Sprintf("%v for %s", e.Kind, e.Name)
+	if e.IssuerKey != "" {
+		msg += " (issuer=" + e.IssuerKey + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the kind and the underlying error.
+func (e HandshakeError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// issuanceHandshakeError returns the error that fails a handshake if
+// the certificate for name couldn't be obtained or renewed because of
+// err. Errors that are of no known kind are returned as they are.
+func issuanceHandshakeError(name string, err error) error {
+	var handshakeErr HandshakeError
+	if err == nil || errors.As(err, &handshakeErr) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return HandshakeError{Kind: ErrObtainTimeout, Name: name, Err: err}
+	}
+	var issuerErr issuerError
+	var problem acme.Problem
+	var caaErr CAAError
+	var caErr CAError
+	switch {
+	case errors.As(err, &issuerErr):
+		return HandshakeError{Kind: ErrCARejected, Name: name, IssuerKey: issuerErr.issuerKey, Err: err}
+	case errors.As(err, &caaErr):
+		return HandshakeError{Kind: ErrCARejected, Name: name, IssuerKey: caaErr.Issuer, Err: err}
+	case errors.As(err, &problem), errors.As(err, &caErr):
+		return HandshakeError{Kind: ErrCARejected, Name: name, Err: err}
+	}
+	return err
+}
+
+// issuerError is an error from an issuer that failed to issue a
+// certificate; it remembers which issuer it was.
+type issuerError struct {
+	issuerKey string
+	err       error
+}
+
+func (e issuerError) Error() string { return e.err.Error() }
+func (e issuerError) Unwrap() error { return e.err }
@@ -0,0 +1,93 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestHandshakeErrors(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	denied := errors.New("denied")
+	cfg := &Config{
+		Logger:    defaultTestLogger,
+		certCache: &Cache{logger: defaultTestLogger},
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(ctx context.Context, name string) error { return denied },
+		},
+	}
+
+	_, err = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com", Conn: conn})
+	var handshakeErr HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("Expected a HandshakeError, got %T: %v", err, err)
+	}
+	if handshakeErr.Kind != ErrNameNotAllowed || handshakeErr.Name != "example.com" {
+		t.Errorf("Unexpected error: %+v", handshakeErr)
+	}
+	if !errors.Is(err, denied) {
+		t.Errorf("Expected the decision error to be wrapped, got %v", err)
+	}
+
+	cfg.OnDemand = nil
+	_, err = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com", Conn: conn})
+	if !errors.Is(err, ErrNoCertAvailable) {
+		t.Errorf("Expected ErrNoCertAvailable, got %v", err)
+	}
+}
+
+func TestIssuanceHandshakeError(t *testing.T) {
+	rejected := issuerError{issuerKey: "acme-v02.api.letsencrypt.org-directory", err: errors.New("order failed")}
+
+	for i, tc := range []struct {
+		err       error
+		kind      error
+		issuerKey string
+	}{
+		{err: fmt.Errorf("obtaining: %w", rejected), kind: ErrCARejected, issuerKey: rejected.issuerKey},
+		{err: acme.Problem{Type: acme.ProblemTypeRejectedIdentifier}, kind: ErrCARejected},
+		{err: CAAError{Name: "example.com", Issuer: "ca.example"}, kind: ErrCARejected, issuerKey: "ca.example"},
+		{err: fmt.Errorf("waiting: %w", context.DeadlineExceeded), kind: ErrObtainTimeout},
+	} {
+		err := issuanceHandshakeError("example.com", tc.err)
+		var handshakeErr HandshakeError
+		if !errors.As(err, &handshakeErr) {
+			t.Errorf("Test %d: Expected a HandshakeError, got %T: %v", i, err, err)
+			continue
+		}
+		if !errors.Is(err, tc.kind) || handshakeErr.IssuerKey != tc.issuerKey || handshakeErr.Name != "example.com" {
+			t.Errorf("Test %d: Unexpected error: %+v", i, handshakeErr)
+		}
+	}
+
+	// errors of no known kind are left as they are
+	if err := issuanceHandshakeError("example.com", ErrOnDemandRateLimited); err != ErrOnDemandRateLimited {
+		t.Errorf("Expected the error unchanged, got %v", err)
+	}
+}
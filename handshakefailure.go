@@ -0,0 +1,110 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// HandshakeFailureFunc decides how a TLS handshake that failed with err
+// (usually a HandshakeError) is surfaced to the client. The certificate
+// is only used with RespondWithCertificate. It is called synchronously
+// during the handshake, so it should return quickly.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HandshakeFailureFunc func(ctx context.Context, hello *tls.ClientHelloInfo, err error) (HandshakeResponse, *tls.Certificate)
+
+// HandshakeResponse is how a failed TLS handshake is surfaced to the
+// client.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HandshakeResponse int
+
+const (
+	// RespondInternalError returns the error to crypto/tls,
+	// which sends an internal_error alert. This is the default.
+	RespondInternalError HandshakeResponse = iota
+
+	// RespondUnrecognizedName sends an unrecognized_name alert,
+	// which is what clients expect for names a server doesn't
+	// serve. This relies on crypto/tls and requires that the
+	// tls.Config has no static Certificates; otherwise the
+	// first of those is served instead.
+	RespondUnrecognizedName
+
+	// RespondClose closes the connection without an alert.
+	RespondClose
+
+	// RespondWithCertificate completes the handshake with the
+	// certificate returned by the HandshakeFailureFunc, for
+	// example a self-signed one, so that the application can
+	// serve an error page.
+	RespondWithCertificate
+)
+
+func (r HandshakeResponse) String() string {
+	switch r {
+	case RespondInternalError:
+		return "internal_error"
+	case RespondUnrecognizedName:
+		return "unrecognized_name"
+	case RespondClose:
+		return "close"
+	case RespondWithCertificate:
+		return "certificate"
+	}
+	return fmt.Sprintf("HandshakeResponse(%d)", int(r))
+}
+
+// handshakeFailure returns what GetCertificate returns if the
+// certificate for hello couldn't be gotten because of err, according
+// to cfg.OnHandshakeFailure.
+func (cfg *Config) handshakeFailure(ctx context.Context, hello *tls.ClientHelloInfo, err error) (*tls.Certificate, error) {
+	response, cert := cfg.OnHandshakeFailure(ctx, hello, err)
+
+	logger := cfg.Logger.With(
+		zap.String("server_name", hello.ServerName),
+		zap.Stringer("response", response),
+		zap.Error(err))
+	if hello.Conn != nil {
+		logger = logger.With(zap.String("remote", hello.Conn.RemoteAddr().String()))
+	}
+
+	switch response {
+	case RespondUnrecognizedName:
+		// crypto/tls sends unrecognized_name if there is no
+		// certificate at all, which is what (nil, nil) means
+		logger.Debug("rejecting TLS handshake for unrecognized name")
+		return nil, nil
+	case RespondClose:
+		logger.Debug("closing connection of failed TLS handshake")
+		if hello.Conn != nil {
+			hello.Conn.Close()
+		}
+		return nil, err
+	case RespondWithCertificate:
+		if cert == nil {
+			logger.Error("handshake failure function returned no certificate")
+			return nil, err
+		}
+		logger.Debug("serving fallback certificate for failed TLS handshake")
+		return cert, nil
+	}
+	return nil, err
+}
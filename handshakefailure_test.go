@@ -0,0 +1,87 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnHandshakeFailure(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	var response HandshakeResponse
+	var failure error
+	cfg := &Config{
+		Logger:    defaultTestLogger,
+		certCache: &Cache{logger: defaultTestLogger},
+		OnHandshakeFailure: func(ctx context.Context, hello *tls.ClientHelloInfo, err error) (HandshakeResponse, *tls.Certificate) {
+			failure = err
+			return response, &fallback
+		},
+	}
+
+	handshake := func() error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			defer server.Close()
+			_ = tls.Server(server, &tls.Config{GetCertificate: cfg.GetCertificate}).Handshake()
+		}()
+		return tls.Client(client, &tls.Config{ServerName: "unknown.example", InsecureSkipVerify: true}).Handshake()
+	}
+
+	response = RespondUnrecognizedName
+	if err := handshake(); err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+		t.Errorf("Expected unrecognized_name alert, got %v", err)
+	}
+	if !errors.Is(failure, ErrNoCertAvailable) {
+		t.Errorf("Expected the handshake error to be passed to the callback, got %v", failure)
+	}
+
+	response = RespondClose
+	if err := handshake(); err == nil || strings.Contains(err.Error(), "alert") {
+		t.Errorf("Expected the connection to be closed without alert, got %v", err)
+	}
+
+	response = RespondWithCertificate
+	if err := handshake(); err != nil {
+		t.Errorf("Expected the handshake to complete with the fallback certificate, got %v", err)
+	}
+
+	response = RespondInternalError
+	if err := handshake(); err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("Expected internal_error alert, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HandshakeTimeouts limits how long TLS handshakes are held while a
+// certificate is loaded, obtained, or renewed for them. Handshakes are
+// never held longer than their context allows (see tls.ClientHelloInfo's
+// Context), so servers can also limit this per handshake, for example
+// with a handshake timeout. Negative values mean no limit other than
+// the handshake's context.
+//
+// EXPERIMENTAL: Subject to change.
+type HandshakeTimeouts struct {
+	// How long a handshake waits for another handshake
+	// that is already loading, obtaining, or renewing
+	// the same certificate. Default: 2 minutes.
+	Wait time.Duration
+
+	// How long a handshake waits for a certificate to
+	// be obtained on demand. Default: 3 minutes.
+	Obtain time.Duration
+
+	// How long a handshake waits for an expired (or
+	// revoked) certificate to be renewed on demand.
+	// Default: 90 seconds.
+	Renew time.Duration
+}
+
+func (t HandshakeTimeouts) wait() time.Duration {
+	if t.Wait != 0 {
+		return t.Wait
+	}
+	return 2 * time.Minute
+}
+
+func (t HandshakeTimeouts) obtain() time.Duration {
+	if t.Obtain != 0 {
+		return t.Obtain
+	}
+	// based on https://caddy.community/t/zerossl-dns-challenge-failing-often-route53-plugin/13822/24?u=matt
+	return 180 * time.Second
+}
+
+func (t HandshakeTimeouts) renew() time.Duration {
+	if t.Renew != 0 {
+		return t.Renew
+	}
+	return 90 * time.Second
+}
+
+// withTimeout returns ctx with timeout d, unless d is negative.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// waitForHandshake waits until wait is closed by the handshake that is
+// loading, obtaining, or renewing the certificate for name (what it is
+// doing), until the wait timeout, or until ctx is done.
+func (cfg *Config) waitForHandshake(ctx context.Context, wait <-chan struct{}, name, what string) error {
+	ctx, cancel := withTimeout(ctx, cfg.HandshakeTimeouts.wait())
+	defer cancel()
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return HandshakeError{Kind: ErrObtainTimeout, Name: name, Err: fmt.Errorf("%s: %w", what, ctx.Err())}
+		}
+		return ctx.Err()
+	}
+}
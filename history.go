@@ -0,0 +1,265 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNoCertificateHistory is returned (wrapped) by RollbackCertificate
+// when there is no previous version of a certificate to restore.
+var ErrNoCertificateHistory = errors.New("no previous certificate version in storage")
+
+// certHistoryEntry is a previous version of a certificate resource,
+// stored as a single value so that it is written atomically.
+type certHistoryEntry struct {
+	Archived       time.Time       `json:"archived"`
+	CertificatePEM []byte          `json:"certificate_pem"`
+	PrivateKeyPEM  []byte          `json:"private_key_pem"`
+	Meta           json.RawMessage `json:"meta"`
+}
+
+// archiveCertResource copies the certificate resource for certKey from
+// issuer, if there is one and it isn't newCertPEM, into the history,
+// and prunes the history down to cfg.CertificateHistory versions.
+// Callers should hold the issuance lock for the name.
+func (cfg *Config) archiveCertResource(ctx context.Context, issuer Issuer, certKey string, newCertPEM []byte) error {
+	current, err := cfg.loadCertResource(ctx, issuer, certKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // nothing to archive
+	}
+	if err != nil {
+		return fmt.Errorf("loading current certificate: %v", err)
+	}
+	if bytes.Equal(current.CertificatePEM, newCertPEM) {
+		return nil // not actually being replaced
+	}
+
+	meta, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := cfg.encryptKeyPEM(ctx, current.PrivateKeyPEM)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	entry, err := json.Marshal(certHistoryEntry{
+		Archived:       now,
+		CertificatePEM: current.CertificatePEM,
+		PrivateKeyPEM:  keyPEM,
+		Meta:           meta,
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix := StorageKeys.CertHistoryPrefix(issuer.IssuerKey(), certKey)
+	if err := cfg.Storage.Store(ctx, path.Join(prefix, fmt.Sprintf("%020d.json", now.UnixNano())), entry); err != nil {
+		return fmt.Errorf("storing previous certificate: %v", err)
+	}
+
+	versions, err := cfg.certHistory(ctx, issuer, certKey)
+	if err != nil {
+		return err
+	}
+	for len(versions) > cfg.CertificateHistory {
+		if err := cfg.Storage.Delete(ctx, versions[0]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("pruning certificate history: %v", err)
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// certHistory returns the storage keys of the previous versions of the
+// certificate for certKey from issuer, oldest first.
+func (cfg *Config) certHistory(ctx context.Context, issuer Issuer, certKey string) ([]string, error) {
+	keys, err := cfg.Storage.List(ctx, StorageKeys.CertHistoryPrefix(issuer.IssuerKey(), certKey), false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing certificate history: %v", err)
+	}
+	slices.Sort(keys) // keys are zero-padded timestamps
+	return keys, nil
+}
+
+// RollbackCertificate replaces the managed certificate for name with the
+// previous version of it, both in storage and in the cache. This is for
+// quickly mitigating a bad renewal, for example one that picked up a
+// misconfigured chain or the wrong profile. Previous versions are only
+// available if cfg.CertificateHistory is set; if there are none,
+// ErrNoCertificateHistory is returned. The restored version is removed
+// from the history, so calling this again rolls back further; the bad
+// version is discarded.
+//
+// Note that if the restored certificate is due for renewal, it will be
+// renewed during regular maintenance, so the cause of a bad renewal
+// should be fixed soon after rolling back.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) RollbackCertificate(ctx context.Context, name string) (Certificate, error) {
+	name = cfg.transformSubject(ctx, nil, name)
+	cfg = cfg.forSubject(name)
+
+	// don't race with an obtain or renewal of the same name
+	lockKey := cfg.lockKey(certIssueLockOp, name)
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return Certificate{}, fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			cfg.Logger.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	// roll back the cert from the issuer that the current one is from
+	current, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("loading current certificate for %s: %w", name, err)
+	}
+	var issuer Issuer
+	for _, iss := range cfg.Issuers {
+		if iss.IssuerKey() == current.issuerKey {
+			issuer = iss
+			break
+		}
+	}
+	if issuer == nil {
+		return Certificate{}, fmt.Errorf("issuer %s of current certificate for %s is not configured", current.issuerKey, name)
+	}
+
+	versions, err := cfg.certHistory(ctx, issuer, name)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	// restore the newest previous version that is still usable
+	for i := len(versions) - 1; i >= 0; i-- {
+		versionKey := versions[i]
+		restored, err := cfg.loadCertHistoryEntry(ctx, versionKey)
+		if err != nil {
+			cfg.Logger.Warn("skipping unusable previous certificate",
+				zap.String("identifier", name),
+				zap.String("version", versionKey),
+				zap.Error(err))
+			continue
+		}
+
+		metaBytes, err := json.MarshalIndent(restored.meta, "", "\t")
+		if err != nil {
+			return Certificate{}, fmt.Errorf("encoding certificate metadata: %v", err)
+		}
+		keyPEM, err := cfg.encryptKeyPEM(ctx, restored.PrivateKeyPEM)
+		if err != nil {
+			return Certificate{}, err
+		}
+		err = storeTx(ctx, cfg.Storage, []keyValue{
+			{key: StorageKeys.SitePrivateKey(issuer.IssuerKey(), name), value: keyPEM},
+			{key: StorageKeys.SiteCert(issuer.IssuerKey(), name), value: restored.CertificatePEM},
+			{key: StorageKeys.SiteMeta(issuer.IssuerKey(), name), value: metaBytes},
+		})
+		if err != nil {
+			return Certificate{}, fmt.Errorf("restoring previous certificate for %s: %v", name, err)
+		}
+		if err := cfg.Storage.Delete(ctx, versionKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			cfg.Logger.Error("unable to remove restored certificate from history",
+				zap.String("identifier", name),
+				zap.String("version", versionKey),
+				zap.Error(err))
+		}
+
+		// swap it into the cache
+		newCert, err := cfg.loadManagedCertificate(ctx, name)
+		if err != nil {
+			return Certificate{}, fmt.Errorf("loading restored certificate for %s: %v", name, err)
+		}
+		cfg.certCache.mu.Lock()
+		var replaced bool
+		for _, oldCert := range cfg.certCache.getAllMatchingCerts(name) {
+			if oldCert.managed {
+				cfg.certCache.unsyncedReplaceCertificate(oldCert, newCert)
+				replaced = true
+			}
+		}
+		if !replaced {
+			cfg.certCache.unsyncedCacheCertificate(newCert)
+		}
+		cfg.certCache.mu.Unlock()
+		cfg.certCache.notifyInvalidation(ctx, "rolled_back", newCert.Names)
+
+		cfg.Logger.Warn("rolled back certificate to previous version",
+			zap.String("identifier", name),
+			zap.String("issuer", issuer.IssuerKey()),
+			zap.Time("archived", restored.Archived),
+			zap.Time("expiration", expiresAt(newCert.Leaf)))
+		cfg.emit(ctx, "cert_rolled_back", map[string]any{
+			"identifier":  name,
+			"issuer":      issuer.IssuerKey(),
+			"certificate": newCert,
+			"archived":    restored.Archived,
+		})
+
+		return newCert, nil
+	}
+
+	return Certificate{}, fmt.Errorf("%s: %w", name, ErrNoCertificateHistory)
+}
+
+type loadedCertHistoryEntry struct {
+	certHistoryEntry
+	meta CertificateResource
+}
+
+// loadCertHistoryEntry loads the previous certificate version at key,
+// and makes sure that it could be served.
+func (cfg *Config) loadCertHistoryEntry(ctx context.Context, key string) (loadedCertHistoryEntry, error) {
+	entryBytes, err := cfg.Storage.Load(ctx, key)
+	if err != nil {
+		return loadedCertHistoryEntry{}, err
+	}
+	var entry loadedCertHistoryEntry
+	if err := json.Unmarshal(entryBytes, &entry.certHistoryEntry); err != nil {
+		return entry, fmt.Errorf("decoding: %v", err)
+	}
+	if err := json.Unmarshal(entry.Meta, &entry.meta); err != nil {
+		return entry, fmt.Errorf("decoding metadata: %v", err)
+	}
+	keyPEM, err := cfg.decryptKeyPEM(ctx, entry.PrivateKeyPEM)
+	if err != nil {
+		return entry, err
+	}
+	entry.PrivateKeyPEM = keyPEM
+	cert, err := cfg.makeCertificateWithOCSP(ctx, entry.CertificatePEM, entry.PrivateKeyPEM)
+	if err != nil {
+		return entry, err
+	}
+	if cert.Expired() {
+		return entry, fmt.Errorf("certificate expired at %s", expiresAt(cert.Leaf))
+	}
+	return entry, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRollbackCertificate(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	am := &ACMEIssuer{CA: "https://example.com/acme/directory"}
+	cfg := &Config{
+		Issuers:            []Issuer{am},
+		Storage:            &FileStorage{Path: tmpDir},
+		Logger:             defaultTestLogger,
+		OCSP:               OCSPConfig{DisableStapling: true},
+		CertificateHistory: 2,
+		certCache:          NewCache(CacheOptions{GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil }}),
+	}
+	defer cfg.certCache.Stop()
+	am.config = cfg
+
+	const name = "rollback.example.com"
+	var versions [][]byte
+	for i := 0; i < 4; i++ {
+		certPEM, keyPEM := mustGenerateTestCert(t, []string{name}, time.Now().Add(time.Duration(i+1)*24*time.Hour))
+		if _, err := cfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{Overwrite: true}); err != nil {
+			t.Fatalf("Adopting version %d: %v", i, err)
+		}
+		versions = append(versions, certPEM)
+	}
+
+	// only the two versions before the current one are kept
+	history, err := cfg.certHistory(ctx, am, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 previous versions in storage, got %d", len(history))
+	}
+
+	for _, expected := range [][]byte{versions[2], versions[1]} {
+		cert, err := cfg.RollbackCertificate(ctx, name)
+		if err != nil {
+			t.Fatalf("Rolling back: %v", err)
+		}
+		certRes, err := cfg.loadCertResource(ctx, am, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(certRes.CertificatePEM, expected) {
+			t.Error("Expected previous certificate to be restored in storage")
+		}
+		cached := cfg.certCache.getAllMatchingCerts(name)
+		if len(cached) != 1 || cached[0].hash != cert.hash {
+			t.Errorf("Expected only the restored certificate in the cache, got %d certificates", len(cached))
+		}
+	}
+
+	if _, err := cfg.RollbackCertificate(ctx, name); !errors.Is(err, ErrNoCertificateHistory) {
+		t.Errorf("Expected ErrNoCertificateHistory, got: %v", err)
+	}
+}
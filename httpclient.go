@@ -0,0 +1,34 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// httpClientFor returns client, if it is not nil; otherwise the
+// HTTPClient of the config of the operation ctx belongs to, if it
+// has one; and otherwise a client with the given timeout.
+func httpClientFor(ctx context.Context, client *http.Client, timeout time.Duration) *http.Client {
+	if client != nil {
+		return client
+	}
+	if cfg, ok := ctx.Value(ctxKeyConfig).(*Config); ok && cfg != nil && cfg.HTTPClient != nil {
+		return cfg.HTTPClient
+	}
+	return &http.Client{Timeout: timeout}
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClientFor(t *testing.T) {
+	own := &http.Client{}
+	cfgClient := &http.Client{}
+	ctx := withConfig(context.Background(), &Config{HTTPClient: cfgClient})
+
+	if client := httpClientFor(ctx, own, time.Second); client != own {
+		t.Error("Expected the component's own client to take precedence")
+	}
+	if client := httpClientFor(ctx, nil, time.Second); client != cfgClient {
+		t.Error("Expected the config's client")
+	}
+	if client := httpClientFor(context.Background(), nil, time.Second); client.Timeout != time.Second {
+		t.Errorf("Expected a default client with the timeout, got %+v", client)
+	}
+}
+
+func TestConfigHTTPClient(t *testing.T) {
+	received := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	transport := new(countingTransport)
+	cfg := &Config{
+		HTTPClient: &http.Client{Transport: transport},
+		OnEvent: (&EventWebhook{
+			URL:    srv.URL,
+			Events: []string{"cert_obtaining"},
+			Logger: defaultTestLogger,
+		}).OnEvent,
+		Logger: defaultTestLogger,
+	}
+
+	// events sent to webhooks go through the config's client
+	if err := cfg.emit(context.Background(), "cert_obtaining", map[string]any{"identifier": "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+	if transport.requests.Load() != 1 {
+		t.Errorf("Expected the webhook to use the config's client, got %d requests", transport.requests.Load())
+	}
+
+	// a transport that the issuer can't configure is used as it is
+	if am := NewACMEIssuer(cfg, ACMEIssuer{}); am.httpClient != cfg.HTTPClient {
+		t.Error("Expected ACME issuer to use the config's client")
+	}
+
+	// otherwise, the issuer configures a copy of it
+	cfg.HTTPClient = &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: 7},
+		Timeout:   5 * time.Second,
+	}
+	am := NewACMEIssuer(cfg, ACMEIssuer{TrustedRoots: x509.NewCertPool()})
+	issuerTransport, ok := am.httpClient.Transport.(*http.Transport)
+	if !ok || issuerTransport.MaxIdleConnsPerHost != 7 || am.httpClient.Timeout != 5*time.Second {
+		t.Fatalf("Expected ACME issuer to be based on the config's client, got %+v", am.httpClient)
+	}
+	if issuerTransport.TLSClientConfig == nil || issuerTransport.TLSClientConfig.RootCAs == nil {
+		t.Error("Expected ACME issuer to apply its own TLS settings")
+	}
+	if tlsConfig := cfg.HTTPClient.Transport.(*http.Transport).TLSClientConfig; tlsConfig != nil && tlsConfig.RootCAs != nil {
+		t.Error("Expected the config's transport to be left alone")
+	}
+
+	// OCSP requests go through it too
+	if ocspConfig := cfg.ocspConfig(); ocspConfig.httpClient != cfg.HTTPClient {
+		t.Error("Expected OCSP to use the config's client")
+	}
+}
@@ -73,6 +73,11 @@ func (am *ACMEIssuer) distributedHTTPChallengeSolver(w http.ResponseWriter, r *h
 	}
 	host := hostOnly(r.Host)
 	chalInfo, distributed, err := am.config.getChallengeInfo(r.Context(), host)
+	if err == nil && distributed && r.URL.Path != chalInfo.HTTP01ResourcePath() {
+		// what we remembered may be from a previous challenge
+		distributedChallenges.forget(host)
+		chalInfo, distributed, err = am.config.getChallengeInfo(r.Context(), host)
+	}
 	if err != nil {
 		am.Logger.Warn("looking up info for HTTP challenge",
 			zap.String("host", host),
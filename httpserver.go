@@ -0,0 +1,266 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+)
+
+// HTTPServer serves an http.Server over HTTPS with certificates that
+// are managed by a Config, along with an HTTP server that solves HTTP
+// challenges and redirects other requests to HTTPS. Make one with
+// Server or Config.Server; unlike HTTPS, it leaves the http.Server,
+// like its timeouts, up to you, and it can be shut down gracefully.
+//
+// EXPERIMENTAL: Subject to change.
+type HTTPServer struct {
+	// The server of HTTPS requests. Its TLSConfig gets
+	// certificates from Config. Default address: the
+	// HTTPS port.
+	HTTPS *http.Server
+
+	// The server of HTTP requests, which solves HTTP
+	// challenges and redirects the others to HTTPS
+	// according to Redirect. Default address: the
+	// HTTP port.
+	HTTP *http.Server
+
+	// The config that manages the certificates.
+	Config *Config
+
+	// The names to manage certificates for before
+	// serving.
+	Domains []string
+
+	// How HTTP requests are redirected to HTTPS.
+	Redirect RedirectPolicy
+
+	// the port of the HTTPS server, for redirects
+	httpsPort string
+}
+
+// RedirectPolicy configures how an HTTPServer redirects HTTP
+// requests to HTTPS.
+//
+// EXPERIMENTAL: Subject to change.
+type RedirectPolicy struct {
+	// Serve HTTP requests with the handler of the
+	// HTTPS server instead of redirecting them.
+	// HTTP challenges are solved either way.
+	Disabled bool
+
+	// The status code of redirects. Default: 301
+	// (Moved Permanently); 308 (Permanent Redirect)
+	// keeps the method and body of requests.
+	StatusCode int
+
+	// Only redirect requests for the managed domains;
+	// requests for other hosts get 404 (Not Found).
+	OnlyManagedDomains bool
+
+	// If not zero, HTTPS responses have a
+	// Strict-Transport-Security header with this
+	// max-age, so that browsers use HTTPS only.
+	HSTSMaxAge time.Duration
+}
+
+func (p RedirectPolicy) statusCode() int {
+	if p.StatusCode > 0 {
+		return p.StatusCode
+	}
+	return http.StatusMovedPermanently
+}
+
+// Server returns an HTTPServer that serves srv over HTTPS with
+// certificates for domainNames from the Default config. It is the
+// same as NewDefault().Server(srv, domainNames...).
+//
+// Calling this function signifies your acceptance to
+// the CA's Subscriber Agreement and/or Terms of Service.
+//
+// EXPERIMENTAL: Subject to change.
+func Server(srv *http.Server, domainNames ...string) *HTTPServer {
+	DefaultACME.Agreed = true
+	return NewDefault().Server(srv, domainNames...)
+}
+
+// Server returns an HTTPServer that serves srv over HTTPS with
+// certificates for domainNames from cfg. It sets the TLSConfig of
+// srv to get certificates from cfg (keeping its other settings, if
+// it has one), and the HTTP server gets the timeouts of srv. The
+// metadata of the RouteConn function of cfg is in the contexts of the
+// requests; see ConnRoute.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Server(srv *http.Server, domainNames ...string) *HTTPServer {
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = cfg.TLSConfig()
+	} else {
+		srv.TLSConfig = srv.TLSConfig.Clone()
+		srv.TLSConfig.GetCertificate = cfg.GetCertificate
+		if !slices.Contains(srv.TLSConfig.NextProtos, acmez.ACMETLS1Protocol) {
+			srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, acmez.ACMETLS1Protocol)
+		}
+	}
+	if srv.Addr == "" {
+		srv.Addr = fmt.Sprintf(":%d", HTTPSPort)
+	}
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	if connContext := srv.ConnContext; connContext != nil {
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return ConnContext(connContext(ctx, c), c)
+		}
+	} else {
+		srv.ConnContext = ConnContext
+	}
+
+	s := &HTTPServer{
+		HTTPS:   srv,
+		Config:  cfg,
+		Domains: domainNames,
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxAge := s.Redirect.HSTSMaxAge; maxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(maxAge.Seconds())))
+		}
+		handler.ServeHTTP(w, r)
+	})
+	s.HTTP = &http.Server{
+		Addr:              fmt.Sprintf(":%d", HTTPPort),
+		Handler:           cfg.httpChallengeHandler(http.HandlerFunc(s.serveHTTP)),
+		ReadHeaderTimeout: srv.ReadHeaderTimeout,
+		ReadTimeout:       srv.ReadTimeout,
+		WriteTimeout:      srv.WriteTimeout,
+		IdleTimeout:       srv.IdleTimeout,
+		ErrorLog:          srv.ErrorLog,
+		BaseContext:       srv.BaseContext,
+	}
+	return s
+}
+
+// ListenAndServe manages the certificates for the domains, listens
+// on the addresses of the HTTP and HTTPS servers, and serves them;
+// see Serve.
+func (s *HTTPServer) ListenAndServe() error {
+	httpLn, err := net.Listen("tcp", s.HTTP.Addr)
+	if err != nil {
+		return err
+	}
+	httpsLn, err := net.Listen("tcp", s.HTTPS.Addr)
+	if err != nil {
+		httpLn.Close()
+		return err
+	}
+	return s.Serve(httpLn, httpsLn)
+}
+
+// ListenAndServeTLS is like ListenAndServe, with the same signature
+// as that of http.Server, so that servers can be switched over to
+// managed certificates without other changes. If certFile and keyFile
+// are not empty, that certificate is served too, for names it has
+// that are not managed.
+func (s *HTTPServer) ListenAndServeTLS(certFile, keyFile string) error {
+	if certFile != "" || keyFile != "" {
+		if _, err := s.Config.CacheUnmanagedCertificatePEMFile(s.Config.parentContext(), certFile, keyFile, nil); err != nil {
+			return err
+		}
+	}
+	return s.ListenAndServe()
+}
+
+// Serve manages the certificates for the domains, and then serves
+// HTTP on httpLn and HTTPS on httpsLn, which is not a TLS listener.
+// It closes the listeners when it returns, which is when the HTTPS
+// server stops; after Shutdown or Close, that is with
+// http.ErrServerClosed.
+func (s *HTTPServer) Serve(httpLn, httpsLn net.Listener) error {
+	defer httpLn.Close()
+	defer httpsLn.Close()
+
+	if err := s.Config.ManageSync(s.Config.parentContext(), s.Domains); err != nil {
+		return err
+	}
+
+	if _, port, err := net.SplitHostPort(httpsLn.Addr().String()); err == nil {
+		s.httpsPort = port
+	}
+	go s.HTTP.Serve(httpLn)
+	return s.HTTPS.ServeTLS(httpsLn, "", "")
+}
+
+// Shutdown gracefully shuts down the HTTP and HTTPS servers; see
+// http.Server.Shutdown. Certificates are maintained until the cache
+// of the config is stopped.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	return errors.Join(s.HTTP.Shutdown(ctx), s.HTTPS.Shutdown(ctx))
+}
+
+// Close immediately closes the HTTP and HTTPS servers.
+func (s *HTTPServer) Close() error {
+	return errors.Join(s.HTTP.Close(), s.HTTPS.Close())
+}
+
+// serveHTTP serves HTTP requests that are not HTTP challenges.
+func (s *HTTPServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Redirect.Disabled {
+		s.HTTPS.Handler.ServeHTTP(w, r)
+		return
+	}
+	host := hostOnly(r.Host)
+	if s.Redirect.OnlyManagedDomains && !slices.ContainsFunc(s.Domains, func(domain string) bool {
+		return MatchWildcard(host, domain)
+	}) {
+		http.NotFound(w, r)
+		return
+	}
+	if s.httpsPort != "" && s.httpsPort != "443" {
+		host = net.JoinHostPort(host, s.httpsPort)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	// get rid of this unencrypted HTTP connection
+	w.Header().Set("Connection", "close")
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), s.Redirect.statusCode())
+}
+
+// httpChallengeHandler wraps next so that HTTP challenges and
+// validations of the issuers of cfg are solved.
+func (cfg *Config) httpChallengeHandler(next http.Handler) http.Handler {
+	for _, issuer := range slices.Backward(cfg.Issuers) {
+		switch iss := issuer.(type) {
+		case *ACMEIssuer:
+			next = iss.HTTPChallengeHandler(next)
+		case *ZeroSSLIssuer:
+			next = iss.HTTPValidationHandler(next)
+		}
+	}
+	return next
+}
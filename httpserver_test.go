@@ -0,0 +1,116 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPServer(t *testing.T) {
+	const name = "serve.example.com"
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers: []Issuer{&testIssuer{}},
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+		OCSP:    OCSPConfig{DisableStapling: true},
+	})
+
+	srv := cfg.Server(&http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}),
+	}, name)
+	srv.Redirect = RedirectPolicy{StatusCode: http.StatusPermanentRedirect, OnlyManagedDomains: true, HSTSMaxAge: time.Hour}
+
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, httpsPort, _ := net.SplitHostPort(httpsLn.Addr().String())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(httpLn, httpsLn) }()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: name, InsecureSkipVerify: true},
+		},
+		Timeout: 5 * time.Second,
+	}
+	get := func(url, host string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		var resp *http.Response
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			// the certificate is obtained before serving
+			resp, err = client.Do(req)
+			if err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("https://"+httpsLn.Addr().String()+"/", name)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Strict-Transport-Security") != "max-age=3600" {
+		t.Errorf("Expected HTTPS response with HSTS header, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 || resp.TLS.PeerCertificates[0].DNSNames[0] != name {
+		t.Error("Expected managed certificate to be served")
+	}
+
+	resp = get("http://"+httpLn.Addr().String()+"/path?q=1", name)
+	if expect := "https://" + name + ":" + httpsPort + "/path?q=1"; resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != expect {
+		t.Errorf("Expected redirect to %s, got %d %s", expect, resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp = get("http://"+httpLn.Addr().String()+"/", "other.example.com"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected unmanaged host not to be redirected, got %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected server to be closed, got %v", err)
+	}
+}
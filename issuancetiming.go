@@ -0,0 +1,222 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// IssuanceTiming is a breakdown of where the time was spent while
+// obtaining or renewing a certificate. It is included (as "timing")
+// in cert_obtained events, and is aggregated by the cache; see
+// Cache.IssuanceLatency.
+//
+// The phases don't necessarily add up to Total, since not all work
+// is accounted for (like checking storage and emitting events), and
+// DNSPropagation is part of Issuance.
+//
+// EXPERIMENTAL: Subject to change.
+type IssuanceTiming struct {
+	// From when the issuance started until the
+	// certificate was ready to use.
+	Total time.Duration `json:"total"`
+
+	// Waiting to acquire the issuance lock, i.e.
+	// for other instances issuing the same name.
+	LockWait time.Duration `json:"lock_wait"`
+
+	// Generating the private key and CSR.
+	KeyGeneration time.Duration `json:"key_generation"`
+
+	// Getting the certificate from issuers, including
+	// solving challenges and failed attempts.
+	Issuance time.Duration `json:"issuance"`
+
+	// Waiting for DNS challenge records to propagate,
+	// which is included in Issuance.
+	DNSPropagation time.Duration `json:"dns_propagation"`
+
+	// Writing the certificate resources to storage.
+	Storage time.Duration `json:"storage"`
+
+	// Waiting between retries after failed attempts.
+	RetryWait time.Duration `json:"retry_wait"`
+
+	// Loading the certificate into the cache after it
+	// was stored. Only known for certificates that are
+	// loaded into the cache as part of the same operation
+	// (e.g. on-demand); it is zero in cert_obtained events.
+	CacheLoad time.Duration `json:"cache_load"`
+}
+
+// durations returns pointers to all the phases of t, including Total.
+func (t *IssuanceTiming) durations() []*time.Duration {
+	return []*time.Duration{
+		&t.Total,
+		&t.LockWait,
+		&t.KeyGeneration,
+		&t.Issuance,
+		&t.DNSPropagation,
+		&t.Storage,
+		&t.RetryWait,
+		&t.CacheLoad,
+	}
+}
+
+// IssuanceLatencyStats aggregates the timings of issuances.
+//
+// EXPERIMENTAL: Subject to change.
+type IssuanceLatencyStats struct {
+	// How many issuances were measured.
+	Count int
+
+	// The mean and maximum of each phase.
+	Mean, Max IssuanceTiming
+
+	sum IssuanceTiming
+}
+
+func (s *IssuanceLatencyStats) add(t IssuanceTiming) {
+	s.Count++
+	sums, maxes, durs := s.sum.durations(), s.Max.durations(), t.durations()
+	for i, d := range durs {
+		*sums[i] += *d
+		*maxes[i] = max(*maxes[i], *d)
+	}
+	means := s.Mean.durations()
+	for i, sum := range sums {
+		*means[i] = *sum / time.Duration(s.Count)
+	}
+}
+
+// issuanceLatency aggregates the timings of successful issuances.
+type issuanceLatency struct {
+	mu            sync.Mutex
+	obtain, renew IssuanceLatencyStats
+}
+
+// IssuanceLatency returns aggregate timings of the certificates that
+// were successfully obtained and renewed by configs using this cache.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) IssuanceLatency() (obtain, renew IssuanceLatencyStats) {
+	certCache.issuanceLatency.mu.Lock()
+	defer certCache.issuanceLatency.mu.Unlock()
+	return certCache.issuanceLatency.obtain, certCache.issuanceLatency.renew
+}
+
+// issuanceTimer measures the phases of an issuance. It is carried
+// in the context so that code deep in the issuance, like solvers,
+// can record its part. All its methods are safe to call on a nil
+// timer, which is what they get if the issuance isn't being timed.
+type issuanceTimer struct {
+	mu      sync.Mutex
+	start   time.Time
+	renewal bool
+	issued  bool
+	timing  IssuanceTiming
+}
+
+// withIssuanceTimer returns a context that carries a timer for an
+// issuance, and the timer. If ctx already carries a timer, because a
+// caller wants to include what it does after the issuance (like
+// loading the certificate into the cache), that one is returned and
+// owned is false; otherwise, the caller owns the timer and must
+// finish it.
+func withIssuanceTimer(ctx context.Context, renewal bool) (_ context.Context, timer *issuanceTimer, owned bool) {
+	if timer := issuanceTimerFromContext(ctx); timer != nil {
+		return ctx, timer, false
+	}
+	timer = &issuanceTimer{start: time.Now(), renewal: renewal}
+	return context.WithValue(ctx, issuanceTimerCtxKey, timer), timer, true
+}
+
+func issuanceTimerFromContext(ctx context.Context) *issuanceTimer {
+	timer, _ := ctx.Value(issuanceTimerCtxKey).(*issuanceTimer)
+	return timer
+}
+
+// track starts timing a phase, and returns a function that ends
+// it; phase chooses which duration of the timing to add to.
+func (t *issuanceTimer) track(phase func(*IssuanceTiming) *time.Duration) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		*phase(&t.timing) += time.Since(start)
+		t.mu.Unlock()
+	}
+}
+
+// markIssued marks that the certificate was actually
+// issued, rather than found to exist already.
+func (t *issuanceTimer) markIssued() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.issued = true
+	t.mu.Unlock()
+}
+
+// snapshot returns the timing so far.
+func (t *issuanceTimer) snapshot() IssuanceTiming {
+	if t == nil {
+		return IssuanceTiming{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing := t.timing
+	timing.Total = time.Since(t.start)
+	return timing
+}
+
+// finish records the timing of the issuance, if a certificate was
+// issued, in the aggregate stats of certCache, and returns it.
+func (t *issuanceTimer) finish(certCache *Cache) IssuanceTiming {
+	timing := t.snapshot()
+	if t == nil || certCache == nil {
+		return timing
+	}
+	t.mu.Lock()
+	issued := t.issued
+	t.mu.Unlock()
+	if !issued {
+		return timing
+	}
+	certCache.issuanceLatency.mu.Lock()
+	if t.renewal {
+		certCache.issuanceLatency.renew.add(timing)
+	} else {
+		certCache.issuanceLatency.obtain.add(timing)
+	}
+	certCache.issuanceLatency.mu.Unlock()
+	return timing
+}
+
+// Functions that select phases to track.
+func lockWaitPhase(t *IssuanceTiming) *time.Duration       { return &t.LockWait }
+func keyGenerationPhase(t *IssuanceTiming) *time.Duration  { return &t.KeyGeneration }
+func issuancePhase(t *IssuanceTiming) *time.Duration       { return &t.Issuance }
+func dnsPropagationPhase(t *IssuanceTiming) *time.Duration { return &t.DNSPropagation }
+func storagePhase(t *IssuanceTiming) *time.Duration        { return &t.Storage }
+func retryWaitPhase(t *IssuanceTiming) *time.Duration      { return &t.RetryWait }
+func cacheLoadPhase(t *IssuanceTiming) *time.Duration      { return &t.CacheLoad }
+
+const issuanceTimerCtxKey ctxKey = "issuance_timer"
@@ -0,0 +1,136 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIssuanceTiming(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const issueDelay = 20 * time.Millisecond
+	var mu sync.Mutex
+	var eventTiming IssuanceTiming
+	cfg := &Config{
+		Issuers:   []Issuer{&testIssuer{delay: issueDelay}},
+		Storage:   &FileStorage{Path: tmpDir},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "cert_obtained" {
+				mu.Lock()
+				eventTiming, _ = data["timing"].(IssuanceTiming)
+				mu.Unlock()
+			}
+			return nil
+		},
+	}
+	cfg.certCache = NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cfg.certCache.Stop()
+
+	if err := cfg.ManageSync(ctx, []string{"timing.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if eventTiming.Issuance < issueDelay || eventTiming.Total < eventTiming.Issuance {
+		t.Errorf("Unexpected timing in cert_obtained event: %+v", eventTiming)
+	}
+
+	obtain, renew := cfg.certCache.IssuanceLatency()
+	if obtain.Count != 1 || renew.Count != 0 {
+		t.Fatalf("Expected 1 obtain and 0 renewals, got %d and %d", obtain.Count, renew.Count)
+	}
+	if obtain.Mean.CacheLoad <= 0 || obtain.Mean.Storage <= 0 || obtain.Max.Issuance < issueDelay {
+		t.Errorf("Expected cache load, storage, and issuance to be measured: %+v", obtain.Mean)
+	}
+	if obtain.Mean.Total < obtain.Mean.Issuance+obtain.Mean.CacheLoad {
+		t.Errorf("Expected total to include issuance and cache load: %+v", obtain.Mean)
+	}
+
+	// an obtain that finds the certificate in storage is not an issuance
+	if err := cfg.ObtainCertSync(ctx, "timing.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if obtain, _ := cfg.certCache.IssuanceLatency(); obtain.Count != 1 {
+		t.Errorf("Expected no-op obtain to not be counted, got count %d", obtain.Count)
+	}
+}
+
+// testIssuer issues certificates signed by its own key, after a delay.
+type testIssuer struct {
+	delay       time.Duration
+	extKeyUsage []x509.ExtKeyUsage
+
+	mu  sync.Mutex
+	key *ecdsa.PrivateKey
+}
+
+func (ti *testIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	select {
+	case <-time.After(ti.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.key == nil {
+		var err error
+		ti.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:    ti.extKeyUsage,
+	}
+	parent := &x509.Certificate{Subject: pkix.Name{CommonName: "Test Issuer"}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, csr.PublicKey, ti.key)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCertificate{Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+func (ti *testIssuer) IssuerKey() string { return "test_issuer" }
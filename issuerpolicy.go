@@ -0,0 +1,227 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	weakrand "math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IssuerErrorBudget is how many failures an issuer may have within
+// a period of time before it is considered unhealthy. Unhealthy
+// issuers are tried last, so that a degraded CA doesn't slow down
+// (or fail) every issuance while others are available, until its
+// failures have aged out of the window or it succeeds again.
+//
+// Failures are counted per issuer key, across all configs that use
+// the same cache.
+//
+// EXPERIMENTAL: Subject to change.
+type IssuerErrorBudget struct {
+	// How many failures are allowed within the window;
+	// the issuer becomes unhealthy with the next one.
+	// Default: 2.
+	MaxFailures int
+
+	// How long a failure counts against the budget.
+	// Default: 1h.
+	Window time.Duration
+}
+
+func (b *IssuerErrorBudget) maxFailures() int {
+	if b.MaxFailures > 0 {
+		return b.MaxFailures
+	}
+	return 2
+}
+
+func (b *IssuerErrorBudget) window() time.Duration {
+	if b.Window > 0 {
+		return b.Window
+	}
+	return time.Hour
+}
+
+// issuerHealth tracks recent failures of issuers, by issuer key.
+type issuerHealth struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// recordFailure records a failure of the issuer, forgetting
+// failures that are older than window.
+func (h *issuerHealth) recordFailure(issuerKey string, window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures == nil {
+		h.failures = make(map[string][]time.Time)
+	}
+	now := time.Now()
+	recent := slices.DeleteFunc(h.failures[issuerKey], func(t time.Time) bool {
+		return now.Sub(t) > window
+	})
+	h.failures[issuerKey] = append(recent, now)
+}
+
+// recordSuccess clears the failures of the issuer.
+func (h *issuerHealth) recordSuccess(issuerKey string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.failures, issuerKey)
+}
+
+// healthy returns whether the issuer is within budget.
+func (h *issuerHealth) healthy(issuerKey string, budget *IssuerErrorBudget) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var recent int
+	for _, t := range h.failures[issuerKey] {
+		if time.Since(t) <= budget.window() {
+			recent++
+		}
+	}
+	return recent <= budget.maxFailures()
+}
+
+// selectIssuers returns a copy of issuers in the order in which they
+// should be tried for name, according to the issuer policy and the
+// health of the issuers. currentIssuerKey is the key of the issuer
+// of the current certificate for name, if known.
+func (cfg *Config) selectIssuers(name string, issuers []Issuer, currentIssuerKey string) []Issuer {
+	issuers = slices.Clone(issuers)
+
+	switch cfg.IssuerPolicy {
+	case UseFirstRandomIssuer:
+		weakrand.Shuffle(len(issuers), func(i, j int) {
+			issuers[i], issuers[j] = issuers[j], issuers[i]
+		})
+
+	case UseWeightedRandomIssuer:
+		cfg.sortByWeight(issuers, func(string) float64 {
+			return weakrand.Float64()
+		})
+
+	case UseStickyIssuer:
+		// rendezvous hashing, so that adding or removing an
+		// issuer only moves the names that it gets or had
+		cfg.sortByWeight(issuers, func(issuerKey string) float64 {
+			h := fnv.New64a()
+			h.Write([]byte(issuerKey + "\x00" + name))
+			return float64(h.Sum64()>>11) / (1 << 53)
+		})
+		if i := slices.IndexFunc(issuers, func(iss Issuer) bool {
+			return iss.IssuerKey() == currentIssuerKey
+		}); i > 0 {
+			current := issuers[i]
+			copy(issuers[1:i+1], issuers[:i])
+			issuers[0] = current
+		}
+	}
+
+	// try unhealthy issuers only after all the healthy ones
+	if cfg.IssuerErrorBudget != nil && cfg.certCache != nil {
+		var healthy, unhealthy []Issuer
+		for _, iss := range issuers {
+			if cfg.certCache.issuerHealth.healthy(iss.IssuerKey(), cfg.IssuerErrorBudget) {
+				healthy = append(healthy, iss)
+			} else {
+				unhealthy = append(unhealthy, iss)
+			}
+		}
+		if len(unhealthy) > 0 && len(healthy) > 0 {
+			for _, iss := range unhealthy {
+				cfg.Logger.Warn("issuer has exceeded its error budget; trying it last",
+					zap.String("identifier", name),
+					zap.String("issuer", iss.IssuerKey()))
+			}
+			issuers = append(healthy, unhealthy...)
+		}
+	}
+
+	return issuers
+}
+
+// sortByWeight sorts issuers by a weighted random or pseudorandom
+// order, where random returns a number in [0, 1) for each issuer key.
+func (cfg *Config) sortByWeight(issuers []Issuer, random func(issuerKey string) float64) {
+	type scoredIssuer struct {
+		issuer Issuer
+		score  float64
+	}
+	scored := make([]scoredIssuer, len(issuers))
+	for i, iss := range issuers {
+		weight := cfg.IssuerWeights[iss.IssuerKey()]
+		if weight <= 0 {
+			weight = 1
+		}
+		// this is ordering by u^(1/w) (Efraimidis-Spirakis), which picks
+		// each issuer first with a probability proportional to its weight
+		u := max(random(iss.IssuerKey()), math.SmallestNonzeroFloat64)
+		scored[i] = scoredIssuer{iss, -float64(weight) / math.Log(u)}
+	}
+	slices.SortStableFunc(scored, func(a, b scoredIssuer) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+	for i, s := range scored {
+		issuers[i] = s.issuer
+	}
+}
+
+// emitIssuerChosen emits an event for trying issuer for name, as
+// the attempt'th (0-based) issuer.
+func (cfg *Config) emitIssuerChosen(ctx context.Context, name string, issuer Issuer, attempt int, renewal bool) {
+	policy := cfg.IssuerPolicy
+	if policy == "" {
+		policy = UseFirstIssuer
+	}
+	cfg.emit(ctx, "cert_issuer_chosen", map[string]any{
+		"renewal":    renewal,
+		"identifier": name,
+		"issuer":     issuer.IssuerKey(),
+		"attempt":    attempt,
+		"policy":     policy,
+	})
+}
+
+// recordIssuerResult records the outcome of an issuance
+// by issuer for the error budgets.
+func (cfg *Config) recordIssuerResult(ctx context.Context, issuer Issuer, err error) {
+	if cfg.IssuerErrorBudget == nil || cfg.certCache == nil {
+		return
+	}
+	if err == nil {
+		cfg.certCache.issuerHealth.recordSuccess(issuer.IssuerKey())
+		return
+	}
+	// it's not the issuer's fault if we gave up
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	cfg.certCache.issuerHealth.recordFailure(issuer.IssuerKey(), cfg.IssuerErrorBudget.window())
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// failingIssuer is an issuer that always fails.
+type failingIssuer struct {
+	key   string
+	calls int
+}
+
+func (fi *failingIssuer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	fi.calls++
+	return nil, errors.New("CA is down")
+}
+
+func (fi *failingIssuer) IssuerKey() string { return fi.key }
+
+func issuerKeysOf(issuers []Issuer) []string {
+	keys := make([]string, len(issuers))
+	for i, iss := range issuers {
+		keys[i] = iss.IssuerKey()
+	}
+	return keys
+}
+
+func TestSelectIssuersSticky(t *testing.T) {
+	issuers := []Issuer{&failingIssuer{key: "a"}, &failingIssuer{key: "b"}, &failingIssuer{key: "c"}}
+	cfg := &Config{IssuerPolicy: UseStickyIssuer}
+
+	// the same name always gets the same order, and names are spread over issuers
+	firsts := make(map[string]bool)
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com", "f.example.com"} {
+		order := issuerKeysOf(cfg.selectIssuers(name, issuers, ""))
+		if again := issuerKeysOf(cfg.selectIssuers(name, issuers, "")); !slices.Equal(order, again) {
+			t.Errorf("Expected same order for %s, got %v and %v", name, order, again)
+		}
+		firsts[order[0]] = true
+	}
+	if len(firsts) < 2 {
+		t.Errorf("Expected names to be spread over issuers, but all got %v", firsts)
+	}
+
+	// the issuer of the current certificate is preferred
+	if order := issuerKeysOf(cfg.selectIssuers("a.example.com", issuers, "c")); order[0] != "c" || len(order) != 3 {
+		t.Errorf("Expected current issuer first, got %v", order)
+	}
+
+	// the configured slice is not modified
+	if keys := issuerKeysOf(issuers); !slices.Equal(keys, []string{"a", "b", "c"}) {
+		t.Errorf("Configured issuers were reordered: %v", keys)
+	}
+}
+
+func TestSelectIssuersWeighted(t *testing.T) {
+	issuers := []Issuer{&failingIssuer{key: "light"}, &failingIssuer{key: "heavy"}}
+	cfg := &Config{
+		IssuerPolicy:  UseWeightedRandomIssuer,
+		IssuerWeights: map[string]int{"heavy": 9},
+	}
+	var heavyFirst int
+	const trials = 2000
+	for range trials {
+		if cfg.selectIssuers("example.com", issuers, "")[0].IssuerKey() == "heavy" {
+			heavyFirst++
+		}
+	}
+	// expect 90%; allow for randomness
+	if heavyFirst < trials*80/100 || heavyFirst > trials*97/100 {
+		t.Errorf("Expected heavy issuer first about 90%% of the time, got %d/%d", heavyFirst, trials)
+	}
+}
+
+func TestIssuerErrorBudget(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	primary := &failingIssuer{key: "primary"}
+	secondary := &testIssuer{}
+
+	var mu sync.Mutex
+	var chosen []string
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:           []Issuer{primary, secondary},
+		IssuerErrorBudget: &IssuerErrorBudget{MaxFailures: 1},
+		Storage:           &FileStorage{Path: tmpDir},
+		Logger:            defaultTestLogger,
+		OCSP:              OCSPConfig{DisableStapling: true},
+		KeySource:         StandardKeyGenerator{KeyType: P256},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "cert_issuer_chosen" {
+				mu.Lock()
+				chosen = append(chosen, data["issuer"].(string))
+				mu.Unlock()
+			}
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	for _, name := range []string{"one.example.com", "two.example.com", "three.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatalf("Obtaining %s: %v", name, err)
+		}
+	}
+
+	// the primary is within budget after 1 failure, but not after 2
+	if primary.calls != 2 {
+		t.Errorf("Expected primary to be tried 2 times, was tried %d times", primary.calls)
+	}
+	expected := []string{"primary", "test_issuer", "primary", "test_issuer", "test_issuer"}
+	if !slices.Equal(chosen, expected) {
+		t.Errorf("Expected issuers to be chosen in order %v, got %v", expected, chosen)
+	}
+}
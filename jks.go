@@ -0,0 +1,121 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EncodeJKS encodes the private key and certificate chain (leaf first)
+// as a Java KeyStore (JKS) with one private key entry under alias,
+// for JVM applications that only read the legacy JKS format. Both the
+// keystore and the key are protected by password, which Java requires
+// to be at least 6 characters; the protection of the format is weak,
+// so keystores must be kept as confidential as the key itself. Newer
+// Java versions read PKCS#12 files too (see EncodePKCS12), which
+// should be preferred.
+//
+// EXPERIMENTAL: Subject to change.
+func EncodeJKS(key crypto.PrivateKey, chain []*x509.Certificate, alias, password string) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	if alias == "" {
+		return nil, fmt.Errorf("alias is required")
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := jksProtectKey(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		Data:      protected,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	write := func(v any) { _ = binary.Write(&buf, binary.BigEndian, v) }
+	writeUTF := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+	write(uint32(0xFEEDFEED)) // magic
+	write(uint32(2))          // version
+	write(uint32(1))          // number of entries
+
+	write(uint32(1)) // private key entry
+	writeUTF(strings.ToLower(alias))
+	write(uint64(time.Now().UnixMilli()))
+	write(uint32(len(encryptedKey)))
+	buf.Write(encryptedKey)
+	write(uint32(len(chain)))
+	for _, cert := range chain {
+		writeUTF("X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	// the keystore ends with a digest that verifies its integrity
+	h := sha1.New()
+	h.Write(utf16BE(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// jksProtectKey encrypts the encoded private key like Sun's proprietary
+// JKS key protector: XOR with a stream of chained SHA-1 digests of the
+// password, followed by a digest of the password and the key.
+func jksProtectKey(plain []byte, password string) ([]byte, error) {
+	passwd := utf16BE(password)
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	protected := append([]byte{}, salt...)
+	digest := salt
+	for i := 0; i < len(plain); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+			protected = append(protected, plain[i+j]^digest[j])
+		}
+	}
+	h := sha1.New()
+	h.Write(passwd)
+	h.Write(plain)
+	return h.Sum(protected), nil
+}
+
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
@@ -0,0 +1,255 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventJournal persists certificate lifecycle events to storage as an
+// ordered, append-only log. Every entry is assigned a monotonically
+// increasing offset, so consumers that keep track of the last offset
+// they processed (e.g. inventory systems or DNS publishers) can catch
+// up with Replay after being offline instead of rescanning storage.
+//
+// Because offsets are allocated while holding a storage lock, all
+// instances sharing the same storage write to the same journal.
+//
+// EXPERIMENTAL: Subject to change.
+type EventJournal struct {
+	// The storage to write the journal to. If nil,
+	// the storage of the emitting Config is used.
+	Storage Storage
+
+	// The names of events to record. If empty,
+	// DefaultJournalEvents is used.
+	Events []string
+}
+
+// JournalEntry is a single event in an EventJournal.
+type JournalEntry struct {
+	Offset uint64         `json:"offset"`
+	Time   time.Time      `json:"time"`
+	Event  string         `json:"event"`
+	Data   map[string]any `json:"data,omitempty"`
+}
+
+// DefaultJournalEvents are the events recorded by an EventJournal
+// if its Events field is empty; these are the events which describe
+// changes to certificates in storage.
+var DefaultJournalEvents = []string{
+	"cert_obtained",
+	"cert_adopted",
+	"cert_failed",
+	"cert_ocsp_revoked",
+}
+
+// Append records an event in the journal and returns its offset.
+func (j *EventJournal) Append(ctx context.Context, storage Storage, event string, data map[string]any) (uint64, error) {
+	if j.Storage != nil {
+		storage = j.Storage
+	}
+	if storage == nil {
+		return 0, fmt.Errorf("no storage configured for event journal")
+	}
+
+	entry := JournalEntry{
+		Time:  time.Now().UTC(),
+		Event: event,
+		Data:  make(map[string]any, len(data)),
+	}
+	for k, v := range data {
+		entry.Data[k] = journalValue(v)
+	}
+
+	if err := acquireLock(ctx, storage, journalLockName); err != nil {
+		return 0, fmt.Errorf("locking event journal: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(context.WithoutCancel(ctx), storage, journalLockName); err != nil {
+			defaultLogger.Error("unable to unlock event journal", zap.Error(err))
+		}
+	}()
+
+	head, err := journalHead(ctx, storage)
+	if err != nil {
+		return 0, err
+	}
+	entry.Offset = head + 1
+
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("encoding journal entry: %v", err)
+	}
+	if err := storage.Store(ctx, journalEntryKey(entry.Offset), entryBytes); err != nil {
+		return 0, fmt.Errorf("storing journal entry: %v", err)
+	}
+	if err := storage.Store(ctx, journalHeadKey, []byte(strconv.FormatUint(entry.Offset, 10))); err != nil {
+		return 0, fmt.Errorf("storing journal head: %v", err)
+	}
+
+	return entry.Offset, nil
+}
+
+// Replay calls fn for every entry in the journal with an offset greater
+// than after, in order. Pass 0 to replay the whole journal. Entries that
+// were pruned are skipped. If fn returns an error, replay stops and the
+// error is returned. The returned offset is that of the last entry that
+// was successfully handled (or after, if there were none), which can be
+// passed to the next call to Replay.
+func (j *EventJournal) Replay(ctx context.Context, storage Storage, after uint64, fn func(JournalEntry) error) (uint64, error) {
+	if j.Storage != nil {
+		storage = j.Storage
+	}
+	if storage == nil {
+		return after, fmt.Errorf("no storage configured for event journal")
+	}
+
+	head, err := journalHead(ctx, storage)
+	if err != nil {
+		return after, err
+	}
+
+	for offset := after + 1; offset <= head; offset++ {
+		if err := ctx.Err(); err != nil {
+			return after, err
+		}
+		entryBytes, err := storage.Load(ctx, journalEntryKey(offset))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return after, fmt.Errorf("loading journal entry %d: %v", offset, err)
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(entryBytes, &entry); err != nil {
+			return after, fmt.Errorf("decoding journal entry %d: %v", offset, err)
+		}
+		if err := fn(entry); err != nil {
+			return after, err
+		}
+		after = offset
+	}
+
+	return after, nil
+}
+
+// Prune deletes all entries with an offset less than or equal to upTo.
+// The offsets of subsequent entries are not affected.
+func (j *EventJournal) Prune(ctx context.Context, storage Storage, upTo uint64) error {
+	if j.Storage != nil {
+		storage = j.Storage
+	}
+	if storage == nil {
+		return fmt.Errorf("no storage configured for event journal")
+	}
+
+	keys, err := storage.List(ctx, prefixJournal, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, key := range keys {
+		offset, err := strconv.ParseUint(path.Base(key), 10, 64)
+		if err != nil || offset > upTo {
+			continue // not an entry (e.g. the head), or one to keep
+		}
+		if err := storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleting journal entry %d: %v", offset, err)
+		}
+	}
+	return nil
+}
+
+// records returns true if event should be recorded in the journal.
+func (j *EventJournal) records(event string) bool {
+	events := j.Events
+	if len(events) == 0 {
+		events = DefaultJournalEvents
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// journalHead returns the offset of the latest entry in the journal.
+func journalHead(ctx context.Context, storage Storage) (uint64, error) {
+	headBytes, err := storage.Load(ctx, journalHeadKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("loading journal head: %v", err)
+	}
+	head, err := strconv.ParseUint(string(headBytes), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("decoding journal head (corrupted?): %v", err)
+	}
+	return head, nil
+}
+
+// journalValue converts event data values into a form that is
+// suitable for persisting; notably, certificates are reduced to
+// their public properties so that private keys are never written.
+func journalValue(v any) any {
+	switch val := v.(type) {
+	case error:
+		return val.Error()
+	case []byte:
+		return string(val)
+	case Certificate:
+		return map[string]any{
+			"subjects": val.Names,
+			"hash":     val.hash,
+			"expires":  expiresAt(val.Leaf),
+		}
+	case *Certificate:
+		if val == nil {
+			return nil
+		}
+		return journalValue(*val)
+	}
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return v
+}
+
+// journalEntryKey returns the storage key for the entry at offset;
+// offsets are zero-padded so that keys sort in journal order.
+func journalEntryKey(offset uint64) string {
+	return path.Join(prefixJournal, fmt.Sprintf("%020d", offset))
+}
+
+const (
+	prefixJournal   = "journal"
+	journalLockName = "event_journal"
+)
+
+var journalHeadKey = path.Join(prefixJournal, "head")
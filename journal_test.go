@@ -0,0 +1,73 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestEventJournalReplay(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{
+		Storage: &FileStorage{Path: tmpDir},
+		Logger:  defaultTestLogger,
+		Journal: new(EventJournal),
+	}
+
+	cfg.emit(ctx, "cert_obtained", map[string]any{"identifier": "a.example.com"})
+	cfg.emit(ctx, "tls_get_certificate", nil) // not recorded by default
+	cfg.emit(ctx, "cert_failed", map[string]any{"identifier": "b.example.com", "error": errors.New("oops")})
+	cfg.emit(ctx, "cert_obtained", map[string]any{"identifier": "c.example.com"})
+
+	var got []JournalEntry
+	last, err := cfg.Journal.Replay(ctx, cfg.Storage, 0, func(e JournalEntry) error {
+		got = append(got, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if last != 3 || len(got) != 3 {
+		t.Fatalf("Expected 3 entries ending at offset 3, got %d entries ending at %d", len(got), last)
+	}
+	if got[1].Event != "cert_failed" || got[1].Data["error"] != "oops" {
+		t.Errorf("Unexpected second entry: %+v", got[1])
+	}
+
+	// replay from an offset, after pruning
+	if err := cfg.Journal.Prune(ctx, cfg.Storage, 1); err != nil {
+		t.Fatalf("Unexpected error pruning: %v", err)
+	}
+	got = nil
+	last, err = cfg.Journal.Replay(ctx, cfg.Storage, 0, func(e JournalEntry) error {
+		got = append(got, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if last != 3 || len(got) != 2 || got[0].Offset != 2 {
+		t.Errorf("Expected entries 2 and 3 after pruning, got: %+v", got)
+	}
+}
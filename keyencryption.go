@@ -0,0 +1,153 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// KeyEncryption encrypts private keys before they are written to
+// storage, and decrypts them when they are loaded (see
+// Config.KeyEncryption). PassphraseKeyEncryption encrypts them with a
+// passphrase; other schemes, like encrypting to age recipients, can be
+// plugged in by implementing this interface.
+//
+// EXPERIMENTAL: Subject to change.
+type KeyEncryption interface {
+	// EncryptKey encrypts the PEM-encoded private key.
+	EncryptKey(ctx context.Context, keyPEM []byte) ([]byte, error)
+
+	// DecryptKey decrypts a private key that EncryptKey
+	// encrypted, and returns it PEM-encoded.
+	DecryptKey(ctx context.Context, encrypted []byte) ([]byte, error)
+}
+
+// PassphraseKeyEncryption encrypts private keys with a passphrase as
+// encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY" PEM blocks), using PBES2
+// with PBKDF2-HMAC-SHA256 and AES-256-CBC, so that other tools can
+// read them with the passphrase, for example:
+//
+//	openssl pkey -in example.com.key
+//
+// Keys that OpenSSL encrypted with PBES2 and AES-CBC can be decrypted
+// too.
+//
+// EXPERIMENTAL: Subject to change.
+type PassphraseKeyEncryption struct {
+	// The passphrase. REQUIRED.
+	Passphrase string
+
+	// The number of PBKDF2 iterations for keys that are
+	// encrypted. Default: 600000.
+	Iterations int
+}
+
+// EncryptKey implements KeyEncryption.
+func (pe PassphraseKeyEncryption) EncryptKey(_ context.Context, keyPEM []byte) ([]byte, error) {
+	if pe.Passphrase == "" {
+		return nil, fmt.Errorf("no passphrase")
+	}
+	key, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	iterations := pe.Iterations
+	if iterations <= 0 {
+		iterations = defaultKeyEncryptionIterations
+	}
+	algo, encrypted, err := pbes2Encrypt(pkcs8, pe.Passphrase, iterations)
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: algo, Data: encrypted})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// DecryptKey implements KeyEncryption.
+func (pe PassphraseKeyEncryption) DecryptKey(_ context.Context, encrypted []byte) ([]byte, error) {
+	block, _ := pem.Decode(encrypted)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("no encrypted private key found")
+	}
+	var keyInfo encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &keyInfo); err != nil {
+		return nil, fmt.Errorf("decoding encrypted private key: %v", err)
+	}
+	pkcs8, err := pbes2Decrypt(keyInfo.Algorithm, keyInfo.Data, pe.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), nil
+}
+
+// encryptKeyPEM encrypts the PEM-encoded private key with the config's
+// KeyEncryption, if any, before it is stored.
+func (cfg *Config) encryptKeyPEM(ctx context.Context, keyPEM []byte) ([]byte, error) {
+	if cfg.KeyEncryption == nil {
+		return keyPEM, nil
+	}
+	encrypted, err := cfg.KeyEncryption.EncryptKey(ctx, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting private key: %w", err)
+	}
+	return encrypted, nil
+}
+
+// decryptKeyPEM returns the PEM-encoded private key that was loaded from
+// storage, decrypted with the config's KeyEncryption if it isn't a plain
+// PEM-encoded key, which it may be if it was stored before KeyEncryption
+// was configured.
+func (cfg *Config) decryptKeyPEM(ctx context.Context, stored []byte) ([]byte, error) {
+	return decryptKeyPEM(ctx, cfg.KeyEncryption, stored)
+}
+
+// decryptKeyPEM is like Config.decryptKeyPEM, with the given
+// KeyEncryption, which may be nil, in which case the key is returned
+// as stored unless it is obviously encrypted.
+func decryptKeyPEM(ctx context.Context, keyEncryption KeyEncryption, stored []byte) ([]byte, error) {
+	block, _ := pem.Decode(stored)
+	if keyEncryption == nil {
+		if block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, fmt.Errorf("private key is encrypted, but no KeyEncryption is configured")
+		}
+		return stored, nil
+	}
+	if block != nil && strings.HasSuffix(block.Type, "PRIVATE KEY") &&
+		block.Type != "ENCRYPTED PRIVATE KEY" && len(block.Headers) == 0 {
+		return stored, nil
+	}
+	keyPEM, err := keyEncryption.DecryptKey(ctx, stored)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting private key: %w", err)
+	}
+	return keyPEM, nil
+}
+
+const defaultKeyEncryptionIterations = 600000
+
+// Interface guard
+var _ KeyEncryption = PassphraseKeyEncryption{}
@@ -0,0 +1,110 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+)
+
+// KeyRotationPolicy controls when certificates get new private keys.
+// The next key of each certificate is generated ahead of time and
+// stored (like with Config.NextKeys), so that it can be pinned (see
+// Config.Pins) or published in DANE TLSA records before it is used.
+// When the certificate is renewed with a new key, the next key is used,
+// and a new next key is generated.
+//
+// Use SubjectOverrides to rotate the keys of some names differently.
+// Ignored if ReusePrivateKeys is true.
+//
+// EXPERIMENTAL: Subject to change.
+type KeyRotationPolicy struct {
+	// How many renewals in a row reuse the key of the
+	// certificate they renew, before the next key is
+	// used. Default: 0 (a new key for every certificate).
+	Reuse int
+
+	// If true, the TLSA records selecting the public key
+	// (selector 1) of end-entity usages (1 and 3) are also
+	// published for the next key when DANE is configured,
+	// so that, when the next key is used, DANE clients
+	// already accept it and renewals don't have to wait
+	// for new records to propagate.
+	PublishNextKey bool
+}
+
+// reusesKey reports whether the renewal of the certificate in certRes
+// should reuse its key.
+func (p *KeyRotationPolicy) reusesKey(certRes CertificateResource) bool {
+	return p != nil && certRes.KeyReuses < p.Reuse
+}
+
+// nextKeys reports whether the next keys of certificates are generated
+// ahead of time.
+func (cfg *Config) nextKeys() bool {
+	return (cfg.NextKeys || cfg.KeyRotation != nil) && !cfg.ReusePrivateKeys
+}
+
+// publishesNextKey reports whether TLSA records are published for the
+// next keys of certificates.
+func (cfg *Config) publishesNextKey() bool {
+	return cfg.nextKeys() && cfg.KeyRotation != nil && cfg.KeyRotation.PublishNextKey &&
+		cfg.DANE != nil && cfg.DANE.Publisher != nil
+}
+
+// NextPublicKey returns the public key that the next certificate for
+// name will have, if it was generated ahead of time (see NextKeys and
+// KeyRotation), or nil.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) NextPublicKey(ctx context.Context, name string) (crypto.PublicKey, error) {
+	key, err := cfg.loadNextKey(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer.Public(), nil
+	}
+	return nil, nil
+}
+
+// nextKeyTLSA returns the TLSA records to publish for the next key of
+// the certificate for name, if any.
+func (cfg *Config) nextKeyTLSA(ctx context.Context, name string) []TLSARecord {
+	if !cfg.publishesNextKey() {
+		return nil
+	}
+	pub, err := cfg.NextPublicKey(ctx, name)
+	if err != nil || pub == nil {
+		return nil
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var records []TLSARecord
+	for _, p := range cfg.DANE.records() {
+		if p.Selector != 1 || (p.Usage != 1 && p.Usage != 3) {
+			continue
+		}
+		data, err := tlsaMatch(spki, p.MatchingType)
+		if err != nil {
+			continue
+		}
+		records = append(records, TLSARecord{TLSAParams: p, Data: data})
+	}
+	return records
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestKeyRotationReuse(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:     []Issuer{&testIssuer{}},
+		Storage:     &FileStorage{Path: t.TempDir()},
+		Logger:      defaultTestLogger,
+		OCSP:        OCSPConfig{DisableStapling: true},
+		KeySource:   StandardKeyGenerator{KeyType: P256},
+		KeyRotation: &KeyRotationPolicy{Reuse: 1},
+		SubjectOverrides: map[string]SubjectOverride{
+			"rotate.example.com": {KeyRotation: &KeyRotationPolicy{}},
+		},
+	})
+	ctx := context.Background()
+
+	renew := func(name string) CertificatePins {
+		t.Helper()
+		if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+			t.Fatal(err)
+		}
+		pins, err := cfg.Pins(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pins
+	}
+
+	const name = "reuse.example.com"
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	first, err := cfg.Pins(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Next == "" || first.Next == first.Current {
+		t.Fatalf("Expected a distinct next key, got %+v", first)
+	}
+
+	// the first renewal reuses the key and keeps the next key
+	if second := renew(name); second.Current != first.Current || second.Next != first.Next {
+		t.Errorf("Expected renewal to reuse the key: before %+v, after %+v", first, second)
+	}
+
+	// the second one rotates to the next key
+	third := renew(name)
+	if third.Current != first.Next {
+		t.Errorf("Expected rotation to the next key %s, got %s", first.Next, third.Current)
+	}
+	if third.Next == "" || third.Next == first.Next {
+		t.Errorf("Expected a new next key after rotation, got %+v", third)
+	}
+
+	// the override rotates the key at every renewal
+	const other = "rotate.example.com"
+	if err := cfg.ObtainCertSync(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	before, err := cfg.Pins(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := renew(other); after.Current != before.Next {
+		t.Errorf("Expected override to rotate to the next key %s, got %s", before.Next, after.Current)
+	}
+}
+
+func TestKeyRotationPublishNextKey(t *testing.T) {
+	publisher := new(recordingTLSAPublisher)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers: []Issuer{&testIssuer{}},
+		DANE: &DANEConfig{
+			Publisher:     publisher,
+			RolloverDelay: time.Hour,
+		},
+		Storage:     &FileStorage{Path: t.TempDir()},
+		Logger:      defaultTestLogger,
+		OCSP:        OCSPConfig{DisableStapling: true},
+		KeySource:   StandardKeyGenerator{KeyType: P256},
+		KeyRotation: &KeyRotationPolicy{PublishNextKey: true},
+	})
+	ctx := context.Background()
+	const name = "dane.example.com"
+	spkiHash := func(pub any) string {
+		spki, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(spki)
+		return string(sum[:])
+	}
+	publishes := func(records []TLSARecord, hash string) bool {
+		for _, rec := range records {
+			if string(rec.Data) == hash {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	next, err := cfg.NextPublicKey(ctx, name)
+	if err != nil || next == nil {
+		t.Fatalf("Expected a next key, got %v (error: %v)", next, err)
+	}
+	calls := publisher.published()
+	if len(calls) == 0 || !publishes(calls[len(calls)-1], spkiHash(next)) {
+		t.Fatalf("Expected the record of the next key to be published, got %v", calls)
+	}
+
+	// renewal doesn't wait for the rollover delay, since the
+	// record of the new key was already published
+	done := make(chan error, 1)
+	go func() { done <- cfg.RenewCertSync(ctx, name, true) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected renewal not to wait for the rollover delay")
+	}
+	pins, err := cfg.Pins(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect, _ := SPKIPin(next); pins.Current != expect {
+		t.Errorf("Expected renewed certificate to have the published next key")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// KubernetesSecretSink mirrors obtained and renewed certificates into
+// Kubernetes TLS Secrets, so that sidecars and ingresses can use them.
+// Use its OnEvent method as (or call it from) Config.OnEvent:
+//
+//	sink := &certmagic.KubernetesSecretSink{Client: secrets, Storage: storage}
+//	cfg := certmagic.NewDefault()
+//	cfg.OnEvent = sink.OnEvent
+//
+// To avoid a dependency on client-go, the Kubernetes client is adapted
+// to the small KubernetesSecrets interface.
+//
+// EXPERIMENTAL: Subject to change.
+type KubernetesSecretSink struct {
+	// The Kubernetes client. REQUIRED.
+	Client KubernetesSecrets
+
+	// The storage the certificates are stored in; the same
+	// as the config's. REQUIRED.
+	Storage Storage
+
+	// The config's KeyEncryption, if private keys are
+	// encrypted in storage, so that they are decrypted
+	// before they are written to Secrets. Default: the
+	// KeyEncryption of the config of the event.
+	KeyEncryption KeyEncryption
+
+	// Templates (text/template) for the namespace and name of
+	// the Secret of a certificate. They are executed with a
+	// KubernetesSecretName. Default namespace: "default";
+	// default name: "{{.SafeName}}-tls".
+	Namespace string
+	Name      string
+
+	// Labels to set on the Secrets.
+	Labels map[string]string
+
+	// If set, events are passed on to this function after the
+	// certificate is synchronized, and its result is returned.
+	Next func(ctx context.Context, event string, data map[string]any) error
+
+	// Optional logger.
+	Logger *zap.Logger
+}
+
+// KubernetesSecretName is what the namespace and name templates of a
+// KubernetesSecretSink are executed with.
+//
+// EXPERIMENTAL: Subject to change.
+type KubernetesSecretName struct {
+	// The name the certificate is managed for.
+	Name string
+
+	// Name, changed to be valid in a Secret name: lowercase,
+	// with wildcards written as "wildcard", and characters
+	// other than letters, digits, '-' and '.' replaced by '-'.
+	SafeName string
+
+	// The key of the issuer of the certificate.
+	Issuer string
+}
+
+// KubernetesSecret is a Secret of type kubernetes.io/tls.
+//
+// EXPERIMENTAL: Subject to change.
+type KubernetesSecret struct {
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// The type of the Secret; always "kubernetes.io/tls".
+	Type string
+
+	// The contents of the Secret: "tls.crt" is the PEM-encoded
+	// certificate chain, and "tls.key" its private key.
+	Data map[string][]byte
+}
+
+// KubernetesSecrets is the subset of a Kubernetes client used by
+// KubernetesSecretSink.
+//
+// EXPERIMENTAL: Subject to change.
+type KubernetesSecrets interface {
+	// ApplySecret creates the Secret or, if it exists, updates
+	// its type, labels, annotations, and data.
+	ApplySecret(ctx context.Context, secret KubernetesSecret) error
+}
+
+// OnEvent synchronizes the certificate of cert_obtained events, which
+// are emitted when certificates are obtained or renewed, to its Secret.
+// Errors are logged, since the event cannot be aborted anymore.
+func (ks *KubernetesSecretSink) OnEvent(ctx context.Context, event string, data map[string]any) error {
+	if event == "cert_obtained" {
+		if err := ks.sync(ctx, data); err != nil {
+			ks.logger().Error("unable to synchronize certificate to Kubernetes Secret",
+				zap.Any("identifier", data["identifier"]),
+				zap.Error(err))
+		}
+	}
+	if ks.Next != nil {
+		return ks.Next(ctx, event, data)
+	}
+	return nil
+}
+
+// Sync loads the certificate managed for name by the issuer with
+// issuerKey from storage and writes it to its Secret, for example
+// to fill Secrets of certificates that were obtained before.
+func (ks *KubernetesSecretSink) Sync(ctx context.Context, issuerKey, name string) error {
+	return ks.sync(ctx, map[string]any{
+		"identifier":       name,
+		"issuer":           issuerKey,
+		"certificate_path": StorageKeys.SiteCert(issuerKey, name),
+		"private_key_path": StorageKeys.SitePrivateKey(issuerKey, name),
+	})
+}
+
+func (ks *KubernetesSecretSink) sync(ctx context.Context, data map[string]any) error {
+	name, _ := data["identifier"].(string)
+	issuerKey, _ := data["issuer"].(string)
+	certPath, _ := data["certificate_path"].(string)
+	keyPath, _ := data["private_key_path"].(string)
+	if name == "" || certPath == "" || keyPath == "" {
+		return fmt.Errorf("event is missing certificate information")
+	}
+
+	certPEM, err := ks.Storage.Load(ctx, certPath)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+	keyPEM, err := ks.Storage.Load(ctx, keyPath)
+	if err != nil {
+		return fmt.Errorf("loading private key: %v", err)
+	}
+	keyEncryption := ks.KeyEncryption
+	if cfg, ok := ctx.Value(ctxKeyConfig).(*Config); ok && cfg != nil && keyEncryption == nil {
+		keyEncryption = cfg.KeyEncryption
+	}
+	if keyPEM, err = decryptKeyPEM(ctx, keyEncryption, keyPEM); err != nil {
+		return err
+	}
+
+	secret, err := ks.secret(KubernetesSecretName{
+		Name:     name,
+		SafeName: kubernetesSafeName(name),
+		Issuer:   issuerKey,
+	})
+	if err != nil {
+		return err
+	}
+	secret.Data = map[string][]byte{
+		"tls.crt": certPEM,
+		"tls.key": keyPEM,
+	}
+	secret.Annotations = map[string]string{
+		"certmagic/identifier": name,
+		"certmagic/issuer":     issuerKey,
+	}
+	if certs, err := parseCertsFromPEMBundle(certPEM); err == nil {
+		secret.Annotations["certmagic/not-after"] = certs[0].NotAfter.UTC().Format(time.RFC3339)
+	}
+
+	if err := ks.Client.ApplySecret(ctx, secret); err != nil {
+		return fmt.Errorf("applying Secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+
+	ks.logger().Info("synchronized certificate to Kubernetes Secret",
+		zap.String("identifier", name),
+		zap.String("namespace", secret.Namespace),
+		zap.String("secret", secret.Name))
+
+	return nil
+}
+
+// secret returns the Secret (without contents) to write the certificate
+// described by sn to.
+func (ks *KubernetesSecretSink) secret(sn KubernetesSecretName) (KubernetesSecret, error) {
+	namespaceTmpl, err := template.New("namespace").Parse(cmp.Or(ks.Namespace, "default"))
+	if err != nil {
+		return KubernetesSecret{}, fmt.Errorf("parsing namespace template: %v", err)
+	}
+	nameTmpl, err := template.New("name").Parse(cmp.Or(ks.Name, "{{.SafeName}}-tls"))
+	if err != nil {
+		return KubernetesSecret{}, fmt.Errorf("parsing name template: %v", err)
+	}
+
+	var namespace, name strings.Builder
+	if err := namespaceTmpl.Execute(&namespace, sn); err != nil {
+		return KubernetesSecret{}, fmt.Errorf("executing namespace template: %v", err)
+	}
+	if err := nameTmpl.Execute(&name, sn); err != nil {
+		return KubernetesSecret{}, fmt.Errorf("executing name template: %v", err)
+	}
+
+	return KubernetesSecret{
+		Namespace: namespace.String(),
+		Name:      name.String(),
+		Labels:    maps.Clone(ks.Labels),
+		Type:      "kubernetes.io/tls",
+	}, nil
+}
+
+func (ks *KubernetesSecretSink) logger() *zap.Logger {
+	if ks.Logger != nil {
+		return ks.Logger
+	}
+	return defaultLogger
+}
+
+// kubernetesSafeName changes name so it can be part of a Secret name.
+func kubernetesSafeName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.ReplaceAll(name, "*", "wildcard")
+	return kubernetesUnsafeChars.ReplaceAllLiteralString(name, "-")
+}
+
+var kubernetesUnsafeChars = regexp.MustCompile(`[^a-z0-9.-]`)
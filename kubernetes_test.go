@@ -0,0 +1,96 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+)
+
+type fakeKubernetesSecrets struct {
+	mu      sync.Mutex
+	secrets map[string]KubernetesSecret
+}
+
+func (f *fakeKubernetesSecrets) ApplySecret(_ context.Context, secret KubernetesSecret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.secrets == nil {
+		f.secrets = make(map[string]KubernetesSecret)
+	}
+	f.secrets[secret.Namespace+"/"+secret.Name] = secret
+	return nil
+}
+
+func TestKubernetesSecretSink(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	client := new(fakeKubernetesSecrets)
+	var nextCalled bool
+	sink := &KubernetesSecretSink{
+		Client:    client,
+		Storage:   storage,
+		Namespace: "{{if eq .Issuer \"test_issuer\"}}testing{{end}}",
+		Labels:    map[string]string{"app": "web"},
+		Logger:    defaultTestLogger,
+		Next: func(context.Context, string, map[string]any) error {
+			nextCalled = true
+			return nil
+		},
+	}
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   storage,
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnEvent:   sink.OnEvent,
+	})
+
+	if err := cfg.ObtainCertSync(ctx, "*.Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	secret, ok := client.secrets["testing/wildcard.example.com-tls"]
+	if !ok {
+		t.Fatalf("Expected Secret named by templates, got %v", client.secrets)
+	}
+	certPEM, _ := storage.Load(ctx, StorageKeys.SiteCert("test_issuer", "*.example.com"))
+	if secret.Type != "kubernetes.io/tls" || !bytes.Equal(secret.Data["tls.crt"], certPEM) || len(secret.Data["tls.key"]) == 0 {
+		t.Errorf("Unexpected Secret contents: %+v", secret)
+	}
+	if secret.Labels["app"] != "web" || secret.Annotations["certmagic/not-after"] == "" {
+		t.Errorf("Expected labels and annotations, got %v and %v", secret.Labels, secret.Annotations)
+	}
+	if !nextCalled {
+		t.Error("Expected events to be passed on")
+	}
+
+	// renewals replace the Secret's contents
+	if err := cfg.RenewCertSync(ctx, "*.example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if renewed := client.secrets["testing/wildcard.example.com-tls"]; bytes.Equal(renewed.Data["tls.crt"], certPEM) {
+		t.Error("Expected renewed certificate in Secret")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LeaderElector elects one instance of a cluster that shares storage
+// to renew certificates in the background. When a cache has one (see
+// CacheOptions.LeaderElection), its maintenance only renews certificates
+// if it is the leader; followers reload certificates from storage once
+// the leader renewed them. This avoids duplicate renewals and wasted
+// orders with the CA. Certificates are still obtained and renewed
+// on demand by any instance during handshakes, and by ObtainCertSync
+// and similar calls.
+//
+// EXPERIMENTAL: Subject to change.
+type LeaderElector interface {
+	// Leading tries to make or keep the instance, identified
+	// by the ID of its cache, the leader, and reports whether
+	// it is. It is called before each renewal check; an error
+	// makes the instance act as a follower until the next one.
+	Leading(ctx context.Context, instance string) (bool, error)
+}
+
+// StorageLeaderElection is a LeaderElector that elects a leader with a
+// lease in storage: the first instance to find the lease missing or
+// expired takes it, and keeps it by renewing it at each renewal check.
+// The lease is changed while holding a lock in storage. If the leader
+// is stopped, another instance takes over once its lease expires.
+//
+// EXPERIMENTAL: Subject to change.
+type StorageLeaderElection struct {
+	// The storage shared by the cluster. REQUIRED.
+	Storage Storage
+
+	// The storage key of the lease. Default:
+	// "maintenance_leader.json".
+	Key string
+
+	// How long a lease is valid without being renewed. It
+	// should be longer than the caches' RenewCheckInterval,
+	// so the leader keeps its lease between checks. Default:
+	// 3 times DefaultRenewCheckInterval.
+	Lease time.Duration
+}
+
+// leaderLease is the lease of the leader in storage.
+type leaderLease struct {
+	Leader  string    `json:"leader"`
+	Expires time.Time `json:"expires"`
+}
+
+// Leading implements LeaderElector.
+func (sle StorageLeaderElection) Leading(ctx context.Context, instance string) (bool, error) {
+	key := sle.Key
+	if key == "" {
+		key = "maintenance_leader.json"
+	}
+	duration := sle.Lease
+	if duration <= 0 {
+		duration = 3 * DefaultRenewCheckInterval
+	}
+
+	lockKey := "leader_" + key
+	if err := acquireLock(ctx, sle.Storage, lockKey); err != nil {
+		return false, fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		_ = releaseLock(ctx, sle.Storage, lockKey)
+	}()
+
+	var lease leaderLease
+	leaseJSON, err := sle.Storage.Load(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("loading leader lease: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(leaseJSON, &lease); err != nil {
+			return false, fmt.Errorf("decoding leader lease: %v", err)
+		}
+	}
+
+	now := time.Now()
+	if lease.Leader != instance && now.Before(lease.Expires) {
+		return false, nil
+	}
+
+	lease = leaderLease{Leader: instance, Expires: now.Add(duration)}
+	leaseJSON, err = json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	if err := sle.Storage.Store(ctx, key, leaseJSON); err != nil {
+		return false, fmt.Errorf("storing leader lease: %v", err)
+	}
+	return true, nil
+}
+
+// leading reports whether the cache should renew certificates in the
+// background: if it is the elected leader, or if leaders aren't elected.
+func (certCache *Cache) leading(ctx context.Context) bool {
+	certCache.optionsMu.RLock()
+	elector := certCache.options.LeaderElection
+	certCache.optionsMu.RUnlock()
+	if elector == nil {
+		return true
+	}
+
+	log := certCache.logger.Named("maintenance")
+	leading, err := elector.Leading(ctx, certCache.instanceID)
+	if err != nil {
+		log.Error("electing leader; acting as follower", zap.Error(err))
+		leading = false
+	}
+	if certCache.leader.Swap(leading) != leading {
+		if leading {
+			log.Info("became leader; renewing certificates", zap.String("instance", certCache.instanceID))
+		} else {
+			log.Info("no longer leader; leaving renewals to the leader", zap.String("instance", certCache.instanceID))
+		}
+	}
+	return leading
+}
+
+// Interface guard
+var _ LeaderElector = StorageLeaderElection{}
@@ -0,0 +1,130 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStorageLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	election := StorageLeaderElection{
+		Storage: &FileStorage{Path: t.TempDir()},
+		Lease:   100 * time.Millisecond,
+	}
+
+	for i, tc := range []struct {
+		instance string
+		sleep    time.Duration
+		expect   bool
+	}{
+		{instance: "a", expect: true},
+		{instance: "b", expect: false},
+		{instance: "a", expect: true},
+		{instance: "b", sleep: 150 * time.Millisecond, expect: true},
+		{instance: "a", expect: false},
+	} {
+		time.Sleep(tc.sleep)
+		leading, err := election.Leading(ctx, tc.instance)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if leading != tc.expect {
+			t.Errorf("Test %d: Expected %s leading=%t, got %t", i, tc.instance, tc.expect, leading)
+		}
+	}
+}
+
+type fakeLeaderElector struct {
+	leading atomic.Bool
+	calls   atomic.Int32
+}
+
+func (f *fakeLeaderElector) Leading(context.Context, string) (bool, error) {
+	f.calls.Add(1)
+	return f.leading.Load(), nil
+}
+
+func TestMaintenanceRenewsOnlyAsLeader(t *testing.T) {
+	elector := new(fakeLeaderElector)
+	issuer := new(csrRecordingIssuer)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		LeaderElection:   elector,
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		// every certificate needs renewal right away
+		RenewalWindowRatio: 0.9999,
+		DisableARI:         true,
+	})
+	ctx := context.Background()
+	if err := cfg.ManageSync(ctx, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	csrs := func() int {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		return len(issuer.csrs)
+	}
+
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := csrs(); n != 1 {
+		t.Fatalf("Expected follower not to renew, got %d CSRs", n)
+	}
+
+	elector.leading.Store(true)
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); csrs() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected leader to renew certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaintenanceKeepsLeadershipWhenQuiet(t *testing.T) {
+	elector := new(fakeLeaderElector)
+	elector.leading.Store(true)
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		LeaderElection:   elector,
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+
+	// nothing needs renewal, but the leader must still renew its lease
+	if err := cache.RenewManagedCertificates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := elector.calls.Load(); n != 1 {
+		t.Errorf("Expected leader to be elected once per renewal check, got %d elections", n)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ListenerOptions configures the TCP listeners made by
+// ListenWithOptions and Config.Listen.
+//
+// EXPERIMENTAL: Subject to change.
+type ListenerOptions struct {
+	// Expect connections to begin with a PROXY protocol
+	// header (version 1 or 2), as sent by L4 load balancers,
+	// so that the remote address of connections, which
+	// on-demand decisions and logs see, is that of the
+	// client rather than that of the load balancer. If
+	// enabled, the header is required.
+	ProxyProtocol bool
+
+	// How long to wait for the PROXY protocol header
+	// of a connection. Default: 5s.
+	ProxyHeaderTimeout time.Duration
+
+	// If greater than 0, enable TCP Fast Open with a
+	// queue of this many pending connections. Only
+	// supported on Linux.
+	TCPFastOpen int
+
+	// An optional function to set other socket options;
+	// see net.ListenConfig.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// Listen listens for TCP connections on address with the options.
+// The listener is not a TLS listener.
+//
+// EXPERIMENTAL: Subject to change.
+func (opts ListenerOptions) Listen(ctx context.Context, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if opts.TCPFastOpen > 0 {
+				var sockErr error
+				if err := c.Control(func(fd uintptr) {
+					sockErr = setTCPFastOpen(fd, opts.TCPFastOpen)
+				}); err != nil {
+					return err
+				}
+				if sockErr != nil {
+					return fmt.Errorf("enabling TCP Fast Open: %w", sockErr)
+				}
+			}
+			if opts.Control != nil {
+				return opts.Control(network, address, c)
+			}
+			return nil
+		},
+	}
+	ln, err := lc.Listen(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ProxyProtocol {
+		ln = proxyProtocolListener{Listener: ln, headerTimeout: opts.ProxyHeaderTimeout}
+	}
+	return ln, nil
+}
+
+// Listen returns a TLS listener on address with the options, which
+// serves the certificates managed by cfg. The PROXY protocol header
+// is read before the TLS handshake, so that it sees the address of
+// the client.
+//
+// TLS-ALPN challenges are answered over the listener, since
+// challenge servers don't bind a port that is already in use. So
+// if the listener is behind a load balancer, like when using the
+// PROXY protocol, manage certificates after listening, and accept
+// connections while they are obtained, for example with ManageAsync.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Listen(ctx context.Context, address string, opts ListenerOptions) (net.Listener, error) {
+	ln, err := opts.Listen(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, cfg.TLSConfig()), nil
+}
+
+// ListenWithOptions is like Listen, except that the listener has the
+// options, and that it returns before the certificates are obtained,
+// so that TLS-ALPN challenges are answered over it; see Config.Listen.
+// Until then, TLS handshakes for the names fail. It uses the Default
+// config.
+//
+// Calling this function signifies your acceptance to
+// the CA's Subscriber Agreement and/or Terms of Service.
+//
+// EXPERIMENTAL: Subject to change.
+func ListenWithOptions(domainNames []string, opts ListenerOptions) (net.Listener, error) {
+	DefaultACME.Agreed = true
+	DefaultACME.DisableHTTPChallenge = true
+	cfg := NewDefault()
+	ln, err := cfg.Listen(context.Background(), fmt.Sprintf(":%d", HTTPSPort), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.ManageAsync(context.Background(), domainNames); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConfigListen(t *testing.T) {
+	ctx := context.Background()
+	const name = "listen.example.com"
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	var helloAddr string
+	cfg = New(cache, Config{
+		Issuers: []Issuer{&testIssuer{}},
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+		OCSP:    OCSPConfig{DisableStapling: true},
+		OnDemand: &OnDemandConfig{
+			DecisionFunc: func(ctx context.Context, name string) error {
+				helloAddr = ctx.Value(ClientHelloInfoCtxKey).(*tls.ClientHelloInfo).Conn.RemoteAddr().String()
+				return nil
+			},
+		},
+	})
+
+	opts := ListenerOptions{ProxyProtocol: true, ProxyHeaderTimeout: 5 * time.Second}
+	if runtime.GOOS == "linux" {
+		opts.TCPFastOpen = 16
+	}
+	ln, err := cfg.Listen(ctx, "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		// complete the handshake
+		io.ReadAll(conn)
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := tlsConn.ConnectionState().PeerCertificates[0].DNSNames[0]; cn != name {
+		t.Errorf("Expected certificate for %s, got %s", name, cn)
+	}
+	tlsConn.Close()
+
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.Fatal("Expected a connection")
+	}
+	const expect = "203.0.113.7:51234"
+	if addr := serverConn.RemoteAddr().String(); addr != expect {
+		t.Errorf("Expected remote address %s, got %s", expect, addr)
+	}
+	if helloAddr != expect {
+		t.Errorf("Expected on-demand decision to see %s, got %s", expect, helloAddr)
+	}
+}
@@ -0,0 +1,435 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LockRefresher is a Storage that needs the locks that are held to be
+// refreshed regularly, so that they are not considered stale while
+// their holder is alive. When storage implements it, the locks that
+// this package holds are refreshed by the LockSupervisor; storage
+// implementations no longer need to run heartbeats of their own.
+//
+// EXPERIMENTAL: Subject to change.
+type LockRefresher interface {
+	// RefreshLock updates the last-refreshed time of the
+	// lock for name, which this process holds.
+	RefreshLock(ctx context.Context, name string) error
+}
+
+// LockInspector is a Storage that can describe and forcefully release
+// locks, including those held by other processes. When storage
+// implements it, the LockSupervisor can reclaim locks left behind by
+// crashed processes according to its StaleLockPolicy.
+//
+// EXPERIMENTAL: Subject to change.
+type LockInspector interface {
+	// LockInfo describes the lock for name. It returns an
+	// error satisfying errors.Is(err, fs.ErrNotExist) if
+	// nobody holds the lock.
+	LockInfo(ctx context.Context, name string) (LockInfo, error)
+
+	// BreakLock releases the lock for name, whoever holds it.
+	BreakLock(ctx context.Context, name string) error
+}
+
+// LockLister is a LockInspector that can also list the locks in
+// storage, so that storage cleaning can break abandoned locks.
+//
+// EXPERIMENTAL: Subject to change.
+type LockLister interface {
+	LockInspector
+
+	// ListLocks returns the names of all locks in storage,
+	// whoever holds them.
+	ListLocks(ctx context.Context) ([]string, error)
+}
+
+// LockInfo describes a lock in storage.
+//
+// EXPERIMENTAL: Subject to change.
+type LockInfo struct {
+	// The name of the lock.
+	Name string
+
+	// When the lock was acquired and last refreshed.
+	Created time.Time
+	Updated time.Time
+
+	// Who holds the lock, if known; for example a
+	// hostname and process ID.
+	Holder string
+}
+
+// StaleLockPolicy decides when a lock held by another process is
+// considered stale, so that it may be broken. A zero policy doesn't
+// consider any lock stale (but storage implementations may still
+// apply rules of their own).
+//
+// EXPERIMENTAL: Subject to change.
+type StaleLockPolicy struct {
+	// A lock is stale if it has not been refreshed in this
+	// long. It should be a few times the heartbeat interval
+	// of the holders.
+	MaxIdle time.Duration
+
+	// A lock is stale if it was acquired this long ago, even
+	// if it is refreshed; for holders that hang. 0 means no
+	// limit.
+	MaxAge time.Duration
+}
+
+// IsStale returns whether the lock described by info is stale
+// according to the policy.
+func (p StaleLockPolicy) IsStale(info LockInfo, now time.Time) bool {
+	updated := info.Updated
+	if updated.IsZero() {
+		updated = info.Created
+	}
+	if p.MaxIdle > 0 && !updated.IsZero() && now.Sub(updated) > p.MaxIdle {
+		return true
+	}
+	if p.MaxAge > 0 && !info.Created.IsZero() && now.Sub(info.Created) > p.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (p StaleLockPolicy) enabled() bool { return p.MaxIdle > 0 || p.MaxAge > 0 }
+
+// LockSupervisor keeps track of the storage locks held by this process.
+// It refreshes them if their storage is a LockRefresher, reclaims stale
+// locks of other processes while waiting for them if their storage is
+// a LockInspector, and counts how contended locks are.
+//
+// All locks of this package go through DefaultLockSupervisor; change
+// its settings before locks are acquired.
+//
+// EXPERIMENTAL: Subject to change.
+type LockSupervisor struct {
+	// How often to refresh held locks whose storage is a
+	// LockRefresher. Default: 5s.
+	HeartbeatInterval time.Duration
+
+	// When locks held by other processes are reclaimed.
+	Stale StaleLockPolicy
+
+	// How often to inspect a lock while waiting for it, to
+	// check if it is stale. Default: 1s.
+	InspectInterval time.Duration
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu      sync.Mutex
+	held    map[string]*heldLock // keyed by lock name
+	metrics LockMetrics
+}
+
+// DefaultLockSupervisor supervises the locks of this package.
+//
+// EXPERIMENTAL: Subject to change.
+var DefaultLockSupervisor = new(LockSupervisor)
+
+type heldLock struct {
+	HeldLock
+	storage Storage
+	stop    chan struct{}
+}
+
+// HeldLock is a lock that this process holds.
+//
+// EXPERIMENTAL: Subject to change.
+type HeldLock struct {
+	Name          string
+	Storage       string
+	Acquired      time.Time
+	LastHeartbeat time.Time
+}
+
+// LockMetrics counts how locks have been used since the process
+// started.
+//
+// EXPERIMENTAL: Subject to change.
+type LockMetrics struct {
+	// The number of locks currently held.
+	Held int
+
+	// Successful and failed acquisitions.
+	Acquired uint64
+	Failed   uint64
+
+	// Acquisitions that had to wait for another holder, and
+	// the total and longest time spent waiting.
+	Contended uint64
+	WaitTime  time.Duration
+	MaxWait   time.Duration
+
+	// Stale locks of other processes that were broken.
+	StaleReclaimed uint64
+
+	// Heartbeats that failed to refresh a held lock.
+	HeartbeatFailures uint64
+}
+
+// Metrics returns the lock metrics so far.
+func (ls *LockSupervisor) Metrics() LockMetrics {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	metrics := ls.metrics
+	metrics.Held = len(ls.held)
+	return metrics
+}
+
+// HeldLocks returns the locks this process holds, by name.
+func (ls *LockSupervisor) HeldLocks() []HeldLock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	held := make([]HeldLock, 0, len(ls.held))
+	for _, hl := range ls.held {
+		held = append(held, hl.HeldLock)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Name < held[j].Name })
+	return held
+}
+
+// acquire obtains the lock for name from storage, reclaiming it if it
+// is stale, and keeps it refreshed until it is released.
+func (ls *LockSupervisor) acquire(ctx context.Context, storage Storage, name string) error {
+	start := time.Now()
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	var inspecting sync.WaitGroup
+	if inspector, ok := storage.(LockInspector); ok && ls.Stale.enabled() {
+		inspecting.Add(1)
+		go func() {
+			defer inspecting.Done()
+			ls.reclaimWhileWaiting(lockCtx, inspector, name)
+		}()
+	}
+	err := storage.Lock(lockCtx, name)
+	cancel()
+	inspecting.Wait()
+
+	wait := time.Since(start)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err != nil {
+		ls.metrics.Failed++
+		return err
+	}
+	ls.metrics.Acquired++
+	if wait > lockContentionThreshold {
+		ls.metrics.Contended++
+	}
+	ls.metrics.WaitTime += wait
+	ls.metrics.MaxWait = max(ls.metrics.MaxWait, wait)
+
+	if ls.held == nil {
+		ls.held = make(map[string]*heldLock)
+	}
+	now := time.Now()
+	hl := &heldLock{
+		HeldLock: HeldLock{
+			Name:          name,
+			Storage:       fmt.Sprintf("%v", storage),
+			Acquired:      now,
+			LastHeartbeat: now,
+		},
+		storage: storage,
+		stop:    make(chan struct{}),
+	}
+	ls.held[name] = hl
+	if refresher, ok := storage.(LockRefresher); ok {
+		go ls.heartbeat(refresher, hl)
+	}
+	return nil
+}
+
+// release releases the lock for name in storage.
+func (ls *LockSupervisor) release(ctx context.Context, storage Storage, name string) error {
+	ls.stopHeartbeat(name)
+	err := storage.Unlock(context.WithoutCancel(ctx), name)
+	if err == nil {
+		ls.forget(name)
+	}
+	return err
+}
+
+// releaseAll releases all held locks; see CleanUpOwnLocks.
+func (ls *LockSupervisor) releaseAll(ctx context.Context, logger *zap.Logger) {
+	ls.mu.Lock()
+	held := make([]*heldLock, 0, len(ls.held))
+	for _, hl := range ls.held {
+		held = append(held, hl)
+	}
+	ls.mu.Unlock()
+
+	for _, hl := range held {
+		if err := hl.storage.Unlock(ctx, hl.Name); err != nil {
+			if logger != nil {
+				logger.Error("unable to clean up lock in storage backend",
+					zap.Any("storage", hl.storage),
+					zap.String("lock_key", hl.Name),
+					zap.Error(err))
+			}
+			continue
+		}
+		ls.forget(hl.Name)
+	}
+}
+
+// stopHeartbeat stops refreshing the lock for name, which is
+// about to be released.
+func (ls *LockSupervisor) stopHeartbeat(name string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if hl, ok := ls.held[name]; ok {
+		select {
+		case <-hl.stop:
+		default:
+			close(hl.stop)
+		}
+	}
+}
+
+func (ls *LockSupervisor) forget(name string) {
+	ls.stopHeartbeat(name)
+	ls.mu.Lock()
+	delete(ls.held, name)
+	ls.mu.Unlock()
+}
+
+// heartbeat refreshes hl until it is released.
+func (ls *LockSupervisor) heartbeat(refresher LockRefresher, hl *heldLock) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("panic: lock heartbeat: %v\n%s", err, buf)
+		}
+	}()
+
+	interval := ls.HeartbeatInterval
+	if interval <= 0 {
+		interval = lockFreshnessInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hl.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := refresher.RefreshLock(ctx, hl.Name)
+		cancel()
+
+		// the lock may have been released meanwhile
+		select {
+		case <-hl.stop:
+			return
+		default:
+		}
+
+		ls.mu.Lock()
+		if err != nil {
+			ls.metrics.HeartbeatFailures++
+		} else if ls.held[hl.Name] == hl {
+			ls.held[hl.Name].LastHeartbeat = time.Now()
+		}
+		ls.mu.Unlock()
+		if err != nil {
+			ls.logger().Error("refreshing lock",
+				zap.String("lock", hl.Name),
+				zap.String("storage", hl.Storage),
+				zap.Error(err))
+		}
+	}
+}
+
+// reclaimWhileWaiting breaks the lock for name if it becomes stale
+// while ctx is not done, unless this process holds it.
+func (ls *LockSupervisor) reclaimWhileWaiting(ctx context.Context, inspector LockInspector, name string) {
+	interval := ls.InspectInterval
+	if interval <= 0 {
+		interval = fileLockPollInterval
+	}
+	for {
+		ls.reclaimIfStale(ctx, inspector, name)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (ls *LockSupervisor) reclaimIfStale(ctx context.Context, inspector LockInspector, name string) {
+	ls.mu.Lock()
+	_, ours := ls.held[name]
+	ls.mu.Unlock()
+	if ours {
+		return // refreshed by us; wait for our own holder
+	}
+
+	info, err := inspector.LockInfo(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) || ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		ls.logger().Warn("inspecting lock", zap.String("lock", name), zap.Error(err))
+		return
+	}
+	if !ls.Stale.IsStale(info, time.Now()) {
+		return
+	}
+	if err := inspector.BreakLock(ctx, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ls.logger().Error("breaking stale lock", zap.String("lock", name), zap.Error(err))
+		return
+	}
+	ls.mu.Lock()
+	ls.metrics.StaleReclaimed++
+	ls.mu.Unlock()
+	ls.logger().Warn("broke stale lock",
+		zap.String("lock", name),
+		zap.String("holder", info.Holder),
+		zap.Time("created", info.Created),
+		zap.Time("updated", info.Updated))
+}
+
+func (ls *LockSupervisor) logger() *zap.Logger {
+	if ls.Logger != nil {
+		return ls.Logger.Named("locks")
+	}
+	return defaultLogger.Named("locks")
+}
+
+// lockContentionThreshold is how long an acquisition may take
+// before it counts as contended.
+const lockContentionThreshold = 100 * time.Millisecond
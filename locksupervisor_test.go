@@ -0,0 +1,169 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockTestStorage is a memoryStorage with locks that are refreshed
+// and inspected by a LockSupervisor.
+type lockTestStorage struct {
+	memoryStorage
+
+	mu        sync.Mutex
+	locks     map[string]LockInfo
+	refreshes int
+}
+
+func (s *lockTestStorage) Lock(ctx context.Context, name string) error {
+	for {
+		s.mu.Lock()
+		if _, ok := s.locks[name]; !ok {
+			if s.locks == nil {
+				s.locks = make(map[string]LockInfo)
+			}
+			now := time.Now()
+			s.locks[name] = LockInfo{Name: name, Created: now, Updated: now, Holder: "test"}
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *lockTestStorage) Unlock(_ context.Context, name string) error {
+	return s.BreakLock(context.Background(), name)
+}
+
+func (s *lockTestStorage) RefreshLock(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.locks[name]
+	if !ok {
+		return fmt.Errorf("lock %s is not held", name)
+	}
+	info.Updated = time.Now()
+	s.locks[name] = info
+	s.refreshes++
+	return nil
+}
+
+func (s *lockTestStorage) LockInfo(_ context.Context, name string) (LockInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.locks[name]
+	if !ok {
+		return LockInfo{}, fs.ErrNotExist
+	}
+	return info, nil
+}
+
+func (s *lockTestStorage) BreakLock(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[name]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.locks, name)
+	return nil
+}
+
+func (s *lockTestStorage) refreshCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+func TestLockSupervisorHeartbeat(t *testing.T) {
+	ls := &LockSupervisor{HeartbeatInterval: 10 * time.Millisecond, Logger: defaultTestLogger}
+	storage := new(lockTestStorage)
+	ctx := context.Background()
+
+	if err := ls.acquire(ctx, storage, "op_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	held := ls.HeldLocks()
+	if len(held) != 1 || held[0].Name != "op_example.com" {
+		t.Fatalf("Expected the acquired lock to be held, got %+v", held)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if storage.refreshCount() == 0 {
+		t.Error("Expected the held lock to be refreshed")
+	}
+
+	if err := ls.release(ctx, storage, "op_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	refreshes := storage.refreshCount()
+	time.Sleep(30 * time.Millisecond)
+	if storage.refreshCount() != refreshes {
+		t.Error("Expected no refreshes after release")
+	}
+
+	metrics := ls.Metrics()
+	if metrics.Held != 0 || metrics.Acquired != 1 || metrics.HeartbeatFailures != 0 {
+		t.Errorf("Unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestLockSupervisorStaleLocks(t *testing.T) {
+	ls := &LockSupervisor{
+		Stale:           StaleLockPolicy{MaxIdle: time.Minute},
+		InspectInterval: 10 * time.Millisecond,
+		Logger:          defaultTestLogger,
+	}
+	storage := &lockTestStorage{locks: map[string]LockInfo{
+		"stale": {Name: "stale", Created: time.Now().Add(-2 * time.Hour), Updated: time.Now().Add(-time.Hour), Holder: "crashed:1"},
+		"fresh": {Name: "fresh", Created: time.Now(), Updated: time.Now(), Holder: "alive:2"},
+	}}
+	ctx := context.Background()
+
+	// a lock that a crashed process left behind is reclaimed
+	if err := ls.acquire(ctx, storage, "stale"); err != nil {
+		t.Fatalf("Expected the stale lock to be reclaimed: %v", err)
+	}
+
+	// a lock that is refreshed is waited for
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := ls.acquire(waitCtx, storage, "fresh"); err == nil {
+		t.Fatal("Expected to keep waiting for a fresh lock")
+	}
+
+	metrics := ls.Metrics()
+	if metrics.StaleReclaimed != 1 || metrics.Acquired != 1 || metrics.Failed != 1 || metrics.Held != 1 {
+		t.Errorf("Unexpected metrics: %+v", metrics)
+	}
+
+	// the staleness rules
+	if ls.Stale.IsStale(LockInfo{Updated: time.Now()}, time.Now()) {
+		t.Error("Expected a fresh lock not to be stale")
+	}
+	if !(StaleLockPolicy{MaxAge: time.Hour}).IsStale(LockInfo{Created: time.Now().Add(-2 * time.Hour), Updated: time.Now()}, time.Now()) {
+		t.Error("Expected a lock held for longer than MaxAge to be stale")
+	}
+}
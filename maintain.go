@@ -25,6 +25,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mholt/acmez/v3/acme"
@@ -56,7 +57,8 @@ func (certCache *Cache) maintainAssets(panicCount int) {
 	}()
 
 	certCache.optionsMu.RLock()
-	renewalTicker := time.NewTicker(certCache.options.RenewCheckInterval)
+	renewCheckInterval := certCache.options.RenewCheckInterval
+	renewalTicker := time.NewTicker(renewCheckInterval)
 	ocspTicker := time.NewTicker(certCache.options.OCSPCheckInterval)
 	certCache.optionsMu.RUnlock()
 
@@ -72,6 +74,14 @@ func (certCache *Cache) maintainAssets(panicCount int) {
 			if err != nil {
 				log.Error("renewing managed certificates", zap.Error(err))
 			}
+			certCache.updateDelegatedCredentials(ctx)
+			if interval := certCache.updateRenewCheckInterval(); interval != renewCheckInterval {
+				log.Info("adjusted renewal check interval for certificate lifetimes",
+					zap.Duration("old_interval", renewCheckInterval),
+					zap.Duration("new_interval", interval))
+				renewCheckInterval = interval
+				renewalTicker.Reset(interval)
+			}
 		case <-ocspTicker.C:
 			certCache.updateOCSPStaples(ctx)
 		case <-certCache.stopChan:
@@ -96,23 +106,21 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 	// to use when managing that certificate
 	configs := make(map[string]*Config)
 
-	// we use the queues for a very important reason: to do any and all
-	// operations that could require an exclusive write lock outside
-	// of the read lock! otherwise we get a deadlock, yikes. in other
-	// words, our first iteration through the certificate cache does NOT
-	// perform any operations--only queues them--so that more fine-grained
-	// write locks may be obtained during the actual operations.
-	var renewQueue, reloadQueue, deleteQueue, ariQueue certList
+	// we use the queues for a very important reason: our first iteration
+	// through the certificate cache does NOT perform any operations--only
+	// queues them--so that the scan is quick and based on a consistent
+	// list of certificates, and so that operations which change the cache
+	// (which requires exclusive locks) are done separately afterward.
+	var renewQueue, reloadQueue, deleteQueue, decommissionQueue certList
 
-	certCache.mu.RLock()
-	for certKey, cert := range certCache.cache {
+	for _, cert := range certCache.getAllCerts() {
 		if !cert.managed {
 			continue
 		}
 
 		// the list of names on this cert should never be empty... programmer error?
 		if cert.Names == nil || len(cert.Names) == 0 {
-			log.Warn("certificate has no names; removing from cache", zap.String("cert_key", certKey))
+			log.Warn("certificate has no names; removing from cache", zap.String("cert_key", cert.hash))
 			deleteQueue = append(deleteQueue, cert)
 			continue
 		}
@@ -132,14 +140,14 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 			continue
 		}
 		if cfg.OnDemand != nil {
+			if cfg.shouldDecommission(cert) {
+				configs[cert.hash] = cfg
+				decommissionQueue = append(decommissionQueue, cert)
+			}
 			continue
 		}
 
-		// ACME-specific: see if if ACME Renewal Info (ARI) window needs refreshing
-		if !cfg.DisableARI && cert.ari.NeedsRefresh() {
-			configs[cert.hash] = cfg
-			ariQueue = append(ariQueue, cert)
-		}
+		// (ACME Renewal Info is refreshed separately; see maintainARI)
 
 		// if time is up or expires soon, we need to try to renew it
 		if cert.NeedsRenewal(cfg) {
@@ -166,28 +174,17 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 			// the certificate in storage has not been renewed yet, so we will do it
 			// NOTE: It is super-important to note that the TLS-ALPN challenge requires
 			// a write lock on the cache in order to complete its challenge, so it is extra
-			// vital that this renew operation does not happen inside our read lock!
+			// vital that this renew operation does not happen during our scan!
 			renewQueue.insert(cert)
 		}
 	}
-	certCache.mu.RUnlock()
 
-	// Update ARI, and then for any certs where the ARI window changed,
-	// be sure to queue them for renewal if necessary
-	for _, cert := range ariQueue {
-		cfg := configs[cert.hash]
-		cert, changed, err := cfg.updateARI(ctx, cert, log)
-		if err != nil {
-			log.Error("updating ARI", zap.Error(err))
-		}
-		if changed && cert.NeedsRenewal(cfg) {
-			// it's theoretically possible that another instance already got the memo
-			// on the changed ARI and even renewed the cert already, and thus doing it
-			// here is wasteful, but I have never heard of this happening in reality,
-			// so to save some cycles for now I think we'll just queue it for renewal
-			// (notice how we use 'insert' to avoid duplicates, in case it was already
-			// scheduled for renewal anyway)
-			renewQueue.insert(cert)
+	// Decommission on-demand certificates that aren't used anymore
+	for _, cert := range decommissionQueue {
+		if err := configs[cert.hash].decommission(ctx, cert); err != nil {
+			log.Error("decommissioning certificate",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
 		}
 	}
 
@@ -203,6 +200,7 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 		// crucially, this happens OUTSIDE a lock on the certCache
 		_, err := cfg.reloadManagedCertificate(ctx, oldCert)
 		if err != nil {
+			cfg.emitStorageError(ctx, "load", oldCert.Names, err)
 			log.Error("loading renewed certificate",
 				zap.Strings("identifiers", oldCert.Names),
 				zap.Error(err))
@@ -210,7 +208,15 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 		}
 	}
 
-	// Renewal queue
+	// Renewal queue; with leader election, followers leave renewals to
+	// the leader and reload the certificates once it renewed them. The
+	// leader is elected at every check, even if nothing needs renewal,
+	// so that the leader keeps its lease while things are quiet.
+	if leading := certCache.leading(ctx); len(renewQueue) > 0 && !leading {
+		log.Debug("certificates need renewal, but this instance is not the leader",
+			zap.Int("count", len(renewQueue)))
+		renewQueue = nil
+	}
 	for _, oldCert := range renewQueue {
 		cfg := configs[oldCert.hash]
 		err := certCache.queueRenewalTask(ctx, oldCert, cfg)
@@ -229,9 +235,167 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 	}
 	certCache.mu.Unlock()
 
+	// Alert about certificates that are not getting renewed in time
+	certCache.checkExpiryAlerts(ctx)
+
 	return nil
 }
 
+// maintainARI keeps the ACME Renewal Information (ARI) of all managed
+// certificates in the cache up to date, on the schedule suggested by
+// the CA, until the cache is stopped. Unlike renewal checks in TLS
+// handshakes, this also covers certificates that are rarely used, like
+// on-demand certificates of idle sites, so that a CA can pull in their
+// renewal (e.g. before a mass revocation) in time.
+//
+// If panicCount < 10, it recovers from panics by restarting itself,
+// like maintainAssets.
+func (certCache *Cache) maintainARI(panicCount int) {
+	log := certCache.logger.Named("maintenance")
+	log = log.With(zap.String("cache", fmt.Sprintf("%p", certCache)))
+
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Error("panic", zap.Any("error", err), zap.ByteString("stack", buf))
+			if panicCount < 10 {
+				certCache.maintainARI(panicCount + 1)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-certCache.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	timer := time.NewTimer(ariMinCheckInterval)
+	defer timer.Stop()
+	failures := make(map[string]ariFailure)
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(certCache.refreshARI(ctx, failures))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ariFailure tracks failed ARI updates of a certificate, for backoff.
+type ariFailure struct {
+	count int
+	retry time.Time
+}
+
+// refreshARI updates the ARI of all managed certificates that need it
+// and aren't backing off from failed updates, which are recorded in
+// failures (keyed by certificate hash). Certificates that become due
+// for renewal are queued for renewal, unless they are on-demand. It
+// returns how long to wait until the next refresh.
+func (certCache *Cache) refreshARI(ctx context.Context, failures map[string]ariFailure) time.Duration {
+	log := certCache.logger.Named("maintenance")
+
+	next := certCache.renewCheckInterval()
+	now := time.Now()
+	seen := make(map[string]struct{})
+
+	// only elect the leader (which may lock storage) if needed,
+	// and at most once per pass
+	leading := sync.OnceValue(func() bool { return certCache.leading(ctx) })
+
+	for _, cert := range certCache.getAllCerts() {
+		if !cert.managed || len(cert.Names) == 0 || !cert.ari.HasWindow() {
+			continue
+		}
+		seen[cert.hash] = struct{}{}
+
+		// wait for the CA-suggested time, or for the backoff after failures
+		refreshAt := now
+		if cert.ari.RetryAfter != nil {
+			refreshAt = *cert.ari.RetryAfter
+		}
+		if failure, ok := failures[cert.hash]; ok && failure.retry.After(refreshAt) {
+			refreshAt = failure.retry
+		}
+		if refreshAt.After(now) {
+			next = min(next, refreshAt.Sub(now))
+			continue
+		}
+
+		cfg, err := certCache.getConfig(cert)
+		if err != nil || cfg == nil || cfg.DisableARI {
+			continue
+		}
+
+		oldARI := cert.ari
+		ariCtx, cancel := cfg.boundContext(ctx)
+		updatedCert, changed, err := cfg.updateARI(ariCtx, cert, log)
+		cancel()
+		if err != nil {
+			failure := failures[cert.hash]
+			failure.count++
+			backoff := min(ariMinCheckInterval<<min(failure.count-1, 16), ariMaxBackoff)
+			failure.retry = now.Add(backoff)
+			failures[cert.hash] = failure
+			next = min(next, backoff)
+			log.Error("updating ARI",
+				zap.Strings("identifiers", cert.Names),
+				zap.Int("failures", failure.count),
+				zap.Duration("retry_in", backoff),
+				zap.Error(err))
+			continue
+		}
+		delete(failures, cert.hash)
+
+		if !changed || !updatedCert.NeedsRenewal(cfg) {
+			continue
+		}
+
+		log.Warn("ARI update moved renewal earlier; certificate is due for renewal",
+			zap.Strings("identifiers", cert.Names),
+			zap.Time("selected_time", updatedCert.ari.SelectedTime),
+			zap.String("explanation_url", updatedCert.ari.ExplanationURL))
+		cfg.emit(ctx, "cert_renewal_pulled_in", map[string]any{
+			"identifiers":            cert.Names,
+			"issuer":                 cert.issuerKey,
+			"previous_selected_time": oldARI.SelectedTime,
+			"selected_time":          updatedCert.ari.SelectedTime,
+			"window_start":           updatedCert.ari.SuggestedWindow.Start,
+			"window_end":             updatedCert.ari.SuggestedWindow.End,
+			"explanation_url":        updatedCert.ari.ExplanationURL,
+		})
+
+		// on-demand certificates are renewed during handshakes, subject
+		// to the on-demand permission, which will happen with the next
+		// handshake now that the cached certificate needs renewal; with
+		// leader election, followers leave renewals to the leader
+		if cfg.OnDemand != nil || !leading() {
+			continue
+		}
+		if err := certCache.queueRenewalTask(ctx, updatedCert, cfg); err != nil {
+			log.Error("queueing renewal task",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+		}
+	}
+
+	// forget certificates that are no longer cached
+	for hash := range failures {
+		if _, ok := seen[hash]; !ok {
+			delete(failures, hash)
+		}
+	}
+
+	return max(next, ariMinCheckInterval)
+}
+
 func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificate, cfg *Config) error {
 	log := certCache.logger.Named("maintenance")
 
@@ -247,13 +411,22 @@ func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificat
 
 	// queue up this renewal job (is a no-op if already active or queued)
 	jm.Submit(cfg.Logger, "renew_"+renewName, func() error {
+		ctx, cancel := cfg.boundContext(ctx)
+		defer cancel()
+
+		release, err := certCache.acquireRenewalSlot(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+
 		timeLeft := expiresAt(oldCert.Leaf).Sub(time.Now().UTC())
 		log.Info("attempting certificate renewal",
 			zap.Strings("identifiers", oldCert.Names),
 			zap.Duration("remaining", timeLeft))
 
 		// perform renewal - crucially, this happens OUTSIDE a lock on certCache
-		err := cfg.RenewCertAsync(ctx, renewName, false)
+		err = cfg.RenewCertAsync(ctx, renewName, false)
 		if err != nil {
 			if cfg.OnDemand != nil {
 				// loaded dynamically, remove dynamically
@@ -276,6 +449,22 @@ func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificat
 	return nil
 }
 
+// acquireRenewalSlot waits until fewer than MaxConcurrentRenewals
+// renewals are running; release must be called when done.
+func (certCache *Cache) acquireRenewalSlot(ctx context.Context) (release func(), err error) {
+	if certCache.renewalSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case certCache.renewalSlots <- struct{}{}:
+		return func() { <-certCache.renewalSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-certCache.stopChan:
+		return nil, fmt.Errorf("cache stopped")
+	}
+}
+
 // updateOCSPStaples updates the OCSP stapling in all
 // eligible, cached certificates.
 //
@@ -305,9 +494,9 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 	var updateQueue []updateQueueEntry // certs that need a refreshed staple
 	var renewQueue []renewQueueEntry   // certs that need to be renewed (due to revocation)
 
-	// obtain brief read lock during our scan to see which staples need updating
-	certCache.mu.RLock()
-	for certHash, cert := range certCache.cache {
+	// scan to see which staples need updating
+	for _, cert := range certCache.getAllCerts() {
+		certHash := cert.hash
 		// no point in updating OCSP for expired or "synthetic" certificates
 		if cert.Leaf == nil || cert.Expired() {
 			continue
@@ -338,7 +527,6 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 		}
 		updateQueue = append(updateQueue, updateQueueEntry{cert, certHash, lastNextUpdate, cfg})
 	}
-	certCache.mu.RUnlock()
 
 	// perform updates outside of any lock on certCache
 	for _, qe := range updateQueue {
@@ -353,7 +541,14 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 			continue
 		}
 
-		err := stapleOCSP(ctx, qe.cfg.OCSP, qe.cfg.Storage, &cert, nil)
+		ocspCtx, cancel := qe.cfg.boundContext(ctx)
+		err := stapleOCSP(ocspCtx, qe.cfg.ocspConfig(), qe.cfg.Storage, &cert, nil)
+		cancel()
+		if !cert.ocspFailingSince.Equal(qe.cert.ocspFailingSince) {
+			certCache.updateCertificate(certHash, func(cached *Certificate) {
+				cached.ocspFailingSince = cert.ocspFailingSince
+			})
+		}
 		if err != nil {
 			if cert.ocsp != nil {
 				// if there was no staple before, that's fine; otherwise we should log the error
@@ -361,6 +556,14 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 					zap.Strings("identifiers", cert.Names),
 					zap.Error(err))
 			}
+			if cert.Leaf != nil && len(cert.Leaf.OCSPServer) > 0 {
+				qe.cfg.emit(ctx, "ocsp_unavailable", map[string]any{
+					"identifiers":   cert.Names,
+					"responders":    cert.Leaf.OCSPServer,
+					"failing_since": cert.ocspFailingSince,
+					"error":         err,
+				})
+			}
 			continue
 		}
 
@@ -392,21 +595,20 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 		}
 	}
 
-	// These write locks should be brief since we have all the info we need now.
+	// These updates should be brief since we have all the info we need now.
 	for certKey, update := range updated {
-		certCache.mu.Lock()
-		if cert, ok := certCache.cache[certKey]; ok {
+		certCache.updateCertificate(certKey, func(cert *Certificate) {
 			cert.ocsp = update.parsed
 			cert.Certificate.OCSPStaple = update.rawBytes
-			certCache.cache[certKey] = cert
-		}
-		certCache.mu.Unlock()
+		})
 	}
 
 	// We attempt to replace any certificates that were revoked.
 	// Crucially, this happens OUTSIDE a lock on the certCache.
 	for _, renew := range renewQueue {
-		_, err := renew.cfg.forceRenew(ctx, logger, renew.oldCert)
+		renewCtx, cancel := renew.cfg.boundContext(ctx)
+		_, err := renew.cfg.forceRenew(renewCtx, logger, renew.oldCert)
+		cancel()
 		if err != nil {
 			logger.Info("forcefully renewing certificate due to REVOKED status",
 				zap.Strings("identifiers", renew.oldCert.Names),
@@ -463,6 +665,7 @@ func (cfg *Config) loadStoredACMECertificateMetadata(ctx context.Context, cert C
 // This will always try to ARI without checking if it needs to be refreshed. Call
 // NeedsRefresh() on the RenewalInfo first, and only call this if that returns true.
 func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.Logger) (updatedCert Certificate, changed bool, err error) {
+	cfg = cfg.forLeaf(cert.Leaf)
 	logger = logger.With(
 		zap.Strings("identifiers", cert.Names),
 		zap.String("cert_hash", cert.hash),
@@ -506,12 +709,12 @@ func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.
 
 	if err == nil && gotNewARI {
 		// great, storage has a newer one we can use
-		cfg.certCache.mu.Lock()
-		var ok bool
-		updatedCert, ok = cfg.certCache.cache[cert.hash]
+		ok := cfg.certCache.updateCertificate(cert.hash, func(cached *Certificate) {
+			cached.ari = newARI
+			updatedCert = *cached
+		})
 		if !ok {
 			// cert is no longer in the cache... why? what's the right thing to do here?
-			cfg.certCache.mu.Unlock()
 			updatedCert = cert       // return input cert, not an empty one
 			updatedCert.ari = newARI // might as well give it the new ARI for the benefit of our caller, but it won't be updated in the cache or in storage
 			logger.Warn("loaded newer ARI from storage, but certificate is no longer in cache; newer ARI will be returned to caller, but not persisted in the cache",
@@ -520,9 +723,6 @@ func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.
 				zap.String("explanation_url", newARI.ExplanationURL))
 			return
 		}
-		updatedCert.ari = newARI
-		cfg.certCache.cache[cert.hash] = updatedCert
-		cfg.certCache.mu.Unlock()
 		logger.Info("reloaded ARI with newer one in storage",
 			zap.Timep("next_refresh", newARI.RetryAfter),
 			zap.Time("renewal_time", newARI.SelectedTime))
@@ -559,15 +759,16 @@ func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.
 			// then store the updated ARI (even if the window didn't change, the Retry-After
 			// likely did) in cache and storage
 
-			// be sure we get the cert from the cache while inside a lock to avoid logical races
-			cfg.certCache.mu.Lock()
-			updatedCert, ok = cfg.certCache.cache[cert.hash]
+			// be sure we update the cert in the cache atomically to avoid logical races
+			ok := cfg.certCache.updateCertificate(cert.hash, func(cached *Certificate) {
+				cached.ari = newARI
+				updatedCert = *cached
+			})
 			if !ok {
 				// cert is no longer in the cache; this can happen for several reasons (past expiration,
 				// rejected by on-demand permission module, random eviction due to full cache, etc), but
 				// it probably means we don't have use of this ARI update now, so while we can return it
 				// to the caller, we don't persist it anywhere beyond that...
-				cfg.certCache.mu.Unlock()
 				updatedCert = cert       // return input cert, not an empty one
 				updatedCert.ari = newARI // might as well give it the new ARI for the benefit of our caller, but it won't be updated in the cache or in storage
 				logger.Warn("obtained ARI update, but certificate no longer in cache; ARI update will be returned to caller, but not stored",
@@ -576,9 +777,6 @@ func (cfg *Config) updateARI(ctx context.Context, cert Certificate, logger *zap.
 					zap.String("explanation_url", newARI.ExplanationURL))
 				return
 			}
-			updatedCert.ari = newARI
-			cfg.certCache.cache[cert.hash] = updatedCert
-			cfg.certCache.mu.Unlock()
 
 			// update the ARI value in storage
 			var certData acme.Certificate
@@ -632,18 +830,62 @@ type CleanStorageOptions struct {
 	// more recently than this interval.
 	Interval time.Duration
 
-	// Whether to clean cached OCSP staples.
-	OCSPStaples bool
+	// Whether to clean cached OCSP staples, and if so, how
+	// long to keep them after they've expired. Corrupt
+	// staples are always deleted.
+	OCSPStaples           bool
+	OCSPStapleGracePeriod time.Duration
 
 	// Whether to cleanup expired certificates, and if so,
 	// how long to let them stay after they've expired.
 	ExpiredCerts           bool
 	ExpiredCertGracePeriod time.Duration
+
+	// Whether to delete private keys that have no certificate,
+	// for example because obtaining it failed, and if so, how
+	// long after they were last modified. Grace periods shorter
+	// than minOrphanedKeyGracePeriod are raised to it, and keys
+	// of names that are being obtained right now are kept.
+	OrphanedKeys           bool
+	OrphanedKeyGracePeriod time.Duration
+
+	// Whether to break abandoned locks, for example those left
+	// behind by crashed processes, and if so, which locks are
+	// considered abandoned; the policy must not be zero. Locks
+	// held by this process are never broken. Requires storage
+	// to implement LockLister.
+	AbandonedLocks bool
+	StaleLocks     StaleLockPolicy
+
+	// If true, nothing is deleted; the assets that would be
+	// deleted are only reported. A dry run ignores Interval
+	// and does not count as a cleaning for it.
+	DryRun bool
+
+	// Optional function that is called for events about the
+	// assets being deleted; see CleanStorageWithReport. It
+	// has the same signature as Config.OnEvent.
+	OnEvent func(ctx context.Context, event string, data map[string]any) error
 }
 
 // CleanStorage removes assets which are no longer useful,
 // according to opts.
 func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions) error {
+	_, err := CleanStorageWithReport(ctx, storage, opts)
+	return err
+}
+
+// CleanStorageWithReport is like CleanStorage, but also returns the
+// assets that were deleted or, if opts.DryRun is set, that would be
+// deleted.
+//
+// Before each asset is deleted, the "storage_asset_deleting" event is
+// emitted, also during dry runs; if the handler returns an error, the
+// asset is kept. After it is deleted, "storage_asset_deleted" is
+// emitted.
+//
+// EXPERIMENTAL: Subject to change.
+func CleanStorageWithReport(ctx context.Context, storage Storage, opts CleanStorageOptions) ([]CleanedAsset, error) {
 	const (
 		lockName   = "storage_clean"
 		storageKey = "last_clean.json"
@@ -652,11 +894,11 @@ func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions
 	if opts.Logger == nil {
 		opts.Logger = defaultLogger.Named("clean_storage")
 	}
-	opts.Logger = opts.Logger.With(zap.Any("storage", storage))
+	opts.Logger = opts.Logger.With(zap.Any("storage", storage), zap.Bool("dry_run", opts.DryRun))
 
 	// storage cleaning should be globally exclusive
 	if err := acquireLock(ctx, storage, lockName); err != nil {
-		return fmt.Errorf("unable to acquire %s lock: %v", lockName, err)
+		return nil, fmt.Errorf("unable to acquire %s lock: %v", lockName, err)
 	}
 	defer func() {
 		if err := releaseLock(ctx, storage, lockName); err != nil {
@@ -666,17 +908,17 @@ func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions
 	}()
 
 	// cleaning should not happen more often than the interval
-	if opts.Interval > 0 {
+	if opts.Interval > 0 && !opts.DryRun {
 		lastCleanBytes, err := storage.Load(ctx, storageKey)
 		if !errors.Is(err, fs.ErrNotExist) {
 			if err != nil {
-				return fmt.Errorf("loading last clean timestamp: %v", err)
+				return nil, fmt.Errorf("loading last clean timestamp: %v", err)
 			}
 
 			var lastClean lastCleanPayload
 			err = json.Unmarshal(lastCleanBytes, &lastClean)
 			if err != nil {
-				return fmt.Errorf("decoding last clean data: %v", err)
+				return nil, fmt.Errorf("decoding last clean data: %v", err)
 			}
 
 			lastTLSClean := lastClean["tls"]
@@ -687,26 +929,37 @@ func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions
 					zap.Time("try_again", nextTime),
 					zap.Duration("try_again_in", time.Until(nextTime)),
 				)
-				return nil
+				return nil, nil
 			}
 		}
 	}
 
 	opts.Logger.Info("cleaning storage unit")
 
+	sc := &storageCleaner{storage: storage, opts: opts}
+
 	if opts.OCSPStaples {
-		err := deleteOldOCSPStaples(ctx, storage, opts.Logger)
+		err := deleteOldOCSPStaples(ctx, sc)
 		if err != nil {
 			opts.Logger.Error("deleting old OCSP staples", zap.Error(err))
 		}
 	}
-	if opts.ExpiredCerts {
-		err := deleteExpiredCerts(ctx, storage, opts.Logger, opts.ExpiredCertGracePeriod)
+	if opts.ExpiredCerts || opts.OrphanedKeys {
+		err := deleteExpiredCerts(ctx, sc)
 		if err != nil {
-			opts.Logger.Error("deleting expired certificates staples", zap.Error(err))
+			opts.Logger.Error("deleting expired certificates and orphaned keys", zap.Error(err))
+		}
+	}
+	if opts.AbandonedLocks {
+		err := breakAbandonedLocks(ctx, sc)
+		if err != nil {
+			opts.Logger.Error("breaking abandoned locks", zap.Error(err))
 		}
 	}
-	// TODO: delete stale locks?
+
+	if opts.DryRun {
+		return sc.report, nil
+	}
 
 	// update the last-clean time
 	lastCleanBytes, err := json.Marshal(lastCleanPayload{
@@ -716,13 +969,13 @@ func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("encoding last cleaned info: %v", err)
+		return sc.report, fmt.Errorf("encoding last cleaned info: %v", err)
 	}
 	if err := storage.Store(ctx, storageKey, lastCleanBytes); err != nil {
-		return fmt.Errorf("storing last clean info: %v", err)
+		return sc.report, fmt.Errorf("storing last clean info: %v", err)
 	}
 
-	return nil
+	return sc.report, nil
 }
 
 type lastCleanPayload map[string]lastCleaned
@@ -732,8 +985,8 @@ type lastCleaned struct {
 	InstanceID string    `json:"instance_id,omitempty"`
 }
 
-func deleteOldOCSPStaples(ctx context.Context, storage Storage, logger *zap.Logger) error {
-	ocspKeys, err := storage.List(ctx, prefixOCSP, false)
+func deleteOldOCSPStaples(ctx context.Context, sc *storageCleaner) error {
+	ocspKeys, err := sc.storage.List(ctx, prefixOCSP, false)
 	if err != nil {
 		// maybe just hasn't been created yet; no big deal
 		return nil
@@ -745,32 +998,34 @@ func deleteOldOCSPStaples(ctx context.Context, storage Storage, logger *zap.Logg
 			return ctx.Err()
 		default:
 		}
-		ocspBytes, err := storage.Load(ctx, key)
+		ocspBytes, err := sc.storage.Load(ctx, key)
 		if err != nil {
-			logger.Error("while deleting old OCSP staples, unable to load staple file", zap.Error(err))
+			sc.opts.Logger.Error("while deleting old OCSP staples, unable to load staple file", zap.Error(err))
 			continue
 		}
 		resp, err := ocsp.ParseResponse(ocspBytes, nil)
 		if err != nil {
 			// contents are invalid; delete it
-			err = storage.Delete(ctx, key)
+			err = sc.delete(ctx, CleanedAsset{Key: key, Kind: "ocsp_staple", Reason: "corrupt"})
 			if err != nil {
-				logger.Error("purging corrupt staple file", zap.String("storage_key", key), zap.Error(err))
+				sc.opts.Logger.Error("purging corrupt staple file", zap.String("storage_key", key), zap.Error(err))
 			}
 			continue
 		}
-		if time.Now().After(resp.NextUpdate) {
+		if time.Since(resp.NextUpdate) > sc.opts.OCSPStapleGracePeriod {
 			// response has expired; delete it
-			err = storage.Delete(ctx, key)
+			err = sc.delete(ctx, CleanedAsset{Key: key, Kind: "ocsp_staple", Reason: "expired"})
 			if err != nil {
-				logger.Error("purging expired staple file", zap.String("storage_key", key), zap.Error(err))
+				sc.opts.Logger.Error("purging expired staple file", zap.String("storage_key", key), zap.Error(err))
 			}
 		}
 	}
 	return nil
 }
 
-func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger, gracePeriod time.Duration) error {
+func deleteExpiredCerts(ctx context.Context, sc *storageCleaner) error {
+	storage, logger := sc.storage, sc.opts.Logger
+
 	issuerKeys, err := storage.List(ctx, prefixCerts, false)
 	if err != nil {
 		// maybe just hasn't been created yet; no big deal
@@ -798,6 +1053,13 @@ func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger
 				continue
 			}
 
+			if sc.opts.OrphanedKeys {
+				sc.deleteOrphanedKeys(ctx, siteKey, siteAssets)
+			}
+			if !sc.opts.ExpiredCerts {
+				continue
+			}
+
 			for _, assetKey := range siteAssets {
 				if path.Ext(assetKey) != ".crt" {
 					continue
@@ -816,23 +1078,28 @@ func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger
 					return fmt.Errorf("certificate file %s is malformed; error parsing PEM: %v", assetKey, err)
 				}
 
+				gracePeriod := sc.opts.ExpiredCertGracePeriod
 				if expiredTime := time.Since(expiresAt(cert)); expiredTime >= gracePeriod {
 					logger.Info("certificate expired beyond grace period; cleaning up",
 						zap.String("asset_key", assetKey),
 						zap.Duration("expired_for", expiredTime),
 						zap.Duration("grace_period", gracePeriod))
 					baseName := strings.TrimSuffix(assetKey, ".crt")
-					for _, relatedAsset := range []string{
-						assetKey,
-						baseName + ".key",
-						baseName + ".json",
+					for _, relatedAsset := range []CleanedAsset{
+						{Key: assetKey, Kind: "certificate"},
+						{Key: baseName + ".key", Kind: "private_key"},
+						{Key: baseName + ".json", Kind: "metadata"},
+						{Key: baseName + ".dc.json", Kind: "delegated_credential"},
 					} {
-						logger.Info("deleting asset because resource expired", zap.String("asset_key", relatedAsset))
-						err := storage.Delete(ctx, relatedAsset)
+						if relatedAsset.Kind != "certificate" && !storage.Exists(ctx, relatedAsset.Key) {
+							continue
+						}
+						relatedAsset.Reason = "expired"
+						err := sc.delete(ctx, relatedAsset)
 						if err != nil {
 							logger.Error("could not clean up asset related to expired certificate",
 								zap.String("base_name", baseName),
-								zap.String("related_asset", relatedAsset),
+								zap.String("related_asset", relatedAsset.Key),
 								zap.Error(err))
 						}
 					}
@@ -845,8 +1112,7 @@ func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger
 				continue
 			}
 			if len(siteAssets) == 0 {
-				logger.Info("deleting site folder because key is empty", zap.String("site_key", siteKey))
-				err := storage.Delete(ctx, siteKey)
+				err := sc.delete(ctx, CleanedAsset{Key: siteKey, Kind: "site_folder", Reason: "empty"})
 				if err != nil {
 					return fmt.Errorf("deleting empty site folder %s: %v", siteKey, err)
 				}
@@ -983,4 +1249,11 @@ const (
 
 	// DefaultOCSPCheckInterval is how often to check if OCSP stapling needs updating.
 	DefaultOCSPCheckInterval = 1 * time.Hour
+
+	// ariMinCheckInterval is the shortest time between checks for ARI
+	// updates, and the initial backoff after failed ARI updates.
+	ariMinCheckInterval = 1 * time.Minute
+
+	// ariMaxBackoff is the longest time to wait after failed ARI updates.
+	ariMaxBackoff = 6 * time.Hour
 )
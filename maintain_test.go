@@ -0,0 +1,175 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// ariTestIssuer is a testIssuer that also gets renewal info.
+type ariTestIssuer struct {
+	testIssuer
+
+	mu    sync.Mutex
+	calls int
+	ari   acme.RenewalInfo
+	err   error
+}
+
+func (ai *ariTestIssuer) GetRenewalInfo(context.Context, Certificate) (acme.RenewalInfo, error) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	ai.calls++
+	return ai.ari, ai.err
+}
+
+func TestRefreshARI(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	issuer := &ariTestIssuer{err: errors.New("ARI endpoint is down")}
+	pulledIn := make(chan map[string]any, 1)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   &FileStorage{Path: tmpDir},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "cert_renewal_pulled_in" {
+				pulledIn <- data
+			}
+			return nil
+		},
+	})
+
+	ctx := context.Background()
+	const name = "idle.example.com"
+	if err := cfg.ManageSync(ctx, []string{name}); err != nil {
+		t.Fatal(err)
+	}
+	certs := cache.getAllMatchingCerts(name)
+	if len(certs) != 1 {
+		t.Fatalf("Expected 1 cached certificate, got %d", len(certs))
+	}
+	original := certs[0]
+
+	// give the cached cert a window far away, which is due for a refresh
+	past := time.Now().Add(-time.Minute)
+	cache.updateCertificate(original.hash, func(cached *Certificate) {
+		cached.ari = acme.RenewalInfo{
+			SuggestedWindow: struct {
+				Start time.Time `json:"start"`
+				End   time.Time `json:"end"`
+			}{Start: time.Now().Add(50 * 24 * time.Hour), End: time.Now().Add(51 * 24 * time.Hour)},
+			SelectedTime: time.Now().Add(50 * 24 * time.Hour),
+			RetryAfter:   &past,
+		}
+	})
+
+	// failed updates back off
+	failures := make(map[string]ariFailure)
+	if next := cache.refreshARI(ctx, failures); next != ariMinCheckInterval {
+		t.Errorf("Expected to check again after %v, got %v", ariMinCheckInterval, next)
+	}
+	cache.refreshARI(ctx, failures)
+	if issuer.calls != 1 || failures[original.hash].count != 1 {
+		t.Fatalf("Expected 1 ARI request while backing off, got %d (failures: %+v)", issuer.calls, failures)
+	}
+
+	// the CA moves the window into the past, which pulls in the renewal
+	retryAfter := time.Now().Add(6 * time.Hour)
+	issuer.mu.Lock()
+	issuer.err = nil
+	issuer.ari = acme.RenewalInfo{
+		SuggestedWindow: struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		}{Start: time.Now().Add(-2 * time.Hour), End: time.Now().Add(-time.Hour)},
+		SelectedTime:   time.Now().Add(-90 * time.Minute),
+		RetryAfter:     &retryAfter,
+		ExplanationURL: "https://example.com/incident",
+	}
+	issuer.mu.Unlock()
+	cache.refreshARI(ctx, make(map[string]ariFailure))
+
+	select {
+	case data := <-pulledIn:
+		if data["explanation_url"] != "https://example.com/incident" {
+			t.Errorf("Unexpected event data: %v", data)
+		}
+	default:
+		t.Fatal("Expected cert_renewal_pulled_in event")
+	}
+
+	// the renewal is queued, and the renewed cert replaces the original
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		certs := cache.getAllMatchingCerts(name)
+		if len(certs) == 1 && certs[0].hash != original.hash {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for certificate to be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAcquireRenewalSlot(t *testing.T) {
+	cache := NewCache(CacheOptions{
+		GetConfigForCert:      func(Certificate) (*Config, error) { return nil, nil },
+		MaxConcurrentRenewals: 2,
+		Logger:                defaultTestLogger,
+	})
+	defer cache.Stop()
+
+	ctx := context.Background()
+	release1, err := cache.acquireRenewalSlot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.acquireRenewalSlot(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third renewal must wait for a slot
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := cache.acquireRenewalSlot(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for a slot, got %v", err)
+	}
+
+	release1()
+	if _, err := cache.acquireRenewalSlot(ctx); err != nil {
+		t.Fatalf("expected a released slot, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManagerRegistry is a Manager that gets certificates from other
+// Managers, chosen by the server name of the handshake; add it to
+// OnDemandConfig.Managers to have names that are managed by well-known
+// services, like Tailscale, work without configuring a Manager for
+// each. The registry made by NewManagerRegistry has these built-in
+// Managers:
+//
+//   - *.ts.net: a TailscaleManager
+//
+// EXPERIMENTAL: Subject to change.
+type ManagerRegistry struct {
+	mu       sync.RWMutex
+	managers map[string]Manager
+}
+
+// NewManagerRegistry returns a registry with the built-in Managers.
+func NewManagerRegistry() *ManagerRegistry {
+	r := new(ManagerRegistry)
+	r.Register("*.ts.net", new(TailscaleManager))
+	return r
+}
+
+// Register makes the registry use m for server names that match
+// pattern, replacing the Manager that was registered for the same
+// pattern, if any. A pattern is either a name, or "*." followed by a
+// domain, which matches all names below that domain, at any depth.
+// If several patterns match a name, the most specific one is used.
+// If m is nil, the Manager for pattern is removed.
+func (r *ManagerRegistry) Register(pattern string, m Manager) {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m == nil {
+		delete(r.managers, pattern)
+		return
+	}
+	if r.managers == nil {
+		r.managers = make(map[string]Manager)
+	}
+	r.managers[pattern] = m
+}
+
+// Lookup returns the Manager for serverName, if there is one.
+func (r *ManagerRegistry) Lookup(serverName string) (Manager, bool) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if m, ok := r.managers[name]; ok {
+		return m, true
+	}
+	// walk up the domain: the nearest parent is the most specific
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if m, ok := r.managers["*."+name]; ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// GetCertificate implements Manager. It returns (nil, nil) if no
+// Manager is registered for the server name.
+func (r *ManagerRegistry) GetCertificate(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m, ok := r.Lookup(hello.ServerName)
+	if !ok {
+		return nil, nil
+	}
+	return m.GetCertificate(ctx, hello)
+}
+
+// TailscaleManager is a Manager that gets certificates for the names of
+// machines in a tailnet (*.ts.net) from the local Tailscale daemon,
+// which obtains them. HTTPS must be enabled for the tailnet. It returns
+// (nil, nil) for other names.
+//
+// EXPERIMENTAL: Subject to change.
+type TailscaleManager struct {
+	// The path of the socket of the Tailscale daemon's local
+	// API. Default: /var/run/tailscale/tailscaled.sock.
+	SocketPath string
+
+	clientOnce sync.Once
+	client     *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*tls.Certificate
+}
+
+// GetCertificate implements Manager.
+func (tsm *TailscaleManager) GetCertificate(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if !strings.HasSuffix(name, ".ts.net") {
+		return nil, nil
+	}
+
+	// the daemon renews certificates when they are requested, so
+	// ask again once a third of the validity is left
+	tsm.mu.Lock()
+	cert, ok := tsm.cache[name]
+	tsm.mu.Unlock()
+	if ok {
+		lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+		if time.Until(cert.Leaf.NotAfter) > lifetime/3 {
+			return cert, nil
+		}
+	}
+
+	cert, err := tsm.fetch(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("getting certificate for %s from Tailscale: %w", name, err)
+	}
+	tsm.mu.Lock()
+	if tsm.cache == nil {
+		tsm.cache = make(map[string]*tls.Certificate)
+	}
+	tsm.cache[name] = cert
+	tsm.mu.Unlock()
+	return cert, nil
+}
+
+func (tsm *TailscaleManager) fetch(ctx context.Context, name string) (*tls.Certificate, error) {
+	endpoint := "http://local-tailscaled.sock/localapi/v0/cert/" + url.PathEscape(name) + "?type=pair"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tsm.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	// the response is the private key followed by the certificate chain
+	cert, err := tls.X509KeyPair(body, body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate and key: %v", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("parsing certificate: %v", err)
+		}
+	}
+	return &cert, nil
+}
+
+func (tsm *TailscaleManager) httpClient() *http.Client {
+	tsm.clientOnce.Do(func() {
+		socketPath := tsm.SocketPath
+		if socketPath == "" {
+			socketPath = "/var/run/tailscale/tailscaled.sock"
+		}
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		tsm.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+	})
+	return tsm.client
+}
+
+// Interface guards
+var (
+	_ Manager = (*ManagerRegistry)(nil)
+	_ Manager = (*TailscaleManager)(nil)
+)
@@ -0,0 +1,113 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+type namedManager string
+
+func (namedManager) GetCertificate(context.Context, *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return nil, nil
+}
+
+func TestManagerRegistryLookup(t *testing.T) {
+	r := NewManagerRegistry()
+	r.Register("*.example.com", namedManager("wildcard"))
+	r.Register("*.sub.example.com", namedManager("sub"))
+	r.Register("exact.example.com.", namedManager("exact"))
+
+	for i, tc := range []struct {
+		name   string
+		expect Manager
+	}{
+		{name: "foo.example.com", expect: namedManager("wildcard")},
+		{name: "a.b.example.com", expect: namedManager("wildcard")},
+		{name: "foo.sub.example.com", expect: namedManager("sub")},
+		{name: "Exact.Example.com", expect: namedManager("exact")},
+		{name: "example.com", expect: nil},
+		{name: "example.net", expect: nil},
+	} {
+		m, ok := r.Lookup(tc.name)
+		if ok != (tc.expect != nil) || m != tc.expect {
+			t.Errorf("Test %d: %s: Expected %v, got %v", i, tc.name, tc.expect, m)
+		}
+	}
+	if m, ok := r.Lookup("machine.tailnet.ts.net"); !ok {
+		t.Error("Expected built-in Tailscale manager")
+	} else if _, ok := m.(*TailscaleManager); !ok {
+		t.Errorf("Expected TailscaleManager, got %T", m)
+	}
+
+	r.Register("*.example.com", nil)
+	if _, ok := r.Lookup("foo.example.com"); ok {
+		t.Error("Expected manager to be removed")
+	}
+}
+
+func TestTailscaleManager(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "tailscaled.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	}
+	bundle := remoteManagerBundle(t, "machine.tailnet.ts.net")
+	var requests atomic.Int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/localapi/v0/cert/machine.tailnet.ts.net" || r.URL.Query().Get("type") != "pair" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(bundle)
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	tsm := &TailscaleManager{SocketPath: socketPath}
+	ctx := context.Background()
+	for range 2 {
+		cert, err := tsm.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "machine.tailnet.ts.net"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert == nil || cert.Leaf.DNSNames[0] != "machine.tailnet.ts.net" {
+			t.Fatalf("Expected certificate for machine, got %v", cert)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected certificate to be cached, got %d requests", n)
+	}
+
+	if _, err := tsm.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "other.tailnet.ts.net"}); err == nil {
+		t.Error("Expected error for name unknown to Tailscale")
+	}
+	if cert, err := tsm.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "example.com"}); cert != nil || err != nil {
+		t.Errorf("Expected other names to be left to other managers, got %v, %v", cert, err)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"slices"
+	"strings"
+)
+
+// nameIndex maps names to the hashes of the certificates for them. It
+// is an immutable radix tree keyed by the names reversed, so that names
+// in the same domain share a path, and a name and all of the wildcard
+// names that could match it are found in one walk. Changes return a new
+// index that shares all but the changed path with the old one, so that
+// readers can use an index without locks while it is being replaced.
+//
+// A nil *nameIndex is an empty index.
+type nameIndex struct {
+	root indexNode
+}
+
+type indexNode struct {
+	// the part of the reversed name on the edge to this node
+	prefix string
+
+	// sorted by the first byte of their prefix,
+	// which is unique among siblings
+	children []indexNode
+
+	// the first byte of the prefix of each child, so
+	// that a child is found without visiting the others
+	edges string
+
+	// the hashes of the name that ends at this node, if any
+	hashes []string
+}
+
+// get returns the hashes of the certificates for name.
+func (ix *nameIndex) get(name string) ([]string, bool) {
+	if ix == nil {
+		return nil, false
+	}
+	n := ix.root.find(0, name)
+	if n == nil || len(n.hashes) == 0 {
+		return nil, false
+	}
+	return n.hashes, true
+}
+
+// candidates returns the hashes of the certificates for name, and for
+// each name made by replacing labels of name with wildcards from the
+// left: wildcards[0] are the hashes for "*.example.com" if name is
+// "sub.example.com", wildcards[1] those for "*.*.com", and so on.
+func (ix *nameIndex) candidates(name string) (exact []string, wildcards [][]string) {
+	wildcards = make([][]string, strings.Count(name, ".")+1)
+	ix.matches(name, func(wildcardLabels int, hashes []string) {
+		if wildcardLabels == 0 {
+			exact = hashes
+		} else {
+			wildcards[wildcardLabels-1] = hashes
+		}
+	})
+	return exact, wildcards
+}
+
+// mostSpecific returns the hashes of the certificates for the first of
+// the candidates of name (see candidates) that has any, and how many
+// labels of name were replaced with wildcards for it. Unlike candidates,
+// it doesn't allocate.
+func (ix *nameIndex) mostSpecific(name string) (hashes []string, wildcardLabels int) {
+	ix.matches(name, func(labels int, matched []string) {
+		// the more specific ones are found later
+		hashes, wildcardLabels = matched, labels
+	})
+	return hashes, wildcardLabels
+}
+
+// matches calls fn with the hashes of each of the candidates of name
+// (see candidates) that is in the index, and how many labels of name
+// were replaced with wildcards for it (0 for name itself), from the
+// most to the least replaced. They are all found in one walk.
+func (ix *nameIndex) matches(name string, fn func(wildcardLabels int, hashes []string)) {
+	if ix == nil {
+		return
+	}
+	labels := strings.Count(name, ".") + 1
+
+	// walk the name from its end, as it is keyed
+	n, off, dots := &ix.root, 0, 0
+	for end := len(name); ; end-- {
+		// the labels that remain before a dot (or
+		// all of them) may be matched by wildcards
+		if end == len(name) || name[end] == '.' {
+			remaining := labels - dots
+			if m := n.find(off, wildcardKey(remaining)); m != nil && len(m.hashes) > 0 {
+				fn(remaining, m.hashes)
+			}
+		}
+		if end == 0 {
+			if off == len(n.prefix) && len(n.hashes) > 0 {
+				fn(0, n.hashes)
+			}
+			return
+		}
+
+		// follow the next byte of the name
+		b := name[end-1]
+		if off < len(n.prefix) {
+			if n.prefix[off] != b {
+				return
+			}
+			off++
+		} else {
+			i, ok := n.child(b)
+			if !ok {
+				return
+			}
+			n, off = &n.children[i], 1
+		}
+		if b == '.' {
+			dots++
+		}
+	}
+}
+
+// with returns a copy of the index in which the hashes for name are
+// fn(hashes), where hashes are the current ones (nil if there are
+// none). If fn returns no hashes, name is removed. fn must not
+// modify the slice it is given.
+func (ix *nameIndex) with(name string, fn func(hashes []string) []string) *nameIndex {
+	var root indexNode
+	if ix != nil {
+		root = ix.root
+	}
+	return &nameIndex{root: *root.update(reverseName(name), fn, true)}
+}
+
+// rangeAll calls fn for each name in the index.
+func (ix *nameIndex) rangeAll(fn func(name string, hashes []string)) {
+	if ix == nil {
+		return
+	}
+	var walk func(n *indexNode, key string)
+	walk = func(n *indexNode, key string) {
+		key += n.prefix
+		if len(n.hashes) > 0 {
+			fn(reverseName(key), n.hashes)
+		}
+		for i := range n.children {
+			walk(&n.children[i], key)
+		}
+	}
+	walk(&ix.root, "")
+}
+
+// find returns the node at which the key of name ends, starting off
+// bytes into the prefix of n, or nil if there is none. The name is
+// read from its end, so it need not be reversed.
+func (n *indexNode) find(off int, name string) *indexNode {
+	end := len(name)
+	for {
+		for ; off < len(n.prefix); off++ {
+			if end == 0 || n.prefix[off] != name[end-1] {
+				return nil
+			}
+			end--
+		}
+		if end == 0 {
+			return n
+		}
+		i, ok := n.child(name[end-1])
+		if !ok {
+			return nil
+		}
+		n, off = &n.children[i], 0
+	}
+}
+
+// child returns the index of the child of n whose prefix starts
+// with b, or where it would be inserted if there is none.
+func (n *indexNode) child(b byte) (int, bool) {
+	lo, hi := 0, len(n.edges)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if n.edges[mid] < b {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(n.edges) && n.edges[lo] == b
+}
+
+// update returns a copy of n in which the hashes at key, which is
+// relative to the end of the prefix of n, are set by fn; see
+// nameIndex.with. Nodes without hashes and with fewer than two
+// children are removed or merged into their child, except the root.
+func (n *indexNode) update(key string, fn func([]string) []string, root bool) *indexNode {
+	c := *n
+	if key == "" {
+		c.hashes = fn(n.hashes)
+	} else {
+		i, exists := n.child(key[0])
+		var child *indexNode
+		if exists {
+			child = &n.children[i]
+			common := commonPrefixLen(child.prefix, key)
+			if common < len(child.prefix) {
+				// split the edge where the key leaves it
+				rest := *child
+				rest.prefix = child.prefix[common:]
+				child = &indexNode{prefix: child.prefix[:common], children: []indexNode{rest}, edges: rest.prefix[:1]}
+			}
+			child = child.update(key[common:], fn, false)
+		} else {
+			child = (&indexNode{prefix: key}).update("", fn, false)
+		}
+		c.children, c.edges = withChild(n.children, n.edges, i, exists, child)
+	}
+	if root {
+		return &c
+	}
+	switch {
+	case len(c.hashes) > 0:
+		return &c
+	case len(c.children) == 0:
+		return nil
+	case len(c.children) == 1:
+		merged := c.children[0]
+		merged.prefix = c.prefix + merged.prefix
+		return &merged
+	}
+	return &c
+}
+
+// withChild returns a copy of children and their edges in which the
+// child at i is child: it replaces the existing one, if it exists, or
+// is inserted there. A nil child removes the existing one.
+func withChild(children []indexNode, edges string, i int, exists bool, child *indexNode) ([]indexNode, string) {
+	switch {
+	case exists && child == nil:
+		return slices.Delete(slices.Clone(children), i, i+1), edges[:i] + edges[i+1:]
+	case exists:
+		children = slices.Clone(children)
+		children[i] = *child
+		return children, edges
+	case child == nil:
+		return children, edges
+	}
+	grown := make([]indexNode, len(children)+1)
+	copy(grown, children[:i])
+	grown[i] = *child
+	copy(grown[i+1:], children[i:])
+	return grown, edges[:i] + child.prefix[:1] + edges[i:]
+}
+
+func commonPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+func reverseName(name string) string {
+	reversed := make([]byte, len(name))
+	for i := range len(name) {
+		reversed[len(name)-1-i] = name[i]
+	}
+	return string(reversed)
+}
+
+// wildcardKey returns the name that consists of n wildcard
+// labels, like "*.*" for 2, which is its own reverse.
+func wildcardKey(n int) string {
+	if 2*n-1 <= len(wildcardLabels) {
+		return wildcardLabels[:2*n-1]
+	}
+	return strings.Repeat("*.", n-1) + "*"
+}
+
+// wildcardCandidate returns name with its first n labels
+// replaced with wildcards.
+func wildcardCandidate(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	rest := name
+	for range n {
+		var found bool
+		_, rest, found = strings.Cut(rest, ".")
+		if !found {
+			return wildcardKey(n)
+		}
+	}
+	return wildcardKey(n) + "." + rest
+}
+
+// enough wildcard labels for any DNS name
+var wildcardLabels = strings.Repeat("*.", 128)
@@ -0,0 +1,158 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestNameIndex(t *testing.T) {
+	set := func(hash string) func([]string) []string {
+		return func(hashes []string) []string { return append(slices.Clip(hashes), hash) }
+	}
+	remove := func([]string) []string { return nil }
+
+	var ix *nameIndex
+	for _, name := range []string{"example.com", "sub.example.com", "*.example.com", "*.*.com", "*.*.*", "example.org", "ample.com"} {
+		ix = ix.with(name, set(name))
+	}
+	before := ix
+
+	exact, wildcards := ix.candidates("sub.example.com")
+	if !slices.Equal(exact, []string{"sub.example.com"}) {
+		t.Errorf("Expected exact match, got %v", exact)
+	}
+	if expected := [][]string{{"*.example.com"}, {"*.*.com"}, {"*.*.*"}}; !slices.EqualFunc(wildcards, expected, slices.Equal) {
+		t.Errorf("Expected wildcard matches %v, got %v", expected, wildcards)
+	}
+	if _, wildcards := ix.candidates("other.example.org"); wildcards[0] != nil || wildcards[1] != nil || wildcards[2] == nil {
+		t.Errorf("Expected only the catch-all wildcard to match, got %v", wildcards)
+	}
+
+	// removing names leaves earlier versions alone
+	ix = ix.with("example.com", remove).with("*.example.com", remove)
+	if _, ok := ix.get("example.com"); ok {
+		t.Error("Expected name to be removed")
+	}
+	if hashes, ok := ix.get("ample.com"); !ok || hashes[0] != "ample.com" {
+		t.Errorf("Expected name sharing a suffix to remain, got %v", hashes)
+	}
+	if _, ok := before.get("example.com"); !ok {
+		t.Error("Expected earlier version of the index to be unchanged")
+	}
+	if wildcardCandidate("sub.example.com", 2) != "*.*.com" || wildcardCandidate("sub.example.com", 3) != "*.*.*" {
+		t.Error("Unexpected wildcard candidate names")
+	}
+}
+
+func TestNameIndexMatchesMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	labels := []string{"a", "ab", "b", "*", "com", "co"}
+	randomName := func() string {
+		parts := make([]string, 1+rng.Intn(4))
+		for i := range parts {
+			parts[i] = labels[rng.Intn(len(labels))]
+		}
+		return strings.Join(parts, ".")
+	}
+
+	var ix *nameIndex
+	model := make(map[string][]string)
+	for i := range 5000 {
+		name, hash := randomName(), fmt.Sprint(i)
+		if rng.Intn(3) == 0 {
+			ix = ix.with(name, func([]string) []string { return nil })
+			delete(model, name)
+		} else {
+			ix = ix.with(name, func(hashes []string) []string { return append(slices.Clip(hashes), hash) })
+			model[name] = append(slices.Clip(model[name]), hash)
+		}
+
+		// the index agrees with the map, including on
+		// what the wildcard candidates of a name are
+		name = randomName()
+		exact, wildcards := ix.candidates(name)
+		if !slices.Equal(exact, model[name]) {
+			t.Fatalf("Step %d: Expected %v for %s, got %v", i, model[name], name, exact)
+		}
+		mostSpecific, mostSpecificLabels := model[name], 0
+		candidateLabels := strings.Split(name, ".")
+		for j := range candidateLabels {
+			candidateLabels[j] = "*"
+			candidate := strings.Join(candidateLabels, ".")
+			if !slices.Equal(wildcards[j], model[candidate]) {
+				t.Fatalf("Step %d: Expected %v for %s, got %v", i, model[candidate], candidate, wildcards[j])
+			}
+			if len(mostSpecific) == 0 {
+				mostSpecific, mostSpecificLabels = model[candidate], j+1
+			}
+		}
+		if len(mostSpecific) == 0 {
+			mostSpecificLabels = 0
+		}
+		if hashes, labels := ix.mostSpecific(name); !slices.Equal(hashes, mostSpecific) || labels != mostSpecificLabels {
+			t.Fatalf("Step %d: Expected most specific match of %s to be %v (%d labels), got %v (%d labels)",
+				i, name, mostSpecific, mostSpecificLabels, hashes, labels)
+		}
+	}
+
+	var count int
+	ix.rangeAll(func(name string, hashes []string) {
+		count++
+		if !slices.Equal(hashes, model[name]) {
+			t.Errorf("Expected %v for %s, got %v", model[name], name, hashes)
+		}
+	})
+	if count != len(model) {
+		t.Errorf("Expected %d names, got %d", len(model), count)
+	}
+}
+
+// BenchmarkWildcardLookup measures finding the certificates for a name
+// that is only matched by a wildcard, as in TLS handshakes, in a cache
+// with 100k certificates.
+func BenchmarkWildcardLookup(b *testing.B) {
+	const numCerts = 100000
+
+	certCache := &Cache{logger: zap.NewNop()}
+	for i := range numCerts {
+		name := fmt.Sprintf("*.site%d.example.com", i)
+		certCache.unsyncedCacheCertificate(Certificate{Names: []string{name}, hash: fmt.Sprintf("hash%d", i)})
+	}
+
+	names := make([]string, numCerts)
+	for i := range names {
+		names[i] = fmt.Sprintf("www.site%d.example.com", i)
+	}
+
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(7919)
+		for pb.Next() {
+			i++
+			if len(certCache.AllMatchingCertificates(names[i%numCerts])) != 1 {
+				b.Error("Lookup failed")
+			}
+		}
+	})
+}
@@ -0,0 +1,367 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Notifier tells other instances in a cluster that certificates
+// have changed in storage, so that they can update their caches
+// right away instead of at their next maintenance. Instances that
+// share storage should use Notifiers that reach each other.
+//
+// EXPERIMENTAL: Subject to change.
+type Notifier interface {
+	// Notify sends inv to all listening instances.
+	Notify(ctx context.Context, inv CacheInvalidation) error
+
+	// Listen calls handle for each invalidation that is sent,
+	// including those sent by this instance, until ctx is
+	// canceled. It blocks until then, or an error occurs.
+	// Invalidations sent since the given time but before Listen
+	// was called should be handled too, if the Notifier is able
+	// to; the listener may start after the cache already loaded
+	// certificates they are for. A zero time means "now".
+	Listen(ctx context.Context, since time.Time, handle func(CacheInvalidation)) error
+}
+
+// CacheInvalidation describes a change to certificates in storage.
+//
+// EXPERIMENTAL: Subject to change.
+type CacheInvalidation struct {
+	// The names of the certificate that changed.
+	Names []string `json:"names"`
+
+	// Why it changed: "renewed", "revoked", or "rolled_back".
+	Reason string `json:"reason"`
+
+	// The ID of the cache that sent the invalidation.
+	Origin string `json:"origin"`
+
+	// When it was sent.
+	Time time.Time `json:"time"`
+}
+
+// notifyInvalidation tells other instances that the certificate for
+// names changed, if the cache has a Notifier. Errors are only logged,
+// since other instances will catch up during maintenance anyway.
+func (certCache *Cache) notifyInvalidation(ctx context.Context, reason string, names []string) {
+	certCache.optionsMu.RLock()
+	notifier := certCache.options.Notifier
+	certCache.optionsMu.RUnlock()
+	if notifier == nil {
+		return
+	}
+	inv := CacheInvalidation{
+		Names:  names,
+		Reason: reason,
+		Origin: certCache.instanceID,
+		Time:   time.Now().UTC(),
+	}
+	if err := notifier.Notify(ctx, inv); err != nil {
+		certCache.logger.Error("unable to notify other instances of certificate change",
+			zap.Strings("identifiers", names),
+			zap.String("reason", reason),
+			zap.Error(err))
+	}
+}
+
+// listenForInvalidations handles invalidations from other instances
+// until the cache is stopped, restarting the listener if it fails.
+func (certCache *Cache) listenForInvalidations(notifier Notifier) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-certCache.stopChan
+		cancel()
+	}()
+
+	const retryDelay = 10 * time.Second
+	for {
+		err := notifier.Listen(ctx, certCache.created, func(inv CacheInvalidation) {
+			certCache.handleInvalidation(ctx, inv)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		certCache.logger.Error("listening for certificate changes from other instances",
+			zap.Duration("retrying_in", retryDelay),
+			zap.Error(err))
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleInvalidation reloads, or evicts if they are no longer in
+// storage, the cached managed certificates for the names in inv.
+func (certCache *Cache) handleInvalidation(ctx context.Context, inv CacheInvalidation) {
+	if inv.Origin == certCache.instanceID {
+		return // our cache is already up to date
+	}
+
+	var affected []Certificate
+	for _, name := range inv.Names {
+		for _, cert := range certCache.getAllMatchingCerts(name) {
+			if cert.managed && !slices.ContainsFunc(affected, func(c Certificate) bool { return c.hash == cert.hash }) {
+				affected = append(affected, cert)
+			}
+		}
+	}
+
+	for _, oldCert := range affected {
+		logger := certCache.logger.With(
+			zap.Strings("identifiers", oldCert.Names),
+			zap.String("reason", inv.Reason),
+			zap.String("origin", inv.Origin))
+
+		cfg, err := certCache.getConfig(oldCert)
+		if err != nil {
+			logger.Error("unable to get config for invalidated certificate", zap.Error(err))
+			continue
+		}
+		newCert, err := cfg.loadManagedCertificate(ctx, oldCert.Names[0])
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Info("evicting certificate removed by another instance")
+			certCache.mu.Lock()
+			certCache.removeCertificate(oldCert)
+			certCache.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			logger.Error("unable to reload certificate changed by another instance", zap.Error(err))
+			continue
+		}
+		if newCert.hash == oldCert.hash {
+			continue
+		}
+		logger.Info("reloading certificate changed by another instance")
+		certCache.replaceCertificate(oldCert, newCert)
+	}
+}
+
+// StorageNotifier is a Notifier that sends invalidations through
+// storage, which is polled for new ones. It needs no infrastructure
+// beyond the storage that instances already share, but latency is
+// bounded by the poll interval, and each poll lists storage.
+//
+// EXPERIMENTAL: Subject to change.
+type StorageNotifier struct {
+	// The storage to send invalidations through. REQUIRED.
+	Storage Storage
+
+	// How often to check for new invalidations.
+	// Default: 10s.
+	PollInterval time.Duration
+
+	// How long to keep invalidations in storage;
+	// must be much longer than PollInterval.
+	// Default: 10m.
+	Retention time.Duration
+}
+
+// Notify implements Notifier.
+func (sn StorageNotifier) Notify(ctx context.Context, inv CacheInvalidation) error {
+	invJSON, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	key := path.Join(prefixInvalidations, fmt.Sprintf("%020d-%s.json", inv.Time.UnixNano(), inv.Origin))
+	return sn.Storage.Store(ctx, key, invJSON)
+}
+
+// Listen implements Notifier. Invalidations that are still in storage
+// (see Retention) and were sent since the given time are handled too.
+func (sn StorageNotifier) Listen(ctx context.Context, since time.Time, handle func(CacheInvalidation)) error {
+	pollInterval := sn.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = 10 * time.Second
+	}
+	retention := sn.Retention
+	if retention <= 0 {
+		retention = 10 * time.Minute
+	}
+
+	// rather than keeping a cursor, remember which keys have been
+	// seen, since clocks of instances may not be perfectly in sync
+	seen := make(map[string]struct{})
+	keys, err := sn.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if sent, ok := invalidationTime(key); ok && !since.IsZero() && !sent.Before(since) {
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		keys, err := sn.list(ctx)
+		if err != nil {
+			return err
+		}
+		current := make(map[string]struct{}, len(keys))
+		for _, key := range keys {
+			if sent, ok := invalidationTime(key); ok && time.Since(sent) > retention {
+				// any instance may clean up; it's fine if several try
+				_ = sn.Storage.Delete(ctx, key)
+				continue
+			}
+			current[key] = struct{}{}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			invJSON, err := sn.Storage.Load(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // cleaned up already
+			}
+			if err != nil {
+				return err
+			}
+			var inv CacheInvalidation
+			if err := json.Unmarshal(invJSON, &inv); err != nil {
+				continue // not ours, or corrupted; nothing we can do
+			}
+			handle(inv)
+		}
+
+		// forget keys that are gone, so seen doesn't grow forever
+		for key := range seen {
+			if _, ok := current[key]; !ok {
+				delete(seen, key)
+			}
+		}
+	}
+}
+
+func (sn StorageNotifier) list(ctx context.Context) ([]string, error) {
+	keys, err := sn.Storage.List(ctx, prefixInvalidations, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing invalidations: %v", err)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// invalidationTime returns the time an invalidation was sent from its key.
+func invalidationTime(key string) (time.Time, bool) {
+	nanos, _, ok := strings.Cut(path.Base(key), "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	unixNano, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, unixNano), true
+}
+
+// RedisNotifier is a Notifier that sends invalidations with Redis
+// pub/sub, which has lower latency than polling storage. To avoid a
+// dependency on any particular Redis client, the client is adapted
+// to the small RedisPubSub interface.
+//
+// EXPERIMENTAL: Subject to change.
+type RedisNotifier struct {
+	// The Redis client. REQUIRED.
+	Client RedisPubSub
+
+	// The channel to publish to and subscribe on.
+	// Default: "certmagic:invalidations".
+	Channel string
+}
+
+// RedisPubSub is the subset of a Redis client used by RedisNotifier.
+//
+// EXPERIMENTAL: Subject to change.
+type RedisPubSub interface {
+	// Publish sends message on channel (PUBLISH).
+	Publish(ctx context.Context, channel string, message []byte) error
+
+	// Subscribe calls handle for each message on channel (SUBSCRIBE)
+	// until ctx is canceled. It blocks until then, or an error occurs.
+	Subscribe(ctx context.Context, channel string, handle func(message []byte)) error
+}
+
+// Notify implements Notifier.
+func (rn RedisNotifier) Notify(ctx context.Context, inv CacheInvalidation) error {
+	invJSON, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return rn.Client.Publish(ctx, rn.channel(), invJSON)
+}
+
+// Listen implements Notifier. Pub/sub does not keep messages, so
+// invalidations sent before Listen is called are not handled.
+func (rn RedisNotifier) Listen(ctx context.Context, _ time.Time, handle func(CacheInvalidation)) error {
+	return rn.Client.Subscribe(ctx, rn.channel(), func(message []byte) {
+		var inv CacheInvalidation
+		if err := json.Unmarshal(message, &inv); err == nil {
+			handle(inv)
+		}
+	})
+}
+
+func (rn RedisNotifier) channel() string {
+	if rn.Channel != "" {
+		return rn.Channel
+	}
+	return "certmagic:invalidations"
+}
+
+// newInstanceID returns a random ID to identify a cache to other instances.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+const prefixInvalidations = "invalidations"
+
+// Interface guards
+var (
+	_ Notifier = StorageNotifier{}
+	_ Notifier = RedisNotifier{}
+)
@@ -0,0 +1,140 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStorageNotifierInvalidation(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	storage := &FileStorage{Path: tmpDir}
+	notifier := StorageNotifier{Storage: storage, PollInterval: 10 * time.Millisecond}
+
+	// two instances sharing storage
+	newInstance := func() *Config {
+		am := &ACMEIssuer{CA: "https://example.com/acme/directory"}
+		cfg := &Config{
+			Issuers:            []Issuer{am},
+			Storage:            storage,
+			Logger:             defaultTestLogger,
+			OCSP:               OCSPConfig{DisableStapling: true},
+			CertificateHistory: 1,
+		}
+		cfg.certCache = NewCache(CacheOptions{
+			GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+			Notifier:         notifier,
+			Logger:           defaultTestLogger,
+		})
+		am.config = cfg
+		return cfg
+	}
+	cfgA, cfgB := newInstance(), newInstance()
+	defer cfgA.certCache.Stop()
+	defer cfgB.certCache.Stop()
+
+	const name = "notify.example.com"
+	var versions [][]byte
+	for i := 0; i < 2; i++ {
+		certPEM, keyPEM := mustGenerateTestCert(t, []string{name}, time.Now().Add(time.Duration(i+1)*24*time.Hour))
+		if _, err := cfgA.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{Overwrite: true}); err != nil {
+			t.Fatalf("Adopting version %d: %v", i, err)
+		}
+		versions = append(versions, certPEM)
+	}
+	if _, err := cfgB.CacheManagedCertificate(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+
+	rolledBack, err := cfgA.RollbackCertificate(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		certs := cfgB.certCache.getAllMatchingCerts(name)
+		if len(certs) == 1 && certs[0].hash == rolledBack.hash {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected other instance to reload rolled-back certificate; has %d certificates", len(certs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a revocation (here, just the removal that follows it) evicts
+	if err := cfgA.deleteSiteAssets(ctx, cfgA.Issuers[0].IssuerKey(), name); err != nil {
+		t.Fatal(err)
+	}
+	cfgA.certCache.notifyInvalidation(ctx, "revoked", []string{name})
+	for len(cfgB.certCache.getAllMatchingCerts(name)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected other instance to evict revoked certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInvalidationTime(t *testing.T) {
+	sent := time.Unix(0, 1700000000123456789)
+	if got, ok := invalidationTime("invalidations/01700000000123456789-abc.json"); !ok || !got.Equal(sent) {
+		t.Errorf("Expected %v, got %v (ok=%t)", sent, got, ok)
+	}
+	if _, ok := invalidationTime("invalidations/garbage"); ok {
+		t.Error("Expected invalid key to not parse")
+	}
+}
+
+func TestStorageNotifierListenSince(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifier := StorageNotifier{Storage: &FileStorage{Path: t.TempDir()}, PollInterval: 10 * time.Millisecond}
+
+	since := time.Now()
+	for _, inv := range []CacheInvalidation{
+		{Names: []string{"old.example.com"}, Origin: "a", Time: since.Add(-time.Minute)},
+		{Names: []string{"new.example.com"}, Origin: "a", Time: since.Add(time.Millisecond)},
+	} {
+		if err := notifier.Notify(ctx, inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handled := make(chan CacheInvalidation, 2)
+	go notifier.Listen(ctx, since, func(inv CacheInvalidation) { handled <- inv })
+	select {
+	case inv := <-handled:
+		if inv.Names[0] != "new.example.com" {
+			t.Errorf("Expected only the invalidation sent since the listener's start time, got %v", inv.Names)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected invalidation sent before Listen was called to be handled")
+	}
+	select {
+	case inv := <-handled:
+		t.Errorf("Expected invalidation sent before the start time to be skipped, got %v", inv.Names)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
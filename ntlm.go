@@ -0,0 +1,249 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4" //nolint:staticcheck // NTLM requires MD4
+)
+
+// NTLMProxyAuth implements NTLM (NTLMv2) authentication to proxies,
+// as specified by [MS-NLMP]. NTLM is connection-oriented: the proxy
+// must keep the connection open between the legs of the handshake.
+//
+// NTLM is a legacy protocol; prefer NegotiateProxyAuth if the proxy
+// supports Kerberos.
+//
+// EXPERIMENTAL: Subject to change.
+type NTLMProxyAuth struct {
+	// The Windows domain of the user, if any.
+	Domain string
+
+	// The credentials.
+	Username, Password string
+
+	// The name of this workstation, if it should be sent.
+	Workstation string
+}
+
+// ProxyAuthorization implements ProxyAuthenticator.
+func (na NTLMProxyAuth) ProxyAuthorization(_ context.Context, _ *url.URL, challenges []string) (string, error) {
+	if challenges == nil {
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+	}
+	param, ok := authChallengeParam(challenges, "NTLM")
+	if !ok || param == "" {
+		return "", nil // proxy doesn't support NTLM, or rejected our credentials
+	}
+	challenge, err := base64.StdEncoding.DecodeString(param)
+	if err != nil {
+		return "", fmt.Errorf("decoding NTLM challenge: %v", err)
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, clientChallenge); err != nil {
+		return "", err
+	}
+	msg, err := na.authenticateMessage(challenge, clientChallenge, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil
+}
+
+// ntlmNegotiateMessage returns the NEGOTIATE_MESSAGE (type 1).
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmDefaultFlags)
+	// domain and workstation fields (16 bytes) are left empty
+	return msg
+}
+
+// authenticateMessage returns the AUTHENTICATE_MESSAGE (type 3) that
+// answers the CHALLENGE_MESSAGE (type 2) challengeMsg.
+func (na NTLMProxyAuth) authenticateMessage(challengeMsg, clientChallenge []byte, now time.Time) ([]byte, error) {
+	if len(challengeMsg) < 32 || !bytes.Equal(challengeMsg[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challengeMsg[8:]) != 2 {
+		return nil, fmt.Errorf("invalid NTLM challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(challengeMsg[20:]) & ntlmDefaultFlags
+	serverChallenge := challengeMsg[24:32]
+	var targetInfo []byte
+	if len(challengeMsg) >= 48 {
+		var err error
+		targetInfo, err = ntlmPayload(challengeMsg, 40)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NTLM target info: %v", err)
+		}
+	}
+
+	// prefer the server's notion of time, if it told us
+	timestamp, hasTimestamp := ntlmAVTimestamp(targetInfo)
+	if !hasTimestamp {
+		timestamp = ntlmFiletime(now)
+	}
+
+	ntResponse, lmResponse := ntlmV2Response(ntowfV2(na.Username, na.Password, na.Domain),
+		serverChallenge, clientChallenge, timestamp, targetInfo)
+	if hasTimestamp {
+		// MS-NLMP 3.1.5.1.2: the LM response must be
+		// zeroed if the server provides a timestamp
+		lmResponse = make([]byte, 24)
+	}
+
+	encode := func(s string) []byte {
+		if flags&ntlmNegotiateUnicode != 0 {
+			return utf16LE(s)
+		}
+		return []byte(s)
+	}
+	payloads := [][]byte{
+		lmResponse,
+		ntResponse,
+		encode(na.Domain),
+		encode(na.Username),
+		encode(na.Workstation),
+		nil, // encrypted random session key
+	}
+
+	const headerLen = 64
+	msg := make([]byte, headerLen)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, payload := range payloads {
+		field := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(field[0:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(field[2:], uint16(len(payload)))
+		binary.LittleEndian.PutUint32(field[4:], uint32(len(msg)))
+		msg = append(msg, payload...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	return msg, nil
+}
+
+// ntowfV2 computes the NTLMv2 response key (MS-NLMP 3.3.2).
+func ntowfV2(username, password, domain string) []byte {
+	ntHash := md4.New()
+	ntHash.Write(utf16LE(password))
+	mac := hmac.New(md5.New, ntHash.Sum(nil))
+	mac.Write(utf16LE(strings.ToUpper(username) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2Response computes the NTLMv2 and LMv2 challenge responses
+// (MS-NLMP 3.3.2).
+func ntlmV2Response(responseKey, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (ntResponse, lmResponse []byte) {
+	var temp []byte
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, responseKey)
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	ntResponse = append(mac.Sum(nil), temp...)
+
+	mac.Reset()
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	lmResponse = append(mac.Sum(nil), clientChallenge...)
+
+	return ntResponse, lmResponse
+}
+
+// ntlmPayload returns the payload described by the
+// field (length, max length, offset) at fieldOffset.
+func ntlmPayload(msg []byte, fieldOffset int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[fieldOffset:]))
+	offset := int(binary.LittleEndian.Uint32(msg[fieldOffset+4:]))
+	if offset < 0 || offset+length > len(msg) {
+		return nil, fmt.Errorf("field out of bounds")
+	}
+	return msg[offset : offset+length], nil
+}
+
+// ntlmAVTimestamp returns the MsvAvTimestamp from an AV_PAIR list.
+func ntlmAVTimestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo[0:])
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAVIDEOL || len(targetInfo) < 4+length {
+			break
+		}
+		if id == ntlmAVIDTimestamp && length == 8 {
+			return targetInfo[4:12], true
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return nil, false
+}
+
+// ntlmFiletime encodes t as a Windows FILETIME: 100ns intervals
+// since January 1, 1601, little-endian.
+func ntlmFiletime(t time.Time) []byte {
+	const epochDiff = 116444736000000000 // 1601 to 1970 in 100ns intervals
+	ft := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ft, uint64(t.UnixNano()/100+epochDiff))
+	return ft
+}
+
+func utf16LE(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(codes))
+	for i, c := range codes {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+const (
+	ntlmNegotiateUnicode            = 0x00000001
+	ntlmRequestTarget               = 0x00000004
+	ntlmNegotiateNTLM               = 0x00000200
+	ntlmNegotiateAlwaysSign         = 0x00008000
+	ntlmNegotiateExtendedSessionSec = 0x00080000
+	ntlmNegotiateTargetInfo         = 0x00800000
+	ntlmNegotiate128                = 0x20000000
+	ntlmNegotiate56                 = 0x80000000
+
+	ntlmDefaultFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSec | ntlmNegotiateTargetInfo |
+		ntlmNegotiate128 | ntlmNegotiate56
+
+	ntlmAVIDEOL       = 0
+	ntlmAVIDTimestamp = 7
+)
+
+// Interface guard
+var _ ProxyAuthenticator = NTLMProxyAuth{}
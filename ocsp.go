@@ -23,7 +23,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"path"
 	"time"
 
 	"golang.org/x/crypto/ocsp"
@@ -33,6 +35,38 @@ import (
 // stapled because the certificate does not support OCSP.
 var ErrNoOCSPServerSpecified = errors.New("no OCSP server specified in certificate")
 
+// ocspConfig returns cfg.OCSP; if it doesn't have its own proxy,
+// requests go through cfg.HTTPClient, or else the proxy of the first
+// issuer that has one, since OCSP responders are run by CAs and
+// reachable the same way. Connections follow cfg.DialPolicy.
+func (cfg *Config) ocspConfig() OCSPConfig {
+	ocspConfig := cfg.OCSP
+	if ocspConfig.HTTPProxy == nil && ocspConfig.ProxyAuthenticator == nil {
+		if cfg.HTTPClient != nil {
+			ocspConfig.httpClient = cfg.HTTPClient
+			return ocspConfig
+		}
+		for _, issuer := range cfg.Issuers {
+			proxied, ok := issuer.(proxiedIssuer)
+			if !ok {
+				continue
+			}
+			if proxyFunc, authenticator := proxied.proxy(); proxyFunc != nil || authenticator != nil {
+				ocspConfig.HTTPProxy, ocspConfig.ProxyAuthenticator = proxyFunc, authenticator
+				break
+			}
+		}
+	}
+	if cfg.DialPolicy != nil {
+		transport := proxyTransport(ocspConfig.HTTPProxy, ocspConfig.ProxyAuthenticator)
+		if ocspConfig.ProxyAuthenticator == nil {
+			transport.DialContext = cfg.DialPolicy.dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+		}
+		ocspConfig.httpClient = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	}
+	return ocspConfig
+}
+
 // stapleOCSP staples OCSP information to cert for hostname name.
 // If you have it handy, you should pass in the PEM-encoded certificate
 // bundle; otherwise the DER-encoded cert will have to be PEM-encoded.
@@ -45,6 +79,7 @@ var ErrNoOCSPServerSpecified = errors.New("no OCSP server specified in certifica
 // Errors here are not necessarily fatal, it could just be that the
 // certificate doesn't have an issuer URL.
 func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cert *Certificate, pemBundle []byte) error {
+	ocspConfig = ocspConfig.forCert(*cert)
 	if ocspConfig.DisableStapling {
 		return nil
 	}
@@ -66,27 +101,25 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 	// First try to load OCSP staple from storage and see if
 	// we can still use it.
 	ocspStapleKey := StorageKeys.OCSPStaple(cert, pemBundle)
-	cachedOCSP, err := storage.Load(ctx, ocspStapleKey)
-	if err == nil {
-		resp, err := ocsp.ParseResponse(cachedOCSP, nil)
-		if err == nil {
-			if freshOCSP(resp) {
-				// staple is still fresh; use it
-				ocspBytes = cachedOCSP
-				ocspResp = resp
-			}
-		} else {
-			// invalid contents; delete the file
-			// (we do this independently of the maintenance routine because
-			// in this case we know for sure this should be a staple file
-			// because we loaded it by name, whereas the maintenance routine
-			// just iterates the list of files, even if somehow a non-staple
-			// file gets in the folder. in this case we are sure it is corrupt.)
-			err := storage.Delete(ctx, ocspStapleKey)
-			if err != nil {
-				log.Printf("[WARNING] Unable to delete invalid OCSP staple file: %v", err)
-			}
+	ocspBytes, ocspResp = loadFreshOCSP(ctx, storage, ocspStapleKey)
+
+	// Otherwise, synchronize fetching, so that only one instance in
+	// a cluster queries the responder and the others use its staple
+	// (certificates without responder have nothing to synchronize)
+	hasResponder := cert.Leaf == nil || len(cert.Leaf.OCSPServer) > 0
+	if (ocspResp == nil || len(ocspBytes) == 0) && hasResponder {
+		lockName := "ocsp_" + path.Base(ocspStapleKey)
+		if err := acquireLock(ctx, storage, lockName); err != nil {
+			return fmt.Errorf("unable to obtain OCSP lock for %v: %v", cert.Names, err)
 		}
+		defer func() {
+			if err := releaseLock(ctx, storage, lockName); err != nil {
+				log.Printf("[ERROR] Unable to release OCSP lock for %v: %v", cert.Names, err)
+			}
+		}()
+
+		// see if the staple has been refreshed already by another instance
+		ocspBytes, ocspResp = loadFreshOCSP(ctx, storage, ocspStapleKey)
 	}
 
 	// If we couldn't get a fresh staple by reading the cache,
@@ -96,6 +129,9 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 		// An error here is not a problem because a certificate
 		// may simply not contain a link to an OCSP server.
 		if ocspErr != nil {
+			if !errors.Is(ocspErr, ErrNoOCSPServerSpecified) && cert.ocspFailingSince.IsZero() {
+				cert.ocspFailingSince = time.Now()
+			}
 			// For short-lived certificates, this is fine and we can ignore
 			// logging because OCSP doesn't make much sense for them anyway.
 			if cert.Lifetime() < 7*24*time.Hour {
@@ -107,6 +143,7 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 		}
 		gotNewOCSP = true
 	}
+	cert.ocspFailingSince = time.Time{}
 
 	if ocspResp.NextUpdate.After(expiresAt(cert.Leaf)) {
 		// uh oh, this OCSP response expires AFTER the certificate does, that's kinda bogus.
@@ -136,6 +173,33 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 	return nil
 }
 
+// loadFreshOCSP loads the OCSP response at key from storage, if it
+// is still fresh.
+func loadFreshOCSP(ctx context.Context, storage Storage, key string) ([]byte, *ocsp.Response) {
+	cachedOCSP, err := storage.Load(ctx, key)
+	if err != nil {
+		return nil, nil
+	}
+	resp, err := ocsp.ParseResponse(cachedOCSP, nil)
+	if err != nil {
+		// invalid contents; delete the file
+		// (we do this independently of the maintenance routine because
+		// in this case we know for sure this should be a staple file
+		// because we loaded it by name, whereas the maintenance routine
+		// just iterates the list of files, even if somehow a non-staple
+		// file gets in the folder. in this case we are sure it is corrupt.)
+		err := storage.Delete(ctx, key)
+		if err != nil {
+			log.Printf("[WARNING] Unable to delete invalid OCSP staple file: %v", err)
+		}
+		return nil, nil
+	}
+	if !freshOCSP(resp) {
+		return nil, nil
+	}
+	return cachedOCSP, resp
+}
+
 // getOCSPForCert takes a PEM encoded cert or cert bundle returning the raw OCSP response,
 // the parsed response, and an error, if any. The returned []byte can be passed directly
 // into the OCSPStaple property of a tls.Certificate. If the bundle only contains the
@@ -175,12 +239,12 @@ func getOCSPForCert(ocspConfig OCSPConfig, bundle []byte) ([]byte, *ocsp.Respons
 
 	// configure HTTP client if necessary
 	httpClient := http.DefaultClient
-	if ocspConfig.HTTPProxy != nil {
+	if ocspConfig.httpClient != nil {
+		httpClient = ocspConfig.httpClient
+	} else if ocspConfig.HTTPProxy != nil || ocspConfig.ProxyAuthenticator != nil {
 		httpClient = &http.Client{
-			Transport: &http.Transport{
-				Proxy: ocspConfig.HTTPProxy,
-			},
-			Timeout: 30 * time.Second,
+			Transport: proxyTransport(ocspConfig.HTTPProxy, ocspConfig.ProxyAuthenticator),
+			Timeout:   30 * time.Second,
 		}
 	}
 
@@ -4,11 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ocsp"
 )
@@ -180,3 +190,70 @@ func startOCSPResponder(
 	}
 	return httptest.NewServer(http.HandlerFunc(h))
 }
+
+func TestStapleOCSPSingleFlight(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	ca := issueTestCert(t, nil, "Test CA", true, "")
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(90 * 24 * time.Hour),
+		OCSPServer:   []string{"ocsp.example.com"},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca.cert, leafKey.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+
+	r, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leafTmpl.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(time.Hour),
+	}, ca.key)
+	if err != nil {
+		t.Fatal("couldn't create OCSP response", err)
+	}
+	var requests atomic.Int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(r)
+	}))
+	defer responder.Close()
+	config := OCSPConfig{ResponderOverrides: map[string]string{"ocsp.example.com": responder.URL}}
+
+	// instances sharing storage fetch the staple only once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cert Certificate
+			if err := fillCertFromLeaf(&cert, tls.Certificate{Certificate: [][]byte{leafDER, ca.cert.Raw}, PrivateKey: leafKey}); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := stapleOCSP(ctx, config, storage, &cert, bundle.Bytes()); err != nil {
+				t.Error("unexpected error:", err)
+			} else if !bytes.Equal(cert.Certificate.OCSPStaple, r) {
+				t.Error("expected OCSP response to be stapled to certificate")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected the responder to be queried once, got %d requests", n)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPPolicy overrides the OCSP configuration for a class of
+// certificates: those of certain issuers or for certain names.
+// A certificate is in the class if it matches both Issuers and
+// Names, where an empty list matches all certificates.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type OCSPPolicy struct {
+	// The issuers of the certificates, each matching the
+	// common name or organization of a certificate's
+	// issuer, or the key of the Issuer that issued it
+	// (for example "acme-v02.api.letsencrypt.org-directory").
+	Issuers []string
+
+	// The names on the certificates, which may be patterns
+	// like "*.example.com" (see MatchWildcard); any name
+	// on a certificate may match.
+	Names []string
+
+	// Whether stapling is disabled for the certificates.
+	DisableStapling bool
+
+	// Whether handshakes fail without a valid staple;
+	// see OCSPConfig.HardFail.
+	HardFail bool
+
+	// Replaces OCSPConfig.ResponderOverrides, if set.
+	ResponderOverrides map[string]string
+}
+
+func (p OCSPPolicy) matches(cert Certificate) bool {
+	if len(p.Issuers) > 0 {
+		var issuerNames []string
+		if cert.Leaf != nil {
+			issuerNames = append(issuerNames, cert.Leaf.Issuer.CommonName)
+			issuerNames = append(issuerNames, cert.Leaf.Issuer.Organization...)
+		}
+		if cert.issuerKey != "" {
+			issuerNames = append(issuerNames, cert.issuerKey)
+		}
+		if !slices.ContainsFunc(p.Issuers, func(issuer string) bool { return slices.Contains(issuerNames, issuer) }) {
+			return false
+		}
+	}
+	if len(p.Names) > 0 {
+		return slices.ContainsFunc(cert.Names, func(name string) bool {
+			return slices.ContainsFunc(p.Names, func(pattern string) bool { return MatchWildcard(name, pattern) })
+		})
+	}
+	return true
+}
+
+// forCert returns the OCSP configuration for cert: oc with the
+// first of its Policies that matches cert applied.
+func (oc OCSPConfig) forCert(cert Certificate) OCSPConfig {
+	for _, p := range oc.Policies {
+		if !p.matches(cert) {
+			continue
+		}
+		oc.DisableStapling = p.DisableStapling
+		oc.HardFail = p.HardFail
+		if p.ResponderOverrides != nil {
+			oc.ResponderOverrides = p.ResponderOverrides
+		}
+		break
+	}
+	return oc
+}
+
+// checkStaple returns cert as it should be served according to oc,
+// or an error if it must not be served because it lacks a valid OCSP
+// staple. A staple that has expired is never served: clients would
+// reject the certificate.
+func (oc OCSPConfig) checkStaple(cert Certificate) (Certificate, error) {
+	if oc.DisableStapling || cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 {
+		return cert, nil
+	}
+	now := time.Now()
+	stapled := cert.ocsp != nil && cert.ocsp.Status == ocsp.Good && len(cert.Certificate.OCSPStaple) > 0
+	if stapled && now.After(cert.ocsp.NextUpdate) {
+		cert.Certificate.OCSPStaple = nil
+		stapled = false
+	}
+	if stapled || !oc.HardFail {
+		return cert, nil
+	}
+	if oc.ServeUnstapledAfter > 0 && !cert.ocspFailingSince.IsZero() &&
+		now.Sub(cert.ocspFailingSince) > oc.ServeUnstapledAfter {
+		return cert, nil
+	}
+	return Certificate{}, fmt.Errorf("no valid OCSP staple for %v", cert.Names)
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPConfigForCert(t *testing.T) {
+	oc := OCSPConfig{
+		ResponderOverrides: map[string]string{"http://ocsp.example": "http://proxy.example"},
+		Policies: []OCSPPolicy{
+			{Issuers: []string{"Deprecated CA"}, DisableStapling: true},
+			{Names: []string{"*.strict.example.com"}, HardFail: true, ResponderOverrides: map[string]string{}},
+		},
+	}
+	certFor := func(issuer string, names ...string) Certificate {
+		return Certificate{
+			Names:       names,
+			Certificate: tls.Certificate{Leaf: &x509.Certificate{Issuer: pkix.Name{CommonName: issuer}}},
+		}
+	}
+
+	if got := oc.forCert(certFor("Deprecated CA", "example.com")); !got.DisableStapling || got.HardFail {
+		t.Errorf("Expected stapling disabled by issuer, got %+v", got)
+	}
+	got := oc.forCert(certFor("Other CA", "example.com", "www.strict.example.com"))
+	if got.DisableStapling || !got.HardFail || len(got.ResponderOverrides) != 0 {
+		t.Errorf("Expected hard-fail by name, got %+v", got)
+	}
+	if got := oc.forCert(certFor("Other CA", "example.com")); got.DisableStapling || got.HardFail || len(got.ResponderOverrides) != 1 {
+		t.Errorf("Expected global configuration, got %+v", got)
+	}
+}
+
+func TestOCSPConfigCheckStaple(t *testing.T) {
+	leaf := &x509.Certificate{OCSPServer: []string{"http://ocsp.example"}}
+	stapled := Certificate{
+		Names:       []string{"example.com"},
+		Certificate: tls.Certificate{Leaf: leaf, OCSPStaple: []byte("staple")},
+		ocsp:        &ocsp.Response{Status: ocsp.Good, NextUpdate: time.Now().Add(time.Hour)},
+	}
+	expired := stapled
+	expired.ocsp = &ocsp.Response{Status: ocsp.Good, NextUpdate: time.Now().Add(-time.Hour)}
+	expired.ocspFailingSince = time.Now().Add(-3 * time.Hour)
+
+	if cert, err := (OCSPConfig{HardFail: true}).checkStaple(stapled); err != nil || cert.OCSPStaple == nil {
+		t.Errorf("Expected stapled certificate to be served with staple, got err=%v", err)
+	}
+	if cert, err := (OCSPConfig{}).checkStaple(expired); err != nil || cert.OCSPStaple != nil {
+		t.Errorf("Expected soft-fail to serve without expired staple, got err=%v", err)
+	}
+	if _, err := (OCSPConfig{HardFail: true, ServeUnstapledAfter: 4 * time.Hour}).checkStaple(expired); err == nil {
+		t.Error("Expected hard-fail without valid staple")
+	}
+	if cert, err := (OCSPConfig{HardFail: true, ServeUnstapledAfter: 2 * time.Hour}).checkStaple(expired); err != nil || cert.OCSPStaple != nil {
+		t.Errorf("Expected to serve without staple after long responder outage, got err=%v", err)
+	}
+
+	noResponder := Certificate{Certificate: tls.Certificate{Leaf: &x509.Certificate{}}}
+	if _, err := (OCSPConfig{HardFail: true}).checkStaple(noResponder); err != nil {
+		t.Errorf("Expected certificates without OCSP responder to be served, got %v", err)
+	}
+}
+
+func TestStapleOCSPFailingSince(t *testing.T) {
+	cert := Certificate{
+		Names: []string{"example.com"},
+		Certificate: tls.Certificate{
+			Certificate: [][]byte{[]byte("not parsed")},
+			Leaf:        &x509.Certificate{OCSPServer: []string{"http://127.0.0.1:0"}, NotAfter: time.Now().Add(90 * 24 * time.Hour)},
+		},
+	}
+	storage := &FileStorage{Path: t.TempDir()}
+
+	// disabled by policy: nothing happens
+	oc := OCSPConfig{Policies: []OCSPPolicy{{Names: []string{"example.com"}, DisableStapling: true}}}
+	if err := stapleOCSP(context.Background(), oc, storage, &cert, nil); err != nil || !cert.ocspFailingSince.IsZero() {
+		t.Errorf("Expected stapling to be disabled by policy, got err=%v", err)
+	}
+
+	// the time the responder started failing is remembered
+	if err := stapleOCSP(context.Background(), OCSPConfig{}, storage, &cert, nil); err == nil || cert.ocspFailingSince.IsZero() {
+		t.Fatalf("Expected failure to be recorded, got err=%v", err)
+	}
+	since := cert.ocspFailingSince
+	stapleOCSP(context.Background(), OCSPConfig{}, storage, &cert, nil)
+	if !cert.ocspFailingSince.Equal(since) {
+		t.Error("Expected the start of the failure to be kept")
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrOnDemandBudgetExceeded is returned (wrapped) when a certificate
+// is not obtained on demand because of OnDemandConfig.MaxCertificates.
+var ErrOnDemandBudgetExceeded = errors.New("on-demand certificate budget exceeded")
+
+// CertificateBudget limits how many certificates are managed on demand,
+// in total and per parent domain, so that a single tenant or an attacker
+// can't make the server obtain certificates past what its storage and
+// cache can hold. A certificate counts from when it is obtained, or
+// loaded from storage during a handshake, until it is decommissioned or
+// evicted to make room; after a restart, the certificates in storage
+// count once they are loaded again.
+//
+// EXPERIMENTAL: Subject to change.
+type CertificateBudget struct {
+	// The maximum number of certificates.
+	// 0 means no limit.
+	Total int
+
+	// The maximum number of certificates for names
+	// with the same parent domain, which is the name
+	// without its first label: "example.com" for both
+	// "a.example.com" and "*.example.com". 0 means
+	// no limit.
+	PerParentDomain int
+
+	// What to do when a certificate is needed beyond
+	// the limits. Default: OverflowDeny.
+	Overflow BudgetOverflow
+
+	mu      sync.Mutex
+	names   map[string]budgetEntry
+	parents map[string]int
+	changed chan struct{}
+	denied  uint64
+	evicted uint64
+	queued  uint64
+}
+
+// budgetEntry is a name that counts against a CertificateBudget.
+type budgetEntry struct {
+	parent  string
+	pending bool // being obtained
+}
+
+// BudgetOverflow is what is done when a certificate is needed on
+// demand beyond the limits of a CertificateBudget.
+//
+// EXPERIMENTAL: Subject to change.
+type BudgetOverflow int
+
+const (
+	// OverflowDeny refuses to obtain the certificate,
+	// so the handshake fails. This is the default.
+	OverflowDeny BudgetOverflow = iota
+
+	// OverflowEvictLeastUsed makes room by removing the
+	// certificate that was least recently used for a
+	// handshake (of the same parent domain, if that
+	// limit is reached) from the cache and from storage.
+	OverflowEvictLeastUsed
+
+	// OverflowQueue waits for room, until the handshake
+	// times out (see HandshakeTimeouts.Obtain).
+	OverflowQueue
+)
+
+func (o BudgetOverflow) String() string {
+	switch o {
+	case OverflowDeny:
+		return "deny"
+	case OverflowEvictLeastUsed:
+		return "evict_least_used"
+	case OverflowQueue:
+		return "queue"
+	}
+	return fmt.Sprintf("BudgetOverflow(%d)", int(o))
+}
+
+// CertificateBudgetUsage is the current usage of a CertificateBudget,
+// and what happened when it was exceeded since the process started.
+//
+// EXPERIMENTAL: Subject to change.
+type CertificateBudgetUsage struct {
+	// The certificates that count, including
+	// those that are being obtained, in total
+	// and per parent domain.
+	Certificates    int
+	PerParentDomain map[string]int
+
+	// How many certificates were denied,
+	// evicted to make room, and queued for
+	// room (whether or not they got it).
+	Denied  uint64
+	Evicted uint64
+	Queued  uint64
+}
+
+// Usage returns the current usage of the budget.
+func (cb *CertificateBudget) Usage() CertificateBudgetUsage {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return CertificateBudgetUsage{
+		Certificates:    len(cb.names),
+		PerParentDomain: maps.Clone(cb.parents),
+		Denied:          cb.denied,
+		Evicted:         cb.evicted,
+		Queued:          cb.queued,
+	}
+}
+
+// reserve makes a certificate for name count against the budget before
+// it is obtained, making room or waiting for it according to the
+// overflow policy. If no error is returned, the caller must call done
+// with the certificate, which is empty if it wasn't obtained.
+func (cb *CertificateBudget) reserve(ctx context.Context, cfg *Config, name string) (done func(Certificate), err error) {
+	parent := parentDomain(name)
+	var queued bool
+	for {
+		cb.mu.Lock()
+		if _, ok := cb.names[name]; ok {
+			// already counts, like when it is renewed
+			cb.mu.Unlock()
+			return func(Certificate) {}, nil
+		}
+		exceeded, perParent := cb.exceeded(parent)
+		if exceeded == "" {
+			cb.addLocked(name, parent, true)
+			cb.mu.Unlock()
+			return func(cert Certificate) { cb.finish(name, !cert.Empty()) }, nil
+		}
+
+		switch cb.Overflow {
+		case OverflowEvictLeastUsed:
+			if victim := cb.leastUsed(cfg.certCache, parent, perParent); victim != "" {
+				cb.removeLocked(victim)
+				cb.evicted++
+				cb.mu.Unlock()
+				cfg.evictForBudget(ctx, victim)
+				continue
+			}
+		case OverflowQueue:
+			if !queued {
+				cb.queued++
+				queued = true
+			}
+			changed := cb.changedLocked()
+			cb.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w: %s; waiting for room: %w", ErrOnDemandBudgetExceeded, exceeded, ctx.Err())
+			}
+		}
+		cb.denied++
+		cb.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrOnDemandBudgetExceeded, exceeded)
+	}
+}
+
+// exceeded describes the limit that a new certificate for a name
+// with the given parent domain would exceed, and whether it is the
+// limit per parent domain; the description is empty if it fits.
+//
+// cb.mu must be locked.
+func (cb *CertificateBudget) exceeded(parent string) (string, bool) {
+	if cb.PerParentDomain > 0 && cb.parents[parent] >= cb.PerParentDomain {
+		return fmt.Sprintf("%d certificates for parent domain %s", cb.PerParentDomain, parent), true
+	}
+	if cb.Total > 0 && len(cb.names) >= cb.Total {
+		return fmt.Sprintf("%d certificates in total", cb.Total), false
+	}
+	return "", false
+}
+
+// leastUsed returns the name whose certificate was least recently
+// used for a handshake, among those with the given parent domain if
+// perParent is true; names without a certificate in the cache come
+// first. Names that are being obtained are not considered. It returns
+// an empty string if there is no such name.
+//
+// cb.mu must be locked.
+func (cb *CertificateBudget) leastUsed(certCache *Cache, parent string, perParent bool) string {
+	var victim string
+	var victimActive time.Time
+	for name, entry := range cb.names {
+		if entry.pending || (perParent && entry.parent != parent) {
+			continue
+		}
+		active := certCache.lastActive(name)
+		if victim == "" || active.Before(victimActive) || (active.Equal(victimActive) && name < victim) {
+			victim, victimActive = name, active
+		}
+	}
+	return victim
+}
+
+// add makes the certificate for name, which was loaded from storage,
+// count against the budget, even if that exceeds it.
+func (cb *CertificateBudget) add(name string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if _, ok := cb.names[name]; !ok {
+		cb.addLocked(name, parentDomain(name), false)
+	}
+}
+
+// finish records whether the certificate for name that was reserved
+// was obtained; if not, it doesn't count anymore.
+func (cb *CertificateBudget) finish(name string, obtained bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !obtained {
+		cb.removeLocked(name)
+		return
+	}
+	if entry, ok := cb.names[name]; ok {
+		entry.pending = false
+		cb.names[name] = entry
+	}
+}
+
+// remove makes the certificates for names not count anymore.
+func (cb *CertificateBudget) remove(names ...string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for _, name := range names {
+		cb.removeLocked(name)
+	}
+}
+
+func (cb *CertificateBudget) addLocked(name, parent string, pending bool) {
+	if cb.names == nil {
+		cb.names = make(map[string]budgetEntry)
+		cb.parents = make(map[string]int)
+	}
+	cb.names[name] = budgetEntry{parent: parent, pending: pending}
+	cb.parents[parent]++
+}
+
+func (cb *CertificateBudget) removeLocked(name string) {
+	entry, ok := cb.names[name]
+	if !ok {
+		return
+	}
+	delete(cb.names, name)
+	if cb.parents[entry.parent]--; cb.parents[entry.parent] <= 0 {
+		delete(cb.parents, entry.parent)
+	}
+	if cb.changed != nil {
+		close(cb.changed)
+		cb.changed = nil
+	}
+}
+
+// changedLocked returns a channel that is closed when a name stops
+// counting against the budget.
+func (cb *CertificateBudget) changedLocked() <-chan struct{} {
+	if cb.changed == nil {
+		cb.changed = make(chan struct{})
+	}
+	return cb.changed
+}
+
+// parentDomain returns name without its first label.
+func parentDomain(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	return parent
+}
+
+// lastActive returns when a managed certificate for name in the cache
+// was last used for a handshake (or added, if it wasn't used), or the
+// zero time if there is none.
+func (certCache *Cache) lastActive(name string) time.Time {
+	var active time.Time
+	for _, cert := range certCache.getAllMatchingCerts(name) {
+		if !cert.managed {
+			continue
+		}
+		if usage, ok := certCache.usage.load(cert.hash); ok {
+			last := usage.added
+			if lastUsed := usage.lastUsed.Load(); lastUsed > 0 {
+				last = time.Unix(0, lastUsed)
+			}
+			if last.After(active) {
+				active = last
+			}
+		}
+	}
+	return active
+}
+
+// evictForBudget removes the certificates for name from the cache and
+// storage to make room in the budget of cfg.OnDemand.
+func (cfg *Config) evictForBudget(ctx context.Context, name string) {
+	cfg.certCache.mu.Lock()
+	for _, cert := range cfg.certCache.getAllMatchingCerts(name) {
+		if cert.managed {
+			cfg.certCache.removeCertificate(cert)
+		}
+	}
+	cfg.certCache.mu.Unlock()
+
+	// certificates that are not in the cache are in storage
+	for _, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(issuerKey, name)) {
+			continue
+		}
+		if err := cfg.deleteCertAssets(ctx, issuerKey, []string{name}, "evicted"); err != nil {
+			cfg.Logger.Error("unable to delete evicted on-demand certificate from storage",
+				zap.String("identifier", name),
+				zap.String("issuer", issuerKey),
+				zap.Error(err))
+		}
+	}
+
+	cfg.Logger.Info("evicted on-demand certificate to make room for another",
+		zap.String("identifier", name))
+}
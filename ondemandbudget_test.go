@@ -0,0 +1,107 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCertificateBudget(t *testing.T) {
+	ctx := context.Background()
+	budget := &CertificateBudget{Total: 3, PerParentDomain: 2}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnDemand: &OnDemandConfig{
+			DecisionFunc:    func(context.Context, string) error { return nil },
+			MaxCertificates: budget,
+		},
+	})
+	issuerKey := cfg.Issuers[0].IssuerKey()
+
+	handshake := func(name string) error {
+		t.Helper()
+		_, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		return err
+	}
+
+	for _, name := range []string{"a.one.example", "b.one.example", "a.two.example"} {
+		if err := handshake(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// certificates that count don't count twice
+	if err := handshake("a.one.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	// by default, certificates beyond either limit are denied
+	for _, name := range []string{"c.one.example", "b.two.example"} {
+		if err := handshake(name); !errors.Is(err, ErrOnDemandBudgetExceeded) {
+			t.Errorf("Expected %s to be denied, got %v", name, err)
+		}
+	}
+
+	// the least used certificate of the parent domain makes room
+	budget.Overflow = OverflowEvictLeastUsed
+	if err := handshake("b.one.example"); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake("c.one.example"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.getAllMatchingCerts("a.one.example")) != 0 || cfg.Storage.Exists(ctx, StorageKeys.SiteCert(issuerKey, "a.one.example")) {
+		t.Error("Expected least used certificate to be evicted from cache and storage")
+	}
+	if len(cache.getAllMatchingCerts("b.one.example")) != 1 {
+		t.Error("Expected recently used certificate to be kept")
+	}
+
+	// or waits for room
+	budget.Overflow = OverflowQueue
+	cfg.HandshakeTimeouts.Obtain = 100 * time.Millisecond
+	if err := handshake("b.two.example"); !errors.Is(err, ErrOnDemandBudgetExceeded) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected queued certificate to time out, got %v", err)
+	}
+	cfg.HandshakeTimeouts.Obtain = 5 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		budget.remove("a.two.example")
+	}()
+	if err := handshake("b.two.example"); err != nil {
+		t.Errorf("Expected queued certificate to be obtained when there is room, got %v", err)
+	}
+
+	usage := budget.Usage()
+	if usage.Certificates != 3 || usage.PerParentDomain["one.example"] != 2 || usage.PerParentDomain["two.example"] != 1 {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+	if usage.Denied != 2 || usage.Evicted != 1 || usage.Queued != 2 {
+		t.Errorf("Unexpected overflow counts: %+v", usage)
+	}
+}
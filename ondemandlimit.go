@@ -0,0 +1,199 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrOnDemandRateLimited is returned (wrapped) when an on-demand
+// certificate operation is refused because of OnDemandRateLimit.
+var ErrOnDemandRateLimited = errors.New("on-demand issuance rate limited")
+
+// OnDemandRateLimit protects on-demand issuance from bursts of TLS
+// handshakes with bogus server names, which could otherwise exhaust
+// CA rate limits and local resources. Limits are enforced only for
+// handshakes that would start a new certificate operation; handshakes
+// that wait for an operation already in progress are not counted.
+// A zero SlidingWindowLimit imposes no limit.
+//
+// EXPERIMENTAL: Subject to change.
+type OnDemandRateLimit struct {
+	// Limit across all names and clients.
+	Global SlidingWindowLimit
+
+	// Limit per client IP address.
+	PerIP SlidingWindowLimit
+
+	// Limit per server name (SNI).
+	PerName SlidingWindowLimit
+
+	// The maximum number of on-demand certificate
+	// operations that may be in progress at once.
+	// 0 means no limit.
+	MaxPending int
+
+	mu        sync.Mutex
+	global    *RingBufferRateLimiter
+	ips       map[string]*keyedRateLimiter
+	names     map[string]*keyedRateLimiter
+	lastSweep time.Time
+	pending   int
+}
+
+// SlidingWindowLimit allows up to Events events in a sliding Window.
+//
+// EXPERIMENTAL: Subject to change.
+type SlidingWindowLimit struct {
+	Events int
+	Window time.Duration
+}
+
+// enabled returns true if swl imposes a limit.
+func (swl SlidingWindowLimit) enabled() bool {
+	return swl.Events > 0 && swl.Window > 0
+}
+
+// keyedRateLimiter is the rate limiter for one client IP or name.
+type keyedRateLimiter struct {
+	limiter   *RingBufferRateLimiter
+	lastEvent time.Time
+}
+
+// start reserves a slot for a new on-demand certificate operation
+// for hello. If no error is returned, the caller must call its done
+// function when the operation has finished.
+func (odrl *OnDemandRateLimit) start(hello *tls.ClientHelloInfo, name string) (done func(), err error) {
+	now := time.Now()
+	ip := remoteIPFromHello(hello)
+
+	odrl.mu.Lock()
+	defer odrl.mu.Unlock()
+
+	if odrl.MaxPending > 0 && odrl.pending >= odrl.MaxPending {
+		return nil, fmt.Errorf("%w: %d operations already pending", ErrOnDemandRateLimited, odrl.pending)
+	}
+
+	if now.Sub(odrl.lastSweep) >= rateLimitSweepInterval {
+		sweepRateLimiters(odrl.ips, odrl.PerIP.Window, now)
+		sweepRateLimiters(odrl.names, odrl.PerName.Window, now)
+		odrl.lastSweep = now
+	}
+	if odrl.Global.enabled() && odrl.global == nil {
+		odrl.global = newWindowLimiter(odrl.Global.Events, odrl.Global.Window)
+	}
+
+	// check all applicable limits before recording the event,
+	// so that a refusal by one limit doesn't count against the
+	// others; keys without a limiter yet have no recent events
+	type check struct {
+		limit   SlidingWindowLimit
+		limiter *RingBufferRateLimiter
+		scope   string
+	}
+	var checks []check
+	if odrl.Global.enabled() {
+		checks = append(checks, check{odrl.Global, odrl.global, "global"})
+	}
+	if odrl.PerIP.enabled() && ip != "" {
+		if kl := odrl.ips[ip]; kl != nil {
+			checks = append(checks, check{odrl.PerIP, kl.limiter, "client IP " + ip})
+		}
+	}
+	if odrl.PerName.enabled() {
+		if kl := odrl.names[name]; kl != nil {
+			checks = append(checks, check{odrl.PerName, kl.limiter, "name " + name})
+		}
+	}
+	for _, c := range checks {
+		if !c.limiter.allowedAt(now) {
+			return nil, fmt.Errorf("%w: %s exceeded %d per %s", ErrOnDemandRateLimited, c.scope, c.limit.Events, c.limit.Window)
+		}
+	}
+
+	// only allowed events create limiters, so if there is a global
+	// limit, it also bounds how many keys are tracked at once
+	if odrl.global != nil {
+		odrl.global.recordAt(now)
+	}
+	if odrl.PerIP.enabled() && ip != "" {
+		odrl.ips = recordKeyedEvent(odrl.ips, ip, odrl.PerIP, now)
+	}
+	if odrl.PerName.enabled() {
+		odrl.names = recordKeyedEvent(odrl.names, name, odrl.PerName, now)
+	}
+
+	odrl.pending++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			odrl.mu.Lock()
+			odrl.pending--
+			odrl.mu.Unlock()
+		})
+	}, nil
+}
+
+// recordKeyedEvent records an event for key in limiters, creating
+// the map and the key's rate limiter if needed.
+func recordKeyedEvent(limiters map[string]*keyedRateLimiter, key string, limit SlidingWindowLimit, now time.Time) map[string]*keyedRateLimiter {
+	if limiters == nil {
+		limiters = make(map[string]*keyedRateLimiter)
+	}
+	kl := limiters[key]
+	if kl == nil {
+		kl = &keyedRateLimiter{limiter: newWindowLimiter(limit.Events, limit.Window)}
+		limiters[key] = kl
+	}
+	kl.limiter.recordAt(now)
+	kl.lastEvent = now
+	return limiters
+}
+
+// sweepRateLimiters removes the rate limiters of keys that have had
+// no events within window, since they are no different from new ones.
+// This keeps memory bounded when many distinct clients or names are
+// seen; it is done at most every rateLimitSweepInterval, so that its
+// cost is amortized over many handshakes.
+func sweepRateLimiters(limiters map[string]*keyedRateLimiter, window time.Duration, now time.Time) {
+	for key, kl := range limiters {
+		if now.Sub(kl.lastEvent) >= window {
+			delete(limiters, key)
+		}
+	}
+}
+
+// remoteIPFromHello returns the IP address of the client, or
+// an empty string if it is not known.
+func remoteIPFromHello(hello *tls.ClientHelloInfo) string {
+	if hello == nil || hello.Conn == nil {
+		return ""
+	}
+	addr := hello.Conn.RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
+
+// rateLimitSweepInterval is how often rate limiters of keys
+// without recent events are discarded.
+const rateLimitSweepInterval = time.Minute
@@ -0,0 +1,99 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOnDemandRateLimit(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	if conn == nil {
+		t.Fatal("failed to create a test connection")
+	}
+	defer conn.Close()
+	hello := &tls.ClientHelloInfo{Conn: conn}
+
+	odrl := &OnDemandRateLimit{
+		PerIP:   SlidingWindowLimit{Events: 2, Window: time.Hour},
+		PerName: SlidingWindowLimit{Events: 1, Window: time.Hour},
+	}
+
+	if _, err := odrl.start(hello, "a.example.com"); err != nil {
+		t.Fatalf("First operation should be allowed: %v", err)
+	}
+	if _, err := odrl.start(hello, "a.example.com"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Fatalf("Second operation for same name should be limited, got: %v", err)
+	}
+	if _, err := odrl.start(hello, "b.example.com"); err != nil {
+		t.Fatalf("Operation for other name should be allowed: %v", err)
+	}
+	if _, err := odrl.start(hello, "c.example.com"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Fatalf("Third operation from same IP should be limited, got: %v", err)
+	}
+	// refused operations must not count against other limits
+	if _, ok := odrl.names["c.example.com"]; ok {
+		t.Errorf("Refused operation counted against per-name limit")
+	}
+}
+
+func TestOnDemandRateLimitSweep(t *testing.T) {
+	odrl := &OnDemandRateLimit{PerName: SlidingWindowLimit{Events: 1, Window: time.Minute}}
+	if _, err := odrl.start(nil, "a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := odrl.start(nil, "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.example.com had its last event more than a window ago
+	odrl.names["a.example.com"].lastEvent = time.Now().Add(-2 * time.Minute)
+	odrl.lastSweep = time.Time{}
+	if _, err := odrl.start(nil, "c.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := odrl.names["a.example.com"]; ok {
+		t.Error("Expected rate limiter without recent events to be removed")
+	}
+	if _, ok := odrl.names["b.example.com"]; !ok {
+		t.Error("Expected rate limiter with recent events to be kept")
+	}
+}
+
+func TestOnDemandRateLimitMaxPending(t *testing.T) {
+	odrl := &OnDemandRateLimit{MaxPending: 1}
+
+	done, err := odrl.start(nil, "a.example.com")
+	if err != nil {
+		t.Fatalf("First operation should be allowed: %v", err)
+	}
+	if _, err := odrl.start(nil, "b.example.com"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Fatalf("Expected limit on pending operations, got: %v", err)
+	}
+	done()
+	done() // must be idempotent
+	if odrl.pending != 0 {
+		t.Fatalf("Expected no pending operations, got %d", odrl.pending)
+	}
+	if _, err := odrl.start(nil, "b.example.com"); err != nil {
+		t.Fatalf("Operation should be allowed after previous one finished: %v", err)
+	}
+}
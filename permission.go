@@ -0,0 +1,186 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrPermissionDenied is returned (wrapped) when a permission
+// endpoint denies a certificate for a name.
+var ErrPermissionDenied = errors.New("certificate not allowed by permission endpoint")
+
+// OnDemandPermission decides whether a certificate may be obtained
+// or renewed on demand for a name (see OnDemandConfig.Permission).
+// HTTPPermission asks an HTTP endpoint; other backends can be plugged
+// in by implementing this interface.
+//
+// EXPERIMENTAL: Subject to change.
+type OnDemandPermission interface {
+	// CertificateAllowed returns nil if a certificate
+	// is allowed for name, or an error if it is not.
+	CertificateAllowed(ctx context.Context, name string) error
+}
+
+// HTTPPermission asks an HTTP endpoint whether a certificate may be
+// obtained for a name. A GET request is made to Endpoint with the name
+// in the "domain" query string parameter; a 2xx response allows the
+// certificate, and a 4xx response denies it. Answers are cached so
+// that repeated handshakes for the same name do not each make an HTTP
+// request.
+//
+// Network errors, timeouts and other status codes, like 5xx, are not
+// answers: they are not cached, and are retried up to Retries times
+// before the certificate is denied.
+//
+// EXPERIMENTAL: Subject to change.
+type HTTPPermission struct {
+	// The URL of the permission endpoint. REQUIRED.
+	Endpoint string
+
+	// How long to wait for each request. Default: 10s.
+	Timeout time.Duration
+
+	// How many times to retry a request that failed
+	// with a network error. Default: 0.
+	Retries int
+
+	// How long to remember that a name was allowed
+	// or denied. 0 disables caching of that answer.
+	AllowCacheTTL time.Duration
+	DenyCacheTTL  time.Duration
+
+	// The HTTP client to use. Default: a client
+	// with the configured Timeout.
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	answers map[string]permissionAnswer
+}
+
+type permissionAnswer struct {
+	err     error // nil if allowed
+	expires time.Time
+}
+
+// CertificateAllowed implements OnDemandPermission.
+func (hp *HTTPPermission) CertificateAllowed(ctx context.Context, name string) error {
+	now := time.Now()
+
+	hp.mu.Lock()
+	if answer, ok := hp.answers[name]; ok {
+		if now.Before(answer.expires) {
+			hp.mu.Unlock()
+			return answer.err
+		}
+		delete(hp.answers, name)
+	}
+	hp.mu.Unlock()
+
+	var err error
+	var answered bool
+	for attempt := 0; attempt <= hp.Retries; attempt++ {
+		answered, err = hp.ask(ctx, name)
+		if answered || ctx.Err() != nil {
+			break
+		}
+	}
+	if !answered {
+		return fmt.Errorf("asking permission endpoint: %w", err)
+	}
+
+	ttl := hp.AllowCacheTTL
+	if err != nil {
+		ttl = hp.DenyCacheTTL
+	}
+	if ttl > 0 {
+		hp.mu.Lock()
+		if hp.answers == nil {
+			hp.answers = make(map[string]permissionAnswer)
+		}
+		if len(hp.answers) >= maxCachedPermissionAnswers {
+			for key, answer := range hp.answers {
+				if now.After(answer.expires) {
+					delete(hp.answers, key)
+				}
+			}
+		}
+		if len(hp.answers) < maxCachedPermissionAnswers {
+			hp.answers[name] = permissionAnswer{err: err, expires: now.Add(ttl)}
+		}
+		hp.mu.Unlock()
+	}
+
+	return err
+}
+
+// ask makes a single request to the permission endpoint. It returns
+// true if the endpoint gave an answer, in which case the error is
+// the answer; otherwise the error is why no answer was obtained.
+func (hp *HTTPPermission) ask(ctx context.Context, name string) (bool, error) {
+	if hp.Endpoint == "" {
+		return false, fmt.Errorf("no permission endpoint configured")
+	}
+	askURL, err := url.Parse(hp.Endpoint)
+	if err != nil {
+		return false, fmt.Errorf("parsing permission endpoint: %v", err)
+	}
+	qs := askURL.Query()
+	qs.Set("domain", name)
+	askURL.RawQuery = qs.Encode()
+
+	timeout := hp.Timeout
+	if timeout <= 0 {
+		timeout = defaultPermissionTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, askURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", buildUAString())
+
+	resp, err := httpClientFor(ctx, hp.HTTPClient, timeout).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return true, nil
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499:
+		return true, fmt.Errorf("%w: %s: %s returned HTTP %d", ErrPermissionDenied, name, hp.Endpoint, resp.StatusCode)
+	}
+	return false, fmt.Errorf("%s returned HTTP %d", hp.Endpoint, resp.StatusCode)
+}
+
+const (
+	defaultPermissionTimeout   = 10 * time.Second
+	maxCachedPermissionAnswers = 10000
+)
+
+// Interface guard
+var _ OnDemandPermission = (*HTTPPermission)(nil)
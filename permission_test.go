@@ -0,0 +1,98 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPPermission(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("domain") != "allowed.example.com" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	hp := &HTTPPermission{
+		Endpoint:      srv.URL + "/ask",
+		AllowCacheTTL: time.Hour,
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := hp.CertificateAllowed(ctx, "allowed.example.com"); err != nil {
+			t.Fatalf("Expected name to be allowed, got: %v", err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected allow answer to be cached (1 request), got %d requests", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := hp.CertificateAllowed(ctx, "denied.example.com"); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("Expected name to be denied, got: %v", err)
+		}
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("Expected deny answer not to be cached (3 requests), got %d requests", n)
+	}
+}
+
+func TestHTTPPermissionUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	endpoint := srv.URL
+	srv.Close()
+
+	hp := &HTTPPermission{Endpoint: endpoint, Retries: 1, DenyCacheTTL: time.Hour}
+	err := hp.CertificateAllowed(context.Background(), "example.com")
+	if err == nil || errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected network error, got: %v", err)
+	}
+	if len(hp.answers) != 0 {
+		t.Error("Network errors should not be cached")
+	}
+}
+
+func TestHTTPPermissionServerError(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	hp := &HTTPPermission{Endpoint: srv.URL, Retries: 1, DenyCacheTTL: time.Hour}
+	err := hp.CertificateAllowed(ctx, "example.com")
+	if err == nil || errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Expected server error, got: %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected server error to be retried (2 requests), got %d requests", n)
+	}
+	if err := hp.CertificateAllowed(ctx, "example.com"); err != nil {
+		t.Errorf("Expected server error not to be cached as a denial, got: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"go.uber.org/zap"
+)
+
+// SPKIPin returns the pin of a public key: the base64 encoding of the
+// SHA-256 hash of its DER-encoded SubjectPublicKeyInfo, as used by HPKP
+// (RFC 7469) and by pin lists of mobile apps.
+//
+// EXPERIMENTAL: Subject to change.
+func SPKIPin(pub crypto.PublicKey) (string, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("encoding public key: %v", err)
+	}
+	sum := sha256.Sum256(spki)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// CertificatePins are the SPKI pins (see SPKIPin) of the key of a
+// managed certificate and of the key of the certificate that will
+// replace it.
+//
+// EXPERIMENTAL: Subject to change.
+type CertificatePins struct {
+	// The names of the certificate.
+	Names []string `json:"names"`
+
+	// The pin of the key of the current certificate.
+	Current string `json:"current"`
+
+	// The pin of the key that the next certificate will
+	// have, to publish as a backup pin. Only with NextKeys
+	// or KeyRotation.
+	Next string `json:"next,omitempty"`
+}
+
+// Pins returns the pins of the managed certificate for name in storage.
+// Pins are also emitted with the cert_pins event after a certificate is
+// obtained or renewed, so that published pins can be kept up to date.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Pins(ctx context.Context, name string) (CertificatePins, error) {
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+	if err != nil {
+		return CertificatePins{}, err
+	}
+	return cfg.pins(ctx, name, certRes)
+}
+
+func (cfg *Config) pins(ctx context.Context, name string, certRes CertificateResource) (CertificatePins, error) {
+	chain, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		return CertificatePins{}, err
+	}
+	pins := CertificatePins{Names: certRes.SANs}
+	if pins.Current, err = SPKIPin(chain[0].PublicKey); err != nil {
+		return CertificatePins{}, err
+	}
+	if !cfg.nextKeys() {
+		return pins, nil
+	}
+	nextKey, err := cfg.loadNextKey(ctx, name)
+	if err != nil {
+		return CertificatePins{}, err
+	}
+	if signer, ok := nextKey.(crypto.Signer); ok {
+		if pins.Next, err = SPKIPin(signer.Public()); err != nil {
+			return CertificatePins{}, err
+		}
+	}
+	return pins, nil
+}
+
+// newPrivateKey returns the private key for a new certificate for name:
+// with NextKeys or KeyRotation, the key that was generated ahead of time,
+// if there is one; otherwise a new key from the KeySource.
+func (cfg *Config) newPrivateKey(ctx context.Context, name string) (crypto.PrivateKey, error) {
+	if cfg.nextKeys() {
+		key, err := cfg.loadNextKey(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return key, nil
+		}
+	}
+	return cfg.KeySource.GenerateKey()
+}
+
+// loadNextKey loads the next private key for name, or returns nil
+// if there is none.
+func (cfg *Config) loadNextKey(ctx context.Context, name string) (crypto.PrivateKey, error) {
+	keyPEM, err := cfg.Storage.Load(ctx, StorageKeys.NextPrivateKey(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading next private key: %v", err)
+	}
+	keyPEM, err = cfg.decryptKeyPEM(ctx, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return PEMDecodePrivateKey(keyPEM)
+}
+
+// certificateIssued prepares the next private key for the certificate
+// for name that was just issued, if next keys are generated ahead of
+// time and the certificate has the current next key (or there is none),
+// and emits its pins. If a certificate was obtained (not renewed), the
+// TLSA records are published again with the new next key, if that is
+// enabled; after renewals, retireTLSA does that. Errors are only logged,
+// since the certificate was issued.
+func (cfg *Config) certificateIssued(ctx context.Context, log *zap.Logger, name string, certRes CertificateResource, renewal bool) {
+	if cfg.nextKeys() {
+		replaced, err := cfg.replaceNextKey(ctx, name, certRes)
+		if err != nil {
+			log.Error("preparing next private key",
+				zap.Strings("identifiers", certRes.SANs),
+				zap.Error(err))
+		}
+		if replaced && !renewal && cfg.publishesNextKey() {
+			if err := cfg.publishTLSA(ctx, certRes.SANs, certRes.CertificatePEM); err != nil {
+				log.Error("publishing TLSA records for next key",
+					zap.Strings("identifiers", certRes.SANs),
+					zap.Error(err))
+			}
+		}
+	}
+
+	pins, err := cfg.pins(ctx, name, certRes)
+	if err != nil {
+		log.Error("computing certificate pins",
+			zap.Strings("identifiers", certRes.SANs),
+			zap.Error(err))
+		return
+	}
+	data := map[string]any{
+		"identifiers": pins.Names,
+		"current":     pins.Current,
+	}
+	if pins.Next != "" {
+		data["next"] = pins.Next
+	}
+	cfg.emit(ctx, "cert_pins", data)
+}
+
+// replaceNextKey generates and stores the next private key for name,
+// unless the stored one is still unused: that is, if there is none, or
+// if it is the key of the certificate in certRes. It reports whether
+// it replaced the key.
+func (cfg *Config) replaceNextKey(ctx context.Context, name string, certRes CertificateResource) (bool, error) {
+	current, err := cfg.loadNextKey(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if current != nil {
+		chain, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+		if err != nil {
+			return false, err
+		}
+		if signer, ok := current.(crypto.Signer); ok && !publicKeysEqual(signer.Public(), chain[0].PublicKey) {
+			return false, nil
+		}
+	}
+
+	key, err := cfg.KeySource.GenerateKey()
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err = cfg.encryptKeyPEM(ctx, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	if err := cfg.Storage.Store(ctx, StorageKeys.NextPrivateKey(name), keyPEM); err != nil {
+		cfg.emitStorageError(ctx, "store", []string{name}, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// publicKeysEqual reports whether a and b are the same public key.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	if eq, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return eq.Equal(b)
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSPKIPin(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(spki)
+	pin, err := SPKIPin(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := base64.StdEncoding.EncodeToString(sum[:]); pin != expect {
+		t.Errorf("Expected %s, got %s", expect, pin)
+	}
+}
+
+func TestNextKeyPins(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	var events []map[string]any
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		NextKeys:  true,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "cert_pins" {
+				events = append(events, data)
+			}
+			return nil
+		},
+	})
+	ctx := context.Background()
+	const name = "example.com"
+
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	first, err := cfg.Pins(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Current == "" || first.Next == "" || first.Current == first.Next {
+		t.Fatalf("Expected distinct current and next pins, got %+v", first)
+	}
+	if len(events) != 1 || events[0]["current"] != first.Current || events[0]["next"] != first.Next {
+		t.Errorf("Expected cert_pins event with the pins, got %v", events)
+	}
+
+	// the renewed certificate has the key that was pinned as the next one
+	if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+		t.Fatal(err)
+	}
+	second, err := cfg.Pins(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Current != first.Next {
+		t.Errorf("Expected renewed certificate to use the next key %s, got %s", first.Next, second.Current)
+	}
+	if second.Next == "" || second.Next == first.Next {
+		t.Errorf("Expected a new next key after renewal, got %+v", second)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"unicode/utf16"
+)
+
+// EncodePKCS12 encodes the private key and certificate chain (leaf
+// first) as a PKCS#12 (PFX) file protected by password, which is what
+// Windows, many appliances, and Java (as keystore type PKCS12) import.
+// The key is encrypted with PBES2 (PBKDF2 with HMAC-SHA256 and
+// AES-256-CBC) and the file is authenticated with HMAC-SHA256, like
+// OpenSSL 3 does by default; the certificates are not encrypted.
+// The key and leaf certificate have the friendly name alias, if any,
+// which Java uses as the alias of the entry.
+//
+// EXPERIMENTAL: Subject to change.
+func EncodePKCS12(key crypto.PrivateKey, chain []*x509.Certificate, alias, password string) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key and its certificate are linked by the key ID
+	keyID := sha256.Sum256(chain[0].Raw)
+	attrs := []pkcs12Attribute{{ID: oidLocalKeyID, Value: setOf(mustMarshal(keyID[:20]))}}
+	if alias != "" {
+		attrs = append(attrs, pkcs12Attribute{ID: oidFriendlyName, Value: setOf(bmpString(alias))})
+	}
+
+	var certBags []safeBag
+	for i, cert := range chain {
+		bag := safeBag{
+			ID: oidCertBag,
+			Value: explicit0(mustMarshal(pkcs12CertBag{
+				ID:   oidX509Certificate,
+				Data: explicit0(mustMarshal(cert.Raw)),
+			})),
+		}
+		if i == 0 {
+			bag.Attributes = attrs
+		}
+		certBags = append(certBags, bag)
+	}
+
+	algo, encrypted, err := pbes2Encrypt(pkcs8, password, pkcs12Iterations)
+	if err != nil {
+		return nil, err
+	}
+	keyBag := safeBag{
+		ID: oidPKCS8ShroudedKeyBag,
+		Value: explicit0(mustMarshal(encryptedPrivateKeyInfo{
+			Algorithm: algo,
+			Data:      encrypted,
+		})),
+		Attributes: attrs,
+	}
+
+	certContents, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, err
+	}
+	keyContents, err := asn1.Marshal([]safeBag{keyBag})
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := asn1.Marshal([]pkcs12ContentInfo{
+		{ContentType: oidDataContentType, Content: explicit0(mustMarshal(certContents))},
+		{ContentType: oidDataContentType, Content: explicit0(mustMarshal(keyContents))},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 16)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(bmpPassword(password), macSalt, pkcs12Iterations, 3, sha256.Size)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(authSafe)
+
+	return asn1.Marshal(pfxPDU{
+		Version:  3,
+		AuthSafe: pkcs12ContentInfo{ContentType: oidDataContentType, Content: explicit0(mustMarshal(authSafe))},
+		MacData: pkcs12MacData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// pbes2Encrypt encrypts data with PBES2 (RFC 8018) using PBKDF2 with
+// HMAC-SHA256 and AES-256-CBC, and returns the algorithm identifier.
+func pbes2Encrypt(data []byte, password string, iterations int) (pkix.AlgorithmIdentifier, []byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	encrypted := make([]byte, len(data)+padding)
+	copy(encrypted, data)
+	for i := len(data); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	params, err := asn1.Marshal(pbes2Params{
+		KDF: pkix.AlgorithmIdentifier{
+			Algorithm: oidPBKDF2,
+			Parameters: asn1.RawValue{FullBytes: mustMarshal(pbkdf2Params{
+				Salt:       salt,
+				Iterations: iterations,
+				KeyLength:  32,
+				PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+			})},
+		},
+		Encryption: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: mustMarshal(iv)},
+		},
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}}, encrypted, nil
+}
+
+// pbes2Decrypt decrypts data that was encrypted with PBES2 using PBKDF2
+// with HMAC-SHA1 or HMAC-SHA256 and AES-CBC, like pbes2Encrypt and
+// OpenSSL do.
+func pbes2Decrypt(algo pkix.AlgorithmIdentifier, data []byte, password string) ([]byte, error) {
+	if !algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption algorithm: %s", algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(algo.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("decoding PBES2 parameters: %v", err)
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", params.KDF.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, fmt.Errorf("decoding PBKDF2 parameters: %v", err)
+	}
+	var keySize int
+	switch {
+	case params.Encryption.Algorithm.Equal(oidAES128CBC):
+		keySize = 16
+	case params.Encryption.Algorithm.Equal(oidAES192CBC):
+		keySize = 24
+	case params.Encryption.Algorithm.Equal(oidAES256CBC):
+		keySize = 32
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %s", params.Encryption.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Encryption.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV")
+	}
+
+	var key []byte
+	var err error
+	switch prf := kdfParams.PRF.Algorithm; {
+	case len(prf) == 0, prf.Equal(oidHMACWithSHA1):
+		key, err = pbkdf2.Key(sha1.New, password, kdfParams.Salt, kdfParams.Iterations, keySize)
+	case prf.Equal(oidHMACWithSHA256):
+		key, err = pbkdf2.Key(sha256.New, password, kdfParams.Salt, kdfParams.Iterations, keySize)
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 function: %s", prf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// a wrong password most likely results in invalid padding
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errIncorrectPassword
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, errIncorrectPassword
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+var errIncorrectPassword = errors.New("incorrect password")
+
+// pkcs12KDF derives a key of length size from the BMP-encoded password
+// and salt, as specified in RFC 7292 appendix B.2, with SHA-256. The
+// id is 1 for encryption keys, 2 for IVs, and 3 for MAC keys.
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha256.Size, sha256.BlockSize
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	I := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		h := sha256.New()
+		h.Write(D)
+		h.Write(I)
+		A := h.Sum(nil)
+		for range iterations - 1 {
+			sum := sha256.Sum256(A)
+			A = sum[:]
+		}
+		out = append(out, A...)
+		if len(out) >= size {
+			break
+		}
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for every block of I
+		B := new(big.Int).SetBytes(fill(A[:u]))
+		B.Add(B, big.NewInt(1))
+		mod := new(big.Int).Lsh(big.NewInt(1), v*8)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, B).Mod(Ij, mod)
+			Ij.FillBytes(I[j : j+v])
+		}
+	}
+	return out[:size]
+}
+
+// bmpPassword encodes password as a null-terminated BMPString, as
+// PKCS#12 key derivation requires.
+func bmpPassword(password string) []byte {
+	return append(utf16BE(password), 0, 0)
+}
+
+// bmpString returns the DER encoding of s as a BMPString.
+func bmpString(s string) []byte {
+	return mustMarshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: utf16BE(s)})
+}
+
+func utf16BE(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+// explicit0 wraps the DER encoding der in an explicit [0] tag.
+func explicit0(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// setOf returns a SET of the DER encoding der.
+func setOf(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der}
+}
+
+// mustMarshal marshals values that can always be marshaled.
+func mustMarshal(val any) []byte {
+	der, err := asn1.Marshal(val)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12MacData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data asn1.RawValue
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KDF        pkix.AlgorithmIdentifier
+	Encryption pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// pkcs12Iterations is the iteration count of key derivation, which
+// is the default of OpenSSL.
+const pkcs12Iterations = 2048
+
+var (
+	oidDataContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1        = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
@@ -0,0 +1,353 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// PreflightStatus is the outcome of a preflight check.
+//
+// EXPERIMENTAL: Subject to change.
+type PreflightStatus string
+
+// Outcomes of preflight checks.
+const (
+	PreflightOK      PreflightStatus = "ok"
+	PreflightWarning PreflightStatus = "warning"
+	PreflightFailed  PreflightStatus = "failed"
+	PreflightSkipped PreflightStatus = "skipped"
+)
+
+// PreflightCheck is the result of one check of Config.Preflight.
+//
+// EXPERIMENTAL: Subject to change.
+type PreflightCheck struct {
+	// What was checked: "storage", "names", "ca_reachability",
+	// "account", "dns_credentials", "http_port", or
+	// "tls_alpn_port".
+	Check string `json:"check"`
+
+	// What it was checked for, like the issuer key,
+	// the DNS zone, or the address to listen on.
+	Subject string `json:"subject,omitempty"`
+
+	Status PreflightStatus `json:"status"`
+
+	// Why the check did not pass, or was skipped.
+	Message string `json:"message,omitempty"`
+
+	// The error, if the check failed.
+	Err error `json:"-"`
+}
+
+// PreflightReport is the result of Config.Preflight.
+//
+// EXPERIMENTAL: Subject to change.
+type PreflightReport struct {
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// Err returns the errors of the checks that failed, if any.
+// Warnings are not errors.
+func (r PreflightReport) Err() error {
+	var errs []error
+	for _, check := range r.Checks {
+		if check.Status == PreflightFailed {
+			errs = append(errs, fmt.Errorf("%s %s: %w", check.Check, check.Subject, check.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *PreflightReport) add(check PreflightCheck) {
+	if check.Err != nil {
+		if check.Status == "" {
+			check.Status = PreflightFailed
+		}
+		if check.Message == "" {
+			check.Message = check.Err.Error()
+		}
+	}
+	if check.Status == "" {
+		check.Status = PreflightOK
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Preflight checks that certificates for names can likely be obtained
+// and renewed with cfg, without obtaining any: that storage can be
+// written, read and locked; that the issuers would accept the names;
+// and, for ACME issuers, that the CA is reachable, the account is
+// valid, the DNS provider accepts its credentials, and the challenge
+// ports can be listened on. Call it at startup to fail fast on bad
+// configuration, rather than at the first renewal.
+//
+// Checks that can't be done without side effects, like those of DNS
+// providers that can't list records, are skipped. Use the Err method
+// of the report to get the failures as an error.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Preflight(ctx context.Context, names []string) PreflightReport {
+	cfg = cfg.current()
+	ctx = withConfig(ctx, cfg)
+
+	var report PreflightReport
+	report.add(cfg.preflightStorage(ctx))
+
+	for _, issuer := range cfg.Issuers {
+		if prechecker, ok := issuer.(PreChecker); ok && len(names) > 0 {
+			report.add(PreflightCheck{
+				Check:   "names",
+				Subject: issuer.IssuerKey(),
+				Err:     prechecker.PreCheck(ctx, names, false),
+			})
+		}
+		if am, ok := issuer.(*ACMEIssuer); ok {
+			am.preflight(ctx, names, &report)
+		}
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == PreflightFailed || check.Status == PreflightWarning {
+			cfg.Logger.Warn("preflight check did not pass",
+				zap.String("check", check.Check),
+				zap.String("subject", check.Subject),
+				zap.String("status", string(check.Status)),
+				zap.String("message", check.Message))
+		}
+	}
+	return report
+}
+
+// preflightStorage checks that a value can be stored, loaded and
+// deleted, and that a lock can be acquired and released.
+func (cfg *Config) preflightStorage(ctx context.Context) PreflightCheck {
+	check := PreflightCheck{Check: "storage", Subject: fmt.Sprintf("%T", cfg.Storage)}
+	if stringer, ok := cfg.Storage.(fmt.Stringer); ok {
+		check.Subject = stringer.String()
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		check.Err = err
+		return check
+	}
+	name := "preflight_" + hex.EncodeToString(id[:])
+	key := path.Join(prefixPreflight, name)
+	value := []byte("certmagic preflight " + time.Now().UTC().Format(time.RFC3339))
+
+	if err := cfg.Storage.Store(ctx, key, value); err != nil {
+		check.Err = fmt.Errorf("storing: %w", err)
+		return check
+	}
+	loaded, err := cfg.Storage.Load(ctx, key)
+	if err != nil {
+		check.Err = fmt.Errorf("loading: %w", err)
+		return check
+	}
+	if !bytes.Equal(loaded, value) {
+		check.Err = fmt.Errorf("loaded value differs from stored value")
+		return check
+	}
+	if err := cfg.Storage.Delete(ctx, key); err != nil {
+		check.Err = fmt.Errorf("deleting: %w", err)
+		return check
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	if err := cfg.Storage.Lock(lockCtx, name); err != nil {
+		check.Err = fmt.Errorf("locking: %w", err)
+		return check
+	}
+	if err := cfg.Storage.Unlock(ctx, name); err != nil {
+		check.Err = fmt.Errorf("unlocking: %w", err)
+	}
+	return check
+}
+
+// preflight adds the checks of the ACME issuer to report.
+func (am *ACMEIssuer) preflight(ctx context.Context, names []string, report *PreflightReport) {
+	issuerKey := am.IssuerKey()
+
+	reachCtx, cancel := context.WithTimeout(ctx, 2*reachabilityTimeout)
+	err := am.CheckReachability(reachCtx)
+	cancel()
+	report.add(PreflightCheck{Check: "ca_reachability", Subject: am.CA, Err: err})
+	if err != nil {
+		report.add(PreflightCheck{
+			Check:   "account",
+			Subject: issuerKey,
+			Status:  PreflightSkipped,
+			Message: "CA is not reachable",
+		})
+	} else {
+		report.add(am.preflightAccount(ctx))
+	}
+
+	if am.DNS01Solver != nil {
+		for _, check := range am.preflightDNSCredentials(ctx, names) {
+			report.add(check)
+		}
+	}
+	if am.DNS01Solver == nil || (am.ChallengePolicy != nil && am.ChallengePolicy.enablesNonDNSChallenges()) {
+		if !am.DisableHTTPChallenge && am.HTTP01Solver == nil {
+			report.add(preflightListen("http_port", net.JoinHostPort(am.ListenHost, strconv.Itoa(am.getHTTPPort()))))
+		}
+		if !am.DisableTLSALPNChallenge {
+			report.add(preflightListen("tls_alpn_port", net.JoinHostPort(am.ListenHost, strconv.Itoa(am.getTLSALPNPort()))))
+		}
+	}
+}
+
+// preflightAccount checks that the account of am is valid with the CA.
+// It does not register an account if there isn't one yet.
+func (am *ACMEIssuer) preflightAccount(ctx context.Context) PreflightCheck {
+	check := PreflightCheck{Check: "account", Subject: am.IssuerKey()}
+	client, err := am.newACMEClient(false)
+	if err != nil {
+		check.Err = err
+		return check
+	}
+
+	var account acme.Account
+	if am.AccountKeyPEM != "" {
+		account.PrivateKey, err = PEMDecodePrivateKey([]byte(am.AccountKeyPEM))
+	} else {
+		account, err = am.loadAccount(ctx, am.CA, am.getEmail())
+		if errors.Is(err, fs.ErrNotExist) {
+			check.Status = PreflightWarning
+			check.Message = "no account yet; one will be registered with the first certificate"
+			return check
+		}
+	}
+	if err != nil {
+		check.Err = fmt.Errorf("loading account: %w", err)
+		return check
+	}
+
+	account, err = client.GetAccount(ctx, account)
+	if err != nil {
+		check.Err = fmt.Errorf("looking up account with CA: %w", err)
+		return check
+	}
+	if account.Status != acme.StatusValid {
+		check.Err = fmt.Errorf("account %s is %s", account.Location, account.Status)
+	}
+	return check
+}
+
+// preflightDNSCredentials checks, for the zone of each name, that
+// the DNS provider of the DNS solver of am accepts its credentials,
+// by listing the records of the zone.
+func (am *ACMEIssuer) preflightDNSCredentials(ctx context.Context, names []string) []PreflightCheck {
+	solver, ok := am.DNS01Solver.(*DNS01Solver)
+	if !ok {
+		return []PreflightCheck{{
+			Check:   "dns_credentials",
+			Subject: am.IssuerKey(),
+			Status:  PreflightSkipped,
+			Message: fmt.Sprintf("unknown DNS solver %T", am.DNS01Solver),
+		}}
+	}
+	getter, ok := solver.DNSProvider.(libdns.RecordGetter)
+	if !ok {
+		return []PreflightCheck{{
+			Check:   "dns_credentials",
+			Subject: am.IssuerKey(),
+			Status:  PreflightSkipped,
+			Message: "DNS provider can't list records, so it can't be checked without changing them",
+		}}
+	}
+
+	var checks []PreflightCheck
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if SubjectIsIP(name) {
+			continue
+		}
+		dnsName := "_acme-challenge." + strings.TrimPrefix(name, "*.")
+		if solver.OverrideDomain != "" {
+			dnsName = solver.OverrideDomain
+		}
+		zone, err := FindZoneByFQDN(ctx, solver.logger(), dnsName, RecursiveNameservers(solver.Resolvers))
+		if err != nil {
+			checks = append(checks, PreflightCheck{
+				Check:   "dns_credentials",
+				Subject: dnsName,
+				Err:     fmt.Errorf("could not determine zone: %w", err),
+			})
+			continue
+		}
+		if seen[zone] {
+			continue
+		}
+		seen[zone] = true
+		zoneCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+		_, err = getter.GetRecords(zoneCtx, zone)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("listing records: %w", err)
+		}
+		checks = append(checks, PreflightCheck{Check: "dns_credentials", Subject: zone, Err: err})
+	}
+	return checks
+}
+
+// preflightListen checks that addr can be listened on for solving
+// challenges. If it can't, that is only a warning, since a server of
+// this process may be listening on it and solve them.
+func preflightListen(checkName, addr string) PreflightCheck {
+	check := PreflightCheck{Check: checkName, Subject: addr}
+
+	solversMu.Lock()
+	si, ok := solvers[addr]
+	serving := ok && si.listener != nil
+	solversMu.Unlock()
+	if serving {
+		return check
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		check.Status = PreflightWarning
+		check.Message = fmt.Sprintf("%v; challenges can only be solved if a server of this process is listening on it and uses the challenge handlers", err)
+		return check
+	}
+	ln.Close()
+	return check
+}
+
+// preflightTimeout is how long each preflight
+// check that could hang may take.
+const preflightTimeout = 30 * time.Second
+
+const prefixPreflight = "preflight"
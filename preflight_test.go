@@ -0,0 +1,87 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// the TLS-ALPN port is taken by someone else
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cfg := &Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger}
+	cfg.Issuers = []Issuer{NewACMEIssuer(cfg, ACMEIssuer{
+		CA:             srv.URL,
+		HTTPProxy:      NoProxy,
+		ListenHost:     "127.0.0.1",
+		AltHTTPPort:    freePort(t),
+		AltTLSALPNPort: taken.Addr().(*net.TCPAddr).Port,
+	})}
+
+	report := cfg.Preflight(context.Background(), []string{"example.com"})
+	if err := report.Err(); err != nil {
+		t.Fatalf("Expected no failures, got %v", err)
+	}
+	expected := map[string]PreflightStatus{
+		"storage":         PreflightOK,
+		"names":           PreflightOK,
+		"ca_reachability": PreflightOK,
+		"account":         PreflightWarning, // none registered yet
+		"http_port":       PreflightOK,
+		"tls_alpn_port":   PreflightWarning,
+	}
+	for _, check := range report.Checks {
+		if check.Status != expected[check.Check] {
+			t.Errorf("Expected %s check to be %s, got %s (%s)", check.Check, expected[check.Check], check.Status, check.Message)
+		}
+		delete(expected, check.Check)
+	}
+	if len(expected) > 0 {
+		t.Errorf("Missing checks: %v", expected)
+	}
+
+	// an unreachable CA fails, and the account can't be checked
+	srv.Close()
+	report = cfg.Preflight(context.Background(), nil)
+	if report.Err() == nil {
+		t.Fatal("Expected unreachable CA to fail preflight")
+	}
+	for _, check := range report.Checks {
+		if check.Check == "account" && check.Status != PreflightSkipped {
+			t.Errorf("Expected account check to be skipped, got %s", check.Status)
+		}
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
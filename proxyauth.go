@@ -0,0 +1,364 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyAuthenticator authenticates to an HTTP proxy that requires
+// authentication for CONNECT requests, as enterprise egress proxies
+// often do. Unlike the credentials in a proxy URL, which only
+// support Basic authentication, a ProxyAuthenticator can carry out
+// connection-oriented, multi-leg schemes like NTLM and Negotiate
+// (SPNEGO/Kerberos): all legs happen on the same connection, which
+// is then used for the tunnel.
+//
+// EXPERIMENTAL: Subject to change.
+type ProxyAuthenticator interface {
+	// ProxyAuthorization returns the value of the Proxy-Authorization
+	// header to send with a CONNECT request to proxy. For the first
+	// request on a connection, challenges is nil; after that, it has
+	// the Proxy-Authenticate header values of the proxy's previous
+	// 407 response. Returning an empty string sends no credentials,
+	// or gives up if the proxy already asked for some.
+	ProxyAuthorization(ctx context.Context, proxy *url.URL, challenges []string) (string, error)
+}
+
+// BasicProxyAuth implements HTTP Basic authentication to proxies.
+//
+// EXPERIMENTAL: Subject to change.
+type BasicProxyAuth struct {
+	// The credentials. If Username is empty, the
+	// credentials in the proxy URL are used.
+	Username, Password string
+}
+
+// ProxyAuthorization implements ProxyAuthenticator. Credentials are
+// sent preemptively, to save a round trip.
+func (ba BasicProxyAuth) ProxyAuthorization(_ context.Context, proxy *url.URL, challenges []string) (string, error) {
+	if challenges != nil {
+		return "", nil // credentials were rejected; no point in sending them again
+	}
+	username, password := ba.Username, ba.Password
+	if username == "" && proxy.User != nil {
+		username = proxy.User.Username()
+		password, _ = proxy.User.Password()
+	}
+	if username == "" {
+		return "", nil
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+}
+
+// NegotiateProxyAuth implements the Negotiate (SPNEGO) scheme of RFC
+// 4559, which is usually backed by Kerberos. Since obtaining Kerberos
+// tickets is platform-specific (GSSAPI on Unix, SSPI on Windows), the
+// security tokens are obtained from InitSecContext, which can be
+// backed by any GSSAPI implementation.
+//
+// EXPERIMENTAL: Subject to change.
+type NegotiateProxyAuth struct {
+	// The service principal name of the proxy. Default:
+	// "HTTP/" + the proxy's host name.
+	SPN string
+
+	// InitSecContext returns the next SPNEGO token for the
+	// service spn, given the token from the proxy (which
+	// is nil for the initial token). REQUIRED.
+	InitSecContext func(ctx context.Context, spn string, input []byte) ([]byte, error)
+}
+
+// ProxyAuthorization implements ProxyAuthenticator.
+func (na NegotiateProxyAuth) ProxyAuthorization(ctx context.Context, proxy *url.URL, challenges []string) (string, error) {
+	var input []byte
+	if challenges != nil {
+		param, ok := authChallengeParam(challenges, "Negotiate")
+		if !ok || param == "" {
+			return "", nil // proxy doesn't support Negotiate, or rejected our token
+		}
+		var err error
+		input, err = base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			return "", fmt.Errorf("decoding Negotiate challenge: %v", err)
+		}
+	}
+	spn := na.SPN
+	if spn == "" {
+		spn = "HTTP/" + proxy.Hostname()
+	}
+	token, err := na.InitSecContext(ctx, spn, input)
+	if err != nil {
+		return "", fmt.Errorf("initializing security context for %s: %v", spn, err)
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
+}
+
+// authChallengeParam returns the parameter of the challenge for scheme
+// among the values of Proxy-Authenticate (or WWW-Authenticate) headers.
+func authChallengeParam(challenges []string, scheme string) (string, bool) {
+	for _, challenge := range challenges {
+		challengeScheme, param, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		if strings.EqualFold(challengeScheme, scheme) {
+			return strings.TrimSpace(param), true
+		}
+	}
+	return "", false
+}
+
+// proxyConnectDialer dials connections through an HTTP proxy by
+// tunneling with the CONNECT method, authenticating as needed.
+// It is used as an http.Transport's DialContext instead of the
+// transport's own proxy support, which can't do multi-leg
+// authentication.
+type proxyConnectDialer struct {
+	proxy         func(*http.Request) (*url.URL, error)
+	authenticator ProxyAuthenticator
+	dialer        *net.Dialer
+	tlsConfig     *tls.Config // for connecting to HTTPS proxies
+}
+
+func (d proxyConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// the proxy function expects a request, but all we have is the
+	// address; ACME and other CA APIs are HTTPS, except in testing
+	scheme := "https"
+	if _, port, _ := net.SplitHostPort(addr); port == "80" {
+		scheme = "http"
+	}
+	proxyURL, err := d.proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		return d.dialSOCKS5(ctx, network, addr, proxyURL)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("proxy scheme %s is not supported with proxy authentication", proxyURL.Scheme)
+	}
+
+	var conn net.Conn
+	var challenges []string
+	var lastAuth string
+	for round := 0; round < maxProxyAuthRounds; round++ {
+		if conn == nil {
+			conn, err = d.dialProxy(ctx, network, proxyURL)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		auth, err := d.authenticator.ProxyAuthorization(ctx, proxyURL, challenges)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authenticating to proxy %s: %w", proxyURL.Host, err)
+		}
+		if challenges != nil && (auth == "" || auth == lastAuth) {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: authentication failed", proxyURL.Host)
+		}
+		lastAuth = auth
+
+		tunnel, resp, err := proxyConnect(ctx, conn, addr, auth)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %v", proxyURL.Host, err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return tunnel, nil
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", proxyURL.Host, addr, resp.Status)
+		}
+		challenges = resp.Header.Values("Proxy-Authenticate")
+		if challenges == nil {
+			challenges = []string{}
+		}
+		if resp.Close {
+			// connection-oriented schemes can't continue, but others
+			// (e.g. Negotiate with Kerberos) can on a new connection
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return nil, fmt.Errorf("proxy %s: authentication did not complete after %d rounds", proxyURL.Host, maxProxyAuthRounds)
+}
+
+func (d proxyConnectDialer) dialProxy(ctx context.Context, network string, proxyURL *url.URL) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := d.dialer.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy: %w", err)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsCfg := &tls.Config{}
+		if d.tlsConfig != nil {
+			tlsCfg = d.tlsConfig.Clone()
+		}
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = proxyURL.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy: %w", err)
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 dials addr through the SOCKS5 proxy at proxyURL. SOCKS5
+// proxies authenticate with the username and password in proxyURL,
+// if any, rather than with the authenticator.
+func (d proxyConnectDialer) dialSOCKS5(ctx context.Context, network, addr string, proxyURL *url.URL) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxyAddr, auth, d.dialer)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %v", proxyURL.Host, err)
+	}
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxyURL.Host, err)
+	}
+	return conn, nil
+}
+
+// proxyTransport returns a transport for connections through the
+// proxy returned by proxyFunc (or http.ProxyFromEnvironment if nil),
+// which authenticates with authenticator, if not nil.
+func proxyTransport(proxyFunc func(*http.Request) (*url.URL, error), authenticator ProxyAuthenticator) *http.Transport {
+	if proxyFunc == nil {
+		proxyFunc = http.ProxyFromEnvironment
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc
+	if authenticator != nil {
+		// the transport's own proxy support can't authenticate,
+		// so we tunnel through the proxy when dialing instead
+		transport.Proxy = nil
+		transport.DialContext = proxyConnectDialer{
+			proxy:         proxyFunc,
+			authenticator: authenticator,
+			dialer:        &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		}.DialContext
+	}
+	return transport
+}
+
+// NoProxy can be used as an HTTPProxy function to connect
+// directly, even if the environment configures a proxy.
+func NoProxy(*http.Request) (*url.URL, error) { return nil, nil }
+
+// proxiedIssuer is an issuer that connects to its CA through
+// a proxy, which is used for related requests, like OCSP.
+type proxiedIssuer interface {
+	proxy() (func(*http.Request) (*url.URL, error), ProxyAuthenticator)
+}
+
+// proxyConnect sends a CONNECT request for addr over conn and reads the
+// response. If the tunnel was established, it returns the connection to
+// use for it; otherwise the response body has been consumed so that the
+// connection can be used for another request.
+func proxyConnect(ctx context.Context, conn net.Conn, addr, auth string) (net.Conn, *http.Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	req.Header.Set("User-Agent", buildUAString())
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, nil, fmt.Errorf("writing CONNECT request: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024*1024))
+		resp.Body.Close()
+		return nil, resp, nil
+	}
+
+	// the proxy shouldn't send anything else until we do, but
+	// if it did, don't lose what's already been buffered
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, resp, nil
+	}
+	return conn, resp, nil
+}
+
+// bufferedConn is a net.Conn whose reads
+// are served from a buffered reader first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// maxProxyAuthRounds is how many CONNECT requests to make while
+// authenticating to a proxy; NTLM, the chattiest scheme, needs 3.
+const maxProxyAuthRounds = 4
+
+// Interface guards
+var (
+	_ ProxyAuthenticator = BasicProxyAuth{}
+	_ ProxyAuthenticator = NegotiateProxyAuth{}
+)
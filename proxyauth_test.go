@@ -0,0 +1,293 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNTLMv2Response(t *testing.T) {
+	// test vectors from MS-NLMP section 4.2.4
+	mustHex := func(s string) []byte {
+		b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	responseKey := ntowfV2("User", "Password", "Domain")
+	if expected := mustHex("0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(responseKey, expected) {
+		t.Fatalf("Expected NTOWFv2 %x, got %x", expected, responseKey)
+	}
+
+	serverChallenge := mustHex("0123456789abcdef")
+	clientChallenge := mustHex("aaaaaaaaaaaaaaaa")
+	targetInfo := mustHex("02000c0044006f006d00610069006e00 01000c005300650072007600650072000000 0000")
+	ntResponse, lmResponse := ntlmV2Response(responseKey, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	if expected := mustHex("68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(ntResponse[:16], expected) {
+		t.Errorf("Expected NTProofStr %x, got %x", expected, ntResponse[:16])
+	}
+	if expected := mustHex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"); !bytes.Equal(lmResponse, expected) {
+		t.Errorf("Expected LMv2 response %x, got %x", expected, lmResponse)
+	}
+}
+
+func TestProxyConnectDialerNTLM(t *testing.T) {
+	serverChallenge := []byte("chalenge")
+
+	// the proxy requires the NTLM handshake to happen on one connection
+	proxyAddr := startTestConnectProxy(t, func(connReqs int, req *http.Request) (int, http.Header) {
+		param, ok := authChallengeParam([]string{req.Header.Get("Proxy-Authorization")}, "NTLM")
+		if !ok {
+			return http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {"NTLM"}}
+		}
+		msg, _ := base64.StdEncoding.DecodeString(param)
+		switch {
+		case connReqs == 1 && len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 1:
+			return http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {
+				"NTLM " + base64.StdEncoding.EncodeToString(testNTLMChallengeMessage(serverChallenge)),
+			}}
+		case connReqs == 2 && len(msg) >= 64 && binary.LittleEndian.Uint32(msg[8:]) == 3:
+			user, err := ntlmPayload(msg, 36)
+			if err == nil && bytes.Equal(user, utf16LE("alice")) {
+				return http.StatusOK, nil
+			}
+		}
+		return http.StatusForbidden, nil
+	})
+
+	dialer := proxyConnectDialer{
+		proxy:         http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+		authenticator: NTLMProxyAuth{Domain: "CORP", Username: "alice", Password: "secret"},
+		dialer:        &net.Dialer{Timeout: 5 * time.Second},
+	}
+	testTunnel(t, dialer, true)
+}
+
+func TestProxyConnectDialerBasic(t *testing.T) {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:hunter2"))
+	proxyAddr := startTestConnectProxy(t, func(_ int, req *http.Request) (int, http.Header) {
+		if req.Header.Get("Proxy-Authorization") != expected {
+			return http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}}
+		}
+		return http.StatusOK, nil
+	})
+
+	// credentials may come from the proxy URL...
+	testTunnel(t, proxyConnectDialer{
+		proxy:         http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr, User: url.UserPassword("bob", "hunter2")}),
+		authenticator: BasicProxyAuth{},
+		dialer:        &net.Dialer{Timeout: 5 * time.Second},
+	}, true)
+
+	// ...and wrong ones fail without looping
+	testTunnel(t, proxyConnectDialer{
+		proxy:         http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+		authenticator: BasicProxyAuth{Username: "bob", Password: "wrong"},
+		dialer:        &net.Dialer{Timeout: 5 * time.Second},
+	}, false)
+}
+
+func TestProxyConnectDialerSOCKS5(t *testing.T) {
+	proxyAddr := startTestSOCKS5Proxy(t, "bob", "hunter2")
+
+	// SOCKS5 proxies authenticate with the credentials in the URL
+	testTunnel(t, proxyConnectDialer{
+		proxy:         http.ProxyURL(&url.URL{Scheme: "socks5", Host: proxyAddr, User: url.UserPassword("bob", "hunter2")}),
+		authenticator: BasicProxyAuth{},
+		dialer:        &net.Dialer{Timeout: 5 * time.Second},
+	}, true)
+	testTunnel(t, proxyConnectDialer{
+		proxy:         http.ProxyURL(&url.URL{Scheme: "socks5", Host: proxyAddr, User: url.UserPassword("bob", "wrong")}),
+		authenticator: BasicProxyAuth{},
+		dialer:        &net.Dialer{Timeout: 5 * time.Second},
+	}, false)
+}
+
+func TestOCSPConfigUsesIssuerProxy(t *testing.T) {
+	proxyURL := &url.URL{Scheme: "socks5", Host: "proxy.example.com:1080"}
+	cfg := &Config{Issuers: []Issuer{
+		&AWSPCAIssuer{},
+		&ZeroSSLIssuer{HTTPProxy: http.ProxyURL(proxyURL), ProxyAuthenticator: BasicProxyAuth{}},
+	}}
+	ocspConfig := cfg.ocspConfig()
+	if ocspConfig.HTTPProxy == nil || ocspConfig.ProxyAuthenticator == nil {
+		t.Fatal("Expected OCSP to use the proxy of the issuer")
+	}
+	if u, _ := ocspConfig.HTTPProxy(&http.Request{URL: &url.URL{Scheme: "http", Host: "ocsp.example.com"}}); u.String() != proxyURL.String() {
+		t.Errorf("Expected proxy %s, got %s", proxyURL, u)
+	}
+
+	cfg.OCSP.HTTPProxy = NoProxy
+	if u, _ := cfg.ocspConfig().HTTPProxy(nil); u != nil {
+		t.Errorf("Expected OCSP's own proxy setting to take precedence, got %s", u)
+	}
+}
+
+// startTestSOCKS5Proxy starts a SOCKS5 proxy that requires the given
+// username and password; once connected, it echoes data.
+func startTestSOCKS5Proxy(t *testing.T, username, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	readBytes := func(r io.Reader, n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+
+				// greeting: choose username/password authentication
+				greeting := readBytes(br, 2)
+				if greeting == nil || readBytes(br, int(greeting[1])) == nil {
+					return
+				}
+				conn.Write([]byte{5, 2})
+				header := readBytes(br, 2)
+				if header == nil {
+					return
+				}
+				user := readBytes(br, int(header[1]))
+				passLen := readBytes(br, 1)
+				if user == nil || passLen == nil {
+					return
+				}
+				pass := readBytes(br, int(passLen[0]))
+				if string(user) != username || string(pass) != password {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				// connect request for a domain name
+				req := readBytes(br, 5)
+				if req == nil || req[3] != 3 || readBytes(br, int(req[4])+2) == nil {
+					return
+				}
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				_, _ = io.Copy(conn, br)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testTunnel dials through the dialer, and if a tunnel is expected,
+// makes sure that it works by seeing if the proxy echoes data.
+func testTunnel(t *testing.T, dialer proxyConnectDialer, expectTunnel bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", "acme.example.com:443")
+	if !expectTunnel {
+		if err == nil {
+			conn.Close()
+			t.Error("Expected error dialing through proxy")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Dialing through proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected tunnel to echo 'ping', got '%s' (err=%v)", buf, err)
+	}
+}
+
+// startTestConnectProxy starts a proxy that answers CONNECT requests
+// according to handle, which is given the number of the request on
+// its connection; once a tunnel is established, it echoes data.
+func startTestConnectProxy(t *testing.T, handle func(connReqs int, req *http.Request) (int, http.Header)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for connReqs := 1; ; connReqs++ {
+					req, err := http.ReadRequest(br)
+					if err != nil || req.Method != http.MethodConnect {
+						return
+					}
+					status, header := handle(connReqs, req)
+					resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: header}
+					if status != http.StatusOK {
+						resp.ContentLength = 0
+					}
+					if err := resp.Write(conn); err != nil {
+						return
+					}
+					if status == http.StatusOK {
+						_, _ = io.Copy(conn, br)
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func testNTLMChallengeMessage(serverChallenge []byte) []byte {
+	targetInfo := []byte{ntlmAVIDEOL, 0, 0, 0}
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmDefaultFlags)
+	copy(msg[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(len(msg)))
+	return append(msg, targetInfo...)
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolListener wraps a listener whose connections begin
+// with a PROXY protocol header (version 1 or 2), as sent by load
+// balancers, so that the RemoteAddr of its connections is that of
+// the client rather than that of the load balancer. Connections
+// without a valid header fail on their first read.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+type proxyProtocolListener struct {
+	net.Listener
+
+	// How long to wait for the header; default: 5s.
+	headerTimeout time.Duration
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.headerTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &proxyProtocolConn{Conn: conn, headerTimeout: timeout}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header when it is
+// first read from or asked for its remote address, so that a slow
+// client doesn't block Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	headerTimeout time.Duration
+
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	headerErr  error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.reader = bufio.NewReader(c.Conn)
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout)); err != nil {
+		c.headerErr = err
+		return
+	}
+	c.remoteAddr, c.headerErr = readProxyProtocolHeader(c.reader)
+	if c.headerErr != nil {
+		c.headerErr = fmt.Errorf("reading PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.headerErr)
+		return
+	}
+	c.headerErr = c.Conn.SetReadDeadline(time.Time{})
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header from r and
+// returns the source address it conveys, which is nil if the header
+// doesn't have one (like for health checks by the load balancer).
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(r)
+	}
+	if len(sig) >= 6 && string(sig[:6]) == "PROXY " {
+		return readProxyProtocolV1Header(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+func readProxyProtocolV1Header(r *bufio.Reader) (net.Addr, error) {
+	// the header is at most 107 bytes, including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("v1 header is too long or not terminated by CRLF")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header: %q", header)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address: %q", header)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2Header(r *bufio.Reader) (net.Addr, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if version := fixed[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	command := fixed[12] & 0x0f
+	family := fixed[13]
+	length := binary.BigEndian.Uint16(fixed[14:16])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// a LOCAL command is from the load balancer itself
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("v2 IPv4 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("v2 IPv6 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil // unspecified or unix sockets: keep the real address
+	}
+}
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
@@ -0,0 +1,80 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2 := string(proxyProtocolV2Signature) +
+		"\x21\x11\x00\x0c" + // PROXY command, TCP over IPv4, 12 bytes of addresses
+		"\xc6\x33\x64\x01" + "\x0a\x00\x00\x01" + "\x1f\x90" + "\x01\xbb"
+	v2Local := string(proxyProtocolV2Signature) + "\x20\x00\x00\x00"
+
+	for i, test := range []struct {
+		input      string
+		expectAddr string
+		expectErr  bool
+	}{
+		{input: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\nGET", expectAddr: "203.0.113.7:51234"},
+		{input: "PROXY TCP6 2001:db8::1 2001:db8::2 443 80\r\nGET", expectAddr: "[2001:db8::1]:443"},
+		{input: "PROXY UNKNOWN\r\nGET"},
+		{input: v2 + "GET", expectAddr: "198.51.100.1:8080"},
+		{input: v2Local + "GET"},
+		{input: "GET / HTTP/1.1\r\n", expectErr: true},
+		{input: "PROXY TCP4 nonsense\r\nGET", expectErr: true},
+		{input: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\nGET", expectErr: true},
+	} {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		addr, err := readProxyProtocolHeader(r)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got address %v", i, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if (addr == nil && test.expectAddr != "") || (addr != nil && addr.String() != test.expectAddr) {
+			t.Errorf("Test %d: Expected address %q, got %v", i, test.expectAddr, addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "GET" {
+			t.Errorf("Test %d: Expected the rest of the stream to be unread, got %q", i, rest)
+		}
+	}
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &proxyProtocolConn{Conn: server, headerTimeout: 5 * time.Second}
+	go io.WriteString(client, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\nhello")
+
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Errorf("Expected client address from header, got %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected to read data after header, got %q (err=%v)", buf, err)
+	}
+}
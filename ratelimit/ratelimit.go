@@ -0,0 +1,270 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit parses rate-limit errors returned by certificate
+// authorities into structured limits, so that callers can resume
+// exactly when a limit resets instead of guessing.
+//
+// CAs are not consistent in how they report rate limits: ACME CAs
+// return a problem of type "urn:ietf:params:acme:error:rateLimited",
+// but the details (which limit, its window, and when to retry) are
+// only found in the human-readable detail string, which differs from
+// CA to CA. This package knows the formats used by Let's Encrypt,
+// ZeroSSL, and Google Trust Services, and recognizes some generic
+// phrasings used elsewhere.
+//
+// EXPERIMENTAL: Subject to change.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/zerossl"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// Known CAs.
+const (
+	LetsEncrypt = "letsencrypt"
+	ZeroSSL     = "zerossl"
+	Google      = "google"
+)
+
+// Limit describes a rate limit that was exceeded.
+type Limit struct {
+	// The CA that enforced the limit, if known
+	// (LetsEncrypt, ZeroSSL, or Google).
+	CA string
+
+	// The name of the limit, if known, for example
+	// "new orders" or "certificates per registered
+	// domain".
+	Name string
+
+	// The identifier the limit applies to, if the
+	// error was specific to one (e.g. a subproblem).
+	Identifier string
+
+	// The number of events allowed per Window, if known.
+	Threshold int
+
+	// The window the limit applies to, if known.
+	Window time.Duration
+
+	// When the limit resets, if known. This is the
+	// earliest time a retry could succeed.
+	RetryAfter time.Time
+
+	// The original, human-readable description.
+	Detail string
+}
+
+// Wait returns how long to wait from now before retrying. If the
+// reset time is not known, it returns 0 and false.
+func (l Limit) Wait(now time.Time) (time.Duration, bool) {
+	if l.RetryAfter.IsZero() {
+		return 0, false
+	}
+	if wait := l.RetryAfter.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+func (l Limit) String() string {
+	var sb strings.Builder
+	sb.WriteString("rate limit")
+	if l.Name != "" {
+		sb.WriteString(" '" + l.Name + "'")
+	}
+	if l.CA != "" {
+		sb.WriteString(" of " + l.CA)
+	}
+	if l.Identifier != "" {
+		sb.WriteString(" for " + l.Identifier)
+	}
+	if l.Threshold > 0 && l.Window > 0 {
+		sb.WriteString(fmt.Sprintf(" (%d per %s)", l.Threshold, l.Window))
+	}
+	if !l.RetryAfter.IsZero() {
+		sb.WriteString(", retry after " + l.RetryAfter.UTC().Format(time.RFC3339))
+	}
+	return sb.String()
+}
+
+// FromError returns the rate limit described by err, if err (or any
+// error it wraps) is a rate-limit error from a CA. Relative retry times
+// are resolved against the current time.
+func FromError(err error) (Limit, bool) {
+	return fromError(err, time.Now())
+}
+
+func fromError(err error, now time.Time) (Limit, bool) {
+	if err == nil {
+		return Limit{}, false
+	}
+
+	var problem acme.Problem
+	if errors.As(err, &problem) {
+		return fromProblem(problem, now)
+	}
+	var problemPtr *acme.Problem
+	if errors.As(err, &problemPtr) && problemPtr != nil {
+		return fromProblem(*problemPtr, now)
+	}
+
+	var apiErr zerossl.APIError
+	if errors.As(err, &apiErr) {
+		return fromZeroSSLAPIError(apiErr)
+	}
+
+	var limited Limited
+	if errors.As(err, &limited) {
+		return limited.RateLimit(), true
+	}
+
+	return Limit{}, false
+}
+
+// Limited is an error that knows the limit it reports, like an
+// error for a limit that is enforced by the client itself.
+type Limited interface {
+	error
+	RateLimit() Limit
+}
+
+// fromProblem parses an ACME problem. A problem is a rate limit if its
+// type is rateLimited, its HTTP status is 429, or any of its subproblems
+// is a rate limit; in the latter case, the subproblem with the latest
+// reset time determines the limit, since nothing can succeed before it.
+func fromProblem(problem acme.Problem, now time.Time) (Limit, bool) {
+	limit, ok := Limit{}, false
+	if problem.Type == acme.ProblemTypeRateLimited || problem.Status == 429 {
+		limit, ok = parseDetail(problem.Detail, now), true
+		limit.CA = identifyCA(problem.Instance, problem.Detail)
+	}
+	for _, sub := range problem.Subproblems {
+		if sub.Type != acme.ProblemTypeRateLimited {
+			continue
+		}
+		subLimit := parseDetail(sub.Detail, now)
+		subLimit.CA = identifyCA(sub.Instance, sub.Detail)
+		if subLimit.CA == "" {
+			subLimit.CA = identifyCA(problem.Instance, problem.Detail)
+		}
+		subLimit.Identifier = sub.Identifier.Value
+		if !ok || subLimit.RetryAfter.After(limit.RetryAfter) {
+			limit, ok = subLimit, true
+		}
+	}
+	return limit, ok
+}
+
+// fromZeroSSLAPIError parses an error from ZeroSSL's REST API, which
+// reports rate limits with HTTP-like error codes or descriptive types
+// rather than in a problem document. It does not say when to retry.
+func fromZeroSSLAPIError(apiErr zerossl.APIError) (Limit, bool) {
+	errType := strings.ToLower(apiErr.ErrorInfo.Type)
+	if apiErr.ErrorInfo.Code != 429 &&
+		!strings.Contains(errType, "rate_limit") &&
+		!strings.Contains(errType, "too_many_requests") {
+		return Limit{}, false
+	}
+	return Limit{
+		CA:     ZeroSSL,
+		Name:   apiErr.ErrorInfo.Type,
+		Detail: apiErr.Error(),
+	}, true
+}
+
+// parseDetail extracts what it can from a human-readable description
+// of a rate limit.
+func parseDetail(detail string, now time.Time) Limit {
+	limit := Limit{Detail: detail}
+
+	// Let's Encrypt: "too many certificates (5) already issued for this exact
+	// set of identifiers in the last 168h0m0s, retry after 2025-01-21 21:30:11 UTC:
+	// see https://letsencrypt.org/docs/rate-limits/#new-certificates-per-exact-set-of-hostnames"
+	if m := leLimitRegex.FindStringSubmatch(detail); m != nil {
+		limit.Name = strings.TrimSpace(m[1])
+		limit.Threshold, _ = strconv.Atoi(m[2])
+		limit.Window, _ = time.ParseDuration(m[3])
+	} else if m := leDocsRegex.FindStringSubmatch(detail); m != nil {
+		// older formats omit the numbers, but the
+		// docs anchor still names the limit
+		limit.Name = strings.ReplaceAll(m[1], "-", " ")
+	}
+
+	if m := retryAfterTimestampRegex.FindStringSubmatch(detail); m != nil {
+		for _, layout := range []string{"2006-01-02 15:04:05 MST", time.RFC3339, time.RFC1123} {
+			if t, err := time.Parse(layout, m[1]); err == nil {
+				limit.RetryAfter = t
+				break
+			}
+		}
+	}
+	if limit.RetryAfter.IsZero() {
+		if m := retryAfterSecondsRegex.FindStringSubmatch(detail); m != nil {
+			if secs, err := strconv.Atoi(m[1]); err == nil {
+				limit.RetryAfter = now.Add(time.Duration(secs) * time.Second)
+			}
+		} else if m := retryAfterDurationRegex.FindStringSubmatch(detail); m != nil {
+			if dur, err := time.ParseDuration(m[1]); err == nil {
+				limit.RetryAfter = now.Add(dur)
+			}
+		}
+	}
+
+	return limit
+}
+
+// identifyCA guesses which CA produced a problem from its
+// instance URL or the documentation links in its detail.
+func identifyCA(instance, detail string) string {
+	hosts := []string{}
+	if u, err := url.Parse(instance); err == nil && u.Host != "" {
+		hosts = append(hosts, strings.ToLower(u.Host))
+	}
+	for _, link := range linkRegex.FindAllString(detail, -1) {
+		if u, err := url.Parse(link); err == nil {
+			hosts = append(hosts, strings.ToLower(u.Host))
+		}
+	}
+	for _, host := range hosts {
+		switch {
+		case host == "letsencrypt.org" || strings.HasSuffix(host, ".letsencrypt.org"):
+			return LetsEncrypt
+		case host == "zerossl.com" || strings.HasSuffix(host, ".zerossl.com"):
+			return ZeroSSL
+		case host == "pki.goog" || strings.HasSuffix(host, ".pki.goog") || strings.HasSuffix(host, ".google.com"):
+			return Google
+		}
+	}
+	return ""
+}
+
+var (
+	leLimitRegex             = regexp.MustCompile(`(?i)too many ([a-z ,]+?) \((\d+)\).*? in the last ([0-9hms.]+)`)
+	leDocsRegex              = regexp.MustCompile(`letsencrypt\.org/docs/rate-limits/#([a-z-]+)`)
+	retryAfterTimestampRegex = regexp.MustCompile(`(?i)retry after (\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?: UTC|Z|[+-]\d{2}:\d{2}))`)
+	retryAfterSecondsRegex   = regexp.MustCompile(`(?i)retry(?:-after:| after| in) (\d+) ?(?:seconds?|secs?|s)\b`)
+	retryAfterDurationRegex  = regexp.MustCompile(`(?i)retry (?:in|after) ((?:\d+(?:\.\d+)?[hms])+)\b`)
+	linkRegex                = regexp.MustCompile(`https?://[^\s,;)]+`)
+)
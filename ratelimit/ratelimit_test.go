@@ -0,0 +1,143 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/zerossl"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestFromError(t *testing.T) {
+	now := time.Date(2025, 1, 21, 20, 0, 0, 0, time.UTC)
+
+	for i, tc := range []struct {
+		err         error
+		expectOK    bool
+		expectLimit Limit
+	}{
+		{
+			err: fmt.Errorf("[example.com] Obtain: %w", acme.Problem{
+				Type:   acme.ProblemTypeRateLimited,
+				Status: 429,
+				Detail: "too many certificates (5) already issued for this exact set of identifiers in the last 168h0m0s, retry after 2025-01-21 21:30:11 UTC: see https://letsencrypt.org/docs/rate-limits/#new-certificates-per-exact-set-of-hostnames",
+			}),
+			expectOK: true,
+			expectLimit: Limit{
+				CA:         LetsEncrypt,
+				Name:       "certificates",
+				Threshold:  5,
+				Window:     168 * time.Hour,
+				RetryAfter: time.Date(2025, 1, 21, 21, 30, 11, 0, time.UTC),
+			},
+		},
+		{
+			err: acme.Problem{
+				Type:   acme.ProblemTypeRateLimited,
+				Detail: "Error creating new order :: too many certificates already issued for: example.com: see https://letsencrypt.org/docs/rate-limits/#new-certificates-per-registered-domain",
+			},
+			expectOK: true,
+			expectLimit: Limit{
+				CA:   LetsEncrypt,
+				Name: "new certificates per registered domain",
+			},
+		},
+		{
+			err: acme.Problem{
+				Type:     acme.ProblemTypeRateLimited,
+				Instance: "https://dv.acme-v02.api.pki.goog/problem/123",
+				Detail:   "Quota exceeded for new orders, retry after 3600 seconds",
+			},
+			expectOK: true,
+			expectLimit: Limit{
+				CA:         Google,
+				RetryAfter: now.Add(time.Hour),
+			},
+		},
+		{
+			err: &acme.Problem{
+				Type:   acme.ProblemTypeMalformed,
+				Detail: "some subproblems",
+				Subproblems: []acme.Subproblem{
+					{
+						Problem:    acme.Problem{Type: acme.ProblemTypeRateLimited, Detail: "retry in 10m"},
+						Identifier: acme.Identifier{Type: "dns", Value: "a.example.com"},
+					},
+					{
+						Problem:    acme.Problem{Type: acme.ProblemTypeRateLimited, Detail: "retry in 1h30m"},
+						Identifier: acme.Identifier{Type: "dns", Value: "b.example.com"},
+					},
+					{
+						Problem:    acme.Problem{Type: acme.ProblemTypeCAA},
+						Identifier: acme.Identifier{Type: "dns", Value: "c.example.com"},
+					},
+				},
+			},
+			expectOK: true,
+			expectLimit: Limit{
+				Identifier: "b.example.com",
+				RetryAfter: now.Add(90 * time.Minute),
+			},
+		},
+		{
+			err: zerossl.APIError{ErrorInfo: struct {
+				Code    int                                           `json:"code"`
+				Type    string                                        `json:"type"`
+				Details map[string]map[string]zerossl.ValidationError `json:"details"`
+			}{Code: 429, Type: "rate_limit_exceeded"}},
+			expectOK: true,
+			expectLimit: Limit{
+				CA:   ZeroSSL,
+				Name: "rate_limit_exceeded",
+			},
+		},
+		{
+			err: acme.Problem{Type: acme.ProblemTypeUnauthorized, Detail: "retry after 10 seconds"},
+		},
+		{
+			err: errors.New("too many certificates (5) already issued"),
+		},
+		{
+			err: nil,
+		},
+	} {
+		actual, ok := fromError(tc.err, now)
+		if ok != tc.expectOK {
+			t.Errorf("Test %d: Expected ok=%t, got %t", i, tc.expectOK, ok)
+			continue
+		}
+		actual.Detail = "" // not worth comparing
+		if actual != tc.expectLimit {
+			t.Errorf("Test %d: Expected limit %+v, got %+v", i, tc.expectLimit, actual)
+		}
+	}
+}
+
+func TestLimitWait(t *testing.T) {
+	now := time.Now()
+	if _, ok := (Limit{}).Wait(now); ok {
+		t.Error("Expected unknown wait for limit without reset time")
+	}
+	if wait, ok := (Limit{RetryAfter: now.Add(time.Minute)}).Wait(now); !ok || wait != time.Minute {
+		t.Errorf("Expected wait of 1m, got %s (ok=%t)", wait, ok)
+	}
+	if wait, ok := (Limit{RetryAfter: now.Add(-time.Minute)}).Wait(now); !ok || wait != 0 {
+		t.Errorf("Expected no wait for limit that already reset, got %s (ok=%t)", wait, ok)
+	}
+}
@@ -242,3 +242,36 @@ func (r *RingBufferRateLimiter) advance() {
 		r.cursor = 0
 	}
 }
+
+// newWindowLimiter returns a rate limiter without a scheduling
+// goroutine, which needs no cleanup. It must only be used with
+// allowedAt and recordAt, which don't block, since Allow and
+// Wait would never get a ticket.
+func newWindowLimiter(maxEvents int, window time.Duration) *RingBufferRateLimiter {
+	return &RingBufferRateLimiter{
+		window: window,
+		ring:   make([]time.Time, maxEvents),
+	}
+}
+
+// allowedAt returns true if an event would be allowed to
+// happen at now. Unlike Allow, it does not claim a ticket;
+// call recordAt if the event happens.
+func (r *RingBufferRateLimiter) allowedAt(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.ring) == 0 {
+		return r.window == 0
+	}
+	return !r.ring[r.cursor].Add(r.window).After(now)
+}
+
+// recordAt records that an event happened at now.
+func (r *RingBufferRateLimiter) recordAt(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.ring) > 0 {
+		r.ring[r.cursor] = now
+		r.advance()
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"maps"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Update changes the settings of cfg without dropping the certificates
+// in its cache. configure is called with a copy of cfg's current
+// settings, which it can change; if it returns without error, the copy
+// replaces cfg, and the new config is returned. Zero-value fields of the
+// copy are filled in like by New.
+//
+// The change is atomic: handshakes and other operations that are already
+// in progress finish with the old settings, and those that start later
+// use the new ones, including those started with cfg (for example by the
+// GetCertificate callback of a tls.Config from cfg.TLSConfig, or certificate
+// maintenance if the cache's GetConfigForCert returns cfg). Certificates
+// that are already cached stay in use until they are renewed (with the
+// new settings); to manage certificates for new names, call ManageSync
+// or ManageAsync afterwards. Preload is not run again.
+//
+// Issuers that refer to their config, like ACMEIssuers, must be created
+// anew for the new config in configure (e.g. with NewACMEIssuer(next, ...))
+// if they should use its settings, like its storage.
+//
+// Update fails if cfg was not made with New or NewDefault, or if it was
+// updated concurrently.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Update(configure func(next *Config) error) (*Config, error) {
+	current := cfg.current()
+	if current.successor == nil {
+		return nil, errors.New("config was not made with New or NewDefault")
+	}
+
+	next := new(Config)
+	*next = *current
+	next.successor = new(atomic.Pointer[Config])
+	if err := configure(next); err != nil {
+		return nil, err
+	}
+	next.setDefaults()
+	next.certCache = current.certCache
+	next.clientCerts = current.clientCerts
+
+	// the on-demand allowlist is made by managing names
+	if next.OnDemand != nil && next.OnDemand != current.OnDemand &&
+		next.OnDemand.hostAllowlist == nil && current.OnDemand != nil {
+		next.OnDemand.hostAllowlist = maps.Clone(current.OnDemand.hostAllowlist)
+	}
+
+	if !current.successor.CompareAndSwap(nil, next) {
+		return nil, errors.New("config was updated concurrently")
+	}
+	next.Logger.Info("config updated", zap.Int("cached_certificates", next.certCache.cache.len()))
+	return next, nil
+}
+
+// current returns the config that cfg has been replaced with by Update,
+// if any, or cfg itself. Since it is called for every handshake, it
+// compresses the chain of replacements as it goes, so that the next
+// call takes one step, and replaced configs in between can be garbage-
+// collected instead of being kept alive by cfg.
+func (cfg *Config) current() *Config {
+	if cfg.successor == nil {
+		return cfg
+	}
+	first := cfg.successor.Load()
+	if first == nil {
+		return cfg
+	}
+	latest := first
+	for latest.successor != nil {
+		next := latest.successor.Load()
+		if next == nil {
+			break
+		}
+		latest = next
+	}
+	if latest != first {
+		// if this fails, another call already compressed it further
+		cfg.successor.CompareAndSwap(first, latest)
+	}
+	return latest
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestConfigUpdate(t *testing.T) {
+	ctx := context.Background()
+	oldIssuer, newIssuer := new(csrRecordingIssuer), new(csrRecordingIssuer)
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{oldIssuer},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+	original := cfg
+
+	if err := original.ManageSync(ctx, []string{"old.example.com"}); err != nil {
+		t.Fatalf("ManageSync: %v", err)
+	}
+
+	updated, err := original.Update(func(next *Config) error {
+		next.Issuers = []Issuer{newIssuer}
+		next.DefaultServerName = "old.example.com"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if updated == original || updated.DefaultServerName != "old.example.com" {
+		t.Fatalf("Expected a new config with the new settings, got %+v", updated)
+	}
+	if updated.certCache != cache || updated.Storage != original.Storage {
+		t.Error("Expected cache and unchanged settings to be kept")
+	}
+	if cache.cache.len() != 1 {
+		t.Errorf("Expected certificate to stay cached, got %d certificates", cache.cache.len())
+	}
+
+	// the old config uses the new settings
+	cert, err := original.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || cert == nil {
+		t.Errorf("Expected certificate for the new default server name: %v", err)
+	}
+	if err := original.ObtainCertSync(ctx, "new.example.com"); err != nil {
+		t.Fatalf("ObtainCertSync: %v", err)
+	}
+	if len(oldIssuer.csrs) != 1 || len(newIssuer.csrs) != 1 {
+		t.Errorf("Expected second certificate from new issuer, got %d and %d CSRs", len(oldIssuer.csrs), len(newIssuer.csrs))
+	}
+
+	// updating a replaced config updates the latest one
+	latest, err := original.Update(func(next *Config) error {
+		if next.DefaultServerName != "old.example.com" {
+			return errors.New("not the latest settings")
+		}
+		next.DefaultServerName = ""
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if updated.current() != latest || original.current() != latest {
+		t.Error("Expected replaced configs to resolve to the latest one")
+	}
+
+	// failed updates change nothing
+	if _, err := latest.Update(func(*Config) error { return errors.New("nope") }); err == nil {
+		t.Error("Expected error from configure to fail the update")
+	}
+	if latest.current() != latest {
+		t.Error("Expected failed update not to replace the config")
+	}
+
+	if _, err := (&Config{}).Update(func(*Config) error { return nil }); err == nil {
+		t.Error("Expected error updating a config not made with New")
+	}
+}
+
+func TestConfigCurrentCompressesChain(t *testing.T) {
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	original := New(cache, Config{Storage: &FileStorage{Path: t.TempDir()}, Logger: defaultTestLogger})
+
+	var latest *Config
+	for i := 0; i < 5; i++ {
+		var err error
+		latest, err = original.Update(func(*Config) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := original.current(); got != latest {
+		t.Fatal("Expected current to return the latest config")
+	}
+	if got := original.successor.Load(); got != latest {
+		t.Error("Expected the chain of replaced configs to be compressed")
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RevocationFeed provides the certificates affected by a mass
+// revocation, like when a CA revokes the certificates it mis-issued,
+// as the hex-encoded serial numbers or SHA-256 fingerprints of the
+// certificates. Colons and case are ignored.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationFeed interface {
+	AffectedCertificates(ctx context.Context) ([]string, error)
+}
+
+// RevocationFeedFunc is a function that implements RevocationFeed,
+// for example to get the affected certificates from an API of the CA.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationFeedFunc func(ctx context.Context) ([]string, error)
+
+// AffectedCertificates implements RevocationFeed.
+func (f RevocationFeedFunc) AffectedCertificates(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// RevocationListFile is the path of a file that lists the affected
+// certificates, one per line; see RevocationListURL for the format.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationListFile string
+
+// AffectedCertificates implements RevocationFeed.
+func (f RevocationListFile) AffectedCertificates(context.Context) ([]string, error) {
+	file, err := os.Open(string(f))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseRevocationList(file)
+}
+
+// RevocationListURL downloads the list of affected certificates. The
+// list has one serial number or fingerprint per line; only the first
+// field of each line (separated by whitespace or commas) is used, so
+// CSV files with more columns work too. Empty lines, lines starting
+// with "#", and fields that are not hexadecimal, like headers, are
+// skipped.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationListURL struct {
+	URL string
+
+	// The client to download the list with. Default:
+	// the config's HTTPClient, or a client with HTTPTimeout.
+	HTTPClient *http.Client
+}
+
+// AffectedCertificates implements RevocationFeed.
+func (u RevocationListURL) AffectedCertificates(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClientFor(ctx, u.HTTPClient, HTTPTimeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+	return parseRevocationList(resp.Body)
+}
+
+// parseRevocationList parses a list of affected certificates in the
+// format described by RevocationListURL.
+func parseRevocationList(r io.Reader) ([]string, error) {
+	var ids []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.ReplaceAll(scanner.Text(), ",", " "))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := normalizeCertID(fields[0]); ok {
+			ids = append(ids, fields[0])
+		}
+	}
+	return ids, scanner.Err()
+}
+
+// normalizeCertID returns the hex-encoded serial number or SHA-256
+// fingerprint id in lowercase, without colons, and, if it is a serial
+// number, without leading zeros, so that it can be compared with
+// those of certificates. It returns false if id is not hexadecimal.
+func normalizeCertID(id string) (string, bool) {
+	id = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(id), ":", ""))
+	if id == "" {
+		return "", false
+	}
+	if _, err := hex.DecodeString(strings.Repeat("0", len(id)%2) + id); err != nil {
+		return "", false
+	}
+	if len(id) == 2*sha256.Size {
+		return id, true // fingerprint; serial numbers have at most 20 octets
+	}
+	if id = strings.TrimLeft(id, "0"); id == "" {
+		id = "0"
+	}
+	return id, true
+}
+
+// certIDs returns the normalized serial number and SHA-256 fingerprint
+// of leaf.
+func certIDs(leaf *x509.Certificate) (serial, fingerprint string) {
+	sum := sha256.Sum256(leaf.Raw)
+	return leaf.SerialNumber.Text(16), hex.EncodeToString(sum[:])
+}
+
+// RemediationOptions configures how the certificates affected by a mass
+// revocation are replaced.
+//
+// EXPERIMENTAL: Subject to change.
+type RemediationOptions struct {
+	// How many certificates are renewed at once.
+	// Default: 1.
+	Concurrency int
+
+	// At most MaxRenewals renewals are started in any
+	// Window, so that replacing many certificates does
+	// not exceed the rate limits of the CA (which are
+	// also respected by each renewal, see ACMERateLimits).
+	// 0 means no limit.
+	MaxRenewals int
+	Window      time.Duration
+
+	// Only find the affected certificates; don't renew
+	// them.
+	DryRun bool
+}
+
+// RemediationResult is the outcome of replacing a certificate affected
+// by a mass revocation.
+//
+// EXPERIMENTAL: Subject to change.
+type RemediationResult struct {
+	// The names of the affected certificate, and the key
+	// of the issuer it was issued by.
+	Names     []string
+	IssuerKey string
+
+	// The serial number of the affected certificate, in hex.
+	SerialNumber string
+
+	// Whether the certificate is in the cache, or only
+	// in storage.
+	Cached bool
+
+	// Whether it was renewed, or the error if it failed.
+	Renewed bool
+	Err     error
+}
+
+// Remediate replaces the managed certificates of the config's issuers
+// that are affected by a mass revocation, as listed by feed: it finds
+// those in the cache and in storage, and force-renews them a few at a
+// time, according to opts. Renewed certificates replace the affected
+// ones in the cache. Renewals are retried like in the background, so
+// this can take long if the CA is unavailable; cancel ctx to stop.
+// With leader election, only the leader renews certificates.
+//
+// Progress is reported with remediation_started and remediation_finished
+// events. The returned error joins the errors of the results.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Remediate(ctx context.Context, feed RevocationFeed, opts RemediationOptions) ([]RemediationResult, error) {
+	cfg = cfg.current()
+	ids, err := feed.AffectedCertificates(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting affected certificates: %w", err)
+	}
+	affected := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if normalized, ok := normalizeCertID(id); ok {
+			affected[normalized] = struct{}{}
+		}
+	}
+
+	log := cfg.Logger.Named("remediation")
+	matches, err := cfg.affectedCertificates(ctx, log, affected)
+	if err != nil {
+		return nil, err
+	}
+	cfg.emit(ctx, "remediation_started", map[string]any{
+		"affected": len(affected),
+		"matched":  len(matches),
+		"dry_run":  opts.DryRun,
+	})
+	log.Warn("found certificates affected by mass revocation",
+		zap.Int("affected", len(affected)),
+		zap.Int("matched", len(matches)),
+		zap.Bool("dry_run", opts.DryRun))
+
+	results := make([]RemediationResult, len(matches))
+	for i, m := range matches {
+		results[i] = m.result
+	}
+	if opts.DryRun || len(matches) == 0 {
+		return results, nil
+	}
+	if !cfg.certCache.leading(ctx) {
+		return results, fmt.Errorf("not renewing %d affected certificates: this instance is not the leader", len(matches))
+	}
+
+	maxRenewals, window := opts.MaxRenewals, opts.Window
+	if maxRenewals <= 0 {
+		maxRenewals, window = 0, 0
+	}
+	limiter := NewRateLimiter(maxRenewals, window)
+	defer limiter.Stop()
+	concurrency := max(opts.Concurrency, 1)
+	throttle := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, m := range matches {
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		select {
+		case throttle <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+			var err error
+			if m.result.Cached {
+				_, err = cfg.forceRenew(ctx, log, m.cert)
+			} else {
+				err = cfg.RenewCertAsync(ctx, m.result.Names[0], true)
+			}
+			results[i].Renewed = err == nil
+			results[i].Err = err
+		}()
+	}
+	wg.Wait()
+
+	var renewed, failed int
+	var errs []error
+	for i := range results {
+		if !results[i].Renewed && results[i].Err == nil {
+			results[i].Err = ctx.Err() // not started
+		}
+		if results[i].Renewed {
+			renewed++
+		} else {
+			failed++
+			errs = append(errs, fmt.Errorf("%v: %w", results[i].Names, results[i].Err))
+		}
+	}
+	cfg.emit(ctx, "remediation_finished", map[string]any{
+		"matched": len(matches),
+		"renewed": renewed,
+		"failed":  failed,
+	})
+	return results, errors.Join(errs...)
+}
+
+// affectedCert is a certificate affected by a mass revocation.
+type affectedCert struct {
+	result RemediationResult
+	cert   Certificate // if cached
+}
+
+// affectedCertificates returns the managed certificates of the config's
+// issuers, in the cache and then in storage, whose serial number or
+// fingerprint is in affected.
+func (cfg *Config) affectedCertificates(ctx context.Context, log *zap.Logger, affected map[string]struct{}) ([]affectedCert, error) {
+	isAffected := func(leaf *x509.Certificate) (string, string, bool) {
+		serial, fingerprint := certIDs(leaf)
+		_, serialAffected := affected[serial]
+		_, fingerprintAffected := affected[fingerprint]
+		return serial, fingerprint, serialAffected || fingerprintAffected
+	}
+	issuers := cfg.allIssuers()
+
+	var matches []affectedCert
+	seen := make(map[string]bool) // by fingerprint
+	cfg.certCache.cache.rangeAll(func(_ string, cert Certificate) {
+		if !cert.managed || cert.Leaf == nil ||
+			!slices.ContainsFunc(issuers, func(iss Issuer) bool { return iss.IssuerKey() == cert.issuerKey }) {
+			return
+		}
+		serial, fingerprint, ok := isAffected(cert.Leaf)
+		if !ok || seen[fingerprint] {
+			return
+		}
+		seen[fingerprint] = true
+		matches = append(matches, affectedCert{
+			result: RemediationResult{
+				Names:        slices.Clone(cert.Names),
+				IssuerKey:    cert.issuerKey,
+				SerialNumber: serial,
+				Cached:       true,
+			},
+			cert: cert,
+		})
+	})
+
+	// certificates that are not loaded, like on-demand ones,
+	// would be served once they are
+	for _, issuer := range issuers {
+		issuerKey := issuer.IssuerKey()
+		siteKeys, err := cfg.Storage.List(ctx, StorageKeys.CertsPrefix(issuerKey), false)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing certificates from issuer %s: %v", issuerKey, err)
+		}
+		for _, siteKey := range siteKeys {
+			certPEM, err := cfg.Storage.Load(ctx, path.Join(siteKey, path.Base(siteKey)+".crt"))
+			if err != nil {
+				log.Error("unable to load certificate from storage", zap.String("site_key", siteKey), zap.Error(err))
+				continue
+			}
+			certs, err := parseCertsFromPEMBundle(certPEM)
+			if err != nil {
+				log.Error("unable to parse certificate from storage", zap.String("site_key", siteKey), zap.Error(err))
+				continue
+			}
+			serial, fingerprint, ok := isAffected(certs[0])
+			if !ok || seen[fingerprint] {
+				continue
+			}
+			seen[fingerprint] = true
+			name, err := cfg.storedSiteName(ctx, siteKey)
+			if err != nil {
+				log.Error("unable to get name of affected certificate in storage", zap.String("site_key", siteKey), zap.Error(err))
+				continue
+			}
+			names := append([]string{name}, slices.DeleteFunc(certs[0].DNSNames, func(n string) bool { return n == name })...)
+			matches = append(matches, affectedCert{
+				result: RemediationResult{
+					Names:        names,
+					IssuerKey:    issuerKey,
+					SerialNumber: serial,
+				},
+			})
+		}
+	}
+	return matches, nil
+}
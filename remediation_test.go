@@ -0,0 +1,129 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRevocationList(t *testing.T) {
+	list := `# affected certificates
+serial,names
+0A:1B:2C, example.com
+
+FFee01	other.example.com
+not-hex
+`
+	ids, err := parseRevocationList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{"0A:1B:2C", "FFee01"}) {
+		t.Errorf("Unexpected identifiers: %v", ids)
+	}
+	for _, tc := range []struct{ id, want string }{
+		{"0A:1B:2C", "a1b2c"},
+		{"00", "0"},
+		{strings.Repeat("0A", 32), strings.Repeat("0a", 32)},
+	} {
+		if got, ok := normalizeCertID(tc.id); !ok || got != tc.want {
+			t.Errorf("normalizeCertID(%q) = %q, %t; want %q", tc.id, got, ok, tc.want)
+		}
+	}
+}
+
+func TestRemediate(t *testing.T) {
+	ctx := context.Background()
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&testIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+	names := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}
+	if err := cfg.ManageSync(ctx, names); err != nil {
+		t.Fatal(err)
+	}
+	certs := make(map[string]Certificate)
+	for _, name := range names {
+		certs[name] = cache.getAllMatchingCerts(name)[0]
+	}
+	// certificates that are only in storage are affected too
+	cache.Remove([]string{certs["c.example.com"].hash})
+
+	serial, _ := certIDs(certs["a.example.com"].Leaf)
+	_, fingerprint := certIDs(certs["b.example.com"].Leaf)
+	storedSerial, _ := certIDs(certs["c.example.com"].Leaf)
+	feed := RevocationFeedFunc(func(context.Context) ([]string, error) {
+		return []string{strings.ToUpper(serial), fingerprint, "00" + storedSerial, "abcdef"}, nil
+	})
+
+	results, err := cfg.Remediate(ctx, feed, RemediationOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || slices.ContainsFunc(results, func(r RemediationResult) bool { return r.Renewed }) {
+		t.Fatalf("Unexpected dry run results: %+v", results)
+	}
+
+	results, err = cfg.Remediate(ctx, feed, RemediationOptions{Concurrency: 2, MaxRenewals: 2, Window: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %+v", results)
+	}
+	for _, result := range results {
+		if !result.Renewed || result.Cached != (result.Names[0] != "c.example.com") {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+	}
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		if renewed := cache.getAllMatchingCerts(name); len(renewed) != 1 || renewed[0].hash == certs[name].hash {
+			t.Errorf("Expected affected certificate for %s to be replaced in the cache", name)
+		}
+	}
+	if cache.getAllMatchingCerts("d.example.com")[0].hash != certs["d.example.com"].hash {
+		t.Error("Expected unaffected certificate to stay")
+	}
+	certRes, err := cfg.loadCertResource(ctx, cfg.Issuers[0], "c.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored[0].SerialNumber.Text(16) == storedSerial {
+		t.Error("Expected affected certificate in storage to be replaced")
+	}
+
+	// once replaced, nothing is affected anymore
+	results, err = cfg.Remediate(ctx, feed, RemediationOptions{})
+	if err != nil || len(results) != 0 {
+		t.Errorf("Expected no affected certificates, got %+v (error: %v)", results, err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteManager is a Manager that gets certificates from a central
+// certificate service over HTTPS, for OnDemandConfig.Managers. For each
+// handshake that needs a certificate, it sends a GET request to the
+// service with these query parameters:
+//
+//   - server_name: the SNI value of the ClientHello
+//   - signature_schemes: the signature schemes the client supports,
+//     as comma-separated hexadecimal numbers
+//   - cipher_suites: the cipher suites the client supports, likewise
+//   - local_ip: the IP address the client connected to, if known
+//
+// The service responds with status 200 and a PEM bundle of the
+// certificate chain and its private key, or with status 204 or 404 if
+// it doesn't have a certificate for the server name, which lets other
+// Managers and the Issuers get one. Other responses are errors.
+//
+// Responses are cached by server name: certificates until CacheTTL
+// passes or they expire, and the lack of one for NegativeCacheTTL.
+//
+// EXPERIMENTAL: Subject to change.
+type RemoteManager struct {
+	// The URLs of the service, like replicas of it. Requests
+	// go to the first URL; if it fails, or if it hasn't
+	// responded within HedgeDelay, the request is also sent
+	// to the next one (at most once to each URL), and the
+	// first response is used. REQUIRED.
+	URLs []string
+
+	// The TLS config for connecting to the service, for
+	// example with client certificates for mutual TLS.
+	// Ignored if HTTPClient is set.
+	TLSConfig *tls.Config
+
+	// The HTTP client to use. Default: a client that uses
+	// TLSConfig.
+	HTTPClient *http.Client
+
+	// How long a request to the service may take. Since
+	// the handshake is waiting, this should be short.
+	// Default: 5 seconds.
+	Timeout time.Duration
+
+	// How long to wait for a response before hedging the
+	// request to the next URL. Default: 0 (hedge only if
+	// the request fails).
+	HedgeDelay time.Duration
+
+	// How long to cache certificates. Default: 10 minutes.
+	CacheTTL time.Duration
+
+	// How long to remember that the service doesn't have
+	// a certificate for a server name. Negative values
+	// disable this. Default: 1 minute.
+	NegativeCacheTTL time.Duration
+
+	clientOnce sync.Once
+	client     *http.Client
+
+	mu    sync.Mutex
+	cache map[string]remoteCacheEntry
+}
+
+type remoteCacheEntry struct {
+	cert    *tls.Certificate // nil if the service has none
+	expires time.Time
+}
+
+// GetCertificate implements Manager.
+func (rm *RemoteManager) GetCertificate(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(rm.URLs) == 0 {
+		return nil, fmt.Errorf("remote manager has no URLs")
+	}
+	serverName := strings.ToLower(hello.ServerName)
+
+	if cert, ok := rm.cached(serverName); ok {
+		return cert, nil
+	}
+
+	timeout := rm.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cert, err := rm.fetchHedged(ctx, hello)
+	if err != nil {
+		return nil, err
+	}
+	rm.store(serverName, cert)
+	return cert, nil
+}
+
+// fetchHedged requests the certificate for hello from the URLs, as
+// described for HedgeDelay, and returns the first response.
+func (rm *RemoteManager) fetchHedged(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	type result struct {
+		cert *tls.Certificate
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stop requests that were hedged
+	results := make(chan result, len(rm.URLs))
+	next, inFlight := 0, 0
+	send := func() {
+		endpoint := rm.URLs[next]
+		next++
+		inFlight++
+		go func() {
+			cert, err := rm.fetch(ctx, endpoint, hello)
+			results <- result{cert, err}
+		}()
+	}
+	send()
+
+	var hedge <-chan time.Time
+	if rm.HedgeDelay > 0 {
+		ticker := time.NewTicker(rm.HedgeDelay)
+		defer ticker.Stop()
+		hedge = ticker.C
+	}
+
+	var errs []error
+	for {
+		select {
+		case r := <-results:
+			inFlight--
+			if r.err == nil {
+				return r.cert, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(rm.URLs) {
+				send()
+			} else if inFlight == 0 {
+				return nil, fmt.Errorf("getting certificate from remote manager: %w", errors.Join(errs...))
+			}
+		case <-hedge:
+			if next < len(rm.URLs) {
+				send()
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("getting certificate from remote manager: %w", ctx.Err())
+		}
+	}
+}
+
+// fetch requests the certificate for hello from endpoint.
+func (rm *RemoteManager) fetch(ctx context.Context, endpoint string, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL %s: %v", endpoint, err)
+	}
+	qs := u.Query()
+	qs.Set("server_name", hello.ServerName)
+	qs.Set("signature_schemes", joinHex(hello.SignatureSchemes))
+	qs.Set("cipher_suites", joinHex(hello.CipherSuites))
+	if hello.Conn != nil {
+		if host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+			qs.Set("local_ip", host)
+		}
+	}
+	u.RawQuery = qs.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rm.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: HTTP %d", u.Host, resp.StatusCode)
+	}
+
+	bundle, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading response: %v", u.Host, err)
+	}
+	cert, err := tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decoding certificate and key: %v", u.Host, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%s: parsing certificate: %v", u.Host, err)
+		}
+	}
+	return &cert, nil
+}
+
+func (rm *RemoteManager) httpClient() *http.Client {
+	if rm.HTTPClient != nil {
+		return rm.HTTPClient
+	}
+	rm.clientOnce.Do(func() {
+		rm.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     rm.TLSConfig,
+				TLSHandshakeTimeout: 5 * time.Second,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	})
+	return rm.client
+}
+
+// cached returns the cached response for serverName, if it is fresh.
+func (rm *RemoteManager) cached(serverName string) (*tls.Certificate, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	entry, ok := rm.cache[serverName]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.cert, true
+}
+
+// store caches cert (which may be nil) as the response for serverName.
+func (rm *RemoteManager) store(serverName string, cert *tls.Certificate) {
+	ttl := rm.CacheTTL
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	if cert == nil {
+		ttl = rm.NegativeCacheTTL
+		if ttl < 0 {
+			return
+		}
+		if ttl == 0 {
+			ttl = time.Minute
+		}
+	}
+	now := time.Now()
+	expires := now.Add(ttl)
+	if cert != nil && cert.Leaf.NotAfter.Before(expires) {
+		expires = cert.Leaf.NotAfter
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.cache == nil {
+		rm.cache = make(map[string]remoteCacheEntry)
+	}
+	// forget stale entries once in a while to bound memory use
+	if len(rm.cache) >= remoteManagerCachePruneSize {
+		for name, entry := range rm.cache {
+			if now.After(entry.expires) {
+				delete(rm.cache, name)
+			}
+		}
+	}
+	rm.cache[serverName] = remoteCacheEntry{cert: cert, expires: expires}
+}
+
+// joinHex joins vals as comma-separated hexadecimal numbers.
+func joinHex[T ~uint16](vals []T) string {
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		strs[i] = "0x" + strconv.FormatUint(uint64(v), 16)
+	}
+	return strings.Join(strs, ",")
+}
+
+const remoteManagerCachePruneSize = 1000
+
+// Interface guard
+var _ Manager = (*RemoteManager)(nil)
@@ -0,0 +1,139 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func remoteManagerBundle(t *testing.T, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM...)
+}
+
+func TestRemoteManager(t *testing.T) {
+	bundle := remoteManagerBundle(t, "example.com")
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("server_name") != "example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("signature_schemes") != "0x403" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(bundle)
+	}))
+	defer srv.Close()
+
+	rm := &RemoteManager{URLs: []string{srv.URL}, HTTPClient: srv.Client()}
+	ctx := context.Background()
+	hello := &tls.ClientHelloInfo{ServerName: "example.com", SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}}
+	for range 2 {
+		cert, err := rm.GetCertificate(ctx, hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert == nil || cert.Leaf == nil || cert.Leaf.DNSNames[0] != "example.com" {
+			t.Fatalf("Expected certificate for example.com, got %v", cert)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected certificate to be cached, got %d requests", n)
+	}
+
+	// no certificate: nil, nil, and cached too
+	for range 2 {
+		cert, err := rm.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "other.example.com"})
+		if err != nil || cert != nil {
+			t.Fatalf("Expected no certificate and no error, got %v, %v", cert, err)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected lack of certificate to be cached, got %d requests", n)
+	}
+
+	if _, err := rm.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "example.net"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&RemoteManager{URLs: []string{srv.URL}, HTTPClient: srv.Client()}).GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Error("Expected error for failed request")
+	}
+}
+
+func TestRemoteManagerHedging(t *testing.T) {
+	bundle := remoteManagerBundle(t, "example.com")
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write(bundle)
+	}))
+	defer slow.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bundle)
+	}))
+	defer fast.Close()
+
+	rm := &RemoteManager{
+		URLs:       []string{slow.URL, failing.URL, fast.URL},
+		HedgeDelay: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	cert, err := rm.GetCertificate(context.Background(), &tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil || cert == nil {
+		t.Fatalf("Expected certificate from the fast server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected hedged request to be answered quickly, took %s", elapsed)
+	}
+}
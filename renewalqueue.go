@@ -0,0 +1,233 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// QueuedJob is a background obtain or renewal that is persisted in
+// storage while it is pending (see Config.PersistentQueue), along with
+// the progress of its retries.
+//
+// EXPERIMENTAL: Subject to change.
+type QueuedJob struct {
+	// "obtain" or "renew".
+	Kind string `json:"kind"`
+
+	// The names to get a certificate for.
+	Names []string `json:"names"`
+
+	// Whether a renewal is forced.
+	Force bool `json:"force,omitempty"`
+
+	// When the job was queued, the number of failed
+	// attempts so far, and when to try again.
+	Queued   time.Time `json:"queued"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try,omitzero"`
+
+	// The error of the last failed attempt.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Kinds of queued jobs.
+const (
+	queuedObtain = "obtain"
+	queuedRenew  = "renew"
+)
+
+// retryCheckpoint persists the progress of a retry loop.
+type retryCheckpoint interface {
+	// resume returns when the loop started, how many attempts
+	// have failed, and when to try next.
+	resume(ctx context.Context) (started time.Time, attempts int, next time.Time)
+
+	// failed records a failed attempt.
+	failed(ctx context.Context, attempts int, next time.Time, err error)
+
+	// finished forgets the loop, which succeeded or gave up.
+	finished(ctx context.Context)
+}
+
+// retryCheckpoint returns the checkpoint of the job of the given kind
+// for names, or nil if the queue is not persisted.
+func (cfg *Config) retryCheckpoint(kind string, names []string, force bool) retryCheckpoint {
+	if !cfg.PersistentQueue {
+		return nil
+	}
+	return &storageCheckpoint{cfg: cfg, job: QueuedJob{Kind: kind, Names: names, Force: force}}
+}
+
+// storageCheckpoint is a retryCheckpoint in the storage of a config.
+// Failing to persist the progress doesn't fail the job; it is only
+// logged.
+type storageCheckpoint struct {
+	cfg *Config
+	job QueuedJob
+}
+
+func (sc *storageCheckpoint) key() string {
+	return queuedJobKey(sc.job.Kind, sc.job.Names[0])
+}
+
+func (sc *storageCheckpoint) resume(ctx context.Context) (time.Time, int, time.Time) {
+	stored, err := loadQueuedJob(ctx, sc.cfg.Storage, sc.key())
+	if err == nil && stored.Kind == sc.job.Kind {
+		sc.job.Queued, sc.job.Attempts, sc.job.NextTry = stored.Queued, stored.Attempts, stored.NextTry
+		sc.job.LastError = stored.LastError
+		return sc.job.Queued, sc.job.Attempts, sc.job.NextTry
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		sc.cfg.Logger.Warn("loading queued job; starting over",
+			zap.String("key", sc.key()),
+			zap.Error(err))
+	}
+	sc.job.Queued = time.Now()
+	sc.store(ctx)
+	return sc.job.Queued, 0, time.Time{}
+}
+
+func (sc *storageCheckpoint) failed(ctx context.Context, attempts int, next time.Time, err error) {
+	sc.job.Attempts, sc.job.NextTry, sc.job.LastError = attempts, next, err.Error()
+	sc.store(ctx)
+}
+
+func (sc *storageCheckpoint) finished(ctx context.Context) {
+	if err := sc.cfg.Storage.Delete(ctx, sc.key()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		sc.cfg.Logger.Warn("deleting queued job",
+			zap.String("key", sc.key()),
+			zap.Error(err))
+	}
+}
+
+func (sc *storageCheckpoint) store(ctx context.Context) {
+	data, err := json.Marshal(sc.job)
+	if err == nil {
+		err = sc.cfg.Storage.Store(ctx, sc.key(), data)
+	}
+	if err != nil {
+		sc.cfg.Logger.Warn("persisting queued job",
+			zap.String("key", sc.key()),
+			zap.Error(err))
+	}
+}
+
+// QueuedJobs returns the jobs that are persisted in cfg's storage.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) QueuedJobs(ctx context.Context) ([]QueuedJob, error) {
+	keys, err := cfg.Storage.List(ctx, prefixQueue, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing queued jobs: %v", err)
+	}
+	var jobs []QueuedJob
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue // a directory
+		}
+		job, err := loadQueuedJob(ctx, cfg.Storage, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // finished in the meantime
+		}
+		if err != nil {
+			cfg.Logger.Warn("skipping unreadable queued job",
+				zap.String("key", key),
+				zap.Error(err))
+			continue
+		}
+		if (job.Kind != queuedObtain && job.Kind != queuedRenew) || len(job.Names) == 0 {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// ResumeQueue submits the jobs that are persisted in cfg's storage
+// (see PersistentQueue) in the background, where they continue with
+// the attempt count and backoff they had; it returns the number of
+// jobs submitted. Call it once at startup, before or after managing
+// certificates: jobs that are already queued are not duplicated.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) ResumeQueue(ctx context.Context) (int, error) {
+	jobs, err := cfg.QueuedJobs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range jobs {
+		cfg.Logger.Info("resuming queued job",
+			zap.String("kind", job.Kind),
+			zap.Strings("identifiers", job.Names),
+			zap.Int("attempts", job.Attempts),
+			zap.Time("next_try", job.NextTry))
+
+		switch job.Kind {
+		case queuedObtain:
+			for _, name := range job.Names {
+				jm.Submit(cfg.Logger, "obtain_"+name, func() error {
+					if err := cfg.ObtainCertAsync(ctx, name); err != nil {
+						return fmt.Errorf("%s: obtaining certificate: %w", name, err)
+					}
+					_, err := cfg.CacheManagedCertificate(ctx, name)
+					return err
+				})
+			}
+		case queuedRenew:
+			name := job.Names[0]
+			jm.Submit(cfg.Logger, "renew_"+name, func() error {
+				if err := cfg.RenewCertAsync(ctx, name, job.Force); err != nil {
+					return fmt.Errorf("%s: renewing certificate: %w", name, err)
+				}
+				_, err := cfg.CacheManagedCertificate(ctx, name)
+				return err
+			})
+		}
+	}
+	return len(jobs), nil
+}
+
+func loadQueuedJob(ctx context.Context, storage Storage, key string) (QueuedJob, error) {
+	var job QueuedJob
+	data, err := storage.Load(ctx, key)
+	if err != nil {
+		return job, err
+	}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, fmt.Errorf("decoding queued job %s: %v", key, err)
+	}
+	return job, nil
+}
+
+// queuedJobKey returns the storage key of the job of the given kind
+// for name.
+func queuedJobKey(kind, name string) string {
+	return path.Join(prefixQueue, kind, StorageKeys.Safe(name)+".json")
+}
+
+const prefixQueue = "queue"
@@ -0,0 +1,140 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestPersistentRetryCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		Storage:         &FileStorage{Path: t.TempDir()},
+		Logger:          defaultTestLogger,
+		PersistentQueue: true,
+	}
+	key := queuedJobKey(queuedRenew, "example.com")
+
+	// a failed attempt is recorded, and kept when the loop is canceled
+	failCtx, cancel := context.WithCancel(ctx)
+	err := doWithRetry(failCtx, defaultTestLogger, cfg.retryCheckpoint(queuedRenew, []string{"example.com"}, true), func(context.Context) error {
+		cancel()
+		return errors.New("validation failed")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected canceled retries, got %v", err)
+	}
+	job, err := loadQueuedJob(ctx, cfg.Storage, key)
+	if err != nil {
+		t.Fatalf("Expected persisted job: %v", err)
+	}
+	if job.Attempts != 1 || !job.Force || job.LastError != "validation failed" {
+		t.Errorf("Unexpected persisted job: %+v", job)
+	}
+	if wait := time.Until(job.NextTry); wait <= 0 || wait > retryIntervals[0] {
+		t.Errorf("Expected next try within %s, got %s", retryIntervals[0], wait)
+	}
+
+	// a resumed loop continues with the stored attempt count and
+	// next try, and forgets the job when it succeeds
+	job.NextTry = time.Now().Add(50 * time.Millisecond)
+	data, _ := json.Marshal(job)
+	if err := cfg.Storage.Store(ctx, key, data); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var attempts int
+	err = doWithRetry(ctx, defaultTestLogger, cfg.retryCheckpoint(queuedRenew, []string{"example.com"}, true), func(ctx context.Context) error {
+		attempts = *ctx.Value(AttemptsCtxKey).(*int)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected resumed attempt count 1, got %d", attempts)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected to wait until the next try, only waited %s", elapsed)
+	}
+	if _, err := cfg.Storage.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected finished job to be deleted, got %v", err)
+	}
+}
+
+func TestResumeQueue(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:         []Issuer{&testIssuer{}},
+		Storage:         &FileStorage{Path: t.TempDir()},
+		Logger:          defaultTestLogger,
+		OCSP:            OCSPConfig{DisableStapling: true},
+		KeySource:       StandardKeyGenerator{KeyType: P256},
+		PersistentQueue: true,
+	})
+	ctx := context.Background()
+
+	// a job left behind by a previous process
+	data, _ := json.Marshal(QueuedJob{
+		Kind:     queuedObtain,
+		Names:    []string{"resumed.example.com"},
+		Queued:   time.Now().Add(-time.Hour),
+		Attempts: 1,
+		NextTry:  time.Now().Add(-time.Minute),
+	})
+	if err := cfg.Storage.Store(ctx, queuedJobKey(queuedObtain, "resumed.example.com"), data); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := cfg.QueuedJobs(ctx)
+	if err != nil || len(jobs) != 1 || jobs[0].Names[0] != "resumed.example.com" {
+		t.Fatalf("Expected the queued job, got %+v (err=%v)", jobs, err)
+	}
+	n, err := cfg.ResumeQueue(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 resumed job, got %d (err=%v)", n, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cache.getAllMatchingCerts("resumed.example.com")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Resumed job did not obtain the certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		jobs, err := cfg.QueuedJobs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the finished job to be forgotten, still have %+v", jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// RevocationReason is the reason a certificate is revoked, as defined
+// by RFC 5280 §5.3.1.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationReason int
+
+// The revocation reasons of RFC 5280 §5.3.1. Code 7 is not used.
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonCACompromise         RevocationReason = 2
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonCertificateHold      RevocationReason = 6
+	ReasonRemoveFromCRL        RevocationReason = 8
+	ReasonPrivilegeWithdrawn   RevocationReason = 9
+	ReasonAACompromise         RevocationReason = 10
+)
+
+var revocationReasonNames = map[RevocationReason]string{
+	ReasonUnspecified:          "unspecified",
+	ReasonKeyCompromise:        "key_compromise",
+	ReasonCACompromise:         "ca_compromise",
+	ReasonAffiliationChanged:   "affiliation_changed",
+	ReasonSuperseded:           "superseded",
+	ReasonCessationOfOperation: "cessation_of_operation",
+	ReasonCertificateHold:      "certificate_hold",
+	ReasonRemoveFromCRL:        "remove_from_crl",
+	ReasonPrivilegeWithdrawn:   "privilege_withdrawn",
+	ReasonAACompromise:         "aa_compromise",
+}
+
+func (r RevocationReason) String() string {
+	if name, ok := revocationReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RevocationReason(%d)", int(r))
+}
+
+// RevocationOptions configures how certificates are revoked.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationOptions struct {
+	// Why the certificates are revoked. Issuers may
+	// not support all reasons; ACME CAs, for example,
+	// only accept some of them.
+	Reason RevocationReason
+
+	// Obtain new certificates for the names of the
+	// revoked ones right away, with new private keys,
+	// and cache them, so that the names are still
+	// served.
+	Reissue bool
+
+	// Whether someone is waiting for the result, as
+	// with ObtainCertSync; otherwise, reissuing is
+	// retried like in the background.
+	Interactive bool
+}
+
+// RevocationResult is the outcome of revoking a certificate.
+//
+// EXPERIMENTAL: Subject to change.
+type RevocationResult struct {
+	// The names of the certificate, and the key of
+	// the issuer it is stored for.
+	Names     []string
+	IssuerKey string
+
+	// The serial number of the certificate, in hex.
+	SerialNumber string
+
+	// The error of the issuer, or nil if the
+	// certificate was revoked.
+	Err error
+
+	// Whether a new certificate was obtained.
+	Reissued bool
+}
+
+// Revoke revokes the certificates for domain in storage, from all the
+// issuers of the config (and those of the certificates with alternate
+// keys) that have one. Revoked certificates are removed from the cache
+// and deleted from storage, so that they are neither served nor reused;
+// cert_revoked and cert_revocation_failed events are emitted for each.
+// If the reason is key compromise, see also RevokeByKey.
+//
+// The returned error joins the errors of the results and of reissuing.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) Revoke(ctx context.Context, domain string, opts RevocationOptions) ([]RevocationResult, error) {
+	cfg = cfg.current()
+	subjCfg := cfg.forSubject(domain)
+	issuers := subjCfg.Issuers
+	if alt := subjCfg.alternateKeyConfig(); alt != nil {
+		issuers = append(slices.Clip(issuers), alt.Issuers...)
+	}
+
+	var results []RevocationResult
+	for _, issuer := range issuers {
+		certRes, err := subjCfg.loadCertResource(ctx, issuer, domain)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return results, fmt.Errorf("loading certificate for %s from issuer %s: %w", domain, issuer.IssuerKey(), err)
+		}
+		results = append(results, subjCfg.revoke(ctx, issuer, domain, certRes, opts))
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no certificate for %s in storage: %w", domain, fs.ErrNotExist)
+	}
+	return results, cfg.finishRevocation(ctx, results, []string{domain}, opts)
+}
+
+// RevokeByKey revokes all certificates in storage from the issuers of the
+// config whose public key is key, like Revoke does. This is for when a
+// private key is compromised, which may be used by several certificates,
+// like when private keys are reused.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) RevokeByKey(ctx context.Context, key crypto.PublicKey, opts RevocationOptions) ([]RevocationResult, error) {
+	cfg = cfg.current()
+	var results []RevocationResult
+	var domains []string
+	for _, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		siteKeys, err := cfg.Storage.List(ctx, StorageKeys.CertsPrefix(issuerKey), false)
+		if err != nil {
+			continue // nothing stored for this issuer
+		}
+		for _, siteKey := range siteKeys {
+			domain, err := cfg.storedDomainWithKey(ctx, issuerKey, siteKey, key)
+			if err != nil {
+				cfg.Logger.Error("checking key of certificate in storage",
+					zap.String("site_key", siteKey),
+					zap.Error(err))
+				continue
+			}
+			if domain == "" {
+				continue
+			}
+			certRes, err := cfg.loadCertResource(ctx, issuer, domain)
+			if err != nil {
+				return results, fmt.Errorf("loading certificate for %s from issuer %s: %w", domain, issuerKey, err)
+			}
+			results = append(results, cfg.revoke(ctx, issuer, domain, certRes, opts))
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return results, cfg.finishRevocation(ctx, results, domains, opts)
+}
+
+// storedDomainWithKey returns the domain whose certificate is stored at
+// siteKey for issuerKey, if the certificate has the public key key.
+func (cfg *Config) storedDomainWithKey(ctx context.Context, issuerKey, siteKey string, key crypto.PublicKey) (string, error) {
+	assets, err := cfg.Storage.List(ctx, siteKey, false)
+	if err != nil {
+		return "", err
+	}
+	for _, assetKey := range assets {
+		if path.Ext(assetKey) != ".crt" {
+			continue
+		}
+		certPEM, err := cfg.Storage.Load(ctx, assetKey)
+		if err != nil {
+			return "", err
+		}
+		certs, err := parseCertsFromPEMBundle(certPEM)
+		if err != nil {
+			return "", err
+		}
+		if !publicKeysEqual(certs[0].PublicKey, key) {
+			return "", nil
+		}
+
+		// the name of the folder may not be reversible,
+		// so find the name the metadata is stored under
+		metaJSON, err := cfg.Storage.Load(ctx, assetKey[:len(assetKey)-len(".crt")]+".json")
+		if err != nil {
+			return "", err
+		}
+		var certRes CertificateResource
+		if err := json.Unmarshal(metaJSON, &certRes); err != nil {
+			return "", fmt.Errorf("decoding certificate metadata: %v", err)
+		}
+		for _, domain := range certRes.storageKeys() {
+			if StorageKeys.CertsSitePrefix(issuerKey, domain) == siteKey {
+				return domain, nil
+			}
+		}
+		return "", fmt.Errorf("certificate metadata has no name for %s", siteKey)
+	}
+	return "", nil
+}
+
+// revoke revokes certRes, which is stored for domain by issuer, and
+// removes it from the cache and storage if it was revoked.
+func (cfg *Config) revoke(ctx context.Context, issuer Issuer, domain string, certRes CertificateResource, opts RevocationOptions) RevocationResult {
+	issuerKey := issuer.IssuerKey()
+	result := RevocationResult{Names: certRes.SANs, IssuerKey: issuerKey}
+	certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.SerialNumber = certs[0].SerialNumber.Text(16)
+
+	eventData := map[string]any{
+		"identifiers":   certRes.SANs,
+		"issuer":        issuerKey,
+		"reason":        opts.Reason.String(),
+		"serial_number": result.SerialNumber,
+	}
+
+	rev, ok := issuer.(Revoker)
+	if !cfg.Storage.Exists(ctx, StorageKeys.SitePrivateKey(issuerKey, domain)) {
+		result.Err = fmt.Errorf("private key not found for %s", certRes.SANs)
+	} else if !ok {
+		result.Err = fmt.Errorf("issuer %s is not a Revoker", issuerKey)
+	} else if err := rev.Revoke(withConfig(ctx, cfg), certRes, int(opts.Reason)); err != nil {
+		result.Err = fmt.Errorf("issuer %s: %w", issuerKey, err)
+	}
+	if result.Err != nil {
+		eventData["error"] = result.Err.Error()
+		cfg.emit(ctx, "cert_revocation_failed", eventData)
+		return result
+	}
+
+	cfg.Logger.Info("revoked certificate",
+		zap.Strings("identifiers", certRes.SANs),
+		zap.String("issuer", issuerKey),
+		zap.Stringer("reason", opts.Reason),
+		zap.String("serial_number", result.SerialNumber))
+	cfg.emit(ctx, "cert_revoked", eventData)
+
+	// don't serve the revoked certificate anymore
+	cfg.certCache.mu.Lock()
+	for _, name := range certRes.SANs {
+		for _, cert := range cfg.certCache.getAllMatchingCerts(name) {
+			if cert.issuerKey == issuerKey && cert.Leaf != nil && cert.Leaf.SerialNumber.Cmp(certs[0].SerialNumber) == 0 {
+				cfg.certCache.removeCertificate(cert)
+			}
+		}
+	}
+	cfg.certCache.mu.Unlock()
+
+	// and don't reuse it, or its key
+	names := append([]string{domain}, slices.DeleteFunc(slices.Clone(certRes.SANs), func(san string) bool { return san == domain })...)
+	if err := cfg.deleteCertAssets(ctx, issuerKey, names, "revoked"); err != nil {
+		result.Err = fmt.Errorf("certificate revoked, but unable to fully clean up assets from issuer %s: %v", issuerKey, err)
+	}
+	return result
+}
+
+// finishRevocation reissues the certificates for domains, if configured,
+// and returns the errors of the results and of reissuing.
+func (cfg *Config) finishRevocation(ctx context.Context, results []RevocationResult, domains []string, opts RevocationOptions) error {
+	var errs []error
+	for _, result := range results {
+		errs = append(errs, result.Err)
+	}
+	if !opts.Reissue {
+		return errors.Join(errs...)
+	}
+	for _, domain := range domains {
+		err := cfg.obtainCert(ctx, domain, opts.Interactive)
+		if err == nil {
+			_, err = cfg.CacheManagedCertificate(ctx, domain)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reissuing certificate for %s: %w", domain, err))
+			continue
+		}
+		for i := range results {
+			if results[i].Err == nil && slices.Contains(results[i].Names, domain) {
+				results[i].Reissued = true
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	issuer := &revokingTestIssuer{}
+	var mu sync.Mutex
+	var events []map[string]any
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{issuer},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "cert_revoked" {
+				mu.Lock()
+				events = append(events, data)
+				mu.Unlock()
+			}
+			return nil
+		},
+	})
+	issuerKey := issuer.IssuerKey()
+
+	if err := cfg.ManageSync(ctx, []string{"a.example.com", "b.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	certA := cache.getAllMatchingCerts("a.example.com")[0]
+
+	// only the certificate with the compromised key is revoked
+	results, err := cfg.RevokeByKey(ctx, certA.Leaf.PublicKey, RevocationOptions{Reason: ReasonKeyCompromise})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Names[0] != "a.example.com" || results[0].Reissued {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	if len(cache.getAllMatchingCerts("a.example.com")) != 0 || cfg.Storage.Exists(ctx, StorageKeys.SiteCert(issuerKey, "a.example.com")) {
+		t.Error("Expected revoked certificate to be removed from cache and storage")
+	}
+	if len(cache.getAllMatchingCerts("b.example.com")) != 1 {
+		t.Error("Expected certificate with another key to stay in the cache")
+	}
+
+	// a revoked certificate can be replaced right away
+	certB := cache.getAllMatchingCerts("b.example.com")[0]
+	results, err = cfg.Revoke(ctx, "b.example.com", RevocationOptions{Reason: ReasonSuperseded, Reissue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !results[0].Reissued {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	reissued := cache.getAllMatchingCerts("b.example.com")
+	if len(reissued) != 1 || reissued[0].hash == certB.hash || publicKeysEqual(reissued[0].Leaf.PublicKey, certB.Leaf.PublicKey) {
+		t.Error("Expected certificate to be reissued with a new key")
+	}
+
+	if _, err := cfg.Revoke(ctx, "a.example.com", RevocationOptions{}); err == nil {
+		t.Error("Expected error revoking certificate that is not in storage")
+	}
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	if len(issuer.reasons) != 2 || issuer.reasons[0] != int(ReasonKeyCompromise) || issuer.reasons[1] != int(ReasonSuperseded) {
+		t.Errorf("Unexpected reasons given to issuer: %v", issuer.reasons)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0]["reason"] != "key_compromise" || events[1]["serial_number"] != results[0].SerialNumber {
+		t.Errorf("Unexpected events: %v", events)
+	}
+}
+
+// revokingTestIssuer is a testIssuer that records revocations.
+type revokingTestIssuer struct {
+	testIssuer
+	reasons []int
+}
+
+func (ri *revokingTestIssuer) Revoke(_ context.Context, _ CertificateResource, reason int) error {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.reasons = append(ri.reasons, reason)
+	return nil
+}
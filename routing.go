@@ -0,0 +1,204 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoutingTable is a snapshot of which certificates are served for which
+// server names (SNI values), for keeping load balancers or external TLS
+// terminators in sync with the cache. It can be marshaled to JSON.
+//
+// EXPERIMENTAL: Subject to change.
+type RoutingTable struct {
+	// Incremented every time certificates are added to or
+	// removed from the cache.
+	Version uint64 `json:"version"`
+
+	// The config's DefaultServerName and FallbackServerName,
+	// whose certificates are served for ClientHellos without
+	// SNI, and for names without a certificate, respectively.
+	DefaultServerName  string `json:"default_server_name,omitempty"`
+	FallbackServerName string `json:"fallback_server_name,omitempty"`
+
+	// The routes, sorted by name.
+	Routes []Route `json:"routes"`
+}
+
+// Route is the certificates for a server name or wildcard pattern.
+type Route struct {
+	// The name, like "example.com", "*.example.com", or an
+	// IP address.
+	Name string `json:"name"`
+
+	// Whether Name is a wildcard pattern, which matches
+	// names one label deeper.
+	Wildcard bool `json:"wildcard,omitempty"`
+
+	// The certificates for the name, in the order in which
+	// they are considered; by default, the first one which
+	// is valid and which the client supports is served.
+	Certificates []RoutedCertificate `json:"certificates"`
+}
+
+// RoutedCertificate describes a certificate in the routing table.
+type RoutedCertificate struct {
+	// The hash of the certificate, which identifies it in
+	// the cache (see Cache.Remove).
+	Hash string `json:"hash"`
+
+	// All names of the certificate.
+	Names []string `json:"names"`
+
+	// Whether the certificate is managed, and if so, the
+	// key of the issuer that issued it.
+	Managed   bool   `json:"managed,omitempty"`
+	IssuerKey string `json:"issuer_key,omitempty"`
+
+	Tags      []string  `json:"tags,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// RoutingTable returns the current routing table of the config's
+// certificate cache.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) RoutingTable() RoutingTable {
+	table := cfg.certCache.RoutingTable()
+	table.DefaultServerName = cfg.DefaultServerName
+	table.FallbackServerName = cfg.FallbackServerName
+	return table
+}
+
+// RoutingTable returns the current routing table of the cache. The
+// default and fallback server names are configured per Config; use
+// Config.RoutingTable to include them.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) RoutingTable() RoutingTable {
+	certCache.mu.Lock()
+	defer certCache.mu.Unlock()
+
+	table := RoutingTable{Version: certCache.routing.version}
+	var names []string
+	certCache.cacheIndex.Load().rangeAll(func(name string, _ []string) {
+		names = append(names, name)
+	})
+	slices.Sort(names)
+	for _, name := range names {
+		route := Route{Name: name, Wildcard: strings.HasPrefix(name, "*.")}
+		for _, cert := range certCache.getAllMatchingCerts(name) {
+			var routed RoutedCertificate
+			routed.Hash = cert.hash
+			routed.Names = cert.Names
+			routed.Managed = cert.managed
+			routed.IssuerKey = cert.issuerKey
+			routed.Tags = cert.Tags
+			if cert.Leaf != nil {
+				routed.NotBefore = cert.Leaf.NotBefore
+				routed.NotAfter = expiresAt(cert.Leaf)
+			}
+			route.Certificates = append(route.Certificates, routed)
+		}
+		if len(route.Certificates) > 0 {
+			table.Routes = append(table.Routes, route)
+		}
+	}
+	return table
+}
+
+// RoutingTableChanged returns a channel that is closed the next time the
+// routing table changes. To stay in sync, get the routing table, then
+// wait for the channel to be closed, and repeat:
+//
+//	for {
+//		changed := cache.RoutingTableChanged()
+//		sync(cfg.RoutingTable())
+//		<-changed
+//	}
+//
+// Getting the channel before the table ensures that no change is missed.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) RoutingTableChanged() <-chan struct{} {
+	return certCache.routing.changed()
+}
+
+// RoutingTableHandler returns a handler that responds with the config's
+// routing table as JSON. If the request has a "version" query parameter
+// equal to the current version, the response is delayed until the table
+// changes or the request is canceled (long polling), so that clients can
+// pass the version they have to be told about the next change.
+//
+// The routing table reveals all names the config has certificates for,
+// so the handler should only be reachable by trusted clients.
+//
+// EXPERIMENTAL: Subject to change.
+func (cfg *Config) RoutingTableHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changed := cfg.certCache.RoutingTableChanged()
+		table := cfg.RoutingTable()
+		if have := r.URL.Query().Get("version"); have != "" {
+			if version, err := strconv.ParseUint(have, 10, 64); err == nil && version == table.Version {
+				select {
+				case <-changed:
+					table = cfg.RoutingTable()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(table)
+	})
+}
+
+// routingState tracks changes to which certificates are in the cache.
+type routingState struct {
+	mu      sync.Mutex
+	version uint64
+	ch      chan struct{}
+}
+
+// changed returns a channel that is closed at the next change.
+func (rs *routingState) changed() <-chan struct{} {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.ch == nil {
+		rs.ch = make(chan struct{})
+	}
+	return rs.ch
+}
+
+// notify records a change and wakes up those waiting for one. Callers
+// must hold the cache's lock, so that the version matches the contents
+// of the cache.
+func (rs *routingState) notify() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.version++
+	if rs.ch != nil {
+		close(rs.ch)
+		rs.ch = nil
+	}
+}
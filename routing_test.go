@@ -0,0 +1,101 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoutingTable(t *testing.T) {
+	cache := &Cache{logger: defaultTestLogger}
+	cfg := &Config{Logger: defaultTestLogger, certCache: cache, DefaultServerName: "example.com"}
+	leaf := &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}
+
+	changed := cache.RoutingTableChanged()
+	cache.cacheCertificate(Certificate{
+		Names:       []string{"example.com", "*.example.com"},
+		Certificate: tls.Certificate{Leaf: leaf},
+		hash:        "a",
+		managed:     true,
+	})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Expected change to be notified")
+	}
+	cache.cacheCertificate(Certificate{Names: []string{"example.com"}, hash: "b"})
+
+	table := cfg.RoutingTable()
+	if table.Version != 2 || table.DefaultServerName != "example.com" || len(table.Routes) != 2 {
+		t.Fatalf("Unexpected table: %+v", table)
+	}
+	wildcard, exact := table.Routes[0], table.Routes[1]
+	if wildcard.Name != "*.example.com" || !wildcard.Wildcard || len(wildcard.Certificates) != 1 {
+		t.Errorf("Unexpected wildcard route: %+v", wildcard)
+	}
+	if exact.Name != "example.com" || exact.Wildcard || len(exact.Certificates) != 2 || exact.Certificates[1].Hash != "b" {
+		t.Errorf("Unexpected route: %+v", exact)
+	}
+	if c := exact.Certificates[0]; !c.Managed || !c.NotAfter.Equal(expiresAt(leaf)) {
+		t.Errorf("Unexpected certificate: %+v", c)
+	}
+
+	changed = cache.RoutingTableChanged()
+	cache.Remove([]string{"a", "b"})
+	<-changed
+	if table := cfg.RoutingTable(); len(table.Routes) != 0 || table.Version <= 2 {
+		t.Errorf("Expected empty routing table after removal, got %+v", table)
+	}
+}
+
+func TestRoutingTableHandler(t *testing.T) {
+	cache := &Cache{logger: defaultTestLogger}
+	cfg := &Config{Logger: defaultTestLogger, certCache: cache}
+	server := httptest.NewServer(cfg.RoutingTableHandler())
+	defer server.Close()
+
+	get := func(query string) RoutingTable {
+		resp, err := server.Client().Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var table RoutingTable
+		if err := json.NewDecoder(resp.Body).Decode(&table); err != nil {
+			t.Fatal(err)
+		}
+		return table
+	}
+
+	table := get("")
+	if table.Version != 0 || len(table.Routes) != 0 {
+		t.Fatalf("Unexpected table: %+v", table)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cache.cacheCertificate(Certificate{Names: []string{"example.com"}, hash: "a"})
+	}()
+	table = get(fmt.Sprintf("?version=%d", table.Version))
+	if table.Version != 1 || len(table.Routes) != 1 || table.Routes[0].Name != "example.com" {
+		t.Errorf("Expected long poll to return changed table, got %+v", table)
+	}
+}
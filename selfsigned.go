@@ -0,0 +1,203 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// SelfSignedFallback serves ephemeral self-signed certificates to
+// handshakes that fail because a certificate is not allowed or could
+// not be obtained, so that the handshake completes and the application
+// can serve an error page instead. (Clients will not trust these
+// certificates, of course.) Certificates mirror the requested server
+// name, are short-lived, and are cached in memory. Use its
+// OnHandshakeFailure method as Config.OnHandshakeFailure:
+//
+//	cfg.OnHandshakeFailure = (&certmagic.SelfSignedFallback{}).OnHandshakeFailure
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SelfSignedFallback struct {
+	// The kinds of handshake errors (see HandshakeError) to
+	// serve a fallback certificate for. Default:
+	// ErrNameNotAllowed, ErrCARejected, and ErrObtainTimeout.
+	Kinds []error
+
+	// How to respond to other failures. Default:
+	// RespondInternalError.
+	Otherwise HandshakeResponse
+
+	// How long fallback certificates are valid.
+	// Default: 1 hour.
+	Lifetime time.Duration
+
+	// The organization in the subject of fallback
+	// certificates, which browsers may show.
+	Organization string
+
+	// The type of key of fallback certificates; all of
+	// them share one key. Default: P256.
+	KeyType KeyType
+
+	// The maximum number of fallback certificates to
+	// cache. Default: 1000.
+	MaxCached int
+
+	mu    sync.Mutex
+	key   crypto.Signer
+	certs map[string]*tls.Certificate
+}
+
+// OnHandshakeFailure is a HandshakeFailureFunc that serves a fallback
+// certificate for hello if err is of one of the configured kinds.
+func (ssf *SelfSignedFallback) OnHandshakeFailure(_ context.Context, hello *tls.ClientHelloInfo, err error) (HandshakeResponse, *tls.Certificate) {
+	if !ssf.handles(err) {
+		return ssf.Otherwise, nil
+	}
+	cert, genErr := ssf.Certificate(fallbackName(hello))
+	if genErr != nil {
+		return ssf.Otherwise, nil
+	}
+	return RespondWithCertificate, cert
+}
+
+func (ssf *SelfSignedFallback) handles(err error) bool {
+	kinds := ssf.Kinds
+	if len(kinds) == 0 {
+		kinds = []error{ErrNameNotAllowed, ErrCARejected, ErrObtainTimeout}
+	}
+	for _, kind := range kinds {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// Certificate returns a self-signed certificate for name, which is a
+// DNS name or an IP address, from the cache or newly generated.
+func (ssf *SelfSignedFallback) Certificate(name string) (*tls.Certificate, error) {
+	lifetime := ssf.Lifetime
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+	now := time.Now()
+
+	ssf.mu.Lock()
+	defer ssf.mu.Unlock()
+
+	// serve cached certificates for the first half of their lifetime
+	if cert, ok := ssf.certs[name]; ok && now.Before(cert.Leaf.NotAfter.Add(-lifetime/2)) {
+		return cert, nil
+	}
+
+	if ssf.key == nil {
+		keyType := ssf.KeyType
+		if keyType == "" {
+			keyType = P256
+		}
+		key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("generating fallback key: %v", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("fallback key %T is not a signer", key)
+		}
+		ssf.key = signer
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ssf.Organization != "" {
+		tmpl.Subject.Organization = []string{ssf.Organization}
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else if name != "" {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, ssf.key.Public(), ssf.key)
+	if err != nil {
+		return nil, fmt.Errorf("creating fallback certificate for %s: %v", name, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: ssf.key, Leaf: leaf}
+
+	maxCached := ssf.MaxCached
+	if maxCached <= 0 {
+		maxCached = 1000
+	}
+	if ssf.certs == nil {
+		ssf.certs = make(map[string]*tls.Certificate)
+	}
+	if _, ok := ssf.certs[name]; !ok && len(ssf.certs) >= maxCached {
+		// evict expiring certificates, or any one if there are none
+		for n, c := range ssf.certs {
+			if now.After(c.Leaf.NotAfter.Add(-lifetime / 2)) {
+				delete(ssf.certs, n)
+			}
+		}
+		for n := range ssf.certs {
+			if len(ssf.certs) < maxCached {
+				break
+			}
+			delete(ssf.certs, n)
+		}
+	}
+	ssf.certs[name] = cert
+
+	return cert, nil
+}
+
+// fallbackName returns the name a fallback certificate for hello is
+// for: its server name, or the IP address it was sent to if it has
+// none.
+func fallbackName(hello *tls.ClientHelloInfo) string {
+	if name := normalizedName(hello.ServerName); name != "" {
+		return name
+	}
+	if hello.Conn != nil {
+		if host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
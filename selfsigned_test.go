@@ -0,0 +1,69 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedFallback(t *testing.T) {
+	ssf := &SelfSignedFallback{Lifetime: 10 * time.Minute, Organization: "Example", MaxCached: 2}
+	ctx := context.Background()
+	hello := &tls.ClientHelloInfo{ServerName: "Denied.Example.com"}
+
+	response, cert := ssf.OnHandshakeFailure(ctx, hello, HandshakeError{Kind: ErrNameNotAllowed, Name: "denied.example.com"})
+	if response != RespondWithCertificate || cert == nil {
+		t.Fatalf("Expected a fallback certificate, got %v", response)
+	}
+	leaf := cert.Leaf
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "denied.example.com" || leaf.Subject.Organization[0] != "Example" {
+		t.Errorf("Unexpected fallback certificate: names=%v subject=%v", leaf.DNSNames, leaf.Subject)
+	}
+	if lifetime := leaf.NotAfter.Sub(time.Now()); lifetime > 10*time.Minute {
+		t.Errorf("Expected a short-lived certificate, got lifetime %s", lifetime)
+	}
+
+	// cached
+	if _, again := ssf.OnHandshakeFailure(ctx, hello, HandshakeError{Kind: ErrCARejected}); again != cert {
+		t.Error("Expected the cached fallback certificate")
+	}
+
+	// other failures are not handled
+	if response, cert := ssf.OnHandshakeFailure(ctx, hello, HandshakeError{Kind: ErrNoCertAvailable}); response != RespondInternalError || cert != nil {
+		t.Errorf("Expected no fallback for unknown names, got %v", response)
+	}
+	if response, _ := ssf.OnHandshakeFailure(ctx, hello, errors.New("other")); response != RespondInternalError {
+		t.Errorf("Expected no fallback for other errors, got %v", response)
+	}
+
+	// IP addresses, and the cache is bounded
+	ipCert, err := ssf.Certificate("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ipCert.Leaf.IPAddresses) != 1 || !ipCert.Leaf.IPAddresses[0].Equal([]byte{192, 0, 2, 1}) {
+		t.Errorf("Expected IP SAN, got %v", ipCert.Leaf.IPAddresses)
+	}
+	if _, err := ssf.Certificate("third.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ssf.certs) != 2 {
+		t.Errorf("Expected at most 2 cached certificates, got %d", len(ssf.certs))
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ServerNamePolicy configures how the server names (SNI values) of TLS
+// handshakes are normalized before certificates are looked up for them.
+// The zero value converts internationalized names with the IDNA Lookup
+// profile and matches names exactly (apart from case).
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ServerNamePolicy struct {
+	// How internationalized names are converted
+	// to ASCII (punycode). Default: IDNLookup.
+	IDNProfile IDNProfile
+
+	// Match names with a trailing dot, which some
+	// clients send, to the certificates for the names
+	// without it. The ClientHello given to hooks like
+	// the on-demand DecisionFunc still has the dot.
+	MatchTrailingDot bool
+
+	// An optional function that normalizes server names
+	// before they are converted to ASCII, for example to
+	// map nonstandard names that some clients send. An
+	// error aborts the handshake.
+	Normalize func(serverName string) (string, error)
+}
+
+func (p ServerNamePolicy) isZero() bool {
+	return p.IDNProfile == IDNLookup && !p.MatchTrailingDot && p.Normalize == nil
+}
+
+// toASCII normalizes serverName according to the policy.
+func (p ServerNamePolicy) toASCII(serverName string) (string, error) {
+	name := strings.TrimSpace(serverName)
+	if p.Normalize != nil {
+		var err error
+		name, err = p.Normalize(name)
+		if err != nil {
+			return "", err
+		}
+	}
+	if p.MatchTrailingDot {
+		name = strings.TrimSuffix(name, ".")
+	}
+	profile, err := p.IDNProfile.profile()
+	if err != nil {
+		return "", err
+	}
+	return profile.ToASCII(name)
+}
+
+// IDNProfile is a profile for converting internationalized
+// domain names to ASCII; see package idna.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type IDNProfile int
+
+const (
+	// IDNLookup uses the profile that RFC 5891 section 5
+	// recommends for lookups, which rejects names that
+	// are not valid host names, like those with "_".
+	// This is the default.
+	IDNLookup IDNProfile = iota
+
+	// IDNRegistration uses the stricter profile for
+	// registering names, which also rejects names
+	// that are not in normalized form.
+	IDNRegistration
+
+	// IDNPermissive maps names like IDNLookup, but
+	// accepts any label, like those with "_" or
+	// leading hyphens.
+	IDNPermissive
+)
+
+var idnPermissive = idna.New(
+	idna.MapForLookup(),
+	idna.StrictDomainName(false),
+	idna.ValidateLabels(false),
+)
+
+func (p IDNProfile) profile() (*idna.Profile, error) {
+	switch p {
+	case IDNLookup:
+		return idna.Lookup, nil
+	case IDNRegistration:
+		return idna.Registration, nil
+	case IDNPermissive:
+		return idnPermissive, nil
+	}
+	return nil, fmt.Errorf("unknown IDN profile: %d", p)
+}
+
+func (p IDNProfile) String() string {
+	switch p {
+	case IDNLookup:
+		return "lookup"
+	case IDNRegistration:
+		return "registration"
+	case IDNPermissive:
+		return "permissive"
+	}
+	return fmt.Sprintf("IDNProfile(%d)", int(p))
+}
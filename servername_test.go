@@ -0,0 +1,97 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestServerNamePolicy(t *testing.T) {
+	stripPort := func(name string) (string, error) {
+		host, _, _ := strings.Cut(name, ":")
+		return host, nil
+	}
+	for i, tc := range []struct {
+		policy    ServerNamePolicy
+		input     string
+		expect    string
+		expectErr bool
+	}{
+		{input: "Example.COM", expect: "example.com"},
+		{input: "münchen.example", expect: "xn--mnchen-3ya.example"},
+		{input: "example.com.", expect: "example.com."},
+		{input: "my_host.corp", expectErr: true},
+		{policy: ServerNamePolicy{IDNProfile: IDNPermissive}, input: "My_Host.corp", expect: "my_host.corp"},
+		{policy: ServerNamePolicy{IDNProfile: IDNPermissive}, input: "-edge.münchen.example", expect: "-edge.xn--mnchen-3ya.example"},
+		{policy: ServerNamePolicy{IDNProfile: IDNRegistration}, input: "münchen.example", expect: "xn--mnchen-3ya.example"},
+		{policy: ServerNamePolicy{IDNProfile: IDNRegistration}, input: "Example.com", expectErr: true},
+		{policy: ServerNamePolicy{MatchTrailingDot: true}, input: "example.com.", expect: "example.com"},
+		{policy: ServerNamePolicy{Normalize: stripPort}, input: "example.com:443", expect: "example.com"},
+		{policy: ServerNamePolicy{IDNProfile: IDNProfile(42)}, input: "example.com", expectErr: true},
+	} {
+		actual, err := tc.policy.toASCII(tc.input)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error for %q, got %q", i, tc.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		} else if actual != tc.expect {
+			t.Errorf("Test %d: Expected %q, got %q", i, tc.expect, actual)
+		}
+	}
+}
+
+func TestServerNamePolicyCacheLookup(t *testing.T) {
+	const name = "xn--mnchen-3ya.example"
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers: []Issuer{&testIssuer{}},
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+		OCSP:    OCSPConfig{DisableStapling: true},
+	})
+	if err := cfg.ManageSync(context.Background(), []string{name}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		policy      ServerNamePolicy
+		serverName  string
+		expectMatch bool
+	}{
+		{serverName: name, expectMatch: true},
+		{serverName: name + "."},
+		{serverName: "münchen.example"},
+		{policy: ServerNamePolicy{MatchTrailingDot: true}, serverName: name + ".", expectMatch: true},
+		{policy: ServerNamePolicy{IDNProfile: IDNPermissive}, serverName: "MÜNCHEN.example", expectMatch: true},
+	} {
+		cfg.ServerNames = tc.policy
+		_, matched, _ := cfg.getCertificateFromCache(&tls.ClientHelloInfo{ServerName: tc.serverName})
+		if matched != tc.expectMatch {
+			t.Errorf("Test %d: Expected matched=%t for %q, got %t", i, tc.expectMatch, tc.serverName, matched)
+		}
+	}
+}
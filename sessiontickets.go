@@ -0,0 +1,265 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SessionTicketKeys generates, rotates, and distributes TLS session
+// ticket encryption keys (STEKs) through storage, so that servers
+// sharing storage also share ticket keys, and clients can resume
+// sessions with any of them. Without this, each server has its own
+// keys, and resumption only works with the server that issued the
+// ticket.
+//
+// Each rotation, the current key is retired (but kept for decrypting
+// existing tickets for a while) and replaced by the next key, which
+// was distributed to all servers one rotation earlier than it started
+// being used, so that tickets can be decrypted by every server as soon
+// as they are issued.
+//
+// The keys are stored unencrypted, and anyone who has them can decrypt
+// recorded TLS sessions that were resumed with them; if the storage is
+// not trusted with that, wrap it with EncryptedStorage.
+//
+// EXPERIMENTAL: Subject to change.
+type SessionTicketKeys struct {
+	// The storage to share keys through. REQUIRED.
+	Storage Storage
+
+	// How often to rotate the keys. Default: 12h.
+	RotationInterval time.Duration
+
+	// How many retired keys to keep for decrypting
+	// tickets issued before a rotation. Default: 2.
+	RetiredKeys int
+
+	// How often to check storage for keys rotated
+	// by other servers; must be shorter than
+	// RotationInterval. Default: RotationInterval/4.
+	CheckInterval time.Duration
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu      sync.Mutex
+	configs []*tls.Config
+	keys    [][32]byte // in the order given to tls.Config
+}
+
+// Start loads or creates the keys, applies them to the TLS configs
+// that were and will be registered, and keeps them up to date in the
+// background until ctx is canceled.
+func (stk *SessionTicketKeys) Start(ctx context.Context) error {
+	if stk.Storage == nil {
+		return fmt.Errorf("session ticket keys: no storage")
+	}
+	if stk.Logger == nil {
+		stk.Logger = zap.NewNop()
+	}
+	if err := stk.sync(ctx); err != nil {
+		return err
+	}
+	go stk.maintain(ctx)
+	return nil
+}
+
+// Register makes cfg use the shared session ticket keys. It can be
+// called before or after Start, and while cfg is in use.
+func (stk *SessionTicketKeys) Register(cfg *tls.Config) {
+	stk.mu.Lock()
+	defer stk.mu.Unlock()
+	stk.configs = append(stk.configs, cfg)
+	if len(stk.keys) > 0 {
+		cfg.SetSessionTicketKeys(stk.keys)
+	}
+}
+
+func (stk *SessionTicketKeys) maintain(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			stk.Logger.Error("panic: session ticket key maintenance", zap.Any("error", err))
+		}
+	}()
+
+	ticker := time.NewTicker(stk.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := stk.sync(ctx); err != nil {
+				stk.Logger.Error("updating session ticket keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// sync loads the keys from storage, rotating them if they are due,
+// and applies them to the registered configs if they changed.
+func (stk *SessionTicketKeys) sync(ctx context.Context) error {
+	stored, err := stk.load(ctx)
+	if err != nil || stored.due(stk.rotationInterval()) {
+		if errors.Is(err, fs.ErrNotExist) {
+			stk.Logger.Info("creating session ticket keys")
+		} else if err != nil {
+			stk.Logger.Error("replacing unusable session ticket keys", zap.Error(err))
+		}
+		stored, err = stk.rotate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the next key is given last, so it can decrypt
+	// but won't be used yet to encrypt tickets
+	keys := append(slices.Clone(stored.Keys[1:]), stored.Keys[0])
+
+	stk.mu.Lock()
+	defer stk.mu.Unlock()
+	if slices.Equal(keys, stk.keys) {
+		return nil
+	}
+	stk.keys = keys
+	for _, cfg := range stk.configs {
+		cfg.SetSessionTicketKeys(keys)
+	}
+	return nil
+}
+
+// rotate rotates the keys in storage, unless another server already
+// did while we waited for the lock, and returns the updated keys.
+func (stk *SessionTicketKeys) rotate(ctx context.Context) (storedSessionTicketKeys, error) {
+	if err := acquireLock(ctx, stk.Storage, sessionTicketKeysLockKey); err != nil {
+		return storedSessionTicketKeys{}, fmt.Errorf("unable to acquire lock: %v", err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, stk.Storage, sessionTicketKeysLockKey); err != nil {
+			stk.Logger.Error("unable to unlock", zap.String("lock_key", sessionTicketKeysLockKey), zap.Error(err))
+		}
+	}()
+
+	stored, err := stk.load(ctx)
+	if err == nil && !stored.due(stk.rotationInterval()) {
+		return stored, nil
+	}
+	if err != nil {
+		// start over; servers that had the old keys can't resume
+		// sessions anymore, but they will get the new keys soon
+		stored = storedSessionTicketKeys{}
+	}
+
+	// a fresh set needs both a next and a current key
+	for len(stored.Keys) < 2 {
+		key, err := newSessionTicketKey()
+		if err != nil {
+			return storedSessionTicketKeys{}, err
+		}
+		stored.Keys = append([][32]byte{key}, stored.Keys...)
+	}
+	if !stored.Rotated.IsZero() {
+		key, err := newSessionTicketKey()
+		if err != nil {
+			return storedSessionTicketKeys{}, err
+		}
+		stored.Keys = append([][32]byte{key}, stored.Keys...)
+	}
+	stored.Keys = stored.Keys[:min(len(stored.Keys), 2+stk.retiredKeys())]
+	stored.Rotated = time.Now().UTC()
+
+	storedJSON, err := json.Marshal(stored)
+	if err != nil {
+		return storedSessionTicketKeys{}, err
+	}
+	if err := stk.Storage.Store(ctx, sessionTicketKeysStorageKey, storedJSON); err != nil {
+		return storedSessionTicketKeys{}, fmt.Errorf("storing session ticket keys: %v", err)
+	}
+	stk.Logger.Info("rotated session ticket keys", zap.Int("keys", len(stored.Keys)))
+
+	return stored, nil
+}
+
+func (stk *SessionTicketKeys) load(ctx context.Context) (storedSessionTicketKeys, error) {
+	storedJSON, err := stk.Storage.Load(ctx, sessionTicketKeysStorageKey)
+	if err != nil {
+		return storedSessionTicketKeys{}, err
+	}
+	var stored storedSessionTicketKeys
+	if err := json.Unmarshal(storedJSON, &stored); err != nil {
+		return storedSessionTicketKeys{}, fmt.Errorf("decoding session ticket keys: %v", err)
+	}
+	if len(stored.Keys) < 2 {
+		return storedSessionTicketKeys{}, fmt.Errorf("expected at least 2 session ticket keys, found %d", len(stored.Keys))
+	}
+	return stored, nil
+}
+
+func (stk *SessionTicketKeys) rotationInterval() time.Duration {
+	if stk.RotationInterval > 0 {
+		return stk.RotationInterval
+	}
+	return 12 * time.Hour
+}
+
+func (stk *SessionTicketKeys) checkInterval() time.Duration {
+	if stk.CheckInterval > 0 {
+		return stk.CheckInterval
+	}
+	return stk.rotationInterval() / 4
+}
+
+func (stk *SessionTicketKeys) retiredKeys() int {
+	if stk.RetiredKeys > 0 {
+		return stk.RetiredKeys
+	}
+	return 2
+}
+
+// storedSessionTicketKeys is how session ticket keys are kept in storage.
+type storedSessionTicketKeys struct {
+	// The next key, then the current key, then retired keys.
+	Keys [][32]byte `json:"keys"`
+
+	// When the keys were last rotated.
+	Rotated time.Time `json:"rotated"`
+}
+
+func (s storedSessionTicketKeys) due(interval time.Duration) bool {
+	return time.Since(s.Rotated) >= interval
+}
+
+func newSessionTicketKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+const (
+	sessionTicketKeysStorageKey = "session_ticket_keys.json"
+	sessionTicketKeysLockKey    = "session_ticket_keys"
+)
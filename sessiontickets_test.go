@@ -0,0 +1,140 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	storage := &FileStorage{Path: tmpDir}
+
+	certPEM, keyPEM := mustGenerateTestCert(t, []string{"tickets.example.com"}, time.Now().Add(time.Hour))
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two servers sharing storage
+	var servers [2]*tls.Config
+	var managers [2]*SessionTicketKeys
+	for i := range servers {
+		servers[i] = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+		managers[i] = &SessionTicketKeys{Storage: storage, RotationInterval: time.Hour}
+		managers[i].Register(servers[i])
+		if err := managers[i].Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &tls.Config{
+		ServerName:         "tickets.example.com",
+		RootCAs:            roots,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	if testTLSResumption(t, client, servers[0]) {
+		t.Fatal("First connection should not be resumed")
+	}
+	if !testTLSResumption(t, client, servers[1]) {
+		t.Error("Expected session from one server to be resumed by the other")
+	}
+
+	// after a rotation, tickets from before it can still be decrypted,
+	// and both servers know the key that becomes current next
+	before := managers[0].keys
+	stored, err := managers[0].load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Rotated = time.Now().Add(-2 * time.Hour)
+	storedJSON, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(ctx, sessionTicketKeysStorageKey, storedJSON); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range managers {
+		if err := m.sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if m.keys[0] != before[len(before)-1] {
+			t.Errorf("Server %d: expected previous next key to become current", i)
+		}
+		if m.keys[1] != before[0] {
+			t.Errorf("Server %d: expected previous current key to be retired but kept", i)
+		}
+	}
+	if !testTLSResumption(t, client, servers[1]) {
+		t.Error("Expected session to be resumed after rotation")
+	}
+}
+
+// testTLSResumption makes a connection from client to server and
+// reports whether the session was resumed.
+func testTLSResumption(t *testing.T, client, server *tls.Config) bool {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		serverConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		conn := tls.Server(serverConn, server)
+		if err := conn.Handshake(); err != nil {
+			return
+		}
+		// session tickets are sent after the handshake in TLS 1.3
+		_, _ = conn.Write([]byte("x"))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	conn := tls.Client(clientConn, client)
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Reading: %v", err)
+	}
+	resumed := conn.ConnectionState().DidResume
+	conn.Close()
+	return resumed
+}
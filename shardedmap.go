@@ -0,0 +1,180 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	weakrand "math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// shardedMap is a map that is split into shards, each protected by
+// its own lock, so that concurrent access to different keys rarely
+// contends on the same lock. This matters during handshake storms on
+// machines with many cores, where a single RWMutex becomes a point of
+// contention even for readers (every RLock writes to the same word).
+//
+// The zero value is ready to use. Values are returned by copy, so
+// values that contain slices must be treated as immutable once stored.
+type shardedMap[V any] struct {
+	shards [mapShardCount]mapShard[V]
+	length atomic.Int64
+}
+
+type mapShard[V any] struct {
+	mu sync.RWMutex
+	m  map[string]V
+
+	// keep each shard's lock on its own cache line so
+	// that locking one shard doesn't slow down another
+	_ [64]byte
+}
+
+func (sm *shardedMap[V]) shard(key string) *mapShard[V] {
+	// FNV-1a, inlined to avoid allocating a hash.Hash
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &sm.shards[h%mapShardCount]
+}
+
+// load returns the value for key, if it exists.
+func (sm *shardedMap[V]) load(key string) (V, bool) {
+	shard := sm.shard(key)
+	shard.mu.RLock()
+	val, ok := shard.m[key]
+	shard.mu.RUnlock()
+	return val, ok
+}
+
+// store sets the value for key.
+func (sm *shardedMap[V]) store(key string, val V) {
+	sm.compute(key, func(V, bool) (V, bool) { return val, true })
+}
+
+// delete removes key from the map and returns the value it had, if any.
+func (sm *shardedMap[V]) delete(key string) (V, bool) {
+	var old V
+	var existed bool
+	sm.compute(key, func(val V, ok bool) (V, bool) {
+		old, existed = val, ok
+		return val, false
+	})
+	return old, existed
+}
+
+// update calls fn with a pointer to a copy of the value for key, if
+// it exists, and stores the modified copy, all atomically. It returns
+// false if key does not exist, in which case fn is not called.
+func (sm *shardedMap[V]) update(key string, fn func(*V)) bool {
+	var existed bool
+	sm.compute(key, func(val V, ok bool) (V, bool) {
+		existed = ok
+		if ok {
+			fn(&val)
+		}
+		return val, ok
+	})
+	return existed
+}
+
+// compute atomically replaces the value for key with the value returned
+// by fn, which is given the current value and whether it exists. If fn
+// returns false, key is deleted instead. fn must not access the map.
+func (sm *shardedMap[V]) compute(key string, fn func(val V, ok bool) (V, bool)) {
+	shard := sm.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	old, existed := shard.m[key]
+	val, keep := fn(old, existed)
+	switch {
+	case keep:
+		if shard.m == nil {
+			shard.m = make(map[string]V)
+		}
+		shard.m[key] = val
+		if !existed {
+			sm.length.Add(1)
+		}
+	case existed:
+		delete(shard.m, key)
+		sm.length.Add(-1)
+	}
+}
+
+// len returns the number of keys in the map.
+func (sm *shardedMap[V]) len() int {
+	return int(sm.length.Load())
+}
+
+// rangeAll calls fn for each key and value in the map. It locks one
+// shard at a time, so it does not see a consistent snapshot of the
+// whole map if it is being modified concurrently. fn is not called
+// while holding a lock, so it may access the map.
+func (sm *shardedMap[V]) rangeAll(fn func(key string, val V)) {
+	type kv struct {
+		key string
+		val V
+	}
+	var entries []kv
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		entries = entries[:0]
+		shard.mu.RLock()
+		for key, val := range shard.m {
+			entries = append(entries, kv{key, val})
+		}
+		shard.mu.RUnlock()
+		for _, e := range entries {
+			fn(e.key, e.val)
+		}
+	}
+}
+
+// random returns a random value of the map, chosen uniformly if the
+// map is not modified concurrently, without copying the map. It
+// returns false if the map is empty.
+func (sm *shardedMap[V]) random() (V, bool) {
+	var zero V
+	n := sm.len()
+	if n <= 0 {
+		return zero, false
+	}
+	skip := weakrand.Intn(n)
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mu.RLock()
+		if skip >= len(shard.m) {
+			skip -= len(shard.m)
+			shard.mu.RUnlock()
+			continue
+		}
+		for _, val := range shard.m {
+			if skip == 0 {
+				shard.mu.RUnlock()
+				return val, true
+			}
+			skip--
+		}
+		shard.mu.RUnlock()
+	}
+	return zero, false
+}
+
+// mapShardCount is the number of shards in a shardedMap; enough
+// that even machines with lots of cores seldom contend on a shard.
+const mapShardCount = 128
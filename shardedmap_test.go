@@ -0,0 +1,127 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedMap(t *testing.T) {
+	var sm shardedMap[int]
+
+	if _, ok := sm.load("nope"); ok {
+		t.Error("Expected no value in empty map")
+	}
+
+	// concurrently add, update, and remove keys
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				sm.store(key, j)
+				sm.update(key, func(v *int) { *v++ })
+				if j%2 == 0 {
+					sm.delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if sm.len() != 8*500 {
+		t.Errorf("Expected %d keys, got %d", 8*500, sm.len())
+	}
+	var count int
+	sm.rangeAll(func(key string, val int) {
+		count++
+		if val%2 != 0 {
+			t.Errorf("Expected updated (even) value for odd key %s, got %d", key, val)
+		}
+	})
+	if count != sm.len() {
+		t.Errorf("Expected rangeAll to visit %d keys, visited %d", sm.len(), count)
+	}
+
+	if sm.update("nope", func(*int) { t.Error("Update function called for missing key") }) {
+		t.Error("Expected update of missing key to report false")
+	}
+	if val, ok := sm.delete("0-1"); !ok || val != 2 {
+		t.Errorf("Expected to delete existing key with value 2, got %d (ok=%t)", val, ok)
+	}
+}
+
+// BenchmarkCacheLookup measures name lookups as performed during TLS
+// handshakes against a large cache, comparing the sharded cache with
+// the single-lock design it replaced. Run with e.g. -cpu 1,16,64 to see
+// how lookups scale with cores.
+func BenchmarkCacheLookup(b *testing.B) {
+	const numCerts = 20000
+
+	names := make([]string, numCerts)
+	certCache := &Cache{logger: defaultTestLogger}
+	singleLock := &singleLockCache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string)}
+	for i := range names {
+		names[i] = fmt.Sprintf("site%d.example.com", i)
+		cert := Certificate{Names: []string{names[i]}, hash: fmt.Sprintf("hash%d", i)}
+		certCache.unsyncedCacheCertificate(cert)
+		singleLock.cache[cert.hash] = cert
+		singleLock.cacheIndex[names[i]] = []string{cert.hash}
+	}
+
+	for _, bm := range []struct {
+		name   string
+		lookup func(string) []Certificate
+	}{
+		{"sharded", certCache.getAllMatchingCerts},
+		{"single_lock", singleLock.getAllMatchingCerts},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var next atomic.Uint64
+			b.RunParallel(func(pb *testing.PB) {
+				i := next.Add(7919) // spread goroutines across names
+				for pb.Next() {
+					i++
+					if len(bm.lookup(names[i%numCerts])) != 1 {
+						b.Error("Lookup failed")
+					}
+				}
+			})
+		})
+	}
+}
+
+// singleLockCache is the cache design before sharding, for comparison.
+type singleLockCache struct {
+	mu         sync.RWMutex
+	cache      map[string]Certificate
+	cacheIndex map[string][]string
+}
+
+func (c *singleLockCache) getAllMatchingCerts(subject string) []Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	allCertKeys := c.cacheIndex[subject]
+	certs := make([]Certificate, len(allCertKeys))
+	for i := range allCertKeys {
+		certs[i] = c.cache[allCertKeys[i]]
+	}
+	return certs
+}
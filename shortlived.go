@@ -0,0 +1,141 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"time"
+)
+
+// ShortLivedPolicy configures how short-lived certificates, like the
+// 6-day certificates of some CAs, are renewed. Their renewal windows
+// are so short that the RenewalWindowRatio suitable for certificates
+// that are valid for months would leave too little room for retries,
+// and renewing many certificates that were issued together at the
+// same point in their lifetime would renew all of them at once.
+//
+// EXPERIMENTAL: Subject to change.
+type ShortLivedPolicy struct {
+	// Certificates valid for at most this long are
+	// short-lived. Default: 10 days.
+	MaxLifetime time.Duration
+
+	// The renewal window ratio for short-lived
+	// certificates, instead of RenewalWindowRatio.
+	// Default: 0.5.
+	RenewalWindowRatio float64
+
+	// The fraction of the renewal window by which
+	// the start of the renewal of each short-lived
+	// certificate is delayed, chosen per certificate,
+	// to spread out renewals of certificates that
+	// were issued at the same time. Set to a negative
+	// value to disable. Default: 0.1.
+	Jitter float64
+}
+
+func (p ShortLivedPolicy) maxLifetime() time.Duration {
+	if p.MaxLifetime > 0 {
+		return p.MaxLifetime
+	}
+	return 10 * 24 * time.Hour
+}
+
+func (p ShortLivedPolicy) renewalWindowRatio() float64 {
+	if p.RenewalWindowRatio > 0 {
+		return p.RenewalWindowRatio
+	}
+	return 0.5
+}
+
+func (p ShortLivedPolicy) jitter() float64 {
+	if p.Jitter < 0 {
+		return 0
+	}
+	if p.Jitter > 0 {
+		return min(p.Jitter, 1)
+	}
+	return 0.1
+}
+
+// renewalWindowRatio returns the renewal window ratio for leaf, which
+// is RenewalWindowRatio unless leaf is short-lived, shortened by the
+// jitter of leaf.
+func (cfg *Config) renewalWindowRatio(leaf *x509.Certificate) float64 {
+	lifetime := expiresAt(leaf).Sub(leaf.NotBefore)
+	if lifetime <= 0 || lifetime > cfg.ShortLived.maxLifetime() {
+		ratio := cfg.RenewalWindowRatio
+		if ratio == 0 {
+			ratio = DefaultRenewalWindowRatio
+		}
+		return ratio * (1 - min(max(cfg.RenewalJitter, 0), 1)*renewalSpread(leaf))
+	}
+	ratio := cfg.ShortLived.renewalWindowRatio()
+	return ratio * (1 - cfg.ShortLived.jitter()*renewalSpread(leaf))
+}
+
+// renewalSpread returns a number in [0, 1) that is derived from
+// leaf, so that it is the same every time the certificate is
+// checked, by any instance, but differs between certificates.
+func renewalSpread(leaf *x509.Certificate) float64 {
+	sum := sha256.Sum256(leaf.Raw)
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// renewCheckInterval returns how often the certificates are checked
+// for renewal, which is RenewCheckInterval unless the cache has any
+// very short-lived managed certificates.
+func (certCache *Cache) renewCheckInterval() time.Duration {
+	if interval := time.Duration(certCache.effectiveRenewCheckInterval.Load()); interval > 0 {
+		return interval
+	}
+	certCache.optionsMu.RLock()
+	defer certCache.optionsMu.RUnlock()
+	return certCache.options.RenewCheckInterval
+}
+
+// updateRenewCheckInterval tightens the renewal check interval if
+// any managed certificate in the cache has a lifetime of less than
+// shortLivedCheckThreshold, or relaxes it to the configured interval
+// otherwise, and returns the interval.
+func (certCache *Cache) updateRenewCheckInterval() time.Duration {
+	certCache.optionsMu.RLock()
+	interval := certCache.options.RenewCheckInterval
+	certCache.optionsMu.RUnlock()
+
+	for _, cert := range certCache.getAllCerts() {
+		if cert.managed && cert.Lifetime() > 0 && cert.Lifetime() < shortLivedCheckThreshold {
+			interval = min(interval, shortLivedRenewCheckInterval)
+			break
+		}
+	}
+	certCache.effectiveRenewCheckInterval.Store(int64(interval))
+	return interval
+}
+
+const (
+	// shortLivedCheckThreshold is the lifetime below which
+	// certificates are checked for renewal more often, so
+	// that the renewal of certificates that are valid for
+	// only a day or so is not delayed by a big fraction of
+	// their lifetime.
+	shortLivedCheckThreshold = 48 * time.Hour
+
+	// shortLivedRenewCheckInterval is how often to check
+	// for renewals if there are such certificates.
+	shortLivedRenewCheckInterval = time.Minute
+)
@@ -0,0 +1,123 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShortLivedRenewalWindowRatio(t *testing.T) {
+	cfg := &Config{RenewalWindowRatio: DefaultRenewalWindowRatio}
+
+	makeCert := func(lifetime time.Duration) Certificate {
+		certPEM, keyPEM := mustGenerateTestCert(t, []string{"example.com"}, time.Now().Add(lifetime-time.Hour))
+		cert, err := makeCertificate(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	long := makeCert(90 * 24 * time.Hour)
+	if ratio := cfg.renewalWindowRatio(long.Leaf); ratio != DefaultRenewalWindowRatio {
+		t.Errorf("Expected ratio %v for long-lived certificate, got %v", DefaultRenewalWindowRatio, ratio)
+	}
+
+	for range 10 {
+		short := makeCert(6 * 24 * time.Hour)
+		ratio := cfg.renewalWindowRatio(short.Leaf)
+		if ratio > 0.5 || ratio < 0.45 {
+			t.Errorf("Expected jittered ratio between 0.45 and 0.5 for short-lived certificate, got %v", ratio)
+		}
+		if again := cfg.renewalWindowRatio(short.Leaf); again != ratio {
+			t.Errorf("Expected same ratio for same certificate, got %v and %v", ratio, again)
+		}
+	}
+
+	cfg.ShortLived = ShortLivedPolicy{RenewalWindowRatio: 0.6, Jitter: -1}
+	if ratio := cfg.renewalWindowRatio(makeCert(24 * time.Hour).Leaf); ratio != 0.6 {
+		t.Errorf("Expected configured ratio 0.6 without jitter, got %v", ratio)
+	}
+}
+
+func TestRenewalJitter(t *testing.T) {
+	cfg := &Config{RenewalWindowRatio: DefaultRenewalWindowRatio, RenewalJitter: 0.3}
+
+	var spread bool
+	var first float64
+	for i := range 10 {
+		certPEM, keyPEM := mustGenerateTestCert(t, []string{"example.com"}, time.Now().Add(90*24*time.Hour))
+		cert, err := makeCertificate(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ratio := cfg.renewalWindowRatio(cert.Leaf)
+		if ratio > DefaultRenewalWindowRatio || ratio < DefaultRenewalWindowRatio*0.7 {
+			t.Errorf("Expected jittered ratio within 30%% of the default, got %v", ratio)
+		}
+		if again := cfg.renewalWindowRatio(cert.Leaf); again != ratio {
+			t.Errorf("Expected same ratio for same certificate, got %v and %v", ratio, again)
+		}
+		if i == 0 {
+			first = ratio
+		} else if ratio != first {
+			spread = true
+		}
+	}
+	if !spread {
+		t.Error("Expected certificates to be spread over the renewal window")
+	}
+}
+
+func TestUpdateRenewCheckInterval(t *testing.T) {
+	cache := NewCache(CacheOptions{
+		GetConfigForCert:   func(Certificate) (*Config, error) { return &Config{}, nil },
+		RenewCheckInterval: time.Hour,
+		Logger:             defaultTestLogger,
+	})
+	defer cache.Stop()
+
+	cacheCert := func(lifetime time.Duration) Certificate {
+		certPEM, keyPEM := mustGenerateTestCert(t, []string{"example.com"}, time.Now().Add(lifetime-time.Hour))
+		cert, err := makeCertificate(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert.managed = true
+		cache.cacheCertificate(cert)
+		return cert
+	}
+
+	cacheCert(30 * 24 * time.Hour)
+	if interval := cache.updateRenewCheckInterval(); interval != time.Hour {
+		t.Errorf("Expected configured interval, got %v", interval)
+	}
+
+	short := cacheCert(24 * time.Hour)
+	if interval := cache.updateRenewCheckInterval(); interval != shortLivedRenewCheckInterval {
+		t.Errorf("Expected tightened interval %v, got %v", shortLivedRenewCheckInterval, interval)
+	}
+	if interval := cache.renewCheckInterval(); interval != shortLivedRenewCheckInterval {
+		t.Errorf("Expected effective interval %v, got %v", shortLivedRenewCheckInterval, interval)
+	}
+
+	cache.mu.Lock()
+	cache.removeCertificate(short)
+	cache.mu.Unlock()
+	if interval := cache.updateRenewCheckInterval(); interval != time.Hour {
+		t.Errorf("Expected interval to be relaxed again, got %v", interval)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// CertificateRecord describes a certificate in the cache at the time
+// of a snapshot. It is a copy; changing it changes nothing.
+//
+// EXPERIMENTAL: Subject to change.
+type CertificateRecord struct {
+	Names []string `json:"names"`
+	Hash  string   `json:"hash"`
+	Tags  []string `json:"tags,omitempty"`
+
+	// Whether the certificate is managed, and the key of
+	// the issuer it was issued by, if known.
+	Managed   bool   `json:"managed"`
+	IssuerKey string `json:"issuer_key,omitempty"`
+
+	// The common name of the certificate's issuer.
+	Issuer string `json:"issuer,omitempty"`
+
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// The status of the latest OCSP response ("good",
+	// "revoked", or "unknown"; empty if there is none),
+	// when it will be updated, and whether it is stapled.
+	OCSPStatus     string    `json:"ocsp_status,omitempty"`
+	OCSPNextUpdate time.Time `json:"ocsp_next_update,omitzero"`
+	OCSPStapled    bool      `json:"ocsp_stapled"`
+
+	// The renewal window suggested by the CA via ARI,
+	// and the time selected within it, if known.
+	ARIWindowStart  time.Time `json:"ari_window_start,omitzero"`
+	ARIWindowEnd    time.Time `json:"ari_window_end,omitzero"`
+	ARISelectedTime time.Time `json:"ari_selected_time,omitzero"`
+
+	// When the certificate was added to the cache, last
+	// used for a TLS handshake, and how many handshakes
+	// it was used for; these carry over from the
+	// certificate it replaced, like when it was renewed.
+	Added    time.Time `json:"added,omitzero"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+	Uses     uint64    `json:"uses"`
+}
+
+// Snapshot returns records of all certificates in the cache, ordered by
+// their first name. It does not block certificate operations or TLS
+// handshakes, so it can be called frequently, for example by health
+// checks; but the records are collected one at a time, so they don't
+// necessarily represent one moment.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) Snapshot() []CertificateRecord {
+	records := make([]CertificateRecord, 0, certCache.cache.len())
+	certCache.cache.rangeAll(func(hash string, cert Certificate) {
+		record := CertificateRecord{
+			Names:           slices.Clone(cert.Names),
+			Hash:            hash,
+			Tags:            slices.Clone(cert.Tags),
+			Managed:         cert.managed,
+			IssuerKey:       cert.issuerKey,
+			OCSPStapled:     len(cert.Certificate.OCSPStaple) > 0,
+			ARIWindowStart:  cert.ari.SuggestedWindow.Start,
+			ARIWindowEnd:    cert.ari.SuggestedWindow.End,
+			ARISelectedTime: cert.ari.SelectedTime,
+		}
+		if cert.Leaf != nil {
+			record.Issuer = cert.Leaf.Issuer.CommonName
+			record.NotBefore = cert.Leaf.NotBefore
+			record.NotAfter = cert.Leaf.NotAfter
+		}
+		if cert.ocsp != nil {
+			record.OCSPStatus = ocspStatusString(cert.ocsp.Status)
+			record.OCSPNextUpdate = cert.ocsp.NextUpdate
+		}
+		if usage, ok := certCache.usage.load(hash); ok {
+			record.Added = usage.added
+			record.Uses = usage.uses.Load()
+			if lastUsed := usage.lastUsed.Load(); lastUsed > 0 {
+				record.LastUsed = time.Unix(0, lastUsed)
+			}
+		}
+		records = append(records, record)
+	})
+	slices.SortFunc(records, func(a, b CertificateRecord) int {
+		var aName, bName string
+		if len(a.Names) > 0 {
+			aName = a.Names[0]
+		}
+		if len(b.Names) > 0 {
+			bName = b.Names[0]
+		}
+		if c := strings.Compare(aName, bName); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	return records
+}
+
+// IdleCertificates returns records of the managed certificates in the
+// cache that have not been used for a TLS handshake for at least idle
+// (or, if never used, were added to the cache at least that long ago).
+// They are candidates to stop managing, so they stop being renewed.
+// Usage is counted since the cache was created, and carries over from
+// certificates to their renewals.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) IdleCertificates(idle time.Duration) []CertificateRecord {
+	cutoff := time.Now().Add(-idle)
+	return slices.DeleteFunc(certCache.Snapshot(), func(record CertificateRecord) bool {
+		lastActive := record.LastUsed
+		if lastActive.IsZero() {
+			lastActive = record.Added
+		}
+		return !record.Managed || lastActive.After(cutoff)
+	})
+}
+
+func ocspStatusString(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	noop := func(Certificate) (*Config, error) { return new(Config), nil }
+	c := NewCache(CacheOptions{GetConfigForCert: noop, Logger: defaultTestLogger})
+	defer c.Stop()
+
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	nextUpdate := time.Now().Add(time.Hour)
+	c.cacheCertificate(Certificate{
+		Names: []string{"b.example.com"},
+		hash:  "b",
+		Certificate: tls.Certificate{
+			Leaf:       &x509.Certificate{NotAfter: notAfter, Issuer: pkix.Name{CommonName: "Test CA"}},
+			OCSPStaple: []byte("staple"),
+		},
+		managed:   true,
+		issuerKey: "test_issuer",
+		ocsp:      &ocsp.Response{Status: ocsp.Good, NextUpdate: nextUpdate},
+	})
+	c.cacheCertificate(Certificate{Names: []string{"a.example.com"}, hash: "a"})
+	c.recordUse("b")
+	c.recordUse("b")
+
+	records := c.Snapshot()
+	if len(records) != 2 || records[0].Hash != "a" || records[1].Hash != "b" {
+		t.Fatalf("Expected records ordered by name, got %+v", records)
+	}
+	b := records[1]
+	if !b.Managed || b.IssuerKey != "test_issuer" || b.Issuer != "Test CA" || !b.NotAfter.Equal(notAfter) {
+		t.Errorf("Unexpected certificate metadata: %+v", b)
+	}
+	if b.OCSPStatus != "good" || !b.OCSPNextUpdate.Equal(nextUpdate) || !b.OCSPStapled {
+		t.Errorf("Unexpected OCSP metadata: %+v", b)
+	}
+	if b.Uses != 2 || b.LastUsed.IsZero() || b.Added.IsZero() {
+		t.Errorf("Unexpected usage: %+v", b)
+	}
+
+	// records are copies
+	b.Names[0] = "changed"
+	if cert, _ := c.cache.load("b"); cert.Names[0] != "b.example.com" {
+		t.Error("Changing a record changed the cached certificate")
+	}
+}
+
+func TestIdleCertificates(t *testing.T) {
+	noop := func(Certificate) (*Config, error) { return new(Config), nil }
+	c := NewCache(CacheOptions{GetConfigForCert: noop, Logger: defaultTestLogger})
+	defer c.Stop()
+
+	old := Certificate{Names: []string{"idle.example.com"}, hash: "old", managed: true}
+	c.cacheCertificate(old)
+	c.cacheCertificate(Certificate{Names: []string{"busy.example.com"}, hash: "busy", managed: true})
+	c.cacheCertificate(Certificate{Names: []string{"unmanaged.example.com"}, hash: "unmanaged"})
+	c.recordUse("old")
+	c.recordUse("busy")
+
+	// usage carries over to the renewed certificate
+	c.replaceCertificate(old, Certificate{Names: []string{"idle.example.com"}, hash: "new", managed: true})
+	for _, hash := range []string{"new", "busy", "unmanaged"} {
+		c.usage.update(hash, func(u **certUsage) {
+			(*u).added = time.Now().Add(-48 * time.Hour)
+		})
+	}
+	c.usage.update("new", func(u **certUsage) {
+		(*u).lastUsed.Store(time.Now().Add(-24 * time.Hour).UnixNano())
+	})
+
+	idle := c.IdleCertificates(time.Hour)
+	if len(idle) != 1 || idle[0].Hash != "new" || idle[0].Uses != 1 {
+		t.Errorf("Expected only the renewed certificate to be idle, got %+v", idle)
+	}
+}
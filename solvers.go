@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"path"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -117,6 +118,212 @@ func (s *httpSolver) CleanUp(_ context.Context, _ acme.Challenge) error {
 	return nil
 }
 
+// HTTP01Solver solves the http-01 challenge with its own server or
+// handler, for when the port that the CA connects to is terminated by
+// a load balancer or reverse proxy that forwards challenge requests
+// elsewhere, rather than by a server whose handler can be wrapped with
+// HTTPChallengeHandler. Set it as the HTTP01Solver of an ACMEIssuer.
+//
+// EXPERIMENTAL: Subject to change.
+type HTTP01Solver struct {
+	// The address to listen on while challenges are being
+	// solved, like ":8080" or "10.0.0.2:8402". If empty, the
+	// solver doesn't listen, and challenge requests must be
+	// routed to its ServeHTTP method, e.g. by mounting it in
+	// an existing server or reverse proxy.
+	Address string
+
+	// Whether connections to Address begin with a PROXY
+	// protocol header (version 1 or 2), as sent by load
+	// balancers that are configured to preserve the client
+	// address. If enabled, the header is required.
+	ProxyProtocol bool
+
+	// An optional function that registers a route for a
+	// challenge with an external router, like an ingress
+	// controller or a load balancer, so that requests for it
+	// reach this solver. If it returns an unregister function,
+	// that is called when the challenge is cleaned up.
+	RegisterRoute func(ctx context.Context, route HTTP01Route) (unregister func(context.Context) error, err error)
+
+	// An optional logger.
+	Logger *zap.Logger
+
+	mu         sync.Mutex
+	challenges map[string][]acme.Challenge // keyed by identifier
+	unregister map[string]func(context.Context) error
+	server     *http.Server
+	listener   net.Listener
+	done       chan struct{}
+}
+
+// HTTP01Route describes where the requests for an http-01 challenge
+// must be routed to.
+//
+// EXPERIMENTAL: Subject to change.
+type HTTP01Route struct {
+	// The host name (or IP address) the CA will request,
+	// and the path of the request.
+	Host string
+	Path string
+
+	// The address the solver listens on, or empty if it
+	// doesn't listen by itself.
+	Address string
+}
+
+// Present makes the solver answer chal, starting its server if
+// needed, and registers a route for it if configured to.
+func (s *HTTP01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	route, err := s.add(chal)
+	if err != nil {
+		return err
+	}
+	if s.RegisterRoute == nil {
+		return nil
+	}
+	unregister, err := s.RegisterRoute(ctx, route)
+	if err != nil {
+		s.remove(chal)
+		return fmt.Errorf("registering route for HTTP challenge of %s: %w", route.Host, err)
+	}
+	if unregister != nil {
+		s.mu.Lock()
+		s.unregister[chal.Identifier.Value+"/"+chal.Token] = unregister
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// CleanUp stops answering chal, unregisters its route if it was
+// registered, and stops the server once no challenges are left.
+func (s *HTTP01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	s.mu.Lock()
+	key := chal.Identifier.Value + "/" + chal.Token
+	unregister := s.unregister[key]
+	delete(s.unregister, key)
+	s.mu.Unlock()
+
+	var err error
+	if unregister != nil {
+		if err = unregister(ctx); err != nil {
+			err = fmt.Errorf("unregistering route for HTTP challenge of %s: %w", chal.Identifier.Value, err)
+		}
+	}
+	s.remove(chal)
+	return err
+}
+
+// add adds chal to the challenges to answer, and starts listening
+// if it is the first one.
+func (s *HTTP01Solver) add(chal acme.Challenge) (HTTP01Route, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.challenges == nil {
+		s.challenges = make(map[string][]acme.Challenge)
+		s.unregister = make(map[string]func(context.Context) error)
+	}
+	if s.Address != "" && s.listener == nil {
+		ln, err := net.Listen("tcp", s.Address)
+		if err != nil {
+			return HTTP01Route{}, fmt.Errorf("listening for HTTP challenges: %w", err)
+		}
+		if s.ProxyProtocol {
+			ln = proxyProtocolListener{Listener: ln}
+		}
+		s.listener = ln
+		s.server = &http.Server{
+			Handler:           s,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		s.server.SetKeepAlivesEnabled(false)
+		s.done = make(chan struct{})
+		go func(server *http.Server, ln net.Listener, done chan struct{}) {
+			defer func() {
+				if err := recover(); err != nil {
+					buf := make([]byte, stackTraceBufferSize)
+					buf = buf[:runtime.Stack(buf, false)]
+					log.Printf("panic: http-01 solver server: %v\n%s", err, buf)
+				}
+			}()
+			defer close(done)
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				s.logger().Error("HTTP challenge server", zap.Error(err))
+			}
+		}(s.server, ln, s.done)
+		s.logger().Info("started HTTP challenge server", zap.String("address", ln.Addr().String()))
+	}
+
+	s.challenges[chal.Identifier.Value] = append(s.challenges[chal.Identifier.Value], chal)
+
+	route := HTTP01Route{
+		Host: chal.Identifier.Value,
+		Path: chal.HTTP01ResourcePath(),
+	}
+	if s.listener != nil {
+		route.Address = s.listener.Addr().String()
+	}
+	return route, nil
+}
+
+// remove removes chal from the challenges to answer, and stops
+// listening if it was the last one.
+func (s *HTTP01Solver) remove(chal acme.Challenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenges := s.challenges[chal.Identifier.Value]
+	for i, c := range challenges {
+		if c.Token == chal.Token {
+			challenges = append(challenges[:i], challenges[i+1:]...)
+			break
+		}
+	}
+	if len(challenges) == 0 {
+		delete(s.challenges, chal.Identifier.Value)
+	} else {
+		s.challenges[chal.Identifier.Value] = challenges
+	}
+
+	if len(s.challenges) == 0 && s.server != nil {
+		// last one out turns off the lights
+		s.server.Close()
+		<-s.done
+		s.logger().Info("stopped HTTP challenge server", zap.String("address", s.listener.Addr().String()))
+		s.server, s.listener, s.done = nil, nil, nil
+	}
+}
+
+// ServeHTTP answers requests for the challenges being solved by s,
+// or by any other solver in this process, and responds with 404 Not
+// Found to other requests.
+func (s *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := hostOnly(r.Host)
+
+	s.mu.Lock()
+	challenges := slices.Clone(s.challenges[host])
+	s.mu.Unlock()
+	if chal, ok := GetACMEChallenge(host); ok {
+		challenges = append(challenges, chal.Challenge)
+	}
+
+	for _, chal := range challenges {
+		if solveHTTPChallenge(s.logger(), w, r, chal, false) {
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *HTTP01Solver) logger() *zap.Logger {
+	logger := s.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return logger.Named("http01_solver")
+}
+
 // tlsALPNSolver is a type that can solve TLS-ALPN challenges.
 // It must have an associated config and address on which to
 // serve the challenge.
@@ -292,6 +499,7 @@ func (s *DNS01Solver) Wait(ctx context.Context, challenge acme.Challenge) error
 	if err != nil {
 		return err
 	}
+	defer issuanceTimerFromContext(ctx).track(dnsPropagationPhase)()
 	return s.DNSManager.wait(ctx, memory.zoneRec)
 }
 
@@ -342,7 +550,8 @@ type DNSManager struct {
 	TTL time.Duration
 
 	// How long to wait before starting propagation checks.
-	// Default: 0 (no wait).
+	// Default: the delay of the DNS provider, if it is a
+	// PropagationDelayer, or else 0 (no wait).
 	PropagationDelay time.Duration
 
 	// Maximum time to wait for temporary DNS record to appear.
@@ -353,6 +562,15 @@ type DNSManager struct {
 	// Preferred DNS resolver(s) to use when doing DNS lookups.
 	Resolvers []string
 
+	// If true, propagation is checked by querying every
+	// authoritative nameserver of the zone directly, without
+	// recursion, and the record must be served by all of them
+	// rather than just one. This bypasses caching resolvers
+	// and catches nameservers that haven't synced yet, which
+	// the CA might query. Resolvers are only used to find
+	// the nameservers. EXPERIMENTAL: Subject to change.
+	AuthoritativeOnly bool
+
 	// Override the domain to set the TXT record on. This is
 	// to delegate the challenge to a different domain. Note
 	// that the solver doesn't follow CNAME/NS record.
@@ -411,15 +629,19 @@ func (m *DNSManager) createRecord(ctx context.Context, dnsName, recordType, reco
 
 // wait blocks until the TXT record created in Present() appears in
 // authoritative lookups, i.e. until it has propagated, or until
-// timeout, whichever is first.
+// timeout, whichever is first. It emits "dns_propagation_progress"
+// events after each check.
 func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 	logger := m.logger()
 
 	// if configured to, pause before doing propagation checks
 	// (even if they are disabled, the wait might be desirable on its own)
-	if m.PropagationDelay > 0 {
+	if delay := m.propagationDelay(zrec.zone); delay > 0 {
+		logger.Debug("waiting before checking DNS propagation",
+			zap.String("zone", zrec.zone),
+			zap.Duration("delay", delay))
 		select {
-		case <-time.After(m.PropagationDelay):
+		case <-time.After(delay):
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -449,8 +671,9 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 	absName := libdns.AbsoluteName(zrec.record.Name, zrec.zone)
 
 	var err error
+	var pending []string
 	start := time.Now()
-	for time.Since(start) < timeout {
+	for attempt := 1; time.Since(start) < timeout; attempt++ {
 		select {
 		case <-time.After(interval):
 		case <-ctx.Done():
@@ -461,21 +684,81 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 			zap.String("fqdn", absName),
 			zap.String("record_type", zrec.record.Type),
 			zap.String("expected_value", zrec.record.Value),
-			zap.Strings("resolvers", resolvers))
+			zap.Strings("resolvers", resolvers),
+			zap.Bool("authoritative_only", m.AuthoritativeOnly))
 
 		var ready bool
-		ready, err = checkDNSPropagation(ctx, logger, absName, recType, zrec.record.Value, checkAuthoritativeServers, resolvers)
-		if err != nil {
-			return fmt.Errorf("checking DNS propagation of %q (relative=%s zone=%s resolvers=%v): %w", absName, zrec.record.Name, zrec.zone, resolvers, err)
+		var propagated []string
+		if m.AuthoritativeOnly {
+			propagated, pending, err = checkDNSPropagationEverywhere(ctx, logger, absName, recType, zrec.record.Value, resolvers)
+			if err != nil && propagated == nil && pending == nil {
+				return fmt.Errorf("checking DNS propagation of %q (relative=%s zone=%s resolvers=%v): %w", absName, zrec.record.Name, zrec.zone, resolvers, err)
+			}
+			ready = len(propagated) > 0 && len(pending) == 0
+		} else {
+			ready, err = checkDNSPropagation(ctx, logger, absName, recType, zrec.record.Value, checkAuthoritativeServers, resolvers)
+			if err != nil {
+				return fmt.Errorf("checking DNS propagation of %q (relative=%s zone=%s resolvers=%v): %w", absName, zrec.record.Name, zrec.zone, resolvers, err)
+			}
 		}
+
+		emitDNSEvent(ctx, "dns_propagation_progress", map[string]any{
+			"fqdn":        absName,
+			"zone":        zrec.zone,
+			"record_type": zrec.record.Type,
+			"attempt":     attempt,
+			"elapsed":     time.Since(start),
+			"timeout":     timeout,
+			"propagated":  ready,
+			"nameservers": propagated,
+			"pending":     pending,
+		})
+
 		if ready {
+			logger.Debug("DNS record propagated",
+				zap.String("fqdn", absName),
+				zap.Int("attempts", attempt),
+				zap.Duration("elapsed", time.Since(start)))
 			return nil
 		}
 	}
 
+	if len(pending) > 0 {
+		return fmt.Errorf("timed out waiting for record to propagate to nameservers %v; verify DNS provider configuration is correct - last error: %v", pending, err)
+	}
 	return fmt.Errorf("timed out waiting for record to fully propagate; verify DNS provider configuration is correct - last error: %v", err)
 }
 
+// propagationDelay returns how long to wait before checking the
+// propagation of a record in zone.
+func (m *DNSManager) propagationDelay(zone string) time.Duration {
+	if m.PropagationDelay != 0 {
+		return m.PropagationDelay
+	}
+	if delayer, ok := m.DNSProvider.(PropagationDelayer); ok {
+		return delayer.PropagationDelay(zone)
+	}
+	return 0
+}
+
+// PropagationDelayer is an optional interface for DNS providers that
+// know how long their changes take to reach all of their nameservers,
+// so that propagation checks don't start (and time out) too early.
+// Wrap a provider to add a delay to one that doesn't have it.
+//
+// EXPERIMENTAL: Subject to change.
+type PropagationDelayer interface {
+	PropagationDelay(zone string) time.Duration
+}
+
+// emitDNSEvent emits an event with the config of the issuance that
+// ctx belongs to, if any; solvers don't have a config of their own.
+func emitDNSEvent(ctx context.Context, eventName string, data map[string]any) {
+	if cfg, ok := ctx.Value(ctxKeyConfig).(*Config); ok && cfg != nil {
+		_ = cfg.emit(ctx, eventName, data)
+	}
+}
+
 type zoneRecord struct {
 	zone   string
 	record libdns.Record
@@ -847,4 +1130,6 @@ var (
 	_ acmez.Solver = (*solverWrapper)(nil)
 	_ acmez.Waiter = (*solverWrapper)(nil)
 	_ acmez.Waiter = (*distributedSolver)(nil)
+	_ acmez.Solver = (*HTTP01Solver)(nil)
+	_ http.Handler = (*HTTP01Solver)(nil)
 )
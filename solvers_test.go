@@ -15,7 +15,14 @@
 package certmagic
 
 import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/mholt/acmez/v3/acme"
 )
@@ -155,3 +162,95 @@ func Test_challengeKey(t *testing.T) {
 		})
 	}
 }
+
+type delayingDNSProvider struct {
+	DNSProvider
+	delays map[string]time.Duration
+}
+
+func (p delayingDNSProvider) PropagationDelay(zone string) time.Duration {
+	return p.delays[zone]
+}
+
+func TestDNSManagerPropagationDelay(t *testing.T) {
+	provider := delayingDNSProvider{delays: map[string]time.Duration{"slow.example.": time.Minute}}
+
+	m := &DNSManager{DNSProvider: provider}
+	if got := m.propagationDelay("slow.example."); got != time.Minute {
+		t.Errorf("Expected delay of provider, got %s", got)
+	}
+	if got := m.propagationDelay("fast.example."); got != 0 {
+		t.Errorf("Expected no delay for other zone, got %s", got)
+	}
+
+	// a configured delay takes precedence
+	m.PropagationDelay = 5 * time.Second
+	if got := m.propagationDelay("slow.example."); got != 5*time.Second {
+		t.Errorf("Expected configured delay, got %s", got)
+	}
+}
+
+func TestHTTP01Solver(t *testing.T) {
+	var routes []HTTP01Route
+	var unregistered int
+	solver := &HTTP01Solver{
+		Address:       "127.0.0.1:0",
+		ProxyProtocol: true,
+		RegisterRoute: func(_ context.Context, route HTTP01Route) (func(context.Context) error, error) {
+			routes = append(routes, route)
+			return func(context.Context) error { unregistered++; return nil }, nil
+		},
+	}
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeHTTP01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	}
+	ctx := context.Background()
+	if err := solver.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Host != "example.com" || routes[0].Path != chal.HTTP01ResourcePath() || routes[0].Address == "" {
+		t.Fatalf("Expected a route for the challenge, got %+v", routes)
+	}
+
+	// a request forwarded by a load balancer with the PROXY protocol
+	conn, err := net.Dial("tcp", routes[0].Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"+
+		"GET "+chal.HTTP01ResourcePath()+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != chal.KeyAuthorization {
+		t.Errorf("Expected key authorization, got HTTP %d: %s", resp.StatusCode, body)
+	}
+
+	// other hosts aren't answered
+	req, _ := http.NewRequest(http.MethodGet, "http://other.example"+chal.HTTP01ResourcePath(), nil)
+	rec := httptest.NewRecorder()
+	solver.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for other host, got %d", rec.Code)
+	}
+
+	if err := solver.CleanUp(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if unregistered != 1 {
+		t.Errorf("Expected route to be unregistered once, got %d", unregistered)
+	}
+	if _, err := net.DialTimeout("tcp", routes[0].Address, time.Second); err == nil {
+		t.Error("Expected server to be stopped after the last challenge")
+	}
+}
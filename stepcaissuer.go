@@ -0,0 +1,486 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StepCAIssuer gets certificates from a Smallstep step-ca server
+// through its native API (rather than ACME), authenticating with a
+// JWK or X5C provisioner. Renewals authenticate with the certificate
+// being renewed, as with `step ca renew`, so the provisioner is only
+// needed for new certificates.
+//
+// Since the certificate names can include URIs, this can be used to
+// get SPIFFE X.509-SVIDs from a step-ca that is configured for them.
+//
+// EXPERIMENTAL: Subject to change.
+type StepCAIssuer struct {
+	// The base URL of the CA, e.g. "https://ca.internal:9000".
+	// REQUIRED.
+	CA string
+
+	// The roots to trust for connecting to the CA. Default:
+	// the system roots (which usually won't include a
+	// private CA's root).
+	Roots *x509.CertPool
+
+	// The name of the provisioner. REQUIRED.
+	Provisioner string
+
+	// The provisioner's private key, which signs the one-time
+	// tokens that authorize issuance. For a JWK provisioner,
+	// this is the (decrypted) provisioner key; for an X5C
+	// provisioner, it is the key of X5CChain[0]. REQUIRED.
+	Key crypto.Signer
+
+	// The key ID of a JWK provisioner's key. Default:
+	// its RFC 7638 thumbprint, like step-ca uses.
+	KeyID string
+
+	// For an X5C provisioner, the certificate chain that
+	// authenticates the Key, leaf first.
+	X5CChain []*x509.Certificate
+
+	// How long issued certificates should be valid for.
+	// Default: the provisioner's default.
+	Lifetime time.Duration
+
+	// If true, renewals do not authenticate with the
+	// certificate being renewed, but get a new certificate
+	// with a token from the provisioner like new ones.
+	DisableRenewalAuth bool
+
+	// The HTTP client to use for requests to the CA. Its
+	// transport must be an *http.Transport for renewals to
+	// work, since they use client certificates. Default: a
+	// client that trusts Roots.
+	HTTPClient *http.Client
+
+	// An optional (but highly recommended) logger.
+	Logger *zap.Logger
+}
+
+// IssuerKey returns the unique issuer key for the CA.
+func (iss *StepCAIssuer) IssuerKey() string {
+	if u, err := url.Parse(iss.CA); err == nil && u.Host != "" {
+		return u.Host + "-stepca"
+	}
+	return iss.CA + "-stepca"
+}
+
+// Issue obtains a certificate for the given csr. If the certificate is
+// being renewed, it is authenticated by the current certificate, so the
+// provisioner doesn't have to sign a token; if that fails, a token is
+// used anyway.
+func (iss *StepCAIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	logger := iss.logger()
+
+	if renewing, ok := ctx.Value(ctxKeyRenewing).(CertificateResource); ok && !iss.DisableRenewalAuth {
+		issued, err := iss.renew(ctx, csr, renewing)
+		if err == nil {
+			return issued, nil
+		}
+		logger.Warn("unable to renew with current certificate; using provisioner",
+			zap.Strings("identifiers", renewing.SANs),
+			zap.Error(err))
+	}
+
+	if iss.Key == nil || iss.Provisioner == "" {
+		return nil, ErrNoRetry{fmt.Errorf("step-ca issuer: provisioner and key are required")}
+	}
+	sans := namesFromCSR(csr)
+	if len(sans) == 0 {
+		return nil, ErrNoRetry{fmt.Errorf("step-ca issuer: CSR has no names")}
+	}
+	token, err := iss.signToken(iss.endpoint("/1.0/sign"), sans[0], sans)
+	if err != nil {
+		return nil, fmt.Errorf("signing provisioner token: %v", err)
+	}
+	req := stepSignRequest{
+		CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+		OTT: token,
+	}
+	if iss.Lifetime > 0 {
+		req.NotAfter = time.Now().Add(iss.Lifetime).UTC().Format(time.RFC3339)
+	}
+
+	logger.Info("requesting certificate from step-ca",
+		zap.String("ca", iss.CA),
+		zap.String("provisioner", iss.Provisioner),
+		zap.Strings("identifiers", sans))
+
+	return iss.postForCertificate(ctx, iss.httpClient(ctx, nil), "/1.0/sign", req)
+}
+
+// renew gets a certificate for csr, authenticating with the current
+// certificate: if the key is the same, it is renewed, otherwise it is
+// rekeyed, like `step ca renew` (with --rekey).
+func (iss *StepCAIssuer) renew(ctx context.Context, csr *x509.CertificateRequest, current CertificateResource) (*IssuedCertificate, error) {
+	clientCert, err := tls.X509KeyPair(current.CertificatePEM, current.PrivateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("current certificate is expired")
+	}
+	client := iss.httpClient(ctx, &clientCert)
+	if pubKeysEqual(leaf.PublicKey, csr.PublicKey) {
+		return iss.postForCertificate(ctx, client, "/1.0/renew", nil)
+	}
+	return iss.postForCertificate(ctx, client, "/1.0/rekey", stepSignRequest{
+		CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+	})
+}
+
+// Revoke revokes the given certificate, authenticating with it.
+func (iss *StepCAIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	clientCert, err := tls.X509KeyPair(cert.CertificatePEM, cert.PrivateKeyPEM)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{
+		"serial":     leaf.SerialNumber.String(),
+		"reasonCode": reason,
+		"passive":    true,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := iss.post(ctx, iss.httpClient(ctx, &clientCert), "/1.0/revoke", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (iss *StepCAIssuer) postForCertificate(ctx context.Context, client *http.Client, endpoint string, reqBody any) (*IssuedCertificate, error) {
+	var body []byte
+	if reqBody != nil {
+		var err error
+		body, err = json.Marshal(reqBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := iss.post(ctx, client, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var signResp struct {
+		CRT       string   `json:"crt"`
+		CA        string   `json:"ca"`
+		CertChain []string `json:"certChain"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&signResp); err != nil {
+		return nil, fmt.Errorf("decoding step-ca response: %v", err)
+	}
+
+	// newer versions of step-ca return the full chain; older ones,
+	// only the leaf and the intermediate
+	chain := signResp.CertChain
+	if len(chain) == 0 {
+		chain = []string{signResp.CRT, signResp.CA}
+	}
+	var bundle bytes.Buffer
+	for _, certPEM := range chain {
+		certPEM = strings.TrimSpace(certPEM)
+		if certPEM == "" {
+			continue
+		}
+		bundle.WriteString(certPEM)
+		bundle.WriteString("\n")
+	}
+	if _, err := parseCertsFromPEMBundle(bundle.Bytes()); err != nil {
+		return nil, fmt.Errorf("invalid certificate from step-ca: %v", err)
+	}
+	return &IssuedCertificate{Certificate: bundle.Bytes()}, nil
+}
+
+func (iss *StepCAIssuer) post(ctx context.Context, client *http.Client, endpoint string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, iss.endpoint(endpoint), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", buildUAString())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("step-ca request: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var stepErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&stepErr)
+		err := fmt.Errorf("step-ca %s: HTTP %d: %s", endpoint, resp.StatusCode, stepErr.Message)
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden {
+			// the request itself is wrong; trying again won't help
+			return nil, ErrNoRetry{err}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// signToken signs a one-time token for the provisioner,
+// authorizing the certificate for sans at audience.
+func (iss *StepCAIssuer) signToken(audience, subject string, sans []string) (string, error) {
+	alg, err := jwsAlgorithm(iss.Key)
+	if err != nil {
+		return "", err
+	}
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if len(iss.X5CChain) > 0 {
+		var x5c []string
+		for _, cert := range iss.X5CChain {
+			x5c = append(x5c, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+		header["x5c"] = x5c
+	} else {
+		kid := iss.KeyID
+		if kid == "" {
+			kid, err = jwkThumbprint(iss.Key.Public())
+			if err != nil {
+				return "", err
+			}
+		}
+		header["kid"] = kid
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]any{
+		"iss":  iss.Provisioner,
+		"aud":  audience,
+		"sub":  subject,
+		"sans": sans,
+		"iat":  now.Unix(),
+		"nbf":  now.Add(-30 * time.Second).Unix(),
+		"exp":  now.Add(5 * time.Minute).Unix(),
+		"jti":  hex.EncodeToString(jti),
+	}
+	return signJWS(iss.Key, alg, header, claims)
+}
+
+func (iss *StepCAIssuer) endpoint(path string) string {
+	return strings.TrimSuffix(iss.CA, "/") + path
+}
+
+// httpClient returns the client to use for requests, which
+// authenticates with clientCert if it is not nil. Without a client
+// of its own, it is based on the HTTP client of the config.
+func (iss *StepCAIssuer) httpClient(ctx context.Context, clientCert *tls.Certificate) *http.Client {
+	if iss.HTTPClient != nil && clientCert == nil {
+		return iss.HTTPClient
+	}
+	base := httpClientFor(ctx, iss.HTTPClient, HTTPTimeout)
+	var transport *http.Transport
+	if t, ok := base.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	}
+	if transport == nil {
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: 30 * time.Second,
+		}
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: iss.Roots}
+	} else if iss.HTTPClient == nil && iss.Roots != nil {
+		transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+		transport.TLSClientConfig.RootCAs = iss.Roots
+	}
+	if clientCert != nil {
+		transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	return &http.Client{Transport: transport, Timeout: base.Timeout}
+}
+
+func (iss *StepCAIssuer) logger() *zap.Logger {
+	if iss.Logger != nil {
+		return iss.Logger
+	}
+	return zap.NewNop()
+}
+
+type stepSignRequest struct {
+	CSR      string `json:"csr"`
+	OTT      string `json:"ott,omitempty"`
+	NotAfter string `json:"notAfter,omitempty"`
+}
+
+// jwsAlgorithm returns the JWS algorithm to sign with key.
+func jwsAlgorithm(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			return "ES256", nil
+		case 384:
+			return "ES384", nil
+		case 521:
+			return "ES512", nil
+		}
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key.Public())
+}
+
+// signJWS signs claims with key, returning a compact JWS.
+func signJWS(key crypto.Signer, alg string, header, claims map[string]any) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	var hash crypto.Hash
+	switch alg {
+	case "ES256", "RS256":
+		hash = crypto.SHA256
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		hash = 0
+	default:
+		return "", fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	digest := []byte(signingInput)
+	if hash != 0 {
+		h := hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	sig, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return "", err
+	}
+
+	// JWS uses fixed-size r||s for ECDSA, not ASN.1
+	if pub, ok := key.Public().(*ecdsa.PublicKey); ok {
+		sig, err = ecdsaSignatureToJWS(sig, (pub.Curve.Params().BitSize+7)/8)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func ecdsaSignatureToJWS(asn1Sig []byte, size int) ([]byte, error) {
+	var parsed struct{ R, S *big.Int }
+	if err := unmarshalASN1Exact(asn1Sig, &parsed); err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 2*size)
+	parsed.R.FillBytes(sig[:size])
+	parsed.S.FillBytes(sig[size:])
+	return sig, nil
+}
+
+func unmarshalASN1Exact(data []byte, val any) error {
+	rest, err := asn1.Unmarshal(data, val)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("trailing data after ASN.1 value")
+	}
+	return nil
+}
+
+// jwkThumbprint returns the base64url-encoded RFC 7638 thumbprint of pub.
+func jwkThumbprint(pub crypto.PublicKey) (string, error) {
+	var members string
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Curve.Params().Name,
+			base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size))),
+			base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size))))
+	case *rsa.PublicKey:
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`,
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			base64.RawURLEncoding.EncodeToString(k.N.Bytes()))
+	case ed25519.PublicKey:
+		members = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, base64.RawURLEncoding.EncodeToString(k))
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// pubKeysEqual reports whether a and b are the same public key.
+func pubKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// Interface guards
+var (
+	_ Issuer  = (*StepCAIssuer)(nil)
+	_ Revoker = (*StepCAIssuer)(nil)
+)
@@ -0,0 +1,211 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStepCAIssuer(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provisionerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, err := jwkThumbprint(provisionerKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var endpoints []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoints = append(endpoints, r.URL.Path)
+		var req stepSignRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		var pubKey crypto.PublicKey
+		var names []string
+		switch r.URL.Path {
+		case "/1.0/sign":
+			claims, ok := verifyTestStepToken(t, req.OTT, kid, &provisionerKey.PublicKey)
+			if !ok || claims["iss"] != "test" || !strings.HasSuffix(claims["aud"].(string), "/1.0/sign") {
+				http.Error(w, `{"message":"invalid token"}`, http.StatusUnauthorized)
+				return
+			}
+			csr := testDecodeCSR(t, req.CSR)
+			pubKey, names = csr.PublicKey, csr.DNSNames
+		case "/1.0/rekey", "/1.0/renew":
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				http.Error(w, `{"message":"no client certificate"}`, http.StatusUnauthorized)
+				return
+			}
+			current := r.TLS.PeerCertificates[0]
+			pubKey, names = current.PublicKey, current.DNSNames
+			if r.URL.Path == "/1.0/rekey" {
+				pubKey = testDecodeCSR(t, req.CSR).PublicKey
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: names[0]},
+			DNSNames:     names,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pubKey, caKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		crt := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		_ = json.NewEncoder(w).Encode(map[string]any{"crt": crt, "certChain": []string{crt}})
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	iss := &StepCAIssuer{
+		CA:          server.URL,
+		Roots:       roots,
+		Provisioner: "test",
+		Key:         provisionerKey,
+		Logger:      defaultTestLogger,
+	}
+	cfg := &Config{Logger: defaultTestLogger}
+
+	// new certificate, with a provisioner token
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := cfg.generateCSR(certKey, []string{"svc.internal"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	issued, err := iss.Issue(ctx, csr)
+	if err != nil {
+		t.Fatalf("Issuing: %v", err)
+	}
+	keyPEM, err := PEMEncodePrivateKey(certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renewals authenticate with the current certificate
+	renewCtx := context.WithValue(ctx, ctxKeyRenewing, CertificateResource{
+		SANs:           []string{"svc.internal"},
+		CertificatePEM: issued.Certificate,
+		PrivateKeyPEM:  keyPEM,
+	})
+	if _, err := iss.Issue(renewCtx, csr); err != nil {
+		t.Fatalf("Renewing: %v", err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCSR, err := cfg.generateCSR(newKey, []string{"svc.internal"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekeyed, err := iss.Issue(renewCtx, newCSR)
+	if err != nil {
+		t.Fatalf("Renewing with new key: %v", err)
+	}
+	if _, err := tls.X509KeyPair(rekeyed.Certificate, mustPEMEncodePrivateKey(t, newKey)); err != nil {
+		t.Errorf("Expected rekeyed certificate for the new key: %v", err)
+	}
+
+	if expected := []string{"/1.0/sign", "/1.0/renew", "/1.0/rekey"}; !slices.Equal(endpoints, expected) {
+		t.Errorf("Expected requests to %v, got %v", expected, endpoints)
+	}
+}
+
+func verifyTestStepToken(t *testing.T, token, kid string, pub *ecdsa.PublicKey) (map[string]any, bool) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	var header map[string]any
+	headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if json.Unmarshal(headerJSON, &header) != nil || header["alg"] != "ES256" || header["kid"] != kid {
+		return nil, false
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if len(sig) != 64 {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, false
+	}
+	var claims map[string]any
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if json.Unmarshal(claimsJSON, &claims) != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+func testDecodeCSR(t *testing.T, csrPEM string) *x509.CertificateRequest {
+	t.Helper()
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		t.Fatal("invalid CSR PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func mustPEMEncodePrivateKey(t *testing.T, key crypto.PrivateKey) []byte {
+	t.Helper()
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPEM
+}
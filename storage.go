@@ -16,10 +16,11 @@ package certmagic
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"path"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -197,13 +198,13 @@ func (keys KeyBuilder) CertsPrefix(issuerKey string) string {
 // CertsSitePrefix returns a key prefix for items associated with
 // the site given by domain using the given issuer key.
 func (keys KeyBuilder) CertsSitePrefix(issuerKey, domain string) string {
-	return path.Join(keys.CertsPrefix(issuerKey), keys.Safe(domain))
+	return path.Join(keys.CertsPrefix(issuerKey), keys.safeSubject(domain))
 }
 
 // SiteCert returns the path to the certificate file for domain
 // that is associated with the issuer with the given issuerKey.
 func (keys KeyBuilder) SiteCert(issuerKey, domain string) string {
-	safeDomain := keys.Safe(domain)
+	safeDomain := keys.safeSubject(domain)
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".crt")
 }
 
@@ -211,7 +212,7 @@ func (keys KeyBuilder) SiteCert(issuerKey, domain string) string {
 // that is associated with the certificate from the given issuer with
 // the given issuerKey.
 func (keys KeyBuilder) SitePrivateKey(issuerKey, domain string) string {
-	safeDomain := keys.Safe(domain)
+	safeDomain := keys.safeSubject(domain)
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".key")
 }
 
@@ -219,10 +220,29 @@ func (keys KeyBuilder) SitePrivateKey(issuerKey, domain string) string {
 // is associated with the certificate from the given issuer with
 // the given issuerKey.
 func (keys KeyBuilder) SiteMeta(issuerKey, domain string) string {
-	safeDomain := keys.Safe(domain)
+	safeDomain := keys.safeSubject(domain)
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".json")
 }
 
+// SiteDelegatedCredential returns the path to the delegated credential
+// of the certificate for domain from the issuer with the given issuerKey.
+func (keys KeyBuilder) SiteDelegatedCredential(issuerKey, domain string) string {
+	safeDomain := keys.safeSubject(domain)
+	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".dc.json")
+}
+
+// NextPrivateKey returns the key of the private key that was generated
+// ahead of time for the next certificate for domain (see Config.NextKeys).
+func (keys KeyBuilder) NextPrivateKey(domain string) string {
+	return path.Join(prefixNextKeys, keys.safeSubject(domain)+".key")
+}
+
+// CertHistoryPrefix returns the key prefix for previous versions
+// of the certificate for domain from the issuer with issuerKey.
+func (keys KeyBuilder) CertHistoryPrefix(issuerKey, domain string) string {
+	return path.Join(prefixCertHistory, keys.Safe(issuerKey), keys.safeSubject(domain))
+}
+
 // OCSPStaple returns a key for the OCSP staple associated
 // with the given certificate. If you have the PEM bundle
 // handy, pass that in to save an extra encoding step.
@@ -257,6 +277,18 @@ func (keys KeyBuilder) Safe(str string) string {
 	return safeKeyRE.ReplaceAllLiteralString(str, "")
 }
 
+// safeSubject returns Safe(subject), made unique for URIs, which
+// could otherwise have the same safe form, since URIs are case-sensitive
+// and Safe removes case and slashes.
+func (keys KeyBuilder) safeSubject(subject string) string {
+	safe := keys.Safe(subject)
+	if SubjectIsURI(subject) {
+		sum := sha256.Sum256([]byte(subject))
+		safe += "_" + hex.EncodeToString(sum[:4])
+	}
+	return safe
+}
+
 // CleanUpOwnLocks immediately cleans up all
 // current locks obtained by this process. Since
 // this does not cancel the operations that
@@ -264,45 +296,17 @@ func (keys KeyBuilder) Safe(str string) string {
 // called only immediately before process exit.
 // Errors are only reported if a logger is given.
 func CleanUpOwnLocks(ctx context.Context, logger *zap.Logger) {
-	locksMu.Lock()
-	defer locksMu.Unlock()
-	for lockKey, storage := range locks {
-		if err := storage.Unlock(ctx, lockKey); err != nil {
-			logger.Error("unable to clean up lock in storage backend",
-				zap.Any("storage", storage),
-				zap.String("lock_key", lockKey),
-				zap.Error(err))
-			continue
-		}
-		delete(locks, lockKey)
-	}
+	DefaultLockSupervisor.releaseAll(ctx, logger)
 }
 
 func acquireLock(ctx context.Context, storage Storage, lockKey string) error {
-	err := storage.Lock(ctx, lockKey)
-	if err == nil {
-		locksMu.Lock()
-		locks[lockKey] = storage
-		locksMu.Unlock()
-	}
-	return err
+	return DefaultLockSupervisor.acquire(ctx, storage, lockKey)
 }
 
 func releaseLock(ctx context.Context, storage Storage, lockKey string) error {
-	err := storage.Unlock(context.WithoutCancel(ctx), lockKey)
-	if err == nil {
-		locksMu.Lock()
-		delete(locks, lockKey)
-		locksMu.Unlock()
-	}
-	return err
+	return DefaultLockSupervisor.release(ctx, storage, lockKey)
 }
 
-// locks stores a reference to all the current
-// locks obtained by this process.
-var locks = make(map[string]Storage)
-var locksMu sync.Mutex
-
 // StorageKeys provides methods for accessing
 // keys and key prefixes for items in a Storage.
 // Typically, you will not need to use this
@@ -312,8 +316,10 @@ var locksMu sync.Mutex
 var StorageKeys KeyBuilder
 
 const (
-	prefixCerts = "certificates"
-	prefixOCSP  = "ocsp"
+	prefixCerts       = "certificates"
+	prefixCertHistory = "certificate_history"
+	prefixNextKeys    = "next_keys"
+	prefixOCSP        = "ocsp"
 )
 
 // safeKeyRE matches any undesirable characters in storage keys.
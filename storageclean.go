@@ -0,0 +1,218 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CleanedAsset describes an asset that storage cleaning deleted or,
+// in a dry run, would delete.
+//
+// EXPERIMENTAL: Subject to change.
+type CleanedAsset struct {
+	// The storage key of the asset; for locks, the
+	// name of the lock.
+	Key string `json:"key"`
+
+	// What the asset is: "certificate", "private_key",
+	// "metadata", "delegated_credential", "ocsp_staple",
+	// "site_folder", or "lock".
+	Kind string `json:"kind"`
+
+	// Why it is deleted: "expired", "corrupt", "orphaned",
+	// "empty", or "stale".
+	Reason string `json:"reason"`
+}
+
+// minOrphanedKeyGracePeriod is the shortest time a private key without
+// certificate is kept, since keys from interrupted or concurrent
+// operations of other instances may not have a certificate yet.
+const minOrphanedKeyGracePeriod = time.Hour
+
+// storageCleaner deletes assets on behalf of CleanStorageWithReport,
+// and records them.
+type storageCleaner struct {
+	storage Storage
+	opts    CleanStorageOptions
+	report  []CleanedAsset
+}
+
+// delete deletes asset, unless this is a dry run or the event handler
+// prevents it, and records it in the report.
+func (sc *storageCleaner) delete(ctx context.Context, asset CleanedAsset) error {
+	data := map[string]any{
+		"key":     asset.Key,
+		"kind":    asset.Kind,
+		"reason":  asset.Reason,
+		"dry_run": sc.opts.DryRun,
+	}
+	if err := sc.emit(ctx, "storage_asset_deleting", data); err != nil {
+		sc.opts.Logger.Info("event handler prevented deleting asset",
+			zap.String("key", asset.Key),
+			zap.String("kind", asset.Kind),
+			zap.Error(err))
+		return nil
+	}
+
+	sc.opts.Logger.Info("deleting asset",
+		zap.String("key", asset.Key),
+		zap.String("kind", asset.Kind),
+		zap.String("reason", asset.Reason))
+
+	if !sc.opts.DryRun {
+		var err error
+		if asset.Kind == "lock" {
+			err = sc.storage.(LockInspector).BreakLock(ctx, asset.Key)
+		} else {
+			err = sc.storage.Delete(ctx, asset.Key)
+		}
+		if err != nil {
+			return err
+		}
+		delete(data, "dry_run")
+		sc.emit(ctx, "storage_asset_deleted", data)
+	}
+
+	sc.report = append(sc.report, asset)
+	return nil
+}
+
+func (sc *storageCleaner) emit(ctx context.Context, eventName string, data map[string]any) error {
+	if sc.opts.OnEvent == nil {
+		return nil
+	}
+	return sc.opts.OnEvent(ctx, eventName, data)
+}
+
+// deleteOrphanedKeys deletes the private keys (and metadata) among the
+// assets of the site folder at siteKey that have no certificate.
+func (sc *storageCleaner) deleteOrphanedKeys(ctx context.Context, siteKey string, siteAssets []string) {
+	gracePeriod := max(sc.opts.OrphanedKeyGracePeriod, minOrphanedKeyGracePeriod)
+
+	for _, assetKey := range siteAssets {
+		if path.Ext(assetKey) != ".key" {
+			continue
+		}
+		baseName := strings.TrimSuffix(assetKey, ".key")
+		if slices.Contains(siteAssets, baseName+".crt") {
+			continue
+		}
+
+		info, err := sc.storage.Stat(ctx, assetKey)
+		if err != nil {
+			sc.opts.Logger.Error("unable to stat private key", zap.String("asset_key", assetKey), zap.Error(err))
+			continue
+		}
+		if time.Since(info.Modified) < gracePeriod {
+			continue
+		}
+		if sc.issuanceInProgress(ctx, path.Base(siteKey)) {
+			sc.opts.Logger.Info("keeping private key without certificate, since certificate is being obtained",
+				zap.String("asset_key", assetKey))
+			continue
+		}
+
+		for _, asset := range []CleanedAsset{
+			{Key: assetKey, Kind: "private_key"},
+			{Key: baseName + ".json", Kind: "metadata"},
+		} {
+			if !slices.Contains(siteAssets, asset.Key) {
+				continue
+			}
+			asset.Reason = "orphaned"
+			if err := sc.delete(ctx, asset); err != nil {
+				sc.opts.Logger.Error("could not clean up orphaned asset",
+					zap.String("asset_key", asset.Key),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// issuanceInProgress returns true if storage is a LockInspector and
+// shows that the certificate of the site folder named safeName is
+// being obtained or renewed.
+func (sc *storageCleaner) issuanceInProgress(ctx context.Context, safeName string) bool {
+	inspector, ok := sc.storage.(LockInspector)
+	if !ok {
+		return false
+	}
+	name := safeName
+	if rest, ok := strings.CutPrefix(name, "wildcard_"); ok {
+		name = "*" + rest
+	}
+	_, err := inspector.LockInfo(ctx, fmt.Sprintf("%s_%s", certIssueLockOp, name))
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// breakAbandonedLocks breaks the locks in storage that are stale
+// according to the configured policy and not held by this process.
+func breakAbandonedLocks(ctx context.Context, sc *storageCleaner) error {
+	if !sc.opts.StaleLocks.enabled() {
+		return fmt.Errorf("no stale lock policy configured")
+	}
+	lister, ok := sc.storage.(LockLister)
+	if !ok {
+		return fmt.Errorf("storage does not implement LockLister")
+	}
+
+	names, err := lister.ListLocks(ctx)
+	if err != nil {
+		return fmt.Errorf("listing locks: %v", err)
+	}
+
+	held := make(map[string]bool)
+	for _, hl := range DefaultLockSupervisor.HeldLocks() {
+		held[StorageKeys.Safe(hl.Name)] = true
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		// if context was cancelled, quit early; otherwise proceed
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if held[StorageKeys.Safe(name)] {
+			continue
+		}
+		info, err := lister.LockInfo(ctx, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // released in the meantime
+		}
+		if err != nil {
+			sc.opts.Logger.Error("unable to inspect lock", zap.String("lock", name), zap.Error(err))
+			continue
+		}
+		if !sc.opts.StaleLocks.IsStale(info, now) {
+			continue
+		}
+		if err := sc.delete(ctx, CleanedAsset{Key: name, Kind: "lock", Reason: "stale"}); err != nil {
+			sc.opts.Logger.Error("could not break abandoned lock", zap.String("lock", name), zap.Error(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCleanStorageWithReport(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	store := func(key string, value []byte) {
+		if err := storage.Store(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backdate := func(key string) {
+		old := time.Now().Add(-48 * time.Hour)
+		if err := os.Chtimes(storage.Filename(key), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an expired certificate with its key and metadata
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "expired.example.com"},
+		NotBefore:    time.Now().Add(-100 * 24 * time.Hour),
+		NotAfter:     time.Now().Add(-10 * 24 * time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(StorageKeys.SiteCert("ca", "expired.example.com"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	store(StorageKeys.SitePrivateKey("ca", "expired.example.com"), []byte("key"))
+	store(StorageKeys.SiteMeta("ca", "expired.example.com"), []byte("{}"))
+
+	// orphaned keys: one old, one recent, and one being obtained
+	store(StorageKeys.SitePrivateKey("ca", "orphan.example.com"), []byte("key"))
+	backdate(StorageKeys.SitePrivateKey("ca", "orphan.example.com"))
+	store(StorageKeys.SitePrivateKey("ca", "recent.example.com"), []byte("key"))
+	store(StorageKeys.SitePrivateKey("ca", "*.obtaining.example.com"), []byte("key"))
+	backdate(StorageKeys.SitePrivateKey("ca", "*.obtaining.example.com"))
+
+	// a corrupt OCSP staple
+	store("ocsp/corrupt-1234", []byte("not a staple"))
+
+	// an abandoned lock, and a lock for a certificate being obtained
+	writeLock := func(name string, updated time.Time) {
+		meta, _ := json.Marshal(lockMeta{Created: updated, Updated: updated, Holder: "crashed:1"})
+		if err := os.MkdirAll(storage.lockDir(), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(storage.lockFilename(name), meta, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLock("renew_abandoned.example.com", time.Now().Add(-time.Hour))
+	writeLock("issue_cert_*.obtaining.example.com", time.Now())
+
+	var events []string
+	opts := CleanStorageOptions{
+		Logger:         defaultTestLogger,
+		OCSPStaples:    true,
+		ExpiredCerts:   true,
+		OrphanedKeys:   true,
+		AbandonedLocks: true,
+		StaleLocks:     StaleLockPolicy{MaxIdle: time.Minute},
+		DryRun:         true,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			events = append(events, event)
+			if data["key"] == StorageKeys.SiteMeta("ca", "expired.example.com") {
+				return errors.New("keep it")
+			}
+			return nil
+		},
+	}
+	keys := func(report []CleanedAsset) []string {
+		var keys []string
+		for _, asset := range report {
+			keys = append(keys, asset.Key)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	expected := []string{
+		"certificates/ca/expired.example.com/expired.example.com.crt",
+		"certificates/ca/expired.example.com/expired.example.com.key",
+		"certificates/ca/orphan.example.com/orphan.example.com.key",
+		"ocsp/corrupt-1234",
+		"renew_abandoned.example.com",
+	}
+
+	// a dry run only reports
+	report, err := CleanStorageWithReport(ctx, storage, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(report); !slices.Equal(got, expected) {
+		t.Errorf("Expected dry run to report %v, got %v", expected, got)
+	}
+	if !storage.Exists(ctx, "ocsp/corrupt-1234") || slices.Contains(events, "storage_asset_deleted") {
+		t.Error("Expected dry run to not delete anything")
+	}
+
+	events = nil
+	opts.DryRun = false
+	// the site folder that becomes empty is deleted, too
+	expected = slices.Insert(expected, 2, "certificates/ca/orphan.example.com")
+	report, err = CleanStorageWithReport(ctx, storage, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(report); !slices.Equal(got, expected) {
+		t.Errorf("Expected cleaning to delete %v, got %v", expected, got)
+	}
+	for _, key := range expected[:5] {
+		if storage.Exists(ctx, key) {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+	if _, err := storage.LockInfo(ctx, "renew_abandoned.example.com"); err == nil {
+		t.Error("Expected abandoned lock to be broken")
+	}
+	for _, key := range []string{
+		StorageKeys.SiteMeta("ca", "expired.example.com"),
+		StorageKeys.SitePrivateKey("ca", "recent.example.com"),
+		StorageKeys.SitePrivateKey("ca", "*.obtaining.example.com"),
+	} {
+		if !storage.Exists(ctx, key) {
+			t.Errorf("Expected %s to be kept", key)
+		}
+	}
+	if _, err := storage.LockInfo(ctx, "issue_cert_*.obtaining.example.com"); err != nil {
+		t.Error("Expected fresh lock to be kept")
+	}
+	var deleted int
+	for _, event := range events {
+		if event == "storage_asset_deleted" {
+			deleted++
+		}
+	}
+	if deleted != len(expected) {
+		t.Errorf("Expected %d deletion events, got %v", len(expected), events)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/x509"
+	"slices"
+	"strings"
+)
+
+// SubjectOverride overrides settings of a Config for certain subject
+// names; see Config.SubjectOverrides. Zero-value fields are not
+// overridden.
+//
+// EXPERIMENTAL: Subject to change.
+type SubjectOverride struct {
+	// The source of private keys, e.g. to use RSA keys
+	// for names that must support old clients.
+	KeySource KeyGenerator
+
+	// The issuers to get certificates from, and how to
+	// choose between them. Like the issuers of the Config,
+	// ACMEIssuers must be made with NewACMEIssuer.
+	Issuers      []Issuer
+	IssuerPolicy IssuerPolicy
+
+	// The renewal window ratio.
+	RenewalWindowRatio float64
+
+	// Whether to add the must staple extension to CSRs.
+	MustStaple *bool
+
+	// When certificates get new private keys.
+	KeyRotation *KeyRotationPolicy
+}
+
+// forSubject returns the config to manage the certificate for name
+// with, which is cfg with any SubjectOverrides for name applied.
+func (cfg *Config) forSubject(name string) *Config {
+	override, ok := cfg.subjectOverride(name)
+	if !ok {
+		return cfg
+	}
+	cfgCopy := *cfg
+	if override.KeySource != nil && cfg.alternateKey == "" {
+		cfgCopy.KeySource = override.KeySource
+	}
+	if len(override.Issuers) > 0 {
+		cfgCopy.Issuers = override.Issuers
+		if cfg.alternateKey != "" {
+			cfgCopy.Issuers = alternateKeyIssuers(override.Issuers, cfg.alternateKey)
+		}
+	}
+	if override.IssuerPolicy != "" {
+		cfgCopy.IssuerPolicy = override.IssuerPolicy
+	}
+	if override.RenewalWindowRatio > 0 {
+		cfgCopy.RenewalWindowRatio = override.RenewalWindowRatio
+	}
+	if override.MustStaple != nil {
+		cfgCopy.MustStaple = *override.MustStaple
+	}
+	if override.KeyRotation != nil {
+		cfgCopy.KeyRotation = override.KeyRotation
+	}
+	return &cfgCopy
+}
+
+// forLeaf is like forSubject, for the subject of leaf.
+func (cfg *Config) forLeaf(leaf *x509.Certificate) *Config {
+	if len(cfg.SubjectOverrides) == 0 || leaf == nil {
+		return cfg
+	}
+	names := slices.Clone(leaf.DNSNames)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	if len(names) == 0 {
+		return cfg
+	}
+	return cfg.forSubject(strings.ToLower(names[0]))
+}
+
+// allIssuers returns the issuers of cfg and of its subject overrides.
+func (cfg *Config) allIssuers() []Issuer {
+	issuers := cfg.Issuers
+	for _, override := range cfg.SubjectOverrides {
+		for _, iss := range override.Issuers {
+			if !slices.ContainsFunc(issuers, func(other Issuer) bool { return other.IssuerKey() == iss.IssuerKey() }) {
+				issuers = append(slices.Clip(issuers), iss)
+			}
+		}
+	}
+	return issuers
+}
+
+// subjectOverride returns the override for name: the one for exactly
+// name, if any, or else the one for the most specific wildcard
+// pattern that matches name.
+func (cfg *Config) subjectOverride(name string) (SubjectOverride, bool) {
+	if len(cfg.SubjectOverrides) == 0 {
+		return SubjectOverride{}, false
+	}
+	if override, ok := cfg.SubjectOverrides[name]; ok {
+		return override, true
+	}
+	var bestPattern string
+	for pattern := range cfg.SubjectOverrides {
+		if !strings.Contains(pattern, "*") || !MatchWildcard(name, pattern) {
+			continue
+		}
+		// more labels is more specific; break ties consistently
+		if bestPattern == "" ||
+			strings.Count(pattern, ".") > strings.Count(bestPattern, ".") ||
+			(strings.Count(pattern, ".") == strings.Count(bestPattern, ".") && pattern < bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	if bestPattern == "" {
+		return SubjectOverride{}, false
+	}
+	return cfg.SubjectOverrides[bestPattern], true
+}
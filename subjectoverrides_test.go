@@ -0,0 +1,103 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"os"
+	"testing"
+)
+
+func TestSubjectOverrideMatching(t *testing.T) {
+	cfg := &Config{
+		RenewalWindowRatio: DefaultRenewalWindowRatio,
+		SubjectOverrides: map[string]SubjectOverride{
+			"exact.example.com": {RenewalWindowRatio: 0.1},
+			"*.example.com":     {RenewalWindowRatio: 0.2},
+			"*.sub.example.com": {RenewalWindowRatio: 0.3},
+		},
+	}
+	for i, tc := range []struct {
+		name   string
+		expect float64
+	}{
+		{name: "exact.example.com", expect: 0.1},
+		{name: "other.example.com", expect: 0.2},
+		{name: "a.sub.example.com", expect: 0.3},
+		{name: "example.com", expect: DefaultRenewalWindowRatio},
+		{name: "a.b.c.example.com", expect: DefaultRenewalWindowRatio},
+	} {
+		if actual := cfg.forSubject(tc.name).RenewalWindowRatio; actual != tc.expect {
+			t.Errorf("Test %d: Expected ratio %v for %s, got %v", i, tc.expect, tc.name, actual)
+		}
+	}
+	if cfg.RenewalWindowRatio != DefaultRenewalWindowRatio {
+		t.Errorf("Original config was modified")
+	}
+}
+
+func TestSubjectOverrideObtainAndRenew(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defaultIssuer := &failingIssuer{key: "default"}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           defaultTestLogger,
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuers: []Issuer{defaultIssuer},
+		SubjectOverrides: map[string]SubjectOverride{
+			"*.internal.example": {
+				Issuers:            []Issuer{&testIssuer{}},
+				KeySource:          StandardKeyGenerator{KeyType: P384},
+				RenewalWindowRatio: 1,
+			},
+		},
+		Storage:   &FileStorage{Path: tmpDir},
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+	})
+
+	ctx := context.Background()
+	if err := cfg.ManageSync(ctx, []string{"app.internal.example"}); err != nil {
+		t.Fatalf("Managing certificate: %v", err)
+	}
+	if defaultIssuer.calls != 0 {
+		t.Errorf("Expected default issuer not to be used, was called %d times", defaultIssuer.calls)
+	}
+
+	certs := cache.getAllMatchingCerts("app.internal.example")
+	if len(certs) != 1 {
+		t.Fatalf("Expected 1 certificate in cache, got %d", len(certs))
+	}
+	cert := certs[0]
+	if key, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok || key.Curve != elliptic.P384() {
+		t.Errorf("Expected P-384 key from override, got %T", cert.PrivateKey)
+	}
+
+	// the overridden renewal window makes the fresh cert due for renewal
+	if !cert.NeedsRenewal(cfg) {
+		t.Errorf("Expected certificate to need renewal with overridden renewal window")
+	}
+}
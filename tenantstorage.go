@@ -0,0 +1,115 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// TenantStorage isolates a tenant's keys within a shared Storage by
+// prefixing all keys and lock names with the tenant's name. Storage
+// operations made through it carry the tenant's name in their context
+// (see StorageTenant), so that wrapped storage implementations, such
+// as EncryptedStorage, can act on a per-tenant basis.
+//
+// EXPERIMENTAL: Subject to change.
+type TenantStorage struct {
+	// The underlying storage. REQUIRED.
+	Storage Storage
+
+	// The name of the tenant; it must be safe to
+	// use as a single storage key component.
+	// REQUIRED.
+	Tenant string
+}
+
+// StorageTenant returns the name of the tenant on whose behalf
+// a storage operation is being performed, if it was made through
+// a TenantStorage; otherwise it returns an empty string.
+func StorageTenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(storageTenantCtxKey).(string)
+	return tenant
+}
+
+func (ts TenantStorage) Store(ctx context.Context, key string, value []byte) error {
+	return ts.Storage.Store(ts.ctx(ctx), ts.key(key), value)
+}
+
+func (ts TenantStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return ts.Storage.Load(ts.ctx(ctx), ts.key(key))
+}
+
+func (ts TenantStorage) Delete(ctx context.Context, key string) error {
+	return ts.Storage.Delete(ts.ctx(ctx), ts.key(key))
+}
+
+func (ts TenantStorage) Exists(ctx context.Context, key string) bool {
+	return ts.Storage.Exists(ts.ctx(ctx), ts.key(key))
+}
+
+func (ts TenantStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := ts.Storage.List(ts.ctx(ctx), ts.key(prefix), recursive)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = ts.unkey(key)
+	}
+	return keys, nil
+}
+
+func (ts TenantStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	info, err := ts.Storage.Stat(ts.ctx(ctx), ts.key(key))
+	info.Key = ts.unkey(info.Key)
+	return info, err
+}
+
+func (ts TenantStorage) Lock(ctx context.Context, name string) error {
+	return ts.Storage.Lock(ts.ctx(ctx), ts.key(name))
+}
+
+func (ts TenantStorage) Unlock(ctx context.Context, name string) error {
+	return ts.Storage.Unlock(ts.ctx(ctx), ts.key(name))
+}
+
+func (ts TenantStorage) String() string {
+	return "tenant:" + ts.Tenant
+}
+
+func (ts TenantStorage) ctx(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storageTenantCtxKey, ts.Tenant)
+}
+
+func (ts TenantStorage) prefix() string {
+	return path.Join(prefixTenants, StorageKeys.Safe(ts.Tenant))
+}
+
+func (ts TenantStorage) key(key string) string {
+	return path.Join(ts.prefix(), key)
+}
+
+func (ts TenantStorage) unkey(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, ts.prefix()), "/")
+}
+
+const (
+	storageTenantCtxKey = ctxKey("storage_tenant")
+	prefixTenants       = "tenants"
+)
+
+// Interface guard
+var _ Storage = TenantStorage{}
@@ -0,0 +1,244 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CachePreload configures how certificates are preloaded from
+// storage into the cache.
+//
+// EXPERIMENTAL: Subject to change.
+type CachePreload struct {
+	// If set, only certificates for names for which
+	// Filter returns true are preloaded.
+	Filter func(name string) bool
+
+	// How many certificates to load from storage at
+	// once. Default: 8.
+	Concurrency int
+}
+
+// Warm preloads the managed certificates for names from cfg's storage
+// into the cache, so that the first handshakes for those names don't have
+// to wait on storage. If names is empty, all certificates that are in
+// storage for any of cfg's issuers are preloaded, subject to cfg.Preload's
+// Filter. Certificates that are already cached are skipped. Loading stops
+// early if the cache fills up, since preloading more would only evict
+// certificates that were just loaded.
+//
+// Progress is reported with cache_warm_started, cache_warm_progress, and
+// cache_warm_finished events. An error is returned if any certificate
+// could not be loaded, but loading continues for the others.
+//
+// EXPERIMENTAL: Subject to change.
+func (certCache *Cache) Warm(ctx context.Context, cfg *Config, names []string) error {
+	if cfg.certCache != certCache {
+		return fmt.Errorf("config is not associated with this cache")
+	}
+
+	concurrency, filter := defaultPreloadConcurrency, func(string) bool { return true }
+	if cfg.Preload != nil {
+		if cfg.Preload.Concurrency > 0 {
+			concurrency = cfg.Preload.Concurrency
+		}
+		if cfg.Preload.Filter != nil && len(names) == 0 {
+			filter = cfg.Preload.Filter
+		}
+	}
+
+	// each job yields the name of a certificate to load; when we're
+	// discovering names, the job has to look up the name in storage
+	var jobs []func(context.Context) (string, error)
+	if len(names) > 0 {
+		for _, name := range names {
+			jobs = append(jobs, func(context.Context) (string, error) { return name, nil })
+		}
+	} else {
+		siteKeys, err := cfg.storedSiteKeys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, siteKey := range siteKeys {
+			jobs = append(jobs, func(ctx context.Context) (string, error) {
+				return cfg.storedSiteName(ctx, siteKey)
+			})
+		}
+	}
+
+	log := cfg.Logger.Named("cache_warm")
+	start := time.Now()
+	cfg.emit(ctx, "cache_warm_started", map[string]any{"total": len(jobs)})
+
+	var loaded, skipped, failed atomic.Int64
+	var firstErr error
+	var firstErrOnce sync.Once
+	fail := func(name string, err error) {
+		failed.Add(1)
+		firstErrOnce.Do(func() { firstErr = fmt.Errorf("%s: %w", name, err) })
+		log.Error("unable to preload certificate", zap.String("identifier", name), zap.Error(err))
+	}
+
+	certCache.optionsMu.RLock()
+	capacity := certCache.options.Capacity
+	certCache.optionsMu.RUnlock()
+
+	var seen sync.Map // names may be stored for more than one issuer
+	var wg sync.WaitGroup
+	throttle := make(chan struct{}, concurrency)
+	for i, job := range jobs {
+		if capacity > 0 && certCache.cache.len() >= capacity {
+			log.Warn("cache is full; not preloading any more certificates",
+				zap.Int("cache_capacity", capacity),
+				zap.Int("remaining", len(jobs)-i))
+			break
+		}
+		select {
+		case throttle <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-throttle
+				wg.Done()
+				if done := loaded.Load() + skipped.Load() + failed.Load(); done%warmProgressInterval == 0 {
+					cfg.emit(ctx, "cache_warm_progress", map[string]any{
+						"total":   len(jobs),
+						"done":    done,
+						"loaded":  loaded.Load(),
+						"skipped": skipped.Load(),
+						"failed":  failed.Load(),
+					})
+				}
+			}()
+
+			name, err := job(ctx)
+			if err != nil {
+				fail(name, err)
+				return
+			}
+			if _, dup := seen.LoadOrStore(name, struct{}{}); dup || !filter(name) || certCache.hasManagedCertificate(name) {
+				skipped.Add(1)
+				return
+			}
+			if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+				fail(name, err)
+				return
+			}
+			loaded.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	cfg.emit(ctx, "cache_warm_finished", map[string]any{
+		"total":   len(jobs),
+		"loaded":  loaded.Load(),
+		"skipped": skipped.Load(),
+		"failed":  failed.Load(),
+		"elapsed": time.Since(start),
+	})
+	log.Info("preloaded certificates into cache",
+		zap.Int64("loaded", loaded.Load()),
+		zap.Int64("skipped", skipped.Load()),
+		zap.Int64("failed", failed.Load()),
+		zap.Duration("elapsed", time.Since(start)))
+
+	if firstErr != nil {
+		return fmt.Errorf("%d certificate(s) could not be preloaded; first error: %w", failed.Load(), firstErr)
+	}
+	return nil
+}
+
+// hasManagedCertificate returns true if a managed certificate
+// for exactly name is in the cache.
+func (certCache *Cache) hasManagedCertificate(name string) bool {
+	for _, cert := range certCache.getAllMatchingCerts(name) {
+		if cert.managed {
+			return true
+		}
+	}
+	return false
+}
+
+// preload warms the cache according to cfg.Preload. It stops
+// early if the cache is stopped or cfg.Context is canceled.
+func (cfg *Config) preload() {
+	ctx, cancel := context.WithCancel(cfg.parentContext())
+	defer cancel()
+	go func() {
+		select {
+		case <-cfg.certCache.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := cfg.certCache.Warm(ctx, cfg, nil); err != nil && !errors.Is(err, context.Canceled) {
+		cfg.Logger.Error("preloading certificates", zap.Error(err))
+	}
+}
+
+// storedSiteKeys returns the storage key prefixes of all the sites
+// that have certificates in storage for any of cfg's issuers.
+func (cfg *Config) storedSiteKeys(ctx context.Context) ([]string, error) {
+	var siteKeys []string
+	for _, issuer := range cfg.allIssuers() {
+		keys, err := cfg.Storage.List(ctx, StorageKeys.CertsPrefix(issuer.IssuerKey()), false)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing certificates from issuer %s: %v", issuer.IssuerKey(), err)
+		}
+		siteKeys = append(siteKeys, keys...)
+	}
+	return siteKeys, nil
+}
+
+// storedSiteName returns the name of the certificate stored under
+// siteKey. Site keys are sanitized names, so they can't simply be
+// converted back; the name is obtained from the metadata instead.
+func (cfg *Config) storedSiteName(ctx context.Context, siteKey string) (string, error) {
+	metaBytes, err := cfg.Storage.Load(ctx, path.Join(siteKey, path.Base(siteKey)+".json"))
+	if err != nil {
+		return siteKey, fmt.Errorf("loading certificate metadata: %w", err)
+	}
+	var certRes CertificateResource
+	if err := json.Unmarshal(metaBytes, &certRes); err != nil {
+		return siteKey, fmt.Errorf("decoding certificate metadata: %v", err)
+	}
+	if len(certRes.SANs) == 0 {
+		return siteKey, fmt.Errorf("certificate metadata has no names")
+	}
+	return certRes.SANs[0], nil
+}
+
+const (
+	defaultPreloadConcurrency = 8
+	warmProgressInterval      = 100
+)
@@ -0,0 +1,136 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheWarm(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp(os.TempDir(), "certmagic*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	am := &ACMEIssuer{CA: "https://example.com/acme/directory"}
+	storage := &FileStorage{Path: tmpDir}
+
+	// put some certificates in storage using one cache...
+	setupCfg := &Config{
+		Issuers:   []Issuer{am},
+		Storage:   storage,
+		Logger:    defaultTestLogger,
+		OCSP:      OCSPConfig{DisableStapling: true},
+		certCache: NewCache(CacheOptions{GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil }}),
+	}
+	defer setupCfg.certCache.Stop()
+	am.config = setupCfg
+	for _, name := range []string{"a.example.com", "b.example.com", "skip.example.com", "*.example.net"} {
+		certPEM, keyPEM := mustGenerateTestCert(t, []string{name}, time.Now().Add(24*time.Hour))
+		if _, err := setupCfg.AdoptCertificate(ctx, certPEM, keyPEM, AdoptOptions{}); err != nil {
+			t.Fatalf("Adopting certificate for %s: %v", name, err)
+		}
+	}
+
+	// ...and warm up a fresh one
+	var mu sync.Mutex
+	events := make(map[string]map[string]any)
+	cfg := &Config{
+		Issuers: []Issuer{am},
+		Storage: storage,
+		Logger:  defaultTestLogger,
+		OCSP:    OCSPConfig{DisableStapling: true},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			mu.Lock()
+			events[event] = data
+			mu.Unlock()
+			return nil
+		},
+		Preload: &CachePreload{
+			Filter:      func(name string) bool { return name != "skip.example.com" },
+			Concurrency: 2,
+		},
+		certCache: NewCache(CacheOptions{GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil }}),
+	}
+	defer cfg.certCache.Stop()
+
+	if err := cfg.certCache.Warm(ctx, cfg, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"a.example.com", "b.example.com", "*.example.net"} {
+		if !cfg.certCache.hasManagedCertificate(name) {
+			t.Errorf("Expected %s to be preloaded", name)
+		}
+	}
+	if cfg.certCache.hasManagedCertificate("skip.example.com") {
+		t.Error("Expected filtered name to not be preloaded")
+	}
+	if finished := events["cache_warm_finished"]; finished == nil {
+		t.Error("Expected cache_warm_finished event")
+	} else if finished["loaded"] != int64(3) || finished["skipped"] != int64(1) || finished["failed"] != int64(0) {
+		t.Errorf("Unexpected counts in cache_warm_finished event: %v", finished)
+	}
+
+	// explicit names are not filtered, and missing ones are reported
+	err = cfg.certCache.Warm(ctx, cfg, []string{"a.example.com", "skip.example.com", "missing.example.com"})
+	if err == nil {
+		t.Error("Expected error preloading a certificate that is not in storage")
+	}
+	if !cfg.certCache.hasManagedCertificate("skip.example.com") {
+		t.Error("Expected explicitly-named certificate to be preloaded")
+	}
+	if finished := events["cache_warm_finished"]; finished["loaded"] != int64(1) || finished["skipped"] != int64(1) || finished["failed"] != int64(1) {
+		t.Errorf("Unexpected counts in cache_warm_finished event: %v", finished)
+	}
+}
+
+// blockingListStorage blocks listing until the context is done.
+type blockingListStorage struct{ *FileStorage }
+
+func (s blockingListStorage) List(ctx context.Context, _ string, _ bool) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestPreloadStopsWithConfigContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := &Config{
+		Context:   ctx,
+		Issuers:   []Issuer{&ACMEIssuer{CA: "https://example.com/acme/directory"}},
+		Storage:   blockingListStorage{&FileStorage{Path: t.TempDir()}},
+		Logger:    defaultTestLogger,
+		Preload:   &CachePreload{},
+		certCache: NewCache(CacheOptions{GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil }}),
+	}
+	defer cfg.certCache.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		cfg.preload()
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected preload to stop when the config's context is canceled")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventWebhook posts events as JSON to a URL, so that operators can be
+// alerted about certificate problems without writing event handlers.
+// Use its OnEvent method as (or call it from) Config.OnEvent:
+//
+//	hook := &certmagic.EventWebhook{URL: "https://alerts.example.com/certs", Secret: secret}
+//	cfg := certmagic.NewDefault()
+//	cfg.OnEvent = hook.OnEvent
+//
+// Events are posted in the background, so they never delay certificate
+// operations, and retried with exponential backoff if the endpoint
+// fails or doesn't respond with a 2xx status. The request body is
+//
+//	{"event": "cert_failed", "time": "...", "data": {...}}
+//
+// where data is the event's data, with values that can't be encoded
+// as JSON (and certificates, which may contain private keys) left out,
+// and errors written as strings.
+//
+// EXPERIMENTAL: Subject to change.
+type EventWebhook struct {
+	// The URL to post events to. REQUIRED.
+	URL string
+
+	// If set, requests are signed with HMAC-SHA256 using this
+	// secret: the Certmagic-Signature header is the hex-encoded
+	// signature of the Certmagic-Timestamp header (Unix seconds),
+	// a period, and the body. Receivers should verify it and
+	// reject old timestamps to prevent replays.
+	Secret []byte
+
+	// The events to post. Default: DefaultWebhookEvents.
+	Events []string
+
+	// How many times to retry a failed request, and how long
+	// to wait before the first retry; the wait doubles with
+	// every retry. Default: 5 retries, 1 second.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// The HTTP client to post with. Default: a client with
+	// a 30-second timeout.
+	HTTPClient *http.Client
+
+	// If set, events are passed on to this function, and its
+	// result is returned.
+	Next func(ctx context.Context, event string, data map[string]any) error
+
+	// Optional logger.
+	Logger *zap.Logger
+}
+
+// DefaultWebhookEvents are the events an EventWebhook posts by default.
+var DefaultWebhookEvents = []string{
+	"cert_obtained",
+	"cert_failed",
+	"cert_expiring_unrenewable",
+	"ocsp_unavailable",
+	"storage_error",
+}
+
+// OnEvent posts the event in the background if it is one of the
+// configured events.
+func (wh *EventWebhook) OnEvent(ctx context.Context, event string, data map[string]any) error {
+	events := wh.Events
+	if len(events) == 0 {
+		events = DefaultWebhookEvents
+	}
+	if slices.Contains(events, event) {
+		body, err := json.Marshal(webhookPayload{
+			Event: event,
+			Time:  time.Now().UTC(),
+			Data:  webhookData(data),
+		})
+		if err != nil {
+			wh.logger().Error("encoding webhook payload", zap.String("event", event), zap.Error(err))
+		} else {
+			go wh.post(context.WithoutCancel(ctx), event, body)
+		}
+	}
+	if wh.Next != nil {
+		return wh.Next(ctx, event, data)
+	}
+	return nil
+}
+
+// post posts body, retrying with backoff until it succeeds or the
+// retries are exhausted.
+func (wh *EventWebhook) post(ctx context.Context, event string, body []byte) {
+	maxRetries := wh.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 5
+	}
+	backoff := wh.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = wh.send(ctx, body); err == nil {
+			return
+		}
+		wh.logger().Warn("posting event to webhook failed",
+			zap.String("event", event),
+			zap.Int("attempt", attempt+1),
+			zap.Error(err))
+	}
+	wh.logger().Error("giving up posting event to webhook",
+		zap.String("event", event),
+		zap.String("url", wh.URL),
+		zap.Error(err))
+}
+
+func (wh *EventWebhook) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CertMagic")
+	if len(wh.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Certmagic-Timestamp", timestamp)
+		req.Header.Set("Certmagic-Signature", webhookSignature(wh.Secret, timestamp, body))
+	}
+
+	resp, err := httpClientFor(ctx, wh.HTTPClient, 30*time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (wh *EventWebhook) logger() *zap.Logger {
+	if wh.Logger != nil {
+		return wh.Logger
+	}
+	return defaultLogger
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of the
+// timestamp, a period, and body.
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookPayload struct {
+	Event string         `json:"event"`
+	Time  time.Time      `json:"time"`
+	Data  map[string]any `json:"data"`
+}
+
+// webhookData returns a copy of data that can be safely encoded as JSON.
+func webhookData(data map[string]any) map[string]any {
+	safe := make(map[string]any, len(data))
+	for key, val := range data {
+		switch v := val.(type) {
+		case Certificate, *Certificate, tls.Certificate, *tls.Certificate:
+			continue // may contain the private key
+		case error:
+			safe[key] = v.Error()
+		case []byte:
+			safe[key] = string(v)
+		case time.Duration:
+			safe[key] = v.String()
+		default:
+			if _, err := json.Marshal(v); err != nil {
+				continue
+			}
+			safe[key] = v
+		}
+	}
+	return safe
+}
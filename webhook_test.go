@@ -0,0 +1,92 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventWebhook(t *testing.T) {
+	secret := []byte("s3cret")
+	var attempts atomic.Int32
+	received := make(chan webhookPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Certmagic-Signature") != webhookSignature(secret, r.Header.Get("Certmagic-Timestamp"), body) {
+			t.Error("Invalid signature")
+		}
+		// fail the first attempt, to be retried
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		received <- payload
+	}))
+	defer srv.Close()
+
+	var nextEvents []string
+	hook := &EventWebhook{
+		URL:          srv.URL,
+		Secret:       secret,
+		RetryBackoff: time.Millisecond,
+		Logger:       defaultTestLogger,
+		Next: func(_ context.Context, event string, _ map[string]any) error {
+			nextEvents = append(nextEvents, event)
+			return nil
+		},
+	}
+
+	ctx := context.Background()
+	hook.OnEvent(ctx, "cert_obtaining", map[string]any{"identifier": "example.com"})
+	hook.OnEvent(ctx, "cert_failed", map[string]any{
+		"identifier":  "example.com",
+		"error":       errors.New("CA is down"),
+		"remaining":   time.Hour,
+		"certificate": Certificate{},
+	})
+
+	select {
+	case payload := <-received:
+		if payload.Event != "cert_failed" || payload.Data["identifier"] != "example.com" {
+			t.Errorf("Unexpected payload: %+v", payload)
+		}
+		if payload.Data["error"] != "CA is down" || payload.Data["remaining"] != "1h0m0s" {
+			t.Errorf("Expected error and duration as strings, got %+v", payload.Data)
+		}
+		if _, ok := payload.Data["certificate"]; ok {
+			t.Error("Expected certificate to be left out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("Expected only the configured event to be posted, after one retry; got %d attempts", n)
+	}
+	if len(nextEvents) != 2 {
+		t.Errorf("Expected all events to be passed on, got %v", nextEvents)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -65,13 +66,22 @@ type ZeroSSLIssuer struct {
 	// Delay between poll attempts.
 	PollInterval time.Duration
 
+	// The HTTP or SOCKS5 proxy to use for API requests
+	// (and OCSP), and optionally how to authenticate to
+	// it. Default: http.ProxyFromEnvironment,
+	// unauthenticated; use NoProxy to ignore the
+	// environment.
+	// EXPERIMENTAL: Subject to change.
+	HTTPProxy          func(*http.Request) (*url.URL, error)
+	ProxyAuthenticator ProxyAuthenticator
+
 	// An optional (but highly recommended) logger.
 	Logger *zap.Logger
 }
 
 // Issue obtains a certificate for the given csr.
 func (iss *ZeroSSLIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
-	client := iss.getClient()
+	client := iss.getClient(ctx)
 
 	identifiers := namesFromCSR(csr)
 	if len(identifiers) == 0 {
@@ -237,8 +247,21 @@ func (iss *ZeroSSLIssuer) pollInterval() time.Duration {
 	return iss.PollInterval
 }
 
-func (iss *ZeroSSLIssuer) getClient() zerossl.Client {
-	return zerossl.Client{AccessKey: iss.APIKey}
+func (iss *ZeroSSLIssuer) getClient(ctx context.Context) zerossl.Client {
+	client := zerossl.Client{AccessKey: iss.APIKey}
+	if iss.HTTPProxy != nil || iss.ProxyAuthenticator != nil {
+		client.HTTPClient = &http.Client{
+			Transport: proxyTransport(iss.HTTPProxy, iss.ProxyAuthenticator),
+			Timeout:   HTTPTimeout,
+		}
+	} else if cfg, ok := ctx.Value(ctxKeyConfig).(*Config); ok && cfg != nil {
+		client.HTTPClient = cfg.HTTPClient
+	}
+	return client
+}
+
+func (iss *ZeroSSLIssuer) proxy() (func(*http.Request) (*url.URL, error), ProxyAuthenticator) {
+	return iss.HTTPProxy, iss.ProxyAuthenticator
 }
 
 func (iss *ZeroSSLIssuer) getHTTPPort() int {
@@ -277,7 +300,7 @@ func (iss *ZeroSSLIssuer) Revoke(ctx context.Context, cert CertificateResource,
 	if err := json.Unmarshal(cert.IssuerData, &certObj); err != nil {
 		return err
 	}
-	return iss.getClient().RevokeCertificate(ctx, certObj.ID, r)
+	return iss.getClient(ctx).RevokeCertificate(ctx, certObj.ID, r)
 }
 
 func (iss *ZeroSSLIssuer) getDistributedValidationInfo(ctx context.Context, identifier string) (acme.Challenge, bool, error) {
@@ -317,6 +340,7 @@ const (
 
 // Interface guards
 var (
-	_ Issuer  = (*ZeroSSLIssuer)(nil)
-	_ Revoker = (*ZeroSSLIssuer)(nil)
+	_ Issuer        = (*ZeroSSLIssuer)(nil)
+	_ Revoker       = (*ZeroSSLIssuer)(nil)
+	_ proxiedIssuer = (*ZeroSSLIssuer)(nil)
 )